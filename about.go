@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	ed "github.com/agl/ed25519"
+	"github.com/rakoo/rakoshare/pkg/id"
+	"github.com/rakoo/rakoshare/pkg/sharesession"
+	"github.com/zeebo/bencode"
+)
+
+// The setting where the last signed description of the share is kept
+const settingAbout = "about"
+
+// Limits of a description, so that it stays a small control message
+const (
+	maxAboutFields      = 32
+	maxAboutKeyLength   = 64
+	maxAboutValueLength = 1024
+)
+
+// Fields shown first, in this order; any other key is allowed
+var aboutWellKnown = []string{"name", "description", "contact"}
+
+var errAboutTooLarge = errors.New("share description too large")
+
+// ShareAbout describes a share to the devices that join it: a display
+// name, a description, how to contact its owner... Writers set it; the
+// one with the highest version wins.
+type ShareAbout struct {
+	Fields  map[string]string `bencode:"fields"`
+	Version int64             `bencode:"version"`
+}
+
+// AboutMessage is the payload of the bs_about extension: a description
+// signed by a writer of the share.
+type AboutMessage struct {
+	About ShareAbout `bencode:"about"`
+	Sig   string     `bencode:"sig"`
+}
+
+func checkAbout(a ShareAbout) error {
+	if len(a.Fields) > maxAboutFields {
+		return errAboutTooLarge
+	}
+	for k, v := range a.Fields {
+		if k == "" || len(k) > maxAboutKeyLength || len(v) > maxAboutValueLength {
+			return errAboutTooLarge
+		}
+	}
+	return nil
+}
+
+func signAbout(a ShareAbout, priv id.PrivKey) (msg AboutMessage, err error) {
+	var buf bytes.Buffer
+	err = bencode.NewEncoder(&buf).Encode(a)
+	if err != nil {
+		return
+	}
+
+	var privarg [ed.PrivateKeySize]byte
+	copy(privarg[:], priv[:])
+	sig := ed.Sign(&privarg, buf.Bytes())
+
+	return AboutMessage{About: a, Sig: string(sig[:])}, nil
+}
+
+func verifyAbout(msg AboutMessage, pubKey id.PubKey) error {
+	if err := checkAbout(msg.About); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	err := bencode.NewEncoder(&buf).Encode(msg.About)
+	if err != nil {
+		return err
+	}
+
+	pub := [ed.PublicKeySize]byte(pubKey)
+	var sig [ed.SignatureSize]byte
+	copy(sig[:], msg.Sig)
+	if !ed.Verify(&pub, buf.Bytes(), &sig) {
+		return errors.New("Bad Signature")
+	}
+	return nil
+}
+
+// storedAbout returns the last signed description of the share we know
+// of.
+func storedAbout(session *sharesession.Session) (msg AboutMessage, ok bool) {
+	raw := session.GetSetting(settingAbout)
+	if raw == "" {
+		return
+	}
+	err := bencode.NewDecoder(strings.NewReader(raw)).Decode(&msg)
+	return msg, err == nil
+}
+
+func saveAbout(session *sharesession.Session, msg AboutMessage) error {
+	var buf bytes.Buffer
+	err := bencode.NewEncoder(&buf).Encode(msg)
+	if err != nil {
+		return err
+	}
+	return session.SetSetting(settingAbout, buf.String())
+}
+
+// aboutKeys returns the keys of fields, well-known ones first.
+func aboutKeys(fields map[string]string) []string {
+	var keys, others []string
+	for _, k := range aboutWellKnown {
+		if _, ok := fields[k]; ok {
+			keys = append(keys, k)
+		}
+	}
+	for k := range fields {
+		if !isWellKnownAbout(k) {
+			others = append(others, k)
+		}
+	}
+	sort.Strings(others)
+	return append(keys, others...)
+}
+
+func isWellKnownAbout(key string) bool {
+	for _, k := range aboutWellKnown {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+func printAbout(fields map[string]string) {
+	for _, k := range aboutKeys(fields) {
+		fmt.Println(T(msgAboutField, k, fields[k]))
+	}
+}
+
+// About changes the description of a share with set, a list of
+// key=value, and unset, a list of keys, then prints it. Only writers can
+// change it; running shares send it to their peers shortly after.
+func About(cliId string, workDir string, set, unset []string) error {
+	shareID, err := id.NewFromString(cliId)
+	if err != nil {
+		return newUserError(msgBadID, err)
+	}
+	session, err := openSession(workDir, shareID)
+	if err != nil {
+		return newUserError(msgOpenSession, err)
+	}
+
+	msg, _ := storedAbout(session)
+	if len(set) == 0 && len(unset) == 0 {
+		printAbout(msg.About.Fields)
+		return nil
+	}
+	if !shareID.CanWrite() {
+		return newUserError(msgAboutNeedsWrite)
+	}
+
+	fields := make(map[string]string)
+	for k, v := range msg.About.Fields {
+		fields[k] = v
+	}
+	for _, kv := range set {
+		i := strings.Index(kv, "=")
+		if i <= 0 {
+			return newUserError(msgInvalidAbout, kv)
+		}
+		fields[kv[:i]] = kv[i+1:]
+	}
+	for _, k := range unset {
+		delete(fields, k)
+	}
+
+	about := ShareAbout{Fields: fields, Version: time.Now().UnixNano()}
+	if about.Version <= msg.About.Version {
+		about.Version = msg.About.Version + 1
+	}
+	if err := checkAbout(about); err != nil {
+		return newUserError(msgInvalidAbout, err)
+	}
+	msg, err = signAbout(about, shareID.Priv)
+	if err != nil {
+		return err
+	}
+	if err := saveAbout(session, msg); err != nil {
+		return err
+	}
+	printAbout(fields)
+	return nil
+}
+
+// sendAbout sends p the description of the share, if we have one.
+func (cs *ControlSession) sendAbout(p *peerState) {
+	if _, ok := p.theirExtensions["bs_about"]; !ok {
+		return
+	}
+	if msg, ok := storedAbout(cs.session); ok {
+		p.sendExtensionMessage("bs_about", msg)
+	}
+}
+
+// broadcastAbout sends the description of the share to all peers, when a
+// newer one than the last sent appeared.
+func (cs *ControlSession) broadcastAbout() {
+	msg, ok := storedAbout(cs.session)
+	if !ok || msg.About.Version <= cs.aboutVersion {
+		return
+	}
+	cs.aboutVersion = msg.About.Version
+	for _, p := range cs.peers.All() {
+		cs.sendAbout(p)
+	}
+}
+
+func (cs *ControlSession) DoAbout(msg []byte, p *peerState) (err error) {
+	var message AboutMessage
+	err = bencode.NewDecoder(bytes.NewReader(msg)).Decode(&message)
+	if err != nil {
+		cs.log("Couldn't decode about message: ", err)
+		return
+	}
+	if !cs.ID.CanRead() {
+		// We can't check it
+		return
+	}
+	err = verifyAbout(message, cs.ID.Pub)
+	if err != nil {
+		return
+	}
+	if stored, ok := storedAbout(cs.session); ok && stored.About.Version >= message.About.Version {
+		return
+	}
+	err = saveAbout(cs.session, message)
+	if err != nil {
+		cs.log("Couldn't save share description: ", err)
+		return nil
+	}
+	cs.broadcastAbout()
+	return
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	ed "github.com/agl/ed25519"
+	"github.com/rakoo/rakoshare/pkg/id"
+)
+
+func TestAboutSignature(t *testing.T) {
+	pub, priv, err := ed.GenerateKey(bytes.NewReader(make([]byte, 64)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	about := ShareAbout{
+		Fields:  map[string]string{"name": "Holidays", "contact": "someone@example.com"},
+		Version: 1,
+	}
+	msg, err := signAbout(about, id.PrivKey(*priv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyAbout(msg, id.PubKey(*pub)); err != nil {
+		t.Fatal("Couldn't verify a valid description: ", err)
+	}
+
+	msg.About.Fields["name"] = "Something else"
+	if err := verifyAbout(msg, id.PubKey(*pub)); err == nil {
+		t.Fatal("A tampered description shouldn't verify")
+	}
+}
+
+func TestCheckAbout(t *testing.T) {
+	fields := map[string]string{"name": strings.Repeat("a", maxAboutValueLength)}
+	if err := checkAbout(ShareAbout{Fields: fields}); err != nil {
+		t.Errorf("Expected a description within the limits to be valid, got %s", err)
+	}
+	fields["description"] = strings.Repeat("a", maxAboutValueLength+1)
+	if err := checkAbout(ShareAbout{Fields: fields}); err != errAboutTooLarge {
+		t.Errorf("Expected a long value to be refused, got %v", err)
+	}
+
+	fields = make(map[string]string)
+	for i := 0; i <= maxAboutFields; i++ {
+		fields[strings.Repeat("k", i+1)] = ""
+	}
+	if err := checkAbout(ShareAbout{Fields: fields}); err != errAboutTooLarge {
+		t.Errorf("Expected too many fields to be refused, got %v", err)
+	}
+}
+
+func TestAboutKeys(t *testing.T) {
+	fields := map[string]string{
+		"website":     "",
+		"contact":     "",
+		"license":     "",
+		"name":        "",
+		"description": "",
+	}
+	expected := []string{"name", "description", "contact", "license", "website"}
+	if keys := aboutKeys(fields); !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Expected %v, got %v", expected, keys)
+	}
+}
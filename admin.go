@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	ed "github.com/agl/ed25519"
+	"github.com/rakoo/rakoshare/pkg/id"
+	"github.com/zeebo/bencode"
+)
+
+// A writer of a share can manage the other devices of the share, such as
+// a NAS replica, over the control connections: pause or resume their
+// transfers, make them scan their folder or ask for their status.
+// Commands are signed with the key of the share, so that readers can
+// check them without being able to send any; devices only obey them when
+// their config allows it. Every device that obeys replies with its
+// status.
+
+const (
+	adminStatus = "status"
+	adminRescan = apiRescan
+	adminReply  = "reply"
+)
+
+// Commands older than that, or from that far in the future, are refused
+const adminMaxAge = 5 * time.Minute
+
+var (
+	errAdminNeedsWrite = errors.New("admin commands need the WriteReadStore id")
+	errAdminUnknown    = errors.New("unknown admin command")
+	errAdminReplayed   = errors.New("admin command expired or replayed")
+)
+
+// AdminMessage is the payload of the bs_admin extension. Commands are
+// signed; replies carry the status of the device in JSON.
+type AdminMessage struct {
+	Command string `bencode:"command"`
+	Time    int64  `bencode:"time"`
+	Nonce   string `bencode:"nonce"`
+	Sig     string `bencode:"sig,omitempty"`
+	Status  string `bencode:"status,omitempty"`
+}
+
+// adminRequest is a verified command for the main loop.
+type adminRequest struct {
+	command string
+	nonce   string
+	peer    *peerState
+}
+
+// adminOutgoing is a message for the main loop of the control session to
+// send: a command to the peers at addr, or to all if addr is empty, or a
+// reply to peer.
+type adminOutgoing struct {
+	msg  AdminMessage
+	addr string
+	peer *peerState
+}
+
+// RemoteStatus is the reply of a device to an admin command.
+type RemoteStatus struct {
+	Peer   string      `json:"peer"`
+	Status ShareStatus `json:"status"`
+}
+
+func validAdminCommand(command string) bool {
+	switch command {
+	case apiPause, apiResume, adminRescan, adminStatus:
+		return true
+	}
+	return false
+}
+
+func signedAdminBytes(msg AdminMessage) ([]byte, error) {
+	msg.Sig = ""
+	msg.Status = ""
+	var buf bytes.Buffer
+	err := bencode.NewEncoder(&buf).Encode(msg)
+	return buf.Bytes(), err
+}
+
+func newAdminCommand(command string, now time.Time, priv id.PrivKey) (msg AdminMessage, err error) {
+	nonce := make([]byte, 16)
+	if _, err = rand.Read(nonce); err != nil {
+		return
+	}
+	msg = AdminMessage{Command: command, Time: now.Unix(), Nonce: hex.EncodeToString(nonce)}
+	signed, err := signedAdminBytes(msg)
+	if err != nil {
+		return
+	}
+
+	var privarg [ed.PrivateKeySize]byte
+	copy(privarg[:], priv[:])
+	sig := ed.Sign(&privarg, signed)
+	msg.Sig = string(sig[:])
+	return
+}
+
+func verifyAdminCommand(msg AdminMessage, pubKey id.PubKey) error {
+	if !validAdminCommand(msg.Command) {
+		return errAdminUnknown
+	}
+	signed, err := signedAdminBytes(msg)
+	if err != nil {
+		return err
+	}
+
+	pub := [ed.PublicKeySize]byte(pubKey)
+	var sig [ed.SignatureSize]byte
+	copy(sig[:], msg.Sig)
+	if !ed.Verify(&pub, signed, &sig) {
+		return errors.New("Bad Signature")
+	}
+	return nil
+}
+
+// adminNonces remembers the commands seen recently, so that a command
+// captured on the network can't be played again.
+type adminNonces struct {
+	sync.Mutex
+	seen map[string]time.Time
+}
+
+func newAdminNonces() *adminNonces {
+	return &adminNonces{seen: make(map[string]time.Time)}
+}
+
+// fresh tells whether the command is recent and wasn't seen yet, and
+// records it.
+func (n *adminNonces) fresh(msg AdminMessage, now time.Time) bool {
+	at := time.Unix(msg.Time, 0)
+	if at.Before(now.Add(-adminMaxAge)) || at.After(now.Add(adminMaxAge)) {
+		return false
+	}
+
+	n.Lock()
+	defer n.Unlock()
+	for nonce, seen := range n.seen {
+		if now.Sub(seen) > 2*adminMaxAge {
+			delete(n.seen, nonce)
+		}
+	}
+	if _, ok := n.seen[msg.Nonce]; ok {
+		return false
+	}
+	n.seen[msg.Nonce] = now
+	return true
+}
+
+// adminWaiters are the commands we sent and whose replies we wait for,
+// by nonce.
+type adminWaiters struct {
+	sync.Mutex
+	replies map[string]chan RemoteStatus
+}
+
+func newAdminWaiters() *adminWaiters {
+	return &adminWaiters{replies: make(map[string]chan RemoteStatus)}
+}
+
+func (w *adminWaiters) add(nonce string) chan RemoteStatus {
+	c := make(chan RemoteStatus, 16)
+	w.Lock()
+	w.replies[nonce] = c
+	w.Unlock()
+	return c
+}
+
+func (w *adminWaiters) remove(nonce string) {
+	w.Lock()
+	delete(w.replies, nonce)
+	w.Unlock()
+}
+
+// deliver passes a reply to whoever waits for it; replies nobody waits
+// for anymore are dropped.
+func (w *adminWaiters) deliver(nonce string, reply RemoteStatus) {
+	w.Lock()
+	defer w.Unlock()
+	if c, ok := w.replies[nonce]; ok {
+		select {
+		case c <- reply:
+		default:
+		}
+	}
+}
+
+// Admin sends command to the devices of the share through the running
+// share, and prints their replies.
+func Admin(cliId, workDir, command, peer string, wait time.Duration) error {
+	shareID, err := id.NewFromString(cliId)
+	if err != nil {
+		return newUserError(msgBadID, err)
+	}
+	if !shareID.CanWrite() {
+		return newUserError(msgAdminNeedsWrite)
+	}
+	if !validAdminCommand(command) {
+		return newUserError(msgAdminUnknown, command)
+	}
+	session, err := openSession(workDir, shareID)
+	if err != nil {
+		return newUserError(msgOpenSession, err)
+	}
+	addr := session.GetSetting(settingAPI)
+	if addr == "" {
+		return newUserError(msgShareNotRunning)
+	}
+
+	client := &http.Client{Timeout: wait + 10*time.Second}
+	statuses, err := sendAdminCommand(client, addr, command, peer, wait)
+	if err != nil {
+		return err
+	}
+	if len(statuses) == 0 {
+		fmt.Println(T(msgAdminNoReply))
+	}
+	for _, s := range statuses {
+		state := T(msgTopRunning)
+		if s.Status.Paused {
+			state = T(msgTopPaused)
+		}
+		fmt.Println(T(msgAdminReply, s.Peer, s.Status.Folder, state, s.Status.Peers, s.Status.Revision))
+	}
+	return nil
+}
+
+// RemoteCommand signs command, sends it to the control peers, or only to
+// those at peer if it isn't empty, and returns the replies received
+// within wait.
+func (cs *ControlSession) RemoteCommand(command, peer string, wait time.Duration) ([]RemoteStatus, error) {
+	if !cs.ID.CanWrite() {
+		return nil, errAdminNeedsWrite
+	}
+	if !validAdminCommand(command) {
+		return nil, errAdminUnknown
+	}
+	msg, err := newAdminCommand(command, time.Now(), cs.ID.Priv)
+	if err != nil {
+		return nil, err
+	}
+
+	replies := cs.adminWaiters.add(msg.Nonce)
+	defer cs.adminWaiters.remove(msg.Nonce)
+	select {
+	case cs.adminOut <- adminOutgoing{msg: msg, addr: peer}:
+	case <-cs.done:
+		return nil, nil
+	}
+
+	var statuses []RemoteStatus
+	timeout := time.After(wait)
+	for {
+		select {
+		case reply := <-replies:
+			statuses = append(statuses, reply)
+		case <-timeout:
+			return statuses, nil
+		}
+	}
+}
+
+// ReplyAdmin sends our status to the device that sent req.
+func (cs *ControlSession) ReplyAdmin(req adminRequest, status ShareStatus) {
+	encoded, err := json.Marshal(status)
+	if err != nil {
+		cs.log("Couldn't encode status: ", err)
+		return
+	}
+	reply := AdminMessage{
+		Command: adminReply,
+		Time:    time.Now().Unix(),
+		Nonce:   req.nonce,
+		Status:  string(encoded),
+	}
+	// The main loop may be waiting for ours
+	go func() {
+		select {
+		case cs.adminOut <- adminOutgoing{msg: reply, peer: req.peer}:
+		case <-cs.done:
+		}
+	}()
+}
+
+// sendAdmin sends an outgoing admin message. Only the main loop calls
+// it.
+func (cs *ControlSession) sendAdmin(out adminOutgoing) {
+	for _, p := range cs.peers.All() {
+		if out.peer == p || out.peer == nil && (out.addr == "" || p.address == out.addr || peerHost(p.address) == out.addr) {
+			p.sendExtensionMessage("bs_admin", out.msg)
+		}
+	}
+}
+
+func (cs *ControlSession) DoAdmin(msg []byte, p *peerState) (err error) {
+	var message AdminMessage
+	err = bencode.NewDecoder(bytes.NewReader(msg)).Decode(&message)
+	if err != nil {
+		cs.log("Couldn't decode admin message: ", err)
+		return
+	}
+
+	if message.Command == adminReply {
+		var status ShareStatus
+		if err := json.Unmarshal([]byte(message.Status), &status); err != nil {
+			cs.log("Couldn't decode admin reply: ", err)
+			return nil
+		}
+		cs.adminWaiters.deliver(message.Nonce, RemoteStatus{Peer: p.address, Status: status})
+		return nil
+	}
+
+	if err := verifyAdminCommand(message, cs.ID.Pub); err != nil {
+		cs.log("Refusing admin command from", p.address, ":", err)
+		return nil
+	}
+	if !cs.adminNonces.fresh(message, time.Now()) {
+		cs.log("Refusing admin command from", p.address, ":", errAdminReplayed)
+		return nil
+	}
+
+	select {
+	case cs.Admin <- adminRequest{command: message.Command, nonce: message.Nonce, peer: p}:
+	case <-cs.done:
+	}
+	return nil
+}
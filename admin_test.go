@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	ed "github.com/agl/ed25519"
+	"github.com/rakoo/rakoshare/pkg/id"
+)
+
+func TestAdminSignature(t *testing.T) {
+	pub, priv, err := ed.GenerateKey(bytes.NewReader(make([]byte, 64)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := newAdminCommand(apiPause, time.Now(), id.PrivKey(*priv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyAdminCommand(msg, id.PubKey(*pub)); err != nil {
+		t.Fatal("Couldn't verify a valid command: ", err)
+	}
+
+	tampered := msg
+	tampered.Command = apiResume
+	if err := verifyAdminCommand(tampered, id.PubKey(*pub)); err == nil {
+		t.Error("A tampered command shouldn't verify")
+	}
+	tampered = msg
+	tampered.Command = "format"
+	if err := verifyAdminCommand(tampered, id.PubKey(*pub)); err != errAdminUnknown {
+		t.Errorf("Expected %v, got %v", errAdminUnknown, err)
+	}
+}
+
+func TestAdminNonces(t *testing.T) {
+	now := time.Now()
+	nonces := newAdminNonces()
+	msg := AdminMessage{Command: adminStatus, Time: now.Unix(), Nonce: "a"}
+
+	if !nonces.fresh(msg, now) {
+		t.Fatal("Expected a new command to be fresh")
+	}
+	if nonces.fresh(msg, now.Add(time.Second)) {
+		t.Error("Expected a replayed command to be refused")
+	}
+
+	msg.Nonce = "b"
+	msg.Time = now.Add(-2 * adminMaxAge).Unix()
+	if nonces.fresh(msg, now) {
+		t.Error("Expected an old command to be refused")
+	}
+	msg.Time = now.Add(2 * adminMaxAge).Unix()
+	if nonces.fresh(msg, now) {
+		t.Error("Expected a command from the future to be refused")
+	}
+
+	// Seen nonces are forgotten once their commands expired
+	later := now.Add(3 * adminMaxAge)
+	if !nonces.fresh(AdminMessage{Time: later.Unix(), Nonce: "c"}, later) {
+		t.Error("Expected a new command to be fresh")
+	}
+	if _, ok := nonces.seen["a"]; ok {
+		t.Error("Expected old nonces to be pruned")
+	}
+}
+
+func TestAdminWaiters(t *testing.T) {
+	waiters := newAdminWaiters()
+	replies := waiters.add("a")
+	waiters.deliver("a", RemoteStatus{Peer: "1.2.3.4:5"})
+	waiters.deliver("b", RemoteStatus{Peer: "5.6.7.8:9"})
+
+	select {
+	case reply := <-replies:
+		if reply.Peer != "1.2.3.4:5" {
+			t.Errorf("Expected the reply of 1.2.3.4:5, got %v", reply)
+		}
+	default:
+		t.Fatal("Expected a reply")
+	}
+	select {
+	case reply := <-replies:
+		t.Errorf("Expected no other reply, got %v", reply)
+	default:
+	}
+
+	waiters.remove("a")
+	waiters.deliver("a", RemoteStatus{})
+	if len(waiters.replies) != 0 {
+		t.Error("Expected no waiters left")
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+)
+
+var alertWebhook = flag.String("alertWebhook", "", "If not empty, alerts are POSTed as JSON to this URL")
+
+// An Alert is a condition the user should look at because rakoshare
+// won't resolve it on its own.
+type Alert struct {
+	Kind    string    `json:"kind"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// raiseAlert reports an alert to the user.
+func raiseAlert(kind, format string, args ...interface{}) {
+	a := Alert{
+		Kind:    kind,
+		Message: fmt.Sprintf(format, args...),
+		Time:    time.Now(),
+	}
+	log.Printf("[ALERT] %s: %s\n", a.Kind, a.Message)
+
+	if *alertWebhook != "" {
+		go postAlert(*alertWebhook, a)
+	}
+}
+
+func postAlert(url string, a Alert) {
+	if err := postJSON(url, a); err != nil {
+		log.Println("Couldn't post alert:", err)
+	}
+}
+
+// postJSON POSTs v as JSON to a webhook.
+func postJSON(url string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	client := proxyHttpClient()
+	client.Timeout = 30 * time.Second
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("webhook refused it: %s", resp.Status)
+	}
+	return nil
+}
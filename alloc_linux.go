@@ -0,0 +1,18 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// preallocate reserves length bytes on disk for f.
+func preallocate(f *os.File, length int64) error {
+	if length == 0 {
+		return nil
+	}
+	err := syscall.Fallocate(int(f.Fd()), 0, 0, length)
+	if err == syscall.EOPNOTSUPP {
+		return writeZeros(f, length)
+	}
+	return err
+}
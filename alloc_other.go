@@ -0,0 +1,10 @@
+// +build !linux
+
+package main
+
+import "os"
+
+// preallocate reserves length bytes on disk for f.
+func preallocate(f *os.File, length int64) error {
+	return writeZeros(f, length)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"log"
+	"sync"
+
+	"github.com/rakoo/rakoshare/pkg/sharesession"
+)
+
+// announceQueue holds the torrent announced by peers until the main loop
+// gets to it, so that the control session never waits while a revision
+// is being applied.
+//
+// Peers only get to announce revisions newer than all those we saw, so a
+// new announce supersedes the one waiting: only the newest is kept, and
+// the main loop never gets a torrent whose revision isn't the last one
+// stored. Announces of the same torrent are merged. The queue is saved in
+// the session so that it survives a restart.
+type announceQueue struct {
+	sync.Mutex
+	session *sharesession.Session
+	entries []Announce
+
+	// Signals that entries changed
+	notify chan struct{}
+	out    chan Announce
+	quit   <-chan struct{}
+}
+
+func newAnnounceQueue(session *sharesession.Session, quit <-chan struct{}) *announceQueue {
+	q := &announceQueue{
+		session: session,
+		notify:  make(chan struct{}, 1),
+		out:     make(chan Announce),
+		quit:    quit,
+	}
+
+	infohashes, peers, err := session.GetAnnounces()
+	if err != nil {
+		log.Println("Couldn't load queued announces:", err)
+	}
+	for i := range infohashes {
+		q.entries = append(q.entries, Announce{infohash: infohashes[i], peer: peers[i]})
+	}
+	// Older versions queued several announces
+	if n := len(q.entries); n > 1 {
+		q.supersede(q.entries[n-1].infohash)
+	}
+
+	go q.run()
+	return q
+}
+
+// Push queues an announce in place of the older ones. It never blocks on
+// the consumer.
+func (q *announceQueue) Push(a Announce) {
+	q.Lock()
+	q.supersede(a.infohash)
+	if len(q.entries) == 0 {
+		q.entries = append(q.entries, a)
+	} else {
+		q.entries[0].peer = a.peer
+	}
+	// Saved under the lock, so that the session doesn't get back an
+	// announce removed meanwhile
+	err := q.session.SaveAnnounce(a.infohash, a.peer)
+	if err != nil {
+		log.Println("Couldn't save announce:", err)
+	}
+	q.Unlock()
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// supersede drops the entries of other torrents than infohash. It must be
+// called with the lock held.
+func (q *announceQueue) supersede(infohash string) {
+	kept := q.entries[:0]
+	for _, a := range q.entries {
+		if a.infohash == infohash {
+			kept = append(kept, a)
+			continue
+		}
+		log.Printf("[CONTROL] Dropping the announce of %x, superseded by %x\n", a.infohash, infohash)
+		if err := q.session.DeleteAnnounce(a.infohash); err != nil {
+			log.Println("Couldn't delete announce:", err)
+		}
+	}
+	q.entries = kept
+}
+
+func (q *announceQueue) peek() (a Announce, ok bool) {
+	q.Lock()
+	defer q.Unlock()
+	if len(q.entries) == 0 {
+		return
+	}
+	return q.entries[0], true
+}
+
+func (q *announceQueue) remove(infohash string) {
+	q.Lock()
+	for i := range q.entries {
+		if q.entries[i].infohash == infohash {
+			q.entries = append(q.entries[:i], q.entries[i+1:]...)
+			break
+		}
+	}
+	err := q.session.DeleteAnnounce(infohash)
+	if err != nil {
+		log.Println("Couldn't delete announce:", err)
+	}
+	q.Unlock()
+}
+
+// run hands the waiting announce over to the consumer of out, until quit
+// is closed.
+func (q *announceQueue) run() {
+	for {
+		a, ok := q.peek()
+		if !ok {
+			select {
+			case <-q.notify:
+				continue
+			case <-q.quit:
+				return
+			}
+		}
+
+		select {
+		case q.out <- a:
+			q.remove(a.infohash)
+		case <-q.notify:
+			// The announce may have been superseded meanwhile
+		case <-q.quit:
+			return
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rakoo/rakoshare/pkg/sharesession"
+)
+
+func newTestSession(t *testing.T) (*sharesession.Session, func()) {
+	dir, err := ioutil.TempDir("", "announces")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := sharesession.New(filepath.Join(dir, "session.sql"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return session, func() { os.RemoveAll(dir) }
+}
+
+func queuedAnnounces(t *testing.T, q *announceQueue) []Announce {
+	q.Lock()
+	defer q.Unlock()
+	infohashes, peers, err := q.session.GetAnnounces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored []Announce
+	for i := range infohashes {
+		stored = append(stored, Announce{infohash: infohashes[i], peer: peers[i]})
+	}
+	if !reflect.DeepEqual(stored, q.entries) && len(stored)+len(q.entries) > 0 {
+		t.Fatalf("Stored announces %v differ from the queued ones %v", stored, q.entries)
+	}
+	return stored
+}
+
+func TestAnnounceQueue(t *testing.T) {
+	session, cleanup := newTestSession(t)
+	defer cleanup()
+	quit := make(chan struct{})
+	q := newAnnounceQueue(session, quit)
+
+	// Announces of the same torrent are merged
+	q.Push(Announce{infohash: "a", peer: "192.0.2.1:1"})
+	q.Push(Announce{infohash: "a", peer: "192.0.2.2:2"})
+	if got := queuedAnnounces(t, q); !reflect.DeepEqual(got, []Announce{{infohash: "a", peer: "192.0.2.2:2"}}) {
+		t.Fatalf("Expected the announces to be merged, got %v", got)
+	}
+
+	// A newer announce supersedes the waiting one
+	q.Push(Announce{infohash: "b", peer: "192.0.2.1:1"})
+	if got := queuedAnnounces(t, q); !reflect.DeepEqual(got, []Announce{{infohash: "b", peer: "192.0.2.1:1"}}) {
+		t.Fatalf("Expected only the newest announce, got %v", got)
+	}
+
+	// It survives a restart
+	close(quit)
+	quit = make(chan struct{})
+	defer close(quit)
+	q = newAnnounceQueue(session, quit)
+
+	select {
+	case a := <-q.out:
+		if a.infohash != "b" {
+			t.Errorf("Expected the newest announce, got %v", a)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No announce delivered")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(queuedAnnounces(t, q)) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := queuedAnnounces(t, q); len(got) > 0 {
+		t.Errorf("Expected delivered announces to be removed, got %v", got)
+	}
+}
+
+func TestAnnounceQueueRestoresNewest(t *testing.T) {
+	session, cleanup := newTestSession(t)
+	defer cleanup()
+	// As queued by older versions
+	for _, ih := range []string{"a", "b", "c"} {
+		if err := session.SaveAnnounce(ih, "192.0.2.1:1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	quit := make(chan struct{})
+	defer close(quit)
+	q := newAnnounceQueue(session, quit)
+	select {
+	case a := <-q.out:
+		if a.infohash != "c" {
+			t.Errorf("Expected the newest announce, got %v", a)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No announce delivered")
+	}
+	select {
+	case a := <-q.out:
+		t.Errorf("Expected the older announces to be dropped, got %v", a)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
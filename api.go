@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rakoo/rakoshare/pkg/id"
+	"github.com/rakoo/rakoshare/pkg/sharesession"
+)
+
+// The setting where a running share records the address of its API
+const settingAPI = "api"
+
+// How often the main loop refreshes the status served by the API
+const statusInterval = time.Second
+
+// ShareStatus is what a running share tells about itself
+type ShareStatus struct {
+	Folder       string    `json:"folder"`
+	Revision     string    `json:"revision"`
+	Paused       bool      `json:"paused"`
+	Peers        int       `json:"peers"`
+	ControlPeers int       `json:"controlPeers"`
+	Uploaded     int64     `json:"uploaded"`
+	Downloaded   int64     `json:"downloaded"`
+	ExternalIP   string    `json:"externalIP,omitempty"`
+	Updated      time.Time `json:"updated"`
+
+	// Bytes exchanged since the share was created, across restarts, and
+	// for each of its last revisions, newest first
+	Lifetime  TransferStats       `json:"lifetime"`
+	Revisions []RevisionTransfers `json:"revisions,omitempty"`
+
+	// The description of the share, as set by its writers
+	About map[string]string `json:"about,omitempty"`
+
+	// Copies of local versions of files that a revision from a peer
+	// replaced, since the share started
+	Conflicts []string `json:"conflicts,omitempty"`
+
+	// Progress of the check of the pieces on disk, while it runs
+	Verifying *VerifyProgress `json:"verifying,omitempty"`
+}
+
+const (
+	apiPause  = "pause"
+	apiResume = "resume"
+	apiRescan = "rescan"
+)
+
+// How long the admin endpoint waits for replies by default, and at most
+const (
+	adminWait    = 5 * time.Second
+	maxAdminWait = time.Minute
+)
+
+// remoteCommander sends an admin command to other devices of the share
+// and returns their replies, such as ControlSession.RemoteCommand.
+type remoteCommander func(command, peer string, wait time.Duration) ([]RemoteStatus, error)
+
+// shareAPI lets local tools, such as the top command, look at a running
+// share and pause or resume its transfers, and send admin commands to the
+// other devices of the share. It only listens on the loopback interface.
+type shareAPI struct {
+	sync.Mutex
+	status ShareStatus
+	peers  []PeerStats
+
+	// The check of the pieces of the current revision
+	verifying VerifyProgress
+
+	// Commands for the main loop: apiPause, apiResume or apiRescan
+	commands chan string
+
+	remote remoteCommander
+}
+
+func newShareAPI(session *sharesession.Session, remote remoteCommander) (*shareAPI, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	err = session.SetSetting(settingAPI, listener.Addr().String())
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	api := &shareAPI{commands: make(chan string), remote: remote}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", api.serveStatus)
+	mux.HandleFunc("/peers", api.servePeers)
+	mux.HandleFunc("/"+apiPause, api.serveCommand(apiPause))
+	mux.HandleFunc("/"+apiResume, api.serveCommand(apiResume))
+	mux.HandleFunc("/"+apiRescan, api.serveCommand(apiRescan))
+	mux.HandleFunc("/admin", api.serveAdmin)
+	go func() {
+		err := http.Serve(listener, mux)
+		log.Println("API server stopped:", err)
+	}()
+	return api, nil
+}
+
+// SetStatus replaces the status served to clients.
+func (api *shareAPI) SetStatus(status ShareStatus) {
+	status.Updated = time.Now()
+	api.Lock()
+	api.status = status
+	api.Unlock()
+}
+
+// SetPeers replaces the statistics of peers served to clients.
+func (api *shareAPI) SetPeers(peers []PeerStats) {
+	api.Lock()
+	api.peers = peers
+	api.Unlock()
+}
+
+func (api *shareAPI) servePeers(w http.ResponseWriter, r *http.Request) {
+	api.Lock()
+	peers := api.peers
+	api.Unlock()
+	if peers == nil {
+		peers = []PeerStats{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(peers)
+}
+
+// Status returns the status served to clients.
+func (api *shareAPI) Status() ShareStatus {
+	api.Lock()
+	defer api.Unlock()
+	return api.status
+}
+
+func (api *shareAPI) serveStatus(w http.ResponseWriter, r *http.Request) {
+	// The main loop waits for the check, so it can't report it
+	status := api.Status()
+	if p, ok := api.verifying.get(); ok {
+		status.Verifying = &p
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// serveAdmin sends the admin command given in the form to the devices of
+// the share and returns their replies.
+func (api *shareAPI) serveAdmin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	wait := adminWait
+	if s := r.FormValue("wait"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 || d > maxAdminWait {
+			http.Error(w, "invalid wait", http.StatusBadRequest)
+			return
+		}
+		wait = d
+	}
+	statuses, err := api.remote(r.FormValue("command"), r.FormValue("peer"), wait)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statuses)
+}
+
+func (api *shareAPI) serveCommand(command string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST only", http.StatusMethodNotAllowed)
+			return
+		}
+		select {
+		case api.commands <- command:
+			w.WriteHeader(http.StatusNoContent)
+		case <-time.After(5 * time.Second):
+			http.Error(w, "share is busy", http.StatusServiceUnavailable)
+		}
+	}
+}
+
+// fetchStatus asks the share listening at addr for its status.
+func fetchStatus(client *http.Client, addr string) (status ShareStatus, err error) {
+	resp, err := client.Get("http://" + addr + "/status")
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	return
+}
+
+// sendCommand asks the share listening at addr to pause or resume.
+func sendCommand(client *http.Client, addr, command string) error {
+	resp, err := client.Post("http://"+addr+"/"+command, "text/plain", nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return newUserError(msgCommandFailed, command, resp.Status)
+	}
+	return nil
+}
+
+// Rescan makes a running share scan its folder for changes now.
+func Rescan(cliId, workDir string) error {
+	shareID, err := id.NewFromString(cliId)
+	if err != nil {
+		return newUserError(msgBadID, err)
+	}
+	if !shareID.CanWrite() {
+		return newUserError(msgRescanNeedsWrite)
+	}
+	session, err := openSession(workDir, shareID)
+	if err != nil {
+		return newUserError(msgOpenSession, err)
+	}
+	addr := session.GetSetting(settingAPI)
+	if addr == "" {
+		return newUserError(msgShareNotRunning)
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	if err := sendCommand(client, addr, apiRescan); err != nil {
+		return err
+	}
+	fmt.Println(T(msgRescanRequested))
+	return nil
+}
+
+// sendAdminCommand asks the share listening at addr to send an admin
+// command to its devices, and returns their replies.
+func sendAdminCommand(client *http.Client, addr, command, peer string, wait time.Duration) (statuses []RemoteStatus, err error) {
+	form := url.Values{"command": {command}, "peer": {peer}, "wait": {wait.String()}}
+	resp, err := client.PostForm("http://"+addr+"/admin", form)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return nil, newUserError(msgCommandFailed, command, strings.TrimSpace(string(msg)))
+	}
+	err = json.NewDecoder(resp.Body).Decode(&statuses)
+	return
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rakoo/rakoshare/pkg/id"
+)
+
+// Every revision a share takes is appended to its audit log, under the
+// working directory, with the peer that announced it. Unlike the
+// history, it is never pruned: it tells which device pushed a change and
+// when.
+
+// Where audit logs are kept, under the working directory
+const auditDir = "audit"
+
+// How the revision of an audit entry was signed
+const (
+	auditVerified = "verified" // by a writer, checked when a peer announced it
+	auditLocal    = "local"    // by us
+)
+
+// AuditEntry records that a share took a revision.
+type AuditEntry struct {
+	Time      time.Time `json:"time"`
+	Previous  string    `json:"previous,omitempty"`
+	Rev       string    `json:"rev"`
+	InfoHash  string    `json:"infohash"`
+	Signer    string    `json:"signer"`
+	Signature string    `json:"signature"`
+
+	// The peer that announced the revision, if it came from one
+	Peer   string `json:"peer,omitempty"`
+	PeerID string `json:"peerID,omitempty"`
+}
+
+// auditAnnouncer is the peer that sent the revision last stored as the
+// one to adopt.
+type auditAnnouncer struct {
+	ih      string
+	rev     string
+	address string
+	id      string
+}
+
+// auditLogPath returns where the audit log of shareID is kept.
+func auditLogPath(workDir string, shareID id.Id) string {
+	return filepath.Join(workDir, auditDir, hex.EncodeToString(shareID.Infohash)+".log")
+}
+
+// appendAudit adds e to the audit log at path, one JSON object per line.
+func appendAudit(path string, e AuditEntry) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	raw, err := json.Marshal(e)
+	if err == nil {
+		_, err = f.Write(append(raw, '\n'))
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// readAudit returns the entries of the audit log at path, oldest first.
+// Lines that can't be read, such as one cut by a crash, are skipped.
+func readAudit(path string) (entries []AuditEntry, err error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e AuditEntry
+		if json.Unmarshal(scanner.Bytes(), &e) == nil {
+			entries = append(entries, e)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// recordAnnouncer remembers that p announced rev, of the torrent ih, as
+// the revision to adopt.
+func (cs *ControlSession) recordAnnouncer(ih string, rev Revision, address string, p *peerState) {
+	cs.announcerLock.Lock()
+	cs.announcer = auditAnnouncer{ih: ih, rev: rev.String(), address: address, id: hex.EncodeToString([]byte(p.id))}
+	cs.announcerLock.Unlock()
+}
+
+// announcerOf returns the address and the id of the peer that announced
+// rev, of the torrent ih, if we know it.
+func (cs *ControlSession) announcerOf(ih string, rev Revision) (address, peerID string) {
+	cs.announcerLock.Lock()
+	defer cs.announcerLock.Unlock()
+	if a := cs.announcer; a.ih == ih && a.rev == rev.String() {
+		return a.address, a.id
+	}
+	return "", ""
+}
+
+// audit appends the change from the revision previous to rev, of the
+// torrent ih, to the audit log. Revisions that were announced by a peer
+// are recorded with it.
+func (cs *ControlSession) audit(previous, rev Revision, ih string, adopted bool) {
+	if cs.auditPath == "" {
+		return
+	}
+	e := AuditEntry{
+		Time:      time.Now(),
+		Rev:       rev.String(),
+		InfoHash:  hex.EncodeToString([]byte(ih)),
+		Signer:    hex.EncodeToString([]byte(rev.Author)),
+		Signature: auditLocal,
+	}
+	if previous.Sig != "" {
+		e.Previous = previous.String()
+	}
+	if adopted {
+		e.Signature = auditVerified
+		e.Peer, e.PeerID = cs.announcerOf(ih, rev)
+	}
+	if err := appendAudit(cs.auditPath, e); err != nil {
+		cs.log("Couldn't append to the audit log:", err)
+	}
+}
+
+// Audit shows the audit log of a share, oldest first.
+func Audit(cliId, workDir string) error {
+	shareID, err := id.NewFromString(cliId)
+	if err != nil {
+		return newUserError(msgBadID, err)
+	}
+	entries, err := readAudit(auditLogPath(workDir, shareID))
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		fmt.Println(T(msgNoAudit))
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, T(msgAuditHeader))
+	for _, e := range entries {
+		signer := e.Signer
+		if len(signer) > 16 {
+			signer = signer[:16]
+		}
+		peer := e.Peer
+		if peer == "" {
+			peer = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", e.Time.Format(time.RFC3339), e.Previous, e.Rev, e.InfoHash, signer, e.Signature, peer)
+	}
+	return w.Flush()
+}
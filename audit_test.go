@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAudit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cs := &ControlSession{auditPath: filepath.Join(dir, auditDir, "share.log")}
+	first := Revision{Counter: 1, Hash: "aa", Author: "w", Sig: "s1"}
+	second := Revision{Counter: 2, Hash: "bb", Author: "w", Sig: "s2"}
+
+	cs.audit(Revision{}, first, "ih1", false)
+	cs.recordAnnouncer("ih2", second, "192.0.2.1:7777", &peerState{id: "peer"})
+	cs.audit(first, second, "ih2", true)
+	// An announcer of another revision isn't blamed
+	cs.audit(second, first, "ih1", true)
+
+	entries, err := readAudit(cs.auditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 entries, got %d", len(entries))
+	}
+	if e := entries[0]; e.Previous != "" || e.Rev != first.String() || e.Signature != auditLocal || e.Peer != "" {
+		t.Errorf("Unexpected local entry %+v", e)
+	}
+	if e := entries[1]; e.Previous != first.String() || e.InfoHash != "696832" || e.Signature != auditVerified ||
+		e.Peer != "192.0.2.1:7777" || e.PeerID != "70656572" {
+		t.Errorf("Unexpected adopted entry %+v", e)
+	}
+	if e := entries[2]; e.Peer != "" {
+		t.Errorf("Expected no peer for the last entry, got %+v", e)
+	}
+
+	// Lines cut by a crash are skipped
+	f, _ := os.OpenFile(cs.auditPath, os.O_WRONLY|os.O_APPEND, 0600)
+	f.Write([]byte(`{"time":`))
+	f.Close()
+	if entries, err = readAudit(cs.auditPath); err != nil || len(entries) != 3 {
+		t.Errorf("Expected 3 entries, got %d, %v", len(entries), err)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// backoff computes exponentially increasing delays between attempts at
+// something that keeps failing, such as contacting a remote host. Delays
+// are randomized so that many clients failing at the same time don't
+// retry in lockstep.
+type backoff struct {
+	Min time.Duration
+	Max time.Duration
+
+	// Fraction of each delay that is randomized: a delay d becomes a
+	// value between d*(1-Jitter) and d*(1+Jitter).
+	Jitter float64
+
+	attempt uint
+}
+
+// Next returns how long to wait before the next attempt.
+func (b *backoff) Next() time.Duration {
+	d := b.Min
+	for i := uint(0); i < b.attempt && d < b.Max; i++ {
+		d *= 2
+	}
+	if d > b.Max {
+		d = b.Max
+	}
+	b.attempt++
+
+	if b.Jitter > 0 {
+		d = time.Duration(float64(d) * (1 - b.Jitter + 2*b.Jitter*rand.Float64()))
+	}
+	if d > b.Max {
+		d = b.Max
+	}
+	return d
+}
+
+// Reset starts over from the minimal delay, after a success.
+func (b *backoff) Reset() {
+	b.attempt = 0
+}
+
+// Attempts returns how many delays were given since the last Reset.
+func (b *backoff) Attempts() int {
+	return int(b.attempt)
+}
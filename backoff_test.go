@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	b := &backoff{Min: time.Second, Max: 10 * time.Second}
+	expected := []time.Duration{1, 2, 4, 8, 10, 10}
+	for i, e := range expected {
+		if d := b.Next(); d != e*time.Second {
+			t.Errorf("attempt %d: expected %s, got %s", i, e*time.Second, d)
+		}
+	}
+
+	b.Reset()
+	if d := b.Next(); d != time.Second {
+		t.Errorf("expected backoff to start over after a reset, got %s", d)
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	b := &backoff{Min: 20 * time.Second, Max: time.Hour, Jitter: 0.25}
+	for i := 0; i < 100; i++ {
+		b.Reset()
+		d := b.Next()
+		if d < 15*time.Second || d > 25*time.Second {
+			t.Fatalf("jittered delay %s out of bounds", d)
+		}
+	}
+
+	for i := 0; i < 20; i++ {
+		if d := b.Next(); d > time.Hour {
+			t.Fatalf("jittered delay %s is over the cap", d)
+		}
+	}
+}
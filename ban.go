@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"flag"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	badPiecesBeforeBan = flag.Int("badPiecesBeforeBan", 3, "Ban peers that contributed to this many pieces failing verification. 0 disables bans")
+	banDuration        = flag.Duration("banDuration", time.Hour, "How long banned peers are refused")
+)
+
+// banList keeps track of the peers that sent us corrupt data, by host and
+// peer id: they can come back on another port, while other devices behind
+// the same NAT, or coming through our onion service, share their host. It
+// outlives torrent sessions, so that a new revision doesn't give
+// poisoners a clean slate.
+type banList struct {
+	sync.Mutex
+	failures map[string]int
+	until    map[string]time.Time
+}
+
+var bannedPeers = newBanList()
+
+var errCorruptPiece = errors.New("contributed to a corrupt piece")
+
+func newBanList() *banList {
+	return &banList{
+		failures: make(map[string]int),
+		until:    make(map[string]time.Time),
+	}
+}
+
+func peerHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// banKey returns what the peer at addr, with the given peer id, is banned
+// by.
+func banKey(addr, id string) string {
+	return peerHost(addr) + "/" + hex.EncodeToString([]byte(id))
+}
+
+// badPiece records that the peer with the given ban key contributed to a
+// piece that failed verification, and tells whether it is now banned.
+func (b *banList) badPiece(key string, now time.Time) (banned bool) {
+	if *badPiecesBeforeBan <= 0 {
+		return false
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	b.failures[key]++
+	if b.failures[key] < *badPiecesBeforeBan {
+		return false
+	}
+	delete(b.failures, key)
+	b.until[key] = now.Add(*banDuration)
+	return true
+}
+
+// isBanned tells whether the peer at addr, with the given peer id, is
+// banned.
+func (b *banList) isBanned(addr, id string, now time.Time) bool {
+	key := banKey(addr, id)
+
+	b.Lock()
+	defer b.Unlock()
+	until, ok := b.until[key]
+	if !ok {
+		return false
+	}
+	if now.After(until) {
+		delete(b.until, key)
+		return false
+	}
+	return true
+}
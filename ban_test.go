@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBanList(t *testing.T) {
+	b := newBanList()
+	now := time.Now()
+	key := banKey("1.2.3.4:6881", "bad")
+
+	for i := 1; i < *badPiecesBeforeBan; i++ {
+		if b.badPiece(key, now) {
+			t.Fatalf("Banned after %d bad pieces", i)
+		}
+	}
+	if b.isBanned("1.2.3.4:6881", "bad", now) {
+		t.Fatal("Banned too early")
+	}
+	if !b.badPiece(key, now) {
+		t.Fatalf("Expected a ban after %d bad pieces", *badPiecesBeforeBan)
+	}
+
+	// Whatever the port
+	if !b.isBanned("1.2.3.4:6881", "bad", now) || !b.isBanned("1.2.3.4:1234", "bad", now) {
+		t.Error("Expected the peer to be banned")
+	}
+	// Other devices behind the same NAT, or coming through our onion
+	// service, aren't
+	if b.isBanned("1.2.3.4:6881", "good", now) || b.isBanned("5.6.7.8:6881", "bad", now) {
+		t.Error("Expected other peers not to be banned")
+	}
+	if b.isBanned("1.2.3.4:6881", "bad", now.Add(*banDuration+time.Second)) {
+		t.Error("Expected the ban to expire")
+	}
+
+	// Failures start over after a ban
+	if b.badPiece(key, now) && *badPiecesBeforeBan > 1 {
+		t.Error("Expected the count of failures to start over")
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	blocklistSource  = flag.String("blocklist", "", "File or http(s) URL of a list of IP ranges to refuse, in PeerGuardian (P2P or P2B) or CIDR format, possibly gzipped")
+	blocklistRefresh = flag.Duration("blocklistRefresh", 24*time.Hour, "How often the blocklist is loaded again")
+)
+
+var (
+	errInvalidBlocklist = errors.New("invalid blocklist")
+	errInvalidP2B       = errors.New("invalid P2B blocklist")
+)
+
+// Lists bigger than that, once uncompressed, are refused
+const maxBlocklistSize = 256 << 20
+
+var p2bMagic = []byte("\xff\xff\xff\xffP2B")
+
+// ipRange is an inclusive range of addresses, all in their 16-byte form.
+type ipRange struct {
+	first, last net.IP
+}
+
+// blocklist holds the ranges we refuse to connect with, sorted and
+// without overlaps.
+type blocklist struct {
+	sync.RWMutex
+	ranges []ipRange
+}
+
+var blockedIPs = &blocklist{}
+
+func (b *blocklist) set(ranges []ipRange) {
+	ranges = mergeRanges(ranges)
+	b.Lock()
+	b.ranges = ranges
+	b.Unlock()
+}
+
+// contains tells whether ip is in one of the ranges.
+func (b *blocklist) contains(ip net.IP) bool {
+	ip = ip.To16()
+	if ip == nil {
+		return false
+	}
+
+	b.RLock()
+	defer b.RUnlock()
+	i := sort.Search(len(b.ranges), func(i int) bool {
+		return bytes.Compare(b.ranges[i].first, ip) > 0
+	})
+	return i > 0 && bytes.Compare(b.ranges[i-1].last, ip) >= 0
+}
+
+// isBlocked tells whether the peer at addr is in the blocklist.
+func isBlocked(addr string) bool {
+	ip := net.ParseIP(peerHost(addr))
+	return ip != nil && blockedIPs.contains(ip)
+}
+
+// mergeRanges sorts ranges and merges those that overlap.
+func mergeRanges(ranges []ipRange) []ipRange {
+	sort.Sort(byFirst(ranges))
+	var merged []ipRange
+	for _, r := range ranges {
+		n := len(merged)
+		if n > 0 && bytes.Compare(r.first, merged[n-1].last) <= 0 {
+			if bytes.Compare(r.last, merged[n-1].last) > 0 {
+				merged[n-1].last = r.last
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+type byFirst []ipRange
+
+func (r byFirst) Len() int           { return len(r) }
+func (r byFirst) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r byFirst) Less(i, j int) bool { return bytes.Compare(r[i].first, r[j].first) < 0 }
+
+// parseBlocklist reads a blocklist, guessing its format.
+func parseBlocklist(r io.Reader) ([]ipRange, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		br = bufio.NewReader(gz)
+	}
+	limited := bufio.NewReader(io.LimitReader(br, maxBlocklistSize))
+	if magic, err := limited.Peek(len(p2bMagic)); err == nil && bytes.Equal(magic, p2bMagic) {
+		return parseP2B(limited)
+	}
+	return parseTextBlocklist(limited)
+}
+
+// parseTextBlocklist reads lines in the P2P format, "description:first-last",
+// as CIDR ranges or as single addresses. Empty lines and comments
+// starting with # are skipped.
+func parseTextBlocklist(r io.Reader) (ranges []ipRange, err error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		r, err := parseBlocklistLine(line)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, scanner.Err()
+}
+
+func parseBlocklistLine(line string) (ipRange, error) {
+	if strings.Contains(line, "/") {
+		_, n, err := net.ParseCIDR(line)
+		if err != nil {
+			return ipRange{}, errInvalidBlocklist
+		}
+		first := n.IP.To16()
+		last := make(net.IP, len(first))
+		mask := n.Mask
+		if len(mask) == net.IPv4len {
+			mask = append(net.CIDRMask(96, 128)[:12], mask...)
+		}
+		for i := range first {
+			last[i] = first[i] | ^mask[i]
+		}
+		return ipRange{first, last}, nil
+	}
+
+	// The description may contain colons, IPv6 ranges aren't used in
+	// this format
+	if i := strings.LastIndex(line, ":"); i >= 0 && strings.Contains(line[i:], "-") {
+		line = line[i+1:]
+	}
+	parts := strings.SplitN(line, "-", 2)
+	first := net.ParseIP(strings.TrimSpace(parts[0]))
+	last := first
+	if len(parts) == 2 {
+		last = net.ParseIP(strings.TrimSpace(parts[1]))
+	}
+	if first == nil || last == nil || bytes.Compare(first.To16(), last.To16()) > 0 {
+		return ipRange{}, errInvalidBlocklist
+	}
+	return ipRange{first.To16(), last.To16()}, nil
+}
+
+// parseP2B reads the binary PeerGuardian format. Versions 1 and 2 are a
+// list of zero-terminated names each followed by a range; version 3
+// lists the names first, and ranges refer to them by index.
+func parseP2B(r *bufio.Reader) (ranges []ipRange, err error) {
+	header := make([]byte, len(p2bMagic)+1)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return nil, errInvalidP2B
+	}
+	readRange := func() (ipRange, error) {
+		var ips [8]byte
+		if _, err := io.ReadFull(r, ips[:]); err != nil {
+			return ipRange{}, errInvalidP2B
+		}
+		first, last := net.IP(ips[:4]).To16(), net.IP(ips[4:]).To16()
+		if bytes.Compare(first, last) > 0 {
+			return ipRange{}, errInvalidP2B
+		}
+		return ipRange{first, last}, nil
+	}
+
+	switch header[len(p2bMagic)] {
+	case 1, 2:
+		for {
+			if _, err := r.ReadBytes(0); err == io.EOF {
+				return ranges, nil
+			} else if err != nil {
+				return nil, err
+			}
+			ipr, err := readRange()
+			if err != nil {
+				return nil, err
+			}
+			ranges = append(ranges, ipr)
+		}
+	case 3:
+		var count uint32
+		if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+			return nil, errInvalidP2B
+		}
+		for i := uint32(0); i < count; i++ {
+			if _, err := r.ReadBytes(0); err != nil {
+				return nil, errInvalidP2B
+			}
+		}
+		if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+			return nil, errInvalidP2B
+		}
+		for i := uint32(0); i < count; i++ {
+			var name uint32
+			if err := binary.Read(r, binary.BigEndian, &name); err != nil {
+				return nil, errInvalidP2B
+			}
+			ipr, err := readRange()
+			if err != nil {
+				return nil, err
+			}
+			ranges = append(ranges, ipr)
+		}
+		return ranges, nil
+	}
+	return nil, errInvalidP2B
+}
+
+// loadBlocklist reads the blocklist at source, a file or an http(s)
+// URL.
+func loadBlocklist(source string) ([]ipRange, error) {
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		client := proxyHttpClient()
+		client.Timeout = 5 * time.Minute
+		resp, err := client.Get(source)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, errors.New(resp.Status)
+		}
+		return parseBlocklist(resp.Body)
+	}
+
+	f, err := os.Open(source)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseBlocklist(f)
+}
+
+// startBlocklist loads the blocklist given on the command line, if any,
+// and reloads it regularly. On failure, the previous list stays.
+func startBlocklist() {
+	if *blocklistSource == "" {
+		return
+	}
+	load := func() {
+		ranges, err := loadBlocklist(*blocklistSource)
+		if err != nil {
+			log.Println("Couldn't load blocklist: ", err)
+			return
+		}
+		blockedIPs.set(ranges)
+		log.Printf("Loaded %d blocked ranges\n", len(ranges))
+	}
+	load()
+	if *blocklistRefresh <= 0 {
+		return
+	}
+	go func() {
+		for _ = range time.Tick(*blocklistRefresh) {
+			load()
+		}
+	}()
+}
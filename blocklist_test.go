@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseTextBlocklist(t *testing.T) {
+	list := `# Comment
+Some org: with colons:1.2.3.0-1.2.3.255
+10.0.0.0/8
+2001:db8::/32
+
+5.6.7.8
+`
+	ranges, err := parseBlocklist(strings.NewReader(list))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ranges) != 4 {
+		t.Fatalf("Expected 4 ranges, got %d", len(ranges))
+	}
+
+	b := &blocklist{}
+	b.set(ranges)
+	for addr, expected := range map[string]bool{
+		"1.2.3.0":     true,
+		"1.2.3.255":   true,
+		"1.2.4.0":     false,
+		"10.200.0.1":  true,
+		"11.0.0.0":    false,
+		"2001:db8::1": true,
+		"2001:db9::1": false,
+		"5.6.7.8":     true,
+		"5.6.7.9":     false,
+		"192.168.0.1": false,
+	} {
+		if b.contains(net.ParseIP(addr)) != expected {
+			t.Errorf("%s: expected blocked to be %v", addr, expected)
+		}
+	}
+
+	if _, err := parseBlocklist(strings.NewReader("not an address\n")); err != errInvalidBlocklist {
+		t.Errorf("Expected an invalid line to be refused, got %v", err)
+	}
+}
+
+func TestParseP2B(t *testing.T) {
+	var v2 bytes.Buffer
+	v2.Write(p2bMagic)
+	v2.WriteByte(2)
+	v2.WriteString("first\x00")
+	v2.Write([]byte{1, 2, 3, 0, 1, 2, 3, 255})
+	v2.WriteString("second\x00")
+	v2.Write([]byte{5, 6, 7, 8, 5, 6, 7, 8})
+
+	var v3 bytes.Buffer
+	v3.Write(p2bMagic)
+	v3.WriteByte(3)
+	v3.Write([]byte{0, 0, 0, 1})
+	v3.WriteString("name\x00")
+	v3.Write([]byte{0, 0, 0, 2})
+	v3.Write([]byte{0, 0, 0, 0, 1, 2, 3, 0, 1, 2, 3, 255})
+	v3.Write([]byte{0, 0, 0, 0, 5, 6, 7, 8, 5, 6, 7, 8})
+
+	// Lists are often distributed gzipped
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(v2.Bytes())
+	w.Close()
+
+	for name, list := range map[string][]byte{"v2": v2.Bytes(), "v3": v3.Bytes(), "gzip": gz.Bytes()} {
+		ranges, err := parseBlocklist(bytes.NewReader(list))
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		b := &blocklist{}
+		b.set(ranges)
+		if len(ranges) != 2 || !b.contains(net.ParseIP("1.2.3.4")) || !b.contains(net.ParseIP("5.6.7.8")) || b.contains(net.ParseIP("5.6.7.9")) {
+			t.Errorf("%s: unexpected ranges %v", name, ranges)
+		}
+	}
+}
+
+func TestMergeRanges(t *testing.T) {
+	r := func(first, last string) ipRange {
+		return ipRange{net.ParseIP(first).To16(), net.ParseIP(last).To16()}
+	}
+	merged := mergeRanges([]ipRange{
+		r("1.0.0.10", "1.0.0.20"),
+		r("1.0.0.0", "1.0.0.15"),
+		r("1.0.0.12", "1.0.0.13"),
+		r("2.0.0.0", "2.0.0.1"),
+	})
+	if len(merged) != 2 || !merged[0].first.Equal(net.ParseIP("1.0.0.0")) || !merged[0].last.Equal(net.ParseIP("1.0.0.20")) {
+		t.Errorf("Unexpected merged ranges: %v", merged)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"flag"
+	"math"
+	"time"
+)
+
+// Requests of 16KiB mean so many messages on a fast LAN that transfers
+// become CPU bound. Peers that advertise it, in the bs_max_block field of
+// the extension handshake, get requests covering several consecutive
+// blocks instead. Their size follows the bandwidth-delay product of the
+// link, measured from the download rate and the round trip time of
+// requests, so that the requests we keep queued are just enough to fill
+// it. When blocks can't grow any more, we queue more requests instead,
+// between minRequests and maxRequests and never more than the reqq the
+// peer advertised.
+
+var (
+	maxRequestBlock = flag.Int("maxRequestBlock", 256*1024, "Largest piece request sent to devices that support large requests, in bytes. 16384 disables them")
+	minRequests     = flag.Int("minRequests", MAX_OUR_REQUESTS, "Fewest piece requests kept queued at each device")
+	maxRequests     = flag.Int("maxRequests", 64, "Most piece requests kept queued at each device, on fast links with long round trips")
+)
+
+// Largest request we serve, and largest block we accept
+const maxBlockLength = 256 * 1024
+
+// A request we sent, covering blocks 16KiB blocks from its begin offset
+type ourRequest struct {
+	at     time.Time
+	blocks int
+}
+
+// blocksPerRequest returns how many blocks a request to p may cover.
+func (p *peerState) blocksPerRequest() int {
+	n := p.blockLength / STANDARD_BLOCK_LENGTH
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// recordRTT notes how long a request to p took to be answered. Only the
+// shortest time since the last tuning is kept, the others include the
+// time spent behind the other requests.
+func (p *peerState) recordRTT(rtt time.Duration) {
+	if p.rtt == 0 || rtt < p.rtt {
+		p.rtt = rtt
+	}
+}
+
+// tuneBlockLength chooses the size of the next requests to p, from what
+// was measured since the last call.
+func (p *peerState) tuneBlockLength() {
+	limit := *maxRequestBlock
+	if p.theirMaxBlock < limit {
+		limit = p.theirMaxBlock
+	}
+	if limit > maxBlockLength {
+		limit = maxBlockLength
+	}
+	limit -= limit % STANDARD_BLOCK_LENGTH
+
+	// Bytes that must be in flight to fill the link
+	bdp := p.downloadRate * p.rtt.Seconds()
+	length := STANDARD_BLOCK_LENGTH
+	for length*2 <= limit && float64(length*p.queueLimit(*minRequests)) < bdp {
+		length *= 2
+	}
+	p.blockLength = length
+	p.queueDepth = int(math.Ceil(bdp / float64(length)))
+	p.rtt = 0
+}
+
+// queueLimit bounds depth by the configured limits and by the queue p
+// advertised.
+func (p *peerState) queueLimit(depth int) int {
+	min, max := *minRequests, *maxRequests
+	if min < 1 {
+		min = 1
+	}
+	if max < min {
+		max = min
+	}
+	if depth < min {
+		depth = min
+	}
+	if depth > max {
+		depth = max
+	}
+	if p.reqq > 0 && p.reqq < depth {
+		depth = p.reqq
+	}
+	return depth
+}
+
+// extendRun claims the free blocks following first, so that a single
+// request covers up to max blocks, and returns how many blocks the
+// request covers.
+func (a *ActivePiece) extendRun(first, max int) (n int) {
+	n = 1
+	for first+n < len(a.downloaderCount) && n < max && a.downloaderCount[first+n] == 0 {
+		a.downloaderCount[first+n]++
+		n++
+	}
+	return
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTuneBlockLength(t *testing.T) {
+	defer func(n int) { *maxRequestBlock = n }(*maxRequestBlock)
+	*maxRequestBlock = 256 * 1024
+
+	// 100MB/s with a 10ms round trip: 1MB must be in flight
+	p := &peerState{downloadRate: 100e6}
+	p.recordRTT(20 * time.Millisecond)
+	p.recordRTT(10 * time.Millisecond)
+	p.tuneBlockLength()
+	if p.blockLength != STANDARD_BLOCK_LENGTH {
+		t.Errorf("Expected standard blocks for peers that don't support larger ones, got %d", p.blockLength)
+	}
+
+	p.theirMaxBlock = maxBlockLength
+	p.recordRTT(10 * time.Millisecond)
+	p.tuneBlockLength()
+	if p.blockLength != 256*1024 {
+		t.Errorf("Expected the largest blocks on a fast link, got %d", p.blockLength)
+	}
+	if p.rtt != 0 {
+		t.Errorf("Expected the round trip time to be measured again, got %s", p.rtt)
+	}
+
+	// A slow link doesn't need large requests
+	p.downloadRate = 100e3
+	p.recordRTT(20 * time.Millisecond)
+	p.tuneBlockLength()
+	if p.blockLength != STANDARD_BLOCK_LENGTH {
+		t.Errorf("Expected standard blocks on a slow link, got %d", p.blockLength)
+	}
+
+	p.theirMaxBlock = 40 * 1024
+	p.downloadRate = 100e6
+	p.recordRTT(10 * time.Millisecond)
+	p.tuneBlockLength()
+	if p.blockLength != 32*1024 {
+		t.Errorf("Expected blocks within what the peer serves, got %d", p.blockLength)
+	}
+
+	*maxRequestBlock = STANDARD_BLOCK_LENGTH
+	p.recordRTT(10 * time.Millisecond)
+	p.tuneBlockLength()
+	if p.blockLength != STANDARD_BLOCK_LENGTH {
+		t.Errorf("Expected standard blocks when large requests are disabled, got %d", p.blockLength)
+	}
+}
+
+func TestExtendRun(t *testing.T) {
+	a := &ActivePiece{downloaderCount: []int{0, 0, -1, 0, 0, 0, 1}}
+
+	first := a.chooseBlockToDownload(false)
+	if n := a.extendRun(first, 4); n != 2 {
+		t.Errorf("Expected the run to stop at a downloaded block, got %d blocks", n)
+	}
+	first = a.chooseBlockToDownload(false)
+	if first != 3 {
+		t.Fatalf("Expected block 3 to be the next free one, got %d", first)
+	}
+	if n := a.extendRun(first, 2); n != 2 {
+		t.Errorf("Expected the run to be limited to 2 blocks, got %d", n)
+	}
+	first = a.chooseBlockToDownload(false)
+	if n := a.extendRun(first, 4); n != 1 {
+		t.Errorf("Expected the run to stop at a requested block, got %d blocks", n)
+	}
+	for i, c := range []int{1, 1, -1, 1, 1, 1, 1} {
+		if a.downloaderCount[i] != c {
+			t.Errorf("Block %d: expected %d downloaders, got %d", i, c, a.downloaderCount[i])
+		}
+	}
+}
+
+func TestQueueDepth(t *testing.T) {
+	defer func(min, max int) { *minRequests, *maxRequests = min, max }(*minRequests, *maxRequests)
+	*minRequests, *maxRequests = 2, 64
+
+	p := &peerState{}
+	if n := p.maxOurRequests(); n != 2 {
+		t.Errorf("Expected the fewest requests before measuring, got %d", n)
+	}
+
+	// 10MB/s with a 50ms round trip: 500KB in flight, in 16KiB blocks
+	p.downloadRate = 10e6
+	p.recordRTT(50 * time.Millisecond)
+	p.tuneBlockLength()
+	if n := p.maxOurRequests(); n != 31 {
+		t.Errorf("Expected 31 requests to fill the link, got %d", n)
+	}
+
+	p.reqq = 16
+	if n := p.maxOurRequests(); n != 16 {
+		t.Errorf("Expected the queue advertised by the peer, got %d", n)
+	}
+
+	p.reqq = 0
+	*maxRequests = 8
+	if n := p.maxOurRequests(); n != 8 {
+		t.Errorf("Expected at most maxRequests, got %d", n)
+	}
+
+	p.downloadRate = 10e3
+	p.recordRTT(50 * time.Millisecond)
+	p.tuneBlockLength()
+	if n := p.maxOurRequests(); n != 2 {
+		t.Errorf("Expected the fewest requests on a slow link, got %d", n)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/zeebo/blake3"
+)
+
+var (
+	manifestChecksum = flag.String("manifestChecksum", "sha256", "Algorithm of the checksum of each file published with a revision: sha1, sha256 or blake3")
+	indexChecksum    = flag.String("indexChecksum", "blake3", "Algorithm used to tell whether a file whose modification time changed was really modified: sha1, sha256 or blake3")
+	verifyChecksums  = flag.Bool("verifyChecksums", false, "Check downloaded files against the checksums of their revision once the download is complete")
+)
+
+var errUnknownChecksum = errors.New("unknown checksum algorithm")
+
+// Checksums are written as <algorithm>:<hex digest>, so that the
+// algorithm can change without changing the formats they're stored in.
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"blake3": func() hash.Hash { return blake3.New() },
+
+	// Only to check the md5sum field of torrents from other clients
+	"md5": md5.New,
+}
+
+func newChecksum(algo string) (hash.Hash, error) {
+	newHash, ok := checksumAlgorithms[algo]
+	if !ok {
+		return nil, errUnknownChecksum
+	}
+	return newHash(), nil
+}
+
+func formatChecksum(algo string, h hash.Hash) string {
+	return algo + ":" + hex.EncodeToString(h.Sum(nil))
+}
+
+func fileChecksum(path, algo string) (string, error) {
+	h, err := newChecksum(algo)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return formatChecksum(algo, h), nil
+}
+
+// checkChecksumFlags makes sure we know the algorithms we were asked for.
+func checkChecksumFlags() error {
+	for _, algo := range []string{*manifestChecksum, *indexChecksum} {
+		if _, ok := checksumAlgorithms[algo]; !ok {
+			return newUserError(msgUnknownChecksum, algo)
+		}
+	}
+	return nil
+}
+
+// expectedChecksum returns the checksum f should have, if it has one.
+// Torrents from other clients may carry an md5sum instead.
+func expectedChecksum(f *FileDict) (algo, sum string, ok bool) {
+	if i := strings.Index(f.Checksum, ":"); i > 0 {
+		return f.Checksum[:i], f.Checksum, true
+	}
+	if f.Md5sum != "" {
+		return "md5", "md5:" + strings.ToLower(f.Md5sum), true
+	}
+	return "", "", false
+}
+
+// verifyFiles checks the files of info, downloaded in dir, against their
+// checksums and returns the paths of those that don't match or are
+// missing. Files without a checksum, or with one of an algorithm we don't
+// know, are skipped. Ignored files are looked for where the store keeps
+// them.
+func verifyFiles(info *InfoDict, dir string) (bad []string, err error) {
+	files := info.fileList()
+	if len(files) == 0 {
+		files = []*FileDict{{Length: info.Length, Path: []string{info.Name}, Md5sum: info.Md5sum}}
+	}
+
+	ignored := loadIgnoreFile(dir)
+	for _, f := range files {
+		algo, expected, ok := expectedChecksum(f)
+		if !ok {
+			continue
+		}
+		if _, known := checksumAlgorithms[algo]; !known {
+			continue
+		}
+		rel := path.Clean("/" + path.Join(f.Path...))[1:]
+		full := filepath.Join(dir, filepath.FromSlash(rel))
+		if ignored.match(rel) {
+			full = filepath.Join(dir, rakoshareDir, "ignored", filepath.FromSlash(rel))
+		}
+		sum, err := fileChecksum(full, algo)
+		if os.IsNotExist(err) {
+			bad = append(bad, full)
+			continue
+		}
+		if err != nil {
+			return bad, err
+		}
+		if sum != expected {
+			bad = append(bad, full)
+		}
+	}
+	return bad, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFileChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checksum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "a")
+	ioutil.WriteFile(path, []byte("abc"), 0644)
+
+	vectors := map[string]string{
+		"sha1":   "sha1:a9993e364706816aba3e25717850c26c9cd0d89d",
+		"sha256": "sha256:ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad",
+	}
+	for algo, expected := range vectors {
+		sum, err := fileChecksum(path, algo)
+		if err != nil || sum != expected {
+			t.Errorf("%s: expected %s, got %s, %v", algo, expected, sum, err)
+		}
+	}
+	if sum, err := fileChecksum(path, "blake3"); err != nil || !strings.HasPrefix(sum, "blake3:") {
+		t.Errorf("blake3: got %s, %v", sum, err)
+	}
+	if _, err := fileChecksum(path, "md4"); err != errUnknownChecksum {
+		t.Errorf("Expected %v, got %v", errUnknownChecksum, err)
+	}
+}
+
+func TestManifestChecksums(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checksum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "a"), []byte("abc"), 0644)
+
+	meta, err := createMeta(dir, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := fileChecksum(filepath.Join(dir, "a"), *manifestChecksum)
+	if len(meta.Info.Files) != 1 || meta.Info.Files[0].Checksum != expected {
+		t.Fatalf("Expected the manifest to carry %s, got %+v", expected, meta.Info.Files)
+	}
+}
+
+func TestVerifyFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checksum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "sub"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "sub", "good"), []byte("abc"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "bad"), []byte("abd"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "md5"), []byte("abc"), 0644)
+
+	abc, _ := fileChecksum(filepath.Join(dir, "sub", "good"), "sha256")
+	info := &InfoDict{Files: []*FileDict{
+		{Length: 3, Path: []string{"sub", "good"}, Checksum: abc},
+		{Length: 3, Path: []string{"bad"}, Checksum: abc},
+		{Length: 3, Path: []string{"md5"}, Md5sum: "900150983CD24FB0D6963F7D28E17F72"},
+		{Length: 3, Path: []string{"future"}, Checksum: "sha4096:00"},
+		{Length: 3, Path: []string{"unchecked"}},
+		{Length: 3, Path: []string{"skipped"}, Checksum: abc},
+		{Length: 3, Path: []string{"missing"}, Checksum: abc},
+	}}
+	// Ignored files are kept aside by the store
+	ioutil.WriteFile(filepath.Join(dir, ignoreFile), []byte("skipped\n"), 0644)
+	os.MkdirAll(filepath.Join(dir, rakoshareDir, "ignored"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, rakoshareDir, "ignored", "skipped"), []byte("abc"), 0644)
+
+	bad, err := verifyFiles(info, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{filepath.Join(dir, "bad"), filepath.Join(dir, "missing")}
+	if !reflect.DeepEqual(bad, expected) {
+		t.Errorf("Expected %v to be reported, got %v", expected, bad)
+	}
+}
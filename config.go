@@ -0,0 +1,472 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rakoo/rakoshare/pkg/sharesession"
+)
+
+// ShareConfig holds the settings of a share. Settings left to their zero
+// value come from the profile the share inherits from, if any, and then
+// from the command-line defaults.
+type ShareConfig struct {
+	// The profile this share inherits its settings from
+	Profile string `json:"profile,omitempty"`
+
+	// Patterns of paths not to share, in the syntax of filepath.Match. A
+	// pattern is matched against the base name and against the path
+	// relative to the shared directory. Patterns of the profile and of
+	// the share add up.
+	Ignore []string `json:"ignore,omitempty"`
+
+	// How often the shared directory is scanned for changes. With
+	// NoWatch, it is only scanned, without notifications of changes,
+	// for network mounts that don't send any.
+	ScanInterval duration `json:"scanInterval,omitempty"`
+	NoWatch      bool     `json:"noWatch,omitempty"`
+
+	// The metainfo format of the revisions we make, formatV1 by default
+	Format string `json:"format,omitempty"`
+
+	// Limits of the data transfers of the share, in bytes per second. 0
+	// means unlimited.
+	UploadRate   int64 `json:"uploadRate,omitempty"`
+	DownloadRate int64 `json:"downloadRate,omitempty"`
+
+	// When the share stops, in RFC 3339 format, and after how many
+	// complete downloads by distinct devices. Empty or 0 means never.
+	Expires      string `json:"expires,omitempty"`
+	MaxDownloads int    `json:"maxDownloads,omitempty"`
+
+	// Peers always connected to, as host:port, or as a host to accept on
+	// any port. Peer ids can't be used, they change at each start. With
+	// TrustedOnly, no other peer is accepted. Peers of the profile and of
+	// the share add up.
+	Trusted     []string `json:"trusted,omitempty"`
+	TrustedOnly bool     `json:"trustedOnly,omitempty"`
+
+	// How many peers the share looks for, and accepts at most. 0 means
+	// TARGET_NUM_PEERS and MAX_NUM_PEERS.
+	TargetPeers int `json:"targetPeers,omitempty"`
+	MaxPeers    int `json:"maxPeers,omitempty"`
+
+	// Base URLs of HTTPS servers with a copy of the files, published in
+	// the next revisions. Mirrors of the profile and of the share add
+	// up.
+	Mirrors []string `json:"mirrors,omitempty"`
+
+	// Whether to obey the admin commands writers of the share send from
+	// their devices
+	Admin bool `json:"admin,omitempty"`
+
+	// How the files are accessed: "files", the default, "mmap" to read
+	// them through memory mappings, "mmap-write" to write through them
+	// too, "memory" not to write them at all, or "s3" to keep them in
+	// the object store at StorageURL.
+	Storage    string `json:"storage,omitempty"`
+	StorageURL string `json:"storageURL,omitempty"`
+
+	// How files being downloaded are allocated: "sparse", the default,
+	// "fallocate" to reserve their whole size on disk, or "none" to
+	// let them grow as blocks arrive.
+	Allocation string `json:"allocation,omitempty"`
+
+	// How long copies of the files that syncs overwrite or delete are
+	// kept. 0 means -keepVersions, negative not to keep them.
+	KeepVersions duration `json:"keepVersions,omitempty"`
+
+	// Patterns of the files downloaded in order, as those of Ignore, so
+	// that they can be played while they download. Patterns of the
+	// profile and of the share add up.
+	Sequential []string `json:"sequential,omitempty"`
+
+	// When a revision stops being uploaded once we have all of it: after
+	// uploading SeedRatio times its size, or SeedBytes bytes, or after
+	// seeding it for SeedTime. 0 means never.
+	SeedRatio float64  `json:"seedRatio,omitempty"`
+	SeedBytes int64    `json:"seedBytes,omitempty"`
+	SeedTime  duration `json:"seedTime,omitempty"`
+
+	// Whether replicas that only hold the store id keep sealed copies of
+	// the pieces: writers publish them, and such replicas download them.
+	Sealed bool `json:"sealed,omitempty"`
+
+	// URLs the events of the share are POSTed to, and the kinds of
+	// events sent, all if empty. Those of the profile and of the share
+	// add up.
+	Webhooks      []string `json:"webhooks,omitempty"`
+	WebhookEvents []string `json:"webhookEvents,omitempty"`
+}
+
+// duration is a time.Duration that reads and writes as "10s" in JSON
+type duration time.Duration
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+// Profiles available without any configuration. Users can override them,
+// or define others, with JSON files in the profiles directory.
+var builtinProfiles = map[string]ShareConfig{
+	"photos": {
+		Ignore:       []string{"Thumbs.db", ".DS_Store", ".picasa.ini", "*.tmp"},
+		ScanInterval: duration(time.Minute),
+	},
+	"code": {
+		Ignore:       []string{".git", ".hg", ".svn", "node_modules", "*.o", "*.pyc", "*.swp", "*~"},
+		ScanInterval: duration(10 * time.Second),
+	},
+	"backup": {
+		Ignore:       []string{"*.tmp", "*.part"},
+		ScanInterval: duration(10 * time.Minute),
+		UploadRate:   1024 * 1024,
+	},
+}
+
+const settingConfig = "config"
+
+func profilesDir(workDir string) string {
+	return filepath.Join(workDir, "profiles")
+}
+
+// loadProfile returns the profile called name, from the profiles
+// directory or else from the built-in ones.
+func loadProfile(workDir, name string) (ShareConfig, error) {
+	var cfg ShareConfig
+	content, err := ioutil.ReadFile(filepath.Join(profilesDir(workDir), name+".json"))
+	if os.IsNotExist(err) {
+		builtin, ok := builtinProfiles[name]
+		if !ok {
+			return cfg, newUserError(msgUnknownProfile, name)
+		}
+		return builtin, nil
+	} else if err != nil {
+		return cfg, err
+	}
+
+	err = json.Unmarshal(content, &cfg)
+	if err != nil {
+		return cfg, newUserError(msgInvalidProfile, name, err)
+	}
+	return cfg, nil
+}
+
+// listProfiles returns the names of all available profiles, sorted.
+func listProfiles(workDir string) []string {
+	names := make(map[string]struct{})
+	for name := range builtinProfiles {
+		names[name] = struct{}{}
+	}
+	files, _ := filepath.Glob(filepath.Join(profilesDir(workDir), "*.json"))
+	for _, f := range files {
+		names[strings.TrimSuffix(filepath.Base(f), ".json")] = struct{}{}
+	}
+
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// getShareConfig returns the settings set on the share itself, without
+// those of its profile.
+func getShareConfig(session *sharesession.Session) (cfg ShareConfig, err error) {
+	raw := session.GetSetting(settingConfig)
+	if raw == "" {
+		return
+	}
+	err = json.Unmarshal([]byte(raw), &cfg)
+	return
+}
+
+func saveShareConfig(session *sharesession.Session, cfg ShareConfig) error {
+	raw, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	return session.SetSetting(settingConfig, string(raw))
+}
+
+// loadShareConfig returns the effective settings of the share: its own
+// merged over those of its profile.
+func loadShareConfig(session *sharesession.Session, workDir string) (ShareConfig, error) {
+	cfg, err := getShareConfig(session)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.Profile == "" {
+		return cfg, nil
+	}
+
+	profile, err := loadProfile(workDir, cfg.Profile)
+	if err != nil {
+		return cfg, err
+	}
+	return profile.merge(cfg), nil
+}
+
+// merge returns c with the non-zero settings of over applied on top.
+func (c ShareConfig) merge(over ShareConfig) ShareConfig {
+	merged := c
+	if over.Profile != "" {
+		merged.Profile = over.Profile
+	}
+	merged.Ignore = append(append([]string{}, c.Ignore...), over.Ignore...)
+	if over.ScanInterval != 0 {
+		merged.ScanInterval = over.ScanInterval
+	}
+	if over.NoWatch {
+		merged.NoWatch = true
+	}
+	if over.Format != "" {
+		merged.Format = over.Format
+	}
+	if over.UploadRate != 0 {
+		merged.UploadRate = over.UploadRate
+	}
+	if over.DownloadRate != 0 {
+		merged.DownloadRate = over.DownloadRate
+	}
+	if over.Expires != "" {
+		merged.Expires = over.Expires
+	}
+	if over.MaxDownloads != 0 {
+		merged.MaxDownloads = over.MaxDownloads
+	}
+	if len(over.Trusted) > 0 {
+		merged.Trusted = append(append([]string{}, c.Trusted...), over.Trusted...)
+	}
+	if over.TrustedOnly {
+		merged.TrustedOnly = true
+	}
+	if over.TargetPeers != 0 {
+		merged.TargetPeers = over.TargetPeers
+	}
+	if over.MaxPeers != 0 {
+		merged.MaxPeers = over.MaxPeers
+	}
+	if len(over.Mirrors) > 0 {
+		merged.Mirrors = append(append([]string{}, c.Mirrors...), over.Mirrors...)
+	}
+	if over.Admin {
+		merged.Admin = true
+	}
+	if over.Storage != "" {
+		merged.Storage = over.Storage
+	}
+	if over.StorageURL != "" {
+		merged.StorageURL = over.StorageURL
+	}
+	if over.Allocation != "" {
+		merged.Allocation = over.Allocation
+	}
+	if over.KeepVersions != 0 {
+		merged.KeepVersions = over.KeepVersions
+	}
+	if len(over.Sequential) > 0 {
+		merged.Sequential = append(append([]string{}, c.Sequential...), over.Sequential...)
+	}
+	if over.SeedRatio != 0 {
+		merged.SeedRatio = over.SeedRatio
+	}
+	if over.SeedBytes != 0 {
+		merged.SeedBytes = over.SeedBytes
+	}
+	if over.SeedTime != 0 {
+		merged.SeedTime = over.SeedTime
+	}
+	if over.Sealed {
+		merged.Sealed = true
+	}
+	if len(over.Webhooks) > 0 {
+		// A hook in both would get every event twice
+		merged.Webhooks = appendMissing(append([]string{}, c.Webhooks...), over.Webhooks...)
+	}
+	if len(over.WebhookEvents) > 0 {
+		merged.WebhookEvents = append(append([]string{}, c.WebhookEvents...), over.WebhookEvents...)
+	}
+	return merged
+}
+
+// configChange is what the config command changes in the settings of a
+// share: settings set and list entries added, settings put back to their
+// default, by their JSON name, and list entries removed.
+type configChange struct {
+	set    ShareConfig
+	unset  []string
+	remove ShareConfig
+}
+
+// apply returns c with ch made. Settings are unset and entries removed
+// before the others are set and added.
+func (c ShareConfig) apply(ch configChange) ShareConfig {
+	changed := c
+	fields := reflect.ValueOf(&changed).Elem()
+	for _, name := range ch.unset {
+		if i, ok := settingField(name); ok {
+			f := fields.Field(i)
+			f.Set(reflect.Zero(f.Type()))
+		}
+	}
+	changed.Ignore = removeValues(changed.Ignore, ch.remove.Ignore)
+	changed.Trusted = removeValues(changed.Trusted, ch.remove.Trusted)
+	changed.Mirrors = removeValues(changed.Mirrors, ch.remove.Mirrors)
+	changed.Sequential = removeValues(changed.Sequential, ch.remove.Sequential)
+	changed.Webhooks = removeValues(changed.Webhooks, ch.remove.Webhooks)
+	changed.WebhookEvents = removeValues(changed.WebhookEvents, ch.remove.WebhookEvents)
+	return changed.merge(ch.set)
+}
+
+// settingField returns the index in ShareConfig of the setting with the
+// given JSON name.
+func settingField(name string) (int, bool) {
+	t := reflect.TypeOf(ShareConfig{})
+	for i := 0; i < t.NumField(); i++ {
+		if strings.Split(t.Field(i).Tag.Get("json"), ",")[0] == name {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// settingNames returns the JSON names of all settings.
+func settingNames() []string {
+	t := reflect.TypeOf(ShareConfig{})
+	names := make([]string, t.NumField())
+	for i := range names {
+		names[i] = strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+	}
+	return names
+}
+
+// removeValues returns list without values, in a new slice.
+func removeValues(list, values []string) []string {
+	var kept []string
+	for _, l := range list {
+		found := false
+		for _, v := range values {
+			if l == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			kept = append(kept, l)
+		}
+	}
+	return kept
+}
+
+// appendMissing appends to list the values it doesn't hold yet.
+func appendMissing(list []string, values ...string) []string {
+	for _, v := range values {
+		found := false
+		for _, l := range list {
+			if l == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// scanInterval returns how often the shared directory must be scanned.
+func (c ShareConfig) scanInterval() time.Duration {
+	if c.ScanInterval > 0 {
+		return time.Duration(c.ScanInterval)
+	}
+	return *rescanInterval
+}
+
+// swarmSize is how many peers a share looks for, and accepts at most.
+type swarmSize struct {
+	target int
+	max    int
+}
+
+func (c ShareConfig) swarmSize() swarmSize {
+	size := swarmSize{target: TARGET_NUM_PEERS, max: MAX_NUM_PEERS}
+	if c.MaxPeers > 0 {
+		size.max = c.MaxPeers
+	}
+	if c.TargetPeers > 0 {
+		size.target = c.TargetPeers
+	}
+	if size.target > size.max {
+		size.target = size.max
+	}
+	return size
+}
+
+// storeOptions is how a share accesses its files.
+type storeOptions struct {
+	storage    string
+	url        string
+	allocation string
+	versions   time.Duration // Retention of replaced files, if positive
+	sequential []string      // Patterns of the files downloaded in order
+	sealed     bool          // Whether writers publish sealed copies of the pieces
+
+	// Where the check of the pieces on disk reports its progress, if anywhere
+	verifying *VerifyProgress
+}
+
+func (c ShareConfig) storeOptions() storeOptions {
+	opts := storeOptions{storage: c.Storage, url: c.StorageURL, allocation: c.Allocation, versions: *keepVersions}
+	if c.KeepVersions != 0 {
+		opts.versions = time.Duration(c.KeepVersions)
+	}
+	opts.sequential = c.Sequential
+	opts.sealed = c.Sealed
+	if *sequentialAll {
+		opts.sequential = []string{"*"}
+	}
+	return opts
+}
+
+// ignored tells whether the file at relPath, relative to the shared
+// directory, must be left out of the share.
+func (c ShareConfig) ignored(relPath string) bool {
+	return matchPatterns(c.Ignore, relPath)
+}
+
+// matchPatterns tells whether the base name or the whole of relPath
+// matches one of patterns.
+func matchPatterns(patterns []string, relPath string) bool {
+	base := filepath.Base(relPath)
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, base); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(pattern, relPath); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestShareConfigMerge(t *testing.T) {
+	profile := ShareConfig{
+		Ignore:       []string{"*.tmp"},
+		ScanInterval: duration(time.Minute),
+		NoWatch:      true,
+		UploadRate:   1000,
+		Sequential:   []string{"*.mkv"},
+		SeedRatio:    2,
+		Webhooks:     []string{"https://a.example.com", "https://b.example.com"},
+	}
+	share := ShareConfig{
+		Profile:    "photos",
+		Ignore:     []string{"raw"},
+		UploadRate: -1,
+		Sequential: []string{"*.mp4"},
+		SeedTime:   duration(time.Hour),
+		Webhooks:   []string{"https://b.example.com", "https://c.example.com"},
+	}
+
+	expected := ShareConfig{
+		Profile:      "photos",
+		Ignore:       []string{"*.tmp", "raw"},
+		ScanInterval: duration(time.Minute),
+		NoWatch:      true,
+		UploadRate:   -1,
+		Sequential:   []string{"*.mkv", "*.mp4"},
+		SeedRatio:    2,
+		SeedTime:     duration(time.Hour),
+		Webhooks:     []string{"https://a.example.com", "https://b.example.com", "https://c.example.com"},
+	}
+	if merged := profile.merge(share); !reflect.DeepEqual(merged, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, merged)
+	}
+}
+
+func TestShareConfigIgnored(t *testing.T) {
+	cfg := ShareConfig{Ignore: []string{"*.tmp", "build/*"}}
+	vectors := map[string]bool{
+		"a.tmp":         true,
+		"dir/b.tmp":     true,
+		"build/out":     true,
+		"src/build/out": false,
+		"main.go":       false,
+	}
+	for path, expected := range vectors {
+		if got := cfg.ignored(path); got != expected {
+			t.Errorf("%s: expected ignored=%v, got %v", path, expected, got)
+		}
+	}
+}
+
+func TestShareConfigJSON(t *testing.T) {
+	cfg := ShareConfig{Profile: "code", ScanInterval: duration(30 * time.Second)}
+	raw, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(raw) != `{"profile":"code","scanInterval":"30s"}` {
+		t.Fatalf("Unexpected encoding: %s", raw)
+	}
+
+	var decoded ShareConfig
+	if err := json.Unmarshal(raw, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, cfg) {
+		t.Fatalf("Expected %+v, got %+v", cfg, decoded)
+	}
+}
+
+func TestShareConfigSwarmSize(t *testing.T) {
+	vectors := []struct {
+		cfg      ShareConfig
+		expected swarmSize
+	}{
+		{ShareConfig{}, swarmSize{TARGET_NUM_PEERS, MAX_NUM_PEERS}},
+		{ShareConfig{MaxPeers: 10}, swarmSize{10, 10}},
+		{ShareConfig{TargetPeers: 50, MaxPeers: 300}, swarmSize{50, 300}},
+		{ShareConfig{TargetPeers: 5}, swarmSize{5, MAX_NUM_PEERS}},
+	}
+	for _, vec := range vectors {
+		if got := vec.cfg.swarmSize(); got != vec.expected {
+			t.Errorf("%+v: expected %+v, got %+v", vec.cfg, vec.expected, got)
+		}
+	}
+
+	merged := ShareConfig{MaxPeers: 10}.merge(ShareConfig{TargetPeers: 5})
+	if merged.MaxPeers != 10 || merged.TargetPeers != 5 {
+		t.Errorf("Expected both settings to be kept, got %+v", merged)
+	}
+}
+
+func TestConfigApply(t *testing.T) {
+	cfg := ShareConfig{
+		Profile:    "photos",
+		Ignore:     []string{"*.tmp", "*.bak"},
+		NoWatch:    true,
+		Admin:      true,
+		UploadRate: 1024,
+		Trusted:    []string{"192.0.2.1:7777"},
+		Webhooks:   []string{"https://hooks.example.com/a"},
+	}
+	vectors := []struct {
+		change   configChange
+		expected ShareConfig
+	}{
+		{configChange{set: ShareConfig{MaxPeers: 10, Ignore: []string{"*.log"}}}, ShareConfig{
+			Profile: "photos", Ignore: []string{"*.tmp", "*.bak", "*.log"}, NoWatch: true, Admin: true, UploadRate: 1024,
+			Trusted: []string{"192.0.2.1:7777"}, Webhooks: []string{"https://hooks.example.com/a"}, MaxPeers: 10,
+		}},
+		{configChange{unset: []string{"noWatch", "admin", "uploadRate", "profile"}}, ShareConfig{
+			Ignore: []string{"*.tmp", "*.bak"}, Trusted: []string{"192.0.2.1:7777"}, Webhooks: []string{"https://hooks.example.com/a"},
+		}},
+		{configChange{remove: ShareConfig{Ignore: []string{"*.tmp"}, Trusted: []string{"192.0.2.1:7777"}, Webhooks: []string{"https://hooks.example.com/a"}}}, ShareConfig{
+			Profile: "photos", Ignore: []string{"*.bak"}, NoWatch: true, Admin: true, UploadRate: 1024,
+		}},
+		// Settings are unset before they are set
+		{configChange{unset: []string{"uploadRate"}, set: ShareConfig{UploadRate: 2048}}, ShareConfig{
+			Profile: "photos", Ignore: []string{"*.tmp", "*.bak"}, NoWatch: true, Admin: true, UploadRate: 2048,
+			Trusted: []string{"192.0.2.1:7777"}, Webhooks: []string{"https://hooks.example.com/a"},
+		}},
+	}
+	for i, vec := range vectors {
+		if got := cfg.apply(vec.change); !reflect.DeepEqual(got, vec.expected) {
+			t.Errorf("%d: expected %+v, got %+v", i, vec.expected, got)
+		}
+	}
+	if len(cfg.Ignore) != 2 || !cfg.NoWatch {
+		t.Errorf("Expected the original settings to be left alone, got %+v", cfg)
+	}
+
+	if _, ok := settingField("trustedOnly"); !ok {
+		t.Error("Expected trustedOnly to be a setting")
+	}
+	if _, ok := settingField("nothing"); ok {
+		t.Error("Expected nothing not to be a setting")
+	}
+}
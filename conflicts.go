@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/rakoo/rakoshare/pkg/sharesession"
+	"github.com/zeebo/bencode"
+)
+
+// The size and modification time of the files of the last revision we
+// had in full, to tell which ones were changed locally since
+const settingSyncedFiles = "synced-files"
+
+var unsafePeerChars = regexp.MustCompile(`[^A-Za-z0-9.-]+`)
+
+// conflictName returns the name under which the local version of path is
+// kept when peer sent another one, as name.conflict-<peer>-<timestamp>.
+func conflictName(path, peer string, now time.Time) string {
+	return path + ".conflict-" + unsafePeerChars.ReplaceAllString(peer, "_") + "-" + now.Format("20060102-150405")
+}
+
+// syncedFile is how a file was when we last had its revision in full.
+type syncedFile struct {
+	Size    int64 `bencode:"size"`
+	ModTime int64 `bencode:"modtime"`
+}
+
+// changedSince tells whether the file described by st is not as it was
+// in synced, or, if we don't know how the files were, whether it was
+// modified after since.
+func changedSince(rel string, st os.FileInfo, synced map[string]syncedFile, since time.Time) bool {
+	if synced == nil {
+		return st.ModTime().After(since)
+	}
+	f, ok := synced[rel]
+	return !ok || f.Size != st.Size() || f.ModTime != st.ModTime().UnixNano()
+}
+
+// syncedState keeps how the files of a share were when it last had a
+// revision in full, and since when. It is nil-safe: without a session
+// nothing is kept.
+type syncedState struct {
+	session *sharesession.Session
+}
+
+// files returns how the files were, by path relative to the shared
+// folder, or nil if it was never recorded.
+func (s *syncedState) files() map[string]syncedFile {
+	if s == nil {
+		return nil
+	}
+	raw := s.session.GetSetting(settingSyncedFiles)
+	if raw == "" {
+		return nil
+	}
+	var files map[string]syncedFile
+	if err := bencode.NewDecoder(strings.NewReader(raw)).Decode(&files); err != nil {
+		return nil
+	}
+	if files == nil {
+		files = make(map[string]syncedFile)
+	}
+	return files
+}
+
+// record keeps how the files of info are in dir, now that we have them
+// all.
+func (s *syncedState) record(dir string, info *InfoDict) {
+	if s == nil {
+		return
+	}
+	files := make(map[string]syncedFile)
+	for _, f := range info.fileList() {
+		rel := filepath.Clean("/" + filepath.Join(f.Path...))[1:]
+		st, err := os.Stat(filepath.Join(dir, rel))
+		if err != nil || !st.Mode().IsRegular() {
+			continue
+		}
+		files[rel] = syncedFile{Size: st.Size(), ModTime: st.ModTime().UnixNano()}
+	}
+	var buf bytes.Buffer
+	err := bencode.NewEncoder(&buf).Encode(files)
+	if err == nil {
+		err = s.session.SetSetting(settingSyncedFiles, buf.String())
+	}
+	if err != nil {
+		log.Println("Couldn't record the state of the files:", err)
+	}
+}
+
+// keepConflicts renames the files of dir changed since the last revision
+// we had in full, as told by synced, and that info, the revision of peer,
+// would overwrite with other contents. Without synced, files modified
+// after since are considered changed. Both versions are kept that way,
+// and the copy is shared with the next local revision. It returns the
+// names of the copies, relative to dir.
+func keepConflicts(dir string, info *InfoDict, since time.Time, synced map[string]syncedFile, peer string, now time.Time) (copies []string) {
+	ignored := loadIgnoreFile(dir)
+	for _, f := range info.fileList() {
+		rel := filepath.Clean("/" + filepath.Join(f.Path...))[1:]
+		if ignored.match(rel) {
+			// Never overwritten
+			continue
+		}
+		path := filepath.Join(dir, rel)
+		st, err := os.Stat(path)
+		if err != nil || !st.Mode().IsRegular() || !changedSince(rel, st, synced, since) {
+			continue
+		}
+		if st.Size() == f.Length {
+			algo, expected, ok := expectedChecksum(f)
+			if !ok {
+				// Without a checksum, assume it's the same
+				continue
+			}
+			if sum, err := fileChecksum(path, algo); err == nil && sum == expected {
+				continue
+			}
+		}
+
+		name := conflictName(path, peer, now)
+		if err := os.Rename(path, name); err != nil {
+			log.Printf("Couldn't keep the local version of %s: %s", rel, err)
+			continue
+		}
+		rel, _ = filepath.Rel(dir, name)
+		raiseAlert("conflict", "%s was changed here and by %s, the local version is kept as %s", filepath.Join(f.Path...), peer, rel)
+		copies = append(copies, rel)
+	}
+	return
+}
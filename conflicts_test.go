@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeepConflicts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conflicts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	since := time.Now().Add(-time.Hour)
+	for _, name := range []string{"changed", "same", "old"} {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte("local"), 0600)
+	}
+	os.Chtimes(filepath.Join(dir, "old"), since.Add(-time.Hour), since.Add(-time.Hour))
+	same, err := fileChecksum(filepath.Join(dir, "same"), "sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := &InfoDict{Files: []*FileDict{
+		{Path: []string{"changed"}, Length: 6, Checksum: same},
+		{Path: []string{"same"}, Length: 5, Checksum: same},
+		{Path: []string{"old"}, Length: 6, Checksum: same},
+		{Path: []string{"missing"}, Length: 6, Checksum: same},
+	}}
+
+	now := time.Date(2015, 3, 14, 15, 9, 26, 0, time.UTC)
+	copies := keepConflicts(dir, info, since, nil, "[::1]:7000", now)
+	expected := "changed.conflict-_1_7000-20150314-150926"
+	if len(copies) != 1 || copies[0] != expected {
+		t.Fatalf("Expected a copy of the changed file, got %v", copies)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, expected)); err != nil || string(data) != "local" {
+		t.Errorf("Expected the local version in the copy, got %q, %v", data, err)
+	}
+	for _, name := range []string{"same", "old"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("Expected %s to stay: %s", name, err)
+		}
+	}
+}
+
+func TestKeepConflictsSynced(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conflicts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"downloaded", "edited"} {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte("local"), 0600)
+	}
+	synced := make(map[string]syncedFile)
+	for _, name := range []string{"downloaded", "edited"} {
+		st, _ := os.Stat(filepath.Join(dir, name))
+		synced[name] = syncedFile{Size: st.Size(), ModTime: st.ModTime().UnixNano()}
+	}
+	ioutil.WriteFile(filepath.Join(dir, "edited"), []byte("edited here"), 0600)
+	info := &InfoDict{Files: []*FileDict{
+		{Path: []string{"downloaded"}, Length: 6},
+		{Path: []string{"edited"}, Length: 6},
+	}}
+
+	// Files downloaded after the last revision started are recent, but
+	// weren't changed since we had them
+	copies := keepConflicts(dir, info, time.Now().Add(-time.Hour), synced, "peer", time.Now())
+	if len(copies) != 1 || !strings.HasPrefix(copies[0], "edited.conflict-") {
+		t.Fatalf("Expected a copy of the edited file only, got %v", copies)
+	}
+}
@@ -1,12 +1,20 @@
 package main
 
 import (
+	"flag"
 	"net"
 	"time"
 
 	"github.com/dchest/spipe"
 )
 
+var (
+	dialTimeout      = flag.Duration("dialTimeout", 10*time.Second, "Maximum time to establish a TCP connection to a peer")
+	handshakeTimeout = flag.Duration("handshakeTimeout", 10*time.Second, "Maximum time for the encrypted handshake and the header exchange with a peer")
+	connectTimeout   = flag.Duration("connectTimeout", 30*time.Second, "Maximum total time of one connection attempt to a peer")
+	writeTimeout     = flag.Duration("writeTimeout", time.Minute, "Maximum time to send data to a peer before giving up on it")
+)
+
 type BufferedSpipeConn struct {
 	net.Conn
 	packets chan []byte
@@ -20,9 +28,25 @@ func newBufferedSpipeConn(conn net.Conn) BufferedSpipeConn {
 		var buf [1024]byte
 		buflen := 0
 
+		// Once a write failed, the connection is closed so that its
+		// reader notices, and everything else is dropped
+		failed := false
+		write := func(b []byte) {
+			if failed {
+				return
+			}
+			conn.SetWriteDeadline(time.Now().Add(*writeTimeout))
+			if _, err := conn.Write(b); err != nil {
+				failed = true
+				conn.Close()
+			}
+		}
+
 		// experimentally, the callers don't batch faster than every
 		// 10ms, so 50ms is a safe amount of time to wait
-		tick := time.Tick(50 * time.Millisecond)
+		ticker := time.NewTicker(50 * time.Millisecond)
+		defer ticker.Stop()
+		tick := ticker.C
 
 		for {
 			select {
@@ -34,11 +58,11 @@ func newBufferedSpipeConn(conn net.Conn) BufferedSpipeConn {
 				}
 
 				copy(buf[buflen:], packet[:1024-buflen])
-				conn.Write(buf[:])
+				write(buf[:])
 
 				packet = packet[1024-buflen:]
 				for len(packet) > 1024 {
-					conn.Write(packet[:1024])
+					write(packet[:1024])
 					packet = packet[1024:]
 				}
 
@@ -48,7 +72,7 @@ func newBufferedSpipeConn(conn net.Conn) BufferedSpipeConn {
 					break
 				}
 
-				conn.Write(buf[:buflen])
+				write(buf[:buflen])
 				buflen = 0
 			case <-bsc.quit:
 				return
@@ -71,11 +95,50 @@ func (bsc BufferedSpipeConn) Close() error {
 	return bsc.Conn.Close()
 }
 
-func NewTCPConn(key []byte, peer string) (conn net.Conn, err error) {
-	sconn, err := spipe.Dial(key, "tcp", peer)
+// handshakeError is returned by NewTCPConn when peer could be reached
+// but didn't complete the encrypted handshake, such as when it doesn't
+// listen on the channel.
+type handshakeError struct {
+	error
+}
+
+// NewTCPConn opens an encrypted connection to peer on the given channel.
+// The connection has a deadline, for the caller to exchange headers; it
+// must be lifted with handshakeDone.
+func NewTCPConn(channel byte, key []byte, peer string) (conn net.Conn, err error) {
+	start := time.Now()
+	timeout := *dialTimeout
+	if *connectTimeout < timeout {
+		timeout = *connectTimeout
+	}
+
+	// Go through the proxy, if any
+	c, err := proxyNetDialTimeout("tcp", peer, timeout)
 	if err != nil {
 		return
 	}
+	deadline := time.Now().Add(*handshakeTimeout)
+	if capped := start.Add(*connectTimeout); capped.Before(deadline) {
+		deadline = capped
+	}
+	c.SetDeadline(deadline)
+
+	if _, err = c.Write([]byte{channel}); err != nil {
+		c.Close()
+		return
+	}
+	sconn := spipe.Client(key, c)
+	if err = sconn.Handshake(); err != nil {
+		handshakeFailed(false)
+		c.Close()
+		return nil, handshakeError{err}
+	}
 
 	return newBufferedSpipeConn(sconn), nil
 }
+
+// handshakeDone lifts the deadline of a connection once headers are
+// exchanged.
+func handshakeDone(conn net.Conn) {
+	conn.SetDeadline(time.Time{})
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSilentPeerTimesOut(t *testing.T) {
+	defer func(d time.Duration) { *handshakeTimeout = d }(*handshakeTimeout)
+	*handshakeTimeout = 100 * time.Millisecond
+
+	// A peer that accepts connections but never says anything
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	start := time.Now()
+	conn, err := NewTCPConn(channelData, make([]byte, 32), listener.Addr().String())
+	if err == nil {
+		_, err = readHeader(conn)
+		conn.Close()
+	}
+	if err == nil {
+		t.Fatal("Expected the connection to a silent peer to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("Gave up after %s, expected about %s", elapsed, *handshakeTimeout)
+	}
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"bytes"
-	"crypto/sha1"
 	"errors"
 	"flag"
 	"fmt"
@@ -14,12 +13,13 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rakoo/rakoshare/pkg/id"
 	"github.com/rakoo/rakoshare/pkg/sharesession"
 
-	ed "github.com/agl/ed25519"
 	"github.com/nictuku/dht"
 	"github.com/zeebo/bencode"
 )
@@ -34,89 +34,185 @@ var (
 var useDHT = flag.Bool("useDHT", true, "Use DHT to get peers")
 
 type ControlSession struct {
+	// Bytes transferred by the data torrents of this share, reported to
+	// trackers. Accessed atomically, so they must stay first in the
+	// struct.
+	uploaded   int64
+	downloaded int64
+
 	ID     id.Id
 	Port   int
 	PeerID string
 
 	// A channel of all announces we get from peers.
 	// If the announce is for the same torrent as the current one, then it
-	// is not broadcasted in this channel.
-	Torrents chan Announce
+	// is not broadcasted in this channel. The newest announce waits in a
+	// queue until it is received.
+	Torrents  <-chan Announce
+	announces *announceQueue
 
 	// A channel of all new peers we acknowledge, in a ip:port format
 	// The port is the one advertised
 	NewPeers chan string
 
-	// The current data torrent
-	currentIH string
-	rev       string
+	// Verified summaries of revisions, as peers send them. Summaries are
+	// dropped when nobody is listening.
+	Summaries chan ShareSummary
+
+	// Verified admin commands from writers of the share
+	Admin        chan adminRequest
+	adminNonces  *adminNonces
+	adminWaiters *adminWaiters
+
+	// As of the last rechoke tick
+	peerStats peerStatsSnapshot
+
+	// The current data torrent. SetCurrent changes it from the main loop
+	// under currentLock, so that the control loop can read it.
+	currentLock sync.Mutex
+	currentIH   string
+	rev         Revision
+
+	// The highest revision seen from each writer
+	highest *highestRevisions
+
+	// Version of the last description of the share sent to peers
+	aboutVersion int64
+
+	// Number of key rotations sent to peers, and whether one of them
+	// revoked our read key
+	rotations int
+	revoked   bool
+
+	// Guards changes of ID by rotations, which torrent sessions read
+	idLock sync.Mutex
+
+	// Returns the ids of the share as they are stored, if not in the
+	// session. Guarded by idLock.
+	loadID func() id.Id
+
+	// Signalled when a rotation of the read key retired our write keys,
+	// and the share must stop
+	Retired chan struct{}
+
+	// The last sealed revision the writers published, which the main
+	// loop reads, and the one last sent to peers
+	Sealed     chan SealedMessage
+	sealedLock sync.Mutex
+	sealed     SealedMessage
+	sealedSent string
+
+	// Where changes of revision are recorded, see audit.go, and the peer
+	// that announced the revision to adopt
+	auditPath     string
+	announcerLock sync.Mutex
+	announcer     auditAnnouncer
+
+	// Where events of the share are sent
+	events *eventNotifier
 
 	ourExtensions   map[int]string
 	header          []byte
 	quit            chan struct{}
+	done            chan struct{}
 	dht             *dht.DHT
-	peers           *Peers
 	peerMessageChan chan peerMessage
+	monitor         *loopMonitor
+	dials           *dialQueue
+	trusted         *trustedPeers
+	swarm           swarmSize
 
-	trackers []string
+	// Only the main loop adds or removes peers, and sends them messages:
+	// other goroutines hand it new connections and admin commands.
+	// Others may read the list, peers don't change their address.
+	peers    *Peers
+	newConns chan *btConn
+	adminOut chan adminOutgoing
+
+	trackers      []string
+	trackerClient trackerClient
 
 	session *sharesession.Session
 }
 
-func NewControlSession(shareid id.Id, listenPort int, session *sharesession.Session, trackers []string) (*ControlSession, error) {
+func NewControlSession(shareid id.Id, listenPort int, session *sharesession.Session, trackers []string, trusted *trustedPeers, swarm swarmSize) (*ControlSession, error) {
 	sid := "-tt" + strconv.Itoa(os.Getpid()) + "_" + strconv.FormatInt(rand.Int63(), 10)
 
-	// TODO: UPnP UDP port mapping.
-	cfg := dht.NewConfig()
-	cfg.Port = listenPort
-	cfg.NumTargetPeers = TARGET_NUM_PEERS
-
-	dhtNode, err := dht.New(cfg)
-	if err != nil {
-		log.Fatal("DHT node creation error", err)
+	// DHT traffic is UDP, which neither the SOCKS5 proxy nor I2P streams
+	// carry: using it would reveal our address to the world.
+	var dhtNode *dht.DHT
+	var err error
+	if *useDHT && !useProxy() && !*useI2P {
+		// TODO: UPnP UDP port mapping.
+		cfg := dht.NewConfig()
+		cfg.Port = listenPort
+		cfg.NumTargetPeers = swarm.target
+
+		dhtNode, err = dht.New(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("DHT node creation error: %s", err)
+		}
+	} else if *useDHT {
+		log.Println("[CONTROL] Not using DHT, it can't go through the proxy or I2P")
 	}
 
-	current := session.GetCurrentIHMessage()
-	var currentIhMessage IHMessage
-	err = bencode.NewDecoder(strings.NewReader(current)).Decode(&currentIhMessage)
+	currentIhMessage, err := decodeIHMessage(session.GetCurrentIHMessage())
 	if err != nil {
 		log.Printf("Couldn't decode current message, starting from scratch: %s\n", err)
 	}
 
-	rev := "0-"
-	if currentIhMessage.Info.Rev != "" {
-		parts := strings.Split(currentIhMessage.Info.Rev, "-")
-		if len(parts) == 2 {
-			if _, err := strconv.Atoi(parts[0]); err == nil {
-				rev = currentIhMessage.Info.Rev
-			}
-		}
-	}
-
 	cs := &ControlSession{
 		Port:            listenPort,
 		PeerID:          sid[:20],
 		ID:              shareid,
-		Torrents:        make(chan Announce),
 		NewPeers:        make(chan string),
+		Summaries:       make(chan ShareSummary, 1),
+		Admin:           make(chan adminRequest, 4),
+		Sealed:          make(chan SealedMessage, 4),
+		Retired:         make(chan struct{}, 1),
+		adminNonces:     newAdminNonces(),
+		adminWaiters:    newAdminWaiters(),
 		dht:             dhtNode,
 		peerMessageChan: make(chan peerMessage),
+		newConns:        make(chan *btConn),
+		adminOut:        make(chan adminOutgoing),
 		quit:            make(chan struct{}),
+		done:            make(chan struct{}),
 		ourExtensions: map[int]string{
 			1: "ut_pex",
 			2: "bs_metadata",
+			3: "bs_summary",
+			4: "bs_about",
+			5: "bs_admin",
+			6: "bs_rotation",
+			7: "bs_sealed",
 		},
-		peers: newPeers(),
+		peers:   newPeers(),
+		monitor: newLoopMonitor("control"),
+		trusted: trusted,
+		swarm:   swarm,
 
 		currentIH: currentIhMessage.Info.InfoHash,
-		rev:       rev,
+		rev:       currentIhMessage.Info.Rev,
 
-		trackers: trackers,
+		trackers:      trackers,
+		trackerClient: NewTrackerClient("", [][]string{trackers}),
 
 		session: session,
 	}
-	go cs.dht.Run()
-	cs.dht.PeersRequest(string(cs.ID.Infohash), true)
+	if about, ok := storedAbout(session); ok {
+		cs.aboutVersion = about.About.Version
+	}
+	cs.highest = loadHighestRevisions(session)
+	cs.broadcastRotations()
+	cs.announces = newAnnounceQueue(session, cs.done)
+	cs.Torrents = cs.announces.out
+	cs.dials = newDialQueue(*maxHalfOpen, cs.connectToPeer)
+
+	if cs.dht != nil {
+		go cs.dht.Run()
+		cs.dht.PeersRequest(string(cs.ID.Infohash), true)
+	}
 
 	go cs.Run()
 
@@ -138,7 +234,9 @@ func (cs *ControlSession) Header() (header []byte) {
 
 	header = make([]byte, 68)
 	copy(header, kBitTorrentHeader[0:])
-	header[27] = header[27] | 0x01
+	if cs.dht != nil {
+		header[27] = header[27] | 0x01
+	}
 	// Support Extension Protocol (BEP-0010)
 	header[25] |= 0x10
 
@@ -150,47 +248,54 @@ func (cs *ControlSession) Header() (header []byte) {
 	return
 }
 
-func (cs *ControlSession) deadlockDetector(heartbeat, quit chan struct{}) {
-	lastHeartbeat := time.Now()
-
-deadlockLoop:
-	for {
-		select {
-		case <-quit:
-			break deadlockLoop
-		case <-heartbeat:
-			lastHeartbeat = time.Now()
-		case <-time.After(15 * time.Second):
-			age := time.Now().Sub(lastHeartbeat)
-			cs.log("Starvation or deadlock of main thread detected. Look in the stack dump for what Run() is currently doing.")
-			cs.log("Last heartbeat", age.Seconds(), "seconds ago")
-			panic("Killed by deadlock detector")
-		}
-	}
-}
+// Run runs the main loop of the session until it quits, restarting it if
+// it crashes.
 func (cs *ControlSession) Run() {
+	supervise("control", cs.quit, cs.run)
+}
+
+func (cs *ControlSession) run() error {
 	// deadlock
 	heartbeat := make(chan struct{}, 1)
 	quitDeadlock := make(chan struct{})
-	go cs.deadlockDetector(heartbeat, quitDeadlock)
-
-	rechokeChan := time.Tick(10 * time.Second)
-	verboseChan := time.Tick(10 * time.Minute)
-	keepAliveChan := time.Tick(60 * time.Second)
-
-	// Start out polling tracker every 20 seconds until we get a response.
-	// Maybe be exponential backoff here?
-	retrackerChan := time.Tick(20 * time.Second)
-	trackerInfoChan := make(chan *TrackerResponse)
+	defer close(quitDeadlock)
+	go watchLoop("control", cs.monitor, heartbeat, quitDeadlock)
+
+	timers := newTimerManager()
+	defer timers.StopAll()
+	rechokeChan := timers.Ticker("rechoke", *rechokeInterval)
+	verboseChan := timers.Ticker("verbose", *verboseInterval)
+	keepAliveChan := timers.Ticker("keepalive", *keepAliveInterval)
+
+	// Start out polling trackers with exponential backoff until one of
+	// them answers, then at the interval it asks for.
+	trackerClient := cs.trackerClient
+	trackerInfoChan := trackerClient.trackerInfoChan
+	retrackerBackoff := &backoff{Min: *retrackMin, Max: *retrackMax, Jitter: 0.25}
+	var dhtResults chan map[dht.InfoHash][]string
+	if cs.dht != nil {
+		dhtResults = cs.dht.PeersRequestResults
+	}
 
-	trackerClient := NewTrackerClient("", [][]string{cs.trackers})
-	trackerClient.Announce(cs.makeClientStatusReport("started"))
+	var retrackerChan <-chan time.Time
+	// Whether an announce is running: slow trackers must not pile them up
+	announcing := false
+	if trackerClient.HasTrackers() {
+		retrackerChan = timers.Ticker("retracker", retrackerBackoff.Next())
+		trackerClient.Announce(cs.makeClientStatusReport("started"))
+		announcing = true
+	}
 
 	for {
 		select {
 		case <-retrackerChan:
+			if announcing {
+				cs.log("Still waiting for trackers, skipping this announce")
+				break
+			}
 			trackerClient.Announce(cs.makeClientStatusReport(""))
-		case dhtInfoHashPeers := <-cs.dht.PeersRequestResults:
+			announcing = true
+		case dhtInfoHashPeers := <-dhtResults:
 			newPeerCount := 0
 			// key = infoHash. The torrent client currently only
 			// supports one download at a time, so let's assume
@@ -204,6 +309,15 @@ func (cs *ControlSession) Run() {
 				}
 			}
 		case ti := <-trackerInfoChan:
+			announcing = false
+			if ti == nil {
+				wait := retrackerBackoff.Next()
+				cs.log("No tracker answered, trying again in", wait)
+				timers.SetInterval("retracker", wait)
+				break
+			}
+			retrackerBackoff.Reset()
+
 			cs.logf("Got response from tracker: %#v\n", ti)
 			newPeerCount := 0
 			for _, peer := range ti.Peers {
@@ -225,9 +339,12 @@ func (cs *ControlSession) Run() {
 				interval = 24 * 3600
 			}
 			cs.log("..checking again in", interval, "seconds.")
-			retrackerChan = time.Tick(interval * time.Second)
-			cs.log("Contacting", newPeerCount, "new peers")
+			timers.SetInterval("retracker", interval*time.Second)
 
+		case btconn := <-cs.newConns:
+			cs.addPeer(btconn)
+		case out := <-cs.adminOut:
+			cs.sendAdmin(out)
 		case pm := <-cs.peerMessageChan:
 			peer, message := pm.peer, pm.message
 			peer.lastReadTime = time.Now()
@@ -238,74 +355,128 @@ func (cs *ControlSession) Run() {
 				}
 				cs.ClosePeer(peer)
 			}
-		case <-rechokeChan:
-			// TODO: recalculate who to choke / unchoke
+		case tick := <-rechokeChan:
+			// No choking here: peers only exchange small control messages
+			cs.monitor.Heartbeat(tick)
 			heartbeat <- struct{}{}
-			if cs.peers.Len() < TARGET_NUM_PEERS {
+			if cs.dht != nil && cs.peers.Len() < cs.swarm.target {
 				go cs.dht.PeersRequest(string(cs.ID.Infohash), true)
 			}
+			// The about command may have changed the description
+			cs.broadcastAbout()
+			cs.broadcastRotations()
+			cs.broadcastSealed()
+			cs.peerStats.update(cs.peers, peerChannelControl)
 		case <-verboseChan:
 			cs.log("Peers:", cs.peers.Len())
 		case <-keepAliveChan:
 			now := time.Now()
+			for _, peer := range auditPeers(cs.peers, now) {
+				cs.log("Closing half-dead peer", peer.address)
+				cs.ClosePeer(peer)
+			}
 
 			for _, peer := range cs.peers.All() {
-				if peer.lastReadTime.Second() != 0 && now.Sub(peer.lastReadTime) > 3*time.Minute {
+				if peer.idle(now) {
 					// log.Println("Closing peer", peer.address, "because timed out.")
 					cs.ClosePeer(peer)
 					continue
 				}
+				if peer.writeStalled(now) {
+					cs.log("Closing peer", peer.address, "because it stalled on writes")
+					stalledPeers.Add(1)
+					cs.ClosePeer(peer)
+					continue
+				}
 				go peer.keepAlive(now)
 			}
 
 		case <-cs.quit:
 			cs.log("Quitting torrent session")
-			quitDeadlock <- struct{}{}
-			return
+			return nil
 		}
 	}
 
 }
 
+// PeerStats returns the statistics of the peers as of the last rechoke
+// tick.
+func (cs *ControlSession) PeerStats() []PeerStats {
+	return cs.peerStats.get()
+}
+
+// Quit stops the session: re-announces and reconnections stop, peers are
+// disconnected and trackers are told we're leaving so they stop handing
+// out our address.
 func (cs *ControlSession) Quit() error {
 	cs.quit <- struct{}{}
+	close(cs.done)
+	cs.dials.Close()
 	for _, peer := range cs.peers.All() {
 		cs.ClosePeer(peer)
 	}
+	cs.trackerClient.Close()
+	cs.trackerClient.AnnounceSync(cs.makeClientStatusReport("stopped"), 5*time.Second)
 	if cs.dht != nil {
 		cs.dht.Stop()
 	}
 	return nil
 }
 
+// AddTransferred accounts for the bytes transferred by a data torrent of
+// this share.
+func (cs *ControlSession) AddTransferred(uploaded, downloaded int64) {
+	atomic.AddInt64(&cs.uploaded, uploaded)
+	atomic.AddInt64(&cs.downloaded, downloaded)
+}
+
 func (cs *ControlSession) makeClientStatusReport(event string) ClientStatusReport {
-	return ClientStatusReport{
-		Event:    event,
-		InfoHash: string(cs.ID.Infohash),
-		PeerId:   cs.PeerID,
-		Port:     cs.Port,
-	}
+	report := ClientStatusReport{
+		Event:      event,
+		InfoHash:   string(cs.ID.Infohash),
+		PeerId:     cs.PeerID,
+		Port:       cs.Port,
+		Uploaded:   atomic.LoadInt64(&cs.uploaded),
+		Downloaded: atomic.LoadInt64(&cs.downloaded),
+	}
+	// Behind a proxy, our real address must stay hidden
+	if !useProxy() {
+		report.IPv6 = localIPv6Address()
+	}
+	return report
 }
 
-func (cs *ControlSession) connectToPeer(peer string) {
-	conn, err := NewTCPConn([]byte(cs.ID.Psk[:]), peer)
+func (cs *ControlSession) connectToPeer(peer string) error {
+	// It may have connected to us while it was queued
+	if cs.peers.Know(peer, "") {
+		return nil
+	}
+	// The blocklist may have changed meanwhile
+	if isBlocked(peer) {
+		return nil
+	}
+	conn, err := NewTCPConn(channelControl, cs.ID.Psk[:], peer)
 	if err != nil {
 		// log.Println("Failed to connect to", peer, err)
-		return
+		return err
 	}
 
 	header := cs.Header()
 	_, err = conn.Write(header)
 	if err != nil {
 		cs.log("Failed to send header to", peer, err)
-		return
+		conn.Close()
+		return err
 	}
 
 	theirheader, err := readHeader(conn)
 	if err != nil {
 		// log.Printf("Failed to read header from %s: %s\n", peer, err)
-		return
+		handshakeFailed(false)
+		conn.Close()
+		return err
 	}
+	handshakeDone(conn)
 
 	peersInfoHash := string(theirheader[8:28])
 	id := string(theirheader[28:48])
@@ -313,7 +484,7 @@ func (cs *ControlSession) connectToPeer(peer string) {
 	// If it's us, we don't need to continue
 	if id == cs.PeerID {
 		conn.Close()
-		return
+		return nil
 	}
 
 	btconn := &btConn{
@@ -324,27 +495,36 @@ func (cs *ControlSession) connectToPeer(peer string) {
 	}
 	cs.session.SavePeer(conn.RemoteAddr().String(), cs.peers.HasPeer)
 	cs.AddPeer(btconn)
+	return nil
 }
 
 func (cs *ControlSession) backoffHintNewPeer(peer string) {
 	go func() {
 		for backoff := 1; backoff < 5; backoff++ {
+			select {
+			case <-cs.done:
+				return
+			default:
+			}
 			cs.hintNewPeer(peer)
 			wait := 10 * int(math.Pow(float64(2), float64(backoff)))
 			// cs.logf("backoff for %s: %d", peer, wait)
-			<-time.After(time.Duration(wait) * time.Second)
+			select {
+			case <-time.After(time.Duration(wait) * time.Second):
+			case <-cs.done:
+				return
+			}
 		}
 		return
 	}()
 }
 
 func (cs *ControlSession) hintNewPeer(peer string) (isnew bool) {
-	if cs.peers.Know(peer, "") {
+	if cs.peers.Know(peer, "") || isBlocked(peer) || !cs.trusted.allows(peer) {
 		return false
 	}
 
-	go cs.connectToPeer(peer)
-	return true
+	return cs.dials.Push(peer)
 }
 
 func (cs *ControlSession) AcceptNewPeer(btconn *btConn) {
@@ -360,14 +540,38 @@ func (cs *ControlSession) AcceptNewPeer(btconn *btConn) {
 		btconn.conn.Close()
 		return
 	}
-	cs.AddPeer(btconn)
+	// The main loop may be waiting for ours
+	go cs.AddPeer(btconn)
 }
 
+// AddPeer hands a new connection to the main loop. It can be called from
+// any goroutine.
 func (cs *ControlSession) AddPeer(btconn *btConn) {
+	select {
+	case cs.newConns <- btconn:
+	case <-cs.done:
+		btconn.conn.Close()
+	}
+}
+
+// addPeer adds a new connection to the peers, unless it is refused or a
+// better connection to the same device exists. Only the main loop calls
+// it, so that the checks and the change are atomic.
+func (cs *ControlSession) addPeer(btconn *btConn) {
 	theirheader := btconn.header
 
 	peer := btconn.conn.RemoteAddr().String()
-	if cs.peers.Len() >= MAX_NUM_PEERS {
+	if isBlocked(peer) {
+		cs.log("Rejecting blocked peer", peer)
+		btconn.conn.Close()
+		return
+	}
+	if !cs.trusted.allows(peer) {
+		cs.log("Rejecting untrusted peer", peer)
+		btconn.conn.Close()
+		return
+	}
+	if cs.peers.Len() >= cs.swarm.max && !cs.trusted.isTrusted(peer) {
 		cs.log("We have enough peers. Rejecting additional peer", peer)
 		btconn.conn.Close()
 		return
@@ -377,11 +581,12 @@ func (cs *ControlSession) AddPeer(btconn *btConn) {
 	ps.id = btconn.id
 
 	if keep := cs.peers.Add(ps); !keep {
+		ps.Close()
 		return
 	}
 
 	// If 128, then it supports DHT.
-	if int(theirheader[7])&0x01 == 0x01 {
+	if cs.dht != nil && int(theirheader[7])&0x01 == 0x01 {
 		// It's OK if we know this node already. The DHT engine will
 		// ignore it accordingly.
 		go cs.dht.AddNode(ps.address)
@@ -390,7 +595,7 @@ func (cs *ControlSession) AddPeer(btconn *btConn) {
 	go ps.peerReader(cs.peerMessageChan)
 
 	if int(theirheader[5])&0x10 == 0x10 {
-		ps.SendExtensions(cs.ourExtensions, 0)
+		ps.SendExtensions(cs.ourExtensions, 0, cs.Port, 0, 0)
 	}
 
 	go func() {
@@ -400,6 +605,8 @@ func (cs *ControlSession) AddPeer(btconn *btConn) {
 	cs.logf("AddPeer: added %s", btconn.conn.RemoteAddr().String())
 }
 
+// ClosePeer removes peer from the peers and closes it. Only the main loop
+// calls it, or Quit once the loop stopped.
 func (cs *ControlSession) ClosePeer(peer *peerState) {
 	cs.peers.Delete(peer)
 	peer.Close()
@@ -418,6 +625,10 @@ func (cs *ControlSession) DoMessage(p *peerState, message []byte) (err error) {
 		cs.logf("Wrong message type: %d\n", message[0])
 		return errInvalidType
 	}
+	// All our control extensions are bencoded
+	if err = checkExtensionMessage(message[1:], true); err != nil {
+		return
+	}
 	switch message[1] {
 	case EXTENSION_HANDSHAKE:
 		err = cs.DoHandshake(message[1:], p)
@@ -436,26 +647,27 @@ func (cs *ControlSession) DoHandshake(msg []byte, p *peerState) (err error) {
 		return err
 	}
 
-	p.theirExtensions = make(map[string]int)
-	for name, code := range h.M {
-		p.theirExtensions[name] = code
-	}
+	p.readExtensionHandshake(h)
 
 	// Now that handshake is done and we know their extension, send the
 	// current ih message, if we have one
 	//
 	// We need to de-serialize the current ih message saved in db before
 	// passing it to the sender otherwise it is serialized into a string
-	var currentIHMessage IHMessage
-	currentFromSession := cs.session.GetCurrentIHMessage()
-	if len(currentFromSession) > 0 {
-		err = bencode.NewDecoder(strings.NewReader(currentFromSession)).Decode(&currentIHMessage)
-		if err != nil {
-			cs.log("Error deserializing current ih message to be resent", err)
-		} else {
-			p.sendExtensionMessage("bs_metadata", currentIHMessage)
-		}
-	}
+	currentIHMessage, err := decodeIHMessage(cs.session.GetCurrentIHMessage())
+	if err != nil {
+		cs.log("Error deserializing current ih message to be resent", err)
+	} else if currentIHMessage.Info.Rev.Sig != "" {
+		// Unsigned revisions from older versions would be rejected. The
+		// message may be the one a peer sent us: tell where to reach us.
+		currentIHMessage.Port = int64(cs.Port)
+		currentIHMessage.Dest = ourOverlay()
+		p.sendExtensionMessage("bs_metadata", currentIHMessage)
+	}
+	cs.requestSummary(p)
+	cs.sendAbout(p)
+	cs.sendRotations(p)
+	cs.sendSealed(p)
 
 	return nil
 }
@@ -467,6 +679,16 @@ func (cs *ControlSession) DoOther(msg []byte, p *peerState) (err error) {
 			err = cs.DoMetadata(msg[1:], p)
 		case "ut_pex":
 			err = cs.DoPex(msg[1:], p)
+		case "bs_summary":
+			err = cs.DoSummary(msg[1:], p)
+		case "bs_about":
+			err = cs.DoAbout(msg[1:], p)
+		case "bs_admin":
+			err = cs.DoAdmin(msg[1:], p)
+		case "bs_rotation":
+			err = cs.DoRotation(msg[1:], p)
+		case "bs_sealed":
+			err = cs.DoSealed(msg[1:], p)
 		default:
 			err = errors.New(fmt.Sprintf("unknown extension: %s", ext))
 		}
@@ -483,41 +705,57 @@ type IHMessage struct {
 	// The port we are listening on
 	Port int64 `bencode:"port"`
 
-	// The signature of the info dict
-	Sig string `bencode:"sig"`
+	// Our onion service or I2P address, when peers can only reach us
+	// through Tor or I2P
+	Dest string `bencode:"dest,omitempty"`
 }
 
 type NewInfo struct {
 	InfoHash string `bencode:"infohash"`
 
-	// The revision, ala CouchDB
-	// ie <counter>-<hash>
-	Rev string `bencode:"rev"`
+	// Signed, it also vouches for the infohash
+	Rev Revision `bencode:"rev"`
 }
 
-func NewIHMessage(port int64, ih, rev string, priv id.PrivKey) (mm IHMessage, err error) {
-
-	info := NewInfo{
-		InfoHash: ih,
-		Rev:      rev,
-	}
-
-	var buf bytes.Buffer
-	err = bencode.NewEncoder(&buf).Encode(info)
-	if err != nil {
-		log.Println("[CONTROL] Couldn't encode ih message, returning now")
-		return mm, err
+func NewIHMessage(port int64, ih string, rev Revision) IHMessage {
+	return IHMessage{
+		Info: NewInfo{
+			InfoHash: ih,
+			Rev:      rev,
+		},
+		Port: port,
+		Dest: ourOverlay(),
 	}
+}
 
-	var privarg [ed.PrivateKeySize]byte
-	copy(privarg[:], priv[:])
-	sig := ed.Sign(&privarg, buf.Bytes())
+// legacyIHMessage is an ih message stored before revisions were signed.
+type legacyIHMessage struct {
+	Info struct {
+		InfoHash string `bencode:"infohash"`
+		Rev      string `bencode:"rev"`
+	} `bencode:"info"`
+	Port int64 `bencode:"port"`
+}
 
-	return IHMessage{
-		Info: info,
-		Port: port,
-		Sig:  string(sig[:]),
-	}, nil
+// decodeIHMessage decodes a stored ih message. Those stored by older
+// versions are converted, but their revision isn't signed.
+func decodeIHMessage(raw string) (message IHMessage, err error) {
+	if raw == "" {
+		return
+	}
+	err = bencode.NewDecoder(strings.NewReader(raw)).Decode(&message)
+	if err == nil {
+		return
+	}
+	var legacy legacyIHMessage
+	if bencode.NewDecoder(strings.NewReader(raw)).Decode(&legacy) != nil {
+		return
+	}
+	rev, ok := parseRevision(legacy.Info.Rev)
+	if !ok {
+		return
+	}
+	return NewIHMessage(legacy.Port, legacy.Info.InfoHash, rev), nil
 }
 
 func (cs *ControlSession) DoMetadata(msg []byte, p *peerState) (err error) {
@@ -531,64 +769,41 @@ func (cs *ControlSession) DoMetadata(msg []byte, p *peerState) (err error) {
 		return
 	}
 
-	// take his IP addr, use the advertised port
-	ip := p.conn.RemoteAddr().(*net.TCPAddr).IP.String()
-	port := strconv.Itoa(int(message.Port))
-	peer := ip + ":" + port
-
-	if cs.isNewerThan(message.Info.Rev) {
-		return
+	// take his IP addr, or the address he is reachable at through Tor or
+	// I2P, use the advertised port
+	host := peerHost(p.address)
+	if isOverlay(message.Dest) {
+		host = message.Dest
+	} else if p.onion != "" {
+		host = p.onion
 	}
+	peer := net.JoinHostPort(host, strconv.Itoa(int(message.Port)))
 
-	var tmpInfoBuf bytes.Buffer
-	err = bencode.NewEncoder(&tmpInfoBuf).Encode(message.Info)
-	if err != nil {
-		cs.log("Couldn't encode ih message, returning now")
+	if err = message.Info.Rev.Verify(message.Info.InfoHash, cs.ID.Pub); err != nil {
+		cs.log("Refusing revision from", peer, ":", err)
 		return err
 	}
-	rawInfo := tmpInfoBuf.Bytes()
-
-	pub := [ed.PublicKeySize]byte(cs.ID.Pub)
-	var sig [ed.SignatureSize]byte
-	copy(sig[0:ed.SignatureSize], message.Sig)
-	ok := ed.Verify(&pub, rawInfo, &sig)
-	if !ok {
-		return errors.New("Bad Signature")
+	if _, rev := cs.current(); !message.Info.Rev.Newer(rev) {
+		return
+	}
+	if !cs.highest.see(message.Info.Rev) {
+		cs.log("Ignoring revision", message.Info.Rev, "from", peer, ": a newer one was seen")
+		return
+	}
+	if err := cs.highest.save(cs.session); err != nil {
+		cs.log("Couldn't save the highest revisions: ", err)
 	}
 
-	var test IHMessage
-	err = bencode.NewDecoder(bytes.NewReader(msg)).Decode(&test)
 	cs.session.SaveIHMessage(msg)
-	cs.Torrents <- Announce{
+	cs.recordAnnouncer(message.Info.InfoHash, message.Info.Rev, peer, p)
+	cs.announces.Push(Announce{
 		infohash: message.Info.InfoHash,
 		peer:     peer,
-	}
+	})
 
 	return
 }
 
-func (cs *ControlSession) isNewerThan(rev string) bool {
-	remoteParts := strings.Split(rev, "-")
-	if len(remoteParts) != 2 {
-		return true
-	}
-	remoteCounter, err := strconv.Atoi(remoteParts[0])
-	if err != nil {
-		return true
-	}
-
-	localParts := strings.Split(cs.rev, "-")
-	if len(localParts) != 2 {
-		return true
-	}
-	localCounter, err := strconv.Atoi(localParts[0])
-	if err != nil {
-		return true
-	}
-
-	return localCounter >= remoteCounter
-}
-
 func (cs *ControlSession) DoPex(msg []byte, p *peerState) (err error) {
 	return
 }
@@ -597,30 +812,51 @@ func (cs *ControlSession) Matches(ih string) bool {
 	return string(cs.ID.Infohash) == ih
 }
 
+// announced tells whether ih is the torrent of the last revision a peer
+// sent us, the only one SetCurrent adopts.
+func (cs *ControlSession) announced(ih string) bool {
+	stored, err := decodeIHMessage(cs.session.GetCurrentIHMessage())
+	return err == nil && stored.Info.InfoHash == ih
+}
+
+// current returns the current torrent and its revision.
+func (cs *ControlSession) current() (ih string, rev Revision) {
+	cs.currentLock.Lock()
+	defer cs.currentLock.Unlock()
+	return cs.currentIH, cs.rev
+}
+
+// SetCurrent makes ih the current torrent. If it is the one of the
+// revision a peer sent us last, that revision is adopted; otherwise we
+// make a new one.
 func (cs *ControlSession) SetCurrent(ih string) error {
 	if cs.currentIH == ih {
 		return nil
 	}
 
-	parts := strings.Split(cs.rev, "-")
-	if len(parts) != 2 {
-		cs.logf("Invalid rev: %s\n", cs.rev)
-		parts = []string{"0", ""}
-	}
-
-	counter, err := strconv.Atoi(parts[0])
-	if err != nil {
-		counter = 0
+	stored, err := decodeIHMessage(cs.session.GetCurrentIHMessage())
+	rev := stored.Info.Rev
+	adopted := err == nil && stored.Info.InfoHash == ih && rev.Newer(cs.rev) && rev.Verify(ih, cs.ID.Pub) == nil
+	if adopted {
+		cs.logf("Adopting rev %s with ih %x", rev, ih)
+	} else if !cs.ID.CanWrite() {
+		return errCantWrite
+	} else {
+		// Our revisions, rollbacks included, always go past the ones we
+		// saw so that peers take them
+		parent := cs.rev
+		if seen, ok := cs.highest.newest(string(cs.ID.Pub[:])); ok && seen.Newer(parent) {
+			parent = seen
+		}
+		rev, err = nextRevision(parent, ih, cs.ID.Pub, cs.ID.Priv)
+		if err != nil {
+			return err
+		}
+		cs.logf("Updating rev with ih %x to %s", ih, rev)
 	}
-	newCounter := strconv.Itoa(counter + 1)
-
-	cs.logf("Updating rev with ih %x", ih)
-	newRev := newCounter + "-" + fmt.Sprintf("%x", sha1.Sum([]byte(ih+parts[1])))
 
-	mess, err := NewIHMessage(int64(cs.Port), ih, newRev, cs.ID.Priv)
-	if err != nil {
-		return err
-	}
+	// Peers connect back to our port
+	mess := NewIHMessage(int64(cs.Port), ih, rev)
 	var buf bytes.Buffer
 	err = bencode.NewEncoder(&buf).Encode(mess)
 	if err != nil {
@@ -631,8 +867,23 @@ func (cs *ControlSession) SetCurrent(ih string) error {
 		return err
 	}
 
+	cs.audit(cs.rev, rev, ih, adopted)
+	if adopted {
+		peer, _ := cs.announcerOf(ih, rev)
+		cs.events.notify(eventRevision, ih, peer, "Took revision %s from a peer", rev)
+	} else {
+		cs.events.notify(eventRevision, ih, "", "Published revision %s", rev)
+	}
+	cs.currentLock.Lock()
 	cs.currentIH = ih
-	cs.rev = newRev
+	cs.rev = rev
+	cs.currentLock.Unlock()
+	if cs.highest.see(rev) {
+		if err := cs.highest.save(cs.session); err != nil {
+			cs.log("Couldn't save the highest revisions: ", err)
+		}
+	}
+	cs.recordRevision(ih, rev)
 
 	cs.broadcast(mess)
 	return nil
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rakoo/rakoshare/pkg/id"
+	"github.com/rakoo/rakoshare/pkg/sharesession"
+	"github.com/zeebo/bencode"
+)
+
+// newTestControlSession returns a control session without DHT nor
+// trackers, whose main loop runs until the returned function is called.
+func newTestControlSession() (*ControlSession, func()) {
+	cs := &ControlSession{
+		PeerID:          "-tt0_000000000000000",
+		NewPeers:        make(chan string, 64),
+		Admin:           make(chan adminRequest, 4),
+		adminNonces:     newAdminNonces(),
+		adminWaiters:    newAdminWaiters(),
+		peerMessageChan: make(chan peerMessage),
+		newConns:        make(chan *btConn),
+		adminOut:        make(chan adminOutgoing),
+		quit:            make(chan struct{}),
+		done:            make(chan struct{}),
+		ourExtensions:   map[int]string{5: "bs_admin"},
+		peers:           newPeers(),
+		monitor:         newLoopMonitor("control"),
+		swarm:           ShareConfig{}.swarmSize(),
+		trackerClient:   NewTrackerClient("", nil),
+	}
+	cs.dials = newDialQueue(1, func(string) error { return nil })
+	go cs.Run()
+	return cs, func() {
+		cs.quit <- struct{}{}
+		close(cs.done)
+		cs.dials.Close()
+	}
+}
+
+// loopbackConns returns n connections to a local listener, whose other
+// ends stay open until the returned function is called.
+func loopbackConns(t *testing.T, n int) ([]net.Conn, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	conns := make([]net.Conn, n)
+	accepted := make([]net.Conn, 0, n)
+	closeAccepted := func() {
+		for _, c := range accepted {
+			c.Close()
+		}
+	}
+	// Each dial is accepted before the next one, so that both ends of a
+	// connection go together
+	for i := range conns {
+		conns[i], err = net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			closeAccepted()
+			t.Fatal(err)
+		}
+		c, err := l.Accept()
+		if err != nil {
+			closeAccepted()
+			t.Fatal(err)
+		}
+		accepted = append(accepted, c)
+	}
+	return conns, closeAccepted
+}
+
+// Run with -race: connections are added from many goroutines while the
+// list is read from others.
+func TestControlSessionConcurrentAddPeer(t *testing.T) {
+	cs, stop := newTestControlSession()
+	defer stop()
+
+	conns, closeConns := loopbackConns(t, 20)
+	defer closeConns()
+	peers := make([]*btConn, len(conns))
+	var wg sync.WaitGroup
+	for i, conn := range conns {
+		peers[i] = &btConn{header: make([]byte, 68), id: string(rune('a' + i)), conn: conn}
+		wg.Add(2)
+		go func(btconn *btConn) {
+			defer wg.Done()
+			cs.AddPeer(btconn)
+		}(peers[i])
+		go func() {
+			defer wg.Done()
+			for _, p := range cs.peers.All() {
+				_ = p.address
+			}
+			cs.peers.Know("127.0.0.1:1", "")
+		}()
+	}
+	wg.Wait()
+
+	// All connections come from the same host: only one is kept
+	deadline := time.Now().Add(5 * time.Second)
+	for len(livePeersOf(peers)) != 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := cs.peers.Len(); n != 1 {
+		t.Fatalf("Expected 1 peer, got %d", n)
+	}
+	// Closed peers leave the registry
+	if open := livePeersOf(peers); len(open) != 1 || open[0] != cs.peers.All()[0] {
+		t.Errorf("Expected the duplicates to be closed, %d are open", len(open))
+	}
+}
+
+// livePeersOf returns the open peers of the given connections.
+func livePeersOf(conns []*btConn) (peers []*peerState) {
+	livePeers.Lock()
+	defer livePeers.Unlock()
+	for p := range livePeers.claimed {
+		for _, c := range conns {
+			if p.conn == c.conn {
+				peers = append(peers, p)
+			}
+		}
+	}
+	return
+}
+
+func TestControlSessionAddPeerAfterQuit(t *testing.T) {
+	cs, stop := newTestControlSession()
+	stop()
+
+	conns, closeConns := loopbackConns(t, 1)
+	defer closeConns()
+	conn := conns[0]
+	done := make(chan struct{})
+	go func() {
+		cs.AddPeer(&btConn{header: make([]byte, 68), id: "a", conn: conn})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("AddPeer blocked after the session quit")
+	}
+	if cs.peers.Len() != 0 {
+		t.Error("Expected no peer to be added after the session quit")
+	}
+}
+
+// Run with -race: peers announce revisions on the control loop while the
+// main loop makes new ones.
+func TestControlSessionConcurrentRevisions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "control")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	session, err := sharesession.New(filepath.Join(dir, "session.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer, err := id.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	quit := make(chan struct{})
+	defer close(quit)
+	cs := &ControlSession{
+		ID:        writer,
+		Port:      7777,
+		session:   session,
+		peers:     newPeers(),
+		highest:   loadHighestRevisions(session),
+		announces: newAnnounceQueue(session, quit),
+	}
+
+	const n = 20
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		p := &peerState{address: "192.0.2.1:6881", id: "peer"}
+		var rev Revision
+		for i := 0; i < n; i++ {
+			ih := fmt.Sprintf("theirs%d", i)
+			next, err := nextRevision(rev, ih, writer.Pub, writer.Priv)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			rev = next
+			var buf bytes.Buffer
+			bencode.NewEncoder(&buf).Encode(NewIHMessage(6881, ih, rev))
+			cs.DoMetadata(buf.Bytes(), p)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < n; i++ {
+			if err := cs.SetCurrent(fmt.Sprintf("ours%d", i)); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	wg.Wait()
+
+	_, rev := cs.current()
+	if newest, ok := cs.highest.newest(rev.Author); !ok || rev.Newer(newest) {
+		t.Errorf("Expected the current revision %s to be seen, got %s", rev, newest)
+	}
+}
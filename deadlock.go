@@ -0,0 +1,80 @@
+package main
+
+import (
+	"expvar"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"time"
+)
+
+var (
+	deadlockTimeout = flag.Duration("deadlockTimeout", 15*time.Second, "Report the main loop of a session as stuck when it gives no sign of life for this long. 0 disables the detection")
+	deadlockPanic   = flag.Bool("deadlockPanic", false, "Kill the process when the main loop of a session is stuck, rather than only reporting it")
+	deadlockDumpDir = flag.String("deadlockDumpDir", "", "Where to write the stacks of all goroutines when the main loop of a session is stuck. Defaults to the temporary directory")
+)
+
+// Number of times a main loop was found stuck, by session name
+var stallsMetrics = expvar.NewMap("stalls")
+
+// watchLoop reports the main loop called name as stuck when it doesn't
+// send on heartbeat for -deadlockTimeout, until quit is closed. A stuck
+// loop is reported once, with the stacks of all goroutines written to a
+// file; the transfers of other sessions go on unless -deadlockPanic is
+// set. It always drains heartbeat, so that the loop never blocks on it.
+func watchLoop(name string, monitor *loopMonitor, heartbeat, quit <-chan struct{}) {
+	lastHeartbeat := time.Now()
+	stuck := false
+
+	for {
+		var timeout <-chan time.Time
+		if *deadlockTimeout > 0 && !stuck {
+			timeout = time.After(*deadlockTimeout - time.Now().Sub(lastHeartbeat))
+		}
+		select {
+		case <-quit:
+			return
+		case <-heartbeat:
+			if stuck {
+				log.Printf("[%s] Main loop is running again after %s\n", name, time.Now().Sub(lastHeartbeat))
+				stuck = false
+			}
+			lastHeartbeat = time.Now()
+		case <-timeout:
+			stuck = true
+			age := time.Now().Sub(lastHeartbeat)
+			stallsMetrics.Add(name, 1)
+			log.Printf("[%s] Loop latency when last seen: %v\n", name, monitor.export())
+			dump, err := dumpGoroutines(name, time.Now())
+			if err != nil {
+				log.Printf("[%s] Couldn't write the stacks of goroutines: %s\n", name, err)
+			}
+			raiseAlert("deadlock", "The main loop of %s gave no sign of life for %s. Look in %s for what it is doing", name, age, dump)
+			if *deadlockPanic {
+				panic("Killed by deadlock detector")
+			}
+		}
+	}
+}
+
+// dumpGoroutines writes the stacks of all goroutines to a new file in
+// -deadlockDumpDir, and returns its path.
+func dumpGoroutines(name string, now time.Time) (string, error) {
+	dir := *deadlockDumpDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	path := filepath.Join(dir, fmt.Sprintf("rakoshare-%s-%d-%s.stacks", name, os.Getpid(), now.Format("20060102-150405")))
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	err = pprof.Lookup("goroutine").WriteTo(f, 2)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return path, err
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"expvar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWatchLoop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deadlock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(timeout time.Duration, dumpDir string) {
+		*deadlockTimeout, *deadlockDumpDir = timeout, dumpDir
+	}(*deadlockTimeout, *deadlockDumpDir)
+	*deadlockTimeout = 50 * time.Millisecond
+	*deadlockDumpDir = dir
+
+	heartbeat := make(chan struct{}, 1)
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		watchLoop("test", newLoopMonitor("test"), heartbeat, quit)
+		close(done)
+	}()
+
+	// Reported once while stuck, without killing the process
+	time.Sleep(200 * time.Millisecond)
+	if v, ok := stallsMetrics.Get("test").(*expvar.Int); !ok || v.Value() != 1 {
+		t.Errorf("Expected one stall, got %v", stallsMetrics.Get("test"))
+	}
+	dumps, _ := filepath.Glob(filepath.Join(dir, "rakoshare-test-*.stacks"))
+	if len(dumps) != 1 {
+		t.Fatalf("Expected one dump, got %q", dumps)
+	}
+	stacks, _ := ioutil.ReadFile(dumps[0])
+	if !strings.Contains(string(stacks), "watchLoop") {
+		t.Error("Expected the stacks of all goroutines in the dump")
+	}
+
+	// The loop may be stuck again once it ran
+	heartbeat <- struct{}{}
+	time.Sleep(200 * time.Millisecond)
+	if v := stallsMetrics.Get("test").(*expvar.Int).Value(); v != 2 {
+		t.Errorf("Expected a second stall, got %d", v)
+	}
+
+	close(quit)
+	<-done
+}
+
+func TestWatchLoopDisabled(t *testing.T) {
+	defer func(timeout time.Duration) { *deadlockTimeout = timeout }(*deadlockTimeout)
+	*deadlockTimeout = 0
+
+	heartbeat := make(chan struct{}, 1)
+	quit := make(chan struct{})
+	defer close(quit)
+	go watchLoop("disabled", newLoopMonitor("disabled"), heartbeat, quit)
+
+	// The loop doesn't block on its heartbeats
+	for i := 0; i < 3; i++ {
+		select {
+		case heartbeat <- struct{}{}:
+		case <-time.After(time.Second):
+			t.Fatal("Heartbeats aren't drained")
+		}
+	}
+	if stallsMetrics.Get("disabled") != nil {
+		t.Error("Expected no stall to be reported")
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/sha1"
+	"flag"
+	"log"
+	"math"
+	"time"
+
+	"github.com/rakoo/rakoshare/pkg/sharesession"
+)
+
+var (
+	deltaAlertSigma    = flag.Float64("deltaAlertSigma", 4, "Alert when a revision changes more than this many standard deviations above the usual. 0 disables the alert")
+	deltaAlertMinBytes = flag.Int64("deltaAlertMinBytes", 16*1024*1024, "Never alert for revisions changing less than this many bytes")
+)
+
+const (
+	// How many past revisions make the baseline
+	deltaHistory = 50
+
+	// Minimum number of past revisions before alerting at all
+	deltaMinSamples = 5
+)
+
+// revisionDelta estimates how many bytes differ between two revisions,
+// counting the pieces that are in one revision but not in the other.
+// It only needs the metainfo so it works for revisions we didn't
+// produce.
+func revisionDelta(prev, next *MetaInfo) (delta int64) {
+	prevPieces := pieceSet(prev)
+	nextPieces := pieceSet(next)
+
+	for h := range nextPieces {
+		if _, ok := prevPieces[h]; !ok {
+			delta += next.Info.PieceLength
+		}
+	}
+	for h := range prevPieces {
+		if _, ok := nextPieces[h]; !ok {
+			delta += prev.Info.PieceLength
+		}
+	}
+	return
+}
+
+func pieceSet(m *MetaInfo) map[string]struct{} {
+	set := make(map[string]struct{})
+	if m == nil || m.Info == nil {
+		return set
+	}
+	for i := 0; i+sha1.Size <= len(m.Info.Pieces); i += sha1.Size {
+		set[m.Info.Pieces[i:i+sha1.Size]] = struct{}{}
+	}
+	return set
+}
+
+// isAnomalousDelta tells whether delta is way above the deltas in
+// history.
+func isAnomalousDelta(history []int64, delta int64, sigma float64, minBytes int64) bool {
+	if sigma <= 0 || len(history) < deltaMinSamples || delta < minBytes {
+		return false
+	}
+
+	var sum float64
+	for _, d := range history {
+		sum += float64(d)
+	}
+	mean := sum / float64(len(history))
+
+	var variance float64
+	for _, d := range history {
+		variance += (float64(d) - mean) * (float64(d) - mean)
+	}
+	stddev := math.Sqrt(variance / float64(len(history)))
+
+	// Very regular histories would make any small difference an anomaly
+	if stddev < mean/10 {
+		stddev = mean / 10
+	}
+
+	return float64(delta) > mean+sigma*stddev
+}
+
+// recordRevisionDelta stores the size of the change from prev to next in
+// the session and raises an alert if it is unusually big.
+func recordRevisionDelta(session *sharesession.Session, prev, next *MetaInfo) {
+	if prev == nil || next == nil || next.Info == nil {
+		return
+	}
+	delta := revisionDelta(prev, next)
+
+	history, err := session.GetRevisionDeltas(deltaHistory)
+	if err != nil {
+		log.Println("Couldn't get revision deltas:", err)
+	} else if isAnomalousDelta(history, delta, *deltaAlertSigma, *deltaAlertMinBytes) {
+		raiseAlert("revision-delta", "Revision %x changes %d bytes, way more than the usual", next.InfoHash, delta)
+	}
+
+	err = session.SaveRevisionDelta(next.InfoHash, delta, time.Now().Format(time.RFC3339))
+	if err != nil {
+		log.Println("Couldn't save revision delta:", err)
+	}
+}
+
+// currentMetaInfo returns the metainfo of the current revision of the
+// share, or nil if there is none.
+func currentMetaInfo(session *sharesession.Session) *MetaInfo {
+	current := session.GetCurrentTorrent()
+	if len(current) == 0 {
+		return nil
+	}
+	m, err := NewMetaInfoFromContent([]byte(current))
+	if err != nil {
+		return nil
+	}
+	return m
+}
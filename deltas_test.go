@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func metaWithPieces(pieces ...string) *MetaInfo {
+	var all []string
+	for _, p := range pieces {
+		all = append(all, strings.Repeat(p, 20))
+	}
+	return &MetaInfo{Info: &InfoDict{PieceLength: 100, Pieces: strings.Join(all, "")}}
+}
+
+func TestRevisionDelta(t *testing.T) {
+	prev := metaWithPieces("a", "b", "c")
+
+	if d := revisionDelta(prev, metaWithPieces("a", "b", "c")); d != 0 {
+		t.Errorf("Identical revisions should have no delta, got %d", d)
+	}
+	// One piece modified: one piece removed, one added
+	if d := revisionDelta(prev, metaWithPieces("a", "x", "c")); d != 200 {
+		t.Errorf("Expected delta of 200, got %d", d)
+	}
+	// Pieces moved around don't count
+	if d := revisionDelta(prev, metaWithPieces("c", "a", "b", "d")); d != 100 {
+		t.Errorf("Expected delta of 100, got %d", d)
+	}
+}
+
+func TestIsAnomalousDelta(t *testing.T) {
+	history := []int64{1000, 1200, 900, 1100, 1000, 950}
+
+	if isAnomalousDelta(history, 1300, 4, 0) {
+		t.Error("A slightly bigger delta shouldn't be an anomaly")
+	}
+	if !isAnomalousDelta(history, 100000, 4, 0) {
+		t.Error("A delta 100 times bigger should be an anomaly")
+	}
+	if isAnomalousDelta(history, 100000, 4, 1000000) {
+		t.Error("Deltas below the minimum should be ignored")
+	}
+	if isAnomalousDelta(history[:2], 100000, 4, 0) {
+		t.Error("There should be no alert without enough history")
+	}
+	if isAnomalousDelta(history, 100000, 0, 0) {
+		t.Error("A zero sigma should disable alerts")
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"path/filepath"
+)
+
+var desktopNotify = flag.Bool("notify", false, "Show desktop notifications when a revision finishes downloading or a local change is kept aside as a conflict")
+
+var errDesktopUnsupported = errors.New("no desktop notifications on this system")
+
+// desktopEvent tells whether events of kind are shown on the desktop.
+func desktopEvent(kind string) bool {
+	return kind == eventSynced || kind == eventConflict
+}
+
+// notifyDesktop shows e, about the share synced to folder, as a
+// notification of the desktop, when asked to.
+func notifyDesktop(folder string, e Event) {
+	if !*desktopNotify || !desktopEvent(e.Kind) {
+		return
+	}
+	title := "rakoshare"
+	if folder != "" {
+		title += ": " + filepath.Base(folder)
+	}
+	go func() {
+		if err := showNotification(title, e.Message); err != nil {
+			log.Println("Couldn't show desktop notification:", err)
+		}
+	}()
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"os/exec"
+)
+
+// showNotification shows a notification of the Notification Center,
+// through osascript. The texts are passed as arguments so that they need
+// no quoting.
+func showNotification(title, body string) error {
+	return exec.Command("osascript",
+		"-e", "on run argv",
+		"-e", "display notification (item 2 of argv) with title (item 1 of argv)",
+		"-e", "end run",
+		title, body).Run()
+}
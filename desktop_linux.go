@@ -0,0 +1,18 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// showNotification shows a notification of the desktop session, through
+// the notify-send utility of libnotify.
+func showNotification(title, body string) error {
+	if os.Getenv("DISPLAY") == "" && os.Getenv("WAYLAND_DISPLAY") == "" {
+		return errDesktopUnsupported
+	}
+	if _, err := exec.LookPath("notify-send"); err != nil {
+		return errDesktopUnsupported
+	}
+	return exec.Command("notify-send", "--app-name=rakoshare", title, body).Run()
+}
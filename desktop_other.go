@@ -0,0 +1,8 @@
+// +build !darwin,!linux,!windows
+
+package main
+
+// showNotification can't show notifications on this system.
+func showNotification(title, body string) error {
+	return errDesktopUnsupported
+}
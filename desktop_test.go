@@ -0,0 +1,12 @@
+package main
+
+import "testing"
+
+func TestDesktopEvent(t *testing.T) {
+	for _, kind := range eventKinds {
+		want := kind == eventSynced || kind == eventConflict
+		if desktopEvent(kind) != want {
+			t.Errorf("Expected %s events shown on the desktop: %v", kind, want)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// Toasts need the id of a registered application: PowerShell's is always
+// there.
+const toastAppID = `{1AC14E77-02E7-4E5D-B744-2EB1AE5198B7}\WindowsPowerShell\v1.0\powershell.exe`
+
+// The texts come from the environment so that they need no quoting
+const toastScript = `[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] | Out-Null
+$t = [Windows.UI.Notifications.ToastNotificationManager]::GetTemplateContent([Windows.UI.Notifications.ToastTemplateType]::ToastText02)
+$x = $t.GetElementsByTagName('text')
+$x.Item(0).AppendChild($t.CreateTextNode($env:RAKOSHARE_TITLE)) | Out-Null
+$x.Item(1).AppendChild($t.CreateTextNode($env:RAKOSHARE_BODY)) | Out-Null
+[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier($env:RAKOSHARE_APP).Show([Windows.UI.Notifications.ToastNotification]::new($t))`
+
+// showNotification shows a toast notification, through PowerShell.
+func showNotification(title, body string) error {
+	cmd := exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", toastScript)
+	cmd.Env = append(os.Environ(), "RAKOSHARE_TITLE="+title, "RAKOSHARE_BODY="+body, "RAKOSHARE_APP="+toastAppID)
+	return cmd.Run()
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"flag"
+	"sync"
+	"time"
+)
+
+var (
+	maxHalfOpen     = flag.Int("maxHalfOpen", 8, "Maximum number of connections to peers each session tries to establish at the same time")
+	dialBackoff     = flag.Duration("dialBackoff", 30*time.Second, "Delay before dialing again a peer we couldn't connect to. It doubles with each failure")
+	maxDialFailures = flag.Int("maxDialFailures", 5, "Failed connections after which a peer is ignored for an hour")
+)
+
+// Candidates waiting to be dialed; more are dropped, they will come back
+// with the next DHT or tracker results
+const maxPendingDials = 256
+
+// How long unreachable peers are ignored once they failed too many times
+const unreachableFor = time.Hour
+
+// dialFailure remembers that connecting to a peer failed, and when to try
+// again.
+type dialFailure struct {
+	backoff backoff
+	retryAt time.Time
+}
+
+// dialQueue connects to candidate peers with a limited number of
+// connections being established at any time, so that a burst of
+// candidates doesn't exhaust file descriptors.
+type dialQueue struct {
+	sync.Mutex
+	queued     map[string]bool // Pending or being dialed
+	failures   map[string]*dialFailure
+	candidates chan string
+	done       chan struct{}
+	closeOnce  sync.Once
+}
+
+// newDialQueue starts workers goroutines calling dial on the candidates
+// pushed to the queue. Candidates for which dial fails aren't accepted
+// again until their backoff delay is over.
+func newDialQueue(workers int, dial func(peer string) error) *dialQueue {
+	if workers < 1 {
+		workers = 1
+	}
+	q := &dialQueue{
+		queued:     make(map[string]bool),
+		failures:   make(map[string]*dialFailure),
+		candidates: make(chan string, maxPendingDials),
+		done:       make(chan struct{}),
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				select {
+				case peer := <-q.candidates:
+					err := dial(peer)
+					q.Lock()
+					delete(q.queued, peer)
+					if err != nil {
+						q.failed(peer, time.Now())
+					} else {
+						delete(q.failures, peer)
+					}
+					q.Unlock()
+				case <-q.done:
+					return
+				}
+			}
+		}()
+	}
+	return q
+}
+
+// Push queues peer to be dialed. It returns false if peer is already
+// queued, we recently failed to connect to it, or the queue is full.
+func (q *dialQueue) Push(peer string) bool {
+	q.Lock()
+	defer q.Unlock()
+	if q.queued[peer] || q.waiting(peer, time.Now()) {
+		return false
+	}
+	select {
+	case q.candidates <- peer:
+		q.queued[peer] = true
+		return true
+	default:
+		return false
+	}
+}
+
+// failed records a failure to connect to peer, and forgets the peers
+// that failed long ago. The caller holds the lock.
+func (q *dialQueue) failed(peer string, now time.Time) {
+	for addr, f := range q.failures {
+		if now.Sub(f.retryAt) > unreachableFor {
+			delete(q.failures, addr)
+		}
+	}
+
+	f, ok := q.failures[peer]
+	if !ok {
+		f = &dialFailure{backoff: backoff{Min: *dialBackoff, Max: unreachableFor, Jitter: 0.1}}
+		q.failures[peer] = f
+	}
+	if f.backoff.Attempts()+1 >= *maxDialFailures {
+		f.backoff.Reset()
+		f.retryAt = now.Add(unreachableFor)
+		return
+	}
+	f.retryAt = now.Add(f.backoff.Next())
+}
+
+// waiting tells whether peer failed recently enough not to be dialed
+// yet. The caller holds the lock.
+func (q *dialQueue) waiting(peer string, now time.Time) bool {
+	f, ok := q.failures[peer]
+	return ok && now.Before(f.retryAt)
+}
+
+// Close stops dialing. Connections being established are left to finish.
+func (q *dialQueue) Close() {
+	q.closeOnce.Do(func() { close(q.done) })
+}
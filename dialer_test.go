@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDialQueueLimitsHalfOpen(t *testing.T) {
+	const workers = 3
+	var current, highest int32
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+
+	q := newDialQueue(workers, func(peer string) error {
+		n := atomic.AddInt32(&current, 1)
+		for {
+			h := atomic.LoadInt32(&highest)
+			if n <= h || atomic.CompareAndSwapInt32(&highest, h, n) {
+				break
+			}
+		}
+		<-release
+		atomic.AddInt32(&current, -1)
+		wg.Done()
+		return nil
+	})
+	defer q.Close()
+
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		if !q.Push(fmt.Sprintf("10.0.0.%d:6881", i)) {
+			t.Fatalf("Couldn't queue candidate %d", i)
+		}
+	}
+	if q.Push("10.0.0.0:6881") {
+		t.Error("Expected a queued candidate not to be queued twice")
+	}
+	close(release)
+	wg.Wait()
+
+	if highest > workers {
+		t.Errorf("Expected at most %d dials at once, got %d", workers, highest)
+	}
+}
+
+func TestDialQueueFull(t *testing.T) {
+	block := make(chan struct{})
+	q := newDialQueue(1, func(peer string) error { <-block; return nil })
+	defer close(block)
+	defer q.Close()
+
+	accepted := 0
+	for i := 0; i < maxPendingDials+10; i++ {
+		if q.Push(fmt.Sprintf("10.0.%d.%d:6881", i/256, i%256)) {
+			accepted++
+		}
+	}
+	// One candidate may already be taken by the worker
+	if accepted > maxPendingDials+1 {
+		t.Errorf("Expected at most %d candidates, got %d", maxPendingDials+1, accepted)
+	}
+}
+
+func TestDialQueueBackoff(t *testing.T) {
+	defer func(d time.Duration, n int) { *dialBackoff, *maxDialFailures = d, n }(*dialBackoff, *maxDialFailures)
+	*dialBackoff, *maxDialFailures = time.Minute, 3
+
+	q := newDialQueue(1, func(peer string) error { return nil })
+	defer q.Close()
+
+	const peer = "10.0.0.1:6881"
+	now := time.Now()
+	q.failed(peer, now)
+	if !q.waiting(peer, now.Add(30*time.Second)) {
+		t.Error("Expected a peer that just failed to wait")
+	}
+	if q.waiting(peer, now.Add(2*time.Minute)) {
+		t.Error("Expected the first delay to be over")
+	}
+
+	now = now.Add(2 * time.Minute)
+	q.failed(peer, now)
+	if !q.waiting(peer, now.Add(90*time.Second)) {
+		t.Error("Expected the delay to grow with failures")
+	}
+
+	now = now.Add(3 * time.Minute)
+	q.failed(peer, now)
+	if !q.waiting(peer, now.Add(unreachableFor-time.Minute)) {
+		t.Error("Expected a peer that failed too often to be ignored")
+	}
+	if q.Push(peer) {
+		t.Error("Expected an unreachable peer not to be queued")
+	}
+	if q.waiting(peer, now.Add(unreachableFor+time.Minute)) {
+		t.Error("Expected an unreachable peer to be tried again eventually")
+	}
+	if q.waiting("10.0.0.2:6881", now) {
+		t.Error("Expected other peers not to wait")
+	}
+}
+
+func TestDialQueueForgetsSuccess(t *testing.T) {
+	done := make(chan struct{})
+	q := newDialQueue(1, func(peer string) error {
+		defer close(done)
+		return nil
+	})
+	defer q.Close()
+
+	const peer = "10.0.0.1:6881"
+	q.Lock()
+	q.failed(peer, time.Now().Add(-time.Hour))
+	q.Unlock()
+	if !q.Push(peer) {
+		t.Fatal("Expected a peer whose delay is over to be queued")
+	}
+	<-done
+	for i := 0; i < 100; i++ {
+		q.Lock()
+		_, failed := q.failures[peer]
+		q.Unlock()
+		if !failed {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Error("Expected a successful connection to clear the failures")
+}
@@ -4,12 +4,14 @@ import (
 	"bytes"
 	"crypto/sha1"
 	"errors"
+	"flag"
 	"fmt"
 	"hash"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"sync"
 	"time"
@@ -19,9 +21,15 @@ import (
 	"github.com/rakoo/rakoshare/pkg/sharesession"
 )
 
+var hashWorkers = flag.Int("hashWorkers", runtime.NumCPU(), "Number of goroutines hashing pieces when making a revision of a share")
+
+// How often hashing logs its progress
+const hashProgressInterval = 10 * time.Second
+
 var (
-	errNewFile    = errors.New("Got new file")
-	errInvalidDir = errors.New("Invalid watched dir")
+	errNewFile      = errors.New("Got new file")
+	errInvalidDir   = errors.New("Invalid watched dir")
+	errHeldRevision = errors.New("Revision held for confirmation")
 )
 
 type state int
@@ -34,19 +42,26 @@ const (
 type Watcher struct {
 	session    *sharesession.Session
 	watchedDir string
+	cfg        ShareConfig
 	lock       sync.Mutex
+	rescan     chan struct{}
 
 	PingNewTorrent chan string
 }
 
-func NewWatcher(session *sharesession.Session, watchedDir string) (w *Watcher, err error) {
+func NewWatcher(session *sharesession.Session, watchedDir string, cfg ShareConfig) (w *Watcher, err error) {
 	w = &Watcher{
 		session:        session,
 		watchedDir:     watchedDir,
+		cfg:            cfg,
+		rescan:         make(chan struct{}, 1),
 		PingNewTorrent: make(chan string),
 	}
 
-	go w.watch()
+	go supervise("watcher", nil, func() error {
+		w.watch()
+		return nil
+	})
 
 	// Initialization, only if there is something in the dir
 	if _, err := os.Stat(watchedDir); err != nil {
@@ -82,27 +97,83 @@ func (w *Watcher) watch() {
 	if len(currentTorrent) != 0 {
 		m, err := NewMetaInfoFromContent([]byte(currentTorrent))
 		if err == nil {
-			for _, f := range m.Info.Files {
+			for _, f := range m.Info.fileList() {
 				previousScanPaths = append(previousScanPaths, filepath.Join(f.Path...))
 			}
 		}
 	}
 	w.lock.Unlock()
 
-	for _ = range time.Tick(10 * time.Second) {
+	// With notifications of changes, scans are only a safety net
+	scanEvery := w.cfg.scanInterval()
+	var events *dirEvents
+	if *watchEvents && !w.cfg.NoWatch {
+		var err error
+		events, err = newDirEvents(w.watchedDir, w.ignorer(), *quiescence)
+		if err != nil {
+			log.Printf("Couldn't watch %s for changes, scanning it every %s: %s", w.watchedDir, scanEvery, err)
+		} else {
+			defer events.Close()
+			if *watchRescanInterval > scanEvery {
+				scanEvery = *watchRescanInterval
+			}
+		}
+	}
+	ticker := time.NewTicker(scanEvery)
+	defer ticker.Stop()
+
+	for {
+		settled := false
+		select {
+		case <-ticker.C:
+		case <-w.rescan:
+			log.Println("Rescanning", w.watchedDir)
+		case <-events.Settled():
+			settled = true
+		}
+		if ih, ok := w.promoteConfirmed(); ok {
+			w.PingNewTorrent <- ih
+		}
+
 		w.lock.Lock()
 
-		err := torrentWalk(w.watchedDir, func(path string, info os.FileInfo, perr error) (err error) {
+		recorded := make(map[string]*FileDict)
+		current := currentMetaInfo(w.session)
+		if current != nil {
+			for _, f := range current.Info.fileList() {
+				recorded[filepath.Join(f.Path...)] = f
+			}
+		}
+		// Read when a file was touched only
+		var cache *hashCache
+		err := torrentWalk(w.watchedDir, w.ignorer(), func(path string, info os.FileInfo, perr error) (err error) {
 			if perr != nil {
 				return perr
 			}
 
 			if info.ModTime().After(compareTime) {
-				fmt.Printf("[TORRENTWATCH] newer at %s\n", path)
+				if cache == nil {
+					cache = loadHashCache(w.session)
+				}
+				if !w.touchedOnly(path, info, cache) {
+					fmt.Printf("[TORRENTWATCH] newer at %s\n", path)
+					return errNewFile
+				}
+			}
+			if rel, err := filepath.Rel(w.watchedDir, path); err == nil && recorded[rel] != nil && modeChanged(recorded[rel], info) {
+				fmt.Printf("[TORRENTWATCH] new permissions at %s\n", path)
 				return errNewFile
 			}
 			return nil
 		})
+		if err == nil && current != nil && !sameSymlinks(current.Info.symlinks(), shareSymlinks(w.watchedDir, w.ignorer())) {
+			fmt.Println("[TORRENTWATCH] symbolic links changed")
+			err = errNewFile
+		}
+		// Files may have entered or left the share
+		if st, serr := os.Stat(filepath.Join(w.watchedDir, ignoreFile)); err == nil && serr == nil && st.ModTime().After(compareTime) {
+			err = errNewFile
+		}
 
 		w.lock.Unlock()
 
@@ -116,6 +187,11 @@ func (w *Watcher) watch() {
 
 		compareTime = time.Now()
 
+		if currentState == CHANGED && settled {
+			// The changes are over already, no need to wait for the
+			// next scan to see it
+			previousState, currentState = CHANGED, IDEM
+		}
 		if currentState == IDEM && previousState == CHANGED {
 			// Note that we may be in the CHANGED state for multiple
 			// iterations, such as when changes take more than 10 seconds to
@@ -125,6 +201,10 @@ func (w *Watcher) watch() {
 			// Block until we completely manage it. We will take
 			// care of other changes in the next run of the loop.
 			ih, err := w.torrentify()
+			if err == errHeldRevision {
+				previousState = currentState
+				continue
+			}
 			if err != nil {
 				log.Printf("Couldn't torrentify: ", err)
 				continue
@@ -136,58 +216,199 @@ func (w *Watcher) watch() {
 	}
 }
 
+// ignorer returns what decides which files are left out of the share: the
+// settings, and the ignore file as it is now.
+func (w *Watcher) ignorer() func(relPath string) bool {
+	rules := loadIgnoreFile(w.watchedDir)
+	return func(relPath string) bool {
+		return w.cfg.ignored(relPath) || rules.match(relPath)
+	}
+}
+
+// Rescan makes the watcher scan the directory now rather than at the next
+// tick. Watchers of shares we can't write do nothing.
+func (w *Watcher) Rescan() {
+	select {
+	case w.rescan <- struct{}{}:
+	default:
+	}
+}
+
+// touchedOnly tells whether the file at path, whose modification time
+// changed, still has the content we last saw. The file is only read when
+// cache doesn't know its checksum. The index of contents is updated along
+// the way.
+func (w *Watcher) touchedOnly(path string, info os.FileInfo, cache *hashCache) bool {
+	rel, err := filepath.Rel(w.watchedDir, path)
+	if err != nil {
+		return false
+	}
+	sum, ok := cache.checksum(rel, info, *indexChecksum)
+	if !ok {
+		sum, err = fileChecksum(path, *indexChecksum)
+		if err != nil {
+			log.Printf("Couldn't index %s: %s\n", path, err)
+			return false
+		}
+	}
+
+	size, indexed, ok := w.session.GetContent(rel)
+	err = w.session.SaveContent(rel, info.Size(), sum)
+	if err != nil {
+		log.Printf("Couldn't index %s: %s\n", path, err)
+	}
+	// Checksums of another algorithm never match
+	return ok && size == info.Size() && indexed == sum
+}
+
 func (w *Watcher) torrentify() (ih string, err error) {
 	w.lock.Lock()
 	defer w.lock.Unlock()
 
-	meta, err := createMeta(w.watchedDir)
+	var meta *MetaInfo
+	switch w.cfg.Format {
+	case formatV2, formatHybrid:
+		meta, err = createMetaV2(w.watchedDir, w.ignorer(), w.cfg.Mirrors, w.cfg.Format == formatHybrid)
+	default:
+		cache := loadHashCache(w.session)
+		if meta, err = createMeta(w.watchedDir, w.ignorer(), w.cfg.Mirrors, cache); err == nil {
+			cache.save(w.session)
+		}
+	}
+	if err == nil {
+		err = addSymlinks(meta, w.watchedDir, w.ignorer())
+	}
 	if err != nil {
 		log.Println(err)
 		return
 	}
+	if trackers := w.session.GetTrackers(); len(trackers) > 0 {
+		meta.Announce = trackers[0]
+		meta.AnnounceList = [][]string{trackers}
+	}
+	prev := currentMetaInfo(w.session)
+	if meta.Info.Deleted = tombstones(w.watchedDir, prev, meta, time.Now()); len(meta.Info.Deleted) > 0 {
+		if err = meta.hashInfo(); err != nil {
+			return
+		}
+	}
 
 	var buf bytes.Buffer
 	err = bencode.NewEncoder(&buf).Encode(meta)
 	if err != nil {
 		return
 	}
-	w.session.SaveTorrent(buf.Bytes(), meta.InfoHash, time.Now().Format(time.RFC3339))
+	now := time.Now().Format(time.RFC3339)
+
+	if report, suspicious := w.checkMassChange(prev, meta); suspicious {
+		err = w.session.SavePendingTorrent(buf.Bytes(), meta.InfoHash, now, report.String())
+		if err != nil {
+			return
+		}
+		raiseAlert("mass-change", "Revision %x is held back: %s. Run `rakoshare confirm` to publish it anyway.",
+			meta.InfoHash, report)
+		return "", errHeldRevision
+	}
+
+	// An ordinary revision supersedes anything that was held back
+	w.session.DeletePending()
+	recordRevisionDelta(w.session, prev, meta)
+	w.session.SaveTorrent(buf.Bytes(), meta.InfoHash, now)
 
 	return meta.InfoHash, err
 }
 
-func createMeta(dir string) (meta *MetaInfo, err error) {
-	blockSize := int64(1 << 20) // 1MiB
+// checkMassChange compares the new metainfo with the current one and
+// tells whether it should be held back for confirmation.
+func (w *Watcher) checkMassChange(prev, next *MetaInfo) (report changeReport, suspicious bool) {
+	if prev == nil {
+		return
+	}
+
+	report = analyzeChanges(w.watchedDir, prev, next, w.session.GetLastModTime())
+	return report, report.Suspicious(*massChangeRatio, *massChangeMinFiles)
+}
+
+// promoteConfirmed makes the held back torrent the current one once the
+// user has confirmed it.
+func (w *Watcher) promoteConfirmed() (ih string, ok bool) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	torrent, ih, lastModTime, _, confirmed := w.session.GetPendingTorrent()
+	if !confirmed {
+		return "", false
+	}
+	if next, err := NewMetaInfoFromContent([]byte(torrent)); err == nil {
+		recordRevisionDelta(w.session, currentMetaInfo(w.session), next)
+	}
+	err := w.session.SaveTorrent([]byte(torrent), ih, lastModTime)
+	if err != nil {
+		log.Println("Couldn't save confirmed torrent:", err)
+		return "", false
+	}
+	w.session.DeletePending()
+	return ih, true
+}
+
+// createMeta builds the metainfo of the files of dir. Files that didn't
+// change since they were put in cache aren't hashed again; cache may be
+// nil.
+func createMeta(dir string, ignored func(relPath string) bool, mirrors []string, cache *hashCache) (meta *MetaInfo, err error) {
+	size, err := shareSize(dir, ignored)
+	if err != nil {
+		return
+	}
+	blockSize := pieceLengthFor(size)
 
 	fileDicts := make([]*FileDict, 0)
 
 	hasher := NewBlockHasher(blockSize)
-	err = torrentWalk(dir, func(path string, info os.FileInfo, perr error) (err error) {
+	hasher.expect(size)
+	defer hasher.Close()
+	err = torrentWalk(dir, ignored, func(path string, info os.FileInfo, perr error) (err error) {
 		if perr != nil {
 			return perr
 		}
 
+		relPath, err := filepath.Rel(dir, path)
+		if err != nil {
+			return
+		}
+
 		f, err := os.Open(path)
 		if err != nil {
 			return errors.New(fmt.Sprintf("Couldn't open %s for hashing: %s\n", path, err))
 		}
 		defer f.Close()
 
-		_, err = io.Copy(hasher, f)
+		phase := hasher.phase()
+		var sum string
+		if cached, ok := cache.lookup(relPath, info, blockSize, phase, *manifestChecksum); ok {
+			err = hasher.skipFile(f, info.Size(), cached.Pieces)
+			sum = cached.Checksum
+		} else {
+			var checksum hash.Hash
+			var inner []byte
+			if checksum, err = newChecksum(*manifestChecksum); err != nil {
+				return err
+			}
+			if inner, err = hasher.hashFile(f, info.Size(), checksum); err == nil {
+				sum = formatChecksum(*manifestChecksum, checksum)
+				cache.store(relPath, info, blockSize, phase, sum, inner)
+			}
+		}
 		if err != nil {
 			log.Printf("Couldn't hash %s: %s\n", path, err)
 			return err
 		}
 
-		relPath, err := filepath.Rel(dir, path)
-		if err != nil {
-			return
-		}
-
 		fileDict := &FileDict{
-			Length: info.Size(),
-			Path:   strings.Split(relPath, string(os.PathSeparator)),
+			Length:   info.Size(),
+			Path:     strings.Split(relPath, string(os.PathSeparator)),
+			Checksum: sum,
 		}
+		fileMeta(fileDict, path, info)
 		fileDicts = append(fileDicts, fileDict)
 
 		return
@@ -208,34 +429,137 @@ func createMeta(dir string) (meta *MetaInfo, err error) {
 			Private:     0,
 			Name:        "rakoshare",
 			Files:       fileDicts,
+			Mirrors:     mirrors,
 		},
 	}
 
-	hash := sha1.New()
-	err = bencode.NewEncoder(hash).Encode(meta.Info)
+	err = meta.hashInfo()
+	return
+}
+
+// createMetaV2 builds the v2 metainfo of the files of dir, see merkle.go.
+// Hybrid metainfo also has the v1 pieces and list of files, with pad
+// files between them.
+func createMetaV2(dir string, ignored func(relPath string) bool, mirrors []string, hybrid bool) (meta *MetaInfo, err error) {
+	size, err := shareSize(dir, ignored)
+	if err != nil {
+		return
+	}
+	pieceLength := pieceLengthFor(size)
+
+	var files []v2File
+	var fileDicts []*FileDict
+	layers := make(map[string]string)
+	hasher := NewBlockHasher(pieceLength)
+	defer hasher.Close()
+	err = torrentWalk(dir, ignored, func(path string, info os.FileInfo, perr error) (err error) {
+		if perr != nil {
+			return perr
+		}
+		relPath, err := filepath.Rel(dir, path)
+		if err != nil {
+			return
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("Couldn't open %s for hashing: %s", path, err)
+		}
+		defer f.Close()
+
+		checksum, err := newChecksum(*manifestChecksum)
+		if err != nil {
+			return err
+		}
+		var r io.Reader = io.TeeReader(f, checksum)
+		if hybrid {
+			// Files start on pieces, as in v2
+			if phase := hasher.phase(); phase != 0 {
+				pad := pieceLength - phase
+				hasher.readFull(bytes.NewReader(make([]byte, pad)), pad)
+				fileDicts = append(fileDicts, padFile(pad))
+			}
+			r = io.TeeReader(f, io.MultiWriter(checksum, hasher))
+		}
+		root, layer, err := hashV2File(r, info.Size(), pieceLength)
+		if err != nil {
+			log.Printf("Couldn't hash %s: %s\n", path, err)
+			return err
+		}
+		if layer != nil {
+			layers[string(root)] = string(layer)
+		}
+		fileDict := &FileDict{
+			Length:   info.Size(),
+			Path:     strings.Split(relPath, string(os.PathSeparator)),
+			Checksum: formatChecksum(*manifestChecksum, checksum),
+		}
+		fileMeta(fileDict, path, info)
+		files = append(files, v2File{FileDict: *fileDict, Root: string(root)})
+		fileDicts = append(fileDicts, fileDict)
+		return
+	})
 	if err != nil {
 		return
 	}
-	meta.InfoHash = string(hash.Sum(nil))
 
+	meta = &MetaInfo{
+		Info: &InfoDict{
+			PieceLength: pieceLength,
+			Name:        "rakoshare",
+			Mirrors:     mirrors,
+			MetaVersion: metaVersion2,
+			FileTree:    fileTreeOf(files),
+		},
+		PieceLayers: layers,
+	}
+	if hybrid {
+		hasher.Close()
+		meta.Info.Pieces = string(hasher.Pieces)
+		meta.Info.Files = fileDicts
+	}
+	err = meta.hashInfo()
 	return
 }
 
+// BlockHasher computes the SHA-1 of each piece of what is written to it.
+// Pieces are read in order and hashed by a pool of workers, so that
+// hashing keeps up with the disk on large shares.
 type BlockHasher struct {
-	sha1er    hash.Hash
-	left      int64
 	blockSize int64
-	Pieces    []byte
+	buf       []byte // The current piece
+
+	mu     sync.Mutex // Guards Pieces while workers fill them in
+	Pieces []byte
+
+	jobs    chan hashJob
+	free    chan []byte // Buffers of hashed pieces, to read the next ones
+	buffers int
+	pending sync.WaitGroup
+
+	// Progress, for long hashes
+	total, done int64
+	reported    time.Time
+}
+
+type hashJob struct {
+	offset int // In Pieces
+	data   []byte
 }
 
 func NewBlockHasher(blockSize int64) (h *BlockHasher) {
 	return &BlockHasher{
 		blockSize: blockSize,
-		sha1er:    sha1.New(),
-		left:      blockSize,
+		buf:       make([]byte, 0, blockSize),
+		reported:  time.Now(),
 	}
 }
 
+// expect makes h log its progress through total bytes.
+func (h *BlockHasher) expect(total int64) {
+	h.total = total
+}
+
 // You shouldn't use this one
 func (h *BlockHasher) Write(p []byte) (n int, err error) {
 	n2, err := h.ReadFrom(bytes.NewReader(p))
@@ -243,46 +567,97 @@ func (h *BlockHasher) Write(p []byte) (n int, err error) {
 }
 
 func (h *BlockHasher) ReadFrom(rd io.Reader) (n int64, err error) {
-	var stop bool
-
 	for {
-		if h.left > 0 {
-			thisN, err := io.CopyN(h.sha1er, rd, h.left)
-			if err != nil {
-				if err == io.EOF {
-					stop = true
-				} else {
-					return n, err
-				}
-			}
-			h.left -= thisN
-			n += thisN
+		read, err := io.ReadFull(rd, h.buf[len(h.buf):cap(h.buf)])
+		h.buf = h.buf[:len(h.buf)+read]
+		n += int64(read)
+		h.progress(int64(read))
+		if len(h.buf) == cap(h.buf) {
+			h.dispatch()
 		}
-		if h.left == 0 {
-			h.Pieces = h.sha1er.Sum(h.Pieces)
-			h.sha1er = sha1.New()
-			h.left = h.blockSize
+		switch err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			return n, nil
+		default:
+			return n, err
 		}
+	}
+}
 
-		if stop {
-			break
+// dispatch hands the current piece to the workers, which are started on
+// the first piece.
+func (h *BlockHasher) dispatch() {
+	if h.jobs == nil {
+		workers := *hashWorkers
+		if workers < 1 {
+			workers = 1
+		}
+		h.jobs = make(chan hashJob, workers)
+		h.free = make(chan []byte, 2*workers+1)
+		for i := 0; i < workers; i++ {
+			go h.work()
 		}
 	}
 
-	return
+	h.mu.Lock()
+	offset := len(h.Pieces)
+	h.Pieces = append(h.Pieces, make([]byte, sha1.Size)...)
+	h.mu.Unlock()
+	h.pending.Add(1)
+	h.jobs <- hashJob{offset, h.buf}
+
+	if h.buffers < cap(h.free)-1 {
+		h.buffers++
+		h.buf = make([]byte, 0, h.blockSize)
+	} else {
+		h.buf = (<-h.free)[:0]
+	}
 }
 
+func (h *BlockHasher) work() {
+	for job := range h.jobs {
+		sum := sha1.Sum(job.data)
+		h.mu.Lock()
+		copy(h.Pieces[job.offset:], sum[:])
+		h.mu.Unlock()
+		h.free <- job.data
+		h.pending.Done()
+	}
+}
+
+// wait waits for the pieces handed to the workers to be hashed.
+func (h *BlockHasher) wait() {
+	h.pending.Wait()
+}
+
+func (h *BlockHasher) progress(n int64) {
+	h.done += n
+	if h.total > 0 && time.Since(h.reported) >= hashProgressInterval {
+		h.reported = time.Now()
+		log.Printf("[HASH] %d of %d MiB hashed\n", h.done>>20, h.total>>20)
+	}
+}
+
+// Close hashes the last, partial piece and stops the workers. It can be
+// called again.
 func (h *BlockHasher) Close() (err error) {
-	if h.left == h.blockSize {
-		// We're at the end of a blockSize, we don't have any buffered data
-		return
+	if len(h.buf) > 0 {
+		h.dispatch()
+	}
+	if h.jobs != nil {
+		h.wait()
+		close(h.jobs)
+		h.jobs = nil
 	}
-	h.Pieces = h.sha1er.Sum(h.Pieces)
 	return
 }
 
-func torrentWalk(root string, fn filepath.WalkFunc) (err error) {
-	return filepath.Walk(root, func(path string, info os.FileInfo, perr error) (err error) {
+// torrentWalk walks the files of root that can go in a torrent. Paths
+// for which ignored returns true, relative to root, are skipped; ignored
+// may be nil.
+func torrentWalk(root string, ignored func(relPath string) bool, fn filepath.WalkFunc) (err error) {
+	return walkShare(root, ignored, func(path string, info os.FileInfo, perr error) (err error) {
 		if info == nil || !info.Mode().IsRegular() {
 			return
 		}
@@ -303,3 +678,22 @@ func torrentWalk(root string, fn filepath.WalkFunc) (err error) {
 		return fn(path, info, perr)
 	})
 }
+
+// walkShare walks what is in root, but the directory of rakoshare and the
+// paths for which ignored returns true.
+func walkShare(root string, ignored func(relPath string) bool, fn filepath.WalkFunc) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, perr error) (err error) {
+		if info != nil && info.IsDir() && path != root && filepath.Base(path) == rakoshareDir {
+			return filepath.SkipDir
+		}
+		if info != nil && ignored != nil && path != root {
+			if relPath, err := filepath.Rel(root, path); err == nil && ignored(relPath) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+		return fn(path, info, perr)
+	})
+}
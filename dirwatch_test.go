@@ -1,8 +1,10 @@
 package main
 
 import (
+	"bytes"
 	"crypto/sha1"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"testing"
 )
@@ -27,13 +29,16 @@ func TestTorrentify(t *testing.T) {
 	if testing.Short() {
 		t.Skip("This test requires the iso")
 	}
+	// The expected torrents have pieces of 1MiB
+	defer func(length int64) { *fixedPieceLength = length }(*fixedPieceLength)
+	*fixedPieceLength = 1 << 20
 
 	for _, vec := range vecs {
 		if _, err := os.Stat("testData/dsl-4.4.10.iso"); err != nil && os.IsNotExist(err) {
 			t.Fatal("You need to download the iso relative to a.torrent to run this test")
 		}
 
-		actualMeta, err := createMeta(vec.dir)
+		actualMeta, err := createMeta(vec.dir, nil, nil, nil)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -75,3 +80,39 @@ func split(pieces string) []string {
 	}
 	return out
 }
+
+func TestBlockHasher(t *testing.T) {
+	defer func(workers int) { *hashWorkers = workers }(*hashWorkers)
+
+	data := make([]byte, 10*1000+7)
+	rand.Read(data)
+	var expected []byte
+	for off := 0; off < len(data); off += 1000 {
+		end := off + 1000
+		if end > len(data) {
+			end = len(data)
+		}
+		sum := sha1.Sum(data[off:end])
+		expected = append(expected, sum[:]...)
+	}
+
+	for _, workers := range []int{1, 4} {
+		*hashWorkers = workers
+		h := NewBlockHasher(1000)
+		// Writes that don't fall on pieces
+		for off := 0; off < len(data); off += 333 {
+			end := off + 333
+			if end > len(data) {
+				end = len(data)
+			}
+			if _, err := h.Write(data[off:end]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		h.Close()
+		h.Close()
+		if !bytes.Equal(h.Pieces, expected) {
+			t.Errorf("%d workers: unexpected pieces", workers)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"flag"
+	"sort"
+	"sync"
+)
+
+var (
+	diskWriters = flag.Int("diskWriters", 2, "Number of goroutines writing downloaded blocks to disk, for each share")
+	diskQueue   = flag.Int("diskQueue", 64, "Number of downloaded blocks waiting to be written to disk, beyond which peers aren't read anymore")
+)
+
+// Most blocks a writer takes from the queue at once
+const diskBatch = 32
+
+// blockWrite is a downloaded block to write at the global offset off.
+type blockWrite struct {
+	piece int
+	off   int64
+	data  []byte
+}
+
+// pieceVerification is the result of checking a piece once written.
+type pieceVerification struct {
+	piece int
+	ok    bool
+	err   error
+}
+
+// diskWriter writes downloaded blocks to a store off the main loop.
+// Blocks queued together are sorted, and adjacent ones written at once.
+// When the queue is full, the main loop waits, and so stops reading from
+// peers until the disk catches up.
+type diskWriter struct {
+	store    FileStore
+	queue    chan blockWrite
+	verified chan pieceVerification
+	done     chan struct{}
+	workers  sync.WaitGroup
+
+	mu      sync.Mutex
+	written *sync.Cond
+	pending map[int]int   // Blocks queued or being written, by piece
+	failed  map[int]error // Write errors, by piece
+}
+
+func newDiskWriter(store FileStore) *diskWriter {
+	w := &diskWriter{
+		store:    store,
+		queue:    make(chan blockWrite, *diskQueue),
+		verified: make(chan pieceVerification),
+		done:     make(chan struct{}),
+		pending:  make(map[int]int),
+		failed:   make(map[int]error),
+	}
+	w.written = sync.NewCond(&w.mu)
+	workers := *diskWriters
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		w.workers.Add(1)
+		go w.run()
+	}
+	return w
+}
+
+// write queues data, a block of piece, to be written at the global
+// offset off. It blocks while the queue is full.
+func (w *diskWriter) write(piece int, off int64, data []byte) {
+	w.mu.Lock()
+	w.pending[piece]++
+	w.mu.Unlock()
+	w.queue <- blockWrite{piece, off, data}
+}
+
+// verify waits for the blocks of piece to be written, checks it with
+// check and sends the result on Verified.
+func (w *diskWriter) verify(piece int, check func() (bool, error)) {
+	go func() {
+		w.mu.Lock()
+		for w.pending[piece] > 0 {
+			w.written.Wait()
+		}
+		delete(w.pending, piece)
+		err := w.failed[piece]
+		delete(w.failed, piece)
+		w.mu.Unlock()
+
+		ok := false
+		if err == nil {
+			ok, err = check()
+		}
+		select {
+		case w.verified <- pieceVerification{piece, ok, err}:
+		case <-w.done:
+		}
+	}()
+}
+
+// Verified gives the results of verify. It is nil until there is a
+// writer.
+func (w *diskWriter) Verified() <-chan pieceVerification {
+	if w == nil {
+		return nil
+	}
+	return w.verified
+}
+
+// Close writes what is queued and stops the writer. Verifications not
+// received yet are dropped.
+func (w *diskWriter) Close() {
+	close(w.queue)
+	w.workers.Wait()
+	close(w.done)
+}
+
+func (w *diskWriter) run() {
+	defer w.workers.Done()
+	for first := range w.queue {
+		batch := []blockWrite{first}
+	drain:
+		for len(batch) < diskBatch {
+			select {
+			case b, ok := <-w.queue:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, b)
+			default:
+				break drain
+			}
+		}
+		w.writeBatch(batch)
+	}
+}
+
+func (w *diskWriter) writeBatch(batch []blockWrite) {
+	sort.Sort(byOffset(batch))
+	failed := make(map[int]error)
+	for start := 0; start < len(batch); {
+		end := start + 1
+		length := len(batch[start].data)
+		for end < len(batch) && batch[end].off == batch[start].off+int64(length) {
+			length += len(batch[end].data)
+			end++
+		}
+
+		data := batch[start].data
+		if end-start > 1 {
+			data = make([]byte, 0, length)
+			for _, b := range batch[start:end] {
+				data = append(data, b.data...)
+			}
+		}
+		if _, err := w.store.WriteAt(data, batch[start].off); err != nil {
+			for _, b := range batch[start:end] {
+				failed[b.piece] = err
+			}
+		}
+		start = end
+	}
+
+	w.mu.Lock()
+	for _, b := range batch {
+		w.pending[b.piece]--
+	}
+	for piece, err := range failed {
+		w.failed[piece] = err
+	}
+	w.mu.Unlock()
+	w.written.Broadcast()
+}
+
+type byOffset []blockWrite
+
+func (b byOffset) Len() int           { return len(b) }
+func (b byOffset) Less(i, j int) bool { return b[i].off < b[j].off }
+func (b byOffset) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
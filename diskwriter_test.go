@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+// countingStore is a memoryStore that counts the writes it gets, and
+// fails them while err is set.
+type countingStore struct {
+	*memoryStore
+	mu     sync.Mutex
+	writes int
+	err    error
+}
+
+func newCountingStore(size int64) *countingStore {
+	return &countingStore{memoryStore: newMemoryStore(size, size)}
+}
+
+func (c *countingStore) WriteAt(p []byte, off int64) (int, error) {
+	c.mu.Lock()
+	c.writes++
+	err := c.err
+	c.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return c.memoryStore.WriteAt(p, off)
+}
+
+func (c *countingStore) content() string {
+	buf := make([]byte, c.size)
+	c.ReadAt(buf, 0)
+	return string(buf)
+}
+
+func TestDiskWriterCoalesces(t *testing.T) {
+	store := newCountingStore(8)
+	w := &diskWriter{store: store, pending: map[int]int{0: 4}, failed: make(map[int]error)}
+	w.written = sync.NewCond(&w.mu)
+
+	// Out of order, with a gap
+	w.writeBatch([]blockWrite{{0, 2, []byte("cd")}, {0, 0, []byte("ab")}, {0, 6, []byte("gh")}, {0, 4, []byte("ef")}})
+	if content := store.content(); content != "abcdefgh" {
+		t.Errorf("Unexpected data %q", content)
+	}
+	if store.writes != 1 {
+		t.Errorf("Expected adjacent blocks in 1 write, got %d", store.writes)
+	}
+	if w.pending[0] != 0 {
+		t.Errorf("Expected no pending block, got %d", w.pending[0])
+	}
+}
+
+func TestDiskWriterVerify(t *testing.T) {
+	store := newCountingStore(4)
+	w := newDiskWriter(store)
+	defer w.Close()
+
+	w.write(0, 0, []byte("ab"))
+	w.write(0, 2, []byte("cd"))
+	w.verify(0, func() (bool, error) {
+		return store.content() == "abcd", nil
+	})
+	if v := <-w.Verified(); v.piece != 0 || !v.ok || v.err != nil {
+		t.Errorf("Expected piece 0 to be written before its check, got %+v", v)
+	}
+
+	store.mu.Lock()
+	store.err = errors.New("disk full")
+	store.mu.Unlock()
+	w.write(1, 0, []byte("xy"))
+	w.verify(1, func() (bool, error) {
+		t.Error("A piece that couldn't be written shouldn't be checked")
+		return true, nil
+	})
+	if v := <-w.Verified(); v.piece != 1 || v.ok || v.err == nil {
+		t.Errorf("Expected the write error, got %+v", v)
+	}
+}
+
+func TestCloseStoreFlushes(t *testing.T) {
+	store := newCountingStore(4)
+	ts := &TorrentSession{fileStore: store, writer: newDiskWriter(store)}
+	ts.writer.write(0, 0, []byte("abcd"))
+	ts.closeStore()
+	if store.writes != 1 {
+		t.Errorf("Expected the queued block to be written, got %d writes", store.writes)
+	}
+	if ts.writer != nil || ts.fileStore != nil {
+		t.Error("Expected the store to be released")
+	}
+	// Quitting again is harmless
+	ts.closeStore()
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// When downloaded data is flushed to disk
+const (
+	fsyncNever = "never"
+	fsyncPiece = "piece" // Once each piece is checked
+	fsyncFile  = "file"  // Once each file is complete
+)
+
+var fsyncPolicy = flag.String("fsync", fsyncFile, "When downloaded data is flushed to disk: never, piece once each piece is checked, or file once each file is complete. Complete files are flushed before taking the place of the old ones unless never")
+
+// A syncer is a FileStore whose data is in files that can be flushed to
+// disk.
+type syncer interface {
+	// filesIn returns the names of the files with data in
+	// [off, off+length).
+	filesIn(off, length int64) []string
+}
+
+// syncCompleted flushes what piece completed to disk, as the policy
+// says, without waiting for it. The names of the files are taken on the
+// main loop, which renames them; it waits for the flushes before that,
+// with waitSyncs.
+func (t *TorrentSession) syncCompleted(piece int) {
+	s, ok := t.fileStore.(syncer)
+	if !ok {
+		return
+	}
+	pieceLength := t.m.Info.PieceLength
+	var names []string
+	switch *fsyncPolicy {
+	case fsyncPiece:
+		names = s.filesIn(int64(piece)*pieceLength, pieceSize(t.totalSize, pieceLength, piece))
+	case fsyncFile:
+		for _, r := range t.completedFiles(piece) {
+			names = append(names, s.filesIn(r[0], r[1])...)
+		}
+	}
+	if len(names) == 0 {
+		return
+	}
+	t.syncs.Add(1)
+	go func() {
+		defer t.syncs.Done()
+		for _, name := range names {
+			if err := syncOpenFile(name); err != nil {
+				log.Println("Couldn't flush to disk: ", err)
+			}
+		}
+	}()
+}
+
+// waitSyncs waits for the files being flushed, before they are renamed or
+// closed.
+func (t *TorrentSession) waitSyncs() {
+	t.syncs.Wait()
+}
+
+// completedFiles returns the offset and length in the store of the files
+// that piece completed.
+func (t *TorrentSession) completedFiles(piece int) (ranges [][2]int64) {
+	info := t.m.Info
+	files := info.layout()
+	if len(files) == 0 {
+		files = []*FileDict{{Length: info.Length}}
+	}
+	begin := int64(piece) * info.PieceLength
+	end := begin + pieceSize(t.totalSize, info.PieceLength, piece)
+	var offset int64
+	for _, f := range files {
+		fileEnd := offset + f.Length
+		if f.Length > 0 && fileEnd > begin && offset < end {
+			complete := true
+			for i := int(offset / info.PieceLength); i <= int((fileEnd-1)/info.PieceLength); i++ {
+				if !t.pieceSet.IsSet(i) {
+					complete = false
+					break
+				}
+			}
+			if complete {
+				ranges = append(ranges, [2]int64{offset, f.Length})
+			}
+		}
+		offset = fileEnd
+	}
+	return
+}
+
+// syncOpenFile flushes the file called name to disk, through the file
+// kept open, if any.
+func syncOpenFile(name string) error {
+	pf, err := openFiles.acquire(name)
+	if err != nil {
+		return err
+	}
+	defer openFiles.release(pf)
+	return pf.file.Sync()
+}
+
+// syncFile flushes the file called name to disk.
+func syncFile(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// syncDir flushes the entries of the directory of name, such as a file
+// renamed there.
+func syncDir(name string) error {
+	return syncFile(filepath.Dir(name))
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/rakoo/rakoshare/pkg/bitset"
+)
+
+func TestCompletedFiles(t *testing.T) {
+	// Pieces of 4 bytes: a is in 0, b in 0-2, c in 2
+	info := &InfoDict{PieceLength: 4, Files: []*FileDict{{Length: 2}, {Length: 7}, {Length: 2}}}
+	ts := &TorrentSession{m: &MetaInfo{Info: info}, totalSize: 11, pieceSet: bitset.New(3)}
+
+	ts.pieceSet.Set(0)
+	if files := ts.completedFiles(0); len(files) != 1 || files[0] != [2]int64{0, 2} {
+		t.Errorf("Expected the first file to be complete, got %v", files)
+	}
+	ts.pieceSet.Set(2)
+	if files := ts.completedFiles(2); len(files) != 1 || files[0] != [2]int64{9, 2} {
+		t.Errorf("Expected the last file to be complete, got %v", files)
+	}
+	ts.pieceSet.Set(1)
+	if files := ts.completedFiles(1); len(files) != 1 || files[0] != [2]int64{2, 7} {
+		t.Errorf("Expected the middle file to be complete, got %v", files)
+	}
+}
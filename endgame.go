@@ -0,0 +1,42 @@
+package main
+
+import "io"
+
+// Once a peer has no piece left that nobody is downloading, it is asked
+// for the blocks others are downloading too, one at a time, so that a
+// slow peer holding the last blocks doesn't hold back the download. The
+// first copy of a block to arrive cancels the other requests for it.
+
+// requested tells whether we asked p for block of piece.
+func (p *peerState) requested(piece, block int) bool {
+	for k, r := range p.our_requests {
+		first := int(k&0xffffffff) / STANDARD_BLOCK_LENGTH
+		if int(k>>32) == piece && first <= block && block < first+r.blocks {
+			return true
+		}
+	}
+	return false
+}
+
+// requestEndgame asks p for the blocks of piece that haven't arrived and
+// that p wasn't asked for, those with the fewest requests first, as long
+// as p has room for requests. It returns io.EOF if there was none to ask
+// for.
+func (t *TorrentSession) requestEndgame(p *peerState, piece int) error {
+	v := t.activePieces[piece]
+	requested := false
+	for len(p.our_requests) < p.maxOurRequests() {
+		block := v.chooseBlockToDownloadEndgame(func(block int) bool {
+			return p.requested(piece, block)
+		})
+		if block < 0 {
+			break
+		}
+		t.requestBlockImp(p, piece, block, 1, true)
+		requested = true
+	}
+	if !requested {
+		return io.EOF
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import "testing"
+
+func newEndgamePeer() *peerState {
+	return &peerState{
+		writeChan:    make(chan []byte, 16),
+		closed:       make(chan struct{}),
+		our_requests: make(map[uint64]ourRequest),
+	}
+}
+
+func TestEndgame(t *testing.T) {
+	const blocks = 4
+	ts := &TorrentSession{
+		m:            &MetaInfo{Info: &InfoDict{PieceLength: blocks * STANDARD_BLOCK_LENGTH}},
+		totalSize:    blocks * STANDARD_BLOCK_LENGTH,
+		si:           &SessionInfo{},
+		activePieces: make(map[int]*ActivePiece),
+		peers:        newPeers(),
+	}
+	ts.activatePiece(0)
+	// The piece isn't checked here
+	ts.activePieces[0].verifying = true
+	slow, fast := newEndgamePeer(), newEndgamePeer()
+	ts.peers.peerList = []*peerState{slow, fast}
+
+	// The slow peer has all the blocks in a single request
+	ts.requestBlockImp(slow, 0, 0, blocks, true)
+	for i := range ts.activePieces[0].downloaderCount {
+		ts.activePieces[0].downloaderCount[i]++
+	}
+
+	// The fast one gets as many single blocks as it has room for, and
+	// never the same twice
+	for round := 0; round < 2; round++ {
+		for len(fast.our_requests) < fast.maxOurRequests() {
+			if err := ts.RequestBlock2(fast, 0, true); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := ts.RequestBlock2(fast, 0, true); err == nil {
+			t.Fatal("Expected no room for more requests")
+		}
+		for k := range fast.our_requests {
+			block := int(k&0xffffffff) / STANDARD_BLOCK_LENGTH
+			if err := ts.RecordBlock(fast, 0, uint32(block*STANDARD_BLOCK_LENGTH), STANDARD_BLOCK_LENGTH); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if round == 0 && len(slow.our_requests) == 0 {
+			t.Error("The request of the slow peer was cancelled before all its blocks arrived")
+		}
+	}
+
+	if !ts.activePieces[0].isComplete() {
+		t.Fatal("Expected all the blocks from the fast peer")
+	}
+	if len(slow.our_requests) != 0 {
+		t.Error("Expected the request of the slow peer to be cancelled")
+	}
+	// Requests and cancels
+	if len(slow.writeChan) != 2 {
+		t.Errorf("Expected a request and a cancel for the slow peer, got %d messages", len(slow.writeChan))
+	}
+}
+
+func TestRequestsBoundedByQueue(t *testing.T) {
+	const blocks = 1024
+	ts := &TorrentSession{
+		m:            &MetaInfo{Info: &InfoDict{PieceLength: blocks * STANDARD_BLOCK_LENGTH}},
+		totalSize:    blocks * STANDARD_BLOCK_LENGTH,
+		si:           &SessionInfo{},
+		activePieces: make(map[int]*ActivePiece),
+		peers:        newPeers(),
+	}
+	ts.activatePiece(0)
+	p := newEndgamePeer()
+	p.writeChan = make(chan []byte, blocks)
+	if err := ts.RequestBlock2(p, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(p.our_requests); n == 0 || n > p.maxOurRequests() {
+		t.Errorf("Expected at most %d requests, got %d", p.maxOurRequests(), n)
+	}
+
+	p.snubbed = true
+	p.our_requests = make(map[uint64]ourRequest)
+	ts.RequestBlock2(p, 0, false)
+	if n := len(p.our_requests); n != 1 {
+		t.Errorf("Expected a single request to a snubbed peer, got %d", n)
+	}
+}
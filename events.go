@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Events tell what happens to a share as it syncs. They are POSTed as JSON
+// to the webhooks of the share, for chat rooms, push services or home
+// automation to pick them up.
+
+// Kinds of events
+const (
+	eventRevision     = "revision"      // the share took a new revision
+	eventSynced       = "synced"        // all the files of the revision are here
+	eventConflict     = "conflict"      // a local change was kept aside
+	eventVerifyFailed = "verify-failed" // data from peers was corrupt
+	eventPeerBanned   = "peer-banned"
+)
+
+const (
+	// How many events wait to be posted at most; more are dropped
+	eventQueueSize = 64
+
+	// Corrupt pieces come in bursts: verify-failed events are sent at most
+	// this often, with the count of those left out in between
+	verifyFailedInterval = time.Minute
+)
+
+var eventKinds = []string{eventRevision, eventSynced, eventConflict, eventVerifyFailed, eventPeerBanned}
+
+// An Event is something that happened to a share.
+type Event struct {
+	Kind     string    `json:"kind"`
+	Share    string    `json:"share"`
+	InfoHash string    `json:"infohash,omitempty"`
+	Peer     string    `json:"peer,omitempty"`
+	Message  string    `json:"message"`
+	Time     time.Time `json:"time"`
+}
+
+// eventNotifier sends the events of a share to its webhooks, and shows
+// some of them on the desktop.
+type eventNotifier struct {
+	share  string
+	folder string
+	hooks  []string
+
+	// The kinds of events sent, all when nil
+	kinds map[string]bool
+
+	// Events waiting for the worker posting them to the hooks
+	queue   chan Event
+	stopped chan struct{}
+
+	lock         sync.Mutex
+	lastFailed   time.Time // when the last verify-failed event was sent
+	failedMissed int       // verify-failed events left out since
+}
+
+func newEventNotifier(share, folder string, cfg ShareConfig) *eventNotifier {
+	n := &eventNotifier{share: share, folder: folder, hooks: cfg.Webhooks, stopped: make(chan struct{})}
+	if len(cfg.WebhookEvents) > 0 {
+		n.kinds = make(map[string]bool)
+		for _, kind := range cfg.WebhookEvents {
+			n.kinds[kind] = true
+		}
+	}
+	if len(n.hooks) > 0 {
+		n.queue = make(chan Event, eventQueueSize)
+		go n.post()
+	}
+	return n
+}
+
+// post sends the queued events to the hooks, one after the other, until
+// the notifier is stopped.
+func (n *eventNotifier) post() {
+	for {
+		select {
+		case e := <-n.queue:
+			for _, hook := range n.hooks {
+				if err := postJSON(hook, e); err != nil {
+					log.Printf("Couldn't post %s event to %s: %s\n", e.Kind, redactURL(hook), err)
+				}
+			}
+		case <-n.stopped:
+			return
+		}
+	}
+}
+
+// stop makes the notifier drop the events it hasn't posted yet.
+func (n *eventNotifier) stop() {
+	if n != nil {
+		close(n.stopped)
+	}
+}
+
+// coalesce tells whether a verify-failed event must be left out, because
+// one was sent recently. Otherwise it returns how many were left out
+// since the last one sent.
+func (n *eventNotifier) coalesce(now time.Time) (skip bool, missed int) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if now.Sub(n.lastFailed) < verifyFailedInterval {
+		n.failedMissed++
+		return true, 0
+	}
+	missed = n.failedMissed
+	n.lastFailed = now
+	n.failedMissed = 0
+	return false, missed
+}
+
+// notify sends an event about the torrent with infohash ih, if any, and
+// peer, if any. Nothing is sent without a notifier.
+func (n *eventNotifier) notify(kind, ih, peer, format string, args ...interface{}) {
+	if n == nil {
+		return
+	}
+	e := Event{
+		Kind:    kind,
+		Share:   n.share,
+		Peer:    peer,
+		Message: fmt.Sprintf(format, args...),
+		Time:    time.Now(),
+	}
+	if ih != "" {
+		e.InfoHash = fmt.Sprintf("%x", ih)
+	}
+	if kind == eventVerifyFailed {
+		skip, missed := n.coalesce(e.Time)
+		if skip {
+			return
+		} else if missed > 0 {
+			e.Message += fmt.Sprintf(" (and %d more failures since the last event)", missed)
+		}
+	}
+	notifyDesktop(n.folder, e)
+
+	if n.queue == nil || n.kinds != nil && !n.kinds[kind] {
+		return
+	}
+	select {
+	case n.queue <- e:
+	default:
+		log.Printf("Too many events waiting, dropped %s event\n", kind)
+	}
+}
+
+func validWebhook(hook string) bool {
+	u, err := url.Parse(hook)
+	return err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != ""
+}
+
+func validEventKind(kind string) bool {
+	for _, k := range eventKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// redactURL only keeps the host of a webhook for logs, as the rest of its
+// URL often holds its secret.
+func redactURL(hook string) string {
+	u, err := url.Parse(hook)
+	if err != nil {
+		return "webhook"
+	}
+	return u.Scheme + "://" + u.Host
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"time"
+)
+
+// parseExpiry reads when a share must stop: either a duration from now,
+// such as 48h, or a date in RFC 3339 format. It returns the date in RFC
+// 3339 format.
+func parseExpiry(s string, now time.Time) (string, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(d).Format(time.RFC3339), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return "", newUserError(msgInvalidExpiry, s)
+	}
+	return t.Format(time.RFC3339), nil
+}
+
+// deadline returns when the share stops, if it ever does.
+func (c ShareConfig) deadline() (t time.Time, ok bool) {
+	if c.Expires == "" {
+		return
+	}
+	t, err := time.Parse(time.RFC3339, c.Expires)
+	return t, err == nil
+}
+
+// expired tells whether the share must stop, given how many devices
+// downloaded it, and why.
+func (c ShareConfig) expired(downloads int, now time.Time) (bool, error) {
+	if t, ok := c.deadline(); ok && !now.Before(t) {
+		return true, newUserError(msgExpiredDeadline, c.Expires)
+	}
+	if c.MaxDownloads > 0 && downloads >= c.MaxDownloads {
+		return true, newUserError(msgExpiredDownloads, downloads)
+	}
+	return false, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseExpiry(t *testing.T) {
+	now := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	expires, err := parseExpiry("48h", now)
+	if err != nil || expires != "2015-06-03T12:00:00Z" {
+		t.Fatalf("Unexpected expiry for 48h: %q, %v", expires, err)
+	}
+
+	expires, err = parseExpiry("2015-07-01T18:00:00+02:00", now)
+	if err != nil || expires != "2015-07-01T18:00:00+02:00" {
+		t.Fatalf("Unexpected expiry for a date: %q, %v", expires, err)
+	}
+
+	if _, err := parseExpiry("tomorrow", now); err == nil {
+		t.Fatal("Expected an error for an invalid expiry")
+	}
+}
+
+func TestShareConfigExpired(t *testing.T) {
+	now := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	if expired, _ := (ShareConfig{}).expired(100, now); expired {
+		t.Fatal("A share without limits shouldn't expire")
+	}
+
+	cfg := ShareConfig{Expires: "2015-06-01T12:00:00Z"}
+	if expired, _ := cfg.expired(0, now.Add(-time.Second)); expired {
+		t.Fatal("Expired before the deadline")
+	}
+	if expired, why := cfg.expired(0, now); !expired || why.(userError).Code != msgExpiredDeadline {
+		t.Fatalf("Expected to expire at the deadline, got %v", why)
+	}
+
+	cfg = ShareConfig{MaxDownloads: 2}
+	if expired, _ := cfg.expired(1, now); expired {
+		t.Fatal("Expired before enough downloads")
+	}
+	if expired, why := cfg.expired(2, now); !expired || why.(userError).Code != msgExpiredDownloads {
+		t.Fatalf("Expected to expire after 2 downloads, got %v", why)
+	}
+}
+
+func TestPeerCompletedOnHaveAll(t *testing.T) {
+	ts := &TorrentSession{totalPieces: 2, pieceSet: fullBitset(2), completions: make(chan string, 1)}
+	p := &peerState{address: "10.0.0.1:6881", id: "device", fast: true, can_receive_bitfield: true, peer_choking: true}
+	if err := ts.fastMessage([]byte{HAVE_ALL}, p); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case device := <-ts.completions:
+		if device != "646576696365" {
+			t.Errorf("Expected the device to be told by its peer id, got %s", device)
+		}
+	default:
+		t.Error("Expected a peer that has all pieces to have completed")
+	}
+}
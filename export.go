@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+
+	"github.com/zeebo/bencode"
+
+	"github.com/rakoo/rakoshare/pkg/id"
+)
+
+// Export prints the magnet link of the current revision of a share and,
+// if torrentPath isn't empty, writes its metainfo there, so that any
+// BitTorrent client can fetch a snapshot of the share.
+func Export(cliId, workDir, torrentPath string) error {
+	shareID, err := id.NewFromString(cliId)
+	if err != nil {
+		return newUserError(msgBadID, err)
+	}
+	session, err := openSession(workDir, shareID)
+	if err != nil {
+		return newUserError(msgOpenSession, err)
+	}
+	m := currentMetaInfo(session)
+	if m == nil {
+		return newUserError(msgNoRevision)
+	}
+
+	trackers := session.GetTrackers()
+	if len(trackers) > 0 {
+		m.Announce = trackers[0]
+		m.AnnounceList = [][]string{trackers}
+	}
+	magnet, err := magnetURI(m, trackers)
+	if err != nil {
+		return err
+	}
+	fmt.Println(magnet)
+
+	if torrentPath == "" {
+		return nil
+	}
+	var buf bytes.Buffer
+	if err = bencode.NewEncoder(&buf).Encode(m); err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(torrentPath, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	fmt.Println(T(msgTorrentWritten, torrentPath))
+	return nil
+}
+
+// magnetURI returns the magnet link of m: with its v1 infohash, its v2
+// one as a multihash (BEP 52), or both for hybrid torrents.
+func magnetURI(m *MetaInfo, trackers []string) (string, error) {
+	var xt []string
+	if !m.Info.pureV2() {
+		xt = append(xt, fmt.Sprintf("urn:btih:%x", m.InfoHash))
+	}
+	if m.Info.isV2() {
+		var info bytes.Buffer
+		if err := bencode.NewEncoder(&info).Encode(m.Info); err != nil {
+			return "", err
+		}
+		// 0x12 is SHA-256, of 0x20 bytes
+		xt = append(xt, fmt.Sprintf("urn:btmh:1220%x", sha256.Sum256(info.Bytes())))
+	}
+
+	magnet := "magnet:?xt=" + strings.Join(xt, "&xt=")
+	if m.Info.Name != "" {
+		magnet += "&dn=" + url.QueryEscape(m.Info.Name)
+	}
+	for _, tr := range trackers {
+		magnet += "&tr=" + url.QueryEscape(tr)
+	}
+	return magnet, nil
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMagnetURI(t *testing.T) {
+	v1 := &MetaInfo{Info: &InfoDict{Name: "rakoshare", PieceLength: 4, Pieces: "01234567890123456789"}, InfoHash: "\x01\x02"}
+	magnet, err := magnetURI(v1, []string{"udp://tracker:80/announce"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "magnet:?xt=urn:btih:0102&dn=rakoshare&tr=udp%3A%2F%2Ftracker%3A80%2Fannounce"; magnet != expected {
+		t.Errorf("Expected %s, got %s", expected, magnet)
+	}
+
+	v2 := &MetaInfo{Info: &InfoDict{Name: "rakoshare", PieceLength: 1 << 14, MetaVersion: metaVersion2}}
+	if magnet, _ = magnetURI(v2, nil); strings.Contains(magnet, "btih") || !strings.Contains(magnet, "xt=urn:btmh:1220") {
+		t.Errorf("Expected only the v2 infohash, got %s", magnet)
+	}
+	v2.Info.Pieces = v1.Info.Pieces
+	if magnet, _ = magnetURI(v2, nil); strings.Count(magnet, "xt=") != 2 {
+		t.Errorf("Expected both infohashes of a hybrid torrent, got %s", magnet)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net"
+	"sync"
+)
+
+// Number of distinct peers that must agree on our address before we
+// believe them
+const externalIPQuorum = 2
+
+// externalIPs collects the addresses peers see us connect from, through
+// the yourip field of the extension handshake. It is shared by all
+// sessions of the process.
+type externalIPs struct {
+	sync.Mutex
+	votes map[string]map[string]bool // our address -> peers that saw it
+}
+
+var ourExternalIPs = &externalIPs{votes: make(map[string]map[string]bool)}
+
+// record notes that peer sees us with the compact address yourip.
+func (e *externalIPs) record(peer string, yourip string) {
+	if len(yourip) != net.IPv4len && len(yourip) != net.IPv6len {
+		return
+	}
+	ip := net.IP(yourip).String()
+	host, _, err := net.SplitHostPort(peer)
+	if err != nil {
+		host = peer
+	}
+
+	e.Lock()
+	defer e.Unlock()
+	if e.votes[ip] == nil {
+		e.votes[ip] = make(map[string]bool)
+	}
+	e.votes[ip][host] = true
+}
+
+// get returns the address most peers see us with, if enough of them
+// agree.
+func (e *externalIPs) get() (ip net.IP, ok bool) {
+	e.Lock()
+	defer e.Unlock()
+
+	best := 0
+	for candidate, peers := range e.votes {
+		if len(peers) > best {
+			best = len(peers)
+			ip = net.ParseIP(candidate)
+		}
+	}
+	return ip, best >= externalIPQuorum
+}
+
+// compactIP returns the address of peer in the format of the yourip
+// field.
+func compactIP(peer string) string {
+	host, _, err := net.SplitHostPort(peer)
+	if err != nil {
+		return ""
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return string(ip4)
+	}
+	return string(ip.To16())
+}
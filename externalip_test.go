@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestExternalIPQuorum(t *testing.T) {
+	e := &externalIPs{votes: make(map[string]map[string]bool)}
+	ours := string(net.ParseIP("203.0.113.7").To4())
+
+	e.record("198.51.100.1:6881", ours)
+	e.record("198.51.100.1:6882", ours) // Same peer, another connection
+	e.record("198.51.100.2:6881", "garbage")
+	if _, ok := e.get(); ok {
+		t.Fatal("Expected a single peer not to be enough")
+	}
+
+	e.record("198.51.100.3:6881", ours)
+	ip, ok := e.get()
+	if !ok || !ip.Equal(net.ParseIP("203.0.113.7")) {
+		t.Fatalf("Expected 203.0.113.7, got %v %v", ip, ok)
+	}
+}
+
+func TestCompactIP(t *testing.T) {
+	if got := compactIP("1.2.3.4:5"); got != "\x01\x02\x03\x04" {
+		t.Errorf("Expected 4 bytes for an IPv4 peer, got %q", got)
+	}
+	if got := compactIP("[2001:db8::1]:5"); len(got) != net.IPv6len {
+		t.Errorf("Expected 16 bytes for an IPv6 peer, got %q", got)
+	}
+	if got := compactIP("nonsense"); got != "" {
+		t.Errorf("Expected nothing, got %q", got)
+	}
+}
+
+func TestListenAddress(t *testing.T) {
+	p := &peerState{address: "1.2.3.4:50123"}
+	if got := p.listenAddress(); got != p.address {
+		t.Errorf("Expected %s, got %s", p.address, got)
+	}
+	p.readExtensionHandshake(ExtensionHandshake{V: "other", P: 6881, Reqq: 1})
+	if got := p.listenAddress(); got != "1.2.3.4:6881" {
+		t.Errorf("Expected 1.2.3.4:6881, got %s", got)
+	}
+	if p.client != "other" || p.maxOurRequests() != 1 {
+		t.Errorf("Handshake not taken into account: %q, %d", p.client, p.maxOurRequests())
+	}
+}
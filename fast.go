@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"net"
+
+	"github.com/rakoo/rakoshare/pkg/bitset"
+)
+
+// Fast Extension (BEP-0006). Source:
+// http://bittorrent.org/beps/bep_0006.html
+
+// Number of pieces a peer may request from us even when choked
+const allowedFastSetSize = 10
+
+// Suggestions remembered per peer; older ones are forgotten
+const maxSuggestedPieces = 16
+
+// supportsFast tells whether the peer that sent header supports the Fast
+// Extension.
+func supportsFast(header []byte) bool {
+	return header[7]&0x04 == 0x04
+}
+
+func fullBitset(n int) *bitset.Bitset {
+	b := bitset.New(n)
+	for i := 0; i < n; i++ {
+		b.Set(i)
+	}
+	return b
+}
+
+// allowedFastSet computes the pieces a peer at ip can download while
+// choked, with the canonical algorithm of BEP-0006 so that both ends agree.
+// It is only defined for IPv4 peers.
+func allowedFastSet(ip net.IP, infohash string, numPieces, k int) []int {
+	ip4 := ip.To4()
+	if ip4 == nil || numPieces == 0 {
+		return nil
+	}
+	if k > numPieces {
+		k = numPieces
+	}
+
+	x := make([]byte, 0, 4+len(infohash))
+	x = append(x, ip4[0], ip4[1], ip4[2], 0)
+	x = append(x, infohash...)
+
+	var set []int
+	seen := make(map[int]bool, k)
+	for len(set) < k {
+		sum := sha1.Sum(x)
+		x = sum[:]
+		for i := 0; i < 5 && len(set) < k; i++ {
+			index := int(binary.BigEndian.Uint32(x[i*4:i*4+4]) % uint32(numPieces))
+			if !seen[index] {
+				seen[index] = true
+				set = append(set, index)
+			}
+		}
+	}
+	return set
+}
+
+// sendHaves tells p which pieces we have, or offers it a first piece
+// when super-seeding. Fast peers get a single HAVE_ALL or HAVE_NONE when
+// that says it all, and the pieces they are allowed to get while choked.
+func (t *TorrentSession) sendHaves(p *peerState) {
+	pieces, good := t.pieceSet, t.goodPieces
+	if t.superSeed != nil {
+		// Pieces are offered one at a time
+		pieces, good = bitset.New(t.totalPieces), 0
+		defer t.offerPiece(p)
+	}
+	if !p.fast {
+		p.SendBitfield(pieces)
+		return
+	}
+
+	switch good {
+	case 0:
+		p.sendOneCharMessage(HAVE_NONE)
+	case t.totalPieces:
+		p.sendOneCharMessage(HAVE_ALL)
+	default:
+		p.SendBitfield(pieces)
+	}
+
+	host, _, err := net.SplitHostPort(p.address)
+	if err != nil {
+		return
+	}
+	p.ourAllowedFast = make(map[uint32]bool)
+	for _, piece := range allowedFastSet(net.ParseIP(host), t.m.InfoHash, t.totalPieces, allowedFastSetSize) {
+		p.ourAllowedFast[uint32(piece)] = true
+		p.sendPieceMessage(ALLOWED_FAST, uint32(piece))
+	}
+}
+
+// rejectRequest tells a fast peer we won't serve its request. Other
+// peers are expected to time out.
+func (t *TorrentSession) rejectRequest(p *peerState, index, begin, length uint32) {
+	if !p.fast {
+		return
+	}
+	msg := make([]byte, 13)
+	msg[0] = REJECT_REQUEST
+	binary.BigEndian.PutUint32(msg[1:5], index)
+	binary.BigEndian.PutUint32(msg[5:9], begin)
+	binary.BigEndian.PutUint32(msg[9:13], length)
+	p.sendMessage(msg)
+}
+
+// fastMessage handles the messages of the Fast Extension, once we have the
+// torrent.
+func (t *TorrentSession) fastMessage(message []byte, p *peerState) (err error) {
+	if !p.fast {
+		return errors.New("Fast Extension message from a peer that doesn't support it")
+	}
+
+	switch message[0] {
+	case HAVE_ALL, HAVE_NONE:
+		if len(message) != 1 {
+			return errors.New("Unexpected length")
+		}
+		// A super-seed done hiding its pieces may tell it has them all
+		// late, but never that it lost them
+		if !p.can_receive_bitfield && (message[0] == HAVE_NONE || p.have == nil) {
+			return errors.New("Late have all/none")
+		}
+		p.can_receive_bitfield = false
+		if message[0] == HAVE_NONE {
+			p.have = bitset.New(t.totalPieces)
+			return
+		}
+		p.have = fullBitset(t.totalPieces)
+		t.peerCompleted(p)
+		if t.superSeed != nil {
+			t.endSuperSeed()
+		}
+		t.checkInteresting(p)
+		if !p.peer_choking {
+			for i := 0; i < p.maxOurRequests(); i++ {
+				err = t.RequestBlock(p)
+				if err != nil {
+					return
+				}
+			}
+		}
+	case SUGGEST:
+		if len(message) != 5 {
+			return errors.New("Unexpected length")
+		}
+		piece := int(binary.BigEndian.Uint32(message[1:]))
+		if !p.have.IsWithinLimits(piece) {
+			return errors.New("suggest index is out of range.")
+		}
+		p.suggested = append(p.suggested, piece)
+		if len(p.suggested) > maxSuggestedPieces {
+			p.suggested = p.suggested[1:]
+		}
+	case REJECT_REQUEST:
+		if len(message) != 13 {
+			return errors.New("Unexpected length")
+		}
+		piece := binary.BigEndian.Uint32(message[1:5])
+		begin := binary.BigEndian.Uint32(message[5:9])
+		requestIndex := (uint64(piece) << 32) | uint64(begin)
+		r, ok := p.our_requests[requestIndex]
+		if !ok {
+			return errors.New("Rejected a request we didn't make")
+		}
+		delete(p.our_requests, requestIndex)
+		t.removeRequest(int(piece), int(begin)/STANDARD_BLOCK_LENGTH, r.blocks)
+	case ALLOWED_FAST:
+		if len(message) != 5 {
+			return errors.New("Unexpected length")
+		}
+		piece := int(binary.BigEndian.Uint32(message[1:]))
+		if !p.have.IsWithinLimits(piece) {
+			// Peers may compute their set without knowing the torrent;
+			// out of range pieces are simply ignored
+			return
+		}
+		if p.allowedFast == nil {
+			p.allowedFast = make(map[int]bool)
+		}
+		p.allowedFast[piece] = true
+		if p.peer_choking {
+			t.requestAllowedFast(p)
+		}
+	}
+	return
+}
+
+// requestAllowedFast requests, from a peer that chokes us, the pieces it
+// allows us to get anyway.
+func (t *TorrentSession) requestAllowedFast(p *peerState) {
+	if len(p.our_requests) >= p.maxOurRequests() {
+		return
+	}
+	for piece := range p.allowedFast {
+		if t.pieceSet.IsSet(piece) || !p.have.IsSet(piece) {
+			continue
+		}
+		if _, ok := t.activePieces[piece]; !ok {
+			t.activatePiece(piece)
+		}
+		t.RequestBlock2(p, piece, false)
+		if len(p.our_requests) >= p.maxOurRequests() {
+			return
+		}
+	}
+}
+
+// chooseSuggested returns a piece p suggested that we still need and
+// nobody downloads yet, or -1.
+func (t *TorrentSession) chooseSuggested(p *peerState) int {
+	for i := len(p.suggested) - 1; i >= 0; i-- {
+		piece := p.suggested[i]
+		if t.pieceSet.IsSet(piece) || !p.have.IsSet(piece) {
+			continue
+		}
+		if _, ok := t.activePieces[piece]; !ok {
+			return piece
+		}
+	}
+	return -1
+}
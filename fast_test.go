@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Vectors from BEP-0006
+func TestAllowedFastSet(t *testing.T) {
+	ip := net.ParseIP("80.4.4.200")
+	infohash := strings.Repeat("\xaa", 20)
+
+	expected := []int{1059, 431, 808, 1217, 287, 376, 1188}
+	if set := allowedFastSet(ip, infohash, 1313, 7); !reflect.DeepEqual(set, expected) {
+		t.Fatalf("Expected %v, got %v", expected, set)
+	}
+
+	expected = append(expected, 353, 508)
+	if set := allowedFastSet(ip, infohash, 1313, 9); !reflect.DeepEqual(set, expected) {
+		t.Fatalf("Expected %v, got %v", expected, set)
+	}
+}
+
+func TestAllowedFastSetSmallTorrent(t *testing.T) {
+	set := allowedFastSet(net.ParseIP("10.0.0.1"), strings.Repeat("a", 20), 3, allowedFastSetSize)
+	if len(set) != 3 {
+		t.Fatalf("Expected all 3 pieces, got %v", set)
+	}
+	if set := allowedFastSet(net.ParseIP("::1"), strings.Repeat("a", 20), 100, 5); set != nil {
+		t.Fatalf("Expected no set for IPv6 peers, got %v", set)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"strings"
+	"time"
+)
+
+var carryXattrs = flag.Bool("xattrs", false, "Carry the user extended attributes of the shared files, where the system has them")
+
+// fileMeta records in f the time of the last change, the permissions and
+// the extended attributes of the file at path.
+func fileMeta(f *FileDict, path string, info os.FileInfo) {
+	f.Mtime = info.ModTime().Unix()
+	f.Mode = uint32(info.Mode().Perm())
+	if *carryXattrs {
+		f.Xattrs = readXattrs(path)
+	}
+}
+
+// modeChanged tells whether the permissions of a file differ from those
+// f records. Torrents made before modes were recorded never differ.
+func modeChanged(f *FileDict, info os.FileInfo) bool {
+	return f.Mode != 0 && os.FileMode(f.Mode).Perm() != info.Mode().Perm()
+}
+
+// applyFileMeta gives the file at path the metadata f records, where it
+// differs.
+func applyFileMeta(path string, f *FileDict) error {
+	st, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if modeChanged(f, st) {
+		if err := os.Chmod(path, os.FileMode(f.Mode).Perm()); err != nil {
+			return err
+		}
+	}
+	if len(f.Xattrs) > 0 {
+		current := readXattrs(path)
+		for name, value := range f.Xattrs {
+			if !strings.HasPrefix(name, "user.") || current[name] == value {
+				continue
+			}
+			if err := writeXattr(path, name, value); err != nil {
+				return err
+			}
+		}
+	}
+	if f.Mtime != 0 && st.ModTime().Unix() != f.Mtime {
+		mtime := time.Unix(f.Mtime, 0)
+		return os.Chtimes(path, mtime, mtime)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCreateMetaFileMeta(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filemeta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	run := filepath.Join(dir, "run.sh")
+	ioutil.WriteFile(run, []byte("#!/bin/sh\n"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "notes"), []byte("notes"), 0644)
+	mtime := time.Unix(1400000000, 0)
+	os.Chtimes(run, mtime, mtime)
+
+	for _, v2 := range []bool{false, true} {
+		var meta *MetaInfo
+		if v2 {
+			meta, err = createMetaV2(dir, nil, nil, false)
+		} else {
+			meta, err = createMeta(dir, nil, nil, nil)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		var f *FileDict
+		for _, file := range meta.Info.fileList() {
+			if file.Path[0] == "run.sh" {
+				f = file
+			}
+		}
+		if f == nil {
+			t.Fatal("run.sh missing from the metainfo")
+		}
+		if f.Mode != 0755 || f.Mtime != mtime.Unix() {
+			t.Errorf("Expected mode 755 and mtime %d, got %o and %d", mtime.Unix(), f.Mode, f.Mtime)
+		}
+	}
+}
+
+func TestApplyFileMeta(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filemeta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "run.sh")
+	ioutil.WriteFile(path, []byte("#!/bin/sh\n"), 0600)
+
+	f := &FileDict{Mode: 0755, Mtime: 1400000000}
+	info, _ := os.Stat(path)
+	if !modeChanged(f, info) {
+		t.Error("Permissions should differ")
+	}
+	if modeChanged(&FileDict{}, info) {
+		t.Error("Torrents without modes shouldn't differ")
+	}
+
+	if err := applyFileMeta(path, f); err != nil {
+		t.Fatal(err)
+	}
+	info, _ = os.Stat(path)
+	if info.Mode().Perm() != 0755 {
+		t.Errorf("Expected mode 755, got %o", info.Mode().Perm())
+	}
+	if info.ModTime().Unix() != f.Mtime {
+		t.Errorf("Expected mtime %d, got %d", f.Mtime, info.ModTime().Unix())
+	}
+	if modeChanged(f, info) {
+		t.Error("Permissions shouldn't differ anymore")
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"container/list"
+	"flag"
+	"os"
+	"sync"
+)
+
+var maxOpenFiles = flag.Int("maxOpenFiles", 64, "Maximum number of shared files kept open between reads and writes, for all shares together")
+
+// openFiles keeps the files of all the stores open between accesses, so
+// that serving a piece doesn't cost an open and a close per block.
+var openFiles = newFilePool()
+
+// pooledFile is an open file of the pool. It is only closed once nobody
+// uses it anymore.
+type pooledFile struct {
+	name  string
+	file  *os.File
+	users int
+	stale bool
+	elem  *list.Element
+}
+
+// filePool is a set of open files, by name, of which the least recently
+// used are closed when there are too many.
+type filePool struct {
+	sync.Mutex
+	files map[string]*pooledFile
+	lru   *list.List // Most recently used first
+}
+
+func newFilePool() *filePool {
+	return &filePool{files: make(map[string]*pooledFile), lru: list.New()}
+}
+
+// acquire returns the open file with that name. Files are opened for
+// writing when possible, and for reading only otherwise. Callers must
+// release the file when they're done with it.
+func (p *filePool) acquire(name string) (*pooledFile, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	if pf, ok := p.files[name]; ok {
+		pf.users++
+		p.lru.MoveToFront(pf.elem)
+		return pf, nil
+	}
+
+	file, err := os.OpenFile(name, os.O_RDWR, 0600)
+	if os.IsPermission(err) {
+		file, err = os.Open(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	pf := &pooledFile{name: name, file: file, users: 1}
+	pf.elem = p.lru.PushFront(pf)
+	p.files[name] = pf
+	p.trim()
+	return pf, nil
+}
+
+func (p *filePool) release(pf *pooledFile) {
+	p.Lock()
+	defer p.Unlock()
+	pf.users--
+	if pf.stale && pf.users == 0 {
+		pf.file.Close()
+	}
+}
+
+// trim closes the least recently used files beyond the budget. Files in
+// use are skipped, so the pool may go over it for a while.
+func (p *filePool) trim() {
+	max := *maxOpenFiles
+	if max < 1 {
+		max = 1
+	}
+	for e := p.lru.Back(); e != nil && p.lru.Len() > max; {
+		pf := e.Value.(*pooledFile)
+		e = e.Prev()
+		if pf.users == 0 {
+			p.remove(pf)
+		}
+	}
+}
+
+// remove takes pf out of the pool and closes it, now or when its last
+// user releases it.
+func (p *filePool) remove(pf *pooledFile) {
+	p.lru.Remove(pf.elem)
+	delete(p.files, pf.name)
+	pf.stale = true
+	if pf.users == 0 {
+		pf.file.Close()
+	}
+}
+
+// invalidate closes the files with those names, for instance before they
+// are renamed or replaced.
+func (p *filePool) invalidate(names ...string) {
+	p.Lock()
+	defer p.Unlock()
+	for _, name := range names {
+		if pf, ok := p.files[name]; ok {
+			p.remove(pf)
+		}
+	}
+}
+
+// Len returns the number of files in the pool.
+func (p *filePool) Len() int {
+	p.Lock()
+	defer p.Unlock()
+	return p.lru.Len()
+}
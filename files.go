@@ -2,12 +2,14 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"os"
 	"path"
 	"sort"
 	"strings"
+	"time"
 )
 
 type FileStore interface {
@@ -15,8 +17,9 @@ type FileStore interface {
 	io.WriterAt
 	io.Closer
 
-	// Set all pieces from this one to be bad
-	SetBad(from int64)
+	// Set the data in [off, off+length), such as a piece that failed
+	// verification, to be bad
+	SetBad(off, length int64)
 
 	// When downloading is finished, call Finish to move .part files to
 	// real files
@@ -26,14 +29,75 @@ type FileStore interface {
 type fileEntry struct {
 	length int64
 	name   string
+	pad    bool      // Zeros that aren't stored
+	meta   *FileDict // Given to the file once complete
 }
 
 type fileStore struct {
-	offsets []int64
-	files   []fileEntry // Stored in increasing globalOffset order
+	offsets  []int64
+	files    []fileEntry // Stored in increasing globalOffset order
+	size     int64
+	versions *versionKeeper // Where the files replaced go
 }
 
-func (fe *fileEntry) open(name string, length int64) (err error) {
+var errPastEndOfStore = errors.New("access past the end of the store")
+
+// Reads and writes through file handles, the default storage
+const storageFiles = "files"
+
+func init() {
+	registerStore(storageFiles, func(info *InfoDict, storePath string, opts storeOptions) (FileStore, int64, error) {
+		fs, totalSize, err := newFileStore(info, storePath, opts.allocation)
+		if err != nil {
+			return nil, 0, err
+		}
+		fs.versions = newVersionKeeper(storePath, opts.versions)
+		return fs, totalSize, nil
+	})
+}
+
+// How files being downloaded are allocated
+const (
+	allocSparse = "sparse"    // Truncated to their length, the default
+	allocFull   = "fallocate" // Reserved on disk at their length
+	allocNone   = "none"      // Growing as blocks are written
+)
+
+func validAllocation(allocation string) bool {
+	switch allocation {
+	case "", allocSparse, allocFull, allocNone:
+		return true
+	}
+	return false
+}
+
+// allocate gives the new file f its length as allocation says.
+func allocate(f *os.File, length int64, allocation string) error {
+	switch allocation {
+	case allocNone:
+		return nil
+	case allocFull:
+		return preallocate(f, length)
+	}
+	return f.Truncate(length)
+}
+
+// writeZeros preallocates f by writing its length in zeros, where the
+// system can't do it.
+func writeZeros(f *os.File, length int64) error {
+	zeros := make([]byte, 64*1024)
+	for off := int64(0); off < length; off += int64(len(zeros)) {
+		if length-off < int64(len(zeros)) {
+			zeros = zeros[:length-off]
+		}
+		if _, err := f.WriteAt(zeros, off); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fe *fileEntry) open(name string, length int64, allocation string) (err error) {
 	partname := name + ".part"
 	_, parterr := os.Stat(partname)
 	if parterr == nil {
@@ -76,9 +140,9 @@ func (fe *fileEntry) open(name string, length int64) (err error) {
 		}
 		fe.name = partname
 
-		err = os.Truncate(fe.name, length)
+		err = allocate(f, length, allocation)
 		if err != nil {
-			err = errors.New("could not truncate file")
+			return fmt.Errorf("could not allocate %s: %s", partname, err)
 		}
 	}
 
@@ -90,10 +154,11 @@ func (fe *fileEntry) isPart() bool {
 }
 
 func (fe *fileEntry) SetPart() {
-	if fe.isPart() {
+	if fe.pad || fe.isPart() {
 		return
 	}
 
+	openFiles.invalidate(fe.name)
 	err := copyfile(fe.name, fe.name+".part")
 	if err != nil {
 		log.Println("Error at copying to .part file: ", err)
@@ -108,12 +173,26 @@ func (fe *fileEntry) SetPart() {
 }
 
 func (fe *fileEntry) ReadAt(p []byte, off int64) (n int, err error) {
-	file, err := os.Open(fe.name)
+	if fe.pad {
+		for i := range p {
+			p[i] = 0
+		}
+		return len(p), nil
+	}
+	pf, err := openFiles.acquire(fe.name)
 	if err != nil {
 		return
 	}
-	defer file.Close()
-	n, err = file.ReadAt(p, off)
+	defer openFiles.release(pf)
+	n, err = pf.file.ReadAt(p, off)
+	if err == io.EOF && fe.isPart() {
+		// Files allocated as they are written end at the last block
+		// written
+		for i := n; i < len(p); i++ {
+			p[i] = 0
+		}
+		n, err = len(p), nil
+	}
 	if err != nil {
 		log.Printf("Couldn't read %d-%d from %s: %s\n", off,
 			off+int64(len(p)), fe.name, err)
@@ -123,27 +202,41 @@ func (fe *fileEntry) ReadAt(p []byte, off int64) (n int, err error) {
 }
 
 func (fe *fileEntry) WriteAt(p []byte, off int64) (n int, err error) {
-	file, err := os.OpenFile(fe.name, os.O_RDWR, 0600)
+	if fe.pad {
+		return len(p), nil
+	}
+	pf, err := openFiles.acquire(fe.name)
 	if err != nil {
 		return
 	}
-	defer file.Close()
-	return file.WriteAt(p, off)
+	defer openFiles.release(pf)
+	return pf.file.WriteAt(p, off)
 }
 
+// Cleanup replaces the real file with the complete part file. The part
+// file is flushed first, so that a power loss leaves either the old file
+// or the whole new one.
 func (fe *fileEntry) Cleanup() (err error) {
 	if fe.isPart() {
 		realname := strings.Replace(fe.name, ".part", "", 1)
-		err = copyfile(fe.name, realname)
-		if err != nil {
-			log.Printf("Couldn't copy to real file: ", err)
+		openFiles.invalidate(fe.name, realname)
+		if *fsyncPolicy != fsyncNever {
+			if err = syncFile(fe.name); err != nil {
+				log.Println("Couldn't flush part file: ", err)
+				return
+			}
 		}
-
-		err = os.Remove(fe.name)
+		err = os.Rename(fe.name, realname)
 		if err != nil {
-			log.Printf("Couldn't remove part file: ", err)
+			log.Println("Couldn't rename part file: ", err)
+			return
 		}
 		fe.name = realname
+		if *fsyncPolicy != fsyncNever {
+			if err = syncDir(realname); err != nil {
+				log.Println("Couldn't flush directory: ", err)
+			}
+		}
 	}
 
 	return
@@ -168,33 +261,55 @@ func ensureDirectory(fullPath string) (err error) {
 }
 
 func NewFileStore(info *InfoDict, storePath string) (f FileStore, totalSize int64, err error) {
-	fs := new(fileStore)
-	numFiles := len(info.Files)
+	fs, totalSize, err := newFileStore(info, storePath, allocSparse)
+	if err != nil {
+		return
+	}
+	return fs, totalSize, nil
+}
+
+func newFileStore(info *InfoDict, storePath, allocation string) (fs *fileStore, totalSize int64, err error) {
+	fs = new(fileStore)
+	files := info.layout()
+	numFiles := len(files)
 	if numFiles == 0 {
 		// Create dummy Files structure.
-		info = &InfoDict{Files: []*FileDict{&FileDict{info.Length, []string{info.Name}, info.Md5sum}}}
+		files = []*FileDict{&FileDict{Length: info.Length, Path: []string{info.Name}, Md5sum: info.Md5sum}}
 		numFiles = 1
 	}
 	fs.files = make([]fileEntry, numFiles)
 	fs.offsets = make([]int64, numFiles)
-	for i, _ := range info.Files {
-		src := info.Files[i]
+	ignored := loadIgnoreFile(storePath)
+	for i, _ := range files {
+		src := files[i]
+		if src.isPad() {
+			fs.files[i] = fileEntry{length: src.Length, pad: true}
+			fs.offsets[i] = totalSize
+			totalSize += src.Length
+			continue
+		}
 		// Clean the source path before appending to the storePath. This
 		// ensures that source paths that start with ".." can't escape.
 		cleanSrcPath := path.Clean("/" + path.Join(src.Path...))[1:]
 		fullPath := path.Join(storePath, cleanSrcPath)
+		if ignored.match(cleanSrcPath) {
+			// Left out of the folder, but still needed to check and
+			// serve the pieces
+			fullPath = path.Join(storePath, rakoshareDir, "ignored", cleanSrcPath)
+		}
 		err = ensureDirectory(fullPath)
 		if err != nil {
 			return
 		}
-		err = fs.files[i].open(fullPath, src.Length)
+		err = fs.files[i].open(fullPath, src.Length, allocation)
 		if err != nil {
 			return
 		}
+		fs.files[i].meta = src
 		fs.offsets[i] = totalSize
 		totalSize += src.Length
 	}
-	f = fs
+	fs.size = totalSize
 	return
 }
 
@@ -207,37 +322,22 @@ func (f *fileStore) find(offset int64) int {
 	})
 }
 
-func (f *fileStore) ReadAt(p []byte, off int64) (n int, err error) {
-	index := f.find(off)
-	for len(p) > 0 && index < len(f.offsets) {
-		chunk := int64(len(p))
-		entry := &f.files[index]
-		itemOffset := off - f.offsets[index]
-		if itemOffset < entry.length {
-			space := entry.length - itemOffset
-			if space < chunk {
-				chunk = space
-			}
-			var nThisTime int
-			nThisTime, err = entry.ReadAt(p[0:chunk], itemOffset)
-			n = n + nThisTime
-			if err != nil {
-				return
-			}
-			p = p[nThisTime:]
-			off += int64(nThisTime)
-		}
-		index++
-	}
-	// At this point if there's anything left to read it means we've run off the
-	// end of the file store. Read zeros. This is defined by the bittorrent protocol.
-	for i, _ := range p {
-		p[i] = 0
+// checkBounds makes sure [off, off+length) is within the store. The last
+// piece of a torrent is shorter than the others rather than padded, so
+// callers never have a reason to go past the end.
+func (f *fileStore) checkBounds(off int64, length int) error {
+	if off < 0 || off+int64(length) > f.size {
+		return errPastEndOfStore
 	}
-	return
+	return nil
 }
 
-func (f *fileStore) WriteAt(p []byte, off int64) (n int, err error) {
+// span calls access on the parts of p that belong to each file, from
+// the global offset off.
+func (f *fileStore) span(p []byte, off int64, access func(entry *fileEntry, p []byte, off int64) (int, error)) (n int, err error) {
+	if err = f.checkBounds(off, len(p)); err != nil {
+		return
+	}
 	index := f.find(off)
 	for len(p) > 0 && index < len(f.offsets) {
 		chunk := int64(len(p))
@@ -249,7 +349,7 @@ func (f *fileStore) WriteAt(p []byte, off int64) (n int, err error) {
 				chunk = space
 			}
 			var nThisTime int
-			nThisTime, err = entry.WriteAt(p[0:chunk], itemOffset)
+			nThisTime, err = access(entry, p[0:chunk], itemOffset)
 			n += nThisTime
 			if err != nil {
 				return
@@ -259,38 +359,75 @@ func (f *fileStore) WriteAt(p []byte, off int64) (n int, err error) {
 		}
 		index++
 	}
-	// At this point if there's anything left to write it means we've run off the
-	// end of the file store. Check that the data is zeros.
-	// This is defined by the bittorrent protocol.
-	for i, _ := range p {
-		if p[i] != 0 {
-			err = errors.New("unexpected non-zero data at end of store")
-			n = n + i
-			return
-		}
-	}
-	n = n + len(p)
 	return
 }
 
-func (f *fileStore) SetBad(from int64) {
-	index := f.find(from)
-	for index < len(f.offsets) {
-		entry := &f.files[index]
-		entry.SetPart()
-		index++
+func (f *fileStore) ReadAt(p []byte, off int64) (n int, err error) {
+	return f.span(p, off, (*fileEntry).ReadAt)
+}
+
+func (f *fileStore) WriteAt(p []byte, off int64) (n int, err error) {
+	return f.span(p, off, (*fileEntry).WriteAt)
+}
+
+// SetBad makes part files of the files with data in [off, off+length),
+// leaving the others alone.
+func (f *fileStore) SetBad(off, length int64) {
+	for i := range f.files {
+		entry := &f.files[i]
+		if f.offsets[i] < off+length && f.offsets[i]+entry.length > off {
+			entry.SetPart()
+		}
 	}
 }
 
 func (f *fileStore) Cleanup() (err error) {
-	for _, fe := range f.files {
+	now := time.Now()
+	for i := range f.files {
+		fe := &f.files[i]
+		if fe.isPart() {
+			if _, kerr := f.versions.keep(strings.TrimSuffix(fe.name, ".part"), now); kerr != nil {
+				log.Println("Couldn't keep the previous version: ", kerr)
+			}
+		}
 		err = fe.Cleanup()
+		if err == nil && !fe.pad && fe.meta != nil {
+			if merr := applyFileMeta(fe.name, fe.meta); merr != nil {
+				log.Println("Couldn't set the times and permissions: ", merr)
+			}
+		}
 	}
 
 	return
 }
 
+// filesIn returns the names of the files with data in [off, off+length).
+// As Cleanup renames files, it must be called from the same goroutine.
+func (f *fileStore) filesIn(off, length int64) (names []string) {
+	for i, fe := range f.files {
+		if fe.pad || f.offsets[i] >= off+length || f.offsets[i]+fe.length <= off {
+			continue
+		}
+		names = append(names, fe.name)
+	}
+	return
+}
+
+// Close flushes the files being downloaded, unless the policy says never,
+// so that they can be resumed, and closes the files of the store that are
+// still open.
 func (f *fileStore) Close() (err error) {
+	for _, fe := range f.files {
+		if fe.pad {
+			continue
+		}
+		if fe.isPart() && *fsyncPolicy != fsyncNever {
+			if serr := syncFile(fe.name); serr != nil && err == nil {
+				err = serr
+			}
+		}
+		openFiles.invalidate(fe.name)
+	}
 	return
 }
 
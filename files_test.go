@@ -3,6 +3,9 @@ package main
 import (
 	"crypto/sha1"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -29,8 +32,8 @@ var tests []testFile = []testFile{{
 }}
 
 func mkFileStore(tf testFile) (fs *fileStore, err error) {
-	f := fileEntry{tf.fileLen, tf.path}
-	return &fileStore{[]int64{0}, []fileEntry{f}}, nil
+	f := fileEntry{tf.fileLen, tf.path, false, nil}
+	return &fileStore{[]int64{0}, []fileEntry{f}, tf.fileLen, nil}, nil
 }
 
 func TestFileStoreRead(t *testing.T) {
@@ -52,3 +55,175 @@ func TestFileStoreRead(t *testing.T) {
 		}
 	}
 }
+
+func TestFileStoreBounds(t *testing.T) {
+	for _, testFile := range tests {
+		fs, err := mkFileStore(testFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Reading the end of the last piece is fine
+		last := make([]byte, 4)
+		n, err := fs.ReadAt(last, testFile.fileLen-int64(len(last)))
+		if err != nil || n != len(last) {
+			t.Errorf("Reading the end of the store: %d, %v", n, err)
+		}
+
+		// Going past it isn't, even with zeros
+		n, err = fs.ReadAt(make([]byte, 4), testFile.fileLen-2)
+		if err != errPastEndOfStore {
+			t.Errorf("Expected an error reading past the end, got %d, %v", n, err)
+		}
+		n, err = fs.WriteAt(make([]byte, 4), testFile.fileLen-2)
+		if err != errPastEndOfStore || n != 0 {
+			t.Errorf("Expected an error writing past the end, got %d, %v", n, err)
+		}
+		n, err = fs.WriteAt([]byte{1}, -1)
+		if err != errPastEndOfStore {
+			t.Errorf("Expected an error writing before the start, got %d, %v", n, err)
+		}
+	}
+}
+
+func TestFilePool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filepool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	names := make([]string, 3)
+	for i := range names {
+		names[i] = filepath.Join(dir, fmt.Sprint(i))
+		if err := ioutil.WriteFile(names[i], []byte{byte(i)}, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	defer func(max int) { *maxOpenFiles = max }(*maxOpenFiles)
+	*maxOpenFiles = 2
+	pool := newFilePool()
+
+	first, err := pool.acquire(names[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names[1:] {
+		pf, err := pool.acquire(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pool.release(pf)
+	}
+	// The least recently used file is in use, so the next one goes
+	if pool.Len() != 2 || pool.files[names[1]] != nil {
+		t.Errorf("Expected %s to be closed, pool has %d files", names[1], pool.Len())
+	}
+
+	// Files invalidated while in use stay open until released
+	pool.invalidate(names[0])
+	if _, err := first.file.WriteAt([]byte{9}, 0); err != nil {
+		t.Error("Couldn't write to a file in use: ", err)
+	}
+	pool.release(first)
+	if _, err := first.file.WriteAt([]byte{9}, 0); err == nil {
+		t.Error("Expected an invalidated file to be closed")
+	}
+	if pool.Len() != 1 {
+		t.Errorf("Expected 1 file left, got %d", pool.Len())
+	}
+}
+
+func TestFileStoreSetPart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filestore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(name, []byte("abcd"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	fs := &fileStore{[]int64{0}, []fileEntry{{4, name, false, nil}}, 4, nil}
+	defer fs.Close()
+
+	buf := make([]byte, 4)
+	if _, err := fs.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	// Writes after SetBad go to the part file, not to the open real one
+	fs.SetBad(0, 4)
+	if _, err := fs.WriteAt([]byte("xy"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := ioutil.ReadFile(name); string(content) != "abcd" {
+		t.Errorf("Expected the real file to be untouched, got %q", content)
+	}
+
+	if err := fs.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if fs.files[0].name != name {
+		t.Errorf("Expected the store to use %s again, got %s", name, fs.files[0].name)
+	}
+	if _, err := fs.ReadAt(buf, 0); err != nil || string(buf) != "xycd" {
+		t.Errorf("Expected to read the written data, got %q, %v", buf, err)
+	}
+}
+
+func TestFileStoreAllocation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "allocation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	info := &InfoDict{Name: "file", Length: 100000}
+	for allocation, size := range map[string]int64{allocSparse: 100000, allocFull: 100000, allocNone: 0} {
+		storePath := filepath.Join(dir, allocation)
+		fs, _, err := newFileStore(info, storePath, allocation)
+		if err != nil {
+			t.Fatal(allocation, ": ", err)
+		}
+		st, err := os.Stat(filepath.Join(storePath, "file.part"))
+		if err != nil || st.Size() != size {
+			t.Errorf("%s: expected a file of %d bytes, got %v, %v", allocation, size, st, err)
+		}
+
+		// Blocks not written read as zeros
+		if _, err := fs.WriteAt([]byte{1}, 10); err != nil {
+			t.Fatal(allocation, ": ", err)
+		}
+		buf := []byte{9, 9}
+		if _, err := fs.ReadAt(buf, 99998); err != nil || buf[0] != 0 || buf[1] != 0 {
+			t.Errorf("%s: expected zeros, got %v, %v", allocation, buf, err)
+		}
+		fs.Close()
+	}
+}
+
+func TestFileStoreSetBadPiece(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filestore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var entries []fileEntry
+	for _, name := range []string{"a", "b", "c"} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte("abcd"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, fileEntry{4, path, false, nil})
+	}
+	fs := &fileStore{[]int64{0, 4, 8}, entries, 12, nil}
+	defer fs.Close()
+
+	// A piece ending where c starts only touches a and b
+	fs.SetBad(2, 6)
+	for i, part := range []bool{true, true, false} {
+		if fs.files[i].isPart() != part {
+			t.Errorf("File %d: expected part %v, got %s", i, part, fs.files[i].name)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+var (
+	watchEvents         = flag.Bool("watchEvents", true, "Watch shared directories for changes with the notifications of the system, rather than only scanning them")
+	quiescence          = flag.Duration("quiescence", 2*time.Second, "How long a shared directory must stay still after a change before a revision is made of it")
+	watchRescanInterval = flag.Duration("watchRescanInterval", time.Hour, "How often directories watched for changes are scanned anyway, in case a notification was missed")
+)
+
+// dirEvents watches a directory and all the directories under it for
+// changes. When a burst of changes is over, that is once no change came
+// for the quiescence window, it signals on Settled.
+type dirEvents struct {
+	root    string
+	ignored func(relPath string) bool
+	quiet   time.Duration
+	watcher *fsnotify.Watcher
+	settled chan struct{}
+	done    chan struct{}
+}
+
+func newDirEvents(root string, ignored func(relPath string) bool, quiet time.Duration) (*dirEvents, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	d := &dirEvents{
+		root:    root,
+		ignored: ignored,
+		quiet:   quiet,
+		watcher: watcher,
+		settled: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	// Systems only watch single directories
+	if err := d.addTree(root); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	go d.run()
+	return d, nil
+}
+
+// addTree watches dir and the directories under it.
+func (d *dirEvents) addTree(dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path == dir {
+				return err
+			}
+			return nil
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if path != d.root && d.outside(path) {
+			return filepath.SkipDir
+		}
+		return d.watcher.Add(path)
+	})
+}
+
+// outside tells whether path is left out of the share, as torrentWalk
+// does, so that its changes don't matter.
+func (d *dirEvents) outside(path string) bool {
+	rel, err := filepath.Rel(d.root, path)
+	if err != nil {
+		return true
+	}
+	if strings.SplitN(filepath.ToSlash(rel), "/", 2)[0] == rakoshareDir {
+		return true
+	}
+	return d.ignored != nil && d.ignored(rel)
+}
+
+// irrelevant tells whether a change to the file at path can't change the
+// share.
+func (d *dirEvents) irrelevant(path string) bool {
+	base := filepath.Base(path)
+	if base == ignoreFile {
+		return false
+	}
+	return strings.HasPrefix(base, ".") || filepath.Ext(path) == ".part" || d.outside(path)
+}
+
+func (d *dirEvents) run() {
+	timer := time.NewTimer(d.quiet)
+	timer.Stop()
+	reset := func() {
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(d.quiet)
+	}
+
+	for {
+		select {
+		case ev, ok := <-d.watcher.Events:
+			if !ok {
+				return
+			}
+			if ev.Op&fsnotify.Create != 0 {
+				if st, err := os.Stat(ev.Name); err == nil && st.IsDir() && !d.outside(ev.Name) {
+					if err := d.addTree(ev.Name); err != nil {
+						log.Printf("[WATCH] Couldn't watch %s: %s", ev.Name, err)
+					}
+				}
+			}
+			if d.irrelevant(ev.Name) {
+				continue
+			}
+			reset()
+		case err, ok := <-d.watcher.Errors:
+			if !ok {
+				return
+			}
+			// Events may have been lost: look for ourselves
+			log.Println("[WATCH]", err)
+			reset()
+		case <-timer.C:
+			select {
+			case d.settled <- struct{}{}:
+			default:
+			}
+		case <-d.done:
+			return
+		}
+	}
+}
+
+// Settled signals that the directory changed and has been still since.
+// It is nil until there are events.
+func (d *dirEvents) Settled() <-chan struct{} {
+	if d == nil {
+		return nil
+	}
+	return d.settled
+}
+
+func (d *dirEvents) Close() error {
+	close(d.done)
+	return d.watcher.Close()
+}
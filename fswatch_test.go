@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestDirEventsDebounce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fswatch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d, err := newDirEvents(dir, nil, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// Left out of the share
+	for _, name := range []string{"a.part", ".hidden", filepath.Join(rakoshareDir, "versions", "x")} {
+		d.watcher.Events <- fsnotify.Event{Name: filepath.Join(dir, name), Op: fsnotify.Write}
+	}
+	select {
+	case <-d.Settled():
+		t.Fatal("Expected no signal for files outside the share")
+	case <-time.After(150 * time.Millisecond):
+	}
+
+	// A burst of writes makes a single signal
+	for i := 0; i < 5; i++ {
+		d.watcher.Events <- fsnotify.Event{Name: filepath.Join(dir, "a"), Op: fsnotify.Write}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case <-d.Settled():
+	case <-time.After(time.Second):
+		t.Fatal("Expected a signal once the writes are over")
+	}
+	select {
+	case <-d.Settled():
+		t.Fatal("Expected a single signal for the burst")
+	case <-time.After(150 * time.Millisecond):
+	}
+}
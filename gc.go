@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/rakoo/rakoshare/pkg/id"
+	"github.com/rakoo/rakoshare/pkg/sharesession"
+)
+
+var keepTorrents = flag.Int("keepTorrents", 10, "Number of past revisions of each share whose torrent is kept to roll back to; older ones stay in the history without it")
+
+// pruneSession forgets the torrents of old revisions and the deltas that
+// no longer count in the baseline of alerts. It returns the number of
+// records forgotten.
+func pruneSession(session *sharesession.Session) (removed int64, err error) {
+	keep := *keepTorrents
+	if keep < 1 {
+		// Rolling back needs at least the current one
+		keep = 1
+	}
+	n, err := session.PruneRevisionTorrents(keep)
+	if err != nil {
+		return
+	}
+	removed += n
+	n, err = session.PruneRevisionDeltas(deltaHistory)
+	removed += n
+	return
+}
+
+// GC forgets the stale state of a share: on top of what is pruned with
+// each revision, the content index of files no longer in the folder. The
+// room is given back to the system.
+func GC(cliId, workDir string) error {
+	shareID, err := id.NewFromString(cliId)
+	if err != nil {
+		return newUserError(msgBadID, err)
+	}
+	session, err := openSession(workDir, shareID)
+	if err != nil {
+		return newUserError(msgOpenSession, err)
+	}
+
+	removed, err := pruneSession(session)
+	if err != nil {
+		return err
+	}
+	if target := session.GetTarget(); target != "" {
+		n, err := session.PruneContents(func(path string) bool {
+			_, err := os.Stat(filepath.Join(target, path))
+			return !os.IsNotExist(err)
+		})
+		if err != nil {
+			return err
+		}
+		removed += n
+	}
+	if err = session.Vacuum(); err != nil {
+		return err
+	}
+	fmt.Println(T(msgGCDone, removed))
+	return nil
+}
@@ -9,7 +9,13 @@ import (
 	"github.com/rakoo/rakoshare/pkg/sharesession"
 )
 
-func Generate(target, workDir string) error {
+func Generate(target, workDir string, trackers []string, cfg ShareConfig) error {
+	if cfg.Profile != "" {
+		if _, err := loadProfile(workDir, cfg.Profile); err != nil {
+			return err
+		}
+	}
+
 	tmpId, err := id.New()
 	if err != nil {
 		return err
@@ -27,5 +33,18 @@ func Generate(target, workDir string) error {
 	if err != nil {
 		return err
 	}
-	return session.SaveSession(target, tmpId)
+	err = session.SaveSession(target, tmpId)
+	if err != nil {
+		return err
+	}
+	err = protectSecrets(workDir, session, tmpId)
+	if err != nil {
+		return err
+	}
+	err = session.AddTrackers(trackers)
+	if err != nil {
+		return err
+	}
+
+	return saveShareConfig(session, cfg)
 }
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/sha1"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/rakoo/rakoshare/pkg/sharesession"
+)
+
+// hashCache remembers the piece hashes of the shared files, so that
+// building the next revision only reads the files that changed.
+//
+// Pieces span file boundaries, so the first and last pieces of a file
+// depend on its neighbours and are always hashed again; only the pieces
+// fully inside a file are cached. They stay valid as long as the file
+// starts at the same offset in its first piece.
+type hashCache struct {
+	entries map[string]sharesession.FileHashes
+	seen    map[string]bool
+	changed map[string]bool
+}
+
+func newHashCache(entries map[string]sharesession.FileHashes) *hashCache {
+	if entries == nil {
+		entries = make(map[string]sharesession.FileHashes)
+	}
+	return &hashCache{entries: entries, seen: make(map[string]bool), changed: make(map[string]bool)}
+}
+
+// loadHashCache reads the cache of the share, starting afresh if it
+// can't be read.
+func loadHashCache(session *sharesession.Session) *hashCache {
+	entries, err := session.GetFileHashes()
+	if err != nil {
+		log.Println("Couldn't read the hash cache:", err)
+	}
+	return newHashCache(entries)
+}
+
+// lookup returns the cached hashes of the file at relPath if it didn't
+// change and starts at phase in its first piece. A nil cache has nothing.
+func (c *hashCache) lookup(relPath string, info os.FileInfo, pieceLength, phase int64, algo string) (h sharesession.FileHashes, ok bool) {
+	if c == nil {
+		return
+	}
+	c.seen[relPath] = true
+	h, ok = c.entries[relPath]
+	if !ok || h.Size != info.Size() || h.ModTime != info.ModTime().UnixNano() || h.Inode != fileInode(info) ||
+		h.PieceLength != pieceLength || h.Phase != phase || !strings.HasPrefix(h.Checksum, algo+":") {
+		return h, false
+	}
+	_, middle, _ := fileSpan(info.Size(), pieceLength, phase)
+	return h, int64(len(h.Pieces)) == middle/pieceLength*sha1.Size
+}
+
+// checksum returns the cached checksum of the whole file at relPath, if
+// it didn't change and was computed with algo. A nil cache has nothing.
+func (c *hashCache) checksum(relPath string, info os.FileInfo, algo string) (sum string, ok bool) {
+	if c == nil {
+		return
+	}
+	h, ok := c.entries[relPath]
+	if !ok || h.Size != info.Size() || h.ModTime != info.ModTime().UnixNano() || h.Inode != fileInode(info) ||
+		!strings.HasPrefix(h.Checksum, algo+":") {
+		return "", false
+	}
+	return h.Checksum, true
+}
+
+func (c *hashCache) store(relPath string, info os.FileInfo, pieceLength, phase int64, checksum string, pieces []byte) {
+	if c == nil {
+		return
+	}
+	c.seen[relPath] = true
+	c.changed[relPath] = true
+	c.entries[relPath] = sharesession.FileHashes{
+		Size:        info.Size(),
+		ModTime:     info.ModTime().UnixNano(),
+		Inode:       fileInode(info),
+		PieceLength: pieceLength,
+		Phase:       phase,
+		Checksum:    checksum,
+		Pieces:      pieces,
+	}
+}
+
+// save writes the new entries to the session and forgets the files that
+// weren't seen since the cache was loaded.
+func (c *hashCache) save(session *sharesession.Session) {
+	for path, h := range c.entries {
+		var err error
+		switch {
+		case !c.seen[path]:
+			err = session.DeleteFileHashes(path)
+		case c.changed[path]:
+			err = session.SaveFileHashes(path, h)
+		}
+		if err != nil {
+			log.Println("Couldn't update the hash cache:", err)
+			return
+		}
+	}
+}
+
+// hashFile feeds the size bytes of f to h, along with checksum, and
+// returns the hashes of the pieces fully inside f.
+func (h *BlockHasher) hashFile(f io.Reader, size int64, checksum hash.Hash) (inner []byte, err error) {
+	head, middle, tail := fileSpan(size, h.blockSize, h.phase())
+	r := io.TeeReader(f, checksum)
+	if err = h.readFull(r, head); err != nil {
+		return
+	}
+	h.mu.Lock()
+	before := len(h.Pieces)
+	h.mu.Unlock()
+	if err = h.readFull(r, middle); err != nil {
+		return
+	}
+	if middle > 0 {
+		h.wait()
+		h.mu.Lock()
+		inner = append([]byte(nil), h.Pieces[before:]...)
+		h.mu.Unlock()
+	}
+	err = h.readFull(r, tail)
+	return
+}
+
+// skipFile feeds f to h as hashFile would, but only reads its head and
+// tail: the pieces in between are the cached inner ones.
+func (h *BlockHasher) skipFile(f io.ReaderAt, size int64, inner []byte) error {
+	head, middle, tail := fileSpan(size, h.blockSize, h.phase())
+	if err := h.readFull(io.NewSectionReader(f, 0, head), head); err != nil {
+		return err
+	}
+	h.mu.Lock()
+	h.Pieces = append(h.Pieces, inner...)
+	h.mu.Unlock()
+	h.progress(middle)
+	return h.readFull(io.NewSectionReader(f, head+middle, tail), tail)
+}
+
+// readFull feeds exactly n bytes of r to h.
+func (h *BlockHasher) readFull(r io.Reader, n int64) error {
+	read, err := h.ReadFrom(io.LimitReader(r, n))
+	if err == nil && read != n {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// phase returns the offset in the current piece.
+func (h *BlockHasher) phase() int64 {
+	return int64(len(h.buf))
+}
+
+// fileSpan splits a file of size bytes, starting at phase in a piece,
+// into the head that completes its first piece, the middle made of whole
+// pieces, and the tail that starts its last one.
+func fileSpan(size, pieceLength, phase int64) (head, middle, tail int64) {
+	head = (pieceLength - phase) % pieceLength
+	if head > size {
+		head = size
+	}
+	middle = (size - head) / pieceLength * pieceLength
+	tail = size - head - middle
+	return
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileSpan(t *testing.T) {
+	vectors := []struct {
+		size, phase, head, middle, tail int64
+	}{
+		{10, 0, 0, 10, 0},
+		{25, 0, 0, 20, 5},
+		{25, 4, 6, 10, 9},
+		{3, 4, 3, 0, 0},
+		{6, 4, 6, 0, 0},
+	}
+	for _, v := range vectors {
+		head, middle, tail := fileSpan(v.size, 10, v.phase)
+		if head != v.head || middle != v.middle || tail != v.tail {
+			t.Errorf("%d bytes at %d: expected %d/%d/%d, got %d/%d/%d",
+				v.size, v.phase, v.head, v.middle, v.tail, head, middle, tail)
+		}
+	}
+}
+
+func TestCreateMetaHashCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hashcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "a"), bytes.Repeat([]byte("a"), 1<<19), 0644)
+	b := filepath.Join(dir, "b")
+	ioutil.WriteFile(b, bytes.Repeat([]byte("b"), 3<<20), 0644)
+
+	expected, err := createMeta(dir, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := newHashCache(nil)
+	for i := 0; i < 2; i++ {
+		meta, err := createMeta(dir, nil, nil, cache)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta.InfoHash != expected.InfoHash {
+			t.Fatalf("Run %d: expected %x, got %x", i, expected.InfoHash, meta.InfoHash)
+		}
+	}
+
+	// Changes that keep the size and time go unnoticed: the inner pieces
+	// come from the cache
+	info, _ := os.Stat(b)
+	f, _ := os.OpenFile(b, os.O_WRONLY, 0644)
+	f.WriteAt([]byte("changed"), 3<<19)
+	f.Close()
+	os.Chtimes(b, info.ModTime(), info.ModTime())
+	if meta, _ := createMeta(dir, nil, nil, cache); meta.InfoHash != expected.InfoHash {
+		t.Fatal("Expected the cached hashes to be used")
+	}
+
+	later := info.ModTime().Add(time.Second)
+	os.Chtimes(b, later, later)
+	fresh, _ := createMeta(dir, nil, nil, nil)
+	meta, err := createMeta(dir, nil, nil, cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.InfoHash == expected.InfoHash || meta.InfoHash != fresh.InfoHash {
+		t.Fatal("Expected the changed file to be hashed again")
+	}
+}
+
+func TestHashCacheChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hashcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a := filepath.Join(dir, "a")
+	ioutil.WriteFile(a, []byte("content"), 0644)
+	info, _ := os.Stat(a)
+
+	var none *hashCache
+	if _, ok := none.checksum("a", info, "sha1"); ok {
+		t.Error("Expected nothing from a nil cache")
+	}
+	cache := newHashCache(nil)
+	cache.store("a", info, 10, 0, "sha1:abcd", nil)
+	if sum, ok := cache.checksum("a", info, "sha1"); !ok || sum != "sha1:abcd" {
+		t.Errorf("Expected the cached checksum, got %q", sum)
+	}
+	if _, ok := cache.checksum("a", info, "sha256"); ok {
+		t.Error("Expected checksums of another algorithm to be left out")
+	}
+	later := info.ModTime().Add(time.Second)
+	os.Chtimes(a, later, later)
+	info, _ = os.Stat(a)
+	if _, ok := cache.checksum("a", info, "sha1"); ok {
+		t.Error("Expected a changed file to be read again")
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	massChangeRatio    = flag.Float64("massChangeRatio", 0.5, "Hold a new revision for confirmation when more than this fraction of files were rewritten or renamed with random-looking contents. 0 disables the check")
+	massChangeMinFiles = flag.Int("massChangeMinFiles", 10, "Minimum number of changed files for a revision to be considered a mass change")
+)
+
+const (
+	// Shannon entropy, in bits per byte, above which data looks
+	// encrypted.
+	highEntropyThreshold = 7.5
+
+	// Share of the changed files that must look encrypted for the
+	// revision to be suspicious.
+	highEntropyShare = 0.75
+
+	// How much of each file is read to estimate its entropy.
+	entropySampleSize = 64 * 1024
+)
+
+// changeReport summarizes how a new revision differs from the previous
+// one. A rename is seen as one file removed and one file added.
+type changeReport struct {
+	Previous    int // Number of files in the previous revision
+	Modified    int
+	Added       int
+	Removed     int
+	HighEntropy int // Modified or added files with random-looking contents
+}
+
+func (r changeReport) Changed() int {
+	return r.Modified + r.Added
+}
+
+// Suspicious tells whether the change looks like what ransomware does to
+// a directory: most of the existing files are rewritten or renamed at
+// once, and the new contents look encrypted.
+func (r changeReport) Suspicious(ratio float64, minFiles int) bool {
+	if ratio <= 0 || r.Previous == 0 {
+		return false
+	}
+	changed := r.Changed()
+	if changed < minFiles {
+		return false
+	}
+	if float64(r.Modified+r.Removed)/float64(r.Previous) < ratio {
+		return false
+	}
+	return float64(r.HighEntropy)/float64(changed) >= highEntropyShare
+}
+
+func (r changeReport) String() string {
+	return fmt.Sprintf("%d modified, %d added and %d removed out of %d files, %d of them with random-looking contents",
+		r.Modified, r.Added, r.Removed, r.Previous, r.HighEntropy)
+}
+
+// analyzeChanges compares the files of the next revision, found in dir,
+// with those of the previous revision. A file that is in both is
+// considered modified if its size changed or if it was written after
+// since.
+func analyzeChanges(dir string, prev, next *MetaInfo, since time.Time) (r changeReport) {
+	before := make(map[string]int64)
+	if prev != nil && prev.Info != nil {
+		for _, f := range prev.Info.fileList() {
+			before[filepath.Join(f.Path...)] = f.Length
+		}
+	}
+	r.Previous = len(before)
+
+	seen := make(map[string]bool, len(before))
+	for _, f := range next.Info.fileList() {
+		rel := filepath.Join(f.Path...)
+		full := filepath.Join(dir, rel)
+		seen[rel] = true
+
+		length, existed := before[rel]
+		switch {
+		case !existed:
+			r.Added++
+		case length != f.Length || modifiedSince(full, since):
+			r.Modified++
+		default:
+			continue
+		}
+
+		if e, err := sampleEntropy(full); err == nil && e >= highEntropyThreshold {
+			r.HighEntropy++
+		}
+	}
+
+	for rel := range before {
+		if !seen[rel] {
+			r.Removed++
+		}
+	}
+	return
+}
+
+func modifiedSince(path string, since time.Time) bool {
+	st, err := os.Stat(path)
+	if err != nil {
+		return true
+	}
+	return st.ModTime().After(since)
+}
+
+// sampleEntropy estimates the entropy of a file from its first bytes.
+func sampleEntropy(path string) (float64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	buf := make([]byte, entropySampleSize)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return 0, err
+	}
+	return entropy(buf[:n]), nil
+}
+
+// entropy returns the Shannon entropy of data, in bits per byte.
+func entropy(data []byte) float64 {
+	if len(data) == 0 {
+		return 0
+	}
+	var counts [256]int
+	for _, b := range data {
+		counts[b]++
+	}
+
+	var e float64
+	total := float64(len(data))
+	for _, c := range counts {
+		if c == 0 {
+			continue
+		}
+		p := float64(c) / total
+		e -= p * math.Log2(p)
+	}
+	return e
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestEntropy(t *testing.T) {
+	if e := entropy(bytes.Repeat([]byte("a"), 1024)); e != 0 {
+		t.Errorf("Entropy of a constant buffer should be 0, got %f", e)
+	}
+
+	text := bytes.Repeat([]byte("The quick brown fox jumps over the lazy dog. "), 100)
+	if e := entropy(text); e >= highEntropyThreshold {
+		t.Errorf("English text shouldn't look encrypted, got %f", e)
+	}
+
+	random := make([]byte, entropySampleSize)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+	if e := entropy(random); e < highEntropyThreshold {
+		t.Errorf("Random data should look encrypted, got %f", e)
+	}
+}
+
+func TestSuspicious(t *testing.T) {
+	cases := []struct {
+		report     changeReport
+		suspicious bool
+	}{
+		// First revision: nothing to compare with
+		{changeReport{Previous: 0, Added: 100, HighEntropy: 100}, false},
+		// Everything renamed and encrypted
+		{changeReport{Previous: 100, Added: 100, Removed: 100, HighEntropy: 100}, true},
+		// Everything rewritten in place with encrypted contents
+		{changeReport{Previous: 100, Modified: 90, HighEntropy: 90}, true},
+		// A photo import: lots of new random-looking files, nothing touched
+		{changeReport{Previous: 100, Added: 200, HighEntropy: 200}, false},
+		// A mass edit of text files
+		{changeReport{Previous: 100, Modified: 100, HighEntropy: 2}, false},
+		// Too few files to tell
+		{changeReport{Previous: 4, Modified: 4, HighEntropy: 4}, false},
+	}
+
+	for i, c := range cases {
+		if got := c.report.Suspicious(0.5, 10); got != c.suspicious {
+			t.Errorf("case %d (%s): expected %v, got %v", i, c.report, c.suspicious, got)
+		}
+	}
+
+	if (changeReport{Previous: 100, Modified: 100, HighEntropy: 100}).Suspicious(0, 10) {
+		t.Error("A zero ratio should disable the check")
+	}
+}
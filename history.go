@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rakoo/rakoshare/pkg/id"
+	"github.com/rakoo/rakoshare/pkg/sharesession"
+)
+
+var historySize = flag.Int("historySize", 50, "Number of past revisions of each share remembered, to roll back to")
+
+// recordRevision adds rev, of the torrent ih, to the history of the share.
+func (cs *ControlSession) recordRevision(ih string, rev Revision) {
+	err := cs.session.AddRevision(ih, rev.String(), time.Now().Format(time.RFC3339),
+		hex.EncodeToString([]byte(rev.Author)), *historySize)
+	if err != nil {
+		cs.log("Couldn't record revision in history:", err)
+	}
+	if _, err = pruneSession(cs.session); err != nil {
+		cs.log("Couldn't prune old revisions:", err)
+	}
+}
+
+// History shows the last revisions of a share, most recent first.
+func History(cliId, workDir string) error {
+	shareID, err := id.NewFromString(cliId)
+	if err != nil {
+		return newUserError(msgBadID, err)
+	}
+	session, err := openSession(workDir, shareID)
+	if err != nil {
+		return newUserError(msgOpenSession, err)
+	}
+	entries, err := session.GetHistory()
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		fmt.Println(T(msgNoHistory))
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, T(msgHistoryHeader))
+	for _, e := range entries {
+		signer := e.Signer
+		if len(signer) > 16 {
+			signer = signer[:16]
+		}
+		fmt.Fprintf(w, "%s\t%x\t%s\t%s\n", e.Rev, e.Infohash, e.Time, signer)
+	}
+	return w.Flush()
+}
+
+// Rollback makes an older revision of the share, whose infohash starts
+// with to, the current one again. It is published as a new revision at
+// the next scan of the folder. Unless forced, it fails when pieces of the
+// revision can't be read from the folder anymore.
+func Rollback(cliId, workDir, to string, force bool) error {
+	shareID, err := id.NewFromString(cliId)
+	if err != nil {
+		return newUserError(msgBadID, err)
+	}
+	if !shareID.CanWrite() {
+		return newUserError(msgRollbackNeedsWrite)
+	}
+	session, err := openSession(workDir, shareID)
+	if err != nil {
+		return newUserError(msgOpenSession, err)
+	}
+	entries, err := session.GetHistory()
+	if err != nil {
+		return err
+	}
+	entry, ok := findRevision(entries, to)
+	if !ok {
+		return newUserError(msgNoSuchRevision, to)
+	}
+	torrent := session.GetRevisionTorrent(entry.Infohash)
+	if torrent == "" {
+		return newUserError(msgRevisionUnavailable, entry.Rev)
+	}
+	if !force {
+		m, err := NewMetaInfoFromContent([]byte(torrent))
+		if err != nil {
+			return err
+		}
+		if missing, total := missingPieces(session.GetTarget(), m); missing > 0 {
+			return newUserError(msgRollbackMissing, missing, total, entry.Rev)
+		}
+	}
+
+	err = session.SavePendingTorrent([]byte(torrent), entry.Infohash, time.Now().Format(time.RFC3339),
+		"rollback to revision "+entry.Rev)
+	if err != nil {
+		return err
+	}
+	if _, err := session.ConfirmPending(); err != nil {
+		return err
+	}
+	fmt.Println(T(msgRollbackQueued, entry.Rev))
+	return nil
+}
+
+// missingPieces returns how many of the pieces of m can't be read from
+// the files of dir as they are, out of all its pieces.
+func missingPieces(dir string, m *MetaInfo) (missing, total int) {
+	m.cacheV2Pieces()
+	reader := newRevisionReader(dir, m.Info)
+	size := m.Info.totalSize()
+	pieceLength := m.Info.PieceLength
+	total = int((size + pieceLength - 1) / pieceLength)
+	for i := 0; i < total; i++ {
+		data := make([]byte, pieceSize(size, pieceLength, i))
+		if _, err := reader.ReadAt(data, int64(i)*pieceLength); err != nil || !m.pieceMatches(i, data) {
+			missing++
+		}
+	}
+	return
+}
+
+// findRevision returns the latest entry whose infohash, in hex, starts
+// with prefix, if no other torrent matches.
+func findRevision(entries []sharesession.HistoryEntry, prefix string) (found sharesession.HistoryEntry, ok bool) {
+	prefix = strings.ToLower(prefix)
+	if prefix == "" {
+		return
+	}
+	for _, e := range entries {
+		if !strings.HasPrefix(hex.EncodeToString([]byte(e.Infohash)), prefix) {
+			continue
+		}
+		if !ok {
+			found, ok = e, true
+		} else if found.Infohash != e.Infohash {
+			// Ambiguous
+			return sharesession.HistoryEntry{}, false
+		}
+	}
+	return
+}
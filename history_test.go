@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rakoo/rakoshare/pkg/sharesession"
+)
+
+func TestFindRevision(t *testing.T) {
+	entries := []sharesession.HistoryEntry{
+		{Infohash: "\xab\xcd\x01", Rev: "3-c"},
+		{Infohash: "\xab\xce\x02", Rev: "2-b"},
+		{Infohash: "\xab\xcd\x01", Rev: "1-a"},
+	}
+
+	if e, ok := findRevision(entries, "ABCE"); !ok || e.Rev != "2-b" {
+		t.Errorf("Expected revision 2-b, got %v", e)
+	}
+	// The same torrent published twice isn't ambiguous
+	if e, ok := findRevision(entries, "abcd"); !ok || e.Rev != "3-c" {
+		t.Errorf("Expected the latest revision of the torrent, got %v", e)
+	}
+	for _, prefix := range []string{"ab", "ff", ""} {
+		if e, ok := findRevision(entries, prefix); ok {
+			t.Errorf("Expected no revision for %q, got %v", prefix, e)
+		}
+	}
+}
+
+func TestMissingPieces(t *testing.T) {
+	defer func(l int64) { *fixedPieceLength = l }(*fixedPieceLength)
+	*fixedPieceLength = 16 * 1024
+
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	content := bytes.Repeat([]byte("0123456789abcdef"), 2*1024)
+	ioutil.WriteFile(filepath.Join(dir, "a"), content, 0644)
+	meta, err := createMeta(dir, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if missing, total := missingPieces(dir, meta); missing != 0 || total != 2 {
+		t.Errorf("Expected all 2 pieces, got %d missing of %d", missing, total)
+	}
+
+	// The second half of the file changed since
+	copy(content[16*1024:], "changed")
+	ioutil.WriteFile(filepath.Join(dir, "a"), content, 0644)
+	if missing, _ := missingPieces(dir, meta); missing != 1 {
+		t.Errorf("Expected 1 missing piece, got %d", missing)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// Holepunch extension (BEP-0055). Source:
+// http://bittorrent.org/beps/bep_0055.html
+//
+// When we can't connect to a peer we learnt about through PEX, we ask the
+// peer that told us about it to relay a rendezvous: both ends are then
+// told to connect to each other at the same time, which opens the way
+// through most NATs.
+
+const (
+	HOLEPUNCH_RENDEZVOUS = iota
+	HOLEPUNCH_CONNECT
+	HOLEPUNCH_ERROR
+)
+
+// Error codes of HOLEPUNCH_ERROR messages
+const (
+	HOLEPUNCH_NO_SUCH_PEER = iota + 1
+	HOLEPUNCH_NOT_CONNECTED
+	HOLEPUNCH_NO_SUPPORT
+	HOLEPUNCH_NO_SELF
+)
+
+var errInvalidHolepunch = errors.New("invalid holepunch message")
+
+type holepunchMessage struct {
+	msgType byte
+	addr    string // ip:port
+	errCode uint32
+}
+
+func (m holepunchMessage) encode() ([]byte, error) {
+	host, portString, err := net.SplitHostPort(m.addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, errInvalidHolepunch
+	}
+
+	buf := []byte{m.msgType, 0}
+	if ip4 := ip.To4(); ip4 != nil {
+		buf = append(buf, ip4...)
+	} else {
+		buf[1] = 1
+		buf = append(buf, ip.To16()...)
+	}
+	var tail [6]byte
+	binary.BigEndian.PutUint16(tail[0:2], uint16(port))
+	binary.BigEndian.PutUint32(tail[2:6], m.errCode)
+	return append(buf, tail[:]...), nil
+}
+
+func decodeHolepunch(b []byte) (m holepunchMessage, err error) {
+	if len(b) < 2 {
+		return m, errInvalidHolepunch
+	}
+	ipLen := net.IPv4len
+	if b[1] == 1 {
+		ipLen = net.IPv6len
+	} else if b[1] != 0 {
+		return m, errInvalidHolepunch
+	}
+	if len(b) != 2+ipLen+6 {
+		return m, errInvalidHolepunch
+	}
+
+	m.msgType = b[0]
+	ip := net.IP(b[2 : 2+ipLen])
+	port := binary.BigEndian.Uint16(b[2+ipLen : 4+ipLen])
+	m.addr = net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+	m.errCode = binary.BigEndian.Uint32(b[4+ipLen:])
+	return
+}
+
+// holepunchRelays remembers which peer told us about which address, so
+// that we know whom to ask for a rendezvous.
+type holepunchRelays struct {
+	sync.Mutex
+	via map[string]string
+}
+
+func newHolepunchRelays() *holepunchRelays {
+	return &holepunchRelays{via: make(map[string]string)}
+}
+
+func (r *holepunchRelays) add(peer, relay string) {
+	r.Lock()
+	r.via[peer] = relay
+	r.Unlock()
+}
+
+func (r *holepunchRelays) get(peer string) (relay string, ok bool) {
+	r.Lock()
+	relay, ok = r.via[peer]
+	r.Unlock()
+	return
+}
+
+// forget drops the peers that the peer at relay told us about, once it
+// left: it can't introduce us anymore.
+func (r *holepunchRelays) forget(relay string) {
+	r.Lock()
+	for peer, via := range r.via {
+		if via == relay {
+			delete(r.via, peer)
+		}
+	}
+	r.Unlock()
+}
+
+func supportsHolepunch(p *peerState) bool {
+	_, ok := p.theirExtensions["ut_holepunch"]
+	return ok
+}
+
+func (t *TorrentSession) sendHolepunch(p *peerState, m holepunchMessage) {
+	payload, err := m.encode()
+	if err != nil {
+		log.Printf("[TORRENT] Couldn't encode holepunch message for %s: %s\n", m.addr, err)
+		return
+	}
+	p.sendRawExtensionMessage("ut_holepunch", payload)
+}
+
+// rendezvous asks the peer that told us about peer to introduce us.
+func (t *TorrentSession) rendezvous(peer string) {
+	relayAddress, ok := t.relays.get(peer)
+	if !ok {
+		return
+	}
+	relay := t.peers.ByAddress(relayAddress)
+	if relay == nil || !supportsHolepunch(relay) {
+		return
+	}
+	log.Printf("[TORRENT] Asking %s to relay a rendezvous with %s\n", relayAddress, peer)
+	t.sendHolepunch(relay, holepunchMessage{msgType: HOLEPUNCH_RENDEZVOUS, addr: peer})
+}
+
+func (t *TorrentSession) DoHolepunch(msg []byte, p *peerState) {
+	m, err := decodeHolepunch(msg)
+	if err != nil {
+		log.Printf("[TORRENT] Bad holepunch message from %s: %s\n", p.address, err)
+		return
+	}
+
+	switch m.msgType {
+	case HOLEPUNCH_RENDEZVOUS:
+		t.relayRendezvous(p, m.addr)
+	case HOLEPUNCH_CONNECT:
+		// Don't ask for another rendezvous if this fails
+		go func() {
+			err := t.dialPeer(m.addr)
+			if err != nil {
+				log.Printf("[TORRENT] Holepunch to %s failed: %s\n", m.addr, err)
+			}
+		}()
+	case HOLEPUNCH_ERROR:
+		log.Printf("[TORRENT] %s couldn't relay to %s: error %d\n", p.address, m.addr, m.errCode)
+	}
+}
+
+// relayRendezvous tells both p and the peer at target to connect to each
+// other.
+func (t *TorrentSession) relayRendezvous(p *peerState, target string) {
+	fail := func(code uint32) {
+		t.sendHolepunch(p, holepunchMessage{msgType: HOLEPUNCH_ERROR, addr: target, errCode: code})
+	}
+
+	host, port, err := net.SplitHostPort(target)
+	if err != nil || net.ParseIP(host) == nil {
+		fail(HOLEPUNCH_NO_SUCH_PEER)
+		return
+	}
+	if port == strconv.Itoa(t.si.Port) && isOurIP(net.ParseIP(host)) {
+		fail(HOLEPUNCH_NO_SELF)
+		return
+	}
+	other := t.peers.ByAddress(target)
+	if other == nil {
+		fail(HOLEPUNCH_NOT_CONNECTED)
+		return
+	}
+	if !supportsHolepunch(other) {
+		fail(HOLEPUNCH_NO_SUPPORT)
+		return
+	}
+
+	// Inbound connections come from another port than the one p listens on
+	t.sendHolepunch(other, holepunchMessage{msgType: HOLEPUNCH_CONNECT, addr: p.listenAddress()})
+	t.sendHolepunch(p, holepunchMessage{msgType: HOLEPUNCH_CONNECT, addr: target})
+}
+
+// isOurIP tells whether ip is one of our addresses, or the one peers see
+// us with.
+func isOurIP(ip net.IP) bool {
+	if external, ok := ourExternalIPs.get(); ok && external.Equal(ip) {
+		return true
+	}
+	return isLocalIP(ip)
+}
+
+// isLocalIP tells whether ip is one of our local addresses.
+func isLocalIP(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestHolepunchEncoding(t *testing.T) {
+	vectors := []struct {
+		m   holepunchMessage
+		raw []byte
+	}{
+		{
+			holepunchMessage{msgType: HOLEPUNCH_RENDEZVOUS, addr: "1.2.3.4:6881"},
+			[]byte{0, 0, 1, 2, 3, 4, 0x1a, 0xe1, 0, 0, 0, 0},
+		},
+		{
+			holepunchMessage{msgType: HOLEPUNCH_ERROR, addr: "[2001:db8::1]:80", errCode: HOLEPUNCH_NOT_CONNECTED},
+			[]byte{2, 1, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 80, 0, 0, 0, 2},
+		},
+	}
+
+	for _, v := range vectors {
+		raw, err := v.m.encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(raw, v.raw) {
+			t.Fatalf("Expected %v, got %v", v.raw, raw)
+		}
+		decoded, err := decodeHolepunch(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded != v.m {
+			t.Fatalf("Expected %+v, got %+v", v.m, decoded)
+		}
+	}
+}
+
+func TestHolepunchDecodeInvalid(t *testing.T) {
+	invalid := [][]byte{
+		{},
+		{0, 0, 1, 2, 3, 4},
+		{0, 2, 1, 2, 3, 4, 0, 80, 0, 0, 0, 0},
+		{0, 1, 1, 2, 3, 4, 0, 80, 0, 0, 0, 0},
+	}
+	for _, raw := range invalid {
+		if _, err := decodeHolepunch(raw); err == nil {
+			t.Errorf("Expected %v to be invalid", raw)
+		}
+	}
+}
+
+func TestHolepunchRelaysForget(t *testing.T) {
+	r := newHolepunchRelays()
+	r.add("10.0.0.1:7000", "10.0.0.9:6881")
+	r.add("10.0.0.2:7000", "10.0.0.8:6881")
+	r.forget("10.0.0.9:6881")
+	if _, ok := r.get("10.0.0.1:7000"); ok {
+		t.Error("Expected the peers of a relay that left to be forgotten")
+	}
+	if relay, ok := r.get("10.0.0.2:7000"); !ok || relay != "10.0.0.8:6881" {
+		t.Errorf("Expected the other relay to stay, got %q", relay)
+	}
+}
@@ -0,0 +1,685 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var lang = flag.String("lang", "", "Language of the messages, such as en or fr. Defaults to the one of the LC_ALL, LC_MESSAGES or LANG environment variables")
+
+// msgCode identifies a user-facing message. Codes are stable: they are
+// shown next to translated error messages so that scripts and bug
+// reports don't depend on the language.
+type msgCode string
+
+const (
+	msgUsageApp      msgCode = "usage-app"
+	msgUsageGen      msgCode = "usage-gen"
+	msgUsageShare    msgCode = "usage-share"
+	msgUsageConfirm  msgCode = "usage-confirm"
+	msgUsageTrackers msgCode = "usage-trackers"
+	msgUsageConfig   msgCode = "usage-config"
+	msgUsageProfiles msgCode = "usage-profiles"
+	msgUsageList     msgCode = "usage-list"
+	msgUsageTop      msgCode = "usage-top"
+	msgUsagePreview  msgCode = "usage-preview"
+	msgUsageIngest   msgCode = "usage-ingest"
+	msgUsageAdmin    msgCode = "usage-admin"
+	msgUsagePeers    msgCode = "usage-peers"
+
+	msgNeedDir           msgCode = "need-dir"
+	msgNeedID            msgCode = "need-id"
+	msgNeedFolder        msgCode = "need-folder"
+	msgInvalidScan       msgCode = "invalid-scan-interval"
+	msgInvalidInterval   msgCode = "invalid-interval"
+	msgInvalidExpiry     msgCode = "invalid-expiry"
+	msgExpiredDeadline   msgCode = "expired-deadline"
+	msgExpiredDownloads  msgCode = "expired-downloads"
+	msgSharing           msgCode = "sharing"
+	msgNoPending         msgCode = "no-pending"
+	msgRevisionConfirmed msgCode = "revision-confirmed"
+	msgFolderAlreadySet  msgCode = "folder-already-set"
+
+	msgBadID          msgCode = "bad-id"
+	msgOpenSession    msgCode = "open-session"
+	msgLoadSettings   msgCode = "load-settings"
+	msgInvalidDir     msgCode = "invalid-dir"
+	msgStartWatcher   msgCode = "start-watcher"
+	msgListenPeers    msgCode = "listen-peers"
+	msgStartTracker   msgCode = "start-tracker"
+	msgListenLPD      msgCode = "listen-lpd"
+	msgUnknownProfile msgCode = "unknown-profile"
+	msgInvalidProfile msgCode = "invalid-profile"
+	msgCommandFailed  msgCode = "command-failed"
+
+	msgPreviewNeedsRead msgCode = "preview-needs-read"
+	msgNoSummary        msgCode = "no-summary"
+	msgSummaryRevision  msgCode = "summary-revision"
+	msgSummarySize      msgCode = "summary-size"
+	msgSummaryFiles     msgCode = "summary-files"
+	msgSummaryDirs      msgCode = "summary-dirs"
+
+	msgIngestNeedsWrite msgCode = "ingest-needs-write"
+	msgUnknownArchive   msgCode = "unknown-archive"
+	msgExtractFailed    msgCode = "extract-failed"
+	msgIngested         msgCode = "ingested"
+
+	msgUnknownChecksum msgCode = "unknown-checksum"
+
+	msgUsageAbout      msgCode = "usage-about"
+	msgAboutNeedsWrite msgCode = "about-needs-write"
+	msgInvalidAbout    msgCode = "invalid-about"
+	msgAboutField      msgCode = "about-field"
+
+	msgInvalidMirror msgCode = "invalid-mirror"
+
+	msgInvalidStorage    msgCode = "invalid-storage"
+	msgInvalidAllocation msgCode = "invalid-allocation"
+
+	msgAdminNeedsWrite msgCode = "admin-needs-write"
+	msgAdminUnknown    msgCode = "admin-unknown"
+	msgShareNotRunning msgCode = "share-not-running"
+	msgAdminNoReply    msgCode = "admin-no-reply"
+	msgAdminReply      msgCode = "admin-reply"
+
+	msgNoPeers     msgCode = "no-peers"
+	msgPeersHeader msgCode = "peers-header"
+
+	msgTopHeader         msgCode = "top-header"
+	msgTopHelp           msgCode = "top-help"
+	msgTopRunning        msgCode = "top-running"
+	msgTopPaused         msgCode = "top-paused"
+	msgTopStopped        msgCode = "top-stopped"
+	msgTopUnknownCommand msgCode = "top-unknown-command"
+	msgTopNoSuchShare    msgCode = "top-no-such-share"
+	msgTopNotRunning     msgCode = "top-not-running"
+
+	msgTopConflicts msgCode = "top-conflicts"
+
+	msgUsageHistory        msgCode = "usage-history"
+	msgUsageRollback       msgCode = "usage-rollback"
+	msgNoHistory           msgCode = "no-history"
+	msgHistoryHeader       msgCode = "history-header"
+	msgRollbackNeedsWrite  msgCode = "rollback-needs-write"
+	msgNoSuchRevision      msgCode = "no-such-revision"
+	msgRevisionUnavailable msgCode = "revision-unavailable"
+	msgRollbackMissing     msgCode = "rollback-missing"
+	msgRollbackQueued      msgCode = "rollback-queued"
+
+	msgUsageRescan      msgCode = "usage-rescan"
+	msgRescanNeedsWrite msgCode = "rescan-needs-write"
+	msgRescanRequested  msgCode = "rescan-requested"
+
+	msgInvalidFormat msgCode = "invalid-format"
+
+	msgUsageExport    msgCode = "usage-export"
+	msgNoRevision     msgCode = "no-revision"
+	msgTorrentWritten msgCode = "torrent-written"
+
+	msgUsageGC msgCode = "usage-gc"
+	msgGCDone  msgCode = "gc-done"
+
+	msgTopVerifying msgCode = "top-verifying"
+
+	msgInvalidSeedLimit msgCode = "invalid-seed-limit"
+
+	msgUsageRotate      msgCode = "usage-rotate"
+	msgRotateNeedsWrite msgCode = "rotate-needs-write"
+	msgRotated          msgCode = "rotated"
+
+	msgUsageSecrets msgCode = "usage-secrets"
+	msgPassphrase   msgCode = "passphrase"
+	msgSecretsMoved msgCode = "secrets-moved"
+
+	msgUsageRelay  msgCode = "usage-relay"
+	msgRelayOldID  msgCode = "relay-old-id"
+	msgRelayShared msgCode = "relay-shared"
+
+	msgTorOnion msgCode = "tor-onion"
+
+	msgI2PSession msgCode = "i2p-session"
+
+	msgNoAudit     msgCode = "no-audit"
+	msgAuditHeader msgCode = "audit-header"
+
+	msgInvalidWebhook msgCode = "invalid-webhook"
+	msgInvalidEvent   msgCode = "invalid-event"
+
+	msgUnknownSetting msgCode = "unknown-setting"
+
+	// Descriptions of the command-line flags
+	msgFlagGenDir             msgCode = "flag-gen-dir"
+	msgFlagGenTracker         msgCode = "flag-gen-tracker"
+	msgFlagGenProfile         msgCode = "flag-gen-profile"
+	msgFlagGenExpires         msgCode = "flag-gen-expires"
+	msgFlagGenMaxDownloads    msgCode = "flag-gen-max-downloads"
+	msgFlagShareID            msgCode = "flag-share-id"
+	msgFlagShareDir           msgCode = "flag-share-dir"
+	msgFlagTracker            msgCode = "flag-tracker"
+	msgFlagUseLPD             msgCode = "flag-use-lpd"
+	msgFlagPeer               msgCode = "flag-peer"
+	msgFlagServeTracker       msgCode = "flag-serve-tracker"
+	msgFlagShareProfile       msgCode = "flag-share-profile"
+	msgFlagRelayID            msgCode = "flag-relay-id"
+	msgFlagRelayMemory        msgCode = "flag-relay-memory"
+	msgFlagID                 msgCode = "flag-id"
+	msgFlagTrackerAdd         msgCode = "flag-tracker-add"
+	msgFlagTrackerRemove      msgCode = "flag-tracker-remove"
+	msgFlagProfile            msgCode = "flag-profile"
+	msgFlagIgnore             msgCode = "flag-ignore"
+	msgFlagScanInterval       msgCode = "flag-scan-interval"
+	msgFlagNoWatch            msgCode = "flag-no-watch"
+	msgFlagUploadRate         msgCode = "flag-upload-rate"
+	msgFlagDownloadRate       msgCode = "flag-download-rate"
+	msgFlagExpires            msgCode = "flag-expires"
+	msgFlagMaxDownloads       msgCode = "flag-max-downloads"
+	msgFlagTrust              msgCode = "flag-trust"
+	msgFlagTrustedOnly        msgCode = "flag-trusted-only"
+	msgFlagTargetPeers        msgCode = "flag-target-peers"
+	msgFlagMaxPeers           msgCode = "flag-max-peers"
+	msgFlagMirror             msgCode = "flag-mirror"
+	msgFlagAdmin              msgCode = "flag-admin"
+	msgFlagStorage            msgCode = "flag-storage"
+	msgFlagStorageURL         msgCode = "flag-storage-url"
+	msgFlagAllocation         msgCode = "flag-allocation"
+	msgFlagKeepVersions       msgCode = "flag-keep-versions"
+	msgFlagFormat             msgCode = "flag-format"
+	msgFlagSequential         msgCode = "flag-sequential"
+	msgFlagSeedRatio          msgCode = "flag-seed-ratio"
+	msgFlagSeedBytes          msgCode = "flag-seed-bytes"
+	msgFlagSeedTime           msgCode = "flag-seed-time"
+	msgFlagSealed             msgCode = "flag-sealed"
+	msgFlagWebhook            msgCode = "flag-webhook"
+	msgFlagWebhookEvent       msgCode = "flag-webhook-event"
+	msgFlagUnsetSetting       msgCode = "flag-unset-setting"
+	msgFlagRemoveIgnore       msgCode = "flag-remove-ignore"
+	msgFlagRemoveTrust        msgCode = "flag-remove-trust"
+	msgFlagRemoveMirror       msgCode = "flag-remove-mirror"
+	msgFlagRemoveSequential   msgCode = "flag-remove-sequential"
+	msgFlagRemoveWebhook      msgCode = "flag-remove-webhook"
+	msgFlagRemoveWebhookEvent msgCode = "flag-remove-webhook-event"
+	msgFlagPreviewTimeout     msgCode = "flag-preview-timeout"
+	msgFlagTopInterval        msgCode = "flag-top-interval"
+	msgFlagTopPlain           msgCode = "flag-top-plain"
+	msgFlagIngestFrom         msgCode = "flag-ingest-from"
+	msgFlagIngestFormat       msgCode = "flag-ingest-format"
+	msgFlagAboutSet           msgCode = "flag-about-set"
+	msgFlagAboutUnset         msgCode = "flag-about-unset"
+	msgFlagSecretsStore       msgCode = "flag-secrets-store"
+	msgFlagRotateID           msgCode = "flag-rotate-id"
+	msgFlagRotateRead         msgCode = "flag-rotate-read"
+	msgFlagRotateWrite        msgCode = "flag-rotate-write"
+	msgFlagIDOrArg            msgCode = "flag-id-or-arg"
+	msgFlagHistoryAudit       msgCode = "flag-history-audit"
+	msgFlagRollbackTo         msgCode = "flag-rollback-to"
+	msgFlagRollbackForce      msgCode = "flag-rollback-force"
+	msgFlagExportTorrent      msgCode = "flag-export-torrent"
+	msgFlagAdminPeer          msgCode = "flag-admin-peer"
+	msgFlagAdminWait          msgCode = "flag-admin-wait"
+)
+
+// Message catalogs, by language. English is the reference: a message
+// missing from another catalog is shown in English.
+var catalogs = map[string]map[msgCode]string{
+	"en": {
+		msgUsageApp:      "Share content with everyone",
+		msgUsageGen:      "Generate a share with a given target directory. Outputs the 3-tuple of id",
+		msgUsageShare:    "Share the given id",
+		msgUsageConfirm:  "Publish a revision that was held back because it looked like a mass change",
+		msgUsageTrackers: "List or modify the trackers of a share",
+		msgUsageConfig:   "Show or change the settings of a share",
+		msgUsageProfiles: "List the profiles shares can inherit their settings from",
+		msgUsageList:     "List availables shares",
+		msgUsageTop:      "Show the shares and their transfers live, and pause or resume them",
+		msgUsagePreview:  "Show what a share contains before joining it",
+		msgUsageIngest:   "Replace the content of a share with an archive, read from a file or the standard input",
+		msgUsageAdmin:    "Pause, resume, rescan or get the status of the other devices of a share: admin [-peer host] command",
+		msgUsagePeers:    "List the peers of a running share and their transfers",
+
+		msgNeedDir:           "Need a valid directory! Use the -dir flag",
+		msgNeedID:            "Need an id!",
+		msgNeedFolder:        "Need a folder to share!",
+		msgInvalidScan:       "Invalid scan interval: %s",
+		msgInvalidInterval:   "Invalid interval: %s",
+		msgInvalidExpiry:     "Invalid expiry %q: give a duration such as 48h or a date such as 2015-06-01T18:00:00+02:00",
+		msgExpiredDeadline:   "The share expired on %s",
+		msgExpiredDownloads:  "The share expired after being downloaded by %d devices",
+		msgSharing:           "Sharing %s in %s:",
+		msgNoPending:         "No revision is waiting for confirmation",
+		msgRevisionConfirmed: "Revision %x will be published (%s)",
+		msgFolderAlreadySet:  "Can't override folder already set to %s",
+
+		msgBadID:          "Couldn't generate shareId: %s",
+		msgOpenSession:    "Couldn't open session file: %s",
+		msgLoadSettings:   "Couldn't load settings: %s",
+		msgInvalidDir:     "%s is an invalid dir: %s",
+		msgStartWatcher:   "Couldn't start watcher: %s",
+		msgListenPeers:    "Couldn't listen for peers connection: %s",
+		msgStartTracker:   "Couldn't start tracker: %s",
+		msgListenLPD:      "Couldn't listen for Local Peer Discoveries: %s",
+		msgUnknownProfile: "Unknown profile %q",
+		msgInvalidProfile: "Invalid profile %q: %s",
+		msgCommandFailed:  "Couldn't %s the share: %s",
+
+		msgPreviewNeedsRead: "Previewing a share needs its ReadStore or WriteReadStore id",
+		msgNoSummary:        "No peer sent the summary of the share within %s",
+		msgSummaryRevision:  "Revision:\t%s",
+		msgSummarySize:      "Size:\t\t%s (%d bytes)",
+		msgSummaryFiles:     "Files:\t\t%d",
+		msgSummaryDirs:      "Directories:\t%s",
+
+		msgIngestNeedsWrite: "Ingesting into a share needs its WriteReadStore id",
+		msgUnknownArchive:   "Unknown archive format %q, expected tar, tgz or zip",
+		msgExtractFailed:    "Couldn't extract the archive: %s",
+		msgIngested:         "Ingested %d files into %s; the share publishes them at its next scan",
+
+		msgUnknownChecksum: "Unknown checksum algorithm %q, expected sha1, sha256 or blake3",
+
+		msgUsageAbout:      "Show or change the description of a share: its name, description, owner contact...",
+		msgAboutNeedsWrite: "Changing the description of a share needs its WriteReadStore id",
+		msgInvalidAbout:    "Invalid description field %v, expected key=value",
+		msgAboutField:      "%s: %s",
+
+		msgInvalidMirror: "Invalid mirror %q, expected an https URL",
+
+		msgInvalidStorage:    "Invalid storage %q, expected one of %s",
+		msgInvalidAllocation: "Invalid allocation %q, expected sparse, fallocate or none",
+
+		msgAdminNeedsWrite: "Admin commands need the WriteReadStore id of the share",
+		msgAdminUnknown:    "Unknown admin command %q, expected pause, resume, rescan or status",
+		msgShareNotRunning: "The share isn't running on this device",
+		msgAdminNoReply:    "No device replied",
+		msgAdminReply:      "%s\t%s\t%s\t%d peers\t%s",
+
+		msgNoPeers:     "No peers",
+		msgPeersHeader: "ADDRESS\tCHANNEL\tCLIENT\tUP\tDOWN\tUPLOADED\tDOWNLOADED\tAGE\tLAST ERROR",
+
+		msgTopHeader:         "#\tFOLDER\tSTATE\tPEERS\tCONTROL PEERS\tUP\tDOWN\tUPLOADED\tDOWNLOADED",
+		msgTopHelp:           "Type p N to pause share N, r N to resume it, q to quit, then Enter",
+		msgTopRunning:        "running",
+		msgTopPaused:         "paused",
+		msgTopStopped:        "stopped",
+		msgTopUnknownCommand: "Unknown command %q",
+		msgTopNoSuchShare:    "No share number %s",
+		msgTopNotRunning:     "Share %d isn't running",
+
+		msgTopConflicts: "Share %d kept conflicting copies: %s",
+
+		msgUsageHistory:        "Show the last revisions of a share",
+		msgUsageRollback:       "Publish an older revision of a share again",
+		msgNoHistory:           "No revision recorded yet",
+		msgHistoryHeader:       "REVISION\tINFOHASH\tTIME\tSIGNER",
+		msgRollbackNeedsWrite:  "Rolling back needs the WriteReadStore id of the share",
+		msgNoSuchRevision:      "No single revision in the history matches %q",
+		msgRevisionUnavailable: "The torrent of revision %s was never received, it can't be published again",
+		msgRollbackMissing:     "%d of the %d pieces of revision %s aren't in the folder anymore: only other devices that still have them can bring them back. Use -force to roll back anyway",
+		msgRollbackQueued:      "Revision %s will be published again at the next scan",
+
+		msgUsageRescan:      "Make a running share scan its folder for changes now",
+		msgRescanNeedsWrite: "Only devices with the WriteReadStore id of the share scan its folder",
+		msgRescanRequested:  "The folder is being scanned",
+
+		msgInvalidFormat: "Invalid format %q, expected v1, v2 or hybrid",
+
+		msgUsageExport:    "Print a magnet link to the current revision of a share, for any BitTorrent client",
+		msgNoRevision:     "The share has no revision yet",
+		msgTorrentWritten: "Torrent written to %s",
+
+		msgUsageGC: "Forget the stale state of a share: old torrents, deltas and the index of removed files",
+		msgGCDone:  "Forgot %d stale records",
+
+		msgTopVerifying: "Share %d is checking its files: %d of %d pieces",
+
+		msgInvalidSeedLimit: "Seeding limits can't be negative",
+
+		msgUsageRotate:      "Replace the read key, the write keys or both of a share, revoking the ids that hold the old ones",
+		msgRotateNeedsWrite: "Rotating the keys of a share needs its WriteReadStore id",
+		msgRotated:          "The keys of the share were rotated: give the new ids to the devices that keep their access",
+
+		msgUsageSecrets: "Move the ids of all shares to a secret store: keychain, file, or session to put them back in the session files",
+		msgPassphrase:   "Passphrase of the secrets file: ",
+		msgSecretsMoved: "The ids of the shares are now kept in: %s",
+
+		msgUsageRelay:  "Keep and serve the sealed pieces of a share, without reading it, for devices that are rarely online together",
+		msgRelayOldID:  "This id is too old for a relay, which must check what the writers publish",
+		msgRelayShared: "This share is already shared from %s in this working directory: run the relay from another one",
+
+		msgTorOnion: "Couldn't publish the onion service through the control port of Tor: %s",
+
+		msgI2PSession: "Couldn't open a session through the SAM bridge of I2P: %s",
+
+		msgNoAudit:     "No change of revision recorded yet",
+		msgAuditHeader: "TIME\tPREVIOUS\tREVISION\tINFOHASH\tSIGNER\tSIGNATURE\tPEER",
+
+		msgInvalidWebhook: "Invalid webhook %q, expected an http(s) URL",
+		msgInvalidEvent:   "Unknown kind of event %q, expected one of %s",
+
+		msgUnknownSetting: "Unknown setting %q, expected one of %s",
+
+		msgFlagGenDir:             "The directory to share",
+		msgFlagGenTracker:         "A tracker for this share",
+		msgFlagGenProfile:         "If not empty, the profile the share inherits its settings from",
+		msgFlagGenExpires:         "If not empty, when the share stops, such as 48h or 2015-06-01T18:00:00+02:00",
+		msgFlagGenMaxDownloads:    "If not 0, stop the share once that many devices downloaded it",
+		msgFlagShareID:            "The id to share",
+		msgFlagShareDir:           "If not empty, the dir to share",
+		msgFlagTracker:            "A tracker to connect to. It is remembered for the next times",
+		msgFlagUseLPD:             "Use Local Peer Discovery",
+		msgFlagPeer:               "A peer to connect to",
+		msgFlagServeTracker:       "If not 0, also run a tracker (HTTP and UDP) for this share only on this port",
+		msgFlagShareProfile:       "If not empty, the profile the share inherits its settings from. It is remembered for the next times",
+		msgFlagRelayID:            "An id of the share; only its Store part is kept",
+		msgFlagRelayMemory:        "Cache the sealed pieces in memory only",
+		msgFlagID:                 "The id of the share",
+		msgFlagTrackerAdd:         "A tracker to add",
+		msgFlagTrackerRemove:      "A tracker to remove",
+		msgFlagProfile:            "The profile the share inherits its settings from",
+		msgFlagIgnore:             "A pattern of files not to share",
+		msgFlagScanInterval:       "How often to scan the shared directory, such as 30s or 5m",
+		msgFlagNoWatch:            "Only scan the shared directory, for network mounts that don't notify changes. =false turns it off",
+		msgFlagUploadRate:         "Upload limit in bytes per second. Negative means unlimited",
+		msgFlagDownloadRate:       "Download limit in bytes per second. Negative means unlimited",
+		msgFlagExpires:            "When the share stops, such as 48h or 2015-06-01T18:00:00+02:00",
+		msgFlagMaxDownloads:       "Stop the share once that many devices downloaded it",
+		msgFlagTrust:              "A peer to always connect to, as host:port, or a host to accept on any port",
+		msgFlagTrustedOnly:        "Refuse all peers but the trusted ones. =false turns it off",
+		msgFlagTargetPeers:        "How many peers to look for, if not %d",
+		msgFlagMaxPeers:           "How many peers to accept at most, if not %d",
+		msgFlagMirror:             "Base URL of an HTTPS server with a copy of the files, to download from when no peer has them",
+		msgFlagAdmin:              "Obey the admin commands writers of the share send from their devices. =false turns it off",
+		msgFlagStorage:            "How to access the files: files, mmap to read them through memory mappings, mmap-write, memory, or s3",
+		msgFlagStorageURL:         "Where the s3 storage keeps the files, such as https://s3.eu-west-1.amazonaws.com/bucket/prefix",
+		msgFlagAllocation:         "How to allocate files being downloaded: sparse, fallocate to reserve their size, or none",
+		msgFlagKeepVersions:       "How long to keep copies of the files that syncs overwrite or delete, such as 720h. Negative not to keep them",
+		msgFlagFormat:             "The metainfo format of new revisions: v1, v2 for per-file merkle trees (BEP 52), or hybrid for clients of either version",
+		msgFlagSequential:         "A pattern of files to download in order, such as *.mkv, to play them while they download",
+		msgFlagSeedRatio:          "Stop uploading a revision once we uploaded that many times its size",
+		msgFlagSeedBytes:          "Stop uploading a revision once we uploaded that many bytes of it",
+		msgFlagSeedTime:           "Stop uploading a revision after seeding it for that long, such as 72h",
+		msgFlagSealed:             "Publish sealed copies of the pieces, or keep them when the share can't be read, so that untrusted replicas can serve it. =false turns it off",
+		msgFlagWebhook:            "A URL to POST the events of the share to, as JSON",
+		msgFlagWebhookEvent:       "A kind of event to send to webhooks, all if none: %s",
+		msgFlagUnsetSetting:       "A setting to put back to its default, or to the one of the profile, such as uploadRate or profile",
+		msgFlagRemoveIgnore:       "A pattern of files not to ignore anymore",
+		msgFlagRemoveTrust:        "A peer not to trust anymore",
+		msgFlagRemoveMirror:       "A mirror not to publish anymore",
+		msgFlagRemoveSequential:   "A pattern of files not to download in order anymore",
+		msgFlagRemoveWebhook:      "A URL not to POST events to anymore",
+		msgFlagRemoveWebhookEvent: "A kind of event not to send to webhooks anymore",
+		msgFlagPreviewTimeout:     "How long to wait for peers",
+		msgFlagTopInterval:        "How often to refresh",
+		msgFlagTopPlain:           "Don't clear the screen between refreshes, for screen readers and logs",
+		msgFlagIngestFrom:         "The archive to ingest, or - for the standard input",
+		msgFlagIngestFormat:       "The format of the archive: tar, tgz or zip. Guessed from its name by default",
+		msgFlagAboutSet:           "A field to set, such as name=Holidays, description=... or contact=...",
+		msgFlagAboutUnset:         "A field to remove",
+		msgFlagSecretsStore:       "Where to keep the ids: keychain, file or session",
+		msgFlagRotateID:           "The WriteReadStore id of the share",
+		msgFlagRotateRead:         "Replace the read key, revoking the ReadStore and Store ids",
+		msgFlagRotateWrite:        "Replace the write keys, revoking the WriteReadStore id",
+		msgFlagIDOrArg:            "The id of the share, which can also be given as argument",
+		msgFlagHistoryAudit:       "Show every revision the share took, with the peer that announced it, rather than the revisions to roll back to",
+		msgFlagRollbackTo:         "The infohash of the revision to go back to, as shown by history, or its first characters",
+		msgFlagRollbackForce:      "Roll back even if pieces of the revision aren't in the folder anymore",
+		msgFlagExportTorrent:      "If not empty, also write the .torrent file of the revision to this path",
+		msgFlagAdminPeer:          "Only send the command to the device at this host or host:port",
+		msgFlagAdminWait:          "How long to wait for replies",
+	},
+	"fr": {
+		msgUsageApp:      "Partager du contenu avec tout le monde",
+		msgUsageGen:      "Créer un partage pour un dossier donné. Affiche les 3 identifiants",
+		msgUsageShare:    "Partager l'identifiant donné",
+		msgUsageConfirm:  "Publier une révision retenue parce qu'elle ressemblait à un changement massif",
+		msgUsageTrackers: "Lister ou modifier les trackers d'un partage",
+		msgUsageConfig:   "Afficher ou modifier les réglages d'un partage",
+		msgUsageProfiles: "Lister les profils dont les partages peuvent hériter leurs réglages",
+		msgUsageList:     "Lister les partages disponibles",
+		msgUsageTop:      "Afficher les partages et leurs transferts en direct, et les suspendre ou les reprendre",
+		msgUsagePreview:  "Afficher le contenu d'un partage avant de le rejoindre",
+		msgUsageIngest:   "Remplacer le contenu d'un partage par une archive, lue depuis un fichier ou l'entrée standard",
+		msgUsageAdmin:    "Suspendre, reprendre, reparcourir ou interroger les autres appareils d'un partage : admin [-peer hôte] commande",
+		msgUsagePeers:    "Lister les pairs d'un partage lancé et leurs transferts",
+
+		msgNeedDir:           "Il faut un dossier valide ! Utilisez l'option -dir",
+		msgNeedID:            "Il faut un identifiant !",
+		msgNeedFolder:        "Il faut un dossier à partager !",
+		msgInvalidScan:       "Intervalle de scan invalide : %s",
+		msgInvalidInterval:   "Intervalle invalide : %s",
+		msgInvalidExpiry:     "Expiration %q invalide : donnez une durée comme 48h ou une date comme 2015-06-01T18:00:00+02:00",
+		msgExpiredDeadline:   "Le partage a expiré le %s",
+		msgExpiredDownloads:  "Le partage a expiré après avoir été téléchargé par %d appareils",
+		msgSharing:           "Partage de %s dans %s :",
+		msgNoPending:         "Aucune révision n'attend de confirmation",
+		msgRevisionConfirmed: "La révision %x va être publiée (%s)",
+		msgFolderAlreadySet:  "Impossible de changer le dossier, il est déjà %s",
+
+		msgBadID:          "Identifiant de partage invalide : %s",
+		msgOpenSession:    "Impossible d'ouvrir le fichier de session : %s",
+		msgLoadSettings:   "Impossible de charger les réglages : %s",
+		msgInvalidDir:     "%s n'est pas un dossier valide : %s",
+		msgStartWatcher:   "Impossible de surveiller le dossier : %s",
+		msgListenPeers:    "Impossible d'écouter les connexions des pairs : %s",
+		msgStartTracker:   "Impossible de démarrer le tracker : %s",
+		msgListenLPD:      "Impossible d'écouter la découverte locale de pairs : %s",
+		msgUnknownProfile: "Profil %q inconnu",
+		msgInvalidProfile: "Profil %q invalide : %s",
+		msgCommandFailed:  "Impossible de faire %s sur le partage : %s",
+
+		msgPreviewNeedsRead: "Il faut l'identifiant ReadStore ou WriteReadStore pour voir le contenu d'un partage",
+		msgNoSummary:        "Aucun pair n'a envoyé le résumé du partage en %s",
+		msgSummaryRevision:  "Révision :\t%s",
+		msgSummarySize:      "Taille :\t%s (%d octets)",
+		msgSummaryFiles:     "Fichiers :\t%d",
+		msgSummaryDirs:      "Dossiers :\t%s",
+
+		msgIngestNeedsWrite: "Il faut l'identifiant WriteReadStore pour importer dans un partage",
+		msgUnknownArchive:   "Format d'archive %q inconnu, tar, tgz ou zip attendu",
+		msgExtractFailed:    "Impossible d'extraire l'archive : %s",
+		msgIngested:         "%d fichiers importés dans %s ; le partage les publiera à son prochain parcours",
+
+		msgUnknownChecksum: "Algorithme de somme de contrôle %q inconnu, sha1, sha256 ou blake3 attendu",
+
+		msgUsageAbout:      "Afficher ou modifier la description d'un partage : son nom, sa description, le contact de son propriétaire...",
+		msgAboutNeedsWrite: "Il faut l'identifiant WriteReadStore pour modifier la description d'un partage",
+		msgInvalidAbout:    "Champ de description %v invalide, clé=valeur attendu",
+		msgAboutField:      "%s : %s",
+
+		msgInvalidMirror: "Miroir %q invalide, URL https attendue",
+
+		msgInvalidStorage:    "Stockage %q invalide, un de %s attendu",
+		msgInvalidAllocation: "Allocation %q invalide, sparse, fallocate ou none attendu",
+
+		msgAdminNeedsWrite: "Il faut l'identifiant WriteReadStore du partage pour les commandes d'administration",
+		msgAdminUnknown:    "Commande d'administration %q inconnue, pause, resume, rescan ou status attendu",
+		msgShareNotRunning: "Le partage n'est pas lancé sur cet appareil",
+		msgAdminNoReply:    "Aucun appareil n'a répondu",
+		msgAdminReply:      "%s\t%s\t%s\t%d pairs\t%s",
+
+		msgNoPeers:     "Aucun pair",
+		msgPeersHeader: "ADRESSE\tCANAL\tCLIENT\tENVOI\tRÉCEPTION\tENVOYÉ\tREÇU\tÂGE\tDERNIÈRE ERREUR",
+
+		msgTopHeader:         "#\tDOSSIER\tÉTAT\tPAIRS\tPAIRS DE CONTRÔLE\tENVOI\tRÉCEPTION\tENVOYÉ\tREÇU",
+		msgTopHelp:           "Tapez p N pour suspendre le partage N, r N pour le reprendre, q pour quitter, puis Entrée",
+		msgTopRunning:        "actif",
+		msgTopPaused:         "suspendu",
+		msgTopStopped:        "arrêté",
+		msgTopUnknownCommand: "Commande %q inconnue",
+		msgTopNoSuchShare:    "Pas de partage numéro %s",
+		msgTopNotRunning:     "Le partage %d n'est pas lancé",
+
+		msgTopConflicts: "Le partage %d a gardé des copies en conflit : %s",
+
+		msgUsageHistory:        "Afficher les dernières révisions d'un partage",
+		msgUsageRollback:       "Publier à nouveau une ancienne révision d'un partage",
+		msgNoHistory:           "Aucune révision enregistrée pour l'instant",
+		msgHistoryHeader:       "RÉVISION\tINFOHASH\tDATE\tSIGNATAIRE",
+		msgRollbackNeedsWrite:  "Il faut l'identifiant WriteReadStore du partage pour revenir en arrière",
+		msgNoSuchRevision:      "Aucune révision unique de l'historique ne correspond à %q",
+		msgRevisionUnavailable: "Le torrent de la révision %s n'a jamais été reçu, elle ne peut pas être publiée à nouveau",
+		msgRollbackMissing:     "%d des %d pièces de la révision %s ne sont plus dans le dossier : seuls d'autres appareils qui les ont encore peuvent les rapporter. Utilisez -force pour revenir en arrière malgré tout",
+		msgRollbackQueued:      "La révision %s sera publiée à nouveau au prochain parcours",
+
+		msgUsageRescan:      "Faire parcourir maintenant son dossier à un partage lancé",
+		msgRescanNeedsWrite: "Seuls les appareils avec l'identifiant WriteReadStore du partage parcourent son dossier",
+		msgRescanRequested:  "Le dossier est en cours de parcours",
+
+		msgInvalidFormat: "Format %q invalide, v1, v2 ou hybrid attendu",
+
+		msgUsageExport:    "Afficher un lien magnet vers la révision actuelle d'un partage, pour tout client BitTorrent",
+		msgNoRevision:     "Le partage n'a encore aucune révision",
+		msgTorrentWritten: "Torrent écrit dans %s",
+
+		msgUsageGC: "Oublier l'état périmé d'un partage : anciens torrents, écarts et index des fichiers supprimés",
+		msgGCDone:  "%d enregistrements périmés oubliés",
+
+		msgTopVerifying: "Le partage %d vérifie ses fichiers : %d pièces sur %d",
+
+		msgInvalidSeedLimit: "Les limites de partage ne peuvent pas être négatives",
+
+		msgUsageRotate:      "Remplacer la clé de lecture, les clés d'écriture ou les deux d'un partage, en révoquant les identifiants qui ont les anciennes",
+		msgRotateNeedsWrite: "Il faut l'identifiant WriteReadStore pour changer les clés d'un partage",
+		msgRotated:          "Les clés du partage ont changé : donnez les nouveaux identifiants aux appareils qui gardent leur accès",
+
+		msgUsageSecrets: "Déplacer les identifiants de tous les partages vers un coffre : keychain, file, ou session pour les remettre dans les fichiers de session",
+		msgPassphrase:   "Phrase secrète du fichier de secrets : ",
+		msgSecretsMoved: "Les identifiants des partages sont maintenant gardés dans : %s",
+
+		msgUsageRelay:  "Garder et servir les morceaux scellés d'un partage, sans pouvoir le lire, pour des appareils rarement en ligne en même temps",
+		msgRelayOldID:  "Cet identifiant est trop ancien pour un relais, qui doit vérifier ce que publient les rédacteurs",
+		msgRelayShared: "Ce partage est déjà partagé depuis %s dans ce répertoire de travail : lancez le relais depuis un autre",
+
+		msgTorOnion: "Impossible de publier le service onion par le port de contrôle de Tor : %s",
+
+		msgI2PSession: "Impossible d'ouvrir une session par le pont SAM d'I2P : %s",
+
+		msgNoAudit:     "Aucun changement de révision enregistré pour l'instant",
+		msgAuditHeader: "DATE\tPRÉCÉDENTE\tRÉVISION\tINFOHASH\tSIGNATAIRE\tSIGNATURE\tPAIR",
+
+		msgInvalidWebhook: "Webhook %q invalide, URL http(s) attendue",
+		msgInvalidEvent:   "Type d'événement %q inconnu, attendu l'un de %s",
+
+		msgUnknownSetting: "Réglage %q inconnu, attendu l'un de %s",
+
+		msgFlagGenDir:             "Le dossier à partager",
+		msgFlagGenTracker:         "Un tracker pour ce partage",
+		msgFlagGenProfile:         "Si non vide, le profil dont le partage hérite ses réglages",
+		msgFlagGenExpires:         "Si non vide, quand le partage s'arrête, comme 48h ou 2015-06-01T18:00:00+02:00",
+		msgFlagGenMaxDownloads:    "Si non nul, arrêter le partage une fois téléchargé par autant d'appareils",
+		msgFlagShareID:            "L'identifiant à partager",
+		msgFlagShareDir:           "Si non vide, le dossier à partager",
+		msgFlagTracker:            "Un tracker auquel se connecter. Il est retenu pour les fois suivantes",
+		msgFlagUseLPD:             "Utiliser la découverte locale de pairs",
+		msgFlagPeer:               "Un pair auquel se connecter",
+		msgFlagServeTracker:       "Si non nul, faire aussi tourner un tracker (HTTP et UDP) pour ce seul partage sur ce port",
+		msgFlagShareProfile:       "Si non vide, le profil dont le partage hérite ses réglages. Il est retenu pour les fois suivantes",
+		msgFlagRelayID:            "Un identifiant du partage ; seule sa partie Store est gardée",
+		msgFlagRelayMemory:        "Ne garder les pièces scellées qu'en mémoire",
+		msgFlagID:                 "L'identifiant du partage",
+		msgFlagTrackerAdd:         "Un tracker à ajouter",
+		msgFlagTrackerRemove:      "Un tracker à retirer",
+		msgFlagProfile:            "Le profil dont le partage hérite ses réglages",
+		msgFlagIgnore:             "Un motif de fichiers à ne pas partager",
+		msgFlagScanInterval:       "À quelle fréquence parcourir le dossier partagé, comme 30s ou 5m",
+		msgFlagNoWatch:            "Seulement parcourir le dossier partagé, pour les montages réseau qui ne signalent pas les changements. =false le désactive",
+		msgFlagUploadRate:         "Limite d'envoi en octets par seconde. Négative pour illimitée",
+		msgFlagDownloadRate:       "Limite de téléchargement en octets par seconde. Négative pour illimitée",
+		msgFlagExpires:            "Quand le partage s'arrête, comme 48h ou 2015-06-01T18:00:00+02:00",
+		msgFlagMaxDownloads:       "Arrêter le partage une fois téléchargé par autant d'appareils",
+		msgFlagTrust:              "Un pair auquel toujours se connecter, en hôte:port, ou un hôte à accepter sur tout port",
+		msgFlagTrustedOnly:        "Refuser tous les pairs sauf ceux de confiance. =false le désactive",
+		msgFlagTargetPeers:        "Combien de pairs chercher, si ce n'est %d",
+		msgFlagMaxPeers:           "Combien de pairs accepter au plus, si ce n'est %d",
+		msgFlagMirror:             "URL de base d'un serveur HTTPS avec une copie des fichiers, d'où télécharger quand aucun pair ne les a",
+		msgFlagAdmin:              "Obéir aux commandes d'administration que les rédacteurs du partage envoient de leurs appareils. =false le désactive",
+		msgFlagStorage:            "Comment accéder aux fichiers : files, mmap pour les lire par projection en mémoire, mmap-write, memory, ou s3",
+		msgFlagStorageURL:         "Où le stockage s3 garde les fichiers, comme https://s3.eu-west-1.amazonaws.com/bucket/prefix",
+		msgFlagAllocation:         "Comment allouer les fichiers en téléchargement : sparse, fallocate pour réserver leur taille, ou none",
+		msgFlagKeepVersions:       "Combien de temps garder des copies des fichiers que les synchronisations écrasent ou suppriment, comme 720h. Négatif pour ne pas les garder",
+		msgFlagFormat:             "Le format de métadonnées des nouvelles révisions : v1, v2 pour des arbres de Merkle par fichier (BEP 52), ou hybrid pour les clients de l'une ou l'autre version",
+		msgFlagSequential:         "Un motif de fichiers à télécharger dans l'ordre, comme *.mkv, pour les lire pendant leur téléchargement",
+		msgFlagSeedRatio:          "Arrêter d'envoyer une révision une fois envoyé autant de fois sa taille",
+		msgFlagSeedBytes:          "Arrêter d'envoyer une révision une fois envoyé autant d'octets",
+		msgFlagSeedTime:           "Arrêter d'envoyer une révision après l'avoir partagée aussi longtemps, comme 72h",
+		msgFlagSealed:             "Publier des copies scellées des pièces, ou les garder quand le partage ne peut être lu, pour que des répliques non fiables puissent le servir. =false le désactive",
+		msgFlagWebhook:            "Une URL où envoyer par POST les événements du partage, en JSON",
+		msgFlagWebhookEvent:       "Un type d'événement à envoyer aux webhooks, tous si aucun : %s",
+		msgFlagUnsetSetting:       "Un réglage à remettre à sa valeur par défaut, ou à celle du profil, comme uploadRate ou profile",
+		msgFlagRemoveIgnore:       "Un motif de fichiers à ne plus ignorer",
+		msgFlagRemoveTrust:        "Un pair auquel ne plus faire confiance",
+		msgFlagRemoveMirror:       "Un miroir à ne plus publier",
+		msgFlagRemoveSequential:   "Un motif de fichiers à ne plus télécharger dans l'ordre",
+		msgFlagRemoveWebhook:      "Une URL où ne plus envoyer les événements",
+		msgFlagRemoveWebhookEvent: "Un type d'événement à ne plus envoyer aux webhooks",
+		msgFlagPreviewTimeout:     "Combien de temps attendre les pairs",
+		msgFlagTopInterval:        "À quelle fréquence rafraîchir",
+		msgFlagTopPlain:           "Ne pas effacer l'écran entre les rafraîchissements, pour les lecteurs d'écran et les journaux",
+		msgFlagIngestFrom:         "L'archive à importer, ou - pour l'entrée standard",
+		msgFlagIngestFormat:       "Le format de l'archive : tar, tgz ou zip. Deviné d'après son nom par défaut",
+		msgFlagAboutSet:           "Un champ à définir, comme name=Vacances, description=... ou contact=...",
+		msgFlagAboutUnset:         "Un champ à retirer",
+		msgFlagSecretsStore:       "Où garder les identifiants : keychain, file ou session",
+		msgFlagRotateID:           "L'identifiant WriteReadStore du partage",
+		msgFlagRotateRead:         "Remplacer la clé de lecture, révoquant les identifiants ReadStore et Store",
+		msgFlagRotateWrite:        "Remplacer les clés d'écriture, révoquant l'identifiant WriteReadStore",
+		msgFlagIDOrArg:            "L'identifiant du partage, qui peut aussi être donné en argument",
+		msgFlagHistoryAudit:       "Montrer chaque révision prise par le partage, avec le pair qui l'a annoncée, plutôt que les révisions où revenir",
+		msgFlagRollbackTo:         "L'infohash de la révision où revenir, tel que montré par history, ou ses premiers caractères",
+		msgFlagRollbackForce:      "Revenir en arrière même si des pièces de la révision ne sont plus dans le dossier",
+		msgFlagExportTorrent:      "Si non vide, écrire aussi le fichier .torrent de la révision à cet endroit",
+		msgFlagAdminPeer:          "N'envoyer la commande qu'à l'appareil à cet hôte ou hôte:port",
+		msgFlagAdminWait:          "Combien de temps attendre les réponses",
+	},
+}
+
+// userLang returns the language messages are shown in: the one given by
+// -lang, or else the one of the environment, if we have a catalog for it.
+func userLang() string {
+	candidates := []string{*lang, os.Getenv("LC_ALL"), os.Getenv("LC_MESSAGES"), os.Getenv("LANG")}
+	for _, c := range candidates {
+		if c == "" {
+			continue
+		}
+		// fr_FR.UTF-8 -> fr
+		parts := strings.FieldsFunc(c, func(r rune) bool {
+			return r == '_' || r == '.' || r == '-' || r == '@'
+		})
+		if len(parts) == 0 {
+			continue
+		}
+		l := strings.ToLower(parts[0])
+		if _, ok := catalogs[l]; ok {
+			return l
+		}
+	}
+	return "en"
+}
+
+// T returns the message in the language of the user, formatted with args
+// as with fmt.Sprintf.
+func T(code msgCode, args ...interface{}) string {
+	format, ok := catalogs[userLang()][code]
+	if !ok {
+		format, ok = catalogs["en"][code]
+	}
+	if !ok {
+		format = string(code)
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+// userError is an error meant to be read by the user. Its text is
+// translated, its code isn't.
+type userError struct {
+	Code msgCode
+	args []interface{}
+}
+
+func newUserError(code msgCode, args ...interface{}) error {
+	return userError{code, args}
+}
+
+func (e userError) Error() string {
+	return fmt.Sprintf("%s [%s]", T(e.Code, e.args...), e.Code)
+}
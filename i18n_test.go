@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestCatalogsComplete(t *testing.T) {
+	for l, catalog := range catalogs {
+		for code := range catalogs["en"] {
+			if _, ok := catalog[code]; !ok {
+				t.Errorf("Message %s is missing from the %s catalog", code, l)
+			}
+		}
+	}
+}
+
+func TestUserLang(t *testing.T) {
+	defer func(l string) { *lang = l }(*lang)
+	defer os.Setenv("LANG", os.Getenv("LANG"))
+	os.Unsetenv("LC_ALL")
+	os.Unsetenv("LC_MESSAGES")
+
+	*lang = ""
+	os.Setenv("LANG", "fr_FR.UTF-8")
+	if l := userLang(); l != "fr" {
+		t.Errorf("Expected fr from the environment, got %s", l)
+	}
+
+	os.Setenv("LANG", "xx_XX.UTF-8")
+	if l := userLang(); l != "en" {
+		t.Errorf("Expected en for an unknown language, got %s", l)
+	}
+
+	*lang = "fr"
+	if l := userLang(); l != "fr" {
+		t.Errorf("Expected fr from the flag, got %s", l)
+	}
+}
+
+func TestUserErrorKeepsCode(t *testing.T) {
+	defer func(l string) { *lang = l }(*lang)
+	*lang = "fr"
+
+	err := newUserError(msgNeedID)
+	if err.Error() != "Il faut un identifiant ! [need-id]" {
+		t.Fatalf("Unexpected message: %s", err)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	useI2P     = flag.Bool("i2p", false, "Go through I2P: reach and accept peers only through the SAM bridge at -samAddress, with a destination kept in the working directory. DHT, LPD, trackers and port mappings are disabled")
+	samAddress = flag.String("samAddress", "127.0.0.1:7656", "Address of the SAM bridge of I2P")
+)
+
+// The private key of our destination, in the working directory, so that
+// our address stays the same
+const i2pKeyFile = "i2p.key"
+
+var (
+	errNotI2P       = errors.New("only I2P destinations can be reached in I2P mode")
+	errNoI2PSession = errors.New("no I2P session")
+)
+
+// I2P destinations are written in base 64 with - and ~ rather than + and
+// /. Peers know each other by the base 32 hash of their destination.
+var (
+	i2pBase64 = base64.NewEncoding("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-~")
+	i2pBase32 = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567")
+)
+
+// The I2P address peers reach us at, and our session with the SAM
+// bridge. They are set before sessions start.
+var (
+	ourI2P     string
+	i2pSession *samSession
+)
+
+// isI2P tells whether host is an I2P address.
+func isI2P(host string) bool {
+	return strings.HasSuffix(host, ".i2p")
+}
+
+// isOverlay tells whether host is only reachable through Tor or I2P.
+func isOverlay(host string) bool {
+	return isOnion(host) || isI2P(host)
+}
+
+// ourOverlay returns the onion service or I2P address peers reach us at,
+// if we only accept them through Tor or I2P.
+func ourOverlay() string {
+	if ourI2P != "" {
+		return ourI2P
+	}
+	return ourOnion
+}
+
+// i2pAddress returns the base 32 address of the destination dest.
+func i2pAddress(dest string) (string, error) {
+	raw, err := i2pBase64.DecodeString(dest)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(raw)
+	return strings.TrimRight(i2pBase32.EncodeToString(sum[:]), "=") + ".b32.i2p", nil
+}
+
+// samConn is a connection to the SAM bridge, on which commands are
+// exchanged until it becomes a stream.
+type samConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func dialSAM() (*samConn, error) {
+	conn, err := net.Dial("tcp", *samAddress)
+	if err != nil {
+		return nil, err
+	}
+	c := &samConn{Conn: conn, r: bufio.NewReader(conn)}
+	if _, err = c.command("HELLO VERSION MIN=3.0 MAX=3.1"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Read reads what the bridge sent after the last reply.
+func (c *samConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// command sends line and returns the fields of the reply, which must be
+// successful.
+func (c *samConn) command(line string) (map[string]string, error) {
+	if _, err := fmt.Fprintf(c.Conn, "%s\n", line); err != nil {
+		return nil, err
+	}
+	reply, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	fields := parseSAMReply(reply)
+	if result := fields["RESULT"]; result != "" && result != "OK" {
+		return nil, fmt.Errorf("I2P refused %s: %s %s", strings.Fields(line)[0], result, fields["MESSAGE"])
+	}
+	return fields, nil
+}
+
+// parseSAMReply returns the KEY=value fields of a reply, whose values may
+// be quoted.
+func parseSAMReply(reply string) map[string]string {
+	fields := make(map[string]string)
+	quoted := false
+	words := strings.FieldsFunc(strings.TrimSpace(reply), func(r rune) bool {
+		if r == '"' {
+			quoted = !quoted
+		}
+		return r == ' ' && !quoted
+	})
+	for _, word := range words {
+		if kv := strings.SplitN(word, "=", 2); len(kv) == 2 {
+			fields[kv[0]] = strings.Trim(kv[1], "\"")
+		}
+	}
+	return fields
+}
+
+// samSession is a stream session of the SAM bridge. It lasts as long as
+// its control connection.
+type samSession struct {
+	id      string
+	control *samConn
+	port    int
+}
+
+// startI2P creates our stream session, with the destination kept in
+// workDir, and sets ourI2P. Peers are told port, which I2P doesn't use.
+func startI2P(workDir string, port int) (*samSession, error) {
+	c, err := dialSAM()
+	if err != nil {
+		return nil, err
+	}
+	keyPath := filepath.Join(workDir, i2pKeyFile)
+	key, _ := ioutil.ReadFile(keyPath)
+	priv := strings.TrimSpace(string(key))
+	if priv == "" {
+		reply, err := c.command("DEST GENERATE SIGNATURE_TYPE=7")
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		priv = reply["PRIV"]
+		if err = ioutil.WriteFile(keyPath, []byte(priv), 0600); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	s := &samSession{id: "rakoshare-" + strconv.Itoa(os.Getpid()), control: c, port: port}
+	if _, err = c.command(fmt.Sprintf("SESSION CREATE STYLE=STREAM ID=%s DESTINATION=%s SIGNATURE_TYPE=7", s.id, priv)); err != nil {
+		c.Close()
+		return nil, err
+	}
+	reply, err := c.command("NAMING LOOKUP NAME=ME")
+	if err == nil {
+		ourI2P, err = i2pAddress(reply["VALUE"])
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *samSession) Close() error {
+	return s.control.Close()
+}
+
+// dial opens a stream to the I2P address of peer.
+func (s *samSession) dial(peer string, timeout time.Duration) (net.Conn, error) {
+	host := peerHost(peer)
+	if !isI2P(host) {
+		return nil, errNotI2P
+	}
+	c, err := dialSAM()
+	if err != nil {
+		return nil, err
+	}
+	c.SetDeadline(time.Now().Add(timeout))
+	if _, err = c.command(fmt.Sprintf("STREAM CONNECT ID=%s DESTINATION=%s SILENT=false", s.id, host)); err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.SetDeadline(time.Time{})
+	return &i2pConn{samConn: c, remote: i2pAddr(peer)}, nil
+}
+
+// Accept waits for a peer to open a stream to us. It makes samSession a
+// net.Listener.
+func (s *samSession) Accept() (net.Conn, error) {
+	c, err := dialSAM()
+	if err != nil {
+		// Don't spin while the bridge is down
+		time.Sleep(time.Second)
+		return nil, err
+	}
+	if _, err = c.command(fmt.Sprintf("STREAM ACCEPT ID=%s SILENT=false", s.id)); err != nil {
+		c.Close()
+		return nil, err
+	}
+	// The bridge sends the destination of the peer first
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	remote, err := i2pAddress(strings.Fields(line + " ")[0])
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return &i2pConn{samConn: c, remote: i2pAddr(net.JoinHostPort(remote, "0"))}, nil
+}
+
+func (s *samSession) Addr() net.Addr {
+	return i2pAddr(net.JoinHostPort(ourI2P, strconv.Itoa(s.port)))
+}
+
+// i2pConn is a stream with a peer over I2P.
+type i2pConn struct {
+	*samConn
+	remote i2pAddr
+}
+
+func (c *i2pConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// i2pAddr is the address of a peer over I2P, as host:port.
+type i2pAddr string
+
+func (a i2pAddr) Network() string { return "i2p" }
+func (a i2pAddr) String() string  { return string(a) }
+
+// i2pDial connects to peer through our I2P session.
+func i2pDial(peer string, timeout time.Duration) (net.Conn, error) {
+	if i2pSession == nil {
+		return nil, errNoI2PSession
+	}
+	return i2pSession.dial(peer, timeout)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSAMReply(t *testing.T) {
+	fields := parseSAMReply(`SESSION STATUS RESULT=I2P_ERROR MESSAGE="Duplicate destination" ID=x` + "\n")
+	if fields["RESULT"] != "I2P_ERROR" || fields["MESSAGE"] != "Duplicate destination" || fields["ID"] != "x" {
+		t.Errorf("Unexpected fields %q", fields)
+	}
+}
+
+func TestI2PAddress(t *testing.T) {
+	addr, err := i2pAddress(i2pBase64.EncodeToString(make([]byte, 387)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addr) != 52+len(".b32.i2p") || !isI2P(addr) {
+		t.Errorf("Unexpected address %q", addr)
+	}
+	if _, err = i2pAddress("not+base64/"); err == nil {
+		t.Error("Expected the standard alphabet to be refused")
+	}
+}
+
+// fakeSAM answers the commands of the connections to it like a SAM
+// bridge, and records them.
+func fakeSAM(t *testing.T, commands chan<- string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := i2pBase64.EncodeToString(make([]byte, 387))
+	go func() {
+		defer l.Close()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					line = strings.TrimSpace(line)
+					commands <- line
+					switch {
+					case strings.HasPrefix(line, "HELLO"):
+						conn.Write([]byte("HELLO REPLY RESULT=OK VERSION=3.1\n"))
+					case strings.HasPrefix(line, "DEST GENERATE"):
+						conn.Write([]byte("DEST REPLY PUB=" + pub + " PRIV=secret\n"))
+					case strings.HasPrefix(line, "NAMING LOOKUP"):
+						conn.Write([]byte("NAMING REPLY RESULT=OK NAME=ME VALUE=" + pub + "\n"))
+					case strings.Contains(line, "DESTINATION=nowhere.b32.i2p"):
+						conn.Write([]byte("STREAM STATUS RESULT=CANT_REACH_PEER\n"))
+					case strings.HasPrefix(line, "STREAM ACCEPT"):
+						conn.Write([]byte("STREAM STATUS RESULT=OK\n" + pub + " FROM_PORT=0\n"))
+					default:
+						conn.Write([]byte("STATUS RESULT=OK\n"))
+					}
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestStartI2P(t *testing.T) {
+	dir, err := ioutil.TempDir("", "i2p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(old string) { *samAddress = old; ourI2P = "" }(*samAddress)
+
+	commands := make(chan string, 100)
+	*samAddress = fakeSAM(t, commands)
+	for _, generate := range []bool{true, false} {
+		s, err := startI2P(dir, 7777)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for len(got) < 3 || !strings.HasPrefix(got[len(got)-1], "NAMING") {
+			got = append(got, <-commands)
+		}
+		if generated := strings.HasPrefix(got[1], "DEST GENERATE"); generated != generate {
+			t.Errorf("Unexpected commands %q", got)
+		}
+		if !strings.Contains(got[len(got)-2], "DESTINATION=secret") {
+			t.Errorf("Expected the kept key to be used, got %q", got)
+		}
+		if !isI2P(ourI2P) || s.Addr().String() != ourI2P+":7777" {
+			t.Errorf("Unexpected address %s", s.Addr())
+		}
+		s.Close()
+	}
+	key, _ := ioutil.ReadFile(filepath.Join(dir, i2pKeyFile))
+	if string(key) != "secret" {
+		t.Errorf("Expected the key to be kept, got %q", key)
+	}
+}
+
+func TestI2PStreams(t *testing.T) {
+	defer func(old string) { *samAddress = old; ourI2P = "" }(*samAddress)
+	commands := make(chan string, 100)
+	*samAddress = fakeSAM(t, commands)
+	s := &samSession{id: "test"}
+
+	if _, err := s.dial("203.0.113.1:7777", time.Second); err != errNotI2P {
+		t.Errorf("Expected clear addresses to be refused, got %v", err)
+	}
+	if _, err := s.dial("nowhere.b32.i2p:7777", time.Second); err == nil || !strings.Contains(err.Error(), "CANT_REACH_PEER") {
+		t.Errorf("Expected the bridge to refuse, got %v", err)
+	}
+	conn, err := s.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if host := peerHost(conn.RemoteAddr().String()); !isI2P(host) {
+		t.Errorf("Expected peers to be known by their I2P address, got %s", host)
+	}
+}
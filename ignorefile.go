@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// The file, at the root of a shared directory, with patterns of paths
+// to leave out of the share, in the syntax of .gitignore. Each device
+// has its own: it is never shared.
+const ignoreFile = ".rakoshareignore"
+
+type ignorePattern struct {
+	segments []string // Matched one by one, ** matches any number of them
+	negate   bool     // Includes back what an earlier pattern left out
+	dirOnly  bool     // Only matches directories
+	anchored bool     // Matched from the root rather than at any level
+}
+
+// ignoreRules are the patterns of an ignore file. The last pattern that
+// matches a path decides, and the content of an ignored directory is
+// ignored whatever the patterns say.
+type ignoreRules []ignorePattern
+
+// loadIgnoreFile reads the ignore file of dir. A missing file ignores
+// nothing.
+func loadIgnoreFile(dir string) ignoreRules {
+	f, err := os.Open(filepath.Join(dir, ignoreFile))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	return parseIgnore(f)
+}
+
+func parseIgnore(r io.Reader) (rules ignoreRules) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var p ignorePattern
+		if strings.HasPrefix(line, "!") {
+			p.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\`) {
+			// \# and \! are literal
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			p.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if strings.Contains(line, "/") {
+			p.anchored = true
+			line = strings.TrimLeft(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		p.segments = strings.Split(line, "/")
+		rules = append(rules, p)
+	}
+	return
+}
+
+// match tells whether the file at relPath, relative to the shared
+// directory, is ignored.
+func (rules ignoreRules) match(relPath string) bool {
+	if len(rules) == 0 {
+		return false
+	}
+	segments := strings.Split(filepath.ToSlash(relPath), "/")
+	for i := 1; i < len(segments); i++ {
+		if rules.decide(segments[:i], true) {
+			return true
+		}
+	}
+	return rules.decide(segments, false)
+}
+
+// decide applies the patterns to a single path, leaving its parents
+// aside.
+func (rules ignoreRules) decide(segments []string, isDir bool) (ignored bool) {
+	for _, p := range rules {
+		if p.dirOnly && !isDir {
+			continue
+		}
+		var ok bool
+		if p.anchored {
+			ok = matchSegments(p.segments, segments)
+		} else {
+			ok = matchSegments(p.segments, segments[len(segments)-1:])
+		}
+		if ok {
+			ignored = !p.negate
+		}
+	}
+	return
+}
+
+func matchSegments(pattern, segments []string) bool {
+	if len(pattern) == 0 {
+		return len(segments) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(segments); i++ {
+			if matchSegments(pattern[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segments) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(pattern[0], segments[0]); !ok {
+		return false
+	}
+	return matchSegments(pattern[1:], segments[1:])
+}
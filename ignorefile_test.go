@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIgnoreRules(t *testing.T) {
+	rules := parseIgnore(strings.NewReader(`
+# Build output
+*.o
+build/
+/TODO
+docs/**/*.tmp
+!keep.o
+\#notes
+`))
+
+	tests := []struct {
+		path    string
+		ignored bool
+	}{
+		{"a.o", true},
+		{"src/deep/a.o", true},
+		{"keep.o", false},
+		{"build", false}, // Only directories, and build is a file
+		{"build/out", true},
+		{"src/build/out", true},
+		{"TODO", true},
+		{"src/TODO", false},
+		{"docs/a.tmp", true},
+		{"docs/x/y/a.tmp", true},
+		{"a.tmp", false},
+		{"#notes", true},
+		{"src/main.go", false},
+	}
+	for _, tt := range tests {
+		if got := rules.match(tt.path); got != tt.ignored {
+			t.Errorf("%s: expected ignored to be %v", tt.path, tt.ignored)
+		}
+	}
+}
+
+func TestFileStoreIgnoredFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ignorefile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, ignoreFile), []byte("local.conf\n"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "local.conf"), []byte("mine"), 0600)
+
+	info := &InfoDict{PieceLength: 8, Files: []*FileDict{
+		{Path: []string{"local.conf"}, Length: 6},
+		{Path: []string{"b"}, Length: 2},
+	}}
+	fs, _, err := newFileStore(info, dir, allocSparse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.WriteAt([]byte("theirsbb"), 0); err != nil {
+		t.Fatal(err)
+	}
+	fs.Cleanup()
+	fs.Close()
+
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "local.conf")); string(data) != "mine" {
+		t.Errorf("Expected the ignored file to be left alone, got %q", data)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "b")); string(data) != "bb" {
+		t.Errorf("Expected the other file to be written, got %q", data)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"log"
+
+	ed "github.com/agl/ed25519"
+	"github.com/rakoo/rakoshare/pkg/id"
+)
+
+// Info dicts of the share are signed by the writer that made them. The
+// signature travels with the metadata, so that winning the race to
+// announce a torrent isn't enough to make replicas download it.
+
+var errInfoUnsigned = errors.New("info dict not signed by a writer of the share")
+
+func signInfo(raw []byte, priv id.PrivKey) string {
+	privarg := [ed.PrivateKeySize]byte(priv)
+	sig := ed.Sign(&privarg, raw)
+	return string(sig[:])
+}
+
+func verifyInfo(raw []byte, sig string, pub id.PubKey) error {
+	if len(sig) != ed.SignatureSize {
+		return errInfoUnsigned
+	}
+	pubarg := [ed.PublicKeySize]byte(pub)
+	var sigarg [ed.SignatureSize]byte
+	copy(sigarg[:], sig)
+	if !ed.Verify(&pubarg, raw, &sigarg) {
+		return errInfoUnsigned
+	}
+	return nil
+}
+
+// signInfo signs the info dict of t when we are a writer and it isn't
+// signed yet.
+func (t *TorrentSession) signInfo() {
+	if t.m.InfoSig != "" || !t.Id.CanWrite() {
+		return
+	}
+	raw, err := t.m.RawInfo()
+	if err != nil {
+		log.Println("Couldn't sign info dict: ", err)
+		return
+	}
+	t.m.InfoSig = signInfo(raw, t.Id.Priv)
+}
+
+// checkInfo tells whether info was signed by the current writers of the
+// share. Store ids of the first versions don't know them and can't tell.
+func (t *TorrentSession) checkInfo(info []byte, sig string) error {
+	if !t.Id.CanVerify() {
+		return nil
+	}
+	return verifyInfo(info, sig, t.writerKey())
+}
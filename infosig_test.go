@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/rakoo/rakoshare/pkg/id"
+)
+
+func TestInfoSignature(t *testing.T) {
+	writer, err := id.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := id.NewFromString(writer.S())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := &TorrentSession{Id: writer, m: &MetaInfo{Info: &InfoDict{Name: "share", PieceLength: 16384}}}
+	ts.signInfo()
+	if ts.m.InfoSig == "" {
+		t.Fatal("Writers should sign their info dicts")
+	}
+	raw, err := ts.m.RawInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replica := &TorrentSession{Id: store, writerKey: func() id.PubKey { return writer.Pub }}
+	if err := replica.checkInfo(raw, ts.m.InfoSig); err != nil {
+		t.Errorf("Expected a valid signature, got %v", err)
+	}
+	if err := replica.checkInfo(raw, ""); err != errInfoUnsigned {
+		t.Errorf("Expected an unsigned info dict to be refused, got %v", err)
+	}
+	forged := append([]byte(nil), raw...)
+	forged[len(forged)-2] ^= 1
+	if err := replica.checkInfo(forged, ts.m.InfoSig); err != errInfoUnsigned {
+		t.Errorf("Expected a tampered info dict to be refused, got %v", err)
+	}
+
+	other, _ := id.New()
+	replica.writerKey = func() id.PubKey { return other.Pub }
+	if err := replica.checkInfo(raw, ts.m.InfoSig); err != errInfoUnsigned {
+		t.Errorf("Expected an info dict from other writers to be refused, got %v", err)
+	}
+}
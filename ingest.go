@@ -0,0 +1,244 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rakoo/rakoshare/pkg/id"
+)
+
+var errUnsafePath = errors.New("path escapes the destination")
+
+// Ingest replaces the content of a share with the files of an archive, so
+// that the next scan publishes them as a new revision. The archive is
+// read from the file at source, or from standard input if source is "-".
+// format is one of tar, tgz or zip; if empty, it is guessed.
+//
+// The archive is first extracted next to the shared directory, which is
+// then swapped with it: peers never see a half-extracted revision.
+func Ingest(cliId, workDir, source, format string) error {
+	shareID, err := id.NewFromString(cliId)
+	if err != nil {
+		return newUserError(msgBadID, err)
+	}
+	if !shareID.CanWrite() {
+		return newUserError(msgIngestNeedsWrite)
+	}
+	session, err := openSession(workDir, shareID)
+	if err != nil {
+		return newUserError(msgOpenSession, err)
+	}
+	target := session.GetTarget()
+	if target == "" {
+		return newUserError(msgNeedFolder)
+	}
+	target = filepath.Clean(target)
+
+	in := os.Stdin
+	if source != "-" {
+		in, err = os.Open(source)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+	}
+	if format == "" {
+		format = guessArchiveFormat(source)
+	}
+
+	err = os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+	staging, err := ioutil.TempDir(filepath.Dir(target), "."+filepath.Base(target)+".ingest-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	var files int
+	switch format {
+	case "tar", "tgz":
+		files, err = extractTar(in, staging)
+	case "zip":
+		files, err = extractZip(in, staging)
+	default:
+		return newUserError(msgUnknownArchive, format)
+	}
+	if err != nil {
+		return newUserError(msgExtractFailed, err)
+	}
+
+	err = swapDir(staging, target)
+	if err != nil {
+		return err
+	}
+	fmt.Println(T(msgIngested, files, target))
+	return nil
+}
+
+func guessArchiveFormat(source string) string {
+	switch {
+	case strings.HasSuffix(source, ".zip"):
+		return "zip"
+	case strings.HasSuffix(source, ".tar.gz"), strings.HasSuffix(source, ".tgz"):
+		return "tgz"
+	default:
+		// Compression is detected when reading
+		return "tar"
+	}
+}
+
+// extractTar extracts the tar stream r, optionally gzipped, into dir.
+func extractTar(r io.Reader, dir string) (files int, err error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return 0, err
+		}
+		defer gz.Close()
+		r = gz
+	} else {
+		r = br
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return files, err
+		}
+
+		path, err := safeJoin(dir, hdr.Name)
+		if err != nil {
+			return files, err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(path, 0755)
+		case tar.TypeReg, tar.TypeRegA:
+			err = writeFile(path, tr, os.FileMode(hdr.Mode).Perm())
+			files++
+		default:
+			log.Printf("Skipping %s: only regular files and directories are shared\n", hdr.Name)
+		}
+		if err != nil {
+			return files, err
+		}
+	}
+}
+
+// extractZip extracts the zip archive r into dir. Zip archives can't be
+// read as a stream: if r isn't a file, it is copied to one first.
+func extractZip(r *os.File, dir string) (files int, err error) {
+	info, err := r.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		tmp, err := ioutil.TempFile(dir, ".archive-")
+		if err != nil {
+			return 0, err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		if _, err := io.Copy(tmp, r); err != nil {
+			return 0, err
+		}
+		r = tmp
+		info, err = r.Stat()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	zr, err := zip.NewReader(r, info.Size())
+	if err != nil {
+		return 0, err
+	}
+	for _, f := range zr.File {
+		path, err := safeJoin(dir, f.Name)
+		if err != nil {
+			return files, err
+		}
+		if f.FileInfo().IsDir() {
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return files, err
+			}
+			continue
+		}
+		if !f.Mode().IsRegular() {
+			log.Printf("Skipping %s: only regular files and directories are shared\n", f.Name)
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return files, err
+		}
+		err = writeFile(path, rc, f.Mode().Perm())
+		rc.Close()
+		if err != nil {
+			return files, err
+		}
+		files++
+	}
+	return files, nil
+}
+
+// safeJoin returns name inside dir, refusing names that would end up
+// outside of it.
+func safeJoin(dir, name string) (string, error) {
+	path := filepath.Join(dir, filepath.FromSlash(name))
+	if path != dir && !strings.HasPrefix(path, dir+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s: %s", name, errUnsafePath)
+	}
+	return path, nil
+}
+
+func writeFile(path string, r io.Reader, perm os.FileMode) error {
+	if perm == 0 {
+		perm = 0644
+	}
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// swapDir puts the directory staging in place of target, and removes the
+// previous content of target.
+func swapDir(staging, target string) error {
+	old := staging + ".old"
+	err := os.Rename(target, old)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = os.Rename(staging, target)
+	if err != nil {
+		// Put things back as they were
+		os.Rename(old, target)
+		return err
+	}
+	return os.RemoveAll(old)
+}
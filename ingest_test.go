@@ -0,0 +1,147 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func makeTar(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, content := range files {
+		err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(content))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func checkFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		got, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		if string(got) != content {
+			t.Errorf("%s: expected %q, got %q", name, content, got)
+		}
+	}
+}
+
+func TestExtractTar(t *testing.T) {
+	files := map[string]string{"a.txt": "a", "dir/b.txt": "bb"}
+	archive := makeTar(t, files)
+
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write(archive)
+	gz.Close()
+
+	for _, data := range [][]byte{archive, gzipped.Bytes()} {
+		dir, err := ioutil.TempDir("", "ingest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		n, err := extractTar(bytes.NewReader(data), dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != len(files) {
+			t.Errorf("Expected %d files, got %d", len(files), n)
+		}
+		checkFiles(t, dir, files)
+	}
+}
+
+func TestExtractZip(t *testing.T) {
+	files := map[string]string{"a.txt": "a", "dir/b.txt": "bb"}
+	f, err := ioutil.TempFile("", "ingest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "ingest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	n, err := extractZip(f, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(files) {
+		t.Errorf("Expected %d files, got %d", len(files), n)
+	}
+	checkFiles(t, dir, files)
+}
+
+func TestExtractRefusesEscapes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ingest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"../evil", "a/../../evil"} {
+		_, err := extractTar(bytes.NewReader(makeTar(t, map[string]string{name: "x"})), dir)
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(dir), "evil")); err == nil {
+		t.Error("File was written outside of the destination")
+	}
+}
+
+func TestSwapDir(t *testing.T) {
+	parent, err := ioutil.TempDir("", "ingest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(parent)
+	target := filepath.Join(parent, "share")
+	staging := filepath.Join(parent, ".share.ingest")
+	os.MkdirAll(target, 0755)
+	os.MkdirAll(staging, 0755)
+	ioutil.WriteFile(filepath.Join(target, "old"), []byte("old"), 0644)
+	ioutil.WriteFile(filepath.Join(staging, "new"), []byte("new"), 0644)
+
+	if err := swapDir(staging, target); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, target, map[string]string{"new": "new"})
+	if _, err := os.Stat(filepath.Join(target, "old")); err == nil {
+		t.Error("Old content is still there")
+	}
+	entries, _ := ioutil.ReadDir(parent)
+	if len(entries) != 1 {
+		t.Errorf("Expected only the share to be left, got %d entries", len(entries))
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"os/exec"
+	"strings"
+)
+
+// keychain keeps secrets in the login keychain, through the security
+// tool.
+type keychain struct{}
+
+func (keychain) Get(account string) (string, error) {
+	out, err := exec.Command("security", "find-generic-password", "-s", keychainService, "-a", account, "-w").Output()
+	if exit, ok := err.(*exec.ExitError); ok && exit.ExitCode() == 44 {
+		return "", errNoSecret
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(out), "\n"), nil
+}
+
+// Set gives the secret on the standard input: with -w last, security asks
+// for it, twice, rather than taking it from its arguments, which any
+// local user can see.
+func (keychain) Set(account, secret string) error {
+	cmd := exec.Command("security", "add-generic-password", "-U", "-s", keychainService, "-a", account, "-w")
+	cmd.Stdin = strings.NewReader(secret + "\n" + secret + "\n")
+	return cmd.Run()
+}
+
+func (keychain) Delete(account string) error {
+	err := exec.Command("security", "delete-generic-password", "-s", keychainService, "-a", account).Run()
+	if exit, ok := err.(*exec.ExitError); ok && exit.ExitCode() == 44 {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os/exec"
+	"strings"
+)
+
+// keychain keeps secrets with the Secret Service of the desktop (GNOME
+// Keyring, KWallet...), through the secret-tool utility.
+type keychain struct{}
+
+func (keychain) Get(account string) (string, error) {
+	if _, err := exec.LookPath("secret-tool"); err != nil {
+		return "", errKeychainUnsupported
+	}
+	out, err := exec.Command("secret-tool", "lookup", "service", keychainService, "account", account).Output()
+	if _, ok := err.(*exec.ExitError); ok && len(out) == 0 {
+		// secret-tool fails without a word when there is no such secret
+		return "", errNoSecret
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(out), "\n"), nil
+}
+
+func (keychain) Set(account, secret string) error {
+	if _, err := exec.LookPath("secret-tool"); err != nil {
+		return errKeychainUnsupported
+	}
+	cmd := exec.Command("secret-tool", "store", "--label", "rakoshare share "+account,
+		"service", keychainService, "account", account)
+	cmd.Stdin = strings.NewReader(secret)
+	return cmd.Run()
+}
+
+func (keychain) Delete(account string) error {
+	if _, err := exec.LookPath("secret-tool"); err != nil {
+		return errKeychainUnsupported
+	}
+	return exec.Command("secret-tool", "clear", "service", keychainService, "account", account).Run()
+}
@@ -0,0 +1,18 @@
+// +build !darwin,!linux,!windows
+
+package main
+
+// keychain is missing on this system.
+type keychain struct{}
+
+func (keychain) Get(account string) (string, error) {
+	return "", errKeychainUnsupported
+}
+
+func (keychain) Set(account, secret string) error {
+	return errKeychainUnsupported
+}
+
+func (keychain) Delete(account string) error {
+	return errKeychainUnsupported
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"flag"
+	"net"
+)
+
+// Devices on the same network sync much faster directly than through
+// the internet. Pieces that a peer of the local network can send us are
+// left to it rather than requested from remote peers, and the rate
+// limits of the share, meant for the internet link, can be lifted for
+// local peers.
+
+var lanUnlimited = flag.Bool("lanUnlimited", true, "Don't apply the rate limits of shares to peers on the local network")
+
+var lanNetworks []*net.IPNet
+
+func init() {
+	for _, cidr := range []string{
+		"10.0.0.0/8",     // RFC 1918
+		"172.16.0.0/12",  // RFC 1918
+		"192.168.0.0/16", // RFC 1918
+		"169.254.0.0/16", // IPv4 link-local
+		"fc00::/7",       // IPv6 unique local
+		"fe80::/10",      // IPv6 link-local
+	} {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		lanNetworks = append(lanNetworks, n)
+	}
+}
+
+// isLANAddress tells whether the peer at addr is on a private or
+// link-local network.
+func isLANAddress(addr string) bool {
+	if *useTor {
+		// All peers come from the local proxy
+		return false
+	}
+	ip := net.ParseIP(peerHost(addr))
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() {
+		return true
+	}
+	for _, n := range lanNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// lanSources returns the local peers we can download from, or nil when p
+// is itself local: remote peers only get the pieces these don't have.
+func (t *TorrentSession) lanSources(p *peerState) (sources []*peerState) {
+	if p.lan {
+		return nil
+	}
+	for _, other := range t.peers.All() {
+		if other.lan && !other.peer_choking && other.have != nil {
+			sources = append(sources, other)
+		}
+	}
+	return
+}
+
+// lanHas tells whether one of sources has piece.
+func lanHas(sources []*peerState, piece int) bool {
+	for _, p := range sources {
+		if p.have.IsSet(piece) {
+			return true
+		}
+	}
+	return false
+}
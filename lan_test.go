@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/rakoo/rakoshare/pkg/bitset"
+)
+
+func TestIsLANAddress(t *testing.T) {
+	for addr, expected := range map[string]bool{
+		"10.1.2.3:6881":      true,
+		"172.16.0.1:6881":    true,
+		"172.32.0.1:6881":    false,
+		"192.168.1.10:6881":  true,
+		"169.254.3.4:6881":   true,
+		"127.0.0.1:6881":     true,
+		"[fe80::1]:6881":     true,
+		"[fd00::1]:6881":     true,
+		"[2001:db8::1]:6881": false,
+		"8.8.8.8:6881":       false,
+		"not an address":     false,
+		"example.com:6881":   false,
+	} {
+		if isLANAddress(addr) != expected {
+			t.Errorf("%s: expected %v", addr, expected)
+		}
+	}
+}
+
+func TestChoosePieceLeavesLANPieces(t *testing.T) {
+	const pieces = 4
+	ts := &TorrentSession{
+		pieceSet:     bitset.New(pieces),
+		activePieces: make(map[int]*ActivePiece),
+		totalPieces:  pieces,
+		peers:        newPeers(),
+	}
+
+	local := &peerState{lan: true, have: bitset.New(pieces)}
+	remote := &peerState{have: bitset.New(pieces)}
+	for i := 0; i < pieces; i++ {
+		remote.have.Set(i)
+		if i != 2 {
+			local.have.Set(i)
+		}
+	}
+	ts.peers.peerList = []*peerState{local, remote}
+
+	// A choking local peer doesn't count
+	local.peer_choking = true
+	if lan := ts.lanSources(remote); len(lan) != 0 {
+		t.Errorf("Expected no local source, got %d", len(lan))
+	}
+
+	local.peer_choking = false
+	lan := ts.lanSources(remote)
+	for i := 0; i < 10; i++ {
+		if piece := ts.ChoosePiece(remote, lan); piece != 2 {
+			t.Fatalf("Expected the remote peer to get the piece the local one lacks, got %d", piece)
+		}
+	}
+	if ts.lanSources(local) != nil {
+		t.Error("Expected local peers to get any piece")
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"strconv"
+)
+
+// Limits on what peers send us, so that a single peer can't make us
+// allocate much more than it sent, or recurse without end.
+
+var maxExtensionMessage = flag.Int("maxExtensionMessage", 64*1024, "Maximum size of an extension message from a peer; peers sending bigger ones are disconnected")
+
+const (
+	maxBencodeDepth = 16
+	maxBencodeItems = 1 << 14
+
+	// Torrents of big shares have big info dicts, but not that big
+	maxMetadataSize = 16 << 20
+)
+
+var (
+	errMessageTooLarge = errors.New("extension message too large")
+	errBencodeTooDeep  = errors.New("bencode nested too deep")
+	errBencodeTooLarge = errors.New("too many bencode values")
+	errInvalidBencode  = errors.New("invalid bencode")
+	errEmptyExtension  = errors.New("empty extension message")
+)
+
+// checkBencode makes sure b starts with a bencoded value that respects
+// our limits, and returns its length. Anything after it is left alone:
+// ut_metadata appends raw data to its messages.
+//
+// Lengths are checked against what was actually received, so decoders
+// never allocate according to a length the peer made up.
+func checkBencode(b []byte) (n int, err error) {
+	items := 0
+	var check func(pos, depth int) (int, error)
+	check = func(pos, depth int) (int, error) {
+		if depth > maxBencodeDepth {
+			return 0, errBencodeTooDeep
+		}
+		items++
+		if items > maxBencodeItems {
+			return 0, errBencodeTooLarge
+		}
+		if pos >= len(b) {
+			return 0, errInvalidBencode
+		}
+
+		switch c := b[pos]; {
+		case c == 'i':
+			end := bytes.IndexByte(b[pos:], 'e')
+			if end < 2 || end > 21 {
+				return 0, errInvalidBencode
+			}
+			return pos + end + 1, nil
+		case c == 'l' || c == 'd':
+			pos++
+			for {
+				if pos >= len(b) {
+					return 0, errInvalidBencode
+				}
+				if b[pos] == 'e' {
+					return pos + 1, nil
+				}
+				var err error
+				pos, err = check(pos, depth+1)
+				if err != nil {
+					return 0, err
+				}
+			}
+		case c >= '0' && c <= '9':
+			colon := bytes.IndexByte(b[pos:], ':')
+			if colon < 1 || colon > 10 {
+				return 0, errInvalidBencode
+			}
+			length, err := strconv.Atoi(string(b[pos : pos+colon]))
+			if err != nil {
+				return 0, errInvalidBencode
+			}
+			start := pos + colon + 1
+			if length > len(b)-start {
+				return 0, errInvalidBencode
+			}
+			return start + length, nil
+		default:
+			return 0, errInvalidBencode
+		}
+	}
+	return check(0, 0)
+}
+
+// checkExtensionMessage makes sure msg, an extension message without its
+// EXTENSION id, respects our limits. Its payload is checked as bencode
+// unless bencoded is false.
+func checkExtensionMessage(msg []byte, bencoded bool) error {
+	if len(msg) > *maxExtensionMessage {
+		return errMessageTooLarge
+	}
+	if len(msg) < 1 {
+		return errEmptyExtension
+	}
+	if !bencoded {
+		return nil
+	}
+	_, err := checkBencode(msg[1:])
+	return err
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckBencode(t *testing.T) {
+	valid := map[string]int{
+		"i42e":                             4,
+		"i-1e":                             4,
+		"4:spam":                           6,
+		"0:":                               2,
+		"le":                               2,
+		"d1:md11:ut_metadatai1eee":         24,
+		"d8:msg_typei1e5:piecei0eeRAWDATA": 25,
+	}
+	for b, expected := range valid {
+		n, err := checkBencode([]byte(b))
+		if err != nil || n != expected {
+			t.Errorf("%q: expected %d, got %d, %v", b, expected, n, err)
+		}
+	}
+
+	invalid := map[string]error{
+		"":                               errInvalidBencode,
+		"x":                              errInvalidBencode,
+		"ie":                             errInvalidBencode,
+		"i42":                            errInvalidBencode,
+		"l":                              errInvalidBencode,
+		"5:spam":                         errInvalidBencode,
+		"999999999999:ab":                errInvalidBencode,
+		nestedLists(maxBencodeDepth + 2): errBencodeTooDeep,
+		"l" + strings.Repeat("0:", maxBencodeItems) + "e": errBencodeTooLarge,
+	}
+	for b, expected := range invalid {
+		if _, err := checkBencode([]byte(b)); err != expected {
+			t.Errorf("%.20q: expected %v, got %v", b, expected, err)
+		}
+	}
+
+	if _, err := checkBencode([]byte(nestedLists(maxBencodeDepth + 1))); err != nil {
+		t.Errorf("Expected %d nested lists to be accepted, got %v", maxBencodeDepth+1, err)
+	}
+}
+
+func nestedLists(n int) string {
+	return strings.Repeat("l", n) + strings.Repeat("e", n)
+}
+
+func TestCheckExtensionMessage(t *testing.T) {
+	big := make([]byte, *maxExtensionMessage+1)
+	if err := checkExtensionMessage(big, false); err != errMessageTooLarge {
+		t.Errorf("Expected %v, got %v", errMessageTooLarge, err)
+	}
+	if err := checkExtensionMessage(nil, false); err != errEmptyExtension {
+		t.Errorf("Expected %v, got %v", errEmptyExtension, err)
+	}
+	// Raw payloads aren't checked as bencode
+	if err := checkExtensionMessage([]byte{3, 1, 0}, false); err != nil {
+		t.Errorf("Expected a raw message to pass, got %v", err)
+	}
+	if err := checkExtensionMessage([]byte{3, 1, 0}, true); err != errInvalidBencode {
+		t.Errorf("Expected %v, got %v", errInvalidBencode, err)
+	}
+}
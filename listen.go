@@ -3,9 +3,11 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"strconv"
+	"time"
 
 	"github.com/dchest/spipe"
 )
@@ -18,6 +20,17 @@ var (
 	useNATPMP = flag.Bool("useNATPMP", false, "Use NAT-PMP to open port in firewall.")
 )
 
+// The first byte of a connection, sent in clear, tells which channel it
+// opens. Each channel has its own key: the control channel only needs the
+// store capability, the data channel needs the read capability. Replicas
+// that can't read the share exchange sealed pieces on the sealed channel,
+// which only needs the store capability.
+const (
+	channelControl byte = 'c'
+	channelData    byte = 'd'
+	channelSealed  byte = 's'
+)
+
 // btConn wraps an incoming network connection and contains metadata that helps
 // identify which active torrentSession it's relevant for.
 type btConn struct {
@@ -25,12 +38,19 @@ type btConn struct {
 	header   []byte
 	infohash string
 	id       string
+	channel  byte
+
+	// Whether we dialed it, and whether it is an additional connection to
+	// a device we are already connected to
+	outbound bool
+	stripe   bool
 }
 
 // listenForPeerConnections listens on a TCP port for incoming connections and
 // demuxes them to the appropriate active torrentSession based on the InfoHash
-// in the header.
-func listenForPeerConnections(key []byte) (conChan chan *btConn, listenPort int, err error) {
+// in the header. Connections are only accepted on the channels we have a key
+// for.
+func listenForPeerConnections(keys map[byte][]byte) (conChan chan *btConn, listenPort int, err error) {
 	listener, err := createListener()
 	if err != nil {
 		return
@@ -55,20 +75,39 @@ func listenForPeerConnections(key []byte) (conChan chan *btConn, listenPort int,
 			}
 
 			go func() {
+				// Dead or slow peers don't get to hold a goroutine forever
+				tcpConn.SetDeadline(time.Now().Add(*handshakeTimeout))
+
+				var channel [1]byte
+				_, err := io.ReadFull(tcpConn, channel[:])
+				if err != nil {
+					tcpConn.Close()
+					return
+				}
+				key, ok := keys[channel[0]]
+				if !ok {
+					tcpConn.Close()
+					return
+				}
+
 				conn := spipe.Server(key, tcpConn)
 				bconn := newBufferedSpipeConn(conn)
 				header, err := readHeader(bconn)
 				if err != nil {
 					//log.Println("Error reading header: ", err)
+					handshakeFailed(true)
 					bconn.Close()
 					return
 				}
+				handshakeDone(tcpConn)
+
 				peersInfoHash := string(header[8:28])
 				id := string(header[28:48])
 				conChan <- &btConn{
 					header:   header,
 					infohash: peersInfoHash,
 					id:       id,
+					channel:  channel[0],
 					conn:     bconn,
 				}
 			}()
@@ -78,6 +117,22 @@ func listenForPeerConnections(key []byte) (conChan chan *btConn, listenPort int,
 }
 
 func createListener() (listener net.Listener, err error) {
+	if *useI2P {
+		// Peers only reach us through our destination
+		if i2pSession == nil {
+			return nil, errNoI2PSession
+		}
+		log.Println("Listening for peers from I2P")
+		return i2pSession, nil
+	}
+	if *useTor {
+		// Peers only reach us through the onion service
+		listener, err = net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: *port})
+		if err == nil {
+			log.Println("Listening for peers from Tor on port:", listener.Addr().(*net.TCPAddr).Port)
+		}
+		return
+	}
 	nat, err := createPortMapping()
 	if err != nil {
 		err = fmt.Errorf("Unable to create NAT: %v", err)
@@ -98,7 +153,7 @@ func createListener() (listener net.Listener, err error) {
 	}
 	listener, err = net.ListenTCP("tcp", &net.TCPAddr{Port: listenPort})
 	if err != nil {
-		log.Fatal("Listen failed:", err)
+		return nil, err
 	}
 	log.Println("Listening for peers on port:", listenPort)
 	return
@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
@@ -12,6 +13,7 @@ import (
 	"path/filepath"
 	"runtime/pprof"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/rakoo/rakoshare/pkg/id"
@@ -31,6 +33,10 @@ var torrent string
 
 func main() {
 	flag.Parse()
+	setupTor()
+	if *useTor && *useI2P {
+		log.Fatal("-tor and -i2p can't be used together")
+	}
 
 	if *cpuprofile != "" {
 		cpuf, err := os.Create(*cpuprofile)
@@ -51,6 +57,9 @@ func main() {
 		}(*memprofile)
 	}
 
+	startHTTP()
+	startBlocklist()
+
 	// Working directory, where all transient stuff happens
 	u, err := user.Current()
 	if err != nil {
@@ -61,79 +70,897 @@ func main() {
 
 	app := cli.NewApp()
 	app.Name = "rakoshare"
-	app.Usage = "Share content with everyone"
+	app.Usage = T(msgUsageApp)
 	app.Commands = []cli.Command{
 		{
-			Name:  "gen",
-			Usage: "Generate a share with a given target directory. Outputs the 3-tuple of id",
+			Name:  "gen",
+			Usage: T(msgUsageGen),
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "dir",
+					Value: "",
+					Usage: T(msgFlagGenDir),
+				},
+				cli.StringSliceFlag{
+					Name:  "tracker",
+					Value: &cli.StringSlice{},
+					Usage: T(msgFlagGenTracker),
+				},
+				cli.StringFlag{
+					Name:  "profile",
+					Value: "",
+					Usage: T(msgFlagGenProfile),
+				},
+				cli.StringFlag{
+					Name:  "expires",
+					Value: "",
+					Usage: T(msgFlagGenExpires),
+				},
+				cli.IntFlag{
+					Name:  "maxDownloads",
+					Value: 0,
+					Usage: T(msgFlagGenMaxDownloads),
+				},
+			},
+			Action: func(c *cli.Context) {
+				if c.String("dir") == "" {
+					fmt.Println(newUserError(msgNeedDir))
+					return
+				}
+				cfg := ShareConfig{
+					Profile:      c.String("profile"),
+					MaxDownloads: c.Int("maxDownloads"),
+				}
+				if s := c.String("expires"); s != "" {
+					expires, err := parseExpiry(s, time.Now())
+					if err != nil {
+						fmt.Println(err)
+						return
+					}
+					cfg.Expires = expires
+				}
+				err := Generate(c.String("dir"), workDir, c.StringSlice("tracker"), cfg)
+				if err != nil {
+					fmt.Println(err)
+				}
+			},
+		},
+		{
+			Name:  "share",
+			Usage: T(msgUsageShare),
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "id",
+					Value: "",
+					Usage: T(msgFlagShareID),
+				},
+				cli.StringFlag{
+					Name:  "dir",
+					Value: "",
+					Usage: T(msgFlagShareDir),
+				},
+				cli.StringSliceFlag{
+					Name:  "tracker",
+					Value: &cli.StringSlice{},
+					Usage: T(msgFlagTracker),
+				},
+				cli.BoolTFlag{
+					Name:  "useLPD",
+					Usage: T(msgFlagUseLPD),
+				},
+				cli.StringSliceFlag{
+					Name:  "peer",
+					Value: &cli.StringSlice{},
+					Usage: T(msgFlagPeer),
+				},
+				cli.IntFlag{
+					Name:  "serveTracker",
+					Value: 0,
+					Usage: T(msgFlagServeTracker),
+				},
+				cli.StringFlag{
+					Name:  "profile",
+					Value: "",
+					Usage: T(msgFlagShareProfile),
+				},
+			},
+			Action: func(c *cli.Context) {
+				if c.String("id") == "" {
+					fmt.Println(newUserError(msgNeedID))
+					return
+				}
+				err := Share(c.String("id"), workDir, c.String("dir"),
+					c.StringSlice("tracker"), c.Bool("useLPD"),
+					c.StringSlice("peer"), c.Int("serveTracker"), c.String("profile"), "")
+				if err != nil {
+					fmt.Println(err)
+					os.Exit(1)
+				}
+			},
+		},
+		{
+			Name:  "relay",
+			Usage: T(msgUsageRelay),
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "id",
+					Value: "",
+					Usage: T(msgFlagRelayID),
+				},
+				cli.StringSliceFlag{
+					Name:  "tracker",
+					Value: &cli.StringSlice{},
+					Usage: T(msgFlagTracker),
+				},
+				cli.BoolTFlag{
+					Name:  "useLPD",
+					Usage: T(msgFlagUseLPD),
+				},
+				cli.StringSliceFlag{
+					Name:  "peer",
+					Value: &cli.StringSlice{},
+					Usage: T(msgFlagPeer),
+				},
+				cli.IntFlag{
+					Name:  "serveTracker",
+					Value: 0,
+					Usage: T(msgFlagServeTracker),
+				},
+				cli.BoolFlag{
+					Name:  "memory",
+					Usage: T(msgFlagRelayMemory),
+				},
+			},
+			Action: func(c *cli.Context) {
+				if c.String("id") == "" {
+					fmt.Println(newUserError(msgNeedID))
+					return
+				}
+				err := Relay(c.String("id"), workDir, c.StringSlice("tracker"), c.Bool("useLPD"),
+					c.StringSlice("peer"), c.Int("serveTracker"), c.Bool("memory"))
+				if err != nil {
+					fmt.Println(err)
+					os.Exit(1)
+				}
+			},
+		},
+		{
+			Name:  "confirm",
+			Usage: T(msgUsageConfirm),
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "id",
+					Value: "",
+					Usage: T(msgFlagID),
+				},
+			},
+			Action: func(c *cli.Context) {
+				if c.String("id") == "" {
+					fmt.Println(newUserError(msgNeedID))
+					return
+				}
+				err := Confirm(c.String("id"), workDir)
+				if err != nil {
+					fmt.Println(err)
+				}
+			},
+		},
+		{
+			Name:  "trackers",
+			Usage: T(msgUsageTrackers),
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "id",
+					Value: "",
+					Usage: T(msgFlagID),
+				},
+				cli.StringSliceFlag{
+					Name:  "add",
+					Value: &cli.StringSlice{},
+					Usage: T(msgFlagTrackerAdd),
+				},
+				cli.StringSliceFlag{
+					Name:  "remove",
+					Value: &cli.StringSlice{},
+					Usage: T(msgFlagTrackerRemove),
+				},
+			},
+			Action: func(c *cli.Context) {
+				if c.String("id") == "" {
+					fmt.Println(newUserError(msgNeedID))
+					return
+				}
+				err := Trackers(c.String("id"), workDir, c.StringSlice("add"), c.StringSlice("remove"))
+				if err != nil {
+					fmt.Println(err)
+				}
+			},
+		},
+		{
+			Name:  "config",
+			Usage: T(msgUsageConfig),
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "id",
+					Value: "",
+					Usage: T(msgFlagID),
+				},
+				cli.StringFlag{
+					Name:  "profile",
+					Value: "",
+					Usage: T(msgFlagProfile),
+				},
+				cli.StringSliceFlag{
+					Name:  "ignore",
+					Value: &cli.StringSlice{},
+					Usage: T(msgFlagIgnore),
+				},
+				cli.StringFlag{
+					Name:  "scanInterval",
+					Value: "",
+					Usage: T(msgFlagScanInterval),
+				},
+				cli.BoolFlag{
+					Name:  "noWatch",
+					Usage: T(msgFlagNoWatch),
+				},
+				cli.IntFlag{
+					Name:  "uploadRate",
+					Value: 0,
+					Usage: T(msgFlagUploadRate),
+				},
+				cli.IntFlag{
+					Name:  "downloadRate",
+					Value: 0,
+					Usage: T(msgFlagDownloadRate),
+				},
+				cli.StringFlag{
+					Name:  "expires",
+					Value: "",
+					Usage: T(msgFlagExpires),
+				},
+				cli.IntFlag{
+					Name:  "maxDownloads",
+					Value: 0,
+					Usage: T(msgFlagMaxDownloads),
+				},
+				cli.StringSliceFlag{
+					Name:  "trust",
+					Value: &cli.StringSlice{},
+					Usage: T(msgFlagTrust),
+				},
+				cli.BoolFlag{
+					Name:  "trustedOnly",
+					Usage: T(msgFlagTrustedOnly),
+				},
+				cli.IntFlag{
+					Name:  "targetPeers",
+					Value: 0,
+					Usage: T(msgFlagTargetPeers, TARGET_NUM_PEERS),
+				},
+				cli.IntFlag{
+					Name:  "maxPeers",
+					Value: 0,
+					Usage: T(msgFlagMaxPeers, MAX_NUM_PEERS),
+				},
+				cli.StringSliceFlag{
+					Name:  "mirror",
+					Value: &cli.StringSlice{},
+					Usage: T(msgFlagMirror),
+				},
+				cli.BoolFlag{
+					Name:  "admin",
+					Usage: T(msgFlagAdmin),
+				},
+				cli.StringFlag{
+					Name:  "storage",
+					Value: "",
+					Usage: T(msgFlagStorage),
+				},
+				cli.StringFlag{
+					Name:  "storageURL",
+					Value: "",
+					Usage: T(msgFlagStorageURL),
+				},
+				cli.StringFlag{
+					Name:  "allocation",
+					Value: "",
+					Usage: T(msgFlagAllocation),
+				},
+				cli.StringFlag{
+					Name:  "keepVersions",
+					Value: "",
+					Usage: T(msgFlagKeepVersions),
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Value: "",
+					Usage: T(msgFlagFormat),
+				},
+				cli.StringSliceFlag{
+					Name:  "sequential",
+					Value: &cli.StringSlice{},
+					Usage: T(msgFlagSequential),
+				},
+				cli.Float64Flag{
+					Name:  "seedRatio",
+					Value: 0,
+					Usage: T(msgFlagSeedRatio),
+				},
+				cli.Int64Flag{
+					Name:  "seedBytes",
+					Value: 0,
+					Usage: T(msgFlagSeedBytes),
+				},
+				cli.StringFlag{
+					Name:  "seedTime",
+					Value: "",
+					Usage: T(msgFlagSeedTime),
+				},
+				cli.BoolFlag{
+					Name:  "sealed",
+					Usage: T(msgFlagSealed),
+				},
+				cli.StringSliceFlag{
+					Name:  "webhook",
+					Value: &cli.StringSlice{},
+					Usage: T(msgFlagWebhook),
+				},
+				cli.StringSliceFlag{
+					Name:  "webhookEvent",
+					Value: &cli.StringSlice{},
+					Usage: T(msgFlagWebhookEvent, strings.Join(eventKinds, ", ")),
+				},
+				cli.StringSliceFlag{
+					Name:  "unset",
+					Value: &cli.StringSlice{},
+					Usage: T(msgFlagUnsetSetting),
+				},
+				cli.StringSliceFlag{
+					Name:  "removeIgnore",
+					Value: &cli.StringSlice{},
+					Usage: T(msgFlagRemoveIgnore),
+				},
+				cli.StringSliceFlag{
+					Name:  "removeTrust",
+					Value: &cli.StringSlice{},
+					Usage: T(msgFlagRemoveTrust),
+				},
+				cli.StringSliceFlag{
+					Name:  "removeMirror",
+					Value: &cli.StringSlice{},
+					Usage: T(msgFlagRemoveMirror),
+				},
+				cli.StringSliceFlag{
+					Name:  "removeSequential",
+					Value: &cli.StringSlice{},
+					Usage: T(msgFlagRemoveSequential),
+				},
+				cli.StringSliceFlag{
+					Name:  "removeWebhook",
+					Value: &cli.StringSlice{},
+					Usage: T(msgFlagRemoveWebhook),
+				},
+				cli.StringSliceFlag{
+					Name:  "removeWebhookEvent",
+					Value: &cli.StringSlice{},
+					Usage: T(msgFlagRemoveWebhookEvent),
+				},
+			},
+			Action: func(c *cli.Context) {
+				if c.String("id") == "" {
+					fmt.Println(newUserError(msgNeedID))
+					return
+				}
+				changes := ShareConfig{
+					Profile:       c.String("profile"),
+					Ignore:        c.StringSlice("ignore"),
+					NoWatch:       c.Bool("noWatch"),
+					UploadRate:    int64(c.Int("uploadRate")),
+					DownloadRate:  int64(c.Int("downloadRate")),
+					MaxDownloads:  c.Int("maxDownloads"),
+					Trusted:       c.StringSlice("trust"),
+					TrustedOnly:   c.Bool("trustedOnly"),
+					TargetPeers:   c.Int("targetPeers"),
+					MaxPeers:      c.Int("maxPeers"),
+					Mirrors:       c.StringSlice("mirror"),
+					Admin:         c.Bool("admin"),
+					Storage:       c.String("storage"),
+					StorageURL:    c.String("storageURL"),
+					Allocation:    c.String("allocation"),
+					Format:        c.String("format"),
+					Sequential:    c.StringSlice("sequential"),
+					SeedRatio:     c.Float64("seedRatio"),
+					SeedBytes:     c.Int64("seedBytes"),
+					Sealed:        c.Bool("sealed"),
+					Webhooks:      c.StringSlice("webhook"),
+					WebhookEvents: c.StringSlice("webhookEvent"),
+				}
+				if changes.SeedRatio < 0 || changes.SeedBytes < 0 {
+					fmt.Println(newUserError(msgInvalidSeedLimit))
+					return
+				}
+				for _, m := range changes.Mirrors {
+					if !validMirror(m) {
+						fmt.Println(newUserError(msgInvalidMirror, m))
+						return
+					}
+				}
+				for _, hook := range changes.Webhooks {
+					if !validWebhook(hook) {
+						fmt.Println(newUserError(msgInvalidWebhook, hook))
+						return
+					}
+				}
+				for _, kind := range changes.WebhookEvents {
+					if !validEventKind(kind) {
+						fmt.Println(newUserError(msgInvalidEvent, kind, strings.Join(eventKinds, ", ")))
+						return
+					}
+				}
+				if !validStorage(changes.Storage) {
+					fmt.Println(newUserError(msgInvalidStorage, changes.Storage, strings.Join(storageNames(), ", ")))
+					return
+				}
+				if !validAllocation(changes.Allocation) {
+					fmt.Println(newUserError(msgInvalidAllocation, changes.Allocation))
+					return
+				}
+				if !validFormat(changes.Format) {
+					fmt.Println(newUserError(msgInvalidFormat, changes.Format))
+					return
+				}
+				if s := c.String("scanInterval"); s != "" {
+					d, err := time.ParseDuration(s)
+					if err != nil {
+						fmt.Println(newUserError(msgInvalidScan, err))
+						return
+					}
+					changes.ScanInterval = duration(d)
+				}
+				if s := c.String("keepVersions"); s != "" {
+					d, err := time.ParseDuration(s)
+					if err != nil || d == 0 {
+						fmt.Println(newUserError(msgInvalidInterval, s))
+						return
+					}
+					changes.KeepVersions = duration(d)
+				}
+				if s := c.String("seedTime"); s != "" {
+					d, err := time.ParseDuration(s)
+					if err != nil || d <= 0 {
+						fmt.Println(newUserError(msgInvalidInterval, s))
+						return
+					}
+					changes.SeedTime = duration(d)
+				}
+				if s := c.String("expires"); s != "" {
+					expires, err := parseExpiry(s, time.Now())
+					if err != nil {
+						fmt.Println(err)
+						return
+					}
+					changes.Expires = expires
+				}
+				unset := c.StringSlice("unset")
+				for _, name := range unset {
+					if _, ok := settingField(name); !ok {
+						fmt.Println(newUserError(msgUnknownSetting, name, strings.Join(settingNames(), ", ")))
+						return
+					}
+				}
+				// Bool flags given as =false turn their setting off
+				for _, name := range []string{"noWatch", "trustedOnly", "admin", "sealed"} {
+					if c.IsSet(name) && !c.Bool(name) {
+						unset = append(unset, name)
+					}
+				}
+				err := Configure(c.String("id"), workDir, configChange{
+					set:   changes,
+					unset: unset,
+					remove: ShareConfig{
+						Ignore:        c.StringSlice("removeIgnore"),
+						Trusted:       c.StringSlice("removeTrust"),
+						Mirrors:       c.StringSlice("removeMirror"),
+						Sequential:    c.StringSlice("removeSequential"),
+						Webhooks:      c.StringSlice("removeWebhook"),
+						WebhookEvents: c.StringSlice("removeWebhookEvent"),
+					},
+				})
+				if err != nil {
+					fmt.Println(err)
+				}
+			},
+		},
+		{
+			Name:  "profiles",
+			Usage: T(msgUsageProfiles),
+			Action: func(c *cli.Context) {
+				for _, name := range listProfiles(workDir) {
+					fmt.Println(name)
+				}
+			},
+		},
+		{
+			Name:  "list",
+			Usage: T(msgUsageList),
+			Action: func(c *cli.Context) {
+				shares, err := List(workDir)
+				if err != nil {
+					fmt.Println(err)
+					return
+				}
+				for _, s := range shares {
+					fmt.Println(T(msgSharing, s.folder, s.sessionFile))
+					fmt.Printf("\tWriteReadStore:\t%s\n\t     ReadStore:\t%s\n\t         Store:\t%s\n",
+						s.wrs, s.rs, s.s)
+					fmt.Println()
+				}
+			},
+		},
+		{
+			Name:  "preview",
+			Usage: T(msgUsagePreview),
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "id",
+					Value: "",
+					Usage: T(msgFlagID),
+				},
+				cli.StringSliceFlag{
+					Name:  "tracker",
+					Value: &cli.StringSlice{},
+					Usage: T(msgFlagTracker),
+				},
+				cli.StringSliceFlag{
+					Name:  "peer",
+					Value: &cli.StringSlice{},
+					Usage: T(msgFlagPeer),
+				},
+				cli.StringFlag{
+					Name:  "timeout",
+					Value: "1m",
+					Usage: T(msgFlagPreviewTimeout),
+				},
+			},
+			Action: func(c *cli.Context) {
+				if c.String("id") == "" {
+					fmt.Println(newUserError(msgNeedID))
+					return
+				}
+				timeout, err := time.ParseDuration(c.String("timeout"))
+				if err != nil || timeout <= 0 {
+					fmt.Println(newUserError(msgInvalidInterval, c.String("timeout")))
+					return
+				}
+				err = Preview(c.String("id"), workDir, c.StringSlice("tracker"), c.StringSlice("peer"), timeout)
+				if err != nil {
+					fmt.Println(err)
+					os.Exit(1)
+				}
+			},
+		},
+		{
+			Name:  "top",
+			Usage: T(msgUsageTop),
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "interval",
+					Value: "2s",
+					Usage: T(msgFlagTopInterval),
+				},
+				cli.BoolFlag{
+					Name:  "plain",
+					Usage: T(msgFlagTopPlain),
+				},
+			},
+			Action: func(c *cli.Context) {
+				interval, err := time.ParseDuration(c.String("interval"))
+				if err != nil || interval <= 0 {
+					fmt.Println(newUserError(msgInvalidInterval, c.String("interval")))
+					return
+				}
+				err = Top(workDir, interval, c.Bool("plain"))
+				if err != nil {
+					fmt.Println(err)
+				}
+			},
+		},
+		{
+			Name:  "ingest",
+			Usage: T(msgUsageIngest),
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "id",
+					Value: "",
+					Usage: T(msgFlagID),
+				},
+				cli.StringFlag{
+					Name:  "from",
+					Value: "-",
+					Usage: T(msgFlagIngestFrom),
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Value: "",
+					Usage: T(msgFlagIngestFormat),
+				},
+			},
+			Action: func(c *cli.Context) {
+				if c.String("id") == "" {
+					fmt.Println(newUserError(msgNeedID))
+					return
+				}
+				err := Ingest(c.String("id"), workDir, c.String("from"), c.String("format"))
+				if err != nil {
+					fmt.Println(err)
+					os.Exit(1)
+				}
+			},
+		},
+		{
+			Name:  "about",
+			Usage: T(msgUsageAbout),
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "id",
+					Value: "",
+					Usage: T(msgFlagID),
+				},
+				cli.StringSliceFlag{
+					Name:  "set",
+					Value: &cli.StringSlice{},
+					Usage: T(msgFlagAboutSet),
+				},
+				cli.StringSliceFlag{
+					Name:  "unset",
+					Value: &cli.StringSlice{},
+					Usage: T(msgFlagAboutUnset),
+				},
+			},
+			Action: func(c *cli.Context) {
+				if c.String("id") == "" {
+					fmt.Println(newUserError(msgNeedID))
+					return
+				}
+				err := About(c.String("id"), workDir, c.StringSlice("set"), c.StringSlice("unset"))
+				if err != nil {
+					fmt.Println(err)
+				}
+			},
+		},
+		{
+			Name:  "secrets",
+			Usage: T(msgUsageSecrets),
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "store",
+					Value: "keychain",
+					Usage: T(msgFlagSecretsStore),
+				},
+			},
+			Action: func(c *cli.Context) {
+				if err := MoveSecrets(workDir, c.String("store")); err != nil {
+					fmt.Println(err)
+					return
+				}
+				fmt.Println(T(msgSecretsMoved, c.String("store")))
+			},
+		},
+		{
+			Name:  "rotate",
+			Usage: T(msgUsageRotate),
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "id",
+					Value: "",
+					Usage: T(msgFlagRotateID),
+				},
+				cli.BoolFlag{
+					Name:  "read",
+					Usage: T(msgFlagRotateRead),
+				},
+				cli.BoolFlag{
+					Name:  "write",
+					Usage: T(msgFlagRotateWrite),
+				},
+			},
+			Action: func(c *cli.Context) {
+				if c.String("id") == "" {
+					fmt.Println(newUserError(msgNeedID))
+					return
+				}
+				err := Rotate(c.String("id"), workDir, c.Bool("read"), c.Bool("write"))
+				if err != nil {
+					fmt.Println(err)
+				}
+			},
+		},
+		{
+			Name:  "peers",
+			Usage: T(msgUsagePeers),
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "id",
+					Value: "",
+					Usage: T(msgFlagID),
+				},
+			},
+			Action: func(c *cli.Context) {
+				if c.String("id") == "" {
+					fmt.Println(newUserError(msgNeedID))
+					return
+				}
+				err := ListPeers(c.String("id"), workDir)
+				if err != nil {
+					fmt.Println(err)
+				}
+			},
+		},
+		{
+			Name:  "rescan",
+			Usage: T(msgUsageRescan),
 			Flags: []cli.Flag{
 				cli.StringFlag{
-					Name:  "dir",
+					Name:  "id",
 					Value: "",
-					Usage: "The directory to share",
+					Usage: T(msgFlagIDOrArg),
 				},
 			},
 			Action: func(c *cli.Context) {
-				if c.String("dir") == "" {
-					fmt.Println("Need a valid directory!")
-					fmt.Println("Use the -dir flag")
+				id := c.String("id")
+				if id == "" {
+					id = c.Args().First()
+				}
+				if id == "" {
+					fmt.Println(newUserError(msgNeedID))
 					return
 				}
-				err := Generate(c.String("dir"), workDir)
+				err := Rescan(id, workDir)
 				if err != nil {
 					fmt.Println(err)
 				}
 			},
 		},
 		{
-			Name:  "share",
-			Usage: "Share the given id",
+			Name:  "history",
+			Usage: T(msgUsageHistory),
 			Flags: []cli.Flag{
 				cli.StringFlag{
 					Name:  "id",
 					Value: "",
-					Usage: "The id to share",
+					Usage: T(msgFlagID),
+				},
+				cli.BoolFlag{
+					Name:  "audit",
+					Usage: T(msgFlagHistoryAudit),
 				},
+			},
+			Action: func(c *cli.Context) {
+				if c.String("id") == "" {
+					fmt.Println(newUserError(msgNeedID))
+					return
+				}
+				history := History
+				if c.Bool("audit") {
+					history = Audit
+				}
+				err := history(c.String("id"), workDir)
+				if err != nil {
+					fmt.Println(err)
+				}
+			},
+		},
+		{
+			Name:  "rollback",
+			Usage: T(msgUsageRollback),
+			Flags: []cli.Flag{
 				cli.StringFlag{
-					Name:  "dir",
+					Name:  "id",
 					Value: "",
-					Usage: "If not empty, the dir to share",
+					Usage: T(msgFlagID),
 				},
-				cli.StringSliceFlag{
-					Name:  "tracker",
-					Value: &cli.StringSlice{},
-					Usage: "A tracker to connect to",
+				cli.StringFlag{
+					Name:  "to",
+					Value: "",
+					Usage: T(msgFlagRollbackTo),
 				},
-				cli.BoolTFlag{
-					Name:  "useLPD",
-					Usage: "Use Local Peer Discovery",
+				cli.BoolFlag{
+					Name:  "force",
+					Usage: T(msgFlagRollbackForce),
 				},
-				cli.StringSliceFlag{
-					Name:  "peer",
-					Value: &cli.StringSlice{},
-					Usage: "A peer to connect to",
+			},
+			Action: func(c *cli.Context) {
+				if c.String("id") == "" {
+					fmt.Println(newUserError(msgNeedID))
+					return
+				}
+				err := Rollback(c.String("id"), workDir, c.String("to"), c.Bool("force"))
+				if err != nil {
+					fmt.Println(err)
+				}
+			},
+		},
+		{
+			Name:  "export",
+			Usage: T(msgUsageExport),
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "id",
+					Value: "",
+					Usage: T(msgFlagID),
+				},
+				cli.StringFlag{
+					Name:  "torrent",
+					Value: "",
+					Usage: T(msgFlagExportTorrent),
 				},
 			},
 			Action: func(c *cli.Context) {
 				if c.String("id") == "" {
-					fmt.Println("Need an id!")
+					fmt.Println(newUserError(msgNeedID))
 					return
 				}
-				Share(c.String("id"), workDir, c.String("dir"),
-					c.StringSlice("tracker"), c.Bool("useLPD"),
-					c.StringSlice("peer"))
+				err := Export(c.String("id"), workDir, c.String("torrent"))
+				if err != nil {
+					fmt.Println(err)
+				}
 			},
 		},
 		{
-			Name:  "list",
-			Usage: "List availables shares",
+			Name:  "gc",
+			Usage: T(msgUsageGC),
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "id",
+					Value: "",
+					Usage: T(msgFlagID),
+				},
+			},
 			Action: func(c *cli.Context) {
-				shares := List(workDir)
-				for _, s := range shares {
-					fmt.Printf("Sharing %s in %s: \n", s.folder, s.sessionFile)
-					fmt.Printf("\tWriteReadStore:\t%s\n\t     ReadStore:\t%s\n\t         Store:\t%s\n",
-						s.wrs, s.rs, s.s)
-					fmt.Println()
+				if c.String("id") == "" {
+					fmt.Println(newUserError(msgNeedID))
+					return
+				}
+				err := GC(c.String("id"), workDir)
+				if err != nil {
+					fmt.Println(err)
+				}
+			},
+		},
+		{
+			Name:  "admin",
+			Usage: T(msgUsageAdmin),
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "id",
+					Value: "",
+					Usage: T(msgFlagID),
+				},
+				cli.StringFlag{
+					Name:  "peer",
+					Value: "",
+					Usage: T(msgFlagAdminPeer),
+				},
+				cli.StringFlag{
+					Name:  "wait",
+					Value: "5s",
+					Usage: T(msgFlagAdminWait),
+				},
+			},
+			Action: func(c *cli.Context) {
+				if c.String("id") == "" {
+					fmt.Println(newUserError(msgNeedID))
+					return
+				}
+				wait, err := time.ParseDuration(c.String("wait"))
+				if err != nil || wait <= 0 || wait > maxAdminWait {
+					fmt.Println(newUserError(msgInvalidInterval, c.String("wait")))
+					return
+				}
+				err = Admin(c.String("id"), workDir, c.Args().First(), c.String("peer"), wait)
+				if err != nil {
+					fmt.Println(err)
 				}
 			},
 		},
@@ -145,19 +972,27 @@ func main() {
 type share struct {
 	sessionFile string
 	folder      string
+	name        string // From the description of the share
 	wrs         string
 	rs          string
 	s           string
+	session     *sharesession.Session
 }
 
-func List(workDir string) []share {
+func List(workDir string) ([]share, error) {
 	dir, err := os.Open(workDir)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	names, err := dir.Readdirnames(-1)
+	dir.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := openSecretStore(*secretStoreKind, workDir)
 	if err != nil {
-		log.Fatal(err)
+		log.Println("Couldn't open the secret store:", err)
 	}
 
 	shares := make([]share, 0, len(names))
@@ -169,30 +1004,131 @@ func List(workDir string) []share {
 		if err != nil {
 			continue
 		}
-		id := session.GetShareId()
+		id := storedShareId(store, session, strings.TrimSuffix(n, ".sql"))
+		about, _ := storedAbout(session)
 
 		shares = append(shares, share{
 			sessionFile: filepath.Join(workDir, n),
 			folder:      session.GetTarget(),
+			name:        about.About.Fields["name"],
 			wrs:         id.WRS(),
 			rs:          id.RS(),
 			s:           id.S(),
+			session:     session,
 		})
 	}
 
-	return shares
+	return shares, nil
+}
+
+func openSession(workDir string, shareID id.Id) (*sharesession.Session, error) {
+	sessionName := hex.EncodeToString(shareID.Infohash) + ".sql"
+	return sharesession.New(filepath.Join(workDir, sessionName))
 }
 
-func Share(cliId string, workDir string, cliTarget string, trackers []string, useLPD bool, manualPeers []string) {
+func Confirm(cliId string, workDir string) error {
 	shareID, err := id.NewFromString(cliId)
 	if err != nil {
-		fmt.Printf("Couldn't generate shareId: %s\n", err)
-		return
+		return err
 	}
-	sessionName := hex.EncodeToString(shareID.Infohash) + ".sql"
-	session, err := sharesession.New(filepath.Join(workDir, sessionName))
+	session, err := openSession(workDir, shareID)
+	if err != nil {
+		return err
+	}
+
+	_, ih, _, reason, _ := session.GetPendingTorrent()
+	ok, err := session.ConfirmPending()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		fmt.Println(T(msgNoPending))
+		return nil
+	}
+	fmt.Println(T(msgRevisionConfirmed, ih, reason))
+	return nil
+}
+
+func Trackers(cliId string, workDir string, add, remove []string) error {
+	shareID, err := id.NewFromString(cliId)
+	if err != nil {
+		return err
+	}
+	session, err := openSession(workDir, shareID)
+	if err != nil {
+		return err
+	}
+
+	err = session.AddTrackers(add)
+	if err != nil {
+		return err
+	}
+	err = session.RemoveTrackers(remove)
+	if err != nil {
+		return err
+	}
+
+	for _, t := range session.GetTrackers() {
+		fmt.Println(t)
+	}
+	return nil
+}
+
+// Configure applies changes to the settings of a share, then prints the
+// resulting settings. The non-zero settings of changes.set are applied and
+// their list entries added to the existing ones; the settings named in
+// changes.unset are reset and the entries of changes.remove removed.
+func Configure(cliId string, workDir string, changes configChange) error {
+	shareID, err := id.NewFromString(cliId)
+	if err != nil {
+		return err
+	}
+	session, err := openSession(workDir, shareID)
+	if err != nil {
+		return err
+	}
+
+	if changes.set.Profile != "" {
+		if _, err := loadProfile(workDir, changes.set.Profile); err != nil {
+			return err
+		}
+	}
+	cfg, err := getShareConfig(session)
+	if err != nil {
+		return err
+	}
+	err = saveShareConfig(session, cfg.apply(changes))
+	if err != nil {
+		return err
+	}
+
+	effective, err := loadShareConfig(session, workDir)
+	if err != nil {
+		return err
+	}
+	out, err := json.MarshalIndent(effective, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+// Share runs a share until the user interrupts it. Errors are only
+// returned when the share can't start at all; once started, failures are
+// logged and the share keeps going. If storage isn't empty, it replaces
+// the storage of the settings for this run.
+func Share(cliId string, workDir string, cliTarget string, trackers []string, useLPD bool, manualPeers []string, serveTracker int, profile string, storage string) error {
+	shareID, err := id.NewFromString(cliId)
 	if err != nil {
-		log.Fatal("Couldn't open session file: ", err)
+		return newUserError(msgBadID, err)
+	}
+	if err := checkChecksumFlags(); err != nil {
+		return err
+	}
+	session, err := openSession(workDir, shareID)
+	if err != nil {
+		return newUserError(msgOpenSession, err)
 	}
 
 	fmt.Printf("WriteReadStore:\t%s\n     ReadStore:\t%s\n         Store:\t%s\n",
@@ -201,46 +1137,148 @@ func Share(cliId string, workDir string, cliTarget string, trackers []string, us
 	target := session.GetTarget()
 	if target == "" {
 		if cliTarget == "" {
-			fmt.Println("Need a folder to share!")
-			return
+			return newUserError(msgNeedFolder)
 		}
 		target = cliTarget
 		session.SaveSession(target, shareID)
+		if err = protectSecrets(workDir, session, shareID); err != nil {
+			log.Println("Couldn't move the ids of the share to the secret store:", err)
+		}
 	} else if cliTarget != "" {
-		fmt.Printf("Can't override folder already set to %s\n", target)
+		fmt.Println(T(msgFolderAlreadySet, target))
+	}
+
+	// Trackers given on the command line are added to those of the share
+	err = session.AddTrackers(trackers)
+	if err != nil {
+		log.Println("Couldn't save trackers: ", err)
+	}
+	trackers = session.GetTrackers()
+
+	if profile != "" {
+		if _, err := loadProfile(workDir, profile); err != nil {
+			return err
+		}
+		cfg, err := getShareConfig(session)
+		if err != nil {
+			return err
+		}
+		cfg.Profile = profile
+		err = saveShareConfig(session, cfg)
+		if err != nil {
+			return err
+		}
+	}
+	cfg, err := loadShareConfig(session, workDir)
+	if err != nil {
+		return newUserError(msgLoadSettings, err)
+	}
+	if storage != "" {
+		// For this run only
+		cfg.Storage = storage
+	}
+	limits := newTransferLimits(cfg)
+	trusted := newTrustedPeers(cfg)
+	swarm := cfg.swarmSize()
+	store := cfg.storeOptions()
+
+	// Expiry
+	downloads, err := session.CountDownloads()
+	if err != nil {
+		log.Println("Couldn't count downloads: ", err)
+	}
+	if expired, why := cfg.expired(downloads, time.Now()); expired {
+		return why
+	}
+	var expiry <-chan time.Time
+	if deadline, ok := cfg.deadline(); ok {
+		expiryTimer := time.NewTimer(deadline.Sub(time.Now()))
+		defer expiryTimer.Stop()
+		expiry = expiryTimer.C
 	}
 	_, err = os.Stat(target)
 	if err != nil {
 		if os.IsNotExist(err) {
 			os.MkdirAll(target, 0744)
 		} else {
-			fmt.Printf("%s is an invalid dir: %s\n", target, err)
-			os.Exit(1)
+			return newUserError(msgInvalidDir, target, err)
 		}
 	}
 
-	// Watcher
+	// Watcher. With the s3 storage, the files aren't in the folder:
+	// scanning it would publish an empty revision.
 	watcher := &Watcher{
 		PingNewTorrent: make(chan string),
 	}
-	if shareID.CanWrite() {
-		watcher, err = NewWatcher(session, filepath.Clean(target))
+	if shareID.CanWrite() && cfg.Storage != storageS3 {
+		watcher, err = NewWatcher(session, filepath.Clean(target), cfg)
 		if err != nil {
-			log.Fatal("Couldn't start watcher: ", err)
+			return newUserError(msgStartWatcher, err)
 		}
 	} else {
 		watcher.PingNewTorrent = make(chan string, 1)
 		watcher.PingNewTorrent <- session.GetCurrentInfohash()
 	}
 
+	// While paused, the share keeps following revisions but doesn't
+	// transfer any data. Shares we can't read are always paused.
+	paused := false
+
 	// External listener
-	conChan, listenPort, err := listenForPeerConnections([]byte(shareID.Psk[:]))
+	keys := map[byte][]byte{channelControl: shareID.Psk[:]}
+	if dataKey, err := shareID.DataKey(); err == nil {
+		keys[channelData] = dataKey[:]
+	} else {
+		log.Println("This share can't be read, only revisions will be followed")
+		paused = true
+	}
+	if shareID.CanRead() || cfg.Sealed {
+		sealedKey := shareID.SealedKey()
+		keys[channelSealed] = sealedKey[:]
+	}
+	if *useI2P {
+		i2pSession, err = startI2P(workDir, *port)
+		if err != nil {
+			return newUserError(msgI2PSession, err)
+		}
+		defer i2pSession.Close()
+		log.Printf("Reachable at %s:%d\n", ourI2P, *port)
+		// Announces and trackers are outside of I2P
+		useLPD = false
+		trackers = nil
+	}
+	conChan, listenPort, err := listenForPeerConnections(keys)
 	if err != nil {
-		log.Fatal("Couldn't listen for peers connection: ", err)
+		return newUserError(msgListenPeers, err)
+	}
+	if *useTor {
+		onion, err := publishOnion(workDir, listenPort)
+		if err != nil {
+			return newUserError(msgTorOnion, err)
+		}
+		defer onion.Close()
+		// Without DHT or LPD, other devices that only use Tor need this
+		// address, given with -peer, unless they share a tracker
+		log.Printf("Reachable at %s:%d\n", ourOnion, listenPort)
+		// Local announces would tell the network who we are
+		useLPD = false
+	}
+
+	// Embedded tracker
+	if serveTracker != 0 {
+		trackerServer, err := NewTrackerServer(serveTracker)
+		if err != nil {
+			return newUserError(msgStartTracker, err)
+		}
+		trackerServer.AddSelf(string(shareID.Infohash), listenPort)
+		log.Println("Serving tracker on port", serveTracker)
 	}
 
 	var currentSession TorrentSessionI = EmptyTorrent{}
 
+	// Local versions of files kept aside when a revision replaced them
+	var conflicts []string
+
 	// quitChan
 	quitChan := listenSigInt()
 
@@ -249,19 +1287,76 @@ func Share(cliId string, workDir string, cliTarget string, trackers []string, us
 	if useLPD {
 		lpd, err = NewAnnouncer(listenPort)
 		if err != nil {
-			log.Fatal("Couldn't listen for Local Peer Discoveries: ", err)
+			return newUserError(msgListenLPD, err)
 		}
 	}
 
 	// Control session
-	controlSession, err := NewControlSession(shareID, listenPort, session, trackers)
+	controlSession, err := NewControlSession(shareID, listenPort, session, trackers, trusted, swarm)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	controlSession.auditPath = auditLogPath(workDir, shareID)
+	controlSession.setIDLoader(func() id.Id {
+		store, err := openSecretStore(*secretStoreKind, workDir)
+		if err != nil {
+			return session.GetShareId()
+		}
+		return storedShareId(store, session, hex.EncodeToString(shareID.Infohash))
+	})
+	events := newEventNotifier(hex.EncodeToString(shareID.Infohash), target, cfg)
+	defer events.stop()
+	controlSession.events = events
+	// Torrent sessions check info dicts against the writers the control
+	// session follows, and readers seal pieces for replicas
+	sealKey, sealErr := shareID.SealKey()
+	transfers := loadTransferTotals(session)
+	synced := &syncedState{session}
+	newTorrentSession := func(torrent string) (*TorrentSession, error) {
+		// Rotations may have changed our keys
+		ts, err := NewTorrentSession(controlSession.CurrentID(), target, torrent, listenPort, limits, trusted, swarm, store, synced)
+		if ts != nil {
+			ts.writerKey = controlSession.WriterKey
+			ts.transfers = transfers
+			ts.events = events
+			if sealErr == nil {
+				ts.sealKey = &sealKey
+				if s, ok := controlSession.sealedFor(ts.m.InfoHash); ok {
+					ts.setSealed(s)
+				}
+			}
+		}
+		return ts, err
+	}
+	// Replicas that can't read the share keep the sealed torrent of the
+	// current revision instead, once the writers published it
+	startSealed := func() {
+		s, ok := controlSession.sealedFor(controlSession.currentIH)
+		if shareID.CanRead() || !cfg.Sealed || !ok {
+			return
+		}
+		currentSession.Quit()
+		controlSession.AddTransferred(currentSession.Transferred())
+		currentSession = EmptyTorrent{}
+		log.Printf("Keeping sealed revision %x\n", s.sealedInfoHash())
+		ts, err := NewTorrentSession(shareID, target, s.torrent(), listenPort, limits, trusted, swarm, store, nil)
+		if err != nil {
+			log.Println("Couldn't start sealed torrent session: ", err)
+			return
+		}
+		ts.sealedOnly = true
+		ts.transfers = transfers
+		ts.events = events
+		currentSession = ts
+		go currentSession.DoTorrent()
+		for _, peer := range controlSession.peers.All() {
+			currentSession.hintNewPeer(peer.address)
+		}
 	}
 	if useLPD {
 		lpd.Announce(string(shareID.Infohash))
 	}
-	for _, peer := range manualPeers {
+	for _, peer := range append(manualPeers, trusted.dialable()...) {
 		controlSession.backoffHintNewPeer(peer)
 	}
 
@@ -271,23 +1366,138 @@ func Share(cliId string, workDir string, cliTarget string, trackers []string, us
 		controlSession.backoffHintNewPeer(p)
 	}
 
+	// Local API, for the top command
+	api, err := newShareAPI(session, controlSession.RemoteCommand)
+	if err != nil {
+		return err
+	}
+	defer session.SetSetting(settingAPI, "")
+	defer shareStatuses.register(hex.EncodeToString(shareID.Infohash), api.Status)()
+	// Torrent sessions, all started from now on, report their check there
+	store.verifying = &api.verifying
+	statusTicker := time.NewTicker(statusInterval)
+	defer statusTicker.Stop()
+	redialTicker := time.NewTicker(sealedRedialInterval)
+	defer redialTicker.Stop()
+	transfersTicker := time.NewTicker(transfersSaveInterval)
+	defer transfersTicker.Stop()
+	saveTransfers := func() {
+		if err := transfers.save(session); err != nil {
+			log.Println("Couldn't save transfer statistics: ", err)
+		}
+	}
+
+	updateStatus := func() {
+		peers, uploaded, downloaded := currentSession.Stats()
+		var externalIP string
+		if ip, ok := ourExternalIPs.get(); ok {
+			externalIP = ip.String()
+		}
+		about, _ := storedAbout(session)
+		lifetime, revisions := transfers.stats()
+		api.SetStatus(ShareStatus{
+			Folder:       target,
+			Revision:     fmt.Sprintf("%x", controlSession.currentIH),
+			Paused:       paused,
+			Peers:        peers,
+			ControlPeers: controlSession.peers.Len(),
+			Uploaded:     atomic.LoadInt64(&controlSession.uploaded) + uploaded,
+			Downloaded:   atomic.LoadInt64(&controlSession.downloaded) + downloaded,
+			ExternalIP:   externalIP,
+			Lifetime:     lifetime,
+			Revisions:    revisions,
+			About:        about.About.Fields,
+			Conflicts:    conflicts,
+		})
+		api.SetPeers(append(controlSession.PeerStats(), currentSession.PeerStats()...))
+	}
+
 	log.Println("Starting.")
 
+	quit := func() {
+		err := currentSession.Quit()
+		saveTransfers()
+		if err == nil {
+			controlSession.AddTransferred(currentSession.Transferred())
+			err = controlSession.Quit()
+		}
+		if err != nil {
+			log.Println("Failed: ", err)
+		} else {
+			log.Println("Done")
+		}
+	}
+
+	// runCommand pauses or resumes the transfers of the share
+	runCommand := func(command string) {
+		switch {
+		case command == apiPause && !paused:
+			log.Println("Pausing transfers")
+			paused = true
+			currentSession.Quit()
+			controlSession.AddTransferred(currentSession.Transferred())
+			currentSession = EmptyTorrent{}
+		case command == apiResume && paused && shareID.CanRead():
+			log.Println("Resuming transfers")
+			paused = false
+			if controlSession.currentIH == "" {
+				break
+			}
+			source := session.GetCurrentTorrent()
+			if session.GetCurrentInfohash() != controlSession.currentIH {
+				source = fmt.Sprintf("magnet:?xt=urn:btih:%x", controlSession.currentIH)
+			}
+			tentativeSession, err := newTorrentSession(source)
+			if err != nil {
+				log.Println("Couldn't resume torrent session: ", err)
+				break
+			}
+			tentativeSession.reusePieces(currentMetaInfo(session))
+			currentSession = tentativeSession
+			go currentSession.DoTorrent()
+			for _, peer := range controlSession.peers.All() {
+				currentSession.hintNewPeer(peer.address)
+			}
+		case command == apiRescan:
+			watcher.Rescan()
+		}
+		updateStatus()
+	}
+
 mainLoop:
 	for {
 		select {
 		case <-quitChan:
-			err := currentSession.Quit()
+			quit()
+			break mainLoop
+		case <-controlSession.Retired:
+			quit()
+			break mainLoop
+		case <-expiry:
+			_, why := cfg.expired(0, time.Now())
+			raiseAlert("expired", "%s", why)
+			quit()
+			break mainLoop
+		case name := <-currentSession.Conflicts():
+			conflicts = append(conflicts, name)
+			events.notify(eventConflict, controlSession.currentIH, "", "A local change was kept as %s", name)
+			updateStatus()
+		case device := <-currentSession.Completions():
+			downloads, err := session.AddDownload(device)
 			if err != nil {
-				log.Println("Failed: ", err)
-			} else {
-				log.Println("Done")
+				log.Println("Couldn't record download: ", err)
+				break
+			}
+			log.Printf("%s downloaded the share, %d devices so far\n", device, downloads)
+			if expired, why := cfg.expired(downloads, time.Now()); expired {
+				raiseAlert("expired", "%s", why)
+				quit()
+				break mainLoop
 			}
-			break mainLoop
 		case c := <-conChan:
-			if currentSession.Matches(c.infohash) {
+			if (c.channel == channelData || c.channel == channelSealed) && currentSession.Matches(c.infohash) {
 				currentSession.AcceptNewPeer(c)
-			} else if controlSession.Matches(c.infohash) {
+			} else if c.channel == channelControl && controlSession.Matches(c.infohash) {
 				controlSession.AcceptNewPeer(c)
 			}
 		case announce := <-lpd.announces:
@@ -305,13 +1515,20 @@ mainLoop:
 			}
 			err := controlSession.SetCurrent(ih)
 			if err != nil {
-				log.Fatal("Error setting new current infohash:", err)
+				raiseAlert("error", "Couldn't set new current infohash %x: %s", ih, err)
+				break
 			}
 
 			currentSession.Quit()
+			controlSession.AddTransferred(currentSession.Transferred())
+			currentSession = EmptyTorrent{}
+			if paused {
+				startSealed()
+				break
+			}
 
 			torrentFile := session.GetCurrentTorrent()
-			tentativeSession, err := NewTorrentSession(shareID, target, torrentFile, listenPort)
+			tentativeSession, err := newTorrentSession(torrentFile)
 			if err != nil {
 				if !os.IsNotExist(err) {
 					log.Println("Couldn't start new session from watched dir: ", err)
@@ -332,36 +1549,68 @@ mainLoop:
 			if controlSession.currentIH == announce.infohash && !currentSession.IsEmpty() {
 				break
 			}
+			if !controlSession.announced(announce.infohash) {
+				// A newer revision came meanwhile; making one of ours
+				// from this torrent would take the share back
+				log.Printf("Skipping announce of %x, superseded\n", announce.infohash)
+				break
+			}
 			err := controlSession.SetCurrent(announce.infohash)
 			if err != nil {
-				log.Fatal("Error setting new current infohash:", err)
+				raiseAlert("error", "Couldn't set new current infohash %x: %s", announce.infohash, err)
+				break
 			}
 
 			currentSession.Quit()
+			controlSession.AddTransferred(currentSession.Transferred())
+			currentSession = EmptyTorrent{}
+			if paused {
+				startSealed()
+				break
+			}
 
 			log.Println("Opening new torrent session")
 			magnet := fmt.Sprintf("magnet:?xt=urn:btih:%x", announce.infohash)
-			tentativeSession, err := NewTorrentSession(shareID, target, magnet, listenPort)
+			tentativeSession, err := newTorrentSession(magnet)
 			if err != nil {
 				log.Println("Couldn't start new session from announce: ", err)
 				currentSession = EmptyTorrent{}
 				break
 			}
+			tentativeSession.keepLocalChanges(announce.peer, session.GetLastModTime(), synced.files())
+			tentativeSession.reusePieces(currentMetaInfo(session))
 			currentSession = tentativeSession
 			go currentSession.DoTorrent()
 			currentSession.hintNewPeer(announce.peer)
 		case peer := <-controlSession.NewPeers:
+			if paused {
+				// Replicas keeping the sealed torrent still want peers
+				currentSession.hintNewPeer(peer)
+				break
+			}
 			if currentSession.IsEmpty() {
 				magnet := fmt.Sprintf("magnet:?xt=urn:btih:%x", controlSession.currentIH)
-				tentativeSession, err := NewTorrentSession(shareID, target, magnet, listenPort)
+				tentativeSession, err := newTorrentSession(magnet)
 				if err != nil {
 					log.Printf("Couldn't start new session with new peer: %s\n", err)
 					break
 				}
+				tentativeSession.reusePieces(currentMetaInfo(session))
 				currentSession = tentativeSession
 				go currentSession.DoTorrent()
 			}
 			currentSession.hintNewPeer(peer)
+		case s := <-controlSession.Sealed:
+			if s.InfoHash != controlSession.currentIH {
+				break
+			}
+			if shareID.CanRead() {
+				currentSession.setSealed(s)
+			} else {
+				startSealed()
+			}
+		case s := <-currentSession.Sealed():
+			controlSession.AnnounceSealed(s)
 		case meta := <-currentSession.NewMetaInfo():
 			var buf bytes.Buffer
 			err := bencode.NewEncoder(&buf).Encode(meta)
@@ -369,20 +1618,55 @@ mainLoop:
 				log.Println(err)
 				break
 			}
+			if meta.InfoHash != session.GetCurrentInfohash() {
+				recordRevisionDelta(session, currentMetaInfo(session), meta)
+			}
 			session.SaveTorrent(buf.Bytes(), meta.InfoHash, time.Now().Format(time.RFC3339))
+		case command := <-api.commands:
+			runCommand(command)
+		case req := <-controlSession.Admin:
+			if !cfg.Admin {
+				log.Println("Ignoring admin command from", req.peer.address, "as the share isn't configured to obey them")
+				break
+			}
+			log.Println("Admin command from", req.peer.address, ":", req.command)
+			switch req.command {
+			case apiPause, apiResume, apiRescan:
+				runCommand(req.command)
+			}
+			updateStatus()
+			controlSession.ReplyAdmin(req, api.Status())
+		case <-statusTicker.C:
+			updateStatus()
+		case <-transfersTicker.C:
+			saveTransfers()
+		case <-redialTicker.C:
+			if paused {
+				for _, peer := range controlSession.peers.All() {
+					currentSession.hintNewPeer(peer.address)
+				}
+			}
 		}
 	}
+	return nil
 }
 
 type EmptyTorrent struct{}
 
 func (et EmptyTorrent) Quit() error                  { return nil }
+func (et EmptyTorrent) Transferred() (int64, int64)  { return 0, 0 }
+func (et EmptyTorrent) Stats() (int, int64, int64)   { return 0, 0, 0 }
+func (et EmptyTorrent) PeerStats() []PeerStats       { return nil }
 func (et EmptyTorrent) Matches(ih string) bool       { return false }
 func (et EmptyTorrent) AcceptNewPeer(btc *btConn)    {}
 func (et EmptyTorrent) DoTorrent()                   {}
 func (et EmptyTorrent) hintNewPeer(peer string) bool { return true }
 func (et EmptyTorrent) IsEmpty() bool                { return true }
 func (et EmptyTorrent) NewMetaInfo() chan *MetaInfo  { return nil }
+func (et EmptyTorrent) Completions() chan string     { return nil }
+func (et EmptyTorrent) Conflicts() chan string       { return nil }
+func (et EmptyTorrent) Sealed() chan SealedMessage   { return nil }
+func (et EmptyTorrent) setSealed(s SealedMessage)    {}
 
 func listenSigInt() chan os.Signal {
 	c := make(chan os.Signal)
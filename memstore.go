@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"sync"
+)
+
+// Keeps the files in memory only, and loses them when the share stops
+const storageMemory = "memory"
+
+var ramMode = flag.Bool("ram", false, "Keep the files of all shares in memory only, for relay nodes that shouldn't write to disk")
+
+func init() {
+	registerStore(storageMemory, func(info *InfoDict, storePath string, opts storeOptions) (FileStore, int64, error) {
+		size := info.totalSize()
+		return newMemoryStore(size, info.PieceLength), size, nil
+	})
+}
+
+// memoryStore is a FileStore in memory. Pieces are allocated as they are
+// written; the others read as zeros.
+type memoryStore struct {
+	size        int64
+	pieceLength int64
+
+	sync.RWMutex
+	pieces map[int][]byte
+}
+
+func newMemoryStore(size, pieceLength int64) *memoryStore {
+	return &memoryStore{size: size, pieceLength: pieceLength, pieces: make(map[int][]byte)}
+}
+
+func (m *memoryStore) ReadAt(p []byte, off int64) (int, error) {
+	m.RLock()
+	defer m.RUnlock()
+	return spanPieces(m.size, m.pieceLength, p, off, func(piece int, p []byte, begin int64) error {
+		data, ok := m.pieces[piece]
+		if !ok {
+			for i := range p {
+				p[i] = 0
+			}
+			return nil
+		}
+		copy(p, data[begin:])
+		return nil
+	})
+}
+
+func (m *memoryStore) WriteAt(p []byte, off int64) (int, error) {
+	m.Lock()
+	defer m.Unlock()
+	return spanPieces(m.size, m.pieceLength, p, off, func(piece int, p []byte, begin int64) error {
+		data, ok := m.pieces[piece]
+		if !ok {
+			data = make([]byte, pieceSize(m.size, m.pieceLength, piece))
+			m.pieces[piece] = data
+		}
+		copy(data[begin:], p)
+		return nil
+	})
+}
+
+// SetBad and Cleanup have no files to fix.
+func (m *memoryStore) SetBad(off, length int64) {}
+
+func (m *memoryStore) Cleanup() error {
+	return nil
+}
+
+// Close frees the memory of the store.
+func (m *memoryStore) Close() error {
+	m.Lock()
+	defer m.Unlock()
+	m.pieces = make(map[int][]byte)
+	return nil
+}
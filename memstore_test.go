@@ -0,0 +1,46 @@
+package main
+
+import (
+	"crypto/sha1"
+	"testing"
+)
+
+func TestMemoryStore(t *testing.T) {
+	defer func(ram bool) { *ramMode = ram }(*ramMode)
+	*ramMode = true
+	info := &InfoDict{PieceLength: 4, Length: 10}
+	store, size, err := openStore(info, "/nonexistent", storeOptions{storage: storageFiles})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.(*memoryStore); !ok || size != 10 {
+		t.Fatalf("Expected a memory store of 10 bytes in RAM mode, got %T of %d", store, size)
+	}
+
+	// Across pieces, up to the short last one
+	data := []byte("0123456789")
+	if n, err := store.WriteAt(data[3:], 3); err != nil || n != 7 {
+		t.Fatalf("Wrote %d, %v", n, err)
+	}
+	buf := make([]byte, 10)
+	store.ReadAt(buf, 0)
+	if string(buf) != "\x00\x00\x003456789" {
+		t.Errorf("Unexpected content %q", buf)
+	}
+	if _, err := store.WriteAt(data, 1); err != errPastEndOfStore {
+		t.Errorf("Expected an error writing past the end, got %v", err)
+	}
+
+	// The piece pipeline checks pieces in memory like on disk
+	store.WriteAt(data[:3], 0)
+	var pieces []byte
+	for _, piece := range []string{"0123", "4567", "89"} {
+		sum := sha1.Sum([]byte(piece))
+		pieces = append(pieces, sum[:]...)
+	}
+	info.Pieces = string(pieces)
+	good, bad, _, err := checkPieces(store, size, &MetaInfo{Info: info}, nil)
+	if err != nil || good != 3 || bad != 0 {
+		t.Errorf("Expected 3 good pieces, got %d good, %d bad, %v", good, bad, err)
+	}
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/zeebo/bencode"
+)
+
+// BitTorrent v2 metainfo (BEP 52). Each file is hashed on its own, with a
+// SHA-256 merkle tree over blocks of 16 KiB, and starts on a piece
+// boundary, so that no piece spans two files. The info dictionary holds
+// the root of each tree; the hashes of the pieces, the piece layers, are
+// outside of it and are fetched from peers by those who only got the info
+// dictionary.
+const (
+	metaVersion2    = 2
+	merkleBlockSize = 16 << 10
+)
+
+// Metainfo formats of the torrents a writer makes. Hybrid torrents have
+// both the v1 and the v2 metainfo of padded files, for other clients of
+// either version to share them too.
+const (
+	formatV1     = "v1"
+	formatV2     = "v2"
+	formatHybrid = "hybrid"
+)
+
+func validFormat(format string) bool {
+	switch format {
+	case "", formatV1, formatV2, formatHybrid:
+		return true
+	}
+	return false
+}
+
+var zeroHash = make([]byte, sha256.Size)
+
+// v2File is a file of the file tree of a v2 torrent. Only the fields of
+// FileDict that v1 torrents don't need to tell files apart are kept.
+type v2File struct {
+	FileDict
+	Root string // The root of its merkle tree
+}
+
+func (info *InfoDict) isV2() bool {
+	return info.MetaVersion == metaVersion2
+}
+
+// pureV2 tells whether the pieces of info can only be checked with the
+// merkle trees: hybrid torrents have v1 pieces too.
+func (info *InfoDict) pureV2() bool {
+	return info.isV2() && info.Pieces == ""
+}
+
+// v2Files returns the files of the file tree in the order of their
+// pieces, which is the order of the names.
+func (info *InfoDict) v2Files() (files []v2File) {
+	var all []v2File
+	walkFileTree(info.FileTree, nil, &all)
+	for _, f := range all {
+		if !f.isSymlink() {
+			files = append(files, f)
+		}
+	}
+	return
+}
+
+func walkFileTree(tree map[string]interface{}, dir []string, files *[]v2File) {
+	names := make([]string, 0, len(tree))
+	for name := range tree {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		node, ok := tree[name].(map[string]interface{})
+		if !ok || name == "" {
+			continue
+		}
+		path := append(dir[:len(dir):len(dir)], name)
+		if leaf, ok := node[""].(map[string]interface{}); ok {
+			f := v2File{FileDict: FileDict{Path: path}}
+			f.Length, _ = leaf["length"].(int64)
+			f.Root, _ = leaf["pieces root"].(string)
+			f.Checksum, _ = leaf["checksum"].(string)
+			f.Attr, _ = leaf["attr"].(string)
+			if target, ok := leaf["symlink path"].([]interface{}); ok {
+				for _, elem := range target {
+					s, _ := elem.(string)
+					f.SymlinkPath = append(f.SymlinkPath, s)
+				}
+			}
+			f.Mtime, _ = leaf["mtime"].(int64)
+			if mode, ok := leaf["mode"].(int64); ok {
+				f.Mode = uint32(mode)
+			}
+			if xattrs, ok := leaf["xattrs"].(map[string]interface{}); ok {
+				f.Xattrs = make(map[string]string, len(xattrs))
+				for name, value := range xattrs {
+					f.Xattrs[name], _ = value.(string)
+				}
+			}
+			*files = append(*files, f)
+			continue
+		}
+		walkFileTree(node, path, files)
+	}
+}
+
+// fileTreeOf builds the file tree of files.
+func fileTreeOf(files []v2File) map[string]interface{} {
+	tree := make(map[string]interface{})
+	for _, f := range files {
+		node := tree
+		for _, dir := range f.Path[:len(f.Path)-1] {
+			child, ok := node[dir].(map[string]interface{})
+			if !ok {
+				child = make(map[string]interface{})
+				node[dir] = child
+			}
+			node = child
+		}
+		leaf := map[string]interface{}{"length": f.Length}
+		if f.isSymlink() {
+			target := make([]interface{}, len(f.SymlinkPath))
+			for i, elem := range f.SymlinkPath {
+				target[i] = elem
+			}
+			leaf["attr"] = f.Attr
+			leaf["symlink path"] = target
+		} else {
+			leaf["pieces root"] = f.Root
+		}
+		if f.Checksum != "" {
+			leaf["checksum"] = f.Checksum
+		}
+		if f.Mtime != 0 {
+			leaf["mtime"] = f.Mtime
+		}
+		if f.Mode != 0 {
+			leaf["mode"] = int64(f.Mode)
+		}
+		if len(f.Xattrs) > 0 {
+			xattrs := make(map[string]interface{}, len(f.Xattrs))
+			for name, value := range f.Xattrs {
+				xattrs[name] = value
+			}
+			leaf["xattrs"] = xattrs
+		}
+		node[f.Path[len(f.Path)-1]] = map[string]interface{}{"": leaf}
+	}
+	return tree
+}
+
+// isPad tells whether f only pads the previous file to the end of its
+// last piece (BEP 47).
+func (f *FileDict) isPad() bool {
+	return strings.Contains(f.Attr, "p")
+}
+
+func padFile(length int64) *FileDict {
+	return &FileDict{Length: length, Path: []string{".pad", strconv.FormatInt(length, 10)}, Attr: "p"}
+}
+
+// layout returns the files of info in the order of the store, pad files
+// included and symbolic links left out. Files of v2 torrents are padded to
+// start on pieces.
+func (info *InfoDict) layout() []*FileDict {
+	if !info.pureV2() {
+		return withoutSymlinks(info.Files)
+	}
+	v2files := info.v2Files()
+	files := make([]*FileDict, 0, 2*len(v2files))
+	for i := range v2files {
+		f := &v2files[i].FileDict
+		files = append(files, f)
+		if rest := f.Length % info.PieceLength; rest != 0 && i < len(v2files)-1 {
+			files = append(files, padFile(info.PieceLength-rest))
+		}
+	}
+	return files
+}
+
+// fileList returns the files of info, without pad files. Single file
+// torrents have none.
+func (info *InfoDict) fileList() []*FileDict {
+	files := info.layout()
+	for i, f := range files {
+		if !f.isPad() {
+			continue
+		}
+		real := append([]*FileDict(nil), files[:i]...)
+		for _, f := range files[i:] {
+			if !f.isPad() {
+				real = append(real, f)
+			}
+		}
+		return real
+	}
+	return files
+}
+
+// infoHashOf returns the infohash of the bencoded info dictionary raw:
+// its SHA-1, or for v2 torrents its SHA-256 truncated to the same length,
+// as in the handshake. Hybrid torrents go by their v1 infohash, which all
+// clients know.
+func infoHashOf(raw []byte) string {
+	var version struct {
+		MetaVersion int64  `bencode:"meta version"`
+		Pieces      string `bencode:"pieces"`
+	}
+	bencode.NewDecoder(bytes.NewReader(raw)).Decode(&version)
+	if version.MetaVersion == metaVersion2 && version.Pieces == "" {
+		sum := sha256.Sum256(raw)
+		return string(sum[:sha1.Size])
+	}
+	sum := sha1.Sum(raw)
+	return string(sum[:])
+}
+
+func nextPow2(n int) int {
+	p := 1
+	for p < n {
+		p <<= 1
+	}
+	return p
+}
+
+// merkleRoot returns the root of the tree whose bottom layer is hashes,
+// padded with pad to width, a power of two.
+func merkleRoot(hashes [][]byte, width int, pad []byte) []byte {
+	layer := make([][]byte, width)
+	copy(layer, hashes)
+	for i := len(hashes); i < width; i++ {
+		layer[i] = pad
+	}
+	for len(layer) > 1 {
+		next := make([][]byte, len(layer)/2)
+		for i := range next {
+			h := sha256.New()
+			h.Write(layer[2*i])
+			h.Write(layer[2*i+1])
+			next[i] = h.Sum(nil)
+		}
+		layer = next
+	}
+	return layer[0]
+}
+
+// pieceRoot returns the root of the tree of leaves blocks over data,
+// blocks past its end being zero hashes.
+func pieceRoot(data []byte, leaves int) []byte {
+	hashes := make([][]byte, 0, leaves)
+	for len(data) > 0 {
+		n := len(data)
+		if n > merkleBlockSize {
+			n = merkleBlockSize
+		}
+		sum := sha256.Sum256(data[:n])
+		hashes = append(hashes, sum[:])
+		data = data[n:]
+	}
+	return merkleRoot(hashes, leaves, zeroHash)
+}
+
+func blocksOf(length int64) int {
+	return int((length + merkleBlockSize - 1) / merkleBlockSize)
+}
+
+// layerRoot returns the root of a file from its piece layer.
+func layerRoot(layer []byte, pieceLength int64) []byte {
+	hashes := make([][]byte, len(layer)/sha256.Size)
+	for i := range hashes {
+		hashes[i] = layer[i*sha256.Size : (i+1)*sha256.Size]
+	}
+	return merkleRoot(hashes, nextPow2(len(hashes)), pieceRoot(nil, blocksOf(pieceLength)))
+}
+
+// hashV2File reads the size bytes of a file from r and returns the root
+// of its tree and, if it is longer than a piece, its piece layer.
+func hashV2File(r io.Reader, size, pieceLength int64) (root, layer []byte, err error) {
+	if size <= pieceLength {
+		data := make([]byte, size)
+		if _, err = io.ReadFull(r, data); err != nil {
+			return
+		}
+		return pieceRoot(data, nextPow2(blocksOf(size))), nil, nil
+	}
+
+	buf := make([]byte, pieceLength)
+	for off := int64(0); off < size; off += pieceLength {
+		n := pieceLength
+		if size-off < n {
+			n = size - off
+		}
+		if _, err = io.ReadFull(r, buf[:n]); err != nil {
+			return
+		}
+		layer = append(layer, pieceRoot(buf[:n], blocksOf(pieceLength))...)
+	}
+	return layerRoot(layer, pieceLength), layer, nil
+}
+
+// v2Piece is what checks a piece of a v2 torrent: the root of the tree of
+// leaves blocks over the length bytes of the file at its start. The hash
+// is nil while the piece layer of the file is unknown.
+type v2Piece struct {
+	hash   []byte
+	length int64
+	leaves int
+}
+
+// v2Pieces returns the pieces of the v2 torrent m, in order. They are
+// computed from its piece layers unless they were cached.
+func (m *MetaInfo) v2Pieces() []v2Piece {
+	if m.v2PieceCache != nil {
+		return m.v2PieceCache
+	}
+	return m.computeV2Pieces()
+}
+
+// cacheV2Pieces computes the pieces of m once, if it is a v2 torrent. It
+// must be called again whenever its info dict or piece layers change.
+func (m *MetaInfo) cacheV2Pieces() {
+	m.v2PieceCache = nil
+	if m.Info != nil && m.Info.pureV2() {
+		m.v2PieceCache = m.computeV2Pieces()
+	}
+}
+
+func (m *MetaInfo) computeV2Pieces() (pieces []v2Piece) {
+	pieceLength := m.Info.PieceLength
+	for _, f := range m.Info.v2Files() {
+		if f.Length <= pieceLength {
+			pieces = append(pieces, v2Piece{[]byte(f.Root), f.Length, nextPow2(blocksOf(f.Length))})
+			continue
+		}
+		layer := m.PieceLayers[f.Root]
+		n := int((f.Length + pieceLength - 1) / pieceLength)
+		if len(layer) != n*sha256.Size {
+			layer = ""
+		}
+		for i := 0; i < n; i++ {
+			p := v2Piece{length: pieceLength, leaves: blocksOf(pieceLength)}
+			if rest := f.Length - int64(i)*pieceLength; rest < pieceLength {
+				p.length = rest
+			}
+			if layer != "" {
+				p.hash = []byte(layer[i*sha256.Size : (i+1)*sha256.Size])
+			}
+			pieces = append(pieces, p)
+		}
+	}
+	return
+}
+
+// missingLayers returns the roots of the files of the v2 torrent m whose
+// piece layer we don't have.
+func (m *MetaInfo) missingLayers() (roots []string) {
+	for _, f := range m.Info.v2Files() {
+		if f.Length <= m.Info.PieceLength {
+			continue
+		}
+		n := (f.Length + m.Info.PieceLength - 1) / m.Info.PieceLength
+		if int64(len(m.PieceLayers[f.Root])) != n*sha256.Size {
+			roots = append(roots, f.Root)
+		}
+	}
+	return
+}
+
+// pieceMatches tells whether data is the piece of m with that index.
+func (m *MetaInfo) pieceMatches(piece int, data []byte) bool {
+	if m.Info.pureV2() {
+		pieces := m.v2Pieces()
+		return piece >= 0 && piece < len(pieces) && pieces[piece].matches(data)
+	}
+	base := piece * sha1.Size
+	if base < 0 || base+sha1.Size > len(m.Info.Pieces) {
+		return false
+	}
+	sum := sha1.Sum(data)
+	return bytes.Equal(sum[:], []byte(m.Info.Pieces[base:base+sha1.Size]))
+}
+
+func (p v2Piece) matches(data []byte) bool {
+	if p.hash == nil || int64(len(data)) < p.length {
+		return false
+	}
+	return bytes.Equal(pieceRoot(data[:p.length], p.leaves), p.hash)
+}
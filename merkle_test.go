@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestHashV2File(t *testing.T) {
+	block := bytes.Repeat([]byte("a"), 100)
+	root, layer, err := hashV2File(bytes.NewReader(block), int64(len(block)), 1<<20)
+	if err != nil || layer != nil {
+		t.Fatal(layer, err)
+	}
+	// A file of one block is its own root
+	if sum := sha256.Sum256(block); !bytes.Equal(root, sum[:]) {
+		t.Errorf("Expected %x, got %x", sum, root)
+	}
+
+	pieceLength := int64(4 * merkleBlockSize)
+	data := bytes.Repeat([]byte("b"), int(2*pieceLength+3))
+	root, layer, err = hashV2File(bytes.NewReader(data), int64(len(data)), pieceLength)
+	if err != nil || len(layer) != 3*sha256.Size {
+		t.Fatal(len(layer), err)
+	}
+	// The same tree, built from the blocks
+	if all := pieceRoot(data, 16); !bytes.Equal(root, all) {
+		t.Errorf("Expected %x, got %x", all, root)
+	}
+}
+
+func TestCreateMetaV2(t *testing.T) {
+	dir, err := ioutil.TempDir("", "merkle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "d"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "a"), bytes.Repeat([]byte("a"), 3<<19), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "d", "b"), []byte("bbb"), 0644)
+	defer func(length int64) { *fixedPieceLength = length }(*fixedPieceLength)
+	*fixedPieceLength = 1 << 20
+
+	meta, err := createMetaV2(dir, nil, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if missing := meta.missingLayers(); len(missing) != 0 {
+		t.Fatalf("Expected all the piece layers, %d are missing", len(missing))
+	}
+	files := meta.Info.fileList()
+	if len(files) != 2 || files[1].Path[1] != "b" || files[1].Checksum == "" {
+		t.Fatalf("Unexpected files %+v", files)
+	}
+	// a is padded to 2 pieces
+	if size := meta.Info.totalSize(); size != 2<<20+3 {
+		t.Fatalf("Expected a size of %d, got %d", 2<<20+3, size)
+	}
+
+	fs, size, err := newFileStore(meta.Info, dir, allocSparse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	if good, bad, _, err := checkPieces(fs, size, meta, nil); good != 3 || bad != 0 || err != nil {
+		t.Fatalf("Expected 3 good pieces, got %d good and %d bad: %v", good, bad, err)
+	}
+
+	// Without the piece layers, only the small file can be checked
+	info, _ := meta.RawInfo()
+	if infoHashOf(info) != meta.InfoHash {
+		t.Error("Expected the infohash to be the truncated SHA-256 of the info")
+	}
+	bare := &MetaInfo{Info: meta.Info, InfoHash: meta.InfoHash}
+	if len(bare.missingLayers()) != 1 || bare.pieceMatches(0, make([]byte, 1<<20)) {
+		t.Error("Expected the pieces of a to be unknown")
+	}
+}
+
+func TestHashRequests(t *testing.T) {
+	pieceLength := int64(1 << 20)
+	n := 600
+	layer := make([]byte, n*sha256.Size)
+	rand.Read(layer)
+	root := string(layerRoot(layer, pieceLength))
+
+	requests := layerRequests(root, n, pieceLength)
+	if len(requests) != 2 || requests[1].index != 512 || requests[1].proofs != 1 {
+		t.Fatalf("Unexpected requests %+v", requests)
+	}
+	var got []byte
+	for _, r := range requests {
+		msg := r.encode(HASH_REQUEST, nil)
+		decoded, rest, err := decodeHashRequest(msg)
+		if err != nil || decoded != r || len(rest) != 0 {
+			t.Fatalf("Expected %+v, got %+v, %v", r, decoded, err)
+		}
+		answer, ok := answerHashRequest(r, layer, pieceLength)
+		if !ok {
+			t.Fatalf("Couldn't answer %+v", r)
+		}
+		hashes, ok := checkHashes(r, answer)
+		if !ok {
+			t.Fatalf("Answer to %+v doesn't check", r)
+		}
+		got = append(got, hashes...)
+
+		answer[len(answer)-1] ^= 1
+		if _, ok := checkHashes(r, answer); ok {
+			t.Errorf("Expected a bad proof to fail")
+		}
+	}
+	if !reflect.DeepEqual(got[:len(layer)], layer) {
+		t.Error("Expected the layer back")
+	}
+}
+
+func TestCreateMetaHybrid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "merkle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "a"), bytes.Repeat([]byte("a"), 3<<19), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "b"), []byte("bbb"), 0644)
+	defer func(length int64) { *fixedPieceLength = length }(*fixedPieceLength)
+	*fixedPieceLength = 1 << 20
+
+	meta, err := createMetaV2(dir, nil, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2, _ := createMetaV2(dir, nil, nil, false)
+	if !reflect.DeepEqual(meta.Info.FileTree, v2.Info.FileTree) || meta.InfoHash == v2.InfoHash {
+		t.Fatal("Expected the v2 file tree along with the v1 pieces")
+	}
+	// The v1 files are padded as the v2 layout
+	if len(meta.Info.Files) != 3 || !meta.Info.Files[1].isPad() || meta.Info.Files[1].Length != 1<<19 {
+		t.Fatalf("Unexpected files %+v", meta.Info.Files)
+	}
+	if len(meta.Info.fileList()) != 2 || len(meta.Info.Pieces) != 3*20 {
+		t.Fatalf("Unexpected files %+v or pieces", meta.Info.fileList())
+	}
+
+	// The SHA-1 of the info is the infohash, and the v1 pieces check
+	info, _ := meta.RawInfo()
+	if sum := sha1.Sum(info); meta.InfoHash != string(sum[:]) {
+		t.Error("Expected the v1 infohash")
+	}
+	fs, size, err := newFileStore(meta.Info, dir, allocSparse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	if good, bad, _, err := checkPieces(fs, size, meta, nil); good != 3 || bad != 0 || err != nil {
+		t.Fatalf("Expected 3 good pieces, got %d good and %d bad: %v", good, bad, err)
+	}
+}
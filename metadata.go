@@ -2,7 +2,6 @@ package main
 
 import (
 	"bytes"
-	"crypto/sha1"
 	"log"
 
 	bencode "github.com/jackpal/bencode-go"
@@ -25,6 +24,9 @@ type MetadataMessage struct {
 	MsgType   messagetype "msg_type"
 	Piece     int         "piece"
 	TotalSize int         "total_size"
+
+	// The signature of the info dict, along with its first piece
+	Sig string `bencode:"sig"`
 }
 
 func (t *TorrentSession) DoMetadata(msg []byte, p *peerState) {
@@ -41,8 +43,16 @@ func (t *TorrentSession) DoMetadata(msg []byte, p *peerState) {
 		if !t.si.HaveTorrent {
 			break
 		}
+		if p.sealed {
+			log.Printf("Not sending the info dict to %s, which can't read the share\n", p.address)
+			break
+		}
 
-		rawInfo := t.m.RawInfo()
+		rawInfo, err := t.m.RawInfo()
+		if err != nil {
+			log.Println(err)
+			break
+		}
 
 		from := message.Piece * METADATA_PIECE_SIZE
 
@@ -69,6 +79,9 @@ func (t *TorrentSession) DoMetadata(msg []byte, p *peerState) {
 			Piece:     message.Piece,
 			TotalSize: len(rawInfo),
 		}
+		if message.Piece == 0 {
+			respHeader.Sig = t.m.InfoSig
+		}
 
 		var resp bytes.Buffer
 		resp.WriteByte(EXTENSION)
@@ -106,6 +119,9 @@ func (t *TorrentSession) DoMetadata(msg []byte, p *peerState) {
 		}
 
 		t.si.ME.Pieces[message.Piece] = msg[len(msg)-pieceSize:]
+		if message.Piece == 0 {
+			t.si.ME.Sig = message.Sig
+		}
 
 		finished := true
 		for idx, data := range t.si.ME.Pieces {
@@ -128,32 +144,27 @@ func (t *TorrentSession) DoMetadata(msg []byte, p *peerState) {
 		info := full.Bytes()
 
 		// Verify sha
-		sha := sha1.New()
-		sha.Write(info)
-		actual := string(sha.Sum(nil))
+		actual := infoHashOf(info)
 		if actual != t.m.InfoHash {
 			log.Println("Invalid metadata")
 			log.Printf("Expected %x, got %x\n", t.m.InfoHash, actual)
 			break
 		}
+		if err = t.checkInfo(info, t.si.ME.Sig); err != nil {
+			log.Printf("Refusing metadata from %s: %s\n", p.address, err)
+			t.si.ME.Pieces = make([][]byte, len(t.si.ME.Pieces))
+			t.si.ME.Sig = ""
+			t.si.ME.Transferring = false
+			break
+		}
+		t.m.InfoSig = t.si.ME.Sig
 
 		err = t.reload(info)
 		if err != nil {
 			return
 		}
 
-		if p.have == nil {
-			if p.temporaryBitfield != nil {
-				p.have = bitset.NewFromBytes(t.totalPieces, p.temporaryBitfield)
-				p.temporaryBitfield = nil
-			} else {
-				p.have = bitset.New(t.totalPieces)
-			}
-		}
-		if p.have == nil {
-			log.Panic("Invalid bitfield data")
-		}
-
+		t.initPeerHave(p)
 		p.SendBitfield(t.pieceSet)
 	case METADATA_REJECT:
 		log.Printf("%d didn't want to send piece %d\n", p.address, message.Piece)
@@ -161,3 +172,20 @@ func (t *TorrentSession) DoMetadata(msg []byte, p *peerState) {
 		log.Println("Didn't understand metadata extension type: ", mt)
 	}
 }
+
+// initPeerHave commits what p told it had before we had the torrent.
+func (t *TorrentSession) initPeerHave(p *peerState) {
+	if p.have == nil {
+		if p.temporaryHaveAll {
+			p.have = fullBitset(t.totalPieces)
+		} else if p.temporaryBitfield != nil {
+			p.have = bitset.NewFromBytes(t.totalPieces, p.temporaryBitfield)
+			p.temporaryBitfield = nil
+		} else {
+			p.have = bitset.New(t.totalPieces)
+		}
+	}
+	if p.have == nil {
+		log.Panic("Invalid bitfield data")
+	}
+}
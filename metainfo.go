@@ -2,13 +2,10 @@ package main
 
 import (
 	"bytes"
-	"crypto/sha1"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
-	"os"
-	"path/filepath"
 	"strings"
 
 	"github.com/nictuku/dht"
@@ -19,11 +16,25 @@ type FileDict struct {
 	Length int64    `bencode:"length"`
 	Path   []string `bencode:"path"`
 	Md5sum string   `bencode:"md5sum,omitempty"`
+
+	// <algorithm>:<hex digest> of the whole file
+	Checksum string `bencode:"checksum,omitempty"`
+
+	// "p" for pad files, "l" for symbolic links (BEP 47)
+	Attr string `bencode:"attr,omitempty"`
+	// Target of a symbolic link, relative to the share
+	SymlinkPath []string `bencode:"symlink path,omitempty"`
+
+	// Unix time of the last change, permissions and user extended
+	// attributes of the file, given to the copies, see filemeta.go
+	Mtime  int64             `bencode:"mtime,omitempty"`
+	Mode   uint32            `bencode:"mode,omitempty"`
+	Xattrs map[string]string `bencode:"xattrs,omitempty"`
 }
 
 type InfoDict struct {
 	PieceLength int64  `bencode:"piece length"`
-	Pieces      string `bencode:"pieces"`
+	Pieces      string `bencode:"pieces,omitempty"`
 	Private     int64  `bencode:"private"`
 	Name        string `bencode:"name"`
 	// Single File Mode
@@ -31,6 +42,18 @@ type InfoDict struct {
 	Md5sum string `bencode:"md5sum,omitempty"`
 	// Multiple File mode
 	Files []*FileDict `bencode:"files,omitempty"`
+
+	// Base URLs of HTTPS servers with a copy of the files, to fall back
+	// on when no peer has them
+	Mirrors []string `bencode:"mirrors,omitempty"`
+
+	// Files recently removed from the share
+	Deleted []Tombstone `bencode:"deleted,omitempty"`
+
+	// v2 torrents (BEP 52) have a tree of files rather than a list, see
+	// merkle.go
+	MetaVersion int64                  `bencode:"meta version,omitempty"`
+	FileTree    map[string]interface{} `bencode:"file tree,omitempty"`
 }
 
 type MetaInfo struct {
@@ -42,9 +65,18 @@ type MetaInfo struct {
 	CreatedBy    string     `bencode:"created by,omitempty"`
 	Encoding     string     `bencode:"encoding,omitempty"`
 
+	// The piece layers of the files of v2 torrents, by pieces root
+	PieceLayers map[string]string `bencode:"piece layers,omitempty"`
+
+	// The signature of the info dict by a writer of the share
+	InfoSig string `bencode:"rakoshare sig,omitempty"`
+
 	// These are not used for bencoding, only for helping
 	InfoHash string `bencode:"-"`
 	rawInfo  []byte `bencode:"-"`
+
+	// The pieces of v2 torrents, as of the last call to cacheV2Pieces
+	v2PieceCache []v2Piece `bencode:"-"`
 }
 
 func NewMetaInfo(torrent string) (m *MetaInfo, err error) {
@@ -94,13 +126,13 @@ func NewMetaInfoFromContent(content []byte) (m *MetaInfo, err error) {
 		return
 	}
 
-	hash := sha1.New()
-	err1 = bencode.NewEncoder(hash).Encode(m1.Info)
+	var info bytes.Buffer
+	err1 = bencode.NewEncoder(&info).Encode(m1.Info)
 	if err1 != nil {
 		return
 	}
 
-	m1.InfoHash = string(hash.Sum(nil))
+	m1.InfoHash = infoHashOf(info.Bytes())
 
 	return &m1, nil
 }
@@ -122,49 +154,37 @@ func NewMetaInfoFromMagnet(torrent string) (m *MetaInfo, err error) {
 
 }
 
-func (m *MetaInfo) saveToDisk(dir string) (err error) {
-	ihhex := fmt.Sprintf("%x", m.InfoHash)
-	f, err := os.Create(filepath.Join(dir, ihhex))
-	if err != nil {
-		log.Println("Error when opening file for creation: ", err)
-		return
-	}
-	defer f.Close()
-
-	return bencode.NewEncoder(f).Encode(m)
-}
-
 // Returns the size of the representation of this metainfo as a bencoded
 // dictionary
-func (m *MetaInfo) Size() (sz int) {
+func (m *MetaInfo) Size() (sz int, err error) {
 	var buf bytes.Buffer
-	err := bencode.NewEncoder(&buf).Encode(m)
+	err = bencode.NewEncoder(&buf).Encode(m)
 	if err != nil {
-		log.Fatal("Couldn't bencode this metainfo: ", err)
+		return 0, fmt.Errorf("Couldn't bencode this metainfo: %s", err)
 	}
 
-	return buf.Len()
+	return buf.Len(), nil
 }
 
 // Returns the representation of this metainfo's info dict as a
 // bencoded dictionary
-func (m *MetaInfo) RawInfo() (b []byte) {
+func (m *MetaInfo) RawInfo() (b []byte, err error) {
 	if m.rawInfo != nil {
-		return m.rawInfo
+		return m.rawInfo, nil
 	}
 	if m.Info == nil {
-		return []byte{}
+		return []byte{}, nil
 	}
 
 	var buf bytes.Buffer
-	err := bencode.NewEncoder(&buf).Encode(m.Info)
+	err = bencode.NewEncoder(&buf).Encode(m.Info)
 	if err != nil {
-		log.Fatal("Couldn't bencode this metainfo's dict: ", err)
+		return nil, fmt.Errorf("Couldn't bencode this metainfo's dict: %s", err)
 	}
 
 	m.rawInfo = buf.Bytes()
 
-	return m.rawInfo
+	return m.rawInfo, nil
 }
 
 func getMetaInfo(torrent string) (metaInfo *MetaInfo, err error) {
@@ -172,11 +192,14 @@ func getMetaInfo(torrent string) (metaInfo *MetaInfo, err error) {
 }
 
 type SessionInfo struct {
-	PeerId     string
-	Port       int
+	// Read while the session runs, so accessed atomically. They must stay
+	// first in the struct.
 	Uploaded   int64
 	Downloaded int64
-	Left       int64
+
+	PeerId string
+	Port   int
+	Left   int64
 
 	//UseDHT      bool
 	FromMagnet  bool
@@ -189,4 +212,5 @@ type SessionInfo struct {
 type MetaDataExchange struct {
 	Transferring bool
 	Pieces       [][]byte
+	Sig          string
 }
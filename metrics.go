@@ -0,0 +1,86 @@
+package main
+
+import (
+	"expvar"
+	"flag"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var httpAddr = flag.String("httpAddr", "", "If not empty, serve metrics over HTTP on this address, under /debug/vars, and for Prometheus under /metrics")
+
+// Above this, the main loop of a session is considered slow
+const slowLoopLatency = 2 * time.Second
+
+// Metrics of the running sessions, by session name
+var sessionsMetrics = expvar.NewMap("sessions")
+
+func startHTTP() {
+	if *httpAddr == "" {
+		return
+	}
+	go func() {
+		err := http.ListenAndServe(*httpAddr, nil)
+		log.Println("HTTP server stopped:", err)
+	}()
+}
+
+// loopMonitor tracks the health of the main loop of a session: when it
+// last gave a sign of life and how late it is in processing its timers.
+// A loop that is late but still running shows up here long before the
+// deadlock detector reports it as stuck.
+type loopMonitor struct {
+	sync.Mutex
+	name          string
+	lastHeartbeat time.Time
+	latency       time.Duration
+	maxLatency    time.Duration
+}
+
+func newLoopMonitor(name string) *loopMonitor {
+	m := &loopMonitor{
+		name:          name,
+		lastHeartbeat: time.Now(),
+	}
+	sessionsMetrics.Set(name, expvar.Func(m.export))
+	return m
+}
+
+// Heartbeat records that the loop processed a timer scheduled at the
+// given time.
+func (m *loopMonitor) Heartbeat(scheduled time.Time) {
+	now := time.Now()
+	latency := now.Sub(scheduled)
+
+	m.Lock()
+	m.lastHeartbeat = now
+	m.latency = latency
+	if latency > m.maxLatency {
+		m.maxLatency = latency
+	}
+	m.Unlock()
+
+	if latency > slowLoopLatency {
+		log.Printf("[%s] Main loop is slow: %s late\n", m.name, latency)
+	}
+}
+
+// HeartbeatAge returns how long ago the loop gave its last sign of life.
+func (m *loopMonitor) HeartbeatAge() time.Duration {
+	m.Lock()
+	defer m.Unlock()
+	return time.Now().Sub(m.lastHeartbeat)
+}
+
+func (m *loopMonitor) export() interface{} {
+	m.Lock()
+	defer m.Unlock()
+	return map[string]interface{}{
+		"last_heartbeat":           m.lastHeartbeat.Unix(),
+		"heartbeat_age_seconds":    time.Now().Sub(m.lastHeartbeat).Seconds(),
+		"loop_latency_seconds":     m.latency.Seconds(),
+		"loop_latency_max_seconds": m.maxLatency.Seconds(),
+	}
+}
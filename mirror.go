@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Writers can list mirrors in a share: read-only HTTPS servers holding a
+// copy of its files. The list is part of the info dict, so it is covered
+// by the signature of the revision. When no peer has the pieces we miss,
+// they are fetched from the mirrors and checked like any other piece.
+
+var mirrorAfter = flag.Duration("mirrorAfter", time.Minute, "How long a download goes without any peer having the pieces it misses before fetching them from the mirrors of the share")
+
+// How many pieces are fetched from mirrors before checking again for
+// peers
+const mirrorBatch = 16
+
+var errMirrorBadPiece = errors.New("piece from mirror failed verification")
+
+// mirrorPiece is the result of fetching a piece from the mirrors.
+type mirrorPiece struct {
+	piece int
+	data  []byte
+	err   error
+}
+
+// fileRange is the part of a file a piece covers. Pad files have no
+// path.
+type fileRange struct {
+	path   []string
+	offset int64
+	length int64
+}
+
+// validMirror tells whether mirror can be used as the base URL of a
+// mirror. Only HTTPS is accepted, so that what we ask for isn't seen or
+// answered on the way.
+func validMirror(mirror string) bool {
+	u, err := url.Parse(mirror)
+	return err == nil && u.Scheme == "https" && u.Host != ""
+}
+
+// mirrorURL returns where mirror serves the file at path.
+func mirrorURL(mirror string, path []string) string {
+	escaped := make([]string, len(path))
+	for i, segment := range path {
+		escaped[i] = url.PathEscape(segment)
+	}
+	return strings.TrimRight(mirror, "/") + "/" + strings.Join(escaped, "/")
+}
+
+// pieceFiles returns the parts of files piece is made of.
+func pieceFiles(info *InfoDict, piece int) (ranges []fileRange) {
+	files := info.layout()
+	if len(files) == 0 {
+		files = []*FileDict{{Length: info.Length, Path: []string{info.Name}}}
+	}
+	var total int64
+	for _, f := range files {
+		total += f.Length
+	}
+
+	begin := int64(piece) * info.PieceLength
+	end := begin + pieceSize(total, info.PieceLength, piece)
+	var offset int64
+	for _, f := range files {
+		fileEnd := offset + f.Length
+		if fileEnd > begin && offset < end {
+			from, to := begin, end
+			if from < offset {
+				from = offset
+			}
+			if to > fileEnd {
+				to = fileEnd
+			}
+			r := fileRange{f.Path, from - offset, to - from}
+			if f.isPad() {
+				r.path = nil
+			}
+			ranges = append(ranges, r)
+		}
+		offset = fileEnd
+	}
+	return
+}
+
+// fetchRange gets length bytes of the file at u, starting at offset.
+// Servers that ignore the Range header are read up to the range.
+func fetchRange(client *http.Client, u string, offset, length int64) ([]byte, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		if _, err := io.CopyN(ioutil.Discard, resp.Body, offset); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New(resp.Status)
+	}
+	data := make([]byte, length)
+	_, err = io.ReadFull(resp.Body, data)
+	return data, err
+}
+
+// fetchPiece gets piece from mirror and checks it.
+func fetchPiece(client *http.Client, mirror string, m *MetaInfo, piece int) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, r := range pieceFiles(m.Info, piece) {
+		if r.path == nil {
+			buf.Write(make([]byte, r.length))
+			continue
+		}
+		data, err := fetchRange(client, mirrorURL(mirror, r.path), r.offset, r.length)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(data)
+	}
+
+	if !m.pieceMatches(piece, buf.Bytes()) {
+		return nil, errMirrorBadPiece
+	}
+	return buf.Bytes(), nil
+}
+
+// fetchFromMirrors gets pieces one by one, trying the mirrors in random
+// order, and sends the results to out until done is closed.
+func fetchFromMirrors(mirrors []string, m *MetaInfo, pieces []int, out chan<- mirrorPiece, done <-chan struct{}) {
+	client := proxyHttpClient()
+	client.Timeout = 5 * time.Minute
+	for _, piece := range pieces {
+		result := mirrorPiece{piece: piece, err: errors.New("no valid mirror")}
+		for _, i := range rand.Perm(len(mirrors)) {
+			if !validMirror(mirrors[i]) {
+				continue
+			}
+			result.data, result.err = fetchPiece(client, mirrors[i], m, piece)
+			if result.err == nil {
+				break
+			}
+			log.Printf("Couldn't fetch piece %d from mirror %s: %s\n", piece, mirrors[i], result.err)
+		}
+		select {
+		case out <- result:
+		case <-done:
+			return
+		}
+	}
+}
+
+// peersHaveMissing tells whether a peer has one of the pieces we miss.
+func (t *TorrentSession) peersHaveMissing() bool {
+	for _, p := range t.peers.All() {
+		if p.have == nil {
+			continue
+		}
+		for i := 0; i < t.totalPieces; i++ {
+			if !t.pieceSet.IsSet(i) && p.have.IsSet(i) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkMirrors starts fetching pieces from the mirrors once no peer had
+// any piece we miss for mirrorAfter.
+func (t *TorrentSession) checkMirrors(now time.Time) {
+	if !t.si.HaveTorrent || len(t.m.Info.Mirrors) == 0 || t.mirrorPending > 0 || t.goodPieces == t.totalPieces || t.needLayers {
+		return
+	}
+	if t.peersHaveMissing() {
+		t.starvedSince = time.Time{}
+		return
+	}
+	if t.starvedSince.IsZero() {
+		t.starvedSince = now
+	}
+	if now.Sub(t.starvedSince) < *mirrorAfter {
+		return
+	}
+
+	var pieces []int
+	for i := 0; i < t.totalPieces && len(pieces) < mirrorBatch; i++ {
+		if _, active := t.activePieces[i]; !active && !t.pieceSet.IsSet(i) {
+			pieces = append(pieces, i)
+		}
+	}
+	if len(pieces) == 0 {
+		return
+	}
+	log.Printf("No peer has the %d pieces we miss, fetching %d from mirrors\n",
+		t.totalPieces-t.goodPieces, len(pieces))
+	t.mirrorPending = len(pieces)
+	go fetchFromMirrors(t.m.Info.Mirrors, t.m, pieces, t.mirrorChan, t.done)
+}
+
+// recordMirrorPiece stores a piece fetched from mirrors.
+func (t *TorrentSession) recordMirrorPiece(mp mirrorPiece) {
+	t.mirrorPending--
+	if mp.err != nil || t.pieceSet.IsSet(mp.piece) {
+		return
+	}
+	// Peers may have started sending it meanwhile; their blocks will be
+	// ignored
+	delete(t.activePieces, mp.piece)
+
+	_, err := t.fileStore.WriteAt(mp.data, int64(mp.piece)*t.m.Info.PieceLength)
+	if err != nil {
+		log.Println("Couldn't write piece from mirror: ", err)
+		return
+	}
+	ok, err := checkPiece(t.fileStore, t.totalSize, t.m, mp.piece)
+	if !ok || err != nil {
+		log.Println("Piece", mp.piece, "from mirror failed verification:", err)
+		return
+	}
+	atomic.AddInt64(&t.si.Downloaded, int64(len(mp.data)))
+	t.transfers.add(t.m.InfoHash, 0, int64(len(mp.data)))
+	t.pieceCompleted(mp.piece, len(mp.data))
+}
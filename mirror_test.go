@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPieceFiles(t *testing.T) {
+	info := &InfoDict{
+		PieceLength: 4,
+		Files: []*FileDict{
+			{Length: 3, Path: []string{"a"}},
+			{Length: 6, Path: []string{"b", "c"}},
+		},
+	}
+	vectors := []struct {
+		piece    int
+		expected []fileRange
+	}{
+		{0, []fileRange{{[]string{"a"}, 0, 3}, {[]string{"b", "c"}, 0, 1}}},
+		{1, []fileRange{{[]string{"b", "c"}, 1, 4}}},
+		{2, []fileRange{{[]string{"b", "c"}, 5, 1}}},
+		{3, nil},
+	}
+	for _, vec := range vectors {
+		if got := pieceFiles(info, vec.piece); !reflect.DeepEqual(got, vec.expected) {
+			t.Errorf("Piece %d: expected %v, got %v", vec.piece, vec.expected, got)
+		}
+	}
+
+	single := &InfoDict{PieceLength: 4, Length: 5, Name: "f"}
+	expected := []fileRange{{[]string{"f"}, 4, 1}}
+	if got := pieceFiles(single, 1); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Single file: expected %v, got %v", expected, got)
+	}
+}
+
+func TestMirrorURL(t *testing.T) {
+	got := mirrorURL("https://example.com/share/", []string{"sub dir", "a#b"})
+	if expected := "https://example.com/share/sub%20dir/a%23b"; got != expected {
+		t.Errorf("Expected %s, got %s", expected, got)
+	}
+	for mirror, valid := range map[string]bool{
+		"https://example.com/share": true,
+		"http://example.com":        false,
+		"ftp://example.com":         false,
+		"example.com/share":         false,
+	} {
+		if validMirror(mirror) != valid {
+			t.Errorf("%s: expected valid=%v", mirror, valid)
+		}
+	}
+}
+
+func TestFetchPiece(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "sub dir"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "a"), []byte("abc"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "sub dir", "b"), []byte("defgh"), 0644)
+
+	mirrors := []string{"https://example.com"}
+	meta, err := createMeta(dir, nil, mirrors, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(meta.Info.Mirrors, mirrors) {
+		t.Fatalf("Expected mirrors %v in the info dict, got %v", mirrors, meta.Info.Mirrors)
+	}
+
+	server := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	defer server.Close()
+	data, err := fetchPiece(http.DefaultClient, server.URL, meta, 0)
+	if err != nil || string(data) != "abcdefgh" {
+		t.Fatalf("Expected abcdefgh, got %q, %v", data, err)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "a"), []byte("xyz"), 0644)
+	if _, err := fetchPiece(http.DefaultClient, server.URL, meta, 0); err != errMirrorBadPiece {
+		t.Errorf("Expected %v for a modified mirror, got %v", errMirrorBadPiece, err)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"sync"
+)
+
+const (
+	storageMmap      = "mmap"       // Reads from memory mappings
+	storageMmapWrite = "mmap-write" // Reads and writes through memory mappings
+)
+
+var errMappedFault = errors.New("mapped file changed during access")
+
+func init() {
+	registerStore(storageMmap, openMmapStore)
+	registerStore(storageMmapWrite, openMmapStore)
+}
+
+// openMmapStore opens the files of info under storePath, mapped in
+// memory. Memory mappings need a 64-bit address space for large shares,
+// so other platforms use plain files.
+func openMmapStore(info *InfoDict, storePath string, opts storeOptions) (FileStore, int64, error) {
+	if opts.allocation == allocNone {
+		// Mapping past the end of a file faults
+		log.Printf("Memory mappings need allocated files, using %s allocation", allocSparse)
+		opts.allocation = allocSparse
+	}
+	fs, totalSize, err := newFileStore(info, storePath, opts.allocation)
+	if err != nil {
+		return nil, 0, err
+	}
+	fs.versions = newVersionKeeper(storePath, opts.versions)
+	if strconv.IntSize < 64 || !mmapSupported {
+		log.Printf("Memory mappings aren't supported on this platform, using %s storage", storageFiles)
+		return fs, totalSize, nil
+	}
+	return newMmapStore(fs, opts.storage == storageMmapWrite), totalSize, nil
+}
+
+// mmapStore is a fileStore whose files are mapped in memory, saving a
+// system call per block read, and per block written if writable. Files
+// are mapped on first access, and unmapped when they're replaced.
+//
+// The files are in the shared folder, where the user may truncate them.
+// Touching a mapping past the end of its file faults, so files are
+// checked before each access and read or written the usual way when
+// they got shorter; a fault in between is turned into an error.
+type mmapStore struct {
+	*fileStore
+	writable bool
+
+	sync.RWMutex // Held for reading while a mapping is in use
+	maps         map[string][]byte
+}
+
+func newMmapStore(fs *fileStore, writable bool) *mmapStore {
+	return &mmapStore{fileStore: fs, writable: writable, maps: make(map[string][]byte)}
+}
+
+// mapEntry maps the file of entry. The caller must hold the read lock,
+// which is released meanwhile.
+func (m *mmapStore) mapEntry(entry *fileEntry) error {
+	m.RUnlock()
+	defer m.RLock()
+	m.Lock()
+	defer m.Unlock()
+
+	if _, ok := m.maps[entry.name]; ok {
+		return nil
+	}
+	flag := os.O_RDONLY
+	if m.writable {
+		flag = os.O_RDWR
+	}
+	file, err := os.OpenFile(entry.name, flag, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	data, err := mapFile(file, int(entry.length), m.writable)
+	if err != nil {
+		return err
+	}
+	m.maps[entry.name] = data
+	return nil
+}
+
+// unmapEntry drops the mapping of the file of entry. The caller must hold
+// the read lock, which is released meanwhile.
+func (m *mmapStore) unmapEntry(entry *fileEntry) {
+	m.RUnlock()
+	defer m.RLock()
+	m.Lock()
+	defer m.Unlock()
+
+	if data, ok := m.maps[entry.name]; ok {
+		if err := unmapFile(data); err != nil {
+			log.Printf("Couldn't unmap %s: %s", entry.name, err)
+		}
+		delete(m.maps, entry.name)
+	}
+}
+
+// copyMapped copies src to dst, one of them being a mapping, turning a
+// fault into an error.
+func copyMapped(dst, src []byte) (n int, err error) {
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		if r := recover(); r != nil {
+			n, err = 0, errMappedFault
+		}
+	}()
+	return copy(dst, src), nil
+}
+
+func (m *mmapStore) access(entry *fileEntry, p []byte, off int64, write bool) (int, error) {
+	// Nothing to map in empty files
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if entry.pad {
+		if write {
+			return entry.WriteAt(p, off)
+		}
+		return entry.ReadAt(p, off)
+	}
+	if st, err := os.Stat(entry.name); err != nil || st.Size() < entry.length {
+		// Truncated or gone: the file is accessed without its mapping
+		// until it is mapped again in full
+		m.unmapEntry(entry)
+		if write {
+			return entry.WriteAt(p, off)
+		}
+		return entry.ReadAt(p, off)
+	}
+	// The mapping may go while the lock is released, so look again
+	for {
+		if data, ok := m.maps[entry.name]; ok {
+			if write {
+				return copyMapped(data[off:], p)
+			}
+			return copyMapped(p, data[off:])
+		}
+		if err := m.mapEntry(entry); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (m *mmapStore) ReadAt(p []byte, off int64) (n int, err error) {
+	m.RLock()
+	defer m.RUnlock()
+	return m.span(p, off, func(entry *fileEntry, p []byte, off int64) (int, error) {
+		return m.access(entry, p, off, false)
+	})
+}
+
+// WriteAt writes through the mappings if they are writable, and to the
+// files otherwise; read-only mappings share the pages written.
+func (m *mmapStore) WriteAt(p []byte, off int64) (n int, err error) {
+	if !m.writable {
+		return m.fileStore.WriteAt(p, off)
+	}
+	m.RLock()
+	defer m.RUnlock()
+	return m.span(p, off, func(entry *fileEntry, p []byte, off int64) (int, error) {
+		return m.access(entry, p, off, true)
+	})
+}
+
+// unmapAll drops all the mappings; the system flushes what was written
+// to them. The caller must hold the lock.
+func (m *mmapStore) unmapAll() {
+	for name, data := range m.maps {
+		if err := unmapFile(data); err != nil {
+			log.Printf("Couldn't unmap %s: %s", name, err)
+		}
+		delete(m.maps, name)
+	}
+}
+
+// SetBad renames files, so their mappings go first, as in Cleanup.
+func (m *mmapStore) SetBad(off, length int64) {
+	m.Lock()
+	defer m.Unlock()
+	m.unmapAll()
+	m.fileStore.SetBad(off, length)
+}
+
+func (m *mmapStore) Cleanup() error {
+	m.Lock()
+	defer m.Unlock()
+	m.unmapAll()
+	return m.fileStore.Cleanup()
+}
+
+func (m *mmapStore) Close() error {
+	m.Lock()
+	defer m.Unlock()
+	m.unmapAll()
+	return m.fileStore.Close()
+}
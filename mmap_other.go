@@ -0,0 +1,20 @@
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+const mmapSupported = false
+
+var errNoMmap = errors.New("memory mappings aren't supported on this platform")
+
+func mapFile(file *os.File, length int, writable bool) ([]byte, error) {
+	return nil, errNoMmap
+}
+
+func unmapFile(data []byte) error {
+	return errNoMmap
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMmapStore(t *testing.T) {
+	if !mmapSupported {
+		t.Skip("No memory mappings on this platform")
+	}
+	dir, err := ioutil.TempDir("", "mmapstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	ioutil.WriteFile(a, []byte("abc"), 0600)
+	ioutil.WriteFile(b, []byte("defg"), 0600)
+
+	for _, writable := range []bool{false, true} {
+		fs := &fileStore{[]int64{0, 3}, []fileEntry{{3, a, false, nil}, {4, b, false, nil}}, 7, nil}
+		m := newMmapStore(fs, writable)
+
+		buf := make([]byte, 4)
+		if _, err := m.ReadAt(buf, 1); err != nil || string(buf) != "bcde" {
+			t.Fatalf("Expected to read across files, got %q, %v", buf, err)
+		}
+		if _, err := m.WriteAt([]byte("XY"), 2); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := m.ReadAt(buf, 1); err != nil || string(buf) != "bXYe" {
+			t.Errorf("Expected to read the written data, got %q, %v", buf, err)
+		}
+		if _, err := m.ReadAt(buf, 5); err != errPastEndOfStore {
+			t.Errorf("Expected an error reading past the end, got %v", err)
+		}
+		m.Close()
+
+		if content, _ := ioutil.ReadFile(b); string(content) != "Yefg" {
+			t.Errorf("Expected the write to reach the file, got %q", content)
+		}
+		ioutil.WriteFile(a, []byte("abc"), 0600)
+		ioutil.WriteFile(b, []byte("defg"), 0600)
+	}
+}
+
+func TestMmapStoreTruncated(t *testing.T) {
+	if !mmapSupported {
+		t.Skip("No memory mappings on this platform")
+	}
+	dir, err := ioutil.TempDir("", "mmapstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a := filepath.Join(dir, "a")
+	ioutil.WriteFile(a, make([]byte, 1<<16), 0600)
+
+	fs := &fileStore{[]int64{0}, []fileEntry{{1 << 16, a, false, nil}}, 1 << 16, nil}
+	m := newMmapStore(fs, false)
+	defer m.Close()
+	buf := make([]byte, 4)
+	if _, err := m.ReadAt(buf, 1<<15); err != nil {
+		t.Fatal(err)
+	}
+
+	// The user truncates the mapped file
+	os.Truncate(a, 10)
+	if _, err := m.ReadAt(buf, 1<<15); err == nil {
+		t.Error("Expected an error reading past the end of the truncated file")
+	}
+	if _, err := m.ReadAt(buf, 2); err != nil {
+		t.Errorf("Expected to read what is left of the file: %s", err)
+	}
+}
@@ -6,6 +6,9 @@ import (
 	"io"
 	"log"
 	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rakoo/rakoshare/pkg/bitset"
@@ -16,6 +19,9 @@ const MAX_OUR_REQUESTS = 2
 const MAX_PEER_REQUESTS = 10
 const STANDARD_BLOCK_LENGTH = 16 * 1024
 
+// Our client name, sent in the extension handshake
+const clientVersion = "rakoshare"
+
 type peerMessage struct {
 	peer    *peerState
 	message []byte // nil means an error occurred
@@ -35,7 +41,40 @@ type peerState struct {
 	peer_choking    bool // peer is choking this client
 	peer_interested bool // peer is interested in this client
 	peer_requests   map[uint64]bool
-	our_requests    map[uint64]time.Time // What we requested, when we requested it
+	our_requests    map[uint64]ourRequest // What we requested, when we requested it
+
+	// Bytes exchanged with the peer since the last rechoke, and the
+	// resulting smoothed rates in bytes per second
+	downloaded   int64
+	uploaded     int64
+	downloadRate float64
+	uploadRate   float64
+
+	// Bytes exchanged with the peer since we connected, up to the last
+	// rechoke, when we connected, and the last error that didn't close
+	// the connection
+	totalDownloaded int64
+	totalUploaded   int64
+	connectedAt     time.Time
+	lastError       string
+
+	// Messages queued for the writer and written by it, and when it last
+	// wrote one, in nanoseconds, or was let through by our upload limit.
+	// Accessed atomically.
+	queued      int64
+	written     int64
+	lastWritten int64
+
+	// 1 while the writer waits for our upload limit rather than for p.
+	// Accessed atomically.
+	throttled int32
+
+	// Limiters of the transfers with this peer; nil means unlimited
+	upLimiter   *rateLimiter
+	downLimiter *rateLimiter
+
+	// Whether the peer is on the local network
+	lan bool
 
 	// This field tells if the peer can send a bitfield or not
 	can_receive_bitfield bool
@@ -43,11 +82,68 @@ type peerState struct {
 	// Stores the bitfield they sent us but we can't verify yet (because
 	// we don't have the torrent yet) and will commit when we can
 	temporaryBitfield []byte
+	// Same, when they sent a HAVE_ALL
+	temporaryHaveAll bool
+
+	// Fast Extension (BEP-0006): whether the peer supports it, the pieces
+	// it lets us get while choked, those we let it get, and the pieces it
+	// suggested, oldest first
+	fast           bool
+	v2             bool // Supports v2 torrents, and so hash requests
+	allowedFast    map[int]bool
+	ourAllowedFast map[uint32]bool
+	suggested      []int
 
 	theirExtensions map[string]int
+
+	// From their extension handshake: their client name, how many
+	// requests they queue, and the port they listen on if they told us
+	client     string
+	reqq       int
+	listenPort int
+	theirConns int
+
+	// The onion service it accepts connections on, if it goes through Tor
+	onion string
+
+	// Whether we dialed the connection, and whether it is one of the
+	// additional connections to the same device
+	outbound bool
+	stripe   bool
+
+	// Whether it is a replica that can't read the share, with which
+	// pieces are exchanged sealed
+	sealed bool
+
+	// Largest request they serve, the size of our requests to them, how
+	// many of them fill the link, and the shortest round trip time of a
+	// request since they were chosen
+	theirMaxBlock int
+	blockLength   int
+	queueDepth    int
+	rtt           time.Duration
+
+	// Whether a request to the peer timed out since it last sent a block
+	snubbed bool
+
+	// Closed by Close. The reader and writer flags are set atomically
+	// when their goroutine stops; suspect is set by audits that found
+	// the peer half-dead.
+	closed     chan struct{}
+	closeOnce  sync.Once
+	readerDone int32
+	writerDone int32
+	suspect    bool
 }
 
-func queueingWriter(in, out chan []byte) {
+// queueingWriter passes the messages from in to out, queueing them
+// without limit. When a CHOKE goes through, the blocks still queued are
+// handed to choked, and replaced with what it returns, if anything: the
+// peer shouldn't get the blocks it requested before the choke.
+func queueingWriter(in, out chan []byte, done chan struct{}, choked func(block []byte) []byte) {
+	atomic.AddInt64(&peerGoroutines, 1)
+	defer atomic.AddInt64(&peerGoroutines, -1)
+
 	queue := make(map[int][]byte)
 	head, tail := 0, 0
 L:
@@ -60,6 +156,8 @@ L:
 				}
 				queue[head] = m
 				head++
+			case <-done:
+				break L
 			}
 		} else {
 			select {
@@ -67,11 +165,16 @@ L:
 				if !ok {
 					break L
 				}
+				if len(m) == 1 && m[0] == CHOKE {
+					head = unqueueBlocks(queue, tail, head, choked)
+				}
 				queue[head] = m
 				head++
 			case out <- queue[tail]:
 				delete(queue, tail)
 				tail++
+			case <-done:
+				break L
 			}
 		}
 	}
@@ -80,28 +183,76 @@ L:
 	close(out)
 }
 
+// unqueueBlocks replaces the PIECE messages in queue, between tail and
+// head, with what choked returns for them, and returns the new head.
+func unqueueBlocks(queue map[int][]byte, tail, head int, choked func([]byte) []byte) int {
+	kept := tail
+	for i := tail; i < head; i++ {
+		m := queue[i]
+		delete(queue, i)
+		if len(m) > 0 && m[0] == PIECE {
+			if m = choked(m); m == nil {
+				continue
+			}
+		}
+		queue[kept] = m
+		kept++
+	}
+	return kept
+}
+
 func NewPeerState(conn net.Conn) *peerState {
 	writeChan := make(chan []byte)
 	writeChan2 := make(chan []byte)
-	go queueingWriter(writeChan, writeChan2)
+	closed := make(chan struct{})
 
 	ps := &peerState{
 		writeChan:            writeChan,
 		writeChan2:           writeChan2,
+		closed:               closed,
 		conn:                 conn,
 		am_choking:           true,
 		peer_choking:         true,
 		peer_requests:        make(map[uint64]bool, MAX_PEER_REQUESTS),
-		our_requests:         make(map[uint64]time.Time, MAX_OUR_REQUESTS),
+		our_requests:         make(map[uint64]ourRequest, MAX_OUR_REQUESTS),
 		can_receive_bitfield: true,
+		connectedAt:          time.Now(),
 	}
+	go queueingWriter(writeChan, writeChan2, closed, ps.unqueueBlock)
+	livePeers.add(ps, ps.connectedAt)
 
 	return ps
 }
 
+// unqueueBlock tells what to send instead of a block still queued when
+// we choke p. The choke cancels the requests of other peers, but fast
+// peers must be told their request is rejected, unless the piece is in
+// their allowed fast set and is still served.
+func (p *peerState) unqueueBlock(block []byte) []byte {
+	index := binary.BigEndian.Uint32(block[1:5])
+	if p.ourAllowedFast[index] {
+		return block
+	}
+	if !p.fast {
+		// Never written, but not waiting either
+		atomic.AddInt64(&p.written, 1)
+		return nil
+	}
+	msg := make([]byte, 13)
+	msg[0] = REJECT_REQUEST
+	copy(msg[1:9], block[1:9])
+	binary.BigEndian.PutUint32(msg[9:13], uint32(len(block)-9))
+	return msg
+}
+
+// Close closes the connection and stops the goroutines of p. It can be
+// called more than once.
 func (p *peerState) Close() {
-	p.conn.Close()
-	// No need to close p.writeChan. Further writes to p.conn will just fail.
+	p.closeOnce.Do(func() {
+		p.conn.Close()
+		close(p.closed)
+	})
+	livePeers.remove(p)
 }
 
 func (p *peerState) AddRequest(index, begin, length uint32) {
@@ -128,6 +279,20 @@ func (p *peerState) RemoveRequest() (index, begin, length uint32, ok bool) {
 	return
 }
 
+// updateRates accounts for the bytes exchanged over the last elapsed
+// seconds. Rates are averaged with the previous ones, so that a peer
+// isn't choked for a single slow period.
+func (p *peerState) updateRates(elapsed float64) {
+	if elapsed <= 0 {
+		return
+	}
+	p.downloadRate = (p.downloadRate + float64(p.downloaded)/elapsed) / 2
+	p.uploadRate = (p.uploadRate + float64(p.uploaded)/elapsed) / 2
+	p.totalDownloaded += p.downloaded
+	p.totalUploaded += p.uploaded
+	p.downloaded, p.uploaded = 0, 0
+}
+
 func (p *peerState) SetChoke(choke bool) {
 	if choke != p.am_choking {
 		p.am_choking = choke
@@ -160,12 +325,18 @@ func (p *peerState) SendBitfield(bs *bitset.Bitset) {
 }
 
 func (p *peerState) SendExtensions(supportedExtensions map[int]string,
-	metadataSize int64) {
+	metadataSize int64, port, conns, maxBlock int) {
 
 	handshake := ExtensionHandshake{
 		M:            make(map[string]int, len(supportedExtensions)),
-		V:            "Taipei-Torrent dev",
+		V:            clientVersion,
+		P:            uint16(port),
+		Yourip:       compactIP(p.address),
+		Reqq:         MAX_PEER_REQUESTS,
 		MetadataSize: metadataSize,
+		Conns:        uint16(conns),
+		MaxBlock:     uint32(maxBlock),
+		Onion:        ourOnion,
 	}
 
 	for i, ext := range supportedExtensions {
@@ -187,18 +358,101 @@ func (p *peerState) SendExtensions(supportedExtensions map[int]string,
 	p.sendMessage(msg)
 }
 
+// readExtensionHandshake remembers what p told us in its extension
+// handshake.
+func (p *peerState) readExtensionHandshake(h ExtensionHandshake) {
+	p.theirExtensions = make(map[string]int)
+	for name, code := range h.M {
+		p.theirExtensions[name] = code
+	}
+	p.client = h.V
+	p.reqq = int(h.Reqq)
+	p.listenPort = int(h.P)
+	p.theirConns = int(h.Conns)
+	p.theirMaxBlock = int(h.MaxBlock)
+	if isOnion(h.Onion) {
+		p.onion = h.Onion
+	}
+	ourExternalIPs.record(p.address, h.Yourip)
+}
+
+// listenAddress returns the address p accepts connections on: for peers
+// that connected to us, the one they told us rather than the one they
+// connected from.
+func (p *peerState) listenAddress() string {
+	if p.listenPort == 0 {
+		return p.address
+	}
+	host, _, err := net.SplitHostPort(p.address)
+	if err != nil {
+		return p.address
+	}
+	if p.onion != "" {
+		host = p.onion
+	}
+	return net.JoinHostPort(host, strconv.Itoa(p.listenPort))
+}
+
+// maxOurRequests returns how many requests we keep queued at p.
+func (p *peerState) maxOurRequests() int {
+	if p.snubbed {
+		return 1
+	}
+	return p.queueLimit(p.queueDepth)
+}
+
+// sendPieceMessage sends a message whose only argument is a piece index,
+// such as HAVE.
+func (p *peerState) sendPieceMessage(b byte, piece uint32) {
+	msg := make([]byte, 5)
+	msg[0] = b
+	binary.BigEndian.PutUint32(msg[1:5], piece)
+	p.sendMessage(msg)
+}
+
 func (p *peerState) sendOneCharMessage(b byte) {
 	// log.Println("ocm", b, p.address)
 	p.sendMessage([]byte{b})
 }
 
 func (p *peerState) sendMessage(b []byte) {
-	p.writeChan <- b
+	select {
+	case p.writeChan <- b:
+		atomic.AddInt64(&p.queued, 1)
+	case <-p.closed:
+	}
 	p.lastWriteTime = time.Now()
 }
 
+// idle tells whether p sent nothing for idleTimeout, counting from the
+// connection if it never sent anything.
+func (p *peerState) idle(now time.Time) bool {
+	last := p.lastReadTime
+	if last.IsZero() {
+		last = p.connectedAt
+	}
+	return *idleTimeout > 0 && now.Sub(last) > *idleTimeout
+}
+
+// writeStalled tells whether messages are waiting for p but none was
+// written for writeStall: p doesn't read what we send, yet may hold an
+// upload slot. Time spent waiting for our own upload limit doesn't count.
+func (p *peerState) writeStalled(now time.Time) bool {
+	if *writeStall <= 0 || atomic.LoadInt64(&p.queued) <= atomic.LoadInt64(&p.written) {
+		return false
+	}
+	if atomic.LoadInt32(&p.throttled) == 1 {
+		return false
+	}
+	last := time.Unix(0, atomic.LoadInt64(&p.lastWritten))
+	if last.Before(p.connectedAt) {
+		last = p.connectedAt
+	}
+	return now.Sub(last) > *writeStall
+}
+
 func (p *peerState) keepAlive(now time.Time) {
-	if now.Sub(p.lastWriteTime) >= 2*time.Minute {
+	if now.Sub(p.lastWriteTime) >= *keepAliveIdle {
 		// log.Stderr("Sending keep alive", p)
 		p.sendMessage([]byte{})
 	}
@@ -211,26 +465,40 @@ func (p *peerState) keepAlive(now time.Time) {
 // listens for messages on a channel and sends them to a peer.
 
 func (p *peerState) peerWriter(errorChan chan peerMessage) {
+	atomic.AddInt64(&peerGoroutines, 1)
+	defer atomic.AddInt64(&peerGoroutines, -1)
 	// log.Println("Writing messages")
 	for msg := range p.writeChan2 {
 		payload := make([]byte, 4+len(msg))
 		binary.BigEndian.PutUint32(payload[:4], uint32(len(msg)))
 		copy(payload[4:], msg)
 
+		atomic.StoreInt32(&p.throttled, 1)
+		p.upLimiter.Wait(len(payload))
+		atomic.StoreInt64(&p.lastWritten, time.Now().UnixNano())
+		atomic.StoreInt32(&p.throttled, 0)
 		_, err := p.conn.Write(payload)
+		atomic.StoreInt64(&p.lastWritten, time.Now().UnixNano())
+		atomic.AddInt64(&p.written, 1)
 		if err != nil {
 			// log.Printf("Failed to write %d bytes to %s: %s\n", len(msg), p.address, err)
 			break
 		}
 	}
 	// log.Println("peerWriter exiting")
-	errorChan <- peerMessage{p, nil}
+	atomic.StoreInt32(&p.writerDone, 1)
+	select {
+	case errorChan <- peerMessage{p, nil}:
+	case <-p.closed:
+	}
 }
 
 // This func is designed to be run as a goroutine. It
 // listens for messages from the peer and forwards them to a channel.
 
 func (p *peerState) peerReader(msgChan chan peerMessage) {
+	atomic.AddInt64(&peerGoroutines, 1)
+	defer atomic.AddInt64(&peerGoroutines, -1)
 	// log.Println("Reading messages")
 	for {
 		var size [4]byte
@@ -243,22 +511,31 @@ func (p *peerState) peerReader(msgChan chan peerMessage) {
 		}
 
 		n := binary.BigEndian.Uint32(size[:])
-		if n > 130*1024 {
+		if n > maxBlockLength+9 {
 			// log.Println("Message size too large: ", n)
 			break
 		}
 
 		buf := make([]byte, n)
 
+		p.downLimiter.Wait(len(buf))
 		_, err = io.ReadFull(p.conn, buf)
 		if err != nil {
 			// log.Printf("Failed to read %d bytes from %s: %s\n", len(buf), p.address, err)
 			break
 		}
-		msgChan <- peerMessage{p, buf}
+		select {
+		case msgChan <- peerMessage{p, buf}:
+		case <-p.closed:
+			return
+		}
 	}
 
-	msgChan <- peerMessage{p, nil}
+	atomic.StoreInt32(&p.readerDone, 1)
+	select {
+	case msgChan <- peerMessage{p, nil}:
+	case <-p.closed:
+	}
 	// log.Println("peerReader exiting")
 }
 
@@ -283,10 +560,21 @@ func (p *peerState) sendExtensionMessage(typ string, data interface{}) {
 		log.Printf("Couldn't marshal extension message: ", err)
 	}
 
-	msg := make([]byte, 2+payload.Len())
+	p.sendRawExtensionMessage(typ, payload.Bytes())
+}
+
+// sendRawExtensionMessage sends an extension message whose payload isn't
+// bencoded.
+func (p *peerState) sendRawExtensionMessage(typ string, payload []byte) {
+	code, ok := p.theirExtensions[typ]
+	if !ok {
+		return
+	}
+
+	msg := make([]byte, 2+len(payload))
 	msg[0] = EXTENSION
-	msg[1] = byte(p.theirExtensions[typ])
-	copy(msg[2:], payload.Bytes())
+	msg[1] = byte(code)
+	copy(msg[2:], payload)
 
 	p.sendMessage(msg)
 }
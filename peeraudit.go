@@ -0,0 +1,133 @@
+package main
+
+import (
+	"expvar"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Peers are supposed to be closed as soon as their reader or writer
+// stops, but a lost message or a forgotten error path leaves them
+// half-dead: still listed, holding a socket and goroutines, never
+// transferring anything. Sessions audit their peers regularly and close
+// those; connections no session claims anymore are closed as well.
+
+// A connection no session claimed for that many audits is closed
+const orphanAudits = 5
+
+var (
+	peerMetrics = expvar.NewMap("peers")
+
+	// Half-dead or orphan peers closed by audits
+	leakedPeers = new(expvar.Int)
+
+	// Peers closed because they didn't accept our messages in time
+	stalledPeers = new(expvar.Int)
+
+	// Peers that left our requests unanswered
+	snubbedPeers = new(expvar.Int)
+
+	// Goroutines reading, writing and queueing for peers. Accessed
+	// atomically.
+	peerGoroutines int64
+)
+
+func init() {
+	peerMetrics.Set("leaked", leakedPeers)
+	peerMetrics.Set("stalled", stalledPeers)
+	peerMetrics.Set("snubbed", snubbedPeers)
+	peerMetrics.Set("open", expvar.Func(func() interface{} { return livePeers.len() }))
+	peerMetrics.Set("goroutines", expvar.Func(func() interface{} { return atomic.LoadInt64(&peerGoroutines) }))
+}
+
+// peerRegistry knows all the open peer connections of the process, and
+// when a session last claimed each of them.
+type peerRegistry struct {
+	sync.Mutex
+	claimed map[*peerState]time.Time
+}
+
+var livePeers = &peerRegistry{claimed: make(map[*peerState]time.Time)}
+
+func (r *peerRegistry) add(p *peerState, now time.Time) {
+	r.Lock()
+	r.claimed[p] = now
+	r.Unlock()
+}
+
+func (r *peerRegistry) remove(p *peerState) {
+	r.Lock()
+	delete(r.claimed, p)
+	r.Unlock()
+}
+
+func (r *peerRegistry) claim(p *peerState, now time.Time) {
+	r.Lock()
+	if _, ok := r.claimed[p]; ok {
+		r.claimed[p] = now
+	}
+	r.Unlock()
+}
+
+func (r *peerRegistry) len() int {
+	r.Lock()
+	defer r.Unlock()
+	return len(r.claimed)
+}
+
+// sweep closes the connections no session claimed for orphanAudits
+// audits, and returns how many.
+func (r *peerRegistry) sweep(now time.Time) (n int) {
+	maxAge := orphanAudits * *keepAliveInterval
+	var orphans []*peerState
+	r.Lock()
+	for p, last := range r.claimed {
+		if now.Sub(last) > maxAge {
+			orphans = append(orphans, p)
+		}
+	}
+	r.Unlock()
+
+	for _, p := range orphans {
+		p.Close()
+	}
+	leakedPeers.Add(int64(len(orphans)))
+	return len(orphans)
+}
+
+// isClosed tells whether p was closed.
+func (p *peerState) isClosed() bool {
+	select {
+	case <-p.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// isHalfDead tells whether p is closed, or one of its reader or writer
+// stopped.
+func (p *peerState) isHalfDead() bool {
+	return p.isClosed() || atomic.LoadInt32(&p.readerDone) != 0 || atomic.LoadInt32(&p.writerDone) != 0
+}
+
+// auditPeers claims the peers of a session and returns those that were
+// already half-dead at the previous audit: the message that should have
+// closed them was lost. It also closes the connections nobody claims.
+func auditPeers(peers *Peers, now time.Time) (zombies []*peerState) {
+	for _, p := range peers.All() {
+		livePeers.claim(p, now)
+		if !p.isHalfDead() {
+			p.suspect = false
+			continue
+		}
+		if p.suspect {
+			zombies = append(zombies, p)
+		}
+		p.suspect = true
+	}
+	leakedPeers.Add(int64(len(zombies)))
+	livePeers.sweep(now)
+	return
+}
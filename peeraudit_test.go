@@ -0,0 +1,138 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAuditPeers(t *testing.T) {
+	peers := newPeers()
+	healthy := stripePeer("a", 1000, 2000)
+	halfDead := stripePeer("b", 1001, 2001)
+	defer healthy.Close()
+	defer halfDead.Close()
+	peers.peerList = []*peerState{healthy, halfDead}
+
+	now := time.Now()
+	if zombies := auditPeers(peers, now); len(zombies) != 0 {
+		t.Fatalf("Expected no zombie, got %d", len(zombies))
+	}
+
+	atomic.StoreInt32(&halfDead.readerDone, 1)
+	if zombies := auditPeers(peers, now); len(zombies) != 0 {
+		t.Fatal("Expected a half-dead peer to get a chance to be closed normally")
+	}
+	zombies := auditPeers(peers, now)
+	if len(zombies) != 1 || zombies[0] != halfDead {
+		t.Fatalf("Expected the half-dead peer to be a zombie, got %v", zombies)
+	}
+}
+
+func TestSweepOrphanPeers(t *testing.T) {
+	claimed := stripePeer("a", 1000, 2000)
+	orphan := stripePeer("b", 1001, 2001)
+	defer claimed.Close()
+	defer orphan.Close()
+
+	later := time.Now().Add(orphanAudits**keepAliveInterval + time.Minute)
+	livePeers.claim(claimed, later)
+	livePeers.sweep(later)
+	if !orphan.isClosed() {
+		t.Error("Expected a peer no session claims to be closed")
+	}
+	if claimed.isClosed() {
+		t.Error("Expected a claimed peer to stay open")
+	}
+	livePeers.Lock()
+	_, registered := livePeers.claimed[orphan]
+	livePeers.Unlock()
+	if registered {
+		t.Error("Expected a closed peer to be forgotten")
+	}
+}
+
+func TestPeerCloseStopsWriter(t *testing.T) {
+	p := stripePeer("a", 1000, 2000)
+	errors := make(chan peerMessage, 1)
+	done := make(chan struct{})
+	go func() {
+		p.peerWriter(errors)
+		close(done)
+	}()
+	p.Close()
+	p.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the writer to stop once the peer is closed")
+	}
+
+	sent := make(chan struct{})
+	go func() {
+		p.sendMessage([]byte{UNCHOKE})
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("Expected sending to a closed peer not to block")
+	}
+}
+
+func TestPeerIdle(t *testing.T) {
+	now := time.Now()
+	p := &peerState{connectedAt: now.Add(-time.Hour)}
+	if !p.idle(now) {
+		t.Error("Expected a peer that never sent anything to be idle")
+	}
+	p.lastReadTime = now.Add(-time.Second)
+	if p.idle(now) {
+		t.Error("Expected a peer that just sent something not to be idle")
+	}
+	p.lastReadTime = now.Add(-*idleTimeout - time.Second)
+	if !p.idle(now) {
+		t.Error("Expected a silent peer to be idle")
+	}
+
+	defer func(d time.Duration) { *idleTimeout = d }(*idleTimeout)
+	*idleTimeout = 0
+	if p.idle(now) {
+		t.Error("Expected no peer to be idle with the timeout disabled")
+	}
+}
+
+func TestPeerWriteStall(t *testing.T) {
+	now := time.Now()
+	p := &peerState{connectedAt: now.Add(-time.Hour)}
+	if p.writeStalled(now) {
+		t.Error("Expected a peer with nothing to write not to be stalled")
+	}
+
+	p.queued = 2
+	p.written = 1
+	p.lastWritten = now.Add(-time.Second).UnixNano()
+	if p.writeStalled(now) {
+		t.Error("Expected a peer that just accepted a message not to be stalled")
+	}
+	p.lastWritten = now.Add(-*writeStall - time.Second).UnixNano()
+	if !p.writeStalled(now) {
+		t.Error("Expected a peer that accepts nothing to be stalled")
+	}
+	// Our upload limit holds the message back, not the peer
+	p.throttled = 1
+	if p.writeStalled(now) {
+		t.Error("Expected a peer waiting for our upload limit not to be stalled")
+	}
+	p.throttled = 0
+
+	// Nothing was ever written
+	p.lastWritten = 0
+	if !p.writeStalled(now) {
+		t.Error("Expected a peer that never accepted anything to be stalled")
+	}
+	p.connectedAt = now
+	if p.writeStalled(now) {
+		t.Error("Expected a new peer not to be stalled")
+	}
+}
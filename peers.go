@@ -15,24 +15,27 @@ func newPeers() *Peers {
 	return &Peers{peerList: make([]*peerState, 0)}
 }
 
+// Know tells whether we are connected to the host of peer, inbound or
+// outbound. If id isn't empty, the connection must also be to that peer
+// id.
 func (lp *Peers) Know(peer, id string) bool {
+	candidateHost, _, err := net.SplitHostPort(peer)
+	if err != nil {
+		return false
+	}
+
 	lp.Lock()
 	defer lp.Unlock()
 
 	for _, p := range lp.peerList {
-		if p.id != id {
+		if id != "" && p.id != id {
 			continue
 		}
 
 		phost, _, err := net.SplitHostPort(p.address)
 		if err != nil {
-			return false
-		}
-		candidateHost, _, err := net.SplitHostPort(peer)
-		if err != nil {
-			return false
+			continue
 		}
-
 		if phost == candidateHost {
 			return true
 		}
@@ -52,6 +55,36 @@ func (lp *Peers) All() []*peerState {
 	return ret
 }
 
+// ByAddress returns the peer connected from or to addr, or listening on
+// addr, or nil.
+func (lp *Peers) ByAddress(addr string) *peerState {
+	lp.Lock()
+	defer lp.Unlock()
+
+	for _, p := range lp.peerList {
+		if p.address == addr || p.listenAddress() == addr {
+			return p
+		}
+	}
+	return nil
+}
+
+// CountID returns how many connections we have to the device with id.
+func (lp *Peers) CountID(id string) int {
+	lp.Lock()
+	defer lp.Unlock()
+	return lp.countID(id)
+}
+
+func (lp *Peers) countID(id string) (n int) {
+	for _, p := range lp.peerList {
+		if p.id == id {
+			n++
+		}
+	}
+	return
+}
+
 func (lp *Peers) Len() (l int) {
 	lp.Lock()
 	l = len(lp.peerList)
@@ -91,6 +124,18 @@ func (lp *Peers) Add(peer *peerState) (keep bool) {
 	lp.Lock()
 	defer lp.Unlock()
 
+	// Additional connections to a device are kept, up to what we agreed
+	// upon with it
+	for _, p := range lp.peerList {
+		if p.id == peer.id && !p.stripe {
+			if lp.countID(peer.id) < p.stripes() {
+				lp.peerList = append(lp.peerList, peer)
+				return true
+			}
+			break
+		}
+	}
+
 	toDelete := make([]int, 0)
 
 	for i, p := range lp.peerList {
@@ -113,11 +158,19 @@ func (lp *Peers) Add(peer *peerState) (keep bool) {
 		toDelete = append(toDelete, i)
 	}
 
-	// Remove old ones
-	for _, delIdx := range toDelete {
-		lp.peerList[delIdx].Close()
-		lp.peerList[delIdx] = lp.peerList[len(lp.peerList)-1]
-		lp.peerList = lp.peerList[:len(lp.peerList)]
+	// Remove old ones. Indices are from the start, so the list is
+	// rebuilt rather than shuffled.
+	if len(toDelete) > 0 {
+		kept := make([]*peerState, 0, len(lp.peerList))
+		for i, p := range lp.peerList {
+			if len(toDelete) > 0 && toDelete[0] == i {
+				toDelete = toDelete[1:]
+				p.Close()
+				continue
+			}
+			kept = append(kept, p)
+		}
+		lp.peerList = kept
 	}
 
 	lp.peerList = append(lp.peerList, peer)
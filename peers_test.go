@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestPeersKnow(t *testing.T) {
+	peers := newPeers()
+	// An inbound connection, from an ephemeral port
+	p := stripePeer("device", 6881, 51234)
+	peers.Add(p)
+
+	if !peers.Know("10.0.0.2:6881", "") {
+		t.Error("Expected to know the host of an inbound connection")
+	}
+	if !peers.Know("10.0.0.2:6881", "device") {
+		t.Error("Expected to know the host with its id")
+	}
+	if peers.Know("10.0.0.2:6881", "other") {
+		t.Error("Expected not to know another id")
+	}
+	if peers.Know("10.0.0.3:6881", "") || peers.Know("nonsense", "") {
+		t.Error("Expected not to know other hosts")
+	}
+}
+
+func TestPeersAddReplacesDuplicate(t *testing.T) {
+	peers := newPeers()
+	old := stripePeer("a", 3000, 4000)
+	other := &peerState{conn: addrConn{
+		local:  &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 3001},
+		remote: &net.TCPAddr{IP: net.ParseIP("10.0.0.3"), Port: 4001},
+	}}
+	if !peers.Add(old) || !peers.Add(other) {
+		t.Fatal("Expected peers of distinct hosts to be added")
+	}
+
+	better := stripePeer("b", 1000, 2000)
+	if !peers.Add(better) {
+		t.Fatal("Expected the connection with the lowest ports to win")
+	}
+	if peers.Len() != 2 {
+		t.Errorf("Expected the duplicate to be removed, got %d peers", peers.Len())
+	}
+	if !old.isClosed() {
+		t.Error("Expected the duplicate to be closed")
+	}
+	if peers.Add(stripePeer("c", 5000, 6000)) {
+		t.Error("Expected a worse duplicate not to be added")
+	}
+}
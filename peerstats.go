@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rakoo/rakoshare/pkg/id"
+)
+
+// Channels of PeerStats
+const (
+	peerChannelControl = "control"
+	peerChannelData    = "data"
+)
+
+// PeerStats is what a running share tells about one of its peers.
+type PeerStats struct {
+	Address      string    `json:"address"`
+	Channel      string    `json:"channel"`
+	Client       string    `json:"client,omitempty"`
+	Outbound     bool      `json:"outbound"`
+	LAN          bool      `json:"lan"`
+	Uploaded     int64     `json:"uploaded"`
+	Downloaded   int64     `json:"downloaded"`
+	UploadRate   float64   `json:"uploadRate"`
+	DownloadRate float64   `json:"downloadRate"`
+	Connected    time.Time `json:"connected"`
+	LastError    string    `json:"lastError,omitempty"`
+}
+
+func (p *peerState) stats(channel string) PeerStats {
+	return PeerStats{
+		Address:      p.address,
+		Channel:      channel,
+		Client:       p.client,
+		Outbound:     p.outbound,
+		LAN:          p.lan,
+		Uploaded:     p.totalUploaded,
+		Downloaded:   p.totalDownloaded,
+		UploadRate:   p.uploadRate,
+		DownloadRate: p.downloadRate,
+		Connected:    p.connectedAt,
+		LastError:    p.lastError,
+	}
+}
+
+// setError records an error with p that didn't close the connection.
+func (p *peerState) setError(err error) {
+	p.lastError = err.Error()
+}
+
+// peerStatsSnapshot holds the statistics of the peers of a session, as
+// its main loop last saw them, for other goroutines to read.
+type peerStatsSnapshot struct {
+	sync.Mutex
+	stats []PeerStats
+}
+
+// update takes a snapshot of peers. It must be called from the main loop
+// of their session.
+func (s *peerStatsSnapshot) update(peers *Peers, channel string) {
+	var stats []PeerStats
+	for _, p := range peers.All() {
+		stats = append(stats, p.stats(channel))
+	}
+	s.Lock()
+	s.stats = stats
+	s.Unlock()
+}
+
+func (s *peerStatsSnapshot) get() []PeerStats {
+	s.Lock()
+	defer s.Unlock()
+	return append([]PeerStats(nil), s.stats...)
+}
+
+// fetchPeers asks the share listening at addr for the statistics of its
+// peers.
+func fetchPeers(client *http.Client, addr string) (peers []PeerStats, err error) {
+	resp, err := client.Get("http://" + addr + "/peers")
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(&peers)
+	return
+}
+
+// ListPeers prints the peers of a running share.
+func ListPeers(cliId, workDir string) error {
+	shareID, err := id.NewFromString(cliId)
+	if err != nil {
+		return newUserError(msgBadID, err)
+	}
+	session, err := openSession(workDir, shareID)
+	if err != nil {
+		return newUserError(msgOpenSession, err)
+	}
+	addr := session.GetSetting(settingAPI)
+	if addr == "" {
+		return newUserError(msgShareNotRunning)
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	peers, err := fetchPeers(client, addr)
+	if err != nil {
+		return err
+	}
+	if len(peers) == 0 {
+		fmt.Println(T(msgNoPeers))
+		return nil
+	}
+
+	now := time.Now()
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, T(msgPeersHeader))
+	for _, p := range peers {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s/s\t%s/s\t%s\t%s\t%s\t%s\n",
+			p.Address, p.Channel, p.Client,
+			humanBytes(int64(p.UploadRate)), humanBytes(int64(p.DownloadRate)),
+			humanBytes(p.Uploaded), humanBytes(p.Downloaded),
+			now.Sub(p.Connected)/time.Second*time.Second, p.LastError)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPeerStats(t *testing.T) {
+	p := &peerState{address: "1.2.3.4:5", client: "rakoshare", downloaded: 300, uploaded: 100}
+	p.updateRates(1)
+	p.downloaded = 200
+	p.updateRates(1)
+	p.setError(errCorruptPiece)
+
+	peers := &Peers{peerList: []*peerState{p}}
+	var snapshot peerStatsSnapshot
+	snapshot.update(peers, peerChannelData)
+
+	stats := snapshot.get()
+	if len(stats) != 1 {
+		t.Fatalf("Expected 1 peer, got %d", len(stats))
+	}
+	s := stats[0]
+	if s.Downloaded != 500 || s.Uploaded != 100 {
+		t.Errorf("Expected 500 bytes down and 100 up, got %d and %d", s.Downloaded, s.Uploaded)
+	}
+	if s.Address != p.address || s.Client != p.client || s.Channel != peerChannelData {
+		t.Errorf("Unexpected stats %+v", s)
+	}
+	if s.LastError != errCorruptPiece.Error() {
+		t.Errorf("Expected last error %q, got %q", errCorruptPiece, s.LastError)
+	}
+}
+
+func TestShareAPIPeers(t *testing.T) {
+	api := &shareAPI{}
+	w := httptest.NewRecorder()
+	api.servePeers(w, httptest.NewRequest("GET", "/peers", nil))
+	if body := w.Body.String(); body != "[]\n" {
+		t.Errorf("Expected an empty list, got %q", body)
+	}
+
+	api.SetPeers([]PeerStats{{Address: "1.2.3.4:5", Channel: peerChannelControl}})
+	w = httptest.NewRecorder()
+	api.servePeers(w, httptest.NewRequest("GET", "/peers", nil))
+	var peers []PeerStats
+	if err := json.NewDecoder(w.Body).Decode(&peers); err != nil || len(peers) != 1 || peers[0].Address != "1.2.3.4:5" {
+		t.Errorf("Expected the peer we set, got %v, %v", peers, err)
+	}
+}
@@ -26,6 +26,7 @@ const (
 type pexPeer struct {
 	address string
 	id      string
+	listen  string
 }
 
 var (
@@ -62,6 +63,10 @@ type PexMessage struct {
 	Added   string "added"
 	AddedF  string "added.f"
 	Dropped string "dropped"
+
+	// Peers reachable through Tor or I2P, as host:port, which don't fit
+	// in the compact lists
+	Overlay []string `bencode:"bs_overlay"`
 }
 
 // The main loop.
@@ -79,25 +84,37 @@ type PexMessage struct {
 //
 // "dropped" is the set of peers we were connected to last time that
 // we aren't currently connected to.
-func (t *TorrentSession) StartPex() {
-	for _ = range time.Tick(1 * time.Minute) {
+func (t *TorrentSession) StartPex(tick <-chan time.Time) {
+	for _ = range tick {
 		newLastPeers := make([]pexPeer, 0)
 
 		numadded := 0
 		added := ""
 		addedf := ""
+		var overlay []string
 
 		// TODO randomize to distribute more evenly
 		for _, peer := range t.peers.All() {
-			newLastPeers = append(newLastPeers, pexPeer{peer.address, peer.id})
+			newLastPeers = append(newLastPeers, pexPeer{peer.address, peer.id, peer.listenAddress()})
 
 			if contains(lastPeers, peer) {
 				continue
 			}
-			added += nettools.DottedPortToBinary(peer.address)
+			if listen := peer.listenAddress(); isOverlay(peerHost(listen)) {
+				overlay = append(overlay, listen)
+				numadded += 1
+				if numadded >= MAX_PEERS {
+					break
+				}
+				continue
+			}
+			added += nettools.DottedPortToBinary(peer.listenAddress())
 
-			// We don't manage those yet
-			addedf += string(0x00)
+			var flags byte
+			if supportsHolepunch(peer) {
+				flags |= SUPPORTS_HOLE_PUNCHING
+			}
+			addedf += string([]byte{flags})
 
 			numadded += 1
 			if numadded >= MAX_PEERS {
@@ -107,8 +124,8 @@ func (t *TorrentSession) StartPex() {
 
 		dropped := ""
 		for _, lastPeer := range lastPeers {
-			if !t.peers.Know(lastPeer.address, lastPeer.id) {
-				dropped += nettools.DottedPortToBinary(lastPeer.address)
+			if !t.peers.Know(lastPeer.address, lastPeer.id) && !isOverlay(peerHost(lastPeer.listen)) {
+				dropped += nettools.DottedPortToBinary(lastPeer.listen)
 			}
 		}
 
@@ -117,6 +134,7 @@ func (t *TorrentSession) StartPex() {
 				Added:   added,
 				AddedF:  addedf,
 				Dropped: dropped,
+				Overlay: overlay,
 			})
 		}
 
@@ -133,8 +151,14 @@ func (t *TorrentSession) DoPex(msg []byte, p *peerState) {
 	}
 
 	for _, peer := range stringToPeers(message.Added) {
+		t.relays.add(peer, p.address)
 		t.hintNewPeer(peer)
 	}
+	for _, peer := range message.Overlay {
+		if isOverlay(peerHost(peer)) {
+			t.hintNewPeer(peer)
+		}
+	}
 
 	// We don't use those yet, but this is possibly how we would
 	//for _, flag := range stringToFlags(message.AddedF) {
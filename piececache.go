@@ -0,0 +1,88 @@
+package main
+
+import (
+	"container/list"
+	"flag"
+	"log"
+)
+
+var pieceCacheSize = flag.Int64("pieceCacheSize", 32*1024*1024, "Memory each share uses to keep the pieces it serves most, in bytes. 0 disables the cache")
+
+// pieceCache keeps the most recently served pieces in memory, so that
+// peers asking for the same popular pieces don't make us read them from
+// disk again and again. Only verified pieces go in. Only the main loop of
+// the session uses it.
+type pieceCache struct {
+	size   int64
+	pieces map[int]*list.Element
+	lru    *list.List // Most recently used first
+}
+
+type cachedPiece struct {
+	index int
+	data  []byte
+}
+
+func newPieceCache() *pieceCache {
+	return &pieceCache{pieces: make(map[int]*list.Element), lru: list.New()}
+}
+
+func (c *pieceCache) get(index int) ([]byte, bool) {
+	e, ok := c.pieces[index]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*cachedPiece).data, true
+}
+
+// add caches data as the piece index, dropping the least recently used
+// pieces to stay within max bytes. Pieces bigger than max aren't cached.
+func (c *pieceCache) add(index int, data []byte, max int64) {
+	if int64(len(data)) > max {
+		return
+	}
+	if _, ok := c.pieces[index]; ok {
+		return
+	}
+	c.pieces[index] = c.lru.PushFront(&cachedPiece{index, data})
+	c.size += int64(len(data))
+	for c.size > max {
+		oldest := c.lru.Back()
+		piece := oldest.Value.(*cachedPiece)
+		c.lru.Remove(oldest)
+		delete(c.pieces, piece.index)
+		c.size -= int64(len(piece.data))
+	}
+}
+
+// clear empties the cache, for instance when the files change.
+func (c *pieceCache) clear() {
+	c.pieces = make(map[int]*list.Element)
+	c.lru.Init()
+	c.size = 0
+}
+
+// readBlock reads a block of a piece we have into p, through the cache.
+func (t *TorrentSession) readBlock(p []byte, index, begin uint32) error {
+	pieceLength := t.m.Info.PieceLength
+	if *pieceCacheSize <= 0 {
+		_, err := t.fileStore.ReadAt(p, int64(index)*pieceLength+int64(begin))
+		return err
+	}
+
+	data, ok := t.pieceCache.get(int(index))
+	if !ok {
+		data = make([]byte, pieceSize(t.totalSize, pieceLength, int(index)))
+		if _, err := t.fileStore.ReadAt(data, int64(index)*pieceLength); err != nil {
+			return err
+		}
+		if t.m.pieceMatches(int(index), data) {
+			t.pieceCache.add(int(index), data, *pieceCacheSize)
+		} else {
+			log.Printf("[TORRENT] Piece %d changed on disk since it was verified", index)
+		}
+	}
+	copy(p, data[begin:])
+	return nil
+}
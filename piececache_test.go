@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestPieceCache(t *testing.T) {
+	c := newPieceCache()
+	c.add(0, make([]byte, 4), 10)
+	c.add(1, make([]byte, 4), 10)
+	c.get(0)
+	// 1 is the least recently used
+	c.add(2, make([]byte, 4), 10)
+	if _, ok := c.get(1); ok {
+		t.Error("Expected piece 1 to be dropped")
+	}
+	if _, ok := c.get(0); !ok {
+		t.Error("Expected piece 0 to stay")
+	}
+	if c.size != 8 {
+		t.Errorf("Expected 8 bytes cached, got %d", c.size)
+	}
+
+	c.add(3, make([]byte, 11), 10)
+	if _, ok := c.get(3); ok {
+		t.Error("Expected a piece bigger than the cache not to be cached")
+	}
+	c.clear()
+	if _, ok := c.get(0); ok || c.size != 0 {
+		t.Error("Expected an empty cache")
+	}
+}
+
+func TestReadBlockCache(t *testing.T) {
+	tf := tests[0]
+	fs, _ := mkFileStore(tf)
+	piece := make([]byte, 25)
+	fs.ReadAt(piece, 0)
+	sumA, _ := hex.DecodeString(tf.hashPieceA)
+	pieces := string(sumA) + string(make([]byte, len(sumA)))
+	m := &MetaInfo{Info: &InfoDict{PieceLength: 25, Pieces: pieces}}
+	ts := &TorrentSession{m: m, fileStore: fs, totalSize: tf.fileLen, pieceCache: newPieceCache()}
+
+	block := make([]byte, 5)
+	if err := ts.readBlock(block, 0, 10); err != nil || string(block) != string(piece[10:15]) {
+		t.Fatalf("Unexpected block %q, %v", block, err)
+	}
+	if _, ok := ts.pieceCache.get(0); !ok {
+		t.Error("Expected the verified piece to be cached")
+	}
+	// Piece 1 doesn't match its hash here, so it is served but not cached
+	if err := ts.readBlock(block, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ts.pieceCache.get(1); ok {
+		t.Error("Expected an unverified piece not to be cached")
+	}
+}
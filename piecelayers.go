@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"log"
+)
+
+// Hash requests (BEP 52) fetch the piece layers of v2 torrents, which
+// aren't part of the info dictionary exchanged as metadata. A layer is
+// asked for by chunks of up to maxLayerHashes hashes, each with the proof
+// hashes that link it to the pieces root of its file.
+
+// Most hashes asked for at once, as BEP 52 recommends
+const maxLayerHashes = 512
+
+var errBadHashRequest = errors.New("invalid hash request")
+
+// supportsV2 tells whether the peer that sent header supports v2
+// torrents.
+func supportsV2(header []byte) bool {
+	return header[7]&0x10 == 0x10
+}
+
+// hashRequest is the header of the hash request, hashes and hash reject
+// messages.
+type hashRequest struct {
+	root   string
+	base   uint32 // The layer, counted from the blocks
+	index  uint32 // Of the first hash in its layer
+	length uint32
+	proofs uint32 // Number of proof layers
+}
+
+const hashRequestLength = 1 + sha256.Size + 16
+
+func (r hashRequest) encode(messageId byte, hashes []byte) []byte {
+	msg := make([]byte, hashRequestLength, hashRequestLength+len(hashes))
+	msg[0] = messageId
+	copy(msg[1:], r.root)
+	binary.BigEndian.PutUint32(msg[33:], r.base)
+	binary.BigEndian.PutUint32(msg[37:], r.index)
+	binary.BigEndian.PutUint32(msg[41:], r.length)
+	binary.BigEndian.PutUint32(msg[45:], r.proofs)
+	return append(msg, hashes...)
+}
+
+// decodeHashRequest returns the header of message and the hashes after
+// it.
+func decodeHashRequest(message []byte) (r hashRequest, hashes []byte, err error) {
+	if len(message) < hashRequestLength {
+		return r, nil, errBadHashRequest
+	}
+	r.root = string(message[1:33])
+	r.base = binary.BigEndian.Uint32(message[33:])
+	r.index = binary.BigEndian.Uint32(message[37:])
+	r.length = binary.BigEndian.Uint32(message[41:])
+	r.proofs = binary.BigEndian.Uint32(message[45:])
+	return r, message[hashRequestLength:], nil
+}
+
+func log2(n int) (l uint32) {
+	for n > 1 {
+		n >>= 1
+		l++
+	}
+	return
+}
+
+// pieceLayerIndex returns the layer of the piece hashes of a tree.
+func pieceLayerIndex(pieceLength int64) uint32 {
+	return log2(blocksOf(pieceLength))
+}
+
+// layerTree returns the layers of the tree of a file from its piece
+// layer, padded to a power of two, up to its root.
+func layerTree(layer []byte, pieceLength int64) [][][]byte {
+	n := len(layer) / sha256.Size
+	bottom := make([][]byte, nextPow2(n))
+	pad := pieceRoot(nil, blocksOf(pieceLength))
+	for i := range bottom {
+		if i < n {
+			bottom[i] = layer[i*sha256.Size : (i+1)*sha256.Size]
+		} else {
+			bottom[i] = pad
+		}
+	}
+
+	tree := [][][]byte{bottom}
+	for len(bottom) > 1 {
+		next := make([][]byte, len(bottom)/2)
+		for i := range next {
+			h := sha256.New()
+			h.Write(bottom[2*i])
+			h.Write(bottom[2*i+1])
+			next[i] = h.Sum(nil)
+		}
+		tree = append(tree, next)
+		bottom = next
+	}
+	return tree
+}
+
+// layerRequests returns the requests that fetch the piece layer of a
+// file of n pieces.
+func layerRequests(root string, n int, pieceLength int64) (requests []hashRequest) {
+	width := nextPow2(n)
+	length := width
+	if length > maxLayerHashes {
+		length = maxLayerHashes
+	}
+	for index := 0; index < n; index += length {
+		requests = append(requests, hashRequest{
+			root:   root,
+			base:   pieceLayerIndex(pieceLength),
+			index:  uint32(index),
+			length: uint32(length),
+			proofs: log2(width) - log2(length),
+		})
+	}
+	return
+}
+
+// answerHashRequest returns the hashes r asks for from the piece layer of
+// its file, followed by their proof hashes.
+func answerHashRequest(r hashRequest, layer []byte, pieceLength int64) ([]byte, bool) {
+	tree := layerTree(layer, pieceLength)
+	width := len(tree[0])
+	if r.base != pieceLayerIndex(pieceLength) || r.length == 0 || r.length&(r.length-1) != 0 ||
+		int(r.length) > width || int(r.index)%int(r.length) != 0 || int(r.index) >= width ||
+		int(log2(int(r.length))+r.proofs) >= len(tree) {
+		return nil, false
+	}
+
+	var hashes []byte
+	for _, h := range tree[0][r.index : r.index+r.length] {
+		hashes = append(hashes, h...)
+	}
+	level := log2(int(r.length))
+	node := int(r.index / r.length)
+	for i := uint32(0); i < r.proofs; i++ {
+		hashes = append(hashes, tree[level+i][node^1]...)
+		node /= 2
+	}
+	return hashes, true
+}
+
+// checkHashes checks the hashes answering r against the root of the file
+// and returns those of its piece layer.
+func checkHashes(r hashRequest, hashes []byte) ([]byte, bool) {
+	if len(hashes) != int(r.length+r.proofs)*sha256.Size || r.length == 0 || r.length&(r.length-1) != 0 {
+		return nil, false
+	}
+	layer := hashes[:int(r.length)*sha256.Size]
+	subtree := make([][]byte, r.length)
+	for i := range subtree {
+		subtree[i] = layer[i*sha256.Size : (i+1)*sha256.Size]
+	}
+	node := merkleRoot(subtree, len(subtree), nil)
+	position := r.index / r.length
+	for proof := hashes[len(layer):]; len(proof) > 0; proof = proof[sha256.Size:] {
+		h := sha256.New()
+		if position%2 == 0 {
+			h.Write(node)
+			h.Write(proof[:sha256.Size])
+		} else {
+			h.Write(proof[:sha256.Size])
+			h.Write(node)
+		}
+		node = h.Sum(nil)
+		position /= 2
+	}
+	return layer, position == 0 && bytes.Equal(node, []byte(r.root))
+}
+
+// layerFetch is a piece layer being fetched.
+type layerFetch struct {
+	layer    []byte
+	requests []hashRequest
+	got      map[uint32]bool // By index
+}
+
+func (f *layerFetch) asked(r hashRequest) bool {
+	for _, q := range f.requests {
+		if q == r {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchLayers starts fetching the piece layers we miss, if any, from our
+// peers.
+func (t *TorrentSession) fetchLayers() {
+	t.layers = make(map[string]*layerFetch)
+	if !t.m.Info.pureV2() {
+		t.needLayers = false
+		return
+	}
+	pieceLength := t.m.Info.PieceLength
+	for _, f := range t.m.Info.v2Files() {
+		n := int((f.Length + pieceLength - 1) / pieceLength)
+		if f.Length <= pieceLength || len(t.m.PieceLayers[f.Root]) == n*sha256.Size {
+			continue
+		}
+		t.layers[f.Root] = &layerFetch{
+			layer:    make([]byte, n*sha256.Size),
+			requests: layerRequests(f.Root, n, pieceLength),
+			got:      make(map[uint32]bool),
+		}
+	}
+	t.needLayers = len(t.layers) > 0
+	if t.needLayers {
+		log.Printf("[TORRENT] Fetching the piece layers of %d files\n", len(t.layers))
+		for _, p := range t.peers.All() {
+			t.requestLayers(p)
+		}
+	}
+}
+
+// requestLayers asks p for the parts of the piece layers we miss.
+func (t *TorrentSession) requestLayers(p *peerState) {
+	if !t.needLayers || !p.v2 {
+		return
+	}
+	for _, fetch := range t.layers {
+		for _, r := range fetch.requests {
+			if !fetch.got[r.index] {
+				p.sendMessage(r.encode(HASH_REQUEST, nil))
+			}
+		}
+	}
+}
+
+func (t *TorrentSession) hashMessage(message []byte, p *peerState) error {
+	if !p.v2 {
+		return errors.New("Hash message from a peer that doesn't support v2 torrents")
+	}
+	r, hashes, err := decodeHashRequest(message)
+	if err != nil {
+		return err
+	}
+
+	switch message[0] {
+	case HASH_REQUEST:
+		if len(hashes) != 0 {
+			return errBadHashRequest
+		}
+		if layer, ok := t.m.PieceLayers[r.root]; ok {
+			if answer, ok := answerHashRequest(r, []byte(layer), t.m.Info.PieceLength); ok {
+				p.sendMessage(r.encode(HASHES, answer))
+				return nil
+			}
+		}
+		p.sendMessage(r.encode(HASH_REJECT, nil))
+	case HASHES:
+		fetch, ok := t.layers[r.root]
+		if !ok || !fetch.asked(r) || fetch.got[r.index] {
+			return nil
+		}
+		layer, ok := checkHashes(r, hashes)
+		if !ok {
+			return errors.New("Hashes don't match their pieces root")
+		}
+		copy(fetch.layer[int(r.index)*sha256.Size:], layer)
+		fetch.got[r.index] = true
+		if len(fetch.got) < len(fetch.requests) {
+			return nil
+		}
+		if t.m.PieceLayers == nil {
+			t.m.PieceLayers = make(map[string]string)
+		}
+		t.m.PieceLayers[r.root] = string(fetch.layer)
+		t.m.cacheV2Pieces()
+		delete(t.layers, r.root)
+		if len(t.layers) == 0 {
+			t.layersComplete()
+		}
+	case HASH_REJECT:
+		log.Printf("[TORRENT] %s doesn't have the piece layer of %x\n", p.address, r.root)
+	}
+	return nil
+}
+
+// layersComplete checks the pieces again once all the piece layers are
+// known, and starts downloading those we miss.
+func (t *TorrentSession) layersComplete() {
+	log.Println("[TORRENT] Got all the piece layers")
+	t.needLayers = false
+	t.miChan <- t.m
+	if err := t.load(); err != nil {
+		log.Println("Couldn't check the pieces:", err)
+		return
+	}
+	for _, p := range t.peers.All() {
+		for i := 0; i < t.totalPieces; i++ {
+			if t.pieceSet.IsSet(i) {
+				haveMsg := make([]byte, 5)
+				haveMsg[0] = HAVE
+				binary.BigEndian.PutUint32(haveMsg[1:5], uint32(i))
+				p.sendMessage(haveMsg)
+			}
+		}
+		if p.have == nil {
+			continue
+		}
+		t.checkInteresting(p)
+		if !p.peer_choking {
+			for i := 0; i < p.maxOurRequests(); i++ {
+				if err := t.RequestBlock(p); err != nil {
+					break
+				}
+			}
+		}
+	}
+}
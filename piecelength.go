@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+)
+
+var fixedPieceLength = flag.Int64("pieceLength", 0, "Length of the pieces of the torrents made of shares, in bytes: a power of two of at least 16384. 0 picks it from the size of the share")
+
+// Automatic piece lengths are the smallest power of two giving no more
+// than maxAutoPieces pieces, so that shares have between 1000 and 2000
+// pieces unless they are very small or very large.
+const (
+	minPieceLength = merkleBlockSize
+	maxPieceLength = 16 << 20
+	maxAutoPieces  = 2000
+)
+
+// pieceLengthFor returns the piece length of a torrent of size bytes.
+func pieceLengthFor(size int64) int64 {
+	if fixed := *fixedPieceLength; fixed != 0 {
+		if fixed >= minPieceLength && fixed&(fixed-1) == 0 {
+			return fixed
+		}
+		log.Printf("Invalid piece length %d, picking one from the size of the share\n", fixed)
+	}
+	length := int64(minPieceLength)
+	for length < maxPieceLength && size/length >= maxAutoPieces {
+		length <<= 1
+	}
+	return length
+}
+
+// shareSize returns the size of the files of dir that go in its torrent.
+func shareSize(dir string, ignored func(relPath string) bool) (size int64, err error) {
+	err = torrentWalk(dir, ignored, func(path string, info os.FileInfo, perr error) error {
+		if perr != nil {
+			return perr
+		}
+		size += info.Size()
+		return nil
+	})
+	return
+}
@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestPieceLengthFor(t *testing.T) {
+	vectors := []struct {
+		size, length int64
+	}{
+		{0, 16 << 10},
+		{10 << 20, 16 << 10},
+		{100 << 20, 64 << 10},
+		{4 << 30, 4 << 20},
+		{1 << 40, 16 << 20},
+	}
+	for _, v := range vectors {
+		if length := pieceLengthFor(v.size); length != v.length {
+			t.Errorf("%d bytes: expected pieces of %d, got %d", v.size, v.length, length)
+		}
+	}
+
+	defer func(length int64) { *fixedPieceLength = length }(*fixedPieceLength)
+	*fixedPieceLength = 1 << 20
+	if length := pieceLengthFor(10 << 20); length != 1<<20 {
+		t.Errorf("Expected the fixed length, got %d", length)
+	}
+	*fixedPieceLength = 1000
+	if length := pieceLengthFor(10 << 20); length != 16<<10 {
+		t.Errorf("Expected invalid lengths to be ignored, got %d", length)
+	}
+}
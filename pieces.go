@@ -5,21 +5,23 @@ import (
 	"crypto/sha1"
 	"errors"
 	"fmt"
-	"runtime"
 
 	"github.com/rakoo/rakoshare/pkg/bitset"
 )
 
-func checkPieces(fs FileStore, totalLength int64, m *MetaInfo) (good, bad int, goodBits *bitset.Bitset, err error) {
+func checkPieces(fs FileStore, totalLength int64, m *MetaInfo, progress *VerifyProgress) (good, bad int, goodBits *bitset.Bitset, err error) {
 	pieceLength := m.Info.PieceLength
 	numPieces := int((totalLength + pieceLength - 1) / pieceLength)
 	goodBits = bitset.New(int(numPieces))
+	if m.Info.pureV2() {
+		return checkPiecesV2(fs, totalLength, m, goodBits, progress)
+	}
 	ref := m.Info.Pieces
 	if len(ref) != numPieces*sha1.Size {
 		err = errors.New(fmt.Sprintf("Incorrect Info.Pieces length: expected %d, got %d", len(ref), numPieces*sha1.Size))
 		return
 	}
-	currentSums, err := computeSums(fs, totalLength, m.Info.PieceLength)
+	currentSums, err := computeSums(fs, totalLength, m.Info.PieceLength, progress)
 	if err != nil {
 		return
 	}
@@ -30,13 +32,38 @@ func checkPieces(fs FileStore, totalLength int64, m *MetaInfo) (good, bad int, g
 			good++
 			goodBits.Set(int(i))
 		} else {
-			fs.SetBad(int64(i) * pieceLength)
+			fs.SetBad(int64(i)*pieceLength, pieceSize(totalLength, pieceLength, i))
 			bad++
 		}
 	}
 	return
 }
 
+// checkPiecesV2 checks the pieces of a v2 torrent against their merkle
+// trees. Pieces of files whose piece layer we miss are bad.
+func checkPiecesV2(fs FileStore, totalLength int64, m *MetaInfo, goodBits *bitset.Bitset, progress *VerifyProgress) (good, bad int, _ *bitset.Bitset, err error) {
+	pieceLength := m.Info.PieceLength
+	pieces := m.v2Pieces()
+	if numPieces := int((totalLength + pieceLength - 1) / pieceLength); len(pieces) != numPieces {
+		err = fmt.Errorf("Incorrect number of pieces: expected %d, got %d", numPieces, len(pieces))
+		return
+	}
+	matches := make([]bool, len(pieces))
+	hashPieces(fs, totalLength, pieceLength, progress, func(i int, data []byte) {
+		matches[i] = pieces[i].matches(data)
+	})
+	for i, ok := range matches {
+		if ok {
+			good++
+			goodBits.Set(i)
+		} else {
+			fs.SetBad(int64(i)*pieceLength, pieceSize(totalLength, pieceLength, i))
+			bad++
+		}
+	}
+	return good, bad, goodBits, nil
+}
+
 func checkEqual(ref, current []byte) bool {
 	for i := 0; i < len(current); i++ {
 		if ref[i] != current[i] {
@@ -51,55 +78,46 @@ type chunk struct {
 	data []byte
 }
 
-// computeSums reads the file content and computes the SHA1 hash for each
-// piece. Spawns parallel goroutines to compute the hashes, since each
-// computation takes ~30ms.
-func computeSums(fs FileStore, totalLength int64, pieceLength int64) (sums []byte, err error) {
-	// Calculate the SHA1 hash for each piece in parallel goroutines.
-	hashes := make(chan chunk)
-	results := make(chan chunk, 3)
-	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
-		go hashPiece(hashes, results)
+// pieceSize returns the length of piece in a torrent of totalLength bytes:
+// pieceLength for all pieces but the last one, which holds what is left.
+// It is 0 for pieces out of range.
+func pieceSize(totalLength, pieceLength int64, piece int) int64 {
+	if piece < 0 || pieceLength <= 0 {
+		return 0
 	}
+	begin := int64(piece) * pieceLength
+	if begin >= totalLength {
+		return 0
+	}
+	if totalLength-begin < pieceLength {
+		return totalLength - begin
+	}
+	return pieceLength
+}
 
-	// Read file content and send to "pieces", keeping order.
+// computeSums reads the file content and computes the SHA1 hash for each
+// piece.
+func computeSums(fs FileStore, totalLength int64, pieceLength int64, progress *VerifyProgress) (sums []byte, err error) {
 	numPieces := (totalLength + pieceLength - 1) / pieceLength
-	go func() {
-		for i := int64(0); i < numPieces; i++ {
-			piece := make([]byte, pieceLength, pieceLength)
-			if i == numPieces-1 {
-				piece = piece[0 : totalLength-i*pieceLength]
-			}
-			// Ignore errors.
-			fs.ReadAt(piece, i*pieceLength)
-			hashes <- chunk{i: i, data: piece}
-		}
-		close(hashes)
-	}()
-
-	// Merge back the results.
 	sums = make([]byte, sha1.Size*numPieces)
-	for i := int64(0); i < numPieces; i++ {
-		h := <-results
-		copy(sums[h.i*sha1.Size:], h.data)
-	}
+	hashPieces(fs, totalLength, pieceLength, progress, func(piece int, data []byte) {
+		sum := sha1.Sum(data)
+		copy(sums[piece*sha1.Size:], sum[:])
+	})
 	return
 }
 
-func hashPiece(h chan chunk, result chan chunk) {
-	hasher := sha1.New()
-	for piece := range h {
-		hasher.Reset()
-		_, err := hasher.Write(piece.data)
-		if err != nil {
-			result <- chunk{piece.i, nil}
-		} else {
-			result <- chunk{piece.i, hasher.Sum(nil)}
+func checkPiece(fs FileStore, totalLength int64, m *MetaInfo, pieceIndex int) (good bool, err error) {
+	if m.Info.pureV2() {
+		piece := make([]byte, pieceSize(totalLength, m.Info.PieceLength, pieceIndex))
+		if _, err = fs.ReadAt(piece, int64(pieceIndex)*m.Info.PieceLength); err != nil {
+			return
 		}
+		if good = m.pieceMatches(pieceIndex, piece); !good {
+			err = fmt.Errorf("piece %d doesn't match its merkle tree", pieceIndex)
+		}
+		return
 	}
-}
-
-func checkPiece(fs FileStore, totalLength int64, m *MetaInfo, pieceIndex int) (good bool, err error) {
 	ref := m.Info.Pieces
 	currentSum, err := computePieceSum(fs, totalLength, m.Info.PieceLength, pieceIndex)
 	if err != nil {
@@ -116,12 +134,8 @@ func checkPiece(fs FileStore, totalLength int64, m *MetaInfo, pieceIndex int) (g
 }
 
 func computePieceSum(fs FileStore, totalLength int64, pieceLength int64, pieceIndex int) (sum []byte, err error) {
-	numPieces := (totalLength + pieceLength - 1) / pieceLength
 	hasher := sha1.New()
-	piece := make([]byte, pieceLength)
-	if int64(pieceIndex) == numPieces-1 {
-		piece = piece[0 : totalLength-int64(pieceIndex)*pieceLength]
-	}
+	piece := make([]byte, pieceSize(totalLength, pieceLength, pieceIndex))
 	_, err = fs.ReadAt(piece, int64(pieceIndex)*pieceLength)
 	if err != nil {
 		return
@@ -13,7 +13,7 @@ func TestComputeSums(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
-		sums, err := computeSums(fs, testFile.fileLen, pieceLen)
+		sums, err := computeSums(fs, testFile.fileLen, pieceLen, nil)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -30,3 +30,25 @@ func TestComputeSums(t *testing.T) {
 		}
 	}
 }
+
+func TestPieceSize(t *testing.T) {
+	vectors := []struct {
+		total, pieceLength int64
+		piece              int
+		expected           int64
+	}{
+		{100, 25, 0, 25},
+		{100, 25, 3, 25}, // last piece is a full piece
+		{100, 25, 4, 0},
+		{101, 25, 4, 1}, // last piece holds a single byte
+		{10, 25, 0, 10}, // single piece shorter than the piece length
+		{10, 25, 1, 0},
+		{100, 25, -1, 0},
+		{0, 25, 0, 0},
+	}
+	for _, v := range vectors {
+		if got := pieceSize(v.total, v.pieceLength, v.piece); got != v.expected {
+			t.Errorf("pieceSize(%d, %d, %d): expected %d, got %d", v.total, v.pieceLength, v.piece, v.expected, got)
+		}
+	}
+}
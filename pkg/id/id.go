@@ -2,8 +2,10 @@ package id
 
 import (
 	"bytes"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha1"
+	"crypto/sha256"
 	"errors"
 	"io"
 
@@ -24,16 +26,46 @@ var (
 var (
 	errInvalidId       = errors.New("Invalid id")
 	errInvalidInfoHash = errors.New("Programming error: Invalid infohash generated")
+	errCantRead        = errors.New("Id can't read")
+	errCantWrite       = errors.New("Id can't write")
+	errNoRotation      = errors.New("No key to rotate")
+	errCantVerify      = errors.New("Id doesn't know the key of the writers")
 )
 
 type PubKey [ed.PublicKeySize]byte
 type PrivKey [ed.PrivateKeySize]byte
 type PreSharedKey [32]byte
+type ReadKey [32]byte
 
 // len = 20
 type infohash []byte
 
-func deriveFromSeed(seed [32]byte) (priv PrivKey, pub PubKey, psk PreSharedKey, ih infohash, err error) {
+// kdfParams are the scrypt parameters of a version of the derivation of
+// the keys of an id. The version is kept in the high bits of the role byte
+// of ids, so that ids made with older versions keep their keys.
+type kdfParams struct {
+	N, r, p int
+
+	// Salts of the derivation of the psk and of the infohash. Without
+	// them, the input is its own salt.
+	pskSalt, ihSalt string
+
+	// Whether the read capability is a secret of its own, derived from
+	// the private key. Before, it was the public key, which every holder
+	// of a revision signed by the writers can see.
+	readSecret bool
+}
+
+var kdfVersions = []kdfParams{
+	{N: 1 << 16, r: 8, p: 1},
+	{N: 1 << 17, r: 8, p: 1, pskSalt: "rakoshare psk", ihSalt: "rakoshare infohash"},
+	{N: 1 << 17, r: 8, p: 1, pskSalt: "rakoshare psk", ihSalt: "rakoshare infohash", readSecret: true},
+}
+
+// The version of the derivation of new ids
+const currentKDF = 2
+
+func deriveFromSeed(seed [32]byte, kdf byte) (priv PrivKey, pub PubKey, read ReadKey, psk PreSharedKey, ih infohash, err error) {
 	// priv/pub key
 	tmpPub, tmpPriv, err := ed.GenerateKey(bytes.NewReader(seed[:32]))
 	if err != nil {
@@ -41,23 +73,43 @@ func deriveFromSeed(seed [32]byte) (priv PrivKey, pub PubKey, psk PreSharedKey,
 	}
 	priv = *tmpPriv
 	pub = *tmpPub
-	psk, err = deriveScrypt(pub)
-
+	read = deriveRead(priv, kdf)
+	psk, err = derivePsk(read, kdf)
 	if err != nil {
 		return
 	}
+	ih, err = deriveInfohash(psk, kdf)
+	return
+}
 
-	outscrypt, err := deriveScrypt(psk)
-	if err != nil {
+// deriveRead returns the read capability of the writer with key priv.
+func deriveRead(priv PrivKey, kdf byte) (read ReadKey) {
+	if !kdfVersions[kdf].readSecret {
+		copy(read[:], priv[32:])
 		return
 	}
-	ih = outscrypt[:sha1.Size]
-
+	mac := hmac.New(sha256.New, priv[:32])
+	mac.Write([]byte("rakoshare read key"))
+	copy(read[:], mac.Sum(nil))
 	return
 }
 
-func deriveScrypt(in [32]byte) (psk [32]byte, err error) {
-	out, err := scrypt.Key(in[:], in[:], 1<<16, 8, 1, 32)
+func derivePsk(read ReadKey, kdf byte) (PreSharedKey, error) {
+	return deriveScrypt(read, kdfVersions[kdf].pskSalt, kdf)
+}
+
+func deriveInfohash(psk PreSharedKey, kdf byte) (infohash, error) {
+	out, err := deriveScrypt(psk, kdfVersions[kdf].ihSalt, kdf)
+	return out[:sha1.Size], err
+}
+
+func deriveScrypt(in [32]byte, salt string, kdf byte) (psk [32]byte, err error) {
+	params := kdfVersions[kdf]
+	s := in[:]
+	if salt != "" {
+		s = []byte(salt)
+	}
+	out, err := scrypt.Key(in[:], s, params.N, params.r, params.p, 32)
 	if err != nil {
 		return
 	}
@@ -82,19 +134,34 @@ func deriveScrypt(in [32]byte) (psk [32]byte, err error) {
 // cannot read it (because the actual content is encrypted). The
 // corresponding value is StoreID.
 //
+// After a rotation of the read key or of the write key alone, the read
+// key can't be derived from the private key anymore: the WriteReadStore
+// ID carries both.
+//
+// Read and store IDs also carry the public key of the writers, so that
+// they can check what writers sign but can't sign anything themselves.
+// IDs of the first versions lack it: their read capability is the public
+// key itself.
+//
 // Finally, when derived a third time, we get a infohash like the
 // Bittorrent ones, that is used to find peers.
 type Id struct {
 	Priv     PrivKey
 	canWrite bool
 
-	Pub     PubKey
+	Pub       PubKey
+	canVerify bool
+
+	Read    ReadKey
 	canRead bool
 
 	Psk PreSharedKey
 
 	// This is automatically generated from Psk. It must be 20 bytes long
 	Infohash []byte
+
+	// The version of the derivation of Read, Psk and Infohash
+	kdf byte
 }
 
 func New() (Id, error) {
@@ -105,23 +172,61 @@ func New() (Id, error) {
 		return Id{}, err
 	}
 
-	priv, pub, psk, ih, err := deriveFromSeed(randSeed)
+	priv, pub, read, psk, ih, err := deriveFromSeed(randSeed, currentKDF)
 
 	id := Id{
 		Priv:     priv,
 		canWrite: true,
 
-		Pub:     pub,
+		Pub:       pub,
+		canVerify: true,
+
+		Read:    read,
 		canRead: true,
 
 		Psk: psk,
 
 		Infohash: ih,
+
+		kdf: currentKDF,
 	}
 
 	return id, err
 }
 
+// Rotate returns an id for the same share with new write keys, a new read
+// key, or both, so that the holders of the old ones lose their access.
+// Only writers can rotate keys. Keeping the read key keeps the swarm of
+// the share, unless id is of an older version.
+func (id Id) Rotate(read, write bool) (Id, error) {
+	if !id.canWrite {
+		return Id{}, errCantWrite
+	}
+	if !read && !write {
+		return Id{}, errNoRotation
+	}
+	rotated, err := New()
+	if err != nil {
+		return Id{}, err
+	}
+	if !write {
+		rotated.Priv, rotated.Pub = id.Priv, id.Pub
+	}
+	switch {
+	case !read:
+		rotated.Read = id.Read
+	case !write:
+		if _, err = io.ReadFull(rand.Reader, rotated.Read[:]); err != nil {
+			return Id{}, err
+		}
+	}
+	if rotated.Psk, err = derivePsk(rotated.Read, rotated.kdf); err != nil {
+		return Id{}, err
+	}
+	rotated.Infohash, err = deriveInfohash(rotated.Psk, rotated.kdf)
+	return rotated, err
+}
+
 func (id Id) CanWrite() bool {
 	return id.canWrite
 }
@@ -130,13 +235,72 @@ func (id Id) CanRead() bool {
 	return id.canRead
 }
 
+// readSecret tells whether the read capability of id is a secret of its
+// own rather than the public key.
+func (id Id) readSecret() bool {
+	return int(id.kdf) < len(kdfVersions) && kdfVersions[id.kdf].readSecret
+}
+
+// CanVerify tells whether id knows the public key of the writers, to
+// check what they sign.
+func (id Id) CanVerify() bool {
+	return id.canVerify
+}
+
+// WriterKey returns the public key of the writers of the share.
+func (id Id) WriterKey() (PubKey, error) {
+	if !id.canVerify {
+		return PubKey{}, errCantVerify
+	}
+	return id.Pub, nil
+}
+
+// DataKey returns the key of the connections that carry the content of
+// the share. It is derived from the read capability, so that only its
+// holders can get the content: holders of the store capability only know
+// Psk, which is derived from it through scrypt and can't be reversed.
+func (id Id) DataKey() (key PreSharedKey, err error) {
+	if !id.CanRead() {
+		err = errCantRead
+		return
+	}
+	mac := hmac.New(sha256.New, id.Read[:])
+	mac.Write([]byte("rakoshare data key"))
+	copy(key[:], mac.Sum(nil))
+	return
+}
+
+// SealKey returns the secret the keys of sealed pieces are derived from:
+// replicas that only store the share keep its pieces sealed, and can't
+// read them.
+func (id Id) SealKey() (key PreSharedKey, err error) {
+	if !id.CanRead() {
+		err = errCantRead
+		return
+	}
+	mac := hmac.New(sha256.New, id.Read[:])
+	mac.Write([]byte("rakoshare seal key"))
+	copy(key[:], mac.Sum(nil))
+	return
+}
+
+// SealedKey returns the key of the connections that carry sealed pieces,
+// which every holder of the store capability knows.
+func (id Id) SealedKey() (key PreSharedKey) {
+	mac := hmac.New(sha256.New, id.Psk[:])
+	mac.Write([]byte("rakoshare sealed data key"))
+	copy(key[:], mac.Sum(nil))
+	return
+}
+
 func (id Id) WRS() string {
 	if !id.CanWrite() {
 		return ""
 	}
-	wrs := make([]byte, len(id.Priv)+1)
-	wrs[0] = byte(ROLE_WRITEREADSTORE)
-	copy(wrs[1:], id.Priv[:])
+	wrs := append([]byte{id.kdf<<4 | byte(ROLE_WRITEREADSTORE)}, id.Priv[:]...)
+	if id.readSecret() && id.Read != deriveRead(id.Priv, id.kdf) {
+		wrs = append(wrs, id.Read[:]...)
+	}
 	return base58.Encode(wrs)
 }
 
@@ -144,16 +308,18 @@ func (id Id) RS() string {
 	if !id.CanRead() {
 		return ""
 	}
-	rs := make([]byte, len(id.Pub)+1)
-	rs[0] = byte(ROLE_READSTORE)
-	copy(rs[1:], id.Pub[:])
+	rs := append([]byte{id.kdf<<4 | byte(ROLE_READSTORE)}, id.Read[:]...)
+	if id.readSecret() {
+		rs = append(rs, id.Pub[:]...)
+	}
 	return base58.Encode(rs)
 }
 
 func (id Id) S() string {
-	s := make([]byte, len(id.Psk)+1)
-	s[0] = byte(ROLE_STORE)
-	copy(s[1:], id.Psk[:])
+	s := append([]byte{id.kdf<<4 | byte(ROLE_STORE)}, id.Psk[:]...)
+	if id.readSecret() {
+		s = append(s, id.Pub[:]...)
+	}
 	return base58.Encode(s)
 }
 
@@ -167,94 +333,67 @@ func NewFromString(in string) (id Id, err error) {
 		return
 	}
 
-	role := Role(decoded[0])
+	role := Role(decoded[0] & 0x0f)
+	kdf := decoded[0] >> 4
+	if int(kdf) >= len(kdfVersions) {
+		err = errInvalidId
+		return
+	}
+	id.kdf = kdf
+	readSecret := kdfVersions[kdf].readSecret
+	key := decoded[1:]
 	switch role {
 	case ROLE_WRITEREADSTORE:
-		if len(decoded[1:]) != ed.PrivateKeySize {
-			err = errInvalidId
-			break
-		}
-
-		priv := decoded[1:]
-		var privId PrivKey
-		copy(privId[:], priv)
-
-		pub := priv[32:]
-		var pubId PubKey
-		copy(pubId[:], pub)
-
-		psk, err := deriveScrypt(pubId)
-		if err != nil {
-			break
-		}
-
-		outscrypt, err := deriveScrypt(psk)
-		if err != nil {
-			break
-		}
-
-		id = Id{
-			Priv:     privId,
-			canWrite: true,
-
-			Pub:     pubId,
-			canRead: true,
-
-			Psk: psk,
-
-			Infohash: outscrypt[:sha1.Size],
+		switch {
+		case len(key) == ed.PrivateKeySize:
+			copy(id.Priv[:], key)
+			id.Read = deriveRead(id.Priv, kdf)
+		case readSecret && len(key) == ed.PrivateKeySize+len(id.Read):
+			copy(id.Priv[:], key)
+			copy(id.Read[:], key[ed.PrivateKeySize:])
+		default:
+			return id, errInvalidId
 		}
-
+		copy(id.Pub[:], key[32:])
+		id.canWrite = true
+		id.canVerify = true
+		id.canRead = true
 	case ROLE_READSTORE:
-		if len(decoded[1:]) != ed.PublicKeySize {
-			err = errInvalidId
-			break
-		}
-
-		pub := decoded[1:]
-		var pubId PubKey
-		copy(pubId[:], pub)
-
-		psk, err := deriveScrypt(pubId)
-		if err != nil {
-			break
-		}
-
-		outscrypt, err := deriveScrypt(psk)
-		if err != nil {
-			break
-		}
-
-		id = Id{
-			Pub:     pubId,
-			canRead: true,
-
-			Psk: psk,
-
-			Infohash: outscrypt[:sha1.Size],
+		if readSecret {
+			if len(key) != 64 {
+				return id, errInvalidId
+			}
+			copy(id.Pub[:], key[32:])
+			id.canVerify = true
+		} else if len(key) != ed.PublicKeySize {
+			return id, errInvalidId
+		} else {
+			// The read capability of old ids is the public key
+			copy(id.Pub[:], key)
+			id.canVerify = true
 		}
+		copy(id.Read[:], key)
+		id.canRead = true
 	case ROLE_STORE:
-		if len(decoded[1:]) != 32 {
-			err = errInvalidId
-			break
-		}
-
-		var psk PreSharedKey
-		copy(psk[:], decoded[1:])
-
-		outscrypt, err := deriveScrypt(psk)
-		if err != nil {
-			break
-		}
-
-		id = Id{
-			Psk: psk,
-
-			Infohash: outscrypt[:sha1.Size],
+		if readSecret {
+			if len(key) != 64 {
+				return id, errInvalidId
+			}
+			copy(id.Pub[:], key[32:])
+			id.canVerify = true
+		} else if len(key) != 32 {
+			return id, errInvalidId
 		}
+		copy(id.Psk[:], key)
 	default:
-		err = errInvalidId
+		return id, errInvalidId
 	}
 
+	if id.canRead {
+		if id.Psk, err = derivePsk(id.Read, kdf); err != nil {
+			return
+		}
+	}
+	id.Infohash, err = deriveInfohash(id.Psk, kdf)
 	return
 }
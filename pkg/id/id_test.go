@@ -1,6 +1,7 @@
 package id
 
 import (
+	"bytes"
 	"encoding/hex"
 	"testing"
 )
@@ -77,3 +78,153 @@ func TestNewFromStringWRS(t *testing.T) {
 		t.Fatalf("Invalid infohash: expected %s, got %s", expectedih, hexih)
 	}
 }
+
+func TestDataKey(t *testing.T) {
+	var read ReadKey
+	copy(read[:], "0123456789abcdef0123456789abcdef")
+
+	store := Id{Read: read}
+	if _, err := store.DataKey(); err == nil {
+		t.Fatal("A store-only id shouldn't have a data key")
+	}
+
+	reader := Id{Read: read, canRead: true}
+	key, err := reader.DataKey()
+	if err != nil {
+		t.Fatal("Couldn't derive data key: ", err)
+	}
+	if bytes.Equal(key[:], read[:]) {
+		t.Fatal("The data key shouldn't be the read key")
+	}
+	again, _ := reader.DataKey()
+	if key != again {
+		t.Fatal("The data key should be stable")
+	}
+}
+
+func TestKDFVersions(t *testing.T) {
+	id, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.kdf != currentKDF {
+		t.Fatalf("Expected new ids to use version %d, got %d", currentKDF, id.kdf)
+	}
+	for _, s := range []string{id.WRS(), id.RS(), id.S()} {
+		parsed, err := NewFromString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed.kdf != id.kdf || parsed.Psk != id.Psk || !bytes.Equal(parsed.Infohash, id.Infohash) {
+			t.Errorf("%s: the keys don't survive a round trip", s)
+		}
+	}
+
+	// Ids of the first version keep their keys
+	legacy := Id{Psk: id.Psk}
+	parsed, err := NewFromString(legacy.S())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := deriveScrypt(id.Psk, "", 0)
+	if !bytes.Equal(parsed.Infohash, expected[:20]) {
+		t.Error("The infohash of version 0 ids changed")
+	}
+	if bytes.Equal(parsed.Infohash, id.Infohash) {
+		t.Error("Versions should derive different infohashes")
+	}
+
+	unknown := Id{Psk: id.Psk, kdf: byte(len(kdfVersions))}
+	if _, err := NewFromString(unknown.S()); err == nil {
+		t.Error("Unknown versions should be refused")
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	id, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Read == ReadKey(id.Pub) {
+		t.Fatal("The read key shouldn't be the public key")
+	}
+	key, _ := id.DataKey()
+
+	vectors := []struct {
+		in                 string
+		write, read, check bool
+	}{
+		{id.WRS(), true, true, true},
+		{id.RS(), false, true, true},
+		{id.S(), false, false, true},
+	}
+	for _, v := range vectors {
+		parsed, err := NewFromString(v.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed.CanWrite() != v.write || parsed.CanRead() != v.read || parsed.CanVerify() != v.check {
+			t.Errorf("%s: expected write %t, read %t and verify %t", v.in, v.write, v.read, v.check)
+		}
+		if pub, err := parsed.WriterKey(); err != nil || pub != id.Pub {
+			t.Errorf("%s: expected the public key of the writers", v.in)
+		}
+		if v.read {
+			if pkey, _ := parsed.DataKey(); pkey != key {
+				t.Errorf("%s: expected the data key of the writers", v.in)
+			}
+		} else if parsed.Read != (ReadKey{}) {
+			t.Errorf("%s: a store id shouldn't know the read key", v.in)
+		}
+	}
+
+	// Knowing the public key isn't enough to read
+	fromPub := Id{Read: ReadKey(id.Pub), canRead: true}
+	if pkey, _ := fromPub.DataKey(); pkey == key {
+		t.Error("The data key shouldn't be derived from the public key")
+	}
+}
+
+func TestRotate(t *testing.T) {
+	id, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := id.Rotate(false, false); err == nil {
+		t.Error("Rotating nothing should fail")
+	}
+	reader, _ := NewFromString(id.RS())
+	if _, err := reader.Rotate(true, true); err == nil {
+		t.Error("Readers shouldn't rotate keys")
+	}
+
+	vectors := []struct {
+		read, write bool
+	}{
+		{true, false},
+		{false, true},
+		{true, true},
+	}
+	for _, v := range vectors {
+		rotated, err := id.Rotate(v.read, v.write)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (rotated.Pub != id.Pub) != v.write {
+			t.Errorf("%v: expected the write keys to change: %t", v, v.write)
+		}
+		if (rotated.Read != id.Read) != v.read {
+			t.Errorf("%v: expected the read key to change: %t", v, v.read)
+		}
+		if bytes.Equal(rotated.Infohash, id.Infohash) == v.read {
+			t.Errorf("%v: expected the swarm to change: %t", v, v.read)
+		}
+		parsed, err := NewFromString(rotated.WRS())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed.Pub != rotated.Pub || parsed.Read != rotated.Read || parsed.Psk != rotated.Psk {
+			t.Errorf("%v: the rotated keys don't survive a round trip", v)
+		}
+	}
+}
@@ -39,6 +39,68 @@ var (
 		)`,
 		//`INSERT INTO meta VALUES ("", "", "", "", "")`,
 	}
+
+	// Tables added after the initial schema. They are created on every
+	// open so that older session files are upgraded transparently.
+	MIGRATIONS = []string{
+		`CREATE TABLE IF NOT EXISTS pending(
+			torrent string,
+			infohash string,
+			lastmodtime string,
+			reason string,
+			confirmed integer
+		)`,
+
+		`CREATE TABLE IF NOT EXISTS trackers(
+			url string primary key
+		)`,
+
+		`CREATE TABLE IF NOT EXISTS deltas(
+			infohash string,
+			delta integer,
+			time string
+		)`,
+
+		`CREATE TABLE IF NOT EXISTS announces(
+			infohash string primary key,
+			peer string
+		)`,
+
+		`CREATE TABLE IF NOT EXISTS settings(
+			name string primary key,
+			value string
+		)`,
+
+		`CREATE TABLE IF NOT EXISTS downloads(
+			device string primary key,
+			time string
+		)`,
+
+		`CREATE TABLE IF NOT EXISTS contents(
+			path string primary key,
+			size integer,
+			checksum string
+		)`,
+
+		`CREATE TABLE IF NOT EXISTS revisions(
+			infohash string,
+			rev string,
+			time string,
+			signer string,
+			torrent string
+		)`,
+
+		`CREATE TABLE IF NOT EXISTS hashes(
+			path string primary key,
+			size integer,
+			modtime integer,
+			inode integer,
+			piecelength integer,
+			phase integer,
+			checksum string,
+			pieces blob
+		)`,
+	}
 )
 
 type Session struct {
@@ -66,6 +128,12 @@ func New(path string) (*Session, error) {
 			}
 		}
 	}
+	for _, str := range MIGRATIONS {
+		_, err := db.Exec(str)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	session := &Session{db}
 	go session.watchPeers()
@@ -131,9 +199,205 @@ func (s *Session) getFromMeta(query string) string {
 
 func (s *Session) SaveTorrent(torrent []byte, infohash, lastModTime string) error {
 	_, err := s.db.Exec(Q_INSERT_TORRENT, torrent, infohash, lastModTime)
+	if err != nil {
+		return err
+	}
+	// Revisions from peers are recorded before we have their torrent
+	_, err = s.db.Exec(`UPDATE revisions SET torrent = ? WHERE infohash = ?`, torrent, infohash)
+	return err
+}
+
+// HistoryEntry is a revision the share went through.
+type HistoryEntry struct {
+	Infohash string
+	Rev      string
+	Time     string
+	Signer   string
+}
+
+// AddRevision records that the share moved to a new revision, and forgets
+// all but the last keep ones.
+func (s *Session) AddRevision(infohash, rev, when, signer string, keep int) error {
+	var torrent string
+	if s.GetCurrentInfohash() == infohash {
+		torrent = s.GetCurrentTorrent()
+	}
+	_, err := s.db.Exec(`INSERT INTO revisions VALUES (?, ?, ?, ?, ?)`, infohash, rev, when, signer, torrent)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`DELETE FROM revisions WHERE rowid NOT IN
+		(SELECT rowid FROM revisions ORDER BY rowid DESC LIMIT ?)`, keep)
+	return err
+}
+
+// GetHistory returns the recorded revisions, most recent first.
+func (s *Session) GetHistory() (entries []HistoryEntry, err error) {
+	rows, err := s.db.Query(`SELECT infohash, rev, time, signer FROM revisions ORDER BY rowid DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e HistoryEntry
+		if err := rows.Scan(&e.Infohash, &e.Rev, &e.Time, &e.Signer); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// GetRevisionTorrent returns the torrent of a recorded revision, or an
+// empty string if we never had it.
+func (s *Session) GetRevisionTorrent(infohash string) (torrent string) {
+	err := s.db.QueryRow(`SELECT torrent FROM revisions WHERE infohash = ? AND torrent != ''
+		ORDER BY rowid DESC LIMIT 1`, infohash).Scan(&torrent)
+	if err != nil && err != sql.ErrNoRows {
+		log.Println(err)
+	}
+	return
+}
+
+// PruneRevisionTorrents forgets the torrents of all but the last keep
+// revisions. The revisions stay in the history, but can't be published
+// again.
+func (s *Session) PruneRevisionTorrents(keep int) (int64, error) {
+	res, err := s.db.Exec(`UPDATE revisions SET torrent = '' WHERE torrent != '' AND rowid NOT IN
+		(SELECT rowid FROM revisions ORDER BY rowid DESC LIMIT ?)`, keep)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// SavePendingTorrent stores a torrent that is held back until the user
+// confirms it. Only one torrent can be pending at a time: a new one
+// replaces the previous one.
+func (s *Session) SavePendingTorrent(torrent []byte, infohash, lastModTime, reason string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM pending`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO pending VALUES (?, ?, ?, ?, 0)`, torrent, infohash, lastModTime, reason)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetPendingTorrent returns the torrent currently held back, if any, and
+// whether the user confirmed it.
+func (s *Session) GetPendingTorrent() (torrent, infohash, lastModTime, reason string, confirmed bool) {
+	var c int
+	err := s.db.QueryRow(`SELECT torrent, infohash, lastmodtime, reason, confirmed FROM pending`).Scan(
+		&torrent, &infohash, &lastModTime, &reason, &c)
+	if err != nil {
+		return "", "", "", "", false
+	}
+	return torrent, infohash, lastModTime, reason, c != 0
+}
+
+// ConfirmPending marks the pending torrent as accepted by the user. It
+// returns false if there was nothing to confirm.
+func (s *Session) ConfirmPending() (bool, error) {
+	res, err := s.db.Exec(`UPDATE pending SET confirmed=1`)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *Session) DeletePending() error {
+	_, err := s.db.Exec(`DELETE FROM pending`)
+	return err
+}
+
+// SaveRevisionDelta records how many bytes changed with the revision
+// whose data torrent has the given infohash.
+func (s *Session) SaveRevisionDelta(infohash string, delta int64, when string) error {
+	_, err := s.db.Exec(`INSERT INTO deltas VALUES (?, ?, ?)`, infohash, delta, when)
+	return err
+}
+
+// PruneRevisionDeltas forgets the deltas of all but the last keep
+// revisions.
+func (s *Session) PruneRevisionDeltas(keep int) (int64, error) {
+	res, err := s.db.Exec(`DELETE FROM deltas WHERE rowid NOT IN
+		(SELECT rowid FROM deltas ORDER BY rowid DESC LIMIT ?)`, keep)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// GetRevisionDeltas returns the deltas of the last n revisions, most
+// recent first.
+func (s *Session) GetRevisionDeltas(n int) (deltas []int64, err error) {
+	rows, err := s.db.Query(`SELECT delta FROM deltas ORDER BY rowid DESC LIMIT ?`, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var delta int64
+		if err := rows.Scan(&delta); err != nil {
+			return nil, err
+		}
+		deltas = append(deltas, delta)
+	}
+	return deltas, rows.Err()
+}
+
+// SaveAnnounce queues the announce of a new torrent by a peer. If the
+// same torrent is already queued, only its peer is updated so that it
+// keeps its place.
+func (s *Session) SaveAnnounce(infohash, peer string) error {
+	res, err := s.db.Exec(`UPDATE announces SET peer = ? WHERE infohash = ?`, peer, infohash)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n > 0 {
+		return nil
+	}
+	_, err = s.db.Exec(`INSERT INTO announces VALUES (?, ?)`, infohash, peer)
 	return err
 }
 
+func (s *Session) DeleteAnnounce(infohash string) error {
+	_, err := s.db.Exec(`DELETE FROM announces WHERE infohash = ?`, infohash)
+	return err
+}
+
+// GetAnnounces returns the queued announces, oldest first. The peer of
+// infohashes[i] is peers[i].
+func (s *Session) GetAnnounces() (infohashes, peers []string, err error) {
+	rows, err := s.db.Query(`SELECT infohash, peer FROM announces ORDER BY rowid`)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var infohash, peer string
+		if err := rows.Scan(&infohash, &peer); err != nil {
+			return nil, nil, err
+		}
+		infohashes = append(infohashes, infohash)
+		peers = append(peers, peer)
+	}
+	return infohashes, peers, rows.Err()
+}
+
 func (s *Session) SaveIHMessage(mess []byte) error {
 	_, err := s.db.Exec(Q_INSERT_IHMESSAGE, mess)
 	return err
@@ -145,6 +409,203 @@ func (s *Session) SaveSession(target string, theid id.Id) error {
 	return err
 }
 
+// SetShareId replaces the ids of the share, after a rotation of its keys.
+func (s *Session) SetShareId(theid id.Id) error {
+	_, err := s.db.Exec(`UPDATE meta SET wrs = ?, rs = ?, s = ?`, theid.WRS(), theid.RS(), theid.S())
+	return err
+}
+
+// ForgetSecrets removes from the session the ids that can read or write,
+// once they are kept elsewhere.
+func (s *Session) ForgetSecrets() error {
+	_, err := s.db.Exec(`UPDATE meta SET wrs = '', rs = ''`)
+	return err
+}
+
+// RestoreSecret puts back in the session the ids derived from secret.
+func (s *Session) RestoreSecret(secret string) error {
+	theid, err := id.NewFromString(secret)
+	if err != nil {
+		return err
+	}
+	return s.SetShareId(theid)
+}
+
+// CopyTo writes a copy of the session to a new file at path.
+func (s *Session) CopyTo(path string) error {
+	_, err := s.db.Exec(`VACUUM INTO ?`, path)
+	return err
+}
+
+// GetSetting returns the value of a setting of the share, or "" if it
+// isn't set.
+func (s *Session) GetSetting(name string) string {
+	var value string
+	err := s.db.QueryRow(`SELECT value FROM settings WHERE name = ?`, name).Scan(&value)
+	if err != nil {
+		return ""
+	}
+	return value
+}
+
+func (s *Session) SetSetting(name, value string) error {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO settings VALUES (?, ?)`, name, value)
+	return err
+}
+
+// AddDownload records that device downloaded the whole share, and returns
+// how many distinct devices did so far.
+func (s *Session) AddDownload(device string) (count int, err error) {
+	_, err = s.db.Exec(`INSERT OR IGNORE INTO downloads VALUES (?, ?)`,
+		device, time.Now().Format(time.RFC3339))
+	if err != nil {
+		return
+	}
+	return s.CountDownloads()
+}
+
+// CountDownloads returns how many distinct devices downloaded the whole
+// share.
+func (s *Session) CountDownloads() (count int, err error) {
+	err = s.db.QueryRow(`SELECT COUNT(*) FROM downloads`).Scan(&count)
+	return
+}
+
+// GetContent returns what the content index knows about the file at
+// path, relative to the shared folder.
+func (s *Session) GetContent(path string) (size int64, checksum string, ok bool) {
+	err := s.db.QueryRow(`SELECT size, checksum FROM contents WHERE path = ?`, path).Scan(&size, &checksum)
+	return size, checksum, err == nil
+}
+
+func (s *Session) SaveContent(path string, size int64, checksum string) error {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO contents VALUES (?, ?, ?)`, path, size, checksum)
+	return err
+}
+
+// PruneContents forgets what the content index knows about the paths for
+// which keep returns false.
+func (s *Session) PruneContents(keep func(path string) bool) (removed int64, err error) {
+	rows, err := s.db.Query(`SELECT path FROM contents`)
+	if err != nil {
+		return 0, err
+	}
+	var stale []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if !keep(path) {
+			stale = append(stale, path)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, path := range stale {
+		if _, err = s.db.Exec(`DELETE FROM contents WHERE path = ?`, path); err != nil {
+			return
+		}
+		removed++
+	}
+	return
+}
+
+// Vacuum gives the room of forgotten records back to the system.
+func (s *Session) Vacuum() error {
+	_, err := s.db.Exec(`VACUUM`)
+	return err
+}
+
+// FileHashes is what hashing a file for the torrent gave, along with what
+// tells whether the file changed since.
+type FileHashes struct {
+	Size        int64
+	ModTime     int64 // In nanoseconds since the epoch
+	Inode       uint64
+	PieceLength int64
+	Phase       int64 // Offset of the file in its first piece
+	Checksum    string
+	Pieces      []byte // The hashes of the pieces fully inside the file
+}
+
+// GetFileHashes returns the cached hashes of the files, by path relative
+// to the shared folder.
+func (s *Session) GetFileHashes() (map[string]FileHashes, error) {
+	rows, err := s.db.Query(`SELECT path, size, modtime, inode, piecelength, phase, checksum, pieces FROM hashes`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hashes := make(map[string]FileHashes)
+	for rows.Next() {
+		var path string
+		var h FileHashes
+		var inode int64
+		err := rows.Scan(&path, &h.Size, &h.ModTime, &inode, &h.PieceLength, &h.Phase, &h.Checksum, &h.Pieces)
+		if err != nil {
+			return nil, err
+		}
+		h.Inode = uint64(inode)
+		hashes[path] = h
+	}
+	return hashes, rows.Err()
+}
+
+func (s *Session) SaveFileHashes(path string, h FileHashes) error {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO hashes VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		path, h.Size, h.ModTime, int64(h.Inode), h.PieceLength, h.Phase, h.Checksum, h.Pieces)
+	return err
+}
+
+func (s *Session) DeleteFileHashes(path string) error {
+	_, err := s.db.Exec(`DELETE FROM hashes WHERE path = ?`, path)
+	return err
+}
+
+// GetTrackers returns the trackers configured for this share
+func (s *Session) GetTrackers() (trackers []string) {
+	rows, err := s.db.Query(`SELECT url FROM trackers ORDER BY rowid`)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var url string
+		if err := rows.Scan(&url); err != nil {
+			return
+		}
+		trackers = append(trackers, url)
+	}
+	return
+}
+
+func (s *Session) AddTrackers(trackers []string) error {
+	for _, t := range trackers {
+		_, err := s.db.Exec(`INSERT OR IGNORE INTO trackers VALUES (?)`, t)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Session) RemoveTrackers(trackers []string) error {
+	for _, t := range trackers {
+		_, err := s.db.Exec(`DELETE FROM trackers WHERE url = ?`, t)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (s *Session) SavePeer(peer string, shouldKeep func(peer string) bool) error {
 	validUntil := time.Now().Add(24 * time.Hour)
 	_, err := s.db.Exec(`INSERT OR REPLACE INTO peers VALUES (?, ?)`, peer, validUntil.Format(time.RFC3339))
@@ -207,7 +668,8 @@ func (s *Session) getPeersWithValidity() (peers []peer, err error) {
 func (s *Session) watchPeers() {
 	peers, err := s.getPeersWithValidity()
 	if err != nil {
-		log.Fatal(err)
+		log.Println("Couldn't load peers: ", err)
+		return
 	}
 
 	for _, p := range peers {
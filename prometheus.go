@@ -0,0 +1,211 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The /metrics endpoint serves, in the text format of Prometheus, what
+// operators alert on: shares stuck without peers or whose transfers
+// stopped, peers failing handshakes or sending corrupt pieces, trackers
+// answering slowly. It is served with the other metrics on -httpAddr.
+
+var (
+	// Connections that failed before headers were exchanged, by direction
+	handshakeFailures = expvar.NewMap("handshake_failures")
+
+	// Downloaded pieces that failed verification
+	badPieces = expvar.NewInt("bad_pieces")
+
+	// Announces to trackers, by tracker
+	announceStats = &announceRegistry{
+		latency:  make(map[string]time.Duration),
+		failures: make(map[string]int64),
+	}
+
+	// The statuses of the running shares, by share
+	shareStatuses = &statusRegistry{statuses: make(map[string]func() ShareStatus)}
+)
+
+func init() {
+	http.HandleFunc("/metrics", serveMetrics)
+}
+
+// handshakeFailed counts a connection that failed before headers were
+// exchanged.
+func handshakeFailed(inbound bool) {
+	if inbound {
+		handshakeFailures.Add("inbound", 1)
+	} else {
+		handshakeFailures.Add("outbound", 1)
+	}
+}
+
+type announceRegistry struct {
+	sync.Mutex
+	latency  map[string]time.Duration
+	failures map[string]int64
+}
+
+// observe records how long an announce to tracker took, and whether it
+// failed.
+func (r *announceRegistry) observe(tracker string, took time.Duration, err error) {
+	r.Lock()
+	defer r.Unlock()
+	r.latency[tracker] = took
+	if err != nil {
+		r.failures[tracker]++
+	}
+}
+
+type statusRegistry struct {
+	sync.Mutex
+	statuses map[string]func() ShareStatus
+}
+
+// register makes the status of share, as returned by status, part of the
+// metrics until the returned function is called.
+func (r *statusRegistry) register(share string, status func() ShareStatus) (unregister func()) {
+	r.Lock()
+	r.statuses[share] = status
+	r.Unlock()
+	return func() {
+		r.Lock()
+		delete(r.statuses, share)
+		r.Unlock()
+	}
+}
+
+func (r *statusRegistry) all() map[string]ShareStatus {
+	r.Lock()
+	defer r.Unlock()
+	all := make(map[string]ShareStatus, len(r.statuses))
+	for share, status := range r.statuses {
+		all[share] = status()
+	}
+	return all
+}
+
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetrics(w, time.Now())
+}
+
+func writeMetrics(w io.Writer, now time.Time) {
+	m := metricsWriter{w}
+
+	statuses := shareStatuses.all()
+	shares := make([]string, 0, len(statuses))
+	for share := range statuses {
+		shares = append(shares, share)
+	}
+	sort.Strings(shares)
+
+	m.help("rakoshare_peers", "gauge", "Peers connected, by share and swarm")
+	for _, share := range shares {
+		m.sample("rakoshare_peers", statuses[share].Peers, "share", share, "swarm", "data")
+		m.sample("rakoshare_peers", statuses[share].ControlPeers, "share", share, "swarm", "control")
+	}
+	m.help("rakoshare_uploaded_bytes_total", "counter", "Bytes sent to peers, by share")
+	for _, share := range shares {
+		m.sample("rakoshare_uploaded_bytes_total", statuses[share].Uploaded, "share", share)
+	}
+	m.help("rakoshare_downloaded_bytes_total", "counter", "Bytes received from peers, by share")
+	for _, share := range shares {
+		m.sample("rakoshare_downloaded_bytes_total", statuses[share].Downloaded, "share", share)
+	}
+	m.help("rakoshare_lifetime_uploaded_bytes_total", "counter", "Bytes sent to peers since the share was created, by share")
+	for _, share := range shares {
+		m.sample("rakoshare_lifetime_uploaded_bytes_total", statuses[share].Lifetime.Uploaded, "share", share)
+	}
+	m.help("rakoshare_lifetime_downloaded_bytes_total", "counter", "Bytes received from peers since the share was created, by share")
+	for _, share := range shares {
+		m.sample("rakoshare_lifetime_downloaded_bytes_total", statuses[share].Lifetime.Downloaded, "share", share)
+	}
+	m.help("rakoshare_paused", "gauge", "Whether the transfers of the share are paused")
+	for _, share := range shares {
+		paused := 0
+		if statuses[share].Paused {
+			paused = 1
+		}
+		m.sample("rakoshare_paused", paused, "share", share)
+	}
+	m.help("rakoshare_status_age_seconds", "gauge", "Time since the main loop of the share last refreshed its status")
+	for _, share := range shares {
+		if updated := statuses[share].Updated; !updated.IsZero() {
+			m.sample("rakoshare_status_age_seconds", now.Sub(updated).Seconds(), "share", share)
+		}
+	}
+
+	m.help("rakoshare_loop_stalls_total", "counter", "Times the main loop of a session was found stuck, by session")
+	stallsMetrics.Do(func(kv expvar.KeyValue) {
+		if v, ok := kv.Value.(*expvar.Int); ok {
+			m.sample("rakoshare_loop_stalls_total", v.Value(), "loop", kv.Key)
+		}
+	})
+
+	m.help("rakoshare_open_connections", "gauge", "Peer connections open in the process")
+	m.sample("rakoshare_open_connections", livePeers.len())
+	m.help("rakoshare_handshake_failures_total", "counter", "Connections that failed before headers were exchanged")
+	for _, direction := range []string{"inbound", "outbound"} {
+		var failures int64
+		if v, ok := handshakeFailures.Get(direction).(*expvar.Int); ok {
+			failures = v.Value()
+		}
+		m.sample("rakoshare_handshake_failures_total", failures, "direction", direction)
+	}
+	m.help("rakoshare_piece_verify_failures_total", "counter", "Downloaded pieces that failed verification")
+	m.sample("rakoshare_piece_verify_failures_total", badPieces.Value())
+
+	// The DHT library keeps the size of its routing table
+	if v, ok := expvar.Get("totalNodes").(*expvar.Int); ok {
+		m.help("rakoshare_dht_nodes", "gauge", "Nodes in the routing table of the DHT")
+		m.sample("rakoshare_dht_nodes", v.Value())
+	}
+
+	announceStats.Lock()
+	trackers := make([]string, 0, len(announceStats.latency))
+	for tracker := range announceStats.latency {
+		trackers = append(trackers, tracker)
+	}
+	sort.Strings(trackers)
+	m.help("rakoshare_announce_latency_seconds", "gauge", "Duration of the last announce, by tracker")
+	for _, tracker := range trackers {
+		m.sample("rakoshare_announce_latency_seconds", announceStats.latency[tracker].Seconds(), "tracker", tracker)
+	}
+	m.help("rakoshare_announce_failures_total", "counter", "Announces that failed, by tracker")
+	for _, tracker := range trackers {
+		m.sample("rakoshare_announce_failures_total", announceStats.failures[tracker], "tracker", tracker)
+	}
+	announceStats.Unlock()
+}
+
+// metricsWriter writes metrics in the text format of Prometheus.
+type metricsWriter struct {
+	w io.Writer
+}
+
+func (m metricsWriter) help(name, kind, help string) {
+	fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes a value of name, with labels given as name and value
+// pairs.
+func (m metricsWriter) sample(name string, value interface{}, labels ...string) {
+	if len(labels) > 0 {
+		pairs := make([]string, 0, len(labels)/2)
+		for i := 0; i+1 < len(labels); i += 2 {
+			pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", labels[i], labelEscaper.Replace(labels[i+1])))
+		}
+		name += "{" + strings.Join(pairs, ",") + "}"
+	}
+	fmt.Fprintf(m.w, "%s %v\n", name, value)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	now := time.Now()
+	unregister := shareStatuses.register("abcd", func() ShareStatus {
+		return ShareStatus{Peers: 3, ControlPeers: 2, Uploaded: 1000, Paused: true, Updated: now.Add(-5 * time.Second)}
+	})
+	announceStats.observe(`http://tracker.example/"announce"`, 1500*time.Millisecond, errors.New("timeout"))
+
+	var buf bytes.Buffer
+	writeMetrics(&buf, now)
+	out := buf.String()
+	for _, want := range []string{
+		"# TYPE rakoshare_peers gauge\n",
+		`rakoshare_peers{share="abcd",swarm="data"} 3` + "\n",
+		`rakoshare_peers{share="abcd",swarm="control"} 2` + "\n",
+		`rakoshare_uploaded_bytes_total{share="abcd"} 1000` + "\n",
+		`rakoshare_paused{share="abcd"} 1` + "\n",
+		`rakoshare_status_age_seconds{share="abcd"} 5` + "\n",
+		`rakoshare_handshake_failures_total{direction="inbound"} `,
+		`rakoshare_announce_latency_seconds{tracker="http://tracker.example/\"announce\""} 1.5` + "\n",
+		`rakoshare_announce_failures_total{tracker="http://tracker.example/\"announce\""} 1` + "\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected %q in\n%s", want, out)
+		}
+	}
+
+	unregister()
+	buf.Reset()
+	writeMetrics(&buf, now)
+	if strings.Contains(buf.String(), `share="abcd"`) {
+		t.Error("Expected the share to be gone once unregistered")
+	}
+}
@@ -1,15 +1,19 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"net"
 	"net/http"
+	"time"
 
 	"github.com/hailiang/gosocks"
 )
 
+var errDialTimeout = errors.New("dial timed out")
+
 func init() {
-	flag.StringVar(&proxyAddress, "proxyAddress", "", "Address of a SOCKS5 proxy to use.")
+	flag.StringVar(&proxyAddress, "proxyAddress", "", "Address of a SOCKS5 proxy to use for connections to peers and trackers. DHT is disabled when it is set.")
 }
 
 var proxyAddress string
@@ -29,6 +33,39 @@ func proxyNetDial(netType, addr string) (net.Conn, error) {
 	return net.Dial(netType, addr)
 }
 
+// proxyNetDialTimeout is like proxyNetDial, but gives up after timeout.
+func proxyNetDialTimeout(netType, addr string, timeout time.Duration) (net.Conn, error) {
+	if *useI2P {
+		return i2pDial(addr, timeout)
+	}
+	if !useProxy() {
+		return net.DialTimeout(netType, addr, timeout)
+	}
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := proxyNetDial(netType, addr)
+		done <- result{conn, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.conn, r.err
+	case <-time.After(timeout):
+		// Don't leak the connection if it comes too late
+		go func() {
+			if r := <-done; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, errDialTimeout
+	}
+}
+
 func proxyHttpClient() (client *http.Client) {
 	if useProxy() {
 		dialSocksProxy := socks.DialSocksProxy(socks.SOCKS5, proxyAddress)
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket limiting the bytes going through all the
+// connections sharing it. A nil *rateLimiter doesn't limit anything.
+type rateLimiter struct {
+	sync.Mutex
+	rate   float64 // bytes per second
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a limiter for rate bytes per second, or nil if
+// rate isn't positive.
+func newRateLimiter(rate int64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// Wait blocks until n more bytes can go through. Bursts are allowed up to
+// one second worth of bytes.
+func (l *rateLimiter) Wait(n int) {
+	if l == nil {
+		return
+	}
+
+	l.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	wait := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// transferLimits are the limiters of the data transfers of a share,
+// shared by all its data sessions, and when each of them stops seeding.
+type transferLimits struct {
+	up   *rateLimiter
+	down *rateLimiter
+	seed seedLimits
+}
+
+func newTransferLimits(cfg ShareConfig) transferLimits {
+	return transferLimits{
+		up:   newRateLimiter(cfg.UploadRate),
+		down: newRateLimiter(cfg.DownloadRate),
+		seed: cfg.seedLimits(),
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"flag"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+var uploadSlots = flag.Int("uploadSlots", 4, "Number of peers we upload to at the same time")
+
+// Every that many rechokes, the optimistic unchoke goes to another peer
+const optimisticUnchokeRounds = 3
+
+// rechoke decides which peers we upload to, tit-for-tat style: the
+// interested peers that gave us the most data recently are unchoked,
+// plus one random peer that gets a chance to prove itself (the
+// optimistic unchoke). When we have everything, peers are ranked by how
+// fast they take data from us instead. Peers that snubbed us stay choked
+// until we have everything.
+func (t *TorrentSession) rechoke() {
+	now := time.Now()
+	elapsed := now.Sub(t.lastRechoke).Seconds()
+	t.lastRechoke = now
+
+	peers := t.peers.All()
+	stillConnected := false
+	for _, p := range peers {
+		p.updateRates(elapsed)
+		p.tuneBlockLength()
+		if p == t.optimistic {
+			stillConnected = true
+		}
+	}
+
+	t.rechokeRound++
+	if t.rechokeRound%optimisticUnchokeRounds == 0 || !stillConnected {
+		t.optimistic = nil
+	}
+
+	seeding := t.goodPieces == t.totalPieces
+	if seeding {
+		// We don't expect blocks anymore
+		for _, p := range peers {
+			p.snubbed = false
+		}
+	}
+	unchoked := chooseUnchoked(peers, *uploadSlots, seeding)
+
+	if t.optimistic == nil {
+		t.optimistic = chooseOptimistic(peers, unchoked)
+	}
+	if t.optimistic != nil {
+		unchoked[t.optimistic] = true
+	}
+	if t.doneSeeding {
+		unchoked, t.optimistic = nil, nil
+	}
+
+	for _, p := range peers {
+		p.SetChoke(!unchoked[p])
+	}
+}
+
+// chooseUnchoked returns the interested peers that are the best at
+// giving us data, or at taking it when seeding. One slot is kept for the
+// optimistic unchoke.
+func chooseUnchoked(peers []*peerState, slots int, seeding bool) map[*peerState]bool {
+	var candidates []*peerState
+	for _, p := range peers {
+		if p.peer_interested && !p.snubbed {
+			candidates = append(candidates, p)
+		}
+	}
+
+	rate := func(p *peerState) float64 {
+		if seeding {
+			return p.uploadRate
+		}
+		return p.downloadRate
+	}
+	sort.Sort(byRate{candidates, rate})
+
+	unchoked := make(map[*peerState]bool)
+	for i := 0; i < len(candidates) && i < slots-1; i++ {
+		unchoked[candidates[i]] = true
+	}
+	return unchoked
+}
+
+// chooseOptimistic picks a random interested peer amongst those that
+// aren't unchoked yet.
+func chooseOptimistic(peers []*peerState, unchoked map[*peerState]bool) *peerState {
+	var choked []*peerState
+	for _, p := range peers {
+		if p.peer_interested && !p.snubbed && !unchoked[p] {
+			choked = append(choked, p)
+		}
+	}
+	if len(choked) == 0 {
+		return nil
+	}
+	return choked[rand.Intn(len(choked))]
+}
+
+type byRate struct {
+	peers []*peerState
+	rate  func(*peerState) float64
+}
+
+func (b byRate) Len() int           { return len(b.peers) }
+func (b byRate) Swap(i, j int)      { b.peers[i], b.peers[j] = b.peers[j], b.peers[i] }
+func (b byRate) Less(i, j int) bool { return b.rate(b.peers[i]) > b.rate(b.peers[j]) }
@@ -0,0 +1,64 @@
+package main
+
+import "testing"
+
+func TestChooseUnchoked(t *testing.T) {
+	fast := &peerState{peer_interested: true, downloadRate: 100, uploadRate: 1}
+	medium := &peerState{peer_interested: true, downloadRate: 50, uploadRate: 50}
+	slow := &peerState{peer_interested: true, downloadRate: 1, uploadRate: 100}
+	uninterested := &peerState{downloadRate: 1000, uploadRate: 1000}
+	peers := []*peerState{slow, uninterested, fast, medium}
+
+	unchoked := chooseUnchoked(peers, 3, false)
+	if len(unchoked) != 2 || !unchoked[fast] || !unchoked[medium] {
+		t.Fatalf("Leeching: expected fast and medium to be unchoked, got %v", unchoked)
+	}
+
+	unchoked = chooseUnchoked(peers, 3, true)
+	if len(unchoked) != 2 || !unchoked[slow] || !unchoked[medium] {
+		t.Fatalf("Seeding: expected slow and medium to be unchoked, got %v", unchoked)
+	}
+}
+
+func TestChooseOptimistic(t *testing.T) {
+	a := &peerState{peer_interested: true}
+	b := &peerState{peer_interested: true}
+	c := &peerState{}
+	peers := []*peerState{a, b, c}
+
+	for i := 0; i < 10; i++ {
+		if p := chooseOptimistic(peers, map[*peerState]bool{a: true}); p != b {
+			t.Fatalf("Expected the only choked interested peer, got %v", p)
+		}
+	}
+	if p := chooseOptimistic(peers, map[*peerState]bool{a: true, b: true}); p != nil {
+		t.Fatalf("Expected no candidate, got %v", p)
+	}
+}
+
+func TestUnqueueBlocks(t *testing.T) {
+	block := func(index byte) []byte {
+		return []byte{PIECE, 0, 0, 0, index, 0, 0, 0, 0, 'x', 'y'}
+	}
+	queue := map[int][]byte{3: block(1), 4: {HAVE, 0, 0, 0, 5}, 5: block(2)}
+
+	p := &peerState{fast: true, ourAllowedFast: map[uint32]bool{2: true}}
+	if head := unqueueBlocks(queue, 3, 6, p.unqueueBlock); head != 6 {
+		t.Fatalf("Expected 3 messages left, got %d", head-3)
+	}
+	if m := queue[3]; m[0] != REJECT_REQUEST || m[4] != 1 || m[12] != 2 {
+		t.Errorf("Expected the block to be rejected, got %v", m)
+	}
+	if m := queue[5]; m[0] != PIECE {
+		t.Errorf("Expected the allowed fast block to be kept, got %v", m)
+	}
+
+	queue = map[int][]byte{3: block(1), 4: {HAVE, 0, 0, 0, 5}, 5: block(2)}
+	p = &peerState{}
+	if head := unqueueBlocks(queue, 3, 6, p.unqueueBlock); head != 4 || queue[3][0] != HAVE || len(queue) != 1 {
+		t.Errorf("Expected only the HAVE to be left, got %v", queue)
+	}
+	if p.written != 2 {
+		t.Errorf("Expected the dropped blocks to count as written, got %d", p.written)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/hex"
+	"path/filepath"
+	"time"
+
+	"github.com/rakoo/rakoshare/pkg/id"
+)
+
+// A relay is an always-on node that keeps a share for devices that are
+// rarely online together. It only ever holds the store id and has no
+// folder: it follows revisions in the control swarm, caches the sealed
+// pieces writers publish and serves them to the readers that show up
+// later. Readers dial relays on the sealed channel, so that those behind
+// a NAT are served too.
+
+// Where relays cache sealed pieces, under the working directory
+const relayDir = "relay"
+
+// How often replicas keeping sealed torrents dial the peers of the
+// control swarm again, as readers only accept them, and only dial them,
+// once they know the sealed revision
+const sealedRedialInterval = 30 * time.Second
+
+// relayCacheDir returns where the relay of shareID caches sealed pieces.
+func relayCacheDir(workDir string, shareID id.Id) string {
+	return filepath.Join(workDir, relayDir, hex.EncodeToString(shareID.Infohash))
+}
+
+// Relay runs a relay of the share of cliId. The cached pieces stay in
+// memory when memory is set.
+func Relay(cliId, workDir string, trackers []string, useLPD bool, manualPeers []string, serveTracker int, memory bool) error {
+	shareID, err := id.NewFromString(cliId)
+	if err != nil {
+		return newUserError(msgBadID, err)
+	}
+	// Whatever id it is given, a relay can't read the share
+	storeID, err := id.NewFromString(shareID.S())
+	if err != nil {
+		return newUserError(msgBadID, err)
+	}
+	if !storeID.CanVerify() {
+		return newUserError(msgRelayOldID)
+	}
+	session, err := openSession(workDir, storeID)
+	if err != nil {
+		return newUserError(msgOpenSession, err)
+	}
+	cache := relayCacheDir(workDir, storeID)
+	if target := session.GetTarget(); target != "" && target != cache {
+		return newUserError(msgRelayShared, target)
+	}
+
+	cfg, err := getShareConfig(session)
+	if err != nil {
+		return newUserError(msgLoadSettings, err)
+	}
+	cfg.Sealed = true
+	if err = saveShareConfig(session, cfg); err != nil {
+		return err
+	}
+	storage := ""
+	if memory {
+		storage = storageMemory
+	}
+	return Share(storeID.S(), workDir, cache, trackers, useLPD, manualPeers, serveTracker, "", storage)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// detectRenames moves the files of dir that info doesn't list anymore to
+// where info lists missing files with the same content, so that renamed
+// or moved files aren't downloaded again. Contents are matched by length,
+// then by checksum. It returns how many files were moved.
+func detectRenames(dir string, info *InfoDict) (moved int) {
+	listed := make(map[string]bool)
+	missing := make(map[int64][]*FileDict)
+	ignored := loadIgnoreFile(dir)
+	for _, f := range info.fileList() {
+		rel := filepath.Clean("/" + filepath.Join(f.Path...))[1:]
+		listed[rel] = true
+		if ignored.match(rel) {
+			continue
+		}
+		algo, _, ok := expectedChecksum(f)
+		if _, known := checksumAlgorithms[algo]; !ok || !known {
+			continue
+		}
+		if st, err := os.Stat(filepath.Join(dir, rel)); err == nil && st.Size() == f.Length {
+			continue
+		}
+		missing[f.Length] = append(missing[f.Length], f)
+	}
+	if len(missing) == 0 {
+		return 0
+	}
+
+	torrentWalk(dir, ignored.match, func(path string, st os.FileInfo, perr error) error {
+		candidates := missing[st.Size()]
+		if len(candidates) == 0 {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || listed[rel] {
+			return nil
+		}
+
+		sums := make(map[string]string) // By algorithm
+		for i, f := range candidates {
+			algo, expected, _ := expectedChecksum(f)
+			sum, ok := sums[algo]
+			if !ok {
+				if sum, err = fileChecksum(path, algo); err != nil {
+					return nil
+				}
+				sums[algo] = sum
+			}
+			if sum != expected {
+				continue
+			}
+
+			target := filepath.Join(dir, filepath.Clean("/" + filepath.Join(f.Path...))[1:])
+			if err := ensureDirectory(target); err != nil {
+				log.Printf("Couldn't move %s: %s", rel, err)
+				return nil
+			}
+			if err := os.Rename(path, target); err != nil {
+				log.Printf("Couldn't move %s: %s", rel, err)
+				return nil
+			}
+			log.Printf("Moved %s to %s rather than downloading it again", rel, filepath.Join(f.Path...))
+			missing[st.Size()] = append(candidates[:i], candidates[i+1:]...)
+			moved++
+			return nil
+		}
+		return nil
+	})
+	return
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDetectRenames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "renames")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "old"), []byte("moved"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "other"), []byte("other"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "kept"), []byte("kept"), 0600)
+
+	sum, err := fileChecksum(filepath.Join(dir, "old"), "sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := &InfoDict{Files: []*FileDict{
+		{Path: []string{"kept"}, Length: 4},
+		{Path: []string{"sub", "new"}, Length: 5, Checksum: sum},
+		{Path: []string{"unknown"}, Length: 5, Checksum: "sha256:00"},
+	}}
+
+	if moved := detectRenames(dir, info); moved != 1 {
+		t.Fatalf("Expected 1 file to be moved, got %d", moved)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "sub", "new")); err != nil || string(data) != "moved" {
+		t.Errorf("Expected the file to be moved, got %q, %v", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "old")); !os.IsNotExist(err) {
+		t.Error("Expected the old name to be gone")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "other")); err != nil {
+		t.Error("Expected the file with other contents to stay")
+	}
+}
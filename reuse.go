@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/sha1"
+	"errors"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// The pieces of a new revision that the previous one had too, with the
+// same hash, are copied from the files of the previous revision rather
+// than downloaded. These files are still on disk when the new revision
+// starts: the files it changes are written as .part files, which only
+// replace them once it completes.
+
+// pieceKey identifies the content of a piece across revisions.
+type pieceKey struct {
+	hash   string
+	length int64
+}
+
+// pieceKeys returns the key of each piece of m, the zero key for pieces
+// whose hash we don't know.
+func pieceKeys(m *MetaInfo, totalSize int64) []pieceKey {
+	if m.Info.pureV2() {
+		pieces := m.v2Pieces()
+		keys := make([]pieceKey, len(pieces))
+		for i, p := range pieces {
+			if p.hash != nil {
+				keys[i] = pieceKey{string(p.hash), pieceSize(totalSize, m.Info.PieceLength, i)}
+			}
+		}
+		return keys
+	}
+	keys := make([]pieceKey, len(m.Info.Pieces)/sha1.Size)
+	for i := range keys {
+		keys[i] = pieceKey{m.Info.Pieces[i*sha1.Size : (i+1)*sha1.Size], pieceSize(totalSize, m.Info.PieceLength, i)}
+	}
+	return keys
+}
+
+var errNotInRevision = errors.New("read past the end of the revision")
+
+// revisionReader reads the data of a revision from the files of dir as
+// they are, without creating or changing any.
+type revisionReader struct {
+	dir     string
+	ignored ignoreRules
+	files   []*FileDict
+	offsets []int64
+}
+
+func newRevisionReader(dir string, info *InfoDict) *revisionReader {
+	r := &revisionReader{dir: dir, ignored: loadIgnoreFile(dir), files: info.layout()}
+	if len(r.files) == 0 {
+		r.files = []*FileDict{{Length: info.Length, Path: []string{info.Name}}}
+	}
+	var offset int64
+	for _, f := range r.files {
+		r.offsets = append(r.offsets, offset)
+		offset += f.Length
+	}
+	return r
+}
+
+// ReadAt reads len(p) bytes at off, or fails.
+func (r *revisionReader) ReadAt(p []byte, off int64) (n int, err error) {
+	for i, f := range r.files {
+		if n == len(p) {
+			break
+		}
+		start := r.offsets[i]
+		if f.Length == 0 || off+int64(n) >= start+f.Length {
+			continue
+		}
+		chunk := p[n:]
+		begin := off + int64(n) - start
+		if rest := f.Length - begin; int64(len(chunk)) > rest {
+			chunk = chunk[:rest]
+		}
+		if f.isPad() {
+			for j := range chunk {
+				chunk[j] = 0
+			}
+		} else if err = r.readFile(f, chunk, begin); err != nil {
+			return
+		}
+		n += len(chunk)
+	}
+	if n < len(p) {
+		err = errNotInRevision
+	}
+	return
+}
+
+func (r *revisionReader) readFile(f *FileDict, p []byte, off int64) error {
+	rel := path.Clean("/" + path.Join(f.Path...))[1:]
+	full := filepath.Join(r.dir, filepath.FromSlash(rel))
+	if r.ignored.match(rel) {
+		full = filepath.Join(r.dir, rakoshareDir, "ignored", filepath.FromSlash(rel))
+	}
+	file, err := os.Open(full)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.ReadAt(p, off)
+	return err
+}
+
+// reusePieces makes the session copy the pieces it misses from the data
+// of prev, the revision it replaces, when it has them. It must be called
+// before DoTorrent.
+func (t *TorrentSession) reusePieces(prev *MetaInfo) {
+	if prev != nil && prev.InfoHash != t.m.InfoHash {
+		t.previous = prev
+	}
+}
+
+// reusePrevious copies into the store the pieces we miss that the
+// previous revision had, and returns how many it copied.
+func (t *TorrentSession) reusePrevious() (reused int) {
+	prev := t.previous
+	t.previous = nil
+	if prev == nil || prev.Info == nil || prev.Info.PieceLength != t.m.Info.PieceLength {
+		return 0
+	}
+	sources := make(map[pieceKey]int)
+	for j, k := range pieceKeys(prev, prev.Info.totalSize()) {
+		if _, ok := sources[k]; k.hash != "" && !ok {
+			sources[k] = j
+		}
+	}
+	if len(sources) == 0 {
+		return 0
+	}
+
+	pieceLength := t.m.Info.PieceLength
+	reader := newRevisionReader(t.target, prev.Info)
+	buf := make([]byte, pieceLength)
+	for i, k := range pieceKeys(t.m, t.totalSize) {
+		j, ok := sources[k]
+		if !ok || t.pieceSet.IsSet(i) {
+			continue
+		}
+		data := buf[:k.length]
+		if _, err := reader.ReadAt(data, int64(j)*pieceLength); err != nil || !t.m.pieceMatches(i, data) {
+			continue
+		}
+		if _, err := t.fileStore.WriteAt(data, int64(i)*pieceLength); err != nil {
+			log.Println("Couldn't copy piece", i, "of the previous revision:", err)
+			continue
+		}
+		t.pieceSet.Set(i)
+		t.syncCompleted(i)
+		reused++
+	}
+	return
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReusePrevious(t *testing.T) {
+	defer func(l int64) { *fixedPieceLength = l }(*fixedPieceLength)
+	*fixedPieceLength = 16 * 1024
+
+	content := bytes.Repeat([]byte("0123456789abcdef"), 2*1024)
+	dir, err := ioutil.TempDir("", "reuse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "a"), content, 0644)
+	prev, err := createMeta(dir, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The next revision has the same content under another name
+	next, err := ioutil.TempDir("", "reuse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(next)
+	ioutil.WriteFile(filepath.Join(next, "b"), content, 0644)
+	meta, err := createMeta(next, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := &TorrentSession{m: meta, target: dir}
+	ts.fileStore, ts.totalSize, err = openStore(meta.Info, dir, storeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.fileStore.Close()
+	_, bad, pieceSet, err := checkPieces(ts.fileStore, ts.totalSize, meta, nil)
+	if err != nil || bad != 2 {
+		t.Fatalf("Expected 2 missing pieces, got %d, %v", bad, err)
+	}
+	ts.pieceSet = pieceSet
+
+	ts.reusePieces(prev)
+	if reused := ts.reusePrevious(); reused != 2 {
+		t.Fatalf("Expected both pieces to be copied, got %d", reused)
+	}
+	if good, _, _, err := checkPieces(ts.fileStore, ts.totalSize, meta, nil); good != 2 || err != nil {
+		t.Errorf("Expected the copied pieces to check, got %d good, %v", good, err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "a")); err != nil || !bytes.Equal(data, content) {
+		t.Error("The files of the previous revision shouldn't change")
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	ed "github.com/agl/ed25519"
+	"github.com/rakoo/rakoshare/pkg/id"
+	"github.com/rakoo/rakoshare/pkg/sharesession"
+	"github.com/zeebo/bencode"
+)
+
+var (
+	errRevisionCounter  = errors.New("invalid revision counter")
+	errRevisionHash     = errors.New("revision hash doesn't match its torrent and parent")
+	errRevisionAuthor   = errors.New("revision isn't from a writer of the share")
+	errRevisionSig      = errors.New("bad revision signature")
+	errRevisionUnsigned = errors.New("unsigned revision")
+	errCantWrite        = errors.New("only writers of the share can make revisions")
+)
+
+// Revision identifies a version of the share, ala CouchDB: a counter
+// increased at each change, and a hash of the torrent chained to the hash
+// of the parent revision. It is signed by the writer that made it.
+type Revision struct {
+	Counter int64  `bencode:"counter"`
+	Hash    string `bencode:"hash"`
+	Parent  string `bencode:"parent"`
+
+	// The public key of the writer, and its signature of the fields above
+	Author string `bencode:"author"`
+	Sig    string `bencode:"sig,omitempty"`
+}
+
+func revisionHash(ih, parent string) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(ih+parent)))
+}
+
+// nextRevision returns the child of parent for the torrent ih, signed by
+// the writer with the given keys.
+func nextRevision(parent Revision, ih string, pub id.PubKey, priv id.PrivKey) (r Revision, err error) {
+	r = Revision{
+		Counter: parent.Counter + 1,
+		Hash:    revisionHash(ih, parent.Hash),
+		Parent:  parent.Hash,
+		Author:  string(pub[:]),
+	}
+	signed, err := r.signedBytes()
+	if err != nil {
+		return
+	}
+	privarg := [ed.PrivateKeySize]byte(priv)
+	sig := ed.Sign(&privarg, signed)
+	r.Sig = string(sig[:])
+	return
+}
+
+func (r Revision) signedBytes() ([]byte, error) {
+	r.Sig = ""
+	var buf bytes.Buffer
+	err := bencode.NewEncoder(&buf).Encode(r)
+	return buf.Bytes(), err
+}
+
+// Verify checks that r is a revision of the torrent ih, signed by the
+// writer of the share whose public key is pub.
+func (r Revision) Verify(ih string, pub id.PubKey) error {
+	if r.Counter < 1 {
+		return errRevisionCounter
+	}
+	if r.Hash != revisionHash(ih, r.Parent) {
+		return errRevisionHash
+	}
+	if r.Sig == "" {
+		return errRevisionUnsigned
+	}
+	if r.Author != string(pub[:]) {
+		return errRevisionAuthor
+	}
+	signed, err := r.signedBytes()
+	if err != nil {
+		return err
+	}
+	pubarg := [ed.PublicKeySize]byte(pub)
+	var sig [ed.SignatureSize]byte
+	copy(sig[:], r.Sig)
+	if !ed.Verify(&pubarg, signed, &sig) {
+		return errRevisionSig
+	}
+	return nil
+}
+
+// Newer tells whether r supersedes o. Concurrent revisions, with the same
+// counter, are ordered by hash so that all peers settle on the same one.
+func (r Revision) Newer(o Revision) bool {
+	if r.Counter != o.Counter {
+		return r.Counter > o.Counter
+	}
+	return r.Hash > o.Hash
+}
+
+// String returns the revision as <counter>-<hash>, as shown to users and
+// in summaries.
+func (r Revision) String() string {
+	return fmt.Sprintf("%d-%s", r.Counter, r.Hash)
+}
+
+// parseRevision reads a revision written as <counter>-<hash>, as stored
+// before revisions were signed. The result has no author.
+func parseRevision(s string) (r Revision, ok bool) {
+	var hash string
+	if n, _ := fmt.Sscanf(s, "%d-%s", &r.Counter, &hash); n < 1 || r.Counter < 0 {
+		return Revision{}, false
+	}
+	r.Hash = hash
+	return r, true
+}
+
+// The setting where the highest revision seen from each writer is kept
+const settingHighestRevisions = "highest revisions"
+
+// highestRevisions remembers the highest revision each writer signed, so
+// that old announcements replayed by an attacker or a lagging peer can't
+// take the share back. Writers are known by their public key. Both the
+// control loop and the main loop update it.
+type highestRevisions struct {
+	lock sync.Mutex
+	revs map[string]Revision
+}
+
+func loadHighestRevisions(session *sharesession.Session) *highestRevisions {
+	h := &highestRevisions{revs: make(map[string]Revision)}
+	if raw := session.GetSetting(settingHighestRevisions); raw != "" {
+		bencode.NewDecoder(strings.NewReader(raw)).Decode(&h.revs)
+	}
+	return h
+}
+
+// stale tells whether r is not newer than the highest revision of its
+// writer.
+func (h *highestRevisions) stale(r Revision) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.staleLocked(r)
+}
+
+func (h *highestRevisions) staleLocked(r Revision) bool {
+	highest, ok := h.revs[r.Author]
+	return ok && !r.Newer(highest)
+}
+
+// see records r if it is the highest revision of its writer, and tells
+// whether it is.
+func (h *highestRevisions) see(r Revision) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.staleLocked(r) {
+		return false
+	}
+	h.revs[r.Author] = r
+	return true
+}
+
+// newest returns the highest revision seen from author, if any.
+func (h *highestRevisions) newest(author string) (r Revision, ok bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	r, ok = h.revs[author]
+	return
+}
+
+// save stores the revisions in session. The lock is held until they are
+// written, so that an older copy can't overwrite a newer one.
+func (h *highestRevisions) save(session *sharesession.Session) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	var buf bytes.Buffer
+	err := bencode.NewEncoder(&buf).Encode(h.revs)
+	if err != nil {
+		return err
+	}
+	return session.SetSetting(settingHighestRevisions, buf.String())
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	ed "github.com/agl/ed25519"
+	"github.com/rakoo/rakoshare/pkg/id"
+	"github.com/zeebo/bencode"
+)
+
+func TestRevisionVerify(t *testing.T) {
+	pub, priv, err := ed.GenerateKey(bytes.NewReader(make([]byte, 64)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := nextRevision(Revision{}, "ih1", id.PubKey(*pub), id.PrivKey(*priv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := nextRevision(first, "ih2", id.PubKey(*pub), id.PrivKey(*priv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Counter != 2 || second.Parent != first.Hash {
+		t.Fatalf("Expected the second revision to follow the first, got %s", second)
+	}
+	if err := second.Verify("ih2", id.PubKey(*pub)); err != nil {
+		t.Fatal("Couldn't verify a valid revision: ", err)
+	}
+
+	if err := second.Verify("ih1", id.PubKey(*pub)); err != errRevisionHash {
+		t.Errorf("Expected a revision of another torrent to fail, got %v", err)
+	}
+	tampered := second
+	tampered.Counter = 10
+	if err := tampered.Verify("ih2", id.PubKey(*pub)); err != errRevisionSig {
+		t.Errorf("Expected a tampered revision to fail, got %v", err)
+	}
+	var other id.PubKey
+	if err := second.Verify("ih2", other); err != errRevisionAuthor {
+		t.Errorf("Expected a revision of another writer to fail, got %v", err)
+	}
+
+	// Only the signature is left out of what is signed
+	var buf bytes.Buffer
+	if err := bencode.NewEncoder(&buf).Encode(second); err != nil {
+		t.Fatal(err)
+	}
+	var decoded Revision
+	if err := bencode.NewDecoder(&buf).Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	if err := decoded.Verify("ih2", id.PubKey(*pub)); err != nil {
+		t.Error("Couldn't verify a decoded revision: ", err)
+	}
+}
+
+func TestRevisionNewer(t *testing.T) {
+	a := Revision{Counter: 3, Hash: "a"}
+	b := Revision{Counter: 3, Hash: "b"}
+	if !b.Newer(a) || a.Newer(b) {
+		t.Error("Concurrent revisions should be ordered by hash")
+	}
+	if !(Revision{Counter: 10}).Newer(b) || a.Newer(Revision{Counter: 4}) {
+		t.Error("Revisions should be ordered by counter first")
+	}
+	if a.Newer(a) {
+		t.Error("A revision isn't newer than itself")
+	}
+}
+
+func TestHighestRevisions(t *testing.T) {
+	h := &highestRevisions{revs: make(map[string]Revision)}
+	first := Revision{Counter: 1, Hash: "a", Author: "writer"}
+	second := Revision{Counter: 2, Hash: "b", Parent: "a", Author: "writer"}
+	if !h.see(first) || !h.see(second) {
+		t.Fatal("Newer revisions should be taken")
+	}
+	if !h.stale(first) || h.see(first) {
+		t.Error("A replayed revision should be stale")
+	}
+	if h.see(second) {
+		t.Error("The same revision again shouldn't be taken")
+	}
+	other := Revision{Counter: 1, Hash: "c", Author: "other writer"}
+	if !h.see(other) {
+		t.Error("Writers should be tracked apart")
+	}
+	if newest, _ := h.newest("writer"); newest != second {
+		t.Errorf("Expected %s to stay the highest, got %s", second, newest)
+	}
+}
+
+func TestDecodeLegacyIHMessage(t *testing.T) {
+	message, err := decodeIHMessage("d4:infod8:infohash2:ih3:rev5:4-abce4:porti6881ee")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.Info.InfoHash != "ih" || message.Info.Rev.String() != "4-abc" || message.Port != 6881 {
+		t.Errorf("Expected the legacy message to be converted, got %+v", message)
+	}
+}
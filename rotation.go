@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	ed "github.com/agl/ed25519"
+	"github.com/rakoo/rakoshare/pkg/id"
+	"github.com/rakoo/rakoshare/pkg/sharesession"
+	"github.com/zeebo/bencode"
+)
+
+// The setting where the signed rotations of the keys of the share are kept
+const settingRotations = "rotations"
+
+var (
+	errRotationSig   = errors.New("bad key rotation signature")
+	errRotationChain = errors.New("key rotation not signed by the keys it replaces")
+)
+
+// KeyRotation records that the owner of a share replaced its keys. It is
+// signed by the write keys it replaces, so that the holders of older ids
+// can follow the writers without trusting anyone else.
+type KeyRotation struct {
+	Prev string `bencode:"prev"`
+	Pub  string `bencode:"pub"`
+
+	// 1 when the read key changed too: the share moved to a swarm that
+	// the holders of the old ids can't find.
+	Read int64 `bencode:"read"`
+
+	Sig string `bencode:"sig,omitempty"`
+}
+
+// RotationMessage is the payload of the bs_rotation extension: all the
+// rotations of the keys of the share, oldest first.
+type RotationMessage struct {
+	Rotations []KeyRotation `bencode:"rotations"`
+}
+
+func (r KeyRotation) signedBytes() ([]byte, error) {
+	r.Sig = ""
+	var buf bytes.Buffer
+	err := bencode.NewEncoder(&buf).Encode(r)
+	return buf.Bytes(), err
+}
+
+// signRotation returns the rotation from the keys of old to the ones of
+// rotated, signed by old.
+func signRotation(old, rotated id.Id) (r KeyRotation, err error) {
+	r = KeyRotation{Prev: string(old.Pub[:]), Pub: string(rotated.Pub[:])}
+	if rotated.Read != old.Read {
+		r.Read = 1
+	}
+	signed, err := r.signedBytes()
+	if err != nil {
+		return
+	}
+	privarg := [ed.PrivateKeySize]byte(old.Priv)
+	sig := ed.Sign(&privarg, signed)
+	r.Sig = string(sig[:])
+	return
+}
+
+func (r KeyRotation) verify(pub id.PubKey) error {
+	if r.Prev != string(pub[:]) || len(r.Pub) != ed.PublicKeySize {
+		return errRotationChain
+	}
+	signed, err := r.signedBytes()
+	if err != nil {
+		return err
+	}
+	pubarg := [ed.PublicKeySize]byte(pub)
+	var sig [ed.SignatureSize]byte
+	copy(sig[:], r.Sig)
+	if !ed.Verify(&pubarg, signed, &sig) {
+		return errRotationSig
+	}
+	return nil
+}
+
+// rotationsFrom returns the rotations from the one replacing pub on.
+// Those before it don't concern us, and can't be verified.
+func rotationsFrom(pub id.PubKey, rotations []KeyRotation) []KeyRotation {
+	for i, r := range rotations {
+		if r.Prev == string(pub[:]) {
+			return rotations[i:]
+		}
+	}
+	return nil
+}
+
+// followRotations returns the write key that rotations lead to from pub,
+// and whether the read key changed on the way. Rotations before the one
+// replacing pub don't concern us.
+func followRotations(pub id.PubKey, rotations []KeyRotation) (current id.PubKey, readRotated bool, err error) {
+	current = pub
+	for _, r := range rotationsFrom(pub, rotations) {
+		if err = r.verify(current); err != nil {
+			return pub, false, err
+		}
+		copy(current[:], r.Pub)
+		readRotated = readRotated || r.Read != 0
+	}
+	return
+}
+
+func storedRotations(session *sharesession.Session) (msg RotationMessage) {
+	raw := session.GetSetting(settingRotations)
+	if raw != "" {
+		bencode.NewDecoder(strings.NewReader(raw)).Decode(&msg)
+	}
+	return
+}
+
+func saveRotations(session *sharesession.Session, msg RotationMessage) error {
+	var buf bytes.Buffer
+	err := bencode.NewEncoder(&buf).Encode(msg)
+	if err != nil {
+		return err
+	}
+	return session.SetSetting(settingRotations, buf.String())
+}
+
+// Rotate replaces the read key, the write keys or both of a share and
+// prints its new ids. The signed rotation stays in the session of the old
+// ids, which running shares send to their peers: those holding the old
+// read and store ids follow new write keys, and learn that they lost
+// access when the read key changed. A new read key moves the share to a
+// new swarm, whose session starts as a copy of the old one so that
+// nothing is hashed or downloaded again.
+func Rotate(cliId, workDir string, read, write bool) error {
+	shareID, err := id.NewFromString(cliId)
+	if err != nil {
+		return newUserError(msgBadID, err)
+	}
+	if !shareID.CanWrite() {
+		return newUserError(msgRotateNeedsWrite)
+	}
+	if !read && !write {
+		read, write = true, true
+	}
+	rotated, err := shareID.Rotate(read, write)
+	if err != nil {
+		return err
+	}
+	session, err := openSession(workDir, shareID)
+	if err != nil {
+		return newUserError(msgOpenSession, err)
+	}
+
+	record, err := signRotation(shareID, rotated)
+	if err != nil {
+		return err
+	}
+	msg := storedRotations(session)
+	msg.Rotations = append(msg.Rotations, record)
+	if err = saveRotations(session, msg); err != nil {
+		return err
+	}
+
+	if !bytes.Equal(rotated.Infohash, shareID.Infohash) {
+		newFile := filepath.Join(workDir, hex.EncodeToString(rotated.Infohash)+".sql")
+		if err = session.CopyTo(newFile); err != nil {
+			return err
+		}
+		if session, err = openSession(workDir, rotated); err != nil {
+			return newUserError(msgOpenSession, err)
+		}
+		// The rotations so far are signed by keys the new ids don't know
+		if err = session.SetSetting(settingRotations, ""); err != nil {
+			return err
+		}
+	}
+	if err = session.SetShareId(rotated); err != nil {
+		return err
+	}
+	if err = protectSecrets(workDir, session, rotated); err != nil {
+		return err
+	}
+
+	fmt.Println(T(msgRotated))
+	fmt.Printf("WriteReadStore:\t%s\n     ReadStore:\t%s\n         Store:\t%s\n",
+		rotated.WRS(), rotated.RS(), rotated.S())
+	return nil
+}
+
+// applyRotations makes cs follow the rotations of msg, if they concern
+// our keys. It tells whether they did.
+//
+// When we rotated the write keys ourselves, the session holds the new
+// ones and we keep writing with them. When the read key was rotated, the
+// share moved to another swarm: a writer stops sharing it with the
+// holders of the old ids, and the others learn they lost access.
+func (cs *ControlSession) applyRotations(msg RotationMessage) (bool, error) {
+	if !cs.ID.CanVerify() {
+		return false, nil
+	}
+	pub, readRotated, err := followRotations(cs.ID.Pub, msg.Rotations)
+	if err != nil || pub == cs.ID.Pub && !readRotated {
+		return false, err
+	}
+	wasWriter := cs.ID.CanWrite()
+	if pub != cs.ID.Pub {
+		cs.logf("Following the writers to their new key %x", pub[:])
+		cs.idLock.Lock()
+		if held := cs.storedID(); wasWriter && held.CanWrite() && held.Pub == pub {
+			cs.ID = held
+		} else if wasWriter {
+			// Our write keys were revoked
+			var demoted id.Id
+			if demoted, err = id.NewFromString(cs.ID.RS()); err != nil {
+				cs.idLock.Unlock()
+				return false, err
+			}
+			cs.ID = demoted
+		}
+		cs.ID.Pub = pub
+		cs.idLock.Unlock()
+	}
+	if readRotated && !cs.revoked {
+		cs.revoked = true
+		if wasWriter {
+			raiseAlert("rotated", "The read key of share %x was rotated: stopping it, run it again with its new ids", cs.ID.Infohash)
+			select {
+			case cs.Retired <- struct{}{}:
+			default:
+			}
+		} else {
+			raiseAlert("revoked", "The read key of share %x was rotated: ask its owner for a new id", cs.ID.Infohash)
+		}
+	}
+	return true, nil
+}
+
+// setIDLoader makes cs read the ids of the share with load, when they
+// aren't kept in its session.
+func (cs *ControlSession) setIDLoader(load func() id.Id) {
+	cs.idLock.Lock()
+	cs.loadID = load
+	cs.idLock.Unlock()
+}
+
+// storedID returns the ids of the share as they are stored, which Rotate
+// changes when it replaces the write keys. The caller must hold idLock.
+func (cs *ControlSession) storedID() id.Id {
+	if cs.loadID == nil {
+		return cs.session.GetShareId()
+	}
+	return cs.loadID()
+}
+
+// CurrentID returns the ids of the share, as rotations left them.
+func (cs *ControlSession) CurrentID() id.Id {
+	cs.idLock.Lock()
+	defer cs.idLock.Unlock()
+	return cs.ID
+}
+
+// WriterKey returns the public key of the current writers of the share.
+func (cs *ControlSession) WriterKey() id.PubKey {
+	cs.idLock.Lock()
+	defer cs.idLock.Unlock()
+	return cs.ID.Pub
+}
+
+// sendRotations sends p the rotations of the keys of the share, if any.
+func (cs *ControlSession) sendRotations(p *peerState) {
+	if _, ok := p.theirExtensions["bs_rotation"]; !ok {
+		return
+	}
+	if msg := storedRotations(cs.session); len(msg.Rotations) > 0 {
+		p.sendExtensionMessage("bs_rotation", msg)
+	}
+}
+
+// broadcastRotations sends the rotations to all peers, when there are
+// more than the last sent.
+func (cs *ControlSession) broadcastRotations() {
+	msg := storedRotations(cs.session)
+	if len(msg.Rotations) <= cs.rotations {
+		return
+	}
+	cs.rotations = len(msg.Rotations)
+	if _, err := cs.applyRotations(msg); err != nil {
+		cs.log("Couldn't follow key rotations: ", err)
+	}
+	for _, p := range cs.peers.All() {
+		cs.sendRotations(p)
+	}
+}
+
+func (cs *ControlSession) DoRotation(msg []byte, p *peerState) (err error) {
+	var message RotationMessage
+	err = bencode.NewDecoder(bytes.NewReader(msg)).Decode(&message)
+	if err != nil {
+		cs.log("Couldn't decode rotation message: ", err)
+		return
+	}
+	// Only the rotations from the keys we started with are verified, and
+	// kept
+	stored := storedRotations(cs.session)
+	base := cs.WriterKey()
+	if len(stored.Rotations) > 0 {
+		copy(base[:], stored.Rotations[0].Prev)
+	}
+	verified := RotationMessage{Rotations: rotationsFrom(base, message.Rotations)}
+	if len(verified.Rotations) <= len(stored.Rotations) {
+		return
+	}
+	if _, _, err = followRotations(base, verified.Rotations); err != nil {
+		cs.log("Refusing key rotations from", p.address, ":", err)
+		return nil
+	}
+	ok, err := cs.applyRotations(verified)
+	if err != nil {
+		cs.log("Refusing key rotations from", p.address, ":", err)
+		return nil
+	}
+	if !ok {
+		return
+	}
+	if err = saveRotations(cs.session, verified); err != nil {
+		cs.log("Couldn't save key rotations: ", err)
+		return nil
+	}
+	cs.broadcastRotations()
+	return
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/rakoo/rakoshare/pkg/id"
+)
+
+func TestFollowRotations(t *testing.T) {
+	owner, err := id.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeRotated, err := owner.Rotate(false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readRotated, err := writeRotated.Rotate(true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := signRotation(owner, writeRotated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := signRotation(writeRotated, readRotated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Read != 0 || second.Read != 1 {
+		t.Fatalf("Expected only the second rotation to change the read key, got %d and %d", first.Read, second.Read)
+	}
+
+	pub, read, err := followRotations(owner.Pub, []KeyRotation{first})
+	if err != nil || pub != writeRotated.Pub || read {
+		t.Errorf("Expected to follow the new write key, got %x, %t, %v", pub, read, err)
+	}
+	pub, read, err = followRotations(owner.Pub, []KeyRotation{first, second})
+	if err != nil || pub != writeRotated.Pub || !read {
+		t.Errorf("Expected the read key to be revoked, got %x, %t, %v", pub, read, err)
+	}
+	pub, read, err = followRotations(writeRotated.Pub, []KeyRotation{first})
+	if err != nil || pub != writeRotated.Pub || read {
+		t.Errorf("Rotations before our keys shouldn't matter, got %x, %t, %v", pub, read, err)
+	}
+
+	forged := second
+	forged.Read = 0
+	if _, _, err = followRotations(owner.Pub, []KeyRotation{first, forged}); err != errRotationSig {
+		t.Errorf("Expected a bad signature, got %v", err)
+	}
+	if _, _, err = followRotations(owner.Pub, []KeyRotation{first, first}); err != errRotationChain {
+		t.Errorf("Expected a broken chain, got %v", err)
+	}
+}
+
+func TestApplyOwnRotations(t *testing.T) {
+	owner, err := id.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeRotated, err := owner.Rotate(false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readRotated, err := writeRotated.Rotate(true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := signRotation(owner, writeRotated)
+	second, _ := signRotation(writeRotated, readRotated)
+
+	// We rotated the write keys: the stored ids have the new ones
+	cs := &ControlSession{ID: owner, Retired: make(chan struct{}, 1)}
+	cs.setIDLoader(func() id.Id { return writeRotated })
+	if ok, err := cs.applyRotations(RotationMessage{[]KeyRotation{first}}); !ok || err != nil {
+		t.Fatalf("Expected to follow the rotation, got %t, %v", ok, err)
+	}
+	if current := cs.CurrentID(); !current.CanWrite() || current.Pub != writeRotated.Pub {
+		t.Error("Expected to keep writing with the new keys")
+	}
+
+	// Then the read key: the share stops
+	if ok, err := cs.applyRotations(RotationMessage{[]KeyRotation{first, second}}); !ok || err != nil {
+		t.Fatalf("Expected to follow the rotation, got %t, %v", ok, err)
+	}
+	select {
+	case <-cs.Retired:
+	default:
+		t.Error("Expected the share to stop after its read key was rotated")
+	}
+
+	if got := rotationsFrom(writeRotated.Pub, []KeyRotation{first, second}); len(got) != 1 || got[0].Sig != second.Sig {
+		t.Errorf("Expected the rotations from the second one, got %d", len(got))
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rakoo/rakoshare/pkg/bitset"
+	"github.com/zeebo/bencode"
+)
+
+// The s3 storage keeps the pieces of a share as objects of an
+// S3-compatible object store, so that a device without a disk of its own,
+// such as a cloud node, can take part in the share. Each piece is an
+// object, uploaded once all its blocks were written, under the infohash
+// of its revision.
+//
+// The storage URL of the share gives the endpoint, the bucket and a
+// prefix, in path style: https://s3.eu-west-1.amazonaws.com/bucket/prefix.
+// Credentials and region come from the AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and AWS_REGION environment variables.
+const storageS3 = "s3"
+
+func init() {
+	registerStore(storageS3, openS3Store)
+}
+
+var errNoStorageURL = errors.New("the s3 storage needs a storage URL")
+
+// s3Client sends requests signed with AWS Signature Version 4.
+type s3Client struct {
+	client *http.Client
+	base   *url.URL
+	access string
+	secret string
+	region string
+}
+
+func newS3Client(rawurl string) (*s3Client, error) {
+	if rawurl == "" {
+		return nil, errNoStorageURL
+	}
+	base, err := url.Parse(strings.TrimSuffix(rawurl, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if base.Scheme != "http" && base.Scheme != "https" || base.Host == "" {
+		return nil, fmt.Errorf("invalid storage URL: %s", rawurl)
+	}
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &s3Client{
+		client: &http.Client{Timeout: time.Minute},
+		base:   base,
+		access: os.Getenv("AWS_ACCESS_KEY_ID"),
+		secret: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		region: region,
+	}, nil
+}
+
+func (c *s3Client) do(method, key string, body []byte, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.base.String()+"/"+key, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	c.sign(req, body, time.Now().UTC())
+	return c.client.Do(req)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func (c *s3Client) sign(req *http.Request, body []byte, now time.Time) {
+	payload := sha256Hex(body)
+	date := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", date)
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host + "\nx-amz-content-sha256:" + payload + "\nx-amz-date:" + date + "\n",
+		signedHeaders,
+		payload,
+	}, "\n")
+	scope := day + "/" + c.region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + date + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+
+	key := hmacSHA256([]byte("AWS4"+c.secret), day)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.access, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, toSign))))
+}
+
+// s3Store is a FileStore of pieces in an object store. Pieces being
+// downloaded stay in memory until complete.
+type s3Store struct {
+	client      *s3Client
+	infoHash    string // In hex, prefixing the keys of the pieces
+	pieceLength int64
+	size        int64
+
+	sync.Mutex
+	partial map[int]*s3Piece
+}
+
+type s3Piece struct {
+	data    []byte
+	written *bitset.Bitset // By block of STANDARD_BLOCK_LENGTH
+}
+
+func openS3Store(info *InfoDict, storePath string, opts storeOptions) (FileStore, int64, error) {
+	client, err := newS3Client(opts.url)
+	if err != nil {
+		return nil, 0, err
+	}
+	var raw bytes.Buffer
+	if err := bencode.NewEncoder(&raw).Encode(info); err != nil {
+		return nil, 0, err
+	}
+	size := info.totalSize()
+	s := &s3Store{
+		client:      client,
+		infoHash:    hex.EncodeToString([]byte(infoHashOf(raw.Bytes()))),
+		pieceLength: info.PieceLength,
+		size:        size,
+		partial:     make(map[int]*s3Piece),
+	}
+	return s, size, nil
+}
+
+// s3PieceKey returns the key of a piece of the torrent with the given hex
+// infohash. Revisions don't share keys, so that the pieces of one don't
+// overwrite those of another.
+func s3PieceKey(infoHash string, piece int) string {
+	return fmt.Sprintf("%s/pieces/%08d", infoHash, piece)
+}
+
+func (s *s3Store) ReadAt(p []byte, off int64) (int, error) {
+	return spanPieces(s.size, s.pieceLength, p, off, s.readPiece)
+}
+
+func (s *s3Store) readPiece(piece int, p []byte, begin int64) error {
+	s.Lock()
+	partial, ok := s.partial[piece]
+	if ok {
+		copy(p, partial.data[begin:])
+	}
+	s.Unlock()
+	if ok {
+		return nil
+	}
+
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", begin, begin+int64(len(p))-1)}}
+	resp, err := s.client.do("GET", s3PieceKey(s.infoHash, piece), nil, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		if _, err := io.CopyN(ioutil.Discard, resp.Body, begin); err != nil {
+			return err
+		}
+	case http.StatusNotFound:
+		// We don't have that piece yet
+		for i := range p {
+			p[i] = 0
+		}
+		return nil
+	default:
+		return fmt.Errorf("reading piece %d: %s", piece, resp.Status)
+	}
+	_, err = io.ReadFull(resp.Body, p)
+	return err
+}
+
+func (s *s3Store) WriteAt(p []byte, off int64) (int, error) {
+	return spanPieces(s.size, s.pieceLength, p, off, s.writePiece)
+}
+
+func (s *s3Store) writePiece(piece int, p []byte, begin int64) error {
+	length := pieceSize(s.size, s.pieceLength, piece)
+	blocks := int((length + STANDARD_BLOCK_LENGTH - 1) / STANDARD_BLOCK_LENGTH)
+
+	s.Lock()
+	partial, ok := s.partial[piece]
+	if !ok {
+		partial = &s3Piece{data: make([]byte, length), written: bitset.New(blocks)}
+		s.partial[piece] = partial
+	}
+	copy(partial.data[begin:], p)
+	end := begin + int64(len(p))
+	for block := int((begin + STANDARD_BLOCK_LENGTH - 1) / STANDARD_BLOCK_LENGTH); block < blocks; block++ {
+		blockEnd := int64(block+1) * STANDARD_BLOCK_LENGTH
+		if blockEnd > length {
+			blockEnd = length
+		}
+		if blockEnd > end {
+			break
+		}
+		partial.written.Set(block)
+	}
+	complete := partial.written.FindNextClear(0) == -1
+	if complete {
+		delete(s.partial, piece)
+	}
+	s.Unlock()
+	if !complete {
+		return nil
+	}
+
+	err := s.upload(piece, partial.data)
+	if err != nil {
+		// Keep it for the next block
+		s.Lock()
+		if _, ok := s.partial[piece]; !ok {
+			s.partial[piece] = partial
+		}
+		s.Unlock()
+	}
+	return err
+}
+
+func (s *s3Store) upload(piece int, data []byte) error {
+	resp, err := s.client.do("PUT", s3PieceKey(s.infoHash, piece), data, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("uploading piece %d: %s", piece, resp.Status)
+	}
+	return nil
+}
+
+// SetBad does nothing, as pieces are separate objects and Cleanup has no
+// files to fix either.
+func (s *s3Store) SetBad(off, length int64) {}
+
+func (s *s3Store) Cleanup() error {
+	return nil
+}
+
+func (s *s3Store) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.partial) > 0 {
+		log.Printf("Dropping %d incomplete pieces", len(s.partial))
+	}
+	s.partial = make(map[int]*s3Piece)
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeS3 serves objects from memory, with ranges.
+type fakeS3 struct {
+	sync.Mutex
+	objects map[string][]byte
+	puts    int
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/") {
+		http.Error(w, "unsigned", http.StatusForbidden)
+		return
+	}
+	f.Lock()
+	defer f.Unlock()
+	switch r.Method {
+	case "PUT":
+		f.objects[r.URL.Path], _ = ioutil.ReadAll(r.Body)
+		f.puts++
+	case "GET":
+		data, ok := f.objects[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		var start, end int
+		fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end)
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(data[start : end+1])
+	}
+}
+
+func TestS3Store(t *testing.T) {
+	fake := &fakeS3{objects: make(map[string][]byte)}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	defer func(access string) { os.Setenv("AWS_ACCESS_KEY_ID", access) }(os.Getenv("AWS_ACCESS_KEY_ID"))
+	os.Setenv("AWS_ACCESS_KEY_ID", "key")
+
+	info := &InfoDict{PieceLength: 2 * STANDARD_BLOCK_LENGTH, Length: 3 * STANDARD_BLOCK_LENGTH}
+	store, size, err := openStore(info, "", storeOptions{storage: storageS3, url: server.URL + "/bucket/share"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != info.Length {
+		t.Errorf("Expected a size of %d, got %d", info.Length, size)
+	}
+
+	block := make([]byte, STANDARD_BLOCK_LENGTH)
+	block[0] = 1
+	store.WriteAt(block, STANDARD_BLOCK_LENGTH)
+	if fake.puts != 0 {
+		t.Error("Expected incomplete pieces to stay in memory")
+	}
+	buf := make([]byte, 2)
+	if _, err := store.ReadAt(buf, STANDARD_BLOCK_LENGTH-1); err != nil || buf[0] != 0 || buf[1] != 1 {
+		t.Errorf("Expected to read the written block, got %v, %v", buf, err)
+	}
+
+	store.WriteAt(block, 0)
+	store.WriteAt(block, 2*STANDARD_BLOCK_LENGTH)
+	if fake.puts != 2 {
+		t.Errorf("Expected the 2 pieces to be uploaded, got %d uploads", fake.puts)
+	}
+	if _, ok := fake.objects["/bucket/share/"+s3PieceKey(store.(*s3Store).infoHash, 1)]; !ok || len(store.(*s3Store).infoHash) != 40 {
+		t.Error("Expected the last piece in the bucket")
+	}
+	if _, err := store.ReadAt(buf, STANDARD_BLOCK_LENGTH-1); err != nil || buf[0] != 0 || buf[1] != 1 {
+		t.Errorf("Expected to read the uploaded block, got %v, %v", buf, err)
+	}
+
+	if _, _, err := openStore(info, "", storeOptions{storage: storageS3}); err != errNoStorageURL {
+		t.Errorf("Expected %v, got %v", errNoStorageURL, err)
+	}
+}
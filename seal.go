@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+
+	ed "github.com/agl/ed25519"
+	"github.com/zeebo/bencode"
+
+	"github.com/rakoo/rakoshare/pkg/id"
+)
+
+// Replicas that only hold the store id of a share, such as a rented
+// server, can keep and serve it sealed. Each piece is encrypted with a key
+// derived from the seal key of the share and from the hash of the piece,
+// so that a piece always seals the same way and replicas check sealed
+// pieces against the hashes of a sealed info dict, like any torrent.
+// Writers publish that info dict over the control channel, along with the
+// info dict of the revision encrypted for readers. Readers seal and unseal
+// the pieces they exchange with replicas on the fly.
+
+// The name of the single file of sealed torrents
+const sealedName = "rakoshare-sealed"
+
+var (
+	errNotSealable = errors.New("only v1 torrents can be sealed")
+	errSealedSig   = errors.New("sealed revision not signed by a writer of the share")
+	errSealedPlain = errors.New("couldn't open the info dict of a sealed revision")
+)
+
+// SealedMessage is the payload of the bs_sealed extension.
+type SealedMessage struct {
+	// The infohash of the revision, and its sealed info dict
+	InfoHash string `bencode:"infohash"`
+	Info     string `bencode:"info"`
+
+	// The signature and the info dict of the revision, encrypted with the
+	// seal key, so that readers can fetch it from replicas alone
+	Plain string `bencode:"plain"`
+
+	Sig string `bencode:"sig,omitempty"`
+}
+
+func (s SealedMessage) signedBytes() ([]byte, error) {
+	s.Sig = ""
+	var buf bytes.Buffer
+	err := bencode.NewEncoder(&buf).Encode(s)
+	return buf.Bytes(), err
+}
+
+func (s *SealedMessage) sign(priv id.PrivKey) error {
+	signed, err := s.signedBytes()
+	if err != nil {
+		return err
+	}
+	privarg := [ed.PrivateKeySize]byte(priv)
+	sig := ed.Sign(&privarg, signed)
+	s.Sig = string(sig[:])
+	return nil
+}
+
+func (s SealedMessage) verify(pub id.PubKey) error {
+	if len(s.Sig) != ed.SignatureSize {
+		return errSealedSig
+	}
+	signed, err := s.signedBytes()
+	if err != nil {
+		return err
+	}
+	pubarg := [ed.PublicKeySize]byte(pub)
+	var sig [ed.SignatureSize]byte
+	copy(sig[:], s.Sig)
+	if !ed.Verify(&pubarg, signed, &sig) {
+		return errSealedSig
+	}
+	return nil
+}
+
+// sealedInfoHash returns the infohash of the sealed torrent.
+func (s SealedMessage) sealedInfoHash() string {
+	return infoHashOf([]byte(s.Info))
+}
+
+// torrent returns the metainfo of the sealed torrent, as
+// NewTorrentSession takes it.
+func (s SealedMessage) torrent() string {
+	return "d4:info" + s.Info + "e"
+}
+
+// pieceSealKey returns the key of the piece whose hash is hash.
+func pieceSealKey(seal id.PreSharedKey, hash []byte) []byte {
+	mac := hmac.New(sha256.New, seal[:])
+	mac.Write(hash)
+	return mac.Sum(nil)
+}
+
+// sealBytes seals or unseals p, found at offset in its piece, with
+// AES-CTR under key.
+func sealBytes(key, p []byte, offset int64) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	iv := make([]byte, aes.BlockSize)
+	binary.BigEndian.PutUint64(iv[8:], uint64(offset/aes.BlockSize))
+	stream := cipher.NewCTR(block, iv)
+	if skip := offset % aes.BlockSize; skip > 0 {
+		stream.XORKeyStream(make([]byte, skip), make([]byte, skip))
+	}
+	stream.XORKeyStream(p, p)
+}
+
+// sealBlock seals or unseals the block of piece index starting at begin.
+func (t *TorrentSession) sealBlock(index, begin uint32, p []byte) {
+	hash := t.m.Info.Pieces[int(index)*sha1.Size : int(index+1)*sha1.Size]
+	sealBytes(pieceSealKey(*t.sealKey, []byte(hash)), p, int64(begin))
+}
+
+func plainAEAD(seal id.PreSharedKey) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, seal[:])
+	mac.Write([]byte("rakoshare sealed info"))
+	return newSecretsAEAD(mac.Sum(nil))
+}
+
+func sealPlain(seal id.PreSharedKey, sig string, info []byte) (string, error) {
+	aead, err := plainAEAD(seal)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	plain := append([]byte(sig), info...)
+	return string(aead.Seal(nonce, nonce, plain, nil)), nil
+}
+
+// openPlain returns the info dict of the revision of s and its signature.
+func openPlain(seal id.PreSharedKey, s SealedMessage) (info []byte, sig string, err error) {
+	aead, err := plainAEAD(seal)
+	if err != nil {
+		return
+	}
+	if len(s.Plain) < aead.NonceSize() {
+		return nil, "", errSealedPlain
+	}
+	sealed := []byte(s.Plain)
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil || len(plain) < ed.SignatureSize {
+		return nil, "", errSealedPlain
+	}
+	return plain[ed.SignatureSize:], string(plain[:ed.SignatureSize]), nil
+}
+
+// sealRevision reads the whole torrent of m from fs and returns its
+// sealed revision, signed with priv.
+func sealRevision(fs FileStore, m *MetaInfo, totalSize int64, seal id.PreSharedKey, priv id.PrivKey) (s SealedMessage, err error) {
+	if m.Info.isV2() {
+		return s, errNotSealable
+	}
+	pieceLength := m.Info.PieceLength
+	numPieces := int((totalSize + pieceLength - 1) / pieceLength)
+	sums := make([]byte, 0, numPieces*sha1.Size)
+	buf := make([]byte, pieceLength)
+	for i := 0; i < numPieces; i++ {
+		data := buf[:pieceSize(totalSize, pieceLength, i)]
+		if _, err = fs.ReadAt(data, int64(i)*pieceLength); err != nil {
+			return
+		}
+		if !m.pieceMatches(i, data) {
+			return s, fmt.Errorf("piece %d changed on disk", i)
+		}
+		hash := m.Info.Pieces[i*sha1.Size : (i+1)*sha1.Size]
+		sealBytes(pieceSealKey(seal, []byte(hash)), data, 0)
+		sum := sha1.Sum(data)
+		sums = append(sums, sum[:]...)
+	}
+
+	info := InfoDict{
+		Name:        sealedName,
+		Length:      totalSize,
+		PieceLength: pieceLength,
+		Pieces:      string(sums),
+		Private:     m.Info.Private,
+	}
+	var raw bytes.Buffer
+	if err = bencode.NewEncoder(&raw).Encode(info); err != nil {
+		return
+	}
+	plainInfo, err := m.RawInfo()
+	if err != nil {
+		return
+	}
+	s = SealedMessage{InfoHash: m.InfoHash, Info: raw.String()}
+	if s.Plain, err = sealPlain(seal, m.InfoSig, plainInfo); err != nil {
+		return
+	}
+	err = s.sign(priv)
+	return
+}
+
+// Sealed gives the sealed revisions we made, to publish.
+func (t *TorrentSession) Sealed() chan SealedMessage {
+	return t.sealedOut
+}
+
+// setSealed hands the session the sealed revision of its torrent, which
+// lets it talk to replicas. It is safe to call while the session runs.
+func (t *TorrentSession) setSealed(s SealedMessage) {
+	select {
+	case <-t.sealedIn:
+	default:
+	}
+	t.sealedIn <- s
+}
+
+// checkSealed seals the revision in the background when we are a writer
+// publishing sealed copies and have all of it.
+func (t *TorrentSession) checkSealed() {
+	if t.sealKey == nil || !t.store.sealed || !t.Id.CanWrite() || t.sealing ||
+		!t.si.HaveTorrent || t.goodPieces < t.totalPieces || t.sealedInfoHash() != "" {
+		return
+	}
+	t.sealing = true
+	fs, m, size, seal, priv := t.fileStore, t.m, t.totalSize, *t.sealKey, t.Id.Priv
+	go func() {
+		s, err := sealRevision(fs, m, size, seal, priv)
+		if err != nil {
+			log.Println("[TORRENT] Couldn't seal the revision: ", err)
+			return
+		}
+		t.setSealed(s)
+		select {
+		case t.sealedOut <- s:
+		default:
+		}
+	}()
+}
+
+// applySealed makes the session accept replicas on the sealed revision s.
+// Readers that don't have the info dict yet take it from s.
+func (t *TorrentSession) applySealed(s SealedMessage) {
+	if s.InfoHash != t.m.InfoHash || t.sealKey == nil {
+		return
+	}
+	if !t.si.HaveTorrent {
+		info, sig, err := openPlain(*t.sealKey, s)
+		if err == nil && infoHashOf(info) != t.m.InfoHash {
+			err = errSealedPlain
+		}
+		if err == nil {
+			err = t.checkInfo(info, sig)
+		}
+		if err != nil {
+			log.Println("[TORRENT] Ignoring sealed revision: ", err)
+			return
+		}
+		t.m.InfoSig = sig
+		if err = t.reload(info); err != nil {
+			return
+		}
+		for _, p := range t.peers.All() {
+			t.initPeerHave(p)
+			p.SendBitfield(t.pieceSet)
+		}
+	}
+	t.sealedLock.Lock()
+	t.sealedIH = s.sealedInfoHash()
+	t.sealedLock.Unlock()
+}
+
+func (t *TorrentSession) sealedInfoHash() string {
+	t.sealedLock.Lock()
+	defer t.sealedLock.Unlock()
+	return t.sealedIH
+}
+
+// sealedHeader returns our header on the sealed torrent.
+func (t *TorrentSession) sealedHeader() []byte {
+	header := append([]byte{}, t.Header()...)
+	copy(header[28:48], t.sealedInfoHash())
+	return header
+}
+
+// sealedFor returns the sealed revision of ih the writers published, if
+// any.
+func (cs *ControlSession) sealedFor(ih string) (SealedMessage, bool) {
+	cs.sealedLock.Lock()
+	defer cs.sealedLock.Unlock()
+	return cs.sealed, ih != "" && cs.sealed.InfoHash == ih
+}
+
+// storeSealed keeps s, unless we already have it or have the one of the
+// current revision. It tells whether s was kept.
+func (cs *ControlSession) storeSealed(s SealedMessage) bool {
+	current, _ := cs.current()
+	cs.sealedLock.Lock()
+	defer cs.sealedLock.Unlock()
+	if s.InfoHash == cs.sealed.InfoHash || cs.sealed.InfoHash == current && s.InfoHash != current {
+		return false
+	}
+	cs.sealed = s
+	return true
+}
+
+// AnnounceSealed publishes the sealed revision we made.
+func (cs *ControlSession) AnnounceSealed(s SealedMessage) {
+	if cs.storeSealed(s) {
+		cs.logf("Publishing sealed revision %x of %x", s.sealedInfoHash(), s.InfoHash)
+	}
+}
+
+// sendSealed sends p the last sealed revision, if any.
+func (cs *ControlSession) sendSealed(p *peerState) {
+	if _, ok := p.theirExtensions["bs_sealed"]; !ok {
+		return
+	}
+	cs.sealedLock.Lock()
+	s := cs.sealed
+	cs.sealedLock.Unlock()
+	if s.InfoHash != "" {
+		p.sendExtensionMessage("bs_sealed", s)
+	}
+}
+
+// broadcastSealed sends the last sealed revision to all peers, when it
+// changed since the last time.
+func (cs *ControlSession) broadcastSealed() {
+	cs.sealedLock.Lock()
+	ih := cs.sealed.InfoHash
+	cs.sealedLock.Unlock()
+	if ih == cs.sealedSent {
+		return
+	}
+	cs.sealedSent = ih
+	for _, p := range cs.peers.All() {
+		cs.sendSealed(p)
+	}
+}
+
+func (cs *ControlSession) DoSealed(msg []byte, p *peerState) (err error) {
+	var message SealedMessage
+	err = bencode.NewDecoder(bytes.NewReader(msg)).Decode(&message)
+	if err != nil {
+		cs.log("Couldn't decode sealed revision: ", err)
+		return
+	}
+	if !cs.ID.CanVerify() {
+		return
+	}
+	if err = message.verify(cs.WriterKey()); err != nil {
+		cs.log("Refusing sealed revision from", p.address, ":", err)
+		return nil
+	}
+	if !cs.storeSealed(message) {
+		return
+	}
+	select {
+	case cs.Sealed <- message:
+	default:
+		cs.log("Dropping sealed revision, nobody is listening")
+	}
+	return
+}
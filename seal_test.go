@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"testing"
+
+	"github.com/rakoo/rakoshare/pkg/id"
+)
+
+func TestSealBytes(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	plain := make([]byte, 100)
+	for i := range plain {
+		plain[i] = byte(i)
+	}
+	whole := append([]byte(nil), plain...)
+	sealBytes(key, whole, 0)
+	if bytes.Equal(whole, plain) {
+		t.Fatal("Expected sealed bytes to differ")
+	}
+
+	// Blocks seal as the part of the piece they are
+	for _, begin := range []int{0, 5, 16, 37} {
+		block := append([]byte(nil), plain[begin:]...)
+		sealBytes(key, block, int64(begin))
+		if !bytes.Equal(block, whole[begin:]) {
+			t.Errorf("Block at %d sealed differently from the whole piece", begin)
+		}
+		sealBytes(key, block, int64(begin))
+		if !bytes.Equal(block, plain[begin:]) {
+			t.Errorf("Block at %d didn't unseal", begin)
+		}
+	}
+
+	again := append([]byte(nil), plain...)
+	sealBytes(key, again, 0)
+	if !bytes.Equal(again, whole) {
+		t.Error("Expected the same piece to seal the same way")
+	}
+}
+
+func TestSealRevision(t *testing.T) {
+	writer, err := id.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seal, err := writer.SealKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := id.NewFromString(writer.S())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.SealKey(); err == nil {
+		t.Error("Store ids shouldn't know the seal key")
+	}
+	if store.SealedKey() != writer.SealedKey() {
+		t.Error("Store ids should reach the sealed channel")
+	}
+
+	tf := tests[0]
+	fs, _ := mkFileStore(tf)
+	data := make([]byte, tf.fileLen)
+	fs.ReadAt(data, 0)
+	const pieceLength = 1024
+	var pieces []byte
+	for i := 0; i < len(data); i += pieceLength {
+		end := i + pieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		sum := sha1.Sum(data[i:end])
+		pieces = append(pieces, sum[:]...)
+	}
+	m := &MetaInfo{Info: &InfoDict{Name: "share", PieceLength: pieceLength, Pieces: string(pieces), Length: tf.fileLen}}
+	raw, err := m.RawInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.InfoHash = infoHashOf(raw)
+	m.InfoSig = signInfo(raw, writer.Priv)
+
+	s, err := sealRevision(fs, m, tf.fileLen, seal, writer.Priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.verify(writer.Pub); err != nil {
+		t.Errorf("Expected a valid signature, got %v", err)
+	}
+	forged := s
+	forged.InfoHash = "x"
+	if err = forged.verify(writer.Pub); err != errSealedSig {
+		t.Errorf("Expected a forged sealed revision to be refused, got %v", err)
+	}
+
+	sealed, err := NewMetaInfoFromContent([]byte(s.torrent()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sealed.InfoHash != s.sealedInfoHash() || sealed.Info.Name != sealedName {
+		t.Fatalf("Unexpected sealed torrent %x %q", sealed.InfoHash, sealed.Info.Name)
+	}
+
+	// A reader seals piece 1 for a replica, which checks it
+	ts := &TorrentSession{m: m, sealKey: &seal}
+	block := append([]byte(nil), data[pieceLength:2*pieceLength]...)
+	ts.sealBlock(1, 0, block)
+	if bytes.Equal(block, data[pieceLength:2*pieceLength]) || !sealed.pieceMatches(1, block) {
+		t.Error("Expected the sealed piece to match the sealed torrent")
+	}
+
+	info, sig, err := openPlain(seal, s)
+	if err != nil || !bytes.Equal(info, raw) || sig != m.InfoSig {
+		t.Errorf("Expected readers to open the info dict, got %v", err)
+	}
+	var other id.PreSharedKey
+	if _, _, err = openPlain(other, s); err != errSealedPlain {
+		t.Errorf("Expected other keys not to open the info dict, got %v", err)
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"code.google.com/p/go.crypto/scrypt"
+	"github.com/rakoo/rakoshare/pkg/id"
+	"github.com/rakoo/rakoshare/pkg/sharesession"
+)
+
+var secretStoreKind = flag.String("secretStore", "", "Where the ids of the shares are kept: in their session file (empty), in the keychain of the system (keychain) or in a file encrypted with a passphrase (file)")
+
+// The service under which secrets are filed in the keychain
+const keychainService = "rakoshare"
+
+// The file of the encrypted store, in the working directory, and the
+// variable that may give its passphrase
+const (
+	secretsFile      = "secrets.enc"
+	passphraseEnvVar = "RAKOSHARE_PASSPHRASE"
+)
+
+var (
+	errNoSecret            = errors.New("no secret for this share")
+	errKeychainUnsupported = errors.New("no keychain on this system")
+	errBadPassphrase       = errors.New("wrong passphrase, or damaged secrets file")
+)
+
+// A secretStore keeps the ids of shares out of their session files, which
+// then only have the Store id. Secrets are filed by the hex infohash of
+// the share.
+type secretStore interface {
+	Get(account string) (string, error)
+	Set(account, secret string) error
+	Delete(account string) error
+}
+
+// The file stores opened so far, so that their passphrase is asked once
+var fileStores = make(map[string]*fileSecrets)
+
+// openSecretStore returns the store named kind, or nil when ids stay in
+// the session files.
+func openSecretStore(kind, workDir string) (secretStore, error) {
+	switch kind {
+	case "", "session":
+		return nil, nil
+	case "keychain":
+		return keychain{}, nil
+	case "file":
+		path := filepath.Join(workDir, secretsFile)
+		if fileStores[path] == nil {
+			fileStores[path] = &fileSecrets{path: path}
+		}
+		return fileStores[path], nil
+	}
+	return nil, fmt.Errorf("unknown secret store %q", kind)
+}
+
+// storedShareId returns the ids of the share with infohash ih, from its
+// session or from store.
+func storedShareId(store secretStore, session *sharesession.Session, ih string) id.Id {
+	shareID := session.GetShareId()
+	if store == nil || shareID.CanRead() {
+		return shareID
+	}
+	if secret, err := store.Get(ih); err == nil {
+		if stored, err := id.NewFromString(secret); err == nil {
+			return stored
+		}
+	}
+	return shareID
+}
+
+// saveSecrets files the ids of the session of the share with infohash
+// ih in store, then removes them from the session.
+func saveSecrets(store secretStore, session *sharesession.Session, ih string) error {
+	if store == nil {
+		return nil
+	}
+	shareID := session.GetShareId()
+	secret := shareID.WRS()
+	if secret == "" {
+		secret = shareID.RS()
+	}
+	if secret == "" {
+		return nil
+	}
+	if err := store.Set(ih, secret); err != nil {
+		return err
+	}
+	return session.ForgetSecrets()
+}
+
+// protectSecrets moves the ids of a share that was just saved to the
+// store chosen on the command line, if any.
+func protectSecrets(workDir string, session *sharesession.Session, shareID id.Id) error {
+	store, err := openSecretStore(*secretStoreKind, workDir)
+	if err != nil {
+		return err
+	}
+	return saveSecrets(store, session, hex.EncodeToString(shareID.Infohash))
+}
+
+// restoreSecrets puts the ids of the share with infohash ih back in its
+// session and removes them from store.
+func restoreSecrets(store secretStore, session *sharesession.Session, ih string) error {
+	secret, err := store.Get(ih)
+	if err == errNoSecret {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err = session.RestoreSecret(secret); err != nil {
+		return err
+	}
+	return store.Delete(ih)
+}
+
+// MoveSecrets moves the ids of all shares to the store named kind, from
+// wherever they are. The session store puts them back in the session
+// files.
+func MoveSecrets(workDir, kind string) error {
+	to, err := openSecretStore(kind, workDir)
+	if err != nil {
+		return err
+	}
+	from := make(map[string]secretStore)
+	for _, k := range []string{"keychain", "file"} {
+		if k != kind {
+			from[k], _ = openSecretStore(k, workDir)
+		}
+	}
+	shares, err := List(workDir)
+	if err != nil {
+		return err
+	}
+	for _, s := range shares {
+		ih := strings.TrimSuffix(filepath.Base(s.sessionFile), ".sql")
+		for _, store := range from {
+			if err := restoreSecrets(store, s.session, ih); err != nil && err != errKeychainUnsupported {
+				return err
+			}
+		}
+		if err := saveSecrets(to, s.session, ih); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fileSecrets keeps secrets in a file encrypted with AES-GCM, under a key
+// derived from a passphrase with scrypt. The passphrase is asked once,
+// when the file exists or is created.
+type fileSecrets struct {
+	path       string
+	passphrase string
+}
+
+const secretsSaltSize = 16
+
+func (f *fileSecrets) key(salt []byte) ([]byte, error) {
+	if f.passphrase == "" {
+		f.passphrase = os.Getenv(passphraseEnvVar)
+	}
+	if f.passphrase == "" {
+		fmt.Fprint(os.Stderr, T(msgPassphrase))
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return nil, err
+		}
+		f.passphrase = strings.TrimRight(line, "\r\n")
+	}
+	return scrypt.Key([]byte(f.passphrase), salt, 1<<15, 8, 1, 32)
+}
+
+func (f *fileSecrets) load() (map[string]string, error) {
+	secrets := make(map[string]string)
+	raw, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return secrets, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) < secretsSaltSize {
+		return nil, errBadPassphrase
+	}
+	key, err := f.key(raw[:secretsSaltSize])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newSecretsAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	sealed := raw[secretsSaltSize:]
+	if len(sealed) < aead.NonceSize() {
+		return nil, errBadPassphrase
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, errBadPassphrase
+	}
+	return secrets, json.Unmarshal(plain, &secrets)
+}
+
+func (f *fileSecrets) save(secrets map[string]string) error {
+	plain, err := json.Marshal(secrets)
+	if err != nil {
+		return err
+	}
+	salt := make([]byte, secretsSaltSize)
+	if _, err = io.ReadFull(rand.Reader, salt); err != nil {
+		return err
+	}
+	key, err := f.key(salt)
+	if err != nil {
+		return err
+	}
+	aead, err := newSecretsAEAD(key)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	out := append(salt, aead.Seal(nonce, nonce, plain, nil)...)
+	tmp := f.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, out, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.path)
+}
+
+func newSecretsAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (f *fileSecrets) Get(account string) (string, error) {
+	secrets, err := f.load()
+	if err != nil {
+		return "", err
+	}
+	secret, ok := secrets[account]
+	if !ok {
+		return "", errNoSecret
+	}
+	return secret, nil
+}
+
+func (f *fileSecrets) Set(account, secret string) error {
+	secrets, err := f.load()
+	if err != nil {
+		return err
+	}
+	secrets[account] = secret
+	return f.save(secrets)
+}
+
+func (f *fileSecrets) Delete(account string) error {
+	secrets, err := f.load()
+	if err != nil {
+		return err
+	}
+	if _, ok := secrets[account]; !ok {
+		return nil
+	}
+	delete(secrets, account)
+	return f.save(secrets)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, secretsFile)
+
+	store := &fileSecrets{path: path, passphrase: "correct horse"}
+	if _, err := store.Get("share"); err != errNoSecret {
+		t.Fatalf("Expected no secret yet, got %v", err)
+	}
+	if err := store.Set("share", "secret id"); err != nil {
+		t.Fatal(err)
+	}
+	if secret, err := store.Get("share"); err != nil || secret != "secret id" {
+		t.Fatalf("Expected the secret back, got %q (%v)", secret, err)
+	}
+
+	raw, _ := ioutil.ReadFile(path)
+	if len(raw) == 0 || string(raw) == "secret id" {
+		t.Fatal("The secrets file should be encrypted")
+	}
+	wrong := &fileSecrets{path: path, passphrase: "battery staple"}
+	if _, err := wrong.Get("share"); err != errBadPassphrase {
+		t.Errorf("Expected a wrong passphrase, got %v", err)
+	}
+
+	reopened := &fileSecrets{path: path, passphrase: "correct horse"}
+	if err := reopened.Delete("share"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get("share"); err != errNoSecret {
+		t.Errorf("Expected the secret to be deleted, got %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/zeebo/bencode"
+)
+
+// When the last revision we had in full was complete, so that restarts
+// don't seed it for SeedTime again
+const settingCompleted = "completed"
+
+type completion struct {
+	InfoHash string `bencode:"infohash"`
+	At       int64  `bencode:"at"`
+}
+
+// seedLimits tell when a data session that has the whole revision stops
+// uploading: once it uploaded ratio times the size of the revision, or
+// bytes bytes, or after seeding for duration. Zero means no limit. The
+// control session keeps following revisions, and the next revision is
+// seeded again.
+type seedLimits struct {
+	ratio    float64
+	bytes    int64
+	duration time.Duration
+}
+
+func (c ShareConfig) seedLimits() seedLimits {
+	return seedLimits{ratio: c.SeedRatio, bytes: c.SeedBytes, duration: time.Duration(c.SeedTime)}
+}
+
+// reached tells whether a session complete since completed, that uploaded
+// uploaded bytes of a revision of size bytes, is done seeding, and why.
+func (l seedLimits) reached(uploaded, size int64, completed, now time.Time) (bool, string) {
+	switch {
+	case l.ratio > 0 && size > 0 && float64(uploaded) >= l.ratio*float64(size):
+		return true, fmt.Sprintf("ratio of %.2f reached", l.ratio)
+	case l.bytes > 0 && uploaded >= l.bytes:
+		return true, fmt.Sprintf("%d bytes uploaded", uploaded)
+	case l.duration > 0 && now.Sub(completed) >= l.duration:
+		return true, fmt.Sprintf("seeded for %s", l.duration)
+	}
+	return false, ""
+}
+
+// completedAt returns when the revision ih was first complete, recording
+// now if it wasn't known. It is now without a session.
+func (s *syncedState) completedAt(ih string, now time.Time) time.Time {
+	if s == nil {
+		return now
+	}
+	var c completion
+	raw := s.session.GetSetting(settingCompleted)
+	if raw != "" && bencode.NewDecoder(strings.NewReader(raw)).Decode(&c) == nil && c.InfoHash == ih {
+		return time.Unix(0, c.At)
+	}
+	var buf bytes.Buffer
+	err := bencode.NewEncoder(&buf).Encode(completion{InfoHash: ih, At: now.UnixNano()})
+	if err == nil {
+		err = s.session.SetSetting(settingCompleted, buf.String())
+	}
+	if err != nil {
+		log.Println("Couldn't record when the revision was complete:", err)
+	}
+	return now
+}
+
+// checkSeedLimits stops uploading once the seeding limits of the share
+// are reached. Peers are choked and their requests rejected from then on.
+func (t *TorrentSession) checkSeedLimits(now time.Time) {
+	if t.doneSeeding || t.completedAt.IsZero() {
+		return
+	}
+	done, why := t.limits.seed.reached(atomic.LoadInt64(&t.si.Uploaded), t.totalSize, t.completedAt, now)
+	if !done {
+		return
+	}
+	log.Println("[TORRENT] Done seeding:", why)
+	t.doneSeeding = true
+	t.optimistic = nil
+	for _, p := range t.peers.All() {
+		p.SetChoke(true)
+	}
+}
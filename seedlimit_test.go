@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSeedLimitsReached(t *testing.T) {
+	completed := time.Unix(1400000000, 0)
+	vectors := []struct {
+		limits   seedLimits
+		uploaded int64
+		after    time.Duration
+		done     bool
+	}{
+		{seedLimits{}, 1 << 30, 24 * time.Hour, false},
+		{seedLimits{ratio: 1.5}, 140, 0, false},
+		{seedLimits{ratio: 1.5}, 150, 0, true},
+		{seedLimits{bytes: 50}, 49, 0, false},
+		{seedLimits{bytes: 50}, 50, 0, true},
+		{seedLimits{duration: time.Hour}, 0, time.Minute, false},
+		{seedLimits{duration: time.Hour}, 0, time.Hour, true},
+		{seedLimits{ratio: 10, duration: time.Hour}, 0, 2 * time.Hour, true},
+	}
+	for i, v := range vectors {
+		if done, why := v.limits.reached(v.uploaded, 100, completed, completed.Add(v.after)); done != v.done {
+			t.Errorf("%d: expected %t, got %t (%s)", i, v.done, done, why)
+		}
+	}
+}
+
+func TestCheckSeedLimits(t *testing.T) {
+	ts := &TorrentSession{
+		si:          &SessionInfo{Uploaded: 300},
+		totalSize:   100,
+		peers:       newPeers(),
+		limits:      transferLimits{seed: seedLimits{ratio: 2}},
+		completedAt: time.Now(),
+	}
+	p := newEndgamePeer()
+	ts.peers.peerList = []*peerState{p}
+
+	ts.checkSeedLimits(time.Now())
+	if !ts.doneSeeding || !p.am_choking {
+		t.Fatal("Expected the session to stop uploading")
+	}
+	ts.unchokeIfFreeSlot(p)
+	if !p.am_choking {
+		t.Error("Peers shouldn't be unchoked once seeding is done")
+	}
+}
+
+func TestCompletedAtWithoutSession(t *testing.T) {
+	var none *syncedState
+	now := time.Now()
+	if at := none.completedAt("ih", now); !at.Equal(now) {
+		t.Errorf("Expected %s, got %s", now, at)
+	}
+}
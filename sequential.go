@@ -0,0 +1,48 @@
+package main
+
+import (
+	"flag"
+	"path"
+	"path/filepath"
+)
+
+var sequentialAll = flag.Bool("sequential", false, "Download the files of all shares in order, so that media can be played before the sync is complete. Shares can also download only some files in order")
+
+// sequentialRanges returns the first and last pieces of the files of info
+// whose path matches patterns, which are downloaded in order.
+func sequentialRanges(info *InfoDict, patterns []string) (ranges [][2]int) {
+	if len(patterns) == 0 {
+		return nil
+	}
+	files := info.layout()
+	if len(files) == 0 {
+		files = []*FileDict{{Length: info.Length, Path: []string{info.Name}}}
+	}
+	var offset int64
+	for _, f := range files {
+		start := offset
+		offset += f.Length
+		if f.isPad() || f.Length == 0 || !matchPatterns(patterns, filepath.FromSlash(path.Join(f.Path...))) {
+			continue
+		}
+		ranges = append(ranges, [2]int{int(start / info.PieceLength), int((offset - 1) / info.PieceLength)})
+	}
+	return
+}
+
+// chooseSequential returns the first piece of the files downloaded in
+// order that we need from p, that nobody downloads yet and that none of
+// lan has, or -1.
+func (t *TorrentSession) chooseSequential(p *peerState, lan []*peerState) int {
+	for _, r := range t.sequential {
+		for piece := r[0]; piece <= r[1]; piece++ {
+			if t.pieceSet.IsSet(piece) || !p.have.IsSet(piece) || lanHas(lan, piece) {
+				continue
+			}
+			if _, ok := t.activePieces[piece]; !ok {
+				return piece
+			}
+		}
+	}
+	return -1
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/rakoo/rakoshare/pkg/bitset"
+)
+
+func TestSequentialRanges(t *testing.T) {
+	info := &InfoDict{PieceLength: 10, Files: []*FileDict{
+		{Length: 15, Path: []string{"notes.txt"}},
+		{Length: 30, Path: []string{"films", "a.mkv"}},
+		{Length: 5, Path: []string{"b.mkv"}},
+	}}
+	if ranges := sequentialRanges(info, nil); ranges != nil {
+		t.Errorf("Expected nothing in order, got %v", ranges)
+	}
+	expected := [][2]int{{1, 4}, {4, 4}}
+	if ranges := sequentialRanges(info, []string{"*.mkv"}); !reflect.DeepEqual(ranges, expected) {
+		t.Errorf("Expected %v, got %v", expected, ranges)
+	}
+	expected = [][2]int{{0, 1}, {1, 4}, {4, 4}}
+	if ranges := sequentialRanges(info, []string{"*"}); !reflect.DeepEqual(ranges, expected) {
+		t.Errorf("Expected %v, got %v", expected, ranges)
+	}
+}
+
+func TestChooseSequential(t *testing.T) {
+	const pieces = 6
+	ts := &TorrentSession{
+		pieceSet:     bitset.New(pieces),
+		activePieces: make(map[int]*ActivePiece),
+		totalPieces:  pieces,
+		sequential:   [][2]int{{2, 4}},
+	}
+	p := &peerState{have: bitset.New(pieces)}
+	for i := 0; i < pieces; i++ {
+		p.have.Set(i)
+	}
+
+	ts.pieceSet.Set(2)
+	ts.activePieces[3] = &ActivePiece{}
+	if piece := ts.ChoosePiece(p, nil); piece != 4 {
+		t.Errorf("Expected the next piece in order, got %d", piece)
+	}
+	ts.pieceSet.Set(4)
+	for i := 0; i < 10; i++ {
+		if piece := ts.ChoosePiece(p, nil); piece == 2 || piece == 3 || piece == 4 {
+			t.Fatalf("Expected any other piece once the file is complete, got %d", piece)
+		}
+	}
+}
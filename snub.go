@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"time"
+)
+
+var requestTimeout = flag.Duration("requestTimeout", 30*time.Second, "Give up on blocks a peer didn't send for that long, and ask other peers for them")
+
+// A peer that leaves a request unanswered for requestTimeout snubbed us:
+// its blocks are requested from other peers, it gets a single request at
+// a time and no upload slot until it sends a block again. That way a dead
+// connection can't hold pieces hostage.
+
+// expireRequests forgets the requests to p older than requestTimeout, and
+// tells whether there were any.
+func (t *TorrentSession) expireRequests(p *peerState, now time.Time) (expired bool) {
+	if *requestTimeout <= 0 {
+		return false
+	}
+	for k, r := range p.our_requests {
+		if now.Sub(r.at) <= *requestTimeout {
+			continue
+		}
+		piece := int(k >> 32)
+		block := int(k&0xffffffff) / STANDARD_BLOCK_LENGTH
+		delete(p.our_requests, k)
+		t.removeRequest(piece, block, r.blocks)
+		expired = true
+	}
+	return
+}
+
+// snub marks p as snubbed, chokes it and hands its blocks to other peers.
+func (t *TorrentSession) snub(p *peerState) {
+	if !p.snubbed {
+		log.Println("Peer", p.address, "snubbed us")
+		snubbedPeers.Add(1)
+		p.snubbed = true
+	}
+	if t.optimistic == p {
+		t.optimistic = nil
+	}
+	p.SetChoke(true)
+	for _, peer := range t.peers.All() {
+		if peer != p && !peer.snubbed {
+			t.RequestBlock(peer)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSnub(t *testing.T) {
+	const blocks = 4
+	ts := &TorrentSession{
+		m:            &MetaInfo{Info: &InfoDict{PieceLength: blocks * STANDARD_BLOCK_LENGTH}},
+		totalSize:    blocks * STANDARD_BLOCK_LENGTH,
+		si:           &SessionInfo{},
+		activePieces: make(map[int]*ActivePiece),
+		peers:        newPeers(),
+	}
+	ts.activatePiece(0)
+	ts.activePieces[0].verifying = true
+	p := newEndgamePeer()
+	p.peer_interested = true
+	ts.peers.peerList = []*peerState{p}
+
+	ts.requestBlockImp(p, 0, 0, 2, true)
+	ts.activePieces[0].downloaderCount[0]++
+	ts.activePieces[0].downloaderCount[1]++
+
+	if ts.expireRequests(p, time.Now()) {
+		t.Fatal("Fresh requests shouldn't expire")
+	}
+	if !ts.expireRequests(p, time.Now().Add(*requestTimeout+time.Second)) {
+		t.Fatal("Expected the request to expire")
+	}
+	if len(p.our_requests) != 0 || ts.activePieces[0].downloaderCount[0] != 0 || ts.activePieces[0].downloaderCount[1] != 0 {
+		t.Errorf("Expected the blocks to be free again, got %v", ts.activePieces[0].downloaderCount)
+	}
+
+	ts.snub(p)
+	if !p.snubbed || !p.am_choking || p.maxOurRequests() != 1 {
+		t.Errorf("Expected a choked peer with a single request, got %t %t %d", p.snubbed, p.am_choking, p.maxOurRequests())
+	}
+	if unchoked := chooseUnchoked(ts.peers.All(), 3, false); unchoked[p] {
+		t.Error("Snubbed peers shouldn't be unchoked")
+	}
+
+	ts.RecordBlock(p, 0, 0, STANDARD_BLOCK_LENGTH)
+	if p.snubbed {
+		t.Error("Expected the peer to be trusted again after a block")
+	}
+}
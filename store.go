@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"sort"
+)
+
+// A storeBackend opens the files described by info, which the share keeps
+// at storePath, and returns them with their total size.
+type storeBackend func(info *InfoDict, storePath string, opts storeOptions) (FileStore, int64, error)
+
+// storeBackends are the available storages, by name. Backends register
+// themselves at init.
+var storeBackends = make(map[string]storeBackend)
+
+func registerStore(name string, backend storeBackend) {
+	if _, ok := storeBackends[name]; ok {
+		panic("storage registered twice: " + name)
+	}
+	storeBackends[name] = backend
+}
+
+// storageNames returns the names of the available storages, sorted.
+func storageNames() []string {
+	var names []string
+	for name := range storeBackends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func validStorage(storage string) bool {
+	_, ok := storeBackends[storage]
+	return storage == "" || ok
+}
+
+// openStore opens the files of info with the storage of opts, plain files
+// by default, or memory in RAM mode.
+func openStore(info *InfoDict, storePath string, opts storeOptions) (FileStore, int64, error) {
+	storage := opts.storage
+	if *ramMode {
+		storage = storageMemory
+	} else if storage == "" {
+		storage = storageFiles
+	}
+	backend, ok := storeBackends[storage]
+	if !ok {
+		return nil, 0, errors.New("unknown storage: " + storage)
+	}
+	return backend(info, storePath, opts)
+}
+
+// totalSize returns the size of all the files of info.
+func (info *InfoDict) totalSize() int64 {
+	size := info.Length
+	for _, f := range info.layout() {
+		size += f.Length
+	}
+	return size
+}
+
+// spanPieces calls access on the parts of p that belong to each piece of
+// a store of size bytes, from the global offset off, for stores that keep
+// pieces rather than files.
+func spanPieces(size, pieceLength int64, p []byte, off int64, access func(piece int, p []byte, begin int64) error) (n int, err error) {
+	if off < 0 || off+int64(len(p)) > size {
+		return 0, errPastEndOfStore
+	}
+	for len(p) > 0 {
+		piece := int(off / pieceLength)
+		begin := off % pieceLength
+		chunk := int64(len(p))
+		if space := pieceSize(size, pieceLength, piece) - begin; space < chunk {
+			chunk = space
+		}
+		if err = access(piece, p[:chunk], begin); err != nil {
+			return
+		}
+		n += int(chunk)
+		p = p[chunk:]
+		off += chunk
+	}
+	return
+}
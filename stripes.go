@@ -0,0 +1,59 @@
+package main
+
+import (
+	"flag"
+	"log"
+)
+
+// A single TCP connection often can't fill a fast link, which matters
+// most when only two devices sync. Devices that both support it open
+// additional connections to each other, called stripes; each stripe
+// requests its own blocks, so transfers are spread over all of them.
+//
+// The number of connections each side accepts is sent in the bs_conns
+// field of the extension handshake. Only the side that dialed the first
+// connection opens the others.
+
+var connectionsPerPeer = flag.Int("connectionsPerPeer", 2, "Number of parallel connections to each device that supports them. 1 disables parallel connections")
+
+// Never open more than that, whatever the flag says
+const maxConnectionsPerPeer = 8
+
+// stripes returns how many connections we agreed to have with p.
+func (p *peerState) stripes() int {
+	n := *connectionsPerPeer
+	if p.theirConns < n {
+		n = p.theirConns
+	}
+	if n > maxConnectionsPerPeer {
+		n = maxConnectionsPerPeer
+	}
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// openStripes opens the additional connections agreed upon with p, if
+// we are the ones to do it.
+func (t *TorrentSession) openStripes(p *peerState) {
+	if !p.outbound || p.stripe {
+		return
+	}
+	dial := t.dialBtConn
+	if p.sealed {
+		dial = t.dialSealed
+	}
+	for i := t.peers.CountID(p.id); i < p.stripes(); i++ {
+		btconn, err := dial(p.address)
+		if err != nil {
+			log.Printf("[TORRENT] Couldn't open another connection to %s: %s\n", p.address, err)
+			return
+		}
+		if btconn == nil {
+			return
+		}
+		btconn.stripe = true
+		t.AddPeer(btconn)
+	}
+}
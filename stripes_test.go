@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+// addrConn is a connection that only knows its addresses.
+type addrConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c addrConn) LocalAddr() net.Addr  { return c.local }
+func (c addrConn) RemoteAddr() net.Addr { return c.remote }
+func (c addrConn) Close() error         { return nil }
+
+func stripePeer(id string, localPort, remotePort int) *peerState {
+	p := NewPeerState(addrConn{
+		local:  &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: localPort},
+		remote: &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: remotePort},
+	})
+	p.id = id
+	p.address = p.conn.RemoteAddr().String()
+	return p
+}
+
+func TestStripesNegotiation(t *testing.T) {
+	defer func(n int) { *connectionsPerPeer = n }(*connectionsPerPeer)
+	*connectionsPerPeer = 3
+
+	p := &peerState{}
+	if p.stripes() != 1 {
+		t.Errorf("Expected a single connection to peers that don't support stripes, got %d", p.stripes())
+	}
+	p.theirConns = 2
+	if p.stripes() != 2 {
+		t.Errorf("Expected the lowest of both sides, got %d", p.stripes())
+	}
+	p.theirConns = 100
+	if p.stripes() != 3 {
+		t.Errorf("Expected our own limit, got %d", p.stripes())
+	}
+}
+
+func TestPeersKeepStripes(t *testing.T) {
+	defer func(n int) { *connectionsPerPeer = n }(*connectionsPerPeer)
+	*connectionsPerPeer = 2
+
+	peers := newPeers()
+	first := stripePeer("device", 40000, 6881)
+	if !peers.Add(first) {
+		t.Fatal("Expected the first connection to be kept")
+	}
+	first.theirConns = 2
+
+	if !peers.Add(stripePeer("device", 40001, 6881)) {
+		t.Fatal("Expected a stripe to be kept")
+	}
+	if peers.CountID("device") != 2 {
+		t.Fatalf("Expected 2 connections, got %d", peers.CountID("device"))
+	}
+	// One too many: the usual duplicate elimination applies
+	if peers.Add(stripePeer("device", 40002, 6881)) {
+		t.Error("Expected connections beyond the agreed number to be refused")
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	ed "github.com/agl/ed25519"
+	"github.com/rakoo/rakoshare/pkg/id"
+	"github.com/zeebo/bencode"
+)
+
+// The setting where the last signed summary we know of is kept
+const settingSummary = "summary"
+
+const (
+	SUMMARY_REQUEST = iota
+	SUMMARY_DATA
+)
+
+// ShareSummary describes the content of a revision of a share, so that a
+// device can check what it is about to join before any data flows.
+type ShareSummary struct {
+	InfoHash string `bencode:"infohash"`
+	Rev      string `bencode:"rev"`
+	Size     int64  `bencode:"size"`
+	Files    int64  `bencode:"files"`
+
+	// The directories at the root of the share
+	Dirs []string `bencode:"dirs"`
+}
+
+// SummaryMessage is the payload of the bs_summary extension: either a
+// request, or a summary signed by a writer of the share.
+type SummaryMessage struct {
+	Type    int64        `bencode:"type"`
+	Summary ShareSummary `bencode:"summary"`
+	Sig     string       `bencode:"sig"`
+}
+
+// summarize describes the content of m, the torrent of revision rev.
+func summarize(m *MetaInfo, rev string) ShareSummary {
+	s := ShareSummary{
+		InfoHash: m.InfoHash,
+		Rev:      rev,
+		Dirs:     []string{},
+	}
+	files := m.Info.fileList()
+	if len(files) == 0 {
+		s.Size = m.Info.Length
+		s.Files = 1
+		return s
+	}
+
+	dirs := make(map[string]bool)
+	for _, f := range files {
+		s.Size += f.Length
+		s.Files++
+		if len(f.Path) > 1 {
+			dirs[f.Path[0]] = true
+		}
+	}
+	for dir := range dirs {
+		s.Dirs = append(s.Dirs, dir)
+	}
+	sort.Strings(s.Dirs)
+	return s
+}
+
+func signSummary(s ShareSummary, priv id.PrivKey) (msg SummaryMessage, err error) {
+	var buf bytes.Buffer
+	err = bencode.NewEncoder(&buf).Encode(s)
+	if err != nil {
+		return
+	}
+
+	var privarg [ed.PrivateKeySize]byte
+	copy(privarg[:], priv[:])
+	sig := ed.Sign(&privarg, buf.Bytes())
+
+	return SummaryMessage{
+		Type:    SUMMARY_DATA,
+		Summary: s,
+		Sig:     string(sig[:]),
+	}, nil
+}
+
+func verifySummary(msg SummaryMessage, pubKey id.PubKey) error {
+	var buf bytes.Buffer
+	err := bencode.NewEncoder(&buf).Encode(msg.Summary)
+	if err != nil {
+		return err
+	}
+
+	pub := [ed.PublicKeySize]byte(pubKey)
+	var sig [ed.SignatureSize]byte
+	copy(sig[:], msg.Sig)
+	if !ed.Verify(&pub, buf.Bytes(), &sig) {
+		return errors.New("Bad Signature")
+	}
+	return nil
+}
+
+// storedSummary returns the last signed summary we know of.
+func (cs *ControlSession) storedSummary() (msg SummaryMessage, ok bool) {
+	raw := cs.session.GetSetting(settingSummary)
+	if raw == "" {
+		return
+	}
+	err := bencode.NewDecoder(strings.NewReader(raw)).Decode(&msg)
+	return msg, err == nil
+}
+
+// currentSummary returns the signed summary of the current revision, if we
+// have it. Writers sign it themselves from the current torrent.
+func (cs *ControlSession) currentSummary() (msg SummaryMessage, ok bool) {
+	ih, rev := cs.current()
+	if msg, ok = cs.storedSummary(); ok && msg.Summary.InfoHash == ih {
+		return
+	}
+	if !cs.ID.CanWrite() {
+		return msg, false
+	}
+
+	m := currentMetaInfo(cs.session)
+	if m == nil || m.InfoHash != ih {
+		return msg, false
+	}
+	msg, err := signSummary(summarize(m, rev.String()), cs.ID.Priv)
+	if err != nil {
+		cs.log("Couldn't sign summary: ", err)
+		return msg, false
+	}
+	cs.saveSummary(msg)
+	return msg, true
+}
+
+func (cs *ControlSession) saveSummary(msg SummaryMessage) {
+	var buf bytes.Buffer
+	err := bencode.NewEncoder(&buf).Encode(msg)
+	if err == nil {
+		err = cs.session.SetSetting(settingSummary, buf.String())
+	}
+	if err != nil {
+		cs.log("Couldn't save summary: ", err)
+	}
+}
+
+// requestSummary asks p for the summary of its current revision. Writers
+// make their own.
+func (cs *ControlSession) requestSummary(p *peerState) {
+	if cs.ID.CanWrite() {
+		return
+	}
+	p.sendExtensionMessage("bs_summary", SummaryMessage{Type: SUMMARY_REQUEST})
+}
+
+func (cs *ControlSession) DoSummary(msg []byte, p *peerState) (err error) {
+	var message SummaryMessage
+	err = bencode.NewDecoder(bytes.NewReader(msg)).Decode(&message)
+	if err != nil {
+		cs.log("Couldn't decode summary message: ", err)
+		return
+	}
+
+	switch message.Type {
+	case SUMMARY_REQUEST:
+		if summary, ok := cs.currentSummary(); ok {
+			p.sendExtensionMessage("bs_summary", summary)
+		}
+	case SUMMARY_DATA:
+		if !cs.ID.CanRead() {
+			// We can't check it
+			return
+		}
+		err = verifySummary(message, cs.ID.Pub)
+		if err != nil {
+			return
+		}
+		if stored, ok := cs.storedSummary(); !ok || !isRevOlder(message.Summary.Rev, stored.Summary.Rev) {
+			cs.saveSummary(message)
+		}
+		select {
+		case cs.Summaries <- message.Summary:
+		default:
+		}
+	}
+	return
+}
+
+// isRevOlder tells whether revision a comes before revision b.
+func isRevOlder(a, b string) bool {
+	var ca, cb int
+	fmt.Sscanf(a, "%d-", &ca)
+	fmt.Sscanf(b, "%d-", &cb)
+	return ca < cb
+}
+
+// Preview connects to the peers of a share and shows the summary of its
+// current revision, without downloading anything.
+func Preview(cliId string, workDir string, trackers, manualPeers []string, timeout time.Duration) error {
+	shareID, err := id.NewFromString(cliId)
+	if err != nil {
+		return newUserError(msgBadID, err)
+	}
+	if !shareID.CanRead() {
+		return newUserError(msgPreviewNeedsRead)
+	}
+	session, err := openSession(workDir, shareID)
+	if err != nil {
+		return newUserError(msgOpenSession, err)
+	}
+	err = session.AddTrackers(trackers)
+	if err != nil {
+		log.Println("Couldn't save trackers: ", err)
+	}
+
+	conChan, listenPort, err := listenForPeerConnections(map[byte][]byte{channelControl: shareID.Psk[:]})
+	if err != nil {
+		return newUserError(msgListenPeers, err)
+	}
+	controlSession, err := NewControlSession(shareID, listenPort, session, session.GetTrackers(), nil, ShareConfig{}.swarmSize())
+	if err != nil {
+		return err
+	}
+	defer controlSession.Quit()
+	for _, peer := range append(manualPeers, session.GetPeers()...) {
+		controlSession.backoffHintNewPeer(peer)
+	}
+
+	deadline := time.After(timeout)
+	for {
+		select {
+		case c := <-conChan:
+			if c.channel == channelControl && controlSession.Matches(c.infohash) {
+				controlSession.AcceptNewPeer(c)
+			} else {
+				c.conn.Close()
+			}
+		case <-controlSession.NewPeers:
+		case s := <-controlSession.Summaries:
+			fmt.Println(T(msgSummaryRevision, s.Rev))
+			fmt.Println(T(msgSummarySize, humanBytes(s.Size), s.Size))
+			fmt.Println(T(msgSummaryFiles, s.Files))
+			if len(s.Dirs) > 0 {
+				fmt.Println(T(msgSummaryDirs, strings.Join(s.Dirs, ", ")))
+			}
+			if about, ok := storedAbout(session); ok {
+				printAbout(about.About.Fields)
+			}
+			return nil
+		case <-deadline:
+			return newUserError(msgNoSummary, timeout)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	ed "github.com/agl/ed25519"
+	"github.com/rakoo/rakoshare/pkg/id"
+)
+
+func TestSummarize(t *testing.T) {
+	m := &MetaInfo{
+		InfoHash: "ih",
+		Info: &InfoDict{
+			Files: []*FileDict{
+				{Length: 10, Path: []string{"photos", "a.jpg"}},
+				{Length: 20, Path: []string{"docs", "sub", "b.txt"}},
+				{Length: 5, Path: []string{"photos", "c.jpg"}},
+				{Length: 1, Path: []string{"README"}},
+			},
+		},
+	}
+	expected := ShareSummary{
+		InfoHash: "ih",
+		Rev:      "3-abc",
+		Size:     36,
+		Files:    4,
+		Dirs:     []string{"docs", "photos"},
+	}
+	if s := summarize(m, "3-abc"); !reflect.DeepEqual(s, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, s)
+	}
+
+	single := &MetaInfo{Info: &InfoDict{Name: "movie.mkv", Length: 1000}}
+	if s := summarize(single, ""); s.Files != 1 || s.Size != 1000 || len(s.Dirs) != 0 {
+		t.Fatalf("Unexpected summary of a single file: %+v", s)
+	}
+}
+
+func TestSummarySignature(t *testing.T) {
+	pub, priv, err := ed.GenerateKey(bytes.NewReader(make([]byte, 64)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := signSummary(ShareSummary{InfoHash: "ih", Rev: "1-a", Size: 42, Dirs: []string{}}, id.PrivKey(*priv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifySummary(msg, id.PubKey(*pub)); err != nil {
+		t.Fatal("Couldn't verify a valid summary: ", err)
+	}
+
+	msg.Summary.Size = 43
+	if err := verifySummary(msg, id.PubKey(*pub)); err == nil {
+		t.Fatal("A tampered summary shouldn't verify")
+	}
+}
+
+func TestIsRevOlder(t *testing.T) {
+	if !isRevOlder("2-abc", "10-def") {
+		t.Fatal("2 should be older than 10")
+	}
+	if isRevOlder("3-abc", "3-def") || isRevOlder("4-abc", "3-def") {
+		t.Fatal("Same or newer revisions aren't older")
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/rakoo/rakoshare/pkg/bitset"
+)
+
+var superSeedSize = flag.Int64("superSeedSize", 0, "Super-seed the revisions of at least that many bytes that we just made as the writer: each piece is offered to a single peer until another one has it, so that the first full copy in the swarm costs us little more than its size. 0 disables it")
+
+// superSeeder tracks the pieces offered to peers while super-seeding (BEP
+// 16). Peers are told we have nothing, then offered one piece at a time.
+// Once another peer announces that piece, it spread, and the peer that was
+// offered it gets another one.
+type superSeeder struct {
+	offered map[*peerState]int // The piece offered to each peer
+	offers  []int              // How many peers each piece was offered to
+	spread  *bitset.Bitset     // Pieces a peer got from another one
+	left    int                // Pieces that didn't spread yet
+}
+
+func newSuperSeeder(pieces int) *superSeeder {
+	return &superSeeder{
+		offered: make(map[*peerState]int),
+		offers:  make([]int, pieces),
+		spread:  bitset.New(pieces),
+		left:    pieces,
+	}
+}
+
+// next returns the piece to offer to p: one that didn't spread, that p
+// doesn't have, and that was offered the fewest times. It is -1 if there
+// is none.
+func (s *superSeeder) next(p *peerState) int {
+	best := -1
+	for i, n := range s.offers {
+		if s.spread.IsSet(i) || (p.have != nil && p.have.IsSet(i)) {
+			continue
+		}
+		if best == -1 || n < s.offers[best] {
+			best = i
+		}
+	}
+	return best
+}
+
+// offerPiece announces the next piece to p.
+func (t *TorrentSession) offerPiece(p *peerState) {
+	s := t.superSeed
+	piece := s.next(p)
+	if piece < 0 {
+		delete(s.offered, p)
+		return
+	}
+	s.offered[p] = piece
+	s.offers[piece]++
+	p.sendPieceMessage(HAVE, uint32(piece))
+}
+
+// superSeedHave notes that p announced piece. When p is the peer we
+// offered it to, it is only offered another one if nobody else could take
+// the piece from it.
+func (t *TorrentSession) superSeedHave(p *peerState, piece int) {
+	s := t.superSeed
+	if p.have.FindNextClear(0) == -1 {
+		// Another seed does the job better
+		t.endSuperSeed()
+		return
+	}
+	if offered, ok := s.offered[p]; ok && offered == piece {
+		if t.peers.Len() == 1 {
+			t.offerPiece(p)
+		}
+		return
+	}
+	if !s.spread.IsSet(piece) {
+		s.spread.Set(piece)
+		s.left--
+	}
+	if s.left == 0 {
+		t.endSuperSeed()
+		return
+	}
+	for q, offered := range s.offered {
+		if offered == piece {
+			t.offerPiece(q)
+		}
+	}
+}
+
+// endSuperSeed goes back to normal seeding, telling every peer that lacks
+// pieces that we have them all, in a single message rather than one HAVE
+// per piece.
+func (t *TorrentSession) endSuperSeed() {
+	log.Println("[TORRENT] Done super-seeding")
+	t.superSeed = nil
+	for _, p := range t.peers.All() {
+		if p.have != nil && p.have.FindNextClear(0) == -1 {
+			continue
+		}
+		if p.fast {
+			p.sendOneCharMessage(HAVE_ALL)
+		} else {
+			p.SendBitfield(fullBitset(t.totalPieces))
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/rakoo/rakoshare/pkg/bitset"
+)
+
+func TestSuperSeed(t *testing.T) {
+	const pieces = 3
+	ts := &TorrentSession{
+		totalPieces: pieces,
+		peers:       newPeers(),
+		superSeed:   newSuperSeeder(pieces),
+	}
+	a, b := newEndgamePeer(), newEndgamePeer()
+	a.have, b.have = bitset.New(pieces), bitset.New(pieces)
+	ts.peers.peerList = []*peerState{a, b}
+
+	ts.offerPiece(a)
+	ts.offerPiece(b)
+	if ts.superSeed.offered[a] != 0 || ts.superSeed.offered[b] != 1 {
+		t.Fatalf("Expected distinct pieces to be offered, got %v", ts.superSeed.offered)
+	}
+
+	// a downloaded its piece: it waits until it spreads
+	a.have.Set(0)
+	ts.superSeedHave(a, 0)
+	if ts.superSeed.offered[a] != 0 {
+		t.Errorf("Expected no new piece for a before its piece spread, got %d", ts.superSeed.offered[a])
+	}
+
+	b.have.Set(0)
+	ts.superSeedHave(b, 0)
+	if ts.superSeed.offered[a] != 2 {
+		t.Errorf("Expected the last piece to be offered to a once its piece spread, got %d", ts.superSeed.offered[a])
+	}
+
+	a.have.Set(1)
+	ts.superSeedHave(a, 1)
+	b.have.Set(2)
+	ts.superSeedHave(b, 2)
+	if ts.superSeed == nil || ts.superSeed.left != 1 {
+		t.Fatal("Expected the last piece not to have spread yet")
+	}
+	a.have.Set(2)
+	sentToA := len(a.writeChan)
+	ts.superSeedHave(a, 2)
+	if ts.superSeed != nil {
+		t.Fatal("Expected super-seeding to end once every piece spread")
+	}
+	if len(a.writeChan) != sentToA {
+		t.Error("Expected nothing more for a peer that has everything")
+	}
+	var last []byte
+	for len(b.writeChan) > 0 {
+		last = <-b.writeChan
+	}
+	if len(last) != 2 || last[0] != BITFIELD || last[1] != 0xe0 {
+		t.Errorf("Expected a single full bitfield for the other peers, got %v", last)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"time"
+)
+
+var (
+	restartMin = flag.Duration("restartMin", 1*time.Second, "Initial delay before restarting a crashed part of a share")
+	restartMax = flag.Duration("restartMax", 10*time.Minute, "Maximal delay before restarting a crashed part of a share")
+)
+
+// A run lasting longer than this is considered healthy: if it fails
+// afterwards, it is restarted quickly again.
+const stableRun = 5 * time.Minute
+
+// Number of restarts, by supervised goroutine name
+var restartsMetrics = expvar.NewMap("restarts")
+
+// supervise runs fn until it returns nil or something is received on
+// quit. When fn panics or returns an error, the failure is logged and
+// raised as an alert, and fn is run again after a delay growing with
+// consecutive failures. This keeps a bug or a bad state in one part of a
+// share from taking the whole process down.
+//
+// fn is expected to watch quit itself while it runs; supervise only
+// watches it between runs.
+func supervise(name string, quit <-chan struct{}, fn func() error) {
+	restarts := &backoff{Min: *restartMin, Max: *restartMax, Jitter: 0.25}
+	for {
+		start := time.Now()
+		err := runProtected(fn)
+		if err == nil {
+			return
+		}
+
+		if time.Since(start) > stableRun {
+			restarts.Reset()
+		}
+		wait := restarts.Next()
+		restartsMetrics.Add(name, 1)
+		raiseAlert("crash", "%s stopped unexpectedly, restarting it in %s: %s", name, wait, err)
+
+		select {
+		case <-time.After(wait):
+		case <-quit:
+			return
+		}
+	}
+}
+
+// runProtected calls fn, turning a panic into an error.
+func runProtected(fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Recovered from panic: %v\n%s", r, debug.Stack())
+			err = errors.New(fmt.Sprint("panic: ", r))
+		}
+	}()
+	return fn()
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSuperviseRestarts(t *testing.T) {
+	defer func(min time.Duration) { *restartMin = min }(*restartMin)
+	*restartMin = time.Millisecond
+
+	runs := 0
+	done := make(chan struct{})
+	go func() {
+		supervise("test", nil, func() error {
+			runs++
+			switch runs {
+			case 1:
+				panic("crash")
+			case 2:
+				return errors.New("failure")
+			}
+			return nil
+		})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("supervise didn't return after a successful run")
+	}
+	if runs != 3 {
+		t.Fatalf("Expected 3 runs, got %d", runs)
+	}
+}
+
+func TestSuperviseQuit(t *testing.T) {
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		supervise("test", quit, func() error {
+			return errors.New("failure")
+		})
+		close(done)
+	}()
+
+	quit <- struct{}{}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("supervise didn't stop restarting after quit")
+	}
+}
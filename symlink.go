@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Symbolic links are entries of their own (BEP 47): no data, the attribute
+// "l", and the path of their target relative to the share. Only links to
+// paths inside the share are kept, so that replicas never get links out of
+// it.
+
+var errSymlinkOutside = errors.New("symbolic link to a path outside of the share")
+
+func (f *FileDict) isSymlink() bool {
+	return strings.Contains(f.Attr, "l")
+}
+
+// withoutSymlinks returns files without the symbolic links, which take no
+// room in the store.
+func withoutSymlinks(files []*FileDict) []*FileDict {
+	for i, f := range files {
+		if !f.isSymlink() {
+			continue
+		}
+		kept := append([]*FileDict(nil), files[:i]...)
+		for _, f := range files[i:] {
+			if !f.isSymlink() {
+				kept = append(kept, f)
+			}
+		}
+		return kept
+	}
+	return files
+}
+
+// symlinks returns the symbolic links of info.
+func (info *InfoDict) symlinks() (links []*FileDict) {
+	if info.isV2() {
+		var files []v2File
+		walkFileTree(info.FileTree, nil, &files)
+		for i := range files {
+			if files[i].isSymlink() {
+				links = append(links, &files[i].FileDict)
+			}
+		}
+		return
+	}
+	for _, f := range info.Files {
+		if f.isSymlink() {
+			links = append(links, f)
+		}
+	}
+	return
+}
+
+// insideShare cleans the path elements of a target or a link, and tells
+// whether they stay inside the share.
+func insideShare(elems []string) (string, bool) {
+	rel := path.Join(elems...)
+	clean := path.Clean(rel)
+	return clean, rel != "" && !path.IsAbs(rel) && clean != "." && clean != ".." && !strings.HasPrefix(clean, "../")
+}
+
+// symlinkEntry returns the entry of the symbolic link at relPath in root.
+func symlinkEntry(root, relPath string) (*FileDict, error) {
+	full := filepath.Join(root, relPath)
+	target, err := os.Readlink(full)
+	if err != nil {
+		return nil, err
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(full), target)
+	}
+	rel, err := filepath.Rel(root, target)
+	if err != nil {
+		return nil, errSymlinkOutside
+	}
+	elems := strings.Split(filepath.ToSlash(rel), "/")
+	if _, ok := insideShare(elems); !ok {
+		return nil, errSymlinkOutside
+	}
+	return &FileDict{
+		Path:        strings.Split(relPath, string(os.PathSeparator)),
+		Attr:        "l",
+		SymlinkPath: elems,
+	}, nil
+}
+
+// shareSymlinks returns the entries of the symbolic links of root that can
+// go in a torrent, skipping those that point outside of it.
+func shareSymlinks(root string, ignored func(relPath string) bool) (links []*FileDict) {
+	walkShare(root, ignored, func(path string, info os.FileInfo, perr error) error {
+		if perr != nil || info.Mode()&os.ModeSymlink == 0 || strings.HasPrefix(filepath.Base(path), ".") {
+			return nil
+		}
+		relPath, err := filepath.Rel(root, path)
+		if err != nil {
+			return nil
+		}
+		link, err := symlinkEntry(root, relPath)
+		if err != nil {
+			log.Printf("Leaving %s out of the share: %s\n", path, err)
+			return nil
+		}
+		links = append(links, link)
+		return nil
+	})
+	return
+}
+
+// addSymlinks adds the symbolic links of dir to the metainfo m.
+func addSymlinks(m *MetaInfo, dir string, ignored func(relPath string) bool) error {
+	links := shareSymlinks(dir, ignored)
+	if len(links) == 0 {
+		return nil
+	}
+	if m.Info.isV2() {
+		var files []v2File
+		walkFileTree(m.Info.FileTree, nil, &files)
+		for _, link := range links {
+			files = append(files, v2File{FileDict: *link})
+		}
+		m.Info.FileTree = fileTreeOf(files)
+	}
+	if !m.Info.pureV2() {
+		m.Info.Files = append(m.Info.Files, links...)
+	}
+	return m.hashInfo()
+}
+
+// sameSymlinks tells whether a and b have the same links to the same
+// targets.
+func sameSymlinks(a, b []*FileDict) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	targets := make(map[string]string, len(a))
+	for _, link := range a {
+		targets[path.Join(link.Path...)] = path.Join(link.SymlinkPath...)
+	}
+	for _, link := range b {
+		target, ok := targets[path.Join(link.Path...)]
+		if !ok || target != path.Join(link.SymlinkPath...) {
+			return false
+		}
+	}
+	return true
+}
+
+// applySymlinks creates in dir the symbolic links of info, as links
+// relative to their directory. Links to paths outside of dir are refused,
+// and other files are never replaced.
+func applySymlinks(dir string, info *InfoDict) {
+	ignored := loadIgnoreFile(dir)
+	for _, link := range info.symlinks() {
+		rel, ok := insideShare(link.Path)
+		target, tok := insideShare(link.SymlinkPath)
+		if !ok || !tok {
+			log.Printf("Refusing symbolic link %s to %s: outside of the share\n", path.Join(link.Path...), path.Join(link.SymlinkPath...))
+			continue
+		}
+		if ignored.match(rel) {
+			continue
+		}
+		full := filepath.Join(dir, filepath.FromSlash(rel))
+		relTarget, err := filepath.Rel(filepath.Dir(full), filepath.Join(dir, filepath.FromSlash(target)))
+		if err != nil {
+			continue
+		}
+		if st, err := os.Lstat(full); err == nil {
+			if st.Mode()&os.ModeSymlink == 0 {
+				log.Printf("Not replacing %s with a symbolic link\n", full)
+				continue
+			}
+			if current, err := os.Readlink(full); err == nil && current == relTarget {
+				continue
+			}
+			if err := os.Remove(full); err != nil {
+				log.Printf("Couldn't replace symbolic link %s: %s\n", full, err)
+				continue
+			}
+		}
+		if err = ensureDirectory(full); err == nil {
+			err = os.Symlink(relTarget, full)
+		}
+		if err != nil {
+			log.Printf("Couldn't create symbolic link %s: %s\n", full, err)
+		}
+	}
+}
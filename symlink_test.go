@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestInsideShare(t *testing.T) {
+	vectors := []struct {
+		elems []string
+		ok    bool
+	}{
+		{[]string{"a", "b"}, true},
+		{[]string{"a", "..", "b"}, true},
+		{[]string{"..", "b"}, false},
+		{[]string{"a", "..", ".."}, false},
+		{[]string{"/etc", "passwd"}, false},
+		{[]string{"."}, false},
+		{nil, false},
+	}
+	for _, v := range vectors {
+		if _, ok := insideShare(v.elems); ok != v.ok {
+			t.Errorf("%q: expected %t, got %t", v.elems, v.ok, ok)
+		}
+	}
+}
+
+func TestSymlinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "symlink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "bin"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "bin", "tool"), []byte("tool"), 0755)
+	os.Symlink("bin/tool", filepath.Join(dir, "tool"))
+	os.Symlink(filepath.Join(dir, "bin", "tool"), filepath.Join(dir, "bin", "abs"))
+	os.Symlink("/etc/passwd", filepath.Join(dir, "passwd"))
+
+	links := shareSymlinks(dir, nil)
+	expected := []*FileDict{
+		{Path: []string{"bin", "abs"}, Attr: "l", SymlinkPath: []string{"bin", "tool"}},
+		{Path: []string{"tool"}, Attr: "l", SymlinkPath: []string{"bin", "tool"}},
+	}
+	if !reflect.DeepEqual(links, expected) {
+		t.Fatalf("Expected %v, got %v", expected, links)
+	}
+
+	for _, format := range []string{formatV1, formatV2, formatHybrid} {
+		var meta *MetaInfo
+		if format == formatV1 {
+			meta, err = createMeta(dir, nil, nil, nil)
+		} else {
+			meta, err = createMetaV2(dir, nil, nil, format == formatHybrid)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = addSymlinks(meta, dir, nil); err != nil {
+			t.Fatal(err)
+		}
+		if !sameSymlinks(meta.Info.symlinks(), links) {
+			t.Errorf("%s: expected links %v, got %v", format, links, meta.Info.symlinks())
+		}
+		if len(meta.Info.fileList()) != 1 || meta.Info.totalSize() != 4 {
+			t.Errorf("%s: links shouldn't be stored", format)
+		}
+
+		replica, err := ioutil.TempDir("", "symlink")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(replica)
+		info := *meta.Info
+		if !info.pureV2() {
+			info.Files = append(info.Files, &FileDict{Path: []string{"escape"}, Attr: "l", SymlinkPath: []string{"..", "x"}})
+		}
+		applySymlinks(replica, &info)
+		if target, err := os.Readlink(filepath.Join(replica, "bin", "abs")); err != nil || target != "tool" {
+			t.Errorf("%s: expected a link to tool, got %q (%v)", format, target, err)
+		}
+		if target, err := os.Readlink(filepath.Join(replica, "tool")); err != nil || target != filepath.Join("bin", "tool") {
+			t.Errorf("%s: expected a link to bin/tool, got %q (%v)", format, target, err)
+		}
+		if _, err := os.Lstat(filepath.Join(replica, "escape")); err == nil {
+			t.Errorf("%s: link out of the share was created", format)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"flag"
+	"sync"
+	"time"
+)
+
+var (
+	rechokeInterval   = flag.Duration("rechokeInterval", 10*time.Second, "How often sessions look for new peers and pieces to request")
+	verboseInterval   = flag.Duration("verboseInterval", 10*time.Minute, "How often sessions log their status")
+	keepAliveInterval = flag.Duration("keepAliveInterval", 60*time.Second, "How often idle peers are checked and sent keep-alives")
+	keepAliveIdle     = flag.Duration("keepAliveIdle", 2*time.Minute, "Send a keep-alive to peers we sent nothing to for that long; keep it below the idle timeout of peers")
+	idleTimeout       = flag.Duration("idleTimeout", 3*time.Minute, "Close peers that sent nothing for that long. 0 disables it")
+	writeStall        = flag.Duration("writeStall", 30*time.Second, "Close peers that accepted none of the messages queued for them for that long, as they hold upload slots without reading. 0 disables it")
+	rescanInterval    = flag.Duration("rescanInterval", 10*time.Second, "How often the shared directory is scanned for changes")
+	pexInterval       = flag.Duration("pexInterval", 1*time.Minute, "How often known peers are exchanged with other peers")
+	retrackMin        = flag.Duration("retrackMin", 20*time.Second, "Initial delay before trying again trackers that didn't answer")
+	retrackMax        = flag.Duration("retrackMax", 30*time.Minute, "Maximal delay before trying again trackers that didn't answer")
+)
+
+// managedTicker is like a time.Ticker, except that its interval can be
+// changed while it runs, without the receiver having to switch to a new
+// channel, and that C is closed once it is stopped so that loops ranging
+// over it end.
+type managedTicker struct {
+	C <-chan time.Time
+
+	c        chan time.Time
+	interval chan time.Duration
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func newManagedTicker(d time.Duration) *managedTicker {
+	c := make(chan time.Time, 1)
+	mt := &managedTicker{
+		C:        c,
+		c:        c,
+		interval: make(chan time.Duration),
+		stop:     make(chan struct{}),
+	}
+	go mt.run(d)
+	return mt
+}
+
+func (mt *managedTicker) run(d time.Duration) {
+	ticker := time.NewTicker(d)
+	defer func() {
+		ticker.Stop()
+		close(mt.c)
+	}()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			// Like time.Ticker, drop ticks for slow receivers
+			select {
+			case mt.c <- now:
+			default:
+			}
+		case d = <-mt.interval:
+			ticker.Stop()
+			ticker = time.NewTicker(d)
+		case <-mt.stop:
+			return
+		}
+	}
+}
+
+// SetInterval changes the period of the ticker. The next tick comes d
+// after the call.
+func (mt *managedTicker) SetInterval(d time.Duration) {
+	select {
+	case mt.interval <- d:
+	case <-mt.stop:
+	}
+}
+
+// Stop turns off the ticker and closes its channel. It is safe to call
+// it more than once.
+func (mt *managedTicker) Stop() {
+	mt.stopOnce.Do(func() { close(mt.stop) })
+}
+
+// timerManager holds the named tickers of a session, so their intervals
+// can be changed by name and they can all be released when the session
+// quits.
+type timerManager struct {
+	mu      sync.Mutex
+	tickers map[string]*managedTicker
+}
+
+func newTimerManager() *timerManager {
+	return &timerManager{tickers: make(map[string]*managedTicker)}
+}
+
+// Ticker starts a ticker called name, stopping any previous one with the
+// same name.
+func (tm *timerManager) Ticker(name string, d time.Duration) <-chan time.Time {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	if old, ok := tm.tickers[name]; ok {
+		old.Stop()
+	}
+	mt := newManagedTicker(d)
+	tm.tickers[name] = mt
+	return mt.C
+}
+
+// SetInterval changes the period of the ticker called name, if it
+// exists.
+func (tm *timerManager) SetInterval(name string, d time.Duration) {
+	tm.mu.Lock()
+	mt, ok := tm.tickers[name]
+	tm.mu.Unlock()
+
+	if ok {
+		mt.SetInterval(d)
+	}
+}
+
+// StopAll stops every ticker. Channels returned by Ticker are closed.
+func (tm *timerManager) StopAll() {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	for name, mt := range tm.tickers {
+		mt.Stop()
+		delete(tm.tickers, name)
+	}
+}
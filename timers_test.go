@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestManagedTickerSetInterval(t *testing.T) {
+	mt := newManagedTicker(time.Hour)
+	defer mt.Stop()
+
+	mt.SetInterval(10 * time.Millisecond)
+	select {
+	case <-mt.C:
+	case <-time.After(time.Second):
+		t.Fatal("No tick after the interval was shortened")
+	}
+}
+
+func TestTimerManagerStopAll(t *testing.T) {
+	tm := newTimerManager()
+	a := tm.Ticker("a", time.Hour)
+	b := tm.Ticker("b", time.Hour)
+	tm.StopAll()
+
+	for _, c := range []<-chan time.Time{a, b} {
+		select {
+		case _, ok := <-c:
+			if ok {
+				t.Fatal("Got a tick from a stopped ticker")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Channel of stopped ticker wasn't closed")
+		}
+	}
+}
+
+func TestTimerManagerReplace(t *testing.T) {
+	tm := newTimerManager()
+	defer tm.StopAll()
+
+	old := tm.Ticker("a", time.Hour)
+	tm.Ticker("a", time.Hour)
+
+	select {
+	case _, ok := <-old:
+		if ok {
+			t.Fatal("Got a tick from a replaced ticker")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Replaced ticker wasn't stopped")
+	}
+}
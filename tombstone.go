@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/zeebo/bencode"
+)
+
+var (
+	tombstoneTTL = flag.Duration("tombstoneTTL", 30*24*time.Hour, "How long revisions keep telling devices to remove deleted files")
+	trashDir     = flag.String("trashDir", "", "Move files deleted from shares to this directory rather than removing them")
+)
+
+// Tombstone records that a file was removed from the share, so that the
+// devices holding it remove it too. Tombstones are part of the revision,
+// whose infohash the writer signs, so readers can trust them.
+type Tombstone struct {
+	Path    []string `bencode:"path"`
+	Deleted int64    `bencode:"deleted"` // When, as a Unix time
+}
+
+// tombstones returns the tombstones of next: those of prev still recent,
+// and one for each file or symbolic link of prev gone from dir. Files only
+// left out of next, by an ignore pattern or for being empty, aren't
+// deleted.
+func tombstones(dir string, prev, next *MetaInfo, now time.Time) (deleted []Tombstone) {
+	if prev == nil {
+		return nil
+	}
+	present := presentPaths(next.Info)
+
+	for _, t := range prev.Info.Deleted {
+		p := path.Join(t.Path...)
+		if !present[p] && now.Sub(time.Unix(t.Deleted, 0)) < *tombstoneTTL {
+			present[p] = true
+			deleted = append(deleted, t)
+		}
+	}
+	for _, f := range append(prev.Info.fileList(), prev.Info.symlinks()...) {
+		p := path.Join(f.Path...)
+		if present[p] {
+			continue
+		}
+		if _, err := os.Lstat(filepath.Join(dir, filepath.FromSlash(p))); os.IsNotExist(err) {
+			deleted = append(deleted, Tombstone{Path: f.Path, Deleted: now.Unix()})
+		}
+	}
+	return
+}
+
+// presentPaths returns the paths of the files and symbolic links of info.
+func presentPaths(info *InfoDict) map[string]bool {
+	present := make(map[string]bool)
+	for _, f := range append(info.fileList(), info.symlinks()...) {
+		present[path.Join(f.Path...)] = true
+	}
+	return present
+}
+
+// hashInfo computes the infohash of m again, after a change of its info.
+func (m *MetaInfo) hashInfo() error {
+	var buf bytes.Buffer
+	if err := bencode.NewEncoder(&buf).Encode(m.Info); err != nil {
+		return err
+	}
+	m.InfoHash = infoHashOf(buf.Bytes())
+	return nil
+}
+
+// applyTombstones removes from dir, or moves to the trash or the versions,
+// the files that info says were deleted. Files changed after their deletion are kept, as
+// they were created again. Deleted symbolic links are removed.
+func applyTombstones(dir string, info *InfoDict, versions *versionKeeper) {
+	present := presentPaths(info)
+	ignored := loadIgnoreFile(dir)
+	for _, t := range info.Deleted {
+		// Like the paths of files, tombstones can't escape dir
+		rel := path.Clean("/" + path.Join(t.Path...))[1:]
+		if rel == "" || present[rel] || ignored.match(rel) {
+			continue
+		}
+		full := filepath.Join(dir, filepath.FromSlash(rel))
+		st, err := os.Lstat(full)
+		link := err == nil && st.Mode()&os.ModeSymlink != 0
+		if err != nil || !st.Mode().IsRegular() && !link || st.ModTime().Unix() > t.Deleted {
+			continue
+		}
+
+		if link {
+			err = os.Remove(full)
+		} else if *trashDir != "" {
+			trashed := filepath.Join(*trashDir, filepath.FromSlash(rel))
+			if err = ensureDirectory(trashed); err == nil {
+				err = os.Rename(full, trashed)
+			}
+		} else if kept, kerr := versions.keep(full, time.Now()); !kept {
+			err = kerr
+			if err == nil {
+				err = os.Remove(full)
+			}
+		}
+		if err != nil {
+			log.Printf("Couldn't remove deleted file %s: %s", full, err)
+			continue
+		}
+		log.Println("Removed deleted file", strings.TrimPrefix(full, dir+string(os.PathSeparator)))
+	}
+}
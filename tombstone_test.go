@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTombstones(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tombstones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "ignored"), []byte("a"), 0600)
+
+	now := time.Now()
+	old := Tombstone{Path: []string{"old"}, Deleted: now.Add(-2 * *tombstoneTTL).Unix()}
+	recent := Tombstone{Path: []string{"recent"}, Deleted: now.Add(-time.Hour).Unix()}
+	recreated := Tombstone{Path: []string{"back"}, Deleted: now.Add(-time.Hour).Unix()}
+	prev := &MetaInfo{Info: &InfoDict{
+		Files:   []*FileDict{{Path: []string{"sub", "gone"}}, {Path: []string{"ignored"}}, {Path: []string{"kept"}}},
+		Deleted: []Tombstone{old, recent, recreated},
+	}}
+	next := &MetaInfo{Info: &InfoDict{Files: []*FileDict{{Path: []string{"kept"}}, {Path: []string{"back"}}}}}
+
+	deleted := tombstones(dir, prev, next, now)
+	if len(deleted) != 2 {
+		t.Fatalf("Expected 2 tombstones, got %v", deleted)
+	}
+	if deleted[0].Path[0] != "recent" {
+		t.Errorf("Expected the recent tombstone to be kept, got %v", deleted[0])
+	}
+	if filepath.Join(deleted[1].Path...) != filepath.Join("sub", "gone") || deleted[1].Deleted != now.Unix() {
+		t.Errorf("Expected a tombstone for the removed file, got %v", deleted[1])
+	}
+}
+
+func TestApplyTombstones(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tombstones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"gone", "recreated", "kept"} {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte("a"), 0600)
+	}
+	outside := dir + "-outside"
+	ioutil.WriteFile(outside, []byte("a"), 0600)
+	defer os.Remove(outside)
+
+	now := time.Now()
+	os.Chtimes(filepath.Join(dir, "gone"), now.Add(-time.Hour), now.Add(-time.Hour))
+	info := &InfoDict{
+		Files: []*FileDict{{Path: []string{"kept"}}},
+		Deleted: []Tombstone{
+			{Path: []string{"gone"}, Deleted: now.Unix()},
+			{Path: []string{"recreated"}, Deleted: now.Add(-time.Hour).Unix()},
+			{Path: []string{"kept"}, Deleted: now.Unix()},
+			{Path: []string{"..", filepath.Base(outside)}, Deleted: now.Unix()},
+		},
+	}
+	applyTombstones(dir, info, nil)
+
+	for name, exists := range map[string]bool{"gone": false, "recreated": true, "kept": true} {
+		if _, err := os.Stat(filepath.Join(dir, name)); (err == nil) != exists {
+			t.Errorf("%s: expected to exist %v, got %v", name, exists, err)
+		}
+	}
+	if _, err := os.Stat(outside); err != nil {
+		t.Error("A tombstone removed a file outside of the share")
+	}
+}
+
+func TestSymlinkTombstones(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tombstones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "target"), []byte("a"), 0600)
+
+	now := time.Now()
+	link := &FileDict{Path: []string{"link"}, Attr: "l", SymlinkPath: []string{"target"}}
+	prev := &MetaInfo{Info: &InfoDict{Files: []*FileDict{{Path: []string{"target"}}, link}}}
+	next := &MetaInfo{Info: &InfoDict{Files: []*FileDict{{Path: []string{"target"}}}}}
+	deleted := tombstones(dir, prev, next, now)
+	if len(deleted) != 1 || deleted[0].Path[0] != "link" {
+		t.Fatalf("Expected a tombstone for the removed link, got %v", deleted)
+	}
+
+	// A replica still has the link
+	if err := os.Symlink("target", filepath.Join(dir, "link")); err != nil {
+		t.Skip("No symbolic links here: ", err)
+	}
+	next.Info.Deleted = []Tombstone{{Path: []string{"link"}, Deleted: now.Add(time.Minute).Unix()}}
+	applyTombstones(dir, next.Info, nil)
+	if _, err := os.Lstat(filepath.Join(dir, "link")); !os.IsNotExist(err) {
+		t.Errorf("Expected the link to be removed, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "target")); err != nil {
+		t.Errorf("Expected the target to stay: %s", err)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// topSample is the status of a share as last seen by top, to compute its
+// rates.
+type topSample struct {
+	running bool
+	status  ShareStatus
+	// Bytes per second
+	upRate   float64
+	downRate float64
+}
+
+// Top shows the shares of workDir and their transfers, refreshed every
+// interval. Commands are read line by line from standard input, so that
+// it works over any terminal and with screen readers; with plain, the
+// screen isn't cleared between refreshes either.
+func Top(workDir string, interval time.Duration, plain bool) error {
+	shares, err := List(workDir)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: interval}
+	samples := make([]topSample, len(shares))
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var message string
+	for {
+		for i, s := range shares {
+			samples[i] = sampleShare(client, s, samples[i])
+		}
+		renderTop(os.Stdout, shares, samples, message, plain)
+		message = ""
+
+		select {
+		case <-ticker.C:
+		case line, ok := <-lines:
+			if !ok {
+				return nil
+			}
+			quit, err := topCommand(client, shares, line)
+			if quit {
+				return nil
+			}
+			if err != nil {
+				message = err.Error()
+			}
+		}
+	}
+}
+
+func sampleShare(client *http.Client, s share, previous topSample) topSample {
+	addr := s.session.GetSetting(settingAPI)
+	if addr == "" {
+		return topSample{}
+	}
+	status, err := fetchStatus(client, addr)
+	if err != nil {
+		return topSample{}
+	}
+
+	sample := topSample{running: true, status: status}
+	if previous.running {
+		seconds := status.Updated.Sub(previous.status.Updated).Seconds()
+		if seconds > 0 {
+			sample.upRate = float64(status.Uploaded-previous.status.Uploaded) / seconds
+			sample.downRate = float64(status.Downloaded-previous.status.Downloaded) / seconds
+		} else {
+			sample.upRate, sample.downRate = previous.upRate, previous.downRate
+		}
+	}
+	return sample
+}
+
+// topCommand runs a command typed by the user: "p N" pauses share N, "r N"
+// resumes it and "q" quits.
+func topCommand(client *http.Client, shares []share, line string) (quit bool, err error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return false, nil
+	}
+	if fields[0] == "q" {
+		return true, nil
+	}
+
+	var command string
+	switch fields[0] {
+	case "p":
+		command = apiPause
+	case "r":
+		command = apiResume
+	default:
+		return false, newUserError(msgTopUnknownCommand, line)
+	}
+	if len(fields) != 2 {
+		return false, newUserError(msgTopUnknownCommand, line)
+	}
+	n, err := strconv.Atoi(fields[1])
+	if err != nil || n < 1 || n > len(shares) {
+		return false, newUserError(msgTopNoSuchShare, fields[1])
+	}
+
+	addr := shares[n-1].session.GetSetting(settingAPI)
+	if addr == "" {
+		return false, newUserError(msgTopNotRunning, n)
+	}
+	return false, sendCommand(client, addr, command)
+}
+
+func renderTop(out io.Writer, shares []share, samples []topSample, message string, plain bool) {
+	if !plain {
+		// Move to the top left corner and clear the screen
+		fmt.Fprint(out, "\033[H\033[2J")
+	}
+
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, T(msgTopHeader))
+	for i, s := range shares {
+		sample := samples[i]
+		state := T(msgTopStopped)
+		if sample.running && sample.status.Paused {
+			state = T(msgTopPaused)
+		} else if sample.running {
+			state = T(msgTopRunning)
+		}
+		label := s.folder
+		if s.name != "" {
+			label = s.name + " (" + s.folder + ")"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%d\t%s/s\t%s/s\t%s\t%s\n", i+1, label, state,
+			sample.status.Peers, sample.status.ControlPeers,
+			humanBytes(int64(sample.upRate)), humanBytes(int64(sample.downRate)),
+			humanBytes(sample.status.Uploaded), humanBytes(sample.status.Downloaded))
+	}
+	w.Flush()
+
+	fmt.Fprintln(out)
+	for i, sample := range samples {
+		if p := sample.status.Verifying; p != nil {
+			fmt.Fprintln(out, T(msgTopVerifying, i+1, p.Checked, p.Total))
+		}
+		if len(sample.status.Conflicts) > 0 {
+			fmt.Fprintln(out, T(msgTopConflicts, i+1, strings.Join(sample.status.Conflicts, ", ")))
+		}
+	}
+	if message != "" {
+		fmt.Fprintln(out, message)
+	}
+	fmt.Fprintln(out, T(msgTopHelp))
+}
+
+// humanBytes formats n bytes with a binary unit, such as 1.5 MiB.
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHumanBytes(t *testing.T) {
+	vectors := map[int64]string{
+		0:                  "0 B",
+		1023:               "1023 B",
+		1024:               "1.0 KiB",
+		1536:               "1.5 KiB",
+		5 * 1024 * 1024:    "5.0 MiB",
+		3 << 30:            "3.0 GiB",
+		1024*1024*1024 - 1: "1024.0 MiB",
+	}
+	for n, expected := range vectors {
+		if got := humanBytes(n); got != expected {
+			t.Errorf("humanBytes(%d): expected %q, got %q", n, expected, got)
+		}
+	}
+}
+
+func TestTopCommandParsing(t *testing.T) {
+	shares := []share{{folder: "a"}}
+
+	quit, err := topCommand(nil, shares, " q ")
+	if !quit || err != nil {
+		t.Fatalf("Expected q to quit, got %v %v", quit, err)
+	}
+	for _, line := range []string{"x 1", "p", "p 1 2"} {
+		_, err := topCommand(nil, shares, line)
+		if e, ok := err.(userError); !ok || e.Code != msgTopUnknownCommand {
+			t.Errorf("%q: expected an unknown command error, got %v", line, err)
+		}
+	}
+	for _, line := range []string{"p 0", "r 2", "p one"} {
+		_, err := topCommand(nil, shares, line)
+		if e, ok := err.(userError); !ok || e.Code != msgTopNoSuchShare {
+			t.Errorf("%q: expected a no such share error, got %v", line, err)
+		}
+	}
+}
+
+func TestShareAPICommand(t *testing.T) {
+	api := &shareAPI{commands: make(chan string, 1)}
+	handler := api.serveCommand(apiPause)
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/pause", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected GET to be refused, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "/pause", nil))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected %d, got %d", http.StatusNoContent, w.Code)
+	}
+	if command := <-api.commands; command != apiPause {
+		t.Fatalf("Expected %q, got %q", apiPause, command)
+	}
+}
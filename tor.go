@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var (
+	useTor     = flag.Bool("tor", false, "Go through Tor: reach peers and trackers through its SOCKS proxy, at -proxyAddress or 127.0.0.1:9050, and accept peers on an onion service only. DHT, LPD and port mappings are disabled, so devices that only use Tor find each other through trackers, or by giving one the onion address of the other with -peer <address>.onion:<port>")
+	torControl = flag.String("torControl", "127.0.0.1:9051", "Address of the control port of Tor, to publish the onion service")
+)
+
+const (
+	torSocksDefault = "127.0.0.1:9050"
+
+	// The password of the control port, when it asks for one
+	torPasswordEnvVar = "RAKOSHARE_TOR_PASSWORD"
+
+	// The key of the onion service, in the working directory, so that
+	// its address stays the same
+	onionKeyFile = "onion.key"
+)
+
+var errTorAuth = errors.New("no supported way to authenticate to the control port of Tor")
+
+// The onion address peers reach us at, once published. It is set before
+// sessions start.
+var ourOnion string
+
+// setupTor makes connections go through the SOCKS proxy of Tor, when
+// asked to.
+func setupTor() {
+	if *useTor && proxyAddress == "" {
+		proxyAddress = torSocksDefault
+	}
+}
+
+// isOnion tells whether host is an onion address.
+func isOnion(host string) bool {
+	return strings.HasSuffix(host, ".onion")
+}
+
+// torController speaks the control protocol of Tor. The onion services
+// it adds last as long as its connection.
+type torController struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialTorControl(addr string) (*torController, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &torController{conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+func (c *torController) Close() error {
+	return c.conn.Close()
+}
+
+// command sends line and returns the lines of the reply, without their
+// status code, if it succeeded.
+func (c *torController) command(line string) (reply []string, err error) {
+	if _, err = fmt.Fprintf(c.conn, "%s\r\n", line); err != nil {
+		return
+	}
+	for {
+		var l string
+		if l, err = c.r.ReadString('\n'); err != nil {
+			return
+		}
+		l = strings.TrimRight(l, "\r\n")
+		if len(l) < 4 {
+			return nil, fmt.Errorf("unexpected reply from Tor: %q", l)
+		}
+		if l[:3] != "250" {
+			return nil, fmt.Errorf("Tor refused %s: %s", strings.Fields(line)[0], l[4:])
+		}
+		reply = append(reply, l[4:])
+		if l[3] == ' ' {
+			return
+		}
+	}
+}
+
+// authenticate picks the way to authenticate that Tor offers: none, its
+// cookie file, or the password in RAKOSHARE_TOR_PASSWORD.
+func (c *torController) authenticate() error {
+	reply, err := c.command("PROTOCOLINFO 1")
+	if err != nil {
+		return err
+	}
+	methods, cookieFile := parseProtocolInfo(reply)
+	switch {
+	case methods["NULL"]:
+		_, err = c.command("AUTHENTICATE")
+	case methods["HASHEDPASSWORD"] && os.Getenv(torPasswordEnvVar) != "":
+		_, err = c.command("AUTHENTICATE " + strconv.Quote(os.Getenv(torPasswordEnvVar)))
+	case methods["COOKIE"] && cookieFile != "":
+		var cookie []byte
+		if cookie, err = ioutil.ReadFile(cookieFile); err != nil {
+			return err
+		}
+		_, err = c.command("AUTHENTICATE " + hex.EncodeToString(cookie))
+	default:
+		err = errTorAuth
+	}
+	return err
+}
+
+// parseProtocolInfo returns the authentication methods of a PROTOCOLINFO
+// reply, and the path of the cookie file if any.
+func parseProtocolInfo(reply []string) (methods map[string]bool, cookieFile string) {
+	methods = make(map[string]bool)
+	for _, line := range reply {
+		if !strings.HasPrefix(line, "AUTH ") {
+			continue
+		}
+		for _, field := range strings.Fields(line[len("AUTH "):]) {
+			if strings.HasPrefix(field, "METHODS=") {
+				for _, m := range strings.Split(field[len("METHODS="):], ",") {
+					methods[m] = true
+				}
+			}
+		}
+		if i := strings.Index(line, "COOKIEFILE="); i >= 0 {
+			if path, err := strconv.Unquote(line[i+len("COOKIEFILE="):]); err == nil {
+				cookieFile = path
+			}
+		}
+	}
+	return
+}
+
+// addOnion publishes an onion service with key, or a new key when key is
+// empty, forwarding port to the same port on the loopback. It returns the
+// service id and the new key, if one was made.
+func (c *torController) addOnion(key string, port int) (serviceID, newKey string, err error) {
+	if key == "" {
+		key = "NEW:ED25519-V3"
+	}
+	reply, err := c.command(fmt.Sprintf("ADD_ONION %s Port=%d,127.0.0.1:%d", key, port, port))
+	if err != nil {
+		return
+	}
+	for _, line := range reply {
+		if strings.HasPrefix(line, "ServiceID=") {
+			serviceID = line[len("ServiceID="):]
+		} else if strings.HasPrefix(line, "PrivateKey=") {
+			newKey = line[len("PrivateKey="):]
+		}
+	}
+	if serviceID == "" {
+		err = errors.New("Tor didn't give the address of the onion service")
+	}
+	return
+}
+
+// publishOnion publishes the onion service of the peers listening on
+// port, with the key kept in workDir, and sets ourOnion. Closing the
+// controller removes the service.
+func publishOnion(workDir string, port int) (*torController, error) {
+	c, err := dialTorControl(*torControl)
+	if err != nil {
+		return nil, err
+	}
+	if err = c.authenticate(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	keyPath := filepath.Join(workDir, onionKeyFile)
+	key, _ := ioutil.ReadFile(keyPath)
+	serviceID, newKey, err := c.addOnion(strings.TrimSpace(string(key)), port)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if newKey != "" {
+		if err = ioutil.WriteFile(keyPath, []byte(newKey), 0600); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	ourOnion = serviceID + ".onion"
+	return c, nil
+}
+
+// isLoopbackHost tells whether host is a loopback address, which is the
+// one of all the peers that reach our onion service.
+func isLoopbackHost(host string) bool {
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
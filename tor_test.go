@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseProtocolInfo(t *testing.T) {
+	methods, cookie := parseProtocolInfo([]string{
+		"PROTOCOLINFO 1",
+		`AUTH METHODS=COOKIE,SAFECOOKIE COOKIEFILE="/run/tor/control.authcookie"`,
+		`VERSION Tor="0.4.8.9"`,
+		"OK",
+	})
+	if !methods["COOKIE"] || !methods["SAFECOOKIE"] || methods["NULL"] {
+		t.Errorf("Unexpected methods %v", methods)
+	}
+	if cookie != "/run/tor/control.authcookie" {
+		t.Errorf("Unexpected cookie file %q", cookie)
+	}
+}
+
+// fakeTor answers the commands of one controller like Tor without
+// authentication, and records them.
+func fakeTor(t *testing.T, commands chan<- string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				close(commands)
+				return
+			}
+			line = strings.TrimSpace(line)
+			commands <- line
+			switch {
+			case strings.HasPrefix(line, "PROTOCOLINFO"):
+				conn.Write([]byte("250-PROTOCOLINFO 1\r\n250-AUTH METHODS=NULL\r\n250 OK\r\n"))
+			case strings.HasPrefix(line, "ADD_ONION NEW:"):
+				conn.Write([]byte("250-ServiceID=abcdef\r\n250-PrivateKey=ED25519-V3:secret\r\n250 OK\r\n"))
+			case strings.HasPrefix(line, "ADD_ONION"):
+				conn.Write([]byte("250-ServiceID=abcdef\r\n250 OK\r\n"))
+			default:
+				conn.Write([]byte("250 OK\r\n"))
+			}
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestPublishOnion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(old string) { *torControl = old; ourOnion = "" }(*torControl)
+
+	for _, want := range []string{"ADD_ONION NEW:ED25519-V3 Port=7777,127.0.0.1:7777", "ADD_ONION ED25519-V3:secret Port=7777,127.0.0.1:7777"} {
+		commands := make(chan string, 10)
+		*torControl = fakeTor(t, commands)
+		c, err := publishOnion(dir, 7777)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+		var got []string
+		for cmd := range commands {
+			got = append(got, cmd)
+		}
+		if len(got) != 3 || got[1] != "AUTHENTICATE" || got[2] != want {
+			t.Errorf("Unexpected commands %q", got)
+		}
+		if ourOnion != "abcdef.onion" {
+			t.Errorf("Unexpected onion address %q", ourOnion)
+		}
+	}
+	key, _ := ioutil.ReadFile(filepath.Join(dir, onionKeyFile))
+	if string(key) != "ED25519-V3:secret" {
+		t.Errorf("Expected the key to be kept, got %q", key)
+	}
+}
+
+func TestOnionListenAddress(t *testing.T) {
+	p := &peerState{address: "127.0.0.1:43210"}
+	p.readExtensionHandshake(ExtensionHandshake{P: 7777, Onion: "abcdef.onion"})
+	if addr := p.listenAddress(); addr != "abcdef.onion:7777" {
+		t.Errorf("Expected to reach the peer at its onion service, got %s", addr)
+	}
+	p.readExtensionHandshake(ExtensionHandshake{P: 7777, Onion: "example.com"})
+	if p.onion != "abcdef.onion" {
+		t.Error("Only onion addresses should be taken")
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
@@ -12,6 +13,8 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/zeebo/bencode"
@@ -20,6 +23,7 @@ import (
 	"github.com/rakoo/rakoshare/pkg/id"
 )
 
+// Defaults of the number of peers of a share, see ShareConfig
 const (
 	MAX_NUM_PEERS    = 60
 	TARGET_NUM_PEERS = 15
@@ -38,8 +42,21 @@ const (
 	REQUEST
 	PIECE
 	CANCEL
-	PORT      // Not implemented. For DHT support.
+	PORT // Not implemented. For DHT support.
+
+	// Fast Extension (BEP-0006)
+	SUGGEST        = 13
+	HAVE_ALL       = 14
+	HAVE_NONE      = 15
+	REJECT_REQUEST = 16
+	ALLOWED_FAST   = 17
+
 	EXTENSION = 20
+
+	// BitTorrent v2 (BEP-0052)
+	HASH_REQUEST = 21
+	HASHES       = 22
+	HASH_REJECT  = 23
 )
 
 const (
@@ -67,11 +84,17 @@ var kBitTorrentHeader = []byte{'\x13', 'B', 'i', 't', 'T', 'o', 'r',
 type ActivePiece struct {
 	downloaderCount []int // -1 means piece is already downloaded
 	pieceLength     int
+
+	// Ban keys of the peers that sent blocks of this piece
+	contributors map[string]bool
+
+	// Whether all blocks arrived and the piece is being checked
+	verifying bool
 }
 
 func (a *ActivePiece) chooseBlockToDownload(endgame bool) (index int) {
 	if endgame {
-		return a.chooseBlockToDownloadEndgame()
+		return a.chooseBlockToDownloadEndgame(nil)
 	}
 	return a.chooseBlockToDownloadNormal()
 }
@@ -86,10 +109,13 @@ func (a *ActivePiece) chooseBlockToDownloadNormal() (index int) {
 	return -1
 }
 
-func (a *ActivePiece) chooseBlockToDownloadEndgame() (index int) {
+// chooseBlockToDownloadEndgame picks the block that didn't arrive with
+// the fewest requests, skipping those for which skip returns true; skip
+// may be nil.
+func (a *ActivePiece) chooseBlockToDownloadEndgame(skip func(block int) bool) (index int) {
 	index, minCount := -1, -1
 	for i, v := range a.downloaderCount {
-		if v >= 0 && (minCount == -1 || minCount > v) {
+		if v >= 0 && (minCount == -1 || minCount > v) && (skip == nil || !skip(i)) {
 			index, minCount = i, v
 		}
 	}
@@ -105,6 +131,16 @@ func (a *ActivePiece) recordBlock(index int) (requestCount int) {
 	return
 }
 
+// received tells whether the blocks blocks from first all arrived.
+func (a *ActivePiece) received(first, blocks int) bool {
+	for i := first; i < first+blocks && i < len(a.downloaderCount); i++ {
+		if a.downloaderCount[i] != -1 {
+			return false
+		}
+	}
+	return true
+}
+
 func (a *ActivePiece) isComplete() bool {
 	for _, v := range a.downloaderCount {
 		if v != -1 {
@@ -116,13 +152,21 @@ func (a *ActivePiece) isComplete() bool {
 
 type TorrentSessionI interface {
 	NewMetaInfo() chan *MetaInfo
+	Completions() chan string
+	Conflicts() chan string
 
 	IsEmpty() bool
 	Quit() error
+	Transferred() (uploaded, downloaded int64)
+	Stats() (peers int, uploaded, downloaded int64)
+	PeerStats() []PeerStats
 	Matches(ih string) bool
 	AcceptNewPeer(btc *btConn)
 	DoTorrent()
 	hintNewPeer(peer string) bool
+
+	Sealed() chan SealedMessage
+	setSealed(s SealedMessage)
 }
 
 type TorrentSession struct {
@@ -138,26 +182,133 @@ type TorrentSession struct {
 	lastPieceLength int
 	goodPieces      int
 	activePieces    map[int]*ActivePiece
-	heartbeat       chan bool
-	quit            chan bool
+	heartbeat       chan struct{}
+	monitor         *loopMonitor
+	timers          *timerManager
+	quit            chan struct{}
+
+	// Closed once the main loop exited
+	done chan struct{}
+
+	// Shared by all data sessions of the share
+	limits  transferLimits
+	trusted *trustedPeers
+	swarm   swarmSize
+
+	// How the files are accessed
+	store storeOptions
+
+	// First and last pieces of the files downloaded in order
+	sequential [][2]int
+
+	// Set while super-seeding
+	superSeed *superSeeder
+
+	// When we got the whole revision, and whether the seeding limits
+	// were reached since
+	completedAt time.Time
+	doneSeeding bool
+
+	// Choking state
+	lastRechoke  time.Time
+	rechokeRound int
+	optimistic   *peerState
 
 	// Where the data lives
 	target string
 
 	miChan chan *MetaInfo
 	Id     id.Id
+
+	// The public key of the writers, which may change with rotations
+	writerKey func() id.PubKey
+
+	// Devices that finished downloading the torrent while connected to us
+	completions chan string
+
+	// Local changes are kept as copies rather than overwritten by the
+	// revision of conflictPeer; the copies go to conflicts. Files are
+	// changed if they aren't as in conflictFiles, or without it if they
+	// were modified after conflictSince.
+	conflictSince time.Time
+	conflictFiles map[string]syncedFile
+	conflictPeer  string
+	conflicts     chan string
+
+	// How the files are once we have the whole revision
+	synced *syncedState
+
+	// The revision this one replaces, whose pieces are copied rather
+	// than downloaded
+	previous *MetaInfo
+
+	// Who told us about which peer, for holepunching
+	relays *holepunchRelays
+
+	// Peers we are about to connect to
+	dials *dialQueue
+
+	// Fetching pieces from mirrors
+	mirrorChan    chan mirrorPiece
+	mirrorPending int
+	starvedSince  time.Time
+
+	// As of the last rechoke
+	peerStats peerStatsSnapshot
+
+	pieceCache *pieceCache
+	writer     *diskWriter
+
+	// Files being flushed to disk
+	syncs sync.WaitGroup
+
+	// Piece layers of v2 torrents being fetched, by pieces root
+	layers     map[string]*layerFetch
+	needLayers bool
+
+	// Sealed copies of the pieces, see seal.go: the key readers seal them
+	// with, whether we are a replica keeping the sealed torrent, and the
+	// infohash replicas use to reach us
+	sealKey    *id.PreSharedKey
+	sealedOnly bool
+	sealing    bool
+	sealedIn   chan SealedMessage
+	sealedOut  chan SealedMessage
+	sealedLock sync.Mutex
+	sealedIH   string
+
+	// What the share transferred across restarts, if it is kept
+	transfers *transferTotals
+
+	// Where events of the share are sent
+	events *eventNotifier
 }
 
-func NewTorrentSession(shareId id.Id, target, torrent string, listenPort int) (ts *TorrentSession, err error) {
+func NewTorrentSession(shareId id.Id, target, torrent string, listenPort int, limits transferLimits, trusted *trustedPeers, swarm swarmSize, store storeOptions, synced *syncedState) (ts *TorrentSession, err error) {
 	t := &TorrentSession{
+		limits:          limits,
+		trusted:         trusted,
+		swarm:           swarm,
+		store:           store,
+		synced:          synced,
 		Id:              shareId,
 		peers:           newPeers(),
 		peerMessageChan: make(chan peerMessage),
 		activePieces:    make(map[int]*ActivePiece),
-		quit:            make(chan bool),
+		timers:          newTimerManager(),
+		quit:            make(chan struct{}),
+		done:            make(chan struct{}),
 		miChan:          make(chan *MetaInfo),
+		completions:     make(chan string, 16),
+		conflicts:       make(chan string, 16),
+		mirrorChan:      make(chan mirrorPiece, mirrorBatch),
+		sealedIn:        make(chan SealedMessage, 1),
+		sealedOut:       make(chan SealedMessage, 1),
+		pieceCache:      newPieceCache(),
+		relays:          newHolepunchRelays(),
 		target:          target,
 	}
+	t.writerKey = func() id.PubKey { return shareId.Pub }
 
 	fromMagnet := strings.HasPrefix(torrent, "magnet:")
 	t.m, err = getMetaInfo(torrent)
@@ -165,7 +316,7 @@ func NewTorrentSession(shareId id.Id, target, torrent string, listenPort int) (t
 		return
 	}
 
-	go t.StartPex()
+	t.dials = newDialQueue(*maxHalfOpen, t.connectToPeer)
 
 	t.si = &SessionInfo{
 		PeerId:      peerId(),
@@ -176,15 +327,41 @@ func NewTorrentSession(shareId id.Id, target, torrent string, listenPort int) (t
 		OurExtensions: map[int]string{
 			1: "ut_metadata",
 			2: "ut_pex",
+			3: "ut_holepunch",
 		},
 	}
 
 	if !t.si.FromMagnet {
 		err = t.load()
+		if err != nil {
+			t.closeStore()
+		}
 	}
 	return t, err
 }
 
+// Completions gives the devices, identified by their address, that
+// finished downloading the torrent while connected to us.
+func (t *TorrentSession) Completions() chan string {
+	return t.completions
+}
+
+// Conflicts gives the copies of the local versions of files, relative to
+// the shared folder, that the torrent would have overwritten.
+func (t *TorrentSession) Conflicts() chan string {
+	return t.conflicts
+}
+
+// keepLocalChanges makes the session keep the files that changed since
+// they were as in synced, or without it since the given time, when the
+// torrent of peer has other versions of them. It must be called before
+// DoTorrent.
+func (t *TorrentSession) keepLocalChanges(peer string, since time.Time, synced map[string]syncedFile) {
+	t.conflictPeer = peer
+	t.conflictSince = since
+	t.conflictFiles = synced
+}
+
 func (t *TorrentSession) NewMetaInfo() chan *MetaInfo {
 	return t.miChan
 }
@@ -210,10 +387,26 @@ func (t *TorrentSession) load() error {
 		return errors.New("Invalid encoding: " + e)
 	}
 
-	t.fileStore, t.totalSize, err = NewFileStore(t.m.Info, t.target)
+	t.closeStore()
+	if !t.conflictSince.IsZero() || t.conflictFiles != nil {
+		for _, name := range keepConflicts(t.target, t.m.Info, t.conflictSince, t.conflictFiles, t.conflictPeer, time.Now()) {
+			select {
+			case t.conflicts <- name:
+			default:
+				log.Println("[TORRENT] Not reporting conflict", name)
+			}
+		}
+	}
+	detectRenames(t.target, t.m.Info)
+	t.m.cacheV2Pieces()
+	t.fileStore, t.totalSize, err = openStore(t.m.Info, t.target, t.store)
 	if err != nil {
-		log.Fatal("Couldn't create filestore: ", err)
+		return fmt.Errorf("Couldn't create filestore: %s", err)
 	}
+	t.sequential = sequentialRanges(t.m.Info, t.store.sequential)
+	t.pieceCache.clear()
+	newVersionKeeper(t.target, t.store.versions).prune(time.Now())
+	t.writer = newDiskWriter(t.fileStore)
 	t.lastPieceLength = int(t.totalSize % t.m.Info.PieceLength)
 	if t.lastPieceLength == 0 { // last piece is a full piece
 		t.lastPieceLength = int(t.m.Info.PieceLength)
@@ -221,7 +414,7 @@ func (t *TorrentSession) load() error {
 
 	log.Println("Starting verification of pieces...")
 	start := time.Now()
-	good, bad, pieceSet, err := checkPieces(t.fileStore, t.totalSize, t.m)
+	good, bad, pieceSet, err := checkPieces(t.fileStore, t.totalSize, t.m, t.store.verifying)
 	if err != nil {
 		return errors.New(fmt.Sprintf("Error when checking pieces: %s", err))
 	}
@@ -232,8 +425,14 @@ func (t *TorrentSession) load() error {
 	}
 	t.pieceSet = pieceSet
 	t.totalPieces = good + bad
+	if reused := t.reusePrevious(); reused > 0 {
+		log.Println("Copied", reused, "pieces from the previous revision")
+		good += reused
+		bad -= reused
+	}
 	t.goodPieces = good
 	log.Println("Good pieces:", good, "Bad pieces:", bad)
+	t.fetchLayers()
 
 	left := int64(bad) * int64(t.m.Info.PieceLength)
 	if !t.pieceSet.IsSet(t.totalPieces - 1) {
@@ -241,12 +440,25 @@ func (t *TorrentSession) load() error {
 	}
 
 	if left == 0 {
+		t.waitSyncs()
 		err := t.fileStore.Cleanup()
 		if err != nil {
 			log.Println("Couldn't cleanup correctly: ", err)
 		}
+		applyTombstones(t.target, t.m.Info, newVersionKeeper(t.target, t.store.versions))
+		applySymlinks(t.target, t.m.Info)
+		t.synced.record(t.target, t.m.Info)
+		t.completedAt = t.synced.completedAt(t.m.InfoHash, time.Now())
+		// Only the writer publishing a fresh revision, not yet signed, is
+		// its sole seed; others spread what they have as usual
+		fresh := t.Id.CanWrite() && t.m.InfoSig == ""
+		if fresh && *superSeedSize > 0 && t.totalSize >= *superSeedSize {
+			log.Println("[TORRENT] Super-seeding")
+			t.superSeed = newSuperSeeder(t.totalPieces)
+		}
 	}
 
+	t.signInfo()
 	t.si.HaveTorrent = true
 	return nil
 }
@@ -266,6 +478,12 @@ func (ts *TorrentSession) Header() (header []byte) {
 	// Support Extension Protocol (BEP-0010)
 	header[25] |= 0x10
 
+	// Support Fast Extension (BEP-0006)
+	header[27] |= 0x04
+
+	// Support BitTorrent v2 (BEP-0052)
+	header[27] |= 0x10
+
 	copy(header[28:48], []byte(ts.m.InfoHash))
 	copy(header[48:68], []byte(ts.si.PeerId))
 
@@ -275,32 +493,97 @@ func (ts *TorrentSession) Header() (header []byte) {
 }
 
 func (ts *TorrentSession) hintNewPeer(peer string) (isnew bool) {
-	if ts.peers.Know(peer, "") {
+	// Bans are only known once the peer told its id
+	if ts.peers.Know(peer, "") || isBlocked(peer) || !ts.trusted.allows(peer) {
 		return false
 	}
 
-	go ts.connectToPeer(peer)
-	return true
+	return ts.dials.Push(peer)
 }
 
-func (ts *TorrentSession) connectToPeer(peer string) {
-	conn, err := NewTCPConn([]byte(ts.Id.Psk[:]), peer)
+func (ts *TorrentSession) connectToPeer(peer string) error {
+	// It may have connected to us while it was queued
+	if ts.peers.Know(peer, "") {
+		return nil
+	}
+	// The blocklist may have changed meanwhile
+	if isBlocked(peer) {
+		return nil
+	}
+	err := ts.dialPeer(peer)
 	if err != nil {
 		log.Println("Failed to connect to", peer, err)
-		return
+		// Maybe it is behind a NAT; onion services and I2P destinations
+		// aren't
+		if !*useTor && !*useI2P {
+			ts.rendezvous(peer)
+		}
 	}
+	return err
+}
 
-	_, err = conn.Write(ts.Header())
+func (ts *TorrentSession) dialPeer(peer string) error {
+	btconn, err := ts.dialBtConn(peer)
+	if _, ok := err.(handshakeError); ok && ts.canDialSealed() {
+		// Replicas that can't read the share only listen for sealed
+		// connections
+		btconn, err = ts.dialSealed(peer)
+	}
+	if err != nil || btconn == nil {
+		return err
+	}
+	ts.AddPeer(btconn)
+	return nil
+}
+
+// canDialSealed tells whether we can read the share and reach replicas
+// on the sealed revision of our torrent.
+func (ts *TorrentSession) canDialSealed() bool {
+	return !ts.sealedOnly && ts.sealKey != nil && ts.sealedInfoHash() != ""
+}
+
+// dialBtConn connects to peer on the channel of our torrent and exchanges
+// headers. It returns nil if peer turns out to be us.
+func (ts *TorrentSession) dialBtConn(peer string) (*btConn, error) {
+	if ts.sealedOnly {
+		key := ts.Id.SealedKey()
+		return ts.dialChannel(peer, channelSealed, key[:], ts.Header())
+	}
+	key, err := ts.Id.DataKey()
 	if err != nil {
-		log.Println("Failed to send header to", peer, err)
-		return
+		return nil, err
+	}
+	return ts.dialChannel(peer, channelData, key[:], ts.Header())
+}
+
+// dialSealed connects to peer, a replica, on the sealed revision of our
+// torrent. The pieces exchanged with it are sealed.
+func (ts *TorrentSession) dialSealed(peer string) (*btConn, error) {
+	key := ts.Id.SealedKey()
+	return ts.dialChannel(peer, channelSealed, key[:], ts.sealedHeader())
+}
+
+// dialChannel connects to peer on channel, with key, and exchanges
+// headers, ours being header.
+func (ts *TorrentSession) dialChannel(peer string, channel byte, key, header []byte) (*btConn, error) {
+	conn, err := NewTCPConn(channel, key, peer)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = conn.Write(header)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("couldn't send header: %s", err)
 	}
 
 	theirheader, err := readHeader(conn)
 	if err != nil {
-		log.Printf("Failed to read header from %s: %s", peer, err)
-		return
+		handshakeFailed(false)
+		conn.Close()
+		return nil, fmt.Errorf("couldn't read header: %s", err)
 	}
+	handshakeDone(conn)
 
 	peersInfoHash := string(theirheader[8:28])
 	id := string(theirheader[28:48])
@@ -308,16 +591,17 @@ func (ts *TorrentSession) connectToPeer(peer string) {
 	// If it's us, we don't need to continue
 	if id == ts.si.PeerId {
 		conn.Close()
-		return
+		return nil, nil
 	}
 
-	btconn := &btConn{
+	return &btConn{
 		header:   theirheader,
 		infohash: peersInfoHash,
 		id:       id,
 		conn:     conn,
-	}
-	ts.AddPeer(btconn)
+		channel:  channel,
+		outbound: true,
+	}, nil
 }
 
 func (t *TorrentSession) AcceptNewPeer(btconn *btConn) {
@@ -327,7 +611,11 @@ func (t *TorrentSession) AcceptNewPeer(btconn *btConn) {
 		return
 	}
 
-	_, err := btconn.conn.Write(t.Header())
+	header := t.Header()
+	if t.isSealedPeer(btconn) {
+		header = t.sealedHeader()
+	}
+	_, err := btconn.conn.Write(header)
 	if err != nil {
 		return
 	}
@@ -338,7 +626,22 @@ func (t *TorrentSession) AddPeer(btconn *btConn) {
 	theirheader := btconn.header
 
 	peer := btconn.conn.RemoteAddr().String()
-	if t.peers.Len() >= MAX_NUM_PEERS {
+	if bannedPeers.isBanned(peer, btconn.id, time.Now()) {
+		log.Println("Rejecting banned peer", peer)
+		btconn.conn.Close()
+		return
+	}
+	if isBlocked(peer) {
+		log.Println("Rejecting blocked peer", peer)
+		btconn.conn.Close()
+		return
+	}
+	if !t.trusted.allows(peer) {
+		log.Println("Rejecting untrusted peer", peer)
+		btconn.conn.Close()
+		return
+	}
+	if t.peers.Len() >= t.swarm.max && !t.trusted.isTrusted(peer) {
 		log.Println("We have enough peers. Rejecting additional peer", peer)
 		btconn.conn.Close()
 		return
@@ -346,20 +649,46 @@ func (t *TorrentSession) AddPeer(btconn *btConn) {
 	ps := NewPeerState(btconn.conn)
 	ps.address = peer
 	ps.id = btconn.id
+	ps.lan = isLANAddress(peer)
+	if !ps.lan || !*lanUnlimited {
+		ps.upLimiter = t.limits.up
+		ps.downLimiter = t.limits.down
+	}
+	ps.fast = supportsFast(theirheader)
+	ps.v2 = supportsV2(theirheader)
+	ps.outbound = btconn.outbound
+	ps.stripe = btconn.stripe
+	ps.sealed = t.isSealedPeer(btconn)
+	if ps.sealed && (t.sealedInfoHash() == "" || !t.si.HaveTorrent) {
+		log.Println("Rejecting replica", peer, "as we can't seal this revision")
+		btconn.conn.Close()
+		return
+	}
 
 	if keep := t.peers.Add(ps); !keep {
 		log.Printf("[TORRENT] Not keeping %s -- %s\n", ps.address, ps.id)
+		ps.Close()
 		return
 	}
 
 	if int(theirheader[5])&0x10 == 0x10 {
-		ps.SendExtensions(t.si.OurExtensions, int64(len(t.m.RawInfo())))
+		rawInfo, err := t.m.RawInfo()
+		if err != nil {
+			log.Println(err)
+			t.ClosePeer(ps)
+			return
+		}
+		if ps.sealed {
+			// They can't have our info dict
+			rawInfo = nil
+		}
+		ps.SendExtensions(t.si.OurExtensions, int64(len(rawInfo)), t.si.Port, *connectionsPerPeer, maxBlockLength)
 
 		if t.si.HaveTorrent {
-			ps.SendBitfield(t.pieceSet)
+			t.sendHaves(ps)
 		}
 	} else {
-		ps.SendBitfield(t.pieceSet)
+		t.sendHaves(ps)
 	}
 
 	if t.si.HaveTorrent {
@@ -367,6 +696,7 @@ func (t *TorrentSession) AddPeer(btconn *btConn) {
 		// a BITFIELD message as a first message
 		ps.have = bitset.New(t.totalPieces)
 	}
+	t.requestLayers(ps)
 
 	// Note that we need to launch these at the end of initialisation, so
 	// we are sure that the message we buffered previously will be the
@@ -384,46 +714,77 @@ func (t *TorrentSession) ClosePeer(peer *peerState) {
 
 	t.removeRequests(peer)
 	t.peers.Delete(peer)
-	peer.Close()
-}
-
-func (t *TorrentSession) deadlockDetector(quit chan struct{}) {
-	lastHeartbeat := time.Now()
-
-deadlockLoop:
-	for {
-		select {
-		case <-quit:
-			break deadlockLoop
-		case <-t.heartbeat:
-			lastHeartbeat = time.Now()
-		case <-time.After(15 * time.Second):
-			age := time.Now().Sub(lastHeartbeat)
-			log.Println("Starvation or deadlock of main thread detected. Look in the stack dump for what DoTorrent() is currently doing.")
-			log.Println("Last heartbeat", age.Seconds(), "seconds ago")
-			panic("Killed by deadlock detector")
-		}
+	t.relays.forget(peer.address)
+	if t.superSeed != nil {
+		delete(t.superSeed.offered, peer)
 	}
+	peer.Close()
 }
 
 func (t *TorrentSession) Quit() (err error) {
-	t.quit <- true
+	t.quit <- struct{}{}
+	t.dials.Close()
 	for _, peer := range t.peers.All() {
 		t.ClosePeer(peer)
 	}
+	t.closeStore()
 	return nil
 }
 
+// closeStore writes the blocks still queued and closes the files of the
+// torrent, if they were opened.
+func (t *TorrentSession) closeStore() {
+	t.waitSyncs()
+	if t.writer != nil {
+		t.writer.Close()
+		t.writer = nil
+	}
+	if t.fileStore != nil {
+		if err := t.fileStore.Close(); err != nil {
+			log.Println("Couldn't close files: ", err)
+		}
+		t.fileStore = nil
+	}
+}
+
+// Transferred returns how many bytes were exchanged with peers.
+func (t *TorrentSession) Transferred() (uploaded, downloaded int64) {
+	return atomic.LoadInt64(&t.si.Uploaded), atomic.LoadInt64(&t.si.Downloaded)
+}
+
+// Stats returns the number of peers and the bytes exchanged so far. It is
+// safe to call while the session runs.
+func (t *TorrentSession) Stats() (peers int, uploaded, downloaded int64) {
+	return t.peers.Len(), atomic.LoadInt64(&t.si.Uploaded), atomic.LoadInt64(&t.si.Downloaded)
+}
+
+// PeerStats returns the statistics of the peers as of the last rechoke.
+func (t *TorrentSession) PeerStats() []PeerStats {
+	return t.peerStats.get()
+}
+
+// DoTorrent runs the main loop of the session until it quits, restarting
+// it if it crashes.
 func (t *TorrentSession) DoTorrent() {
-	t.heartbeat = make(chan bool, 1)
+	defer close(t.done)
+	supervise("torrent", t.quit, t.run)
+}
+
+func (t *TorrentSession) run() error {
+	t.heartbeat = make(chan struct{}, 1)
+	t.monitor = newLoopMonitor("torrent")
 	quitDeadlock := make(chan struct{})
-	go t.deadlockDetector(quitDeadlock)
+	defer close(quitDeadlock)
+	go watchLoop("torrent", t.monitor, t.heartbeat, quitDeadlock)
 
 	log.Println("[CURRENT] Start")
 
-	rechokeChan := time.Tick(10 * time.Second)
-	verboseChan := time.Tick(10 * time.Minute)
-	keepAliveChan := time.Tick(60 * time.Second)
+	defer t.timers.StopAll()
+	rechokeChan := t.timers.Ticker("rechoke", *rechokeInterval)
+	verboseChan := t.timers.Ticker("verbose", *verboseInterval)
+	keepAliveChan := t.timers.Ticker("keepalive", *keepAliveInterval)
+	t.lastRechoke = time.Now()
+	go t.StartPex(t.timers.Ticker("pex", *pexInterval))
 
 	for {
 		select {
@@ -437,8 +798,27 @@ func (t *TorrentSession) DoTorrent() {
 				}
 				t.ClosePeer(peer)
 			}
-		case <-rechokeChan:
-			// TODO: recalculate who to choke / unchoke
+		case mp := <-t.mirrorChan:
+			t.recordMirrorPiece(mp)
+		case v := <-t.writer.Verified():
+			t.pieceVerified(v)
+		case s := <-t.sealedIn:
+			t.applySealed(s)
+		case tick := <-rechokeChan:
+			// Before they get an upload slot again
+			for _, peer := range t.peers.All() {
+				if peer.writeStalled(tick) {
+					log.Println("Closing peer", peer.address, "because it stalled on writes")
+					stalledPeers.Add(1)
+					t.ClosePeer(peer)
+				}
+			}
+			t.checkSeedLimits(tick)
+			t.rechoke()
+			t.peerStats.update(t.peers, peerChannelData)
+			t.monitor.Heartbeat(tick)
+			t.checkMirrors(tick)
+			t.checkSealed()
 
 			// Try to have at least 1 active piece per peer + 1 active piece
 			if len(t.activePieces) < t.peers.Len()+1 {
@@ -447,18 +827,23 @@ func (t *TorrentSession) DoTorrent() {
 				}
 			}
 
-			t.heartbeat <- true
+			t.heartbeat <- struct{}{}
 		case <-verboseChan:
 			ratio := float64(0.0)
-			if t.si.Downloaded > 0 {
-				ratio = float64(t.si.Uploaded) / float64(t.si.Downloaded)
+			uploaded, downloaded := t.Transferred()
+			if downloaded > 0 {
+				ratio = float64(uploaded) / float64(downloaded)
 			}
 			log.Printf("[CURRENT] Peers: %d, good/total: %d/%d, ratio: %f\n",
 				t.peers.Len(), t.goodPieces, t.totalPieces, ratio)
 		case <-keepAliveChan:
 			now := time.Now()
+			for _, peer := range auditPeers(t.peers, now) {
+				log.Println("Closing half-dead peer", peer.address)
+				t.ClosePeer(peer)
+			}
 			for _, peer := range t.peers.All() {
-				if peer.lastReadTime.Second() != 0 && now.Sub(peer.lastReadTime) > 3*time.Minute {
+				if peer.idle(now) {
 					// log.Println("Closing peer", peer.address, "because timed out.")
 					t.ClosePeer(peer)
 					continue
@@ -476,16 +861,20 @@ func (t *TorrentSession) DoTorrent() {
 
 		case <-t.quit:
 			log.Println("Quitting torrent session")
-			quitDeadlock <- struct{}{}
-			return
+			return nil
 		}
 	}
 
 }
 
 func (t *TorrentSession) RequestBlock(p *peerState) (err error) {
+	if t.needLayers {
+		// Pieces can't be checked yet
+		return
+	}
+	lan := t.lanSources(p)
 	for k, _ := range t.activePieces {
-		if p.have.IsSet(k) {
+		if p.have.IsSet(k) && !lanHas(lan, k) {
 			err = t.RequestBlock2(p, k, false)
 			if err != io.EOF {
 				return
@@ -493,7 +882,11 @@ func (t *TorrentSession) RequestBlock(p *peerState) (err error) {
 		}
 	}
 	// No active pieces. (Or no suitable active pieces.) Pick one
-	piece := t.ChoosePiece(p)
+	piece := t.ChoosePiece(p, lan)
+	if piece < 0 && len(lan) > 0 && t.ChoosePiece(p, nil) >= 0 {
+		// Local peers will send the rest
+		return
+	}
 	if piece < 0 {
 		// No unclaimed pieces. See if we can double-up on an active piece
 		for k, _ := range t.activePieces {
@@ -506,32 +899,47 @@ func (t *TorrentSession) RequestBlock(p *peerState) (err error) {
 		}
 	}
 	if piece >= 0 {
-		pieceLength := int(t.m.Info.PieceLength)
-		if piece == t.totalPieces-1 {
-			pieceLength = t.lastPieceLength
-		}
-		pieceCount := (pieceLength + STANDARD_BLOCK_LENGTH - 1) / STANDARD_BLOCK_LENGTH
-		t.activePieces[piece] = &ActivePiece{make([]int, pieceCount), pieceLength}
+		t.activatePiece(piece)
 		return t.RequestBlock2(p, piece, false)
-	} else {
+	} else if len(p.our_requests) == 0 {
 		p.SetInterested(false)
 	}
-	return
+	return nil
 }
 
-func (t *TorrentSession) ChoosePiece(p *peerState) (piece int) {
+// activatePiece starts tracking the download of the blocks of piece.
+func (t *TorrentSession) activatePiece(piece int) {
+	pieceLength := int(pieceSize(t.totalSize, t.m.Info.PieceLength, piece))
+	pieceCount := (pieceLength + STANDARD_BLOCK_LENGTH - 1) / STANDARD_BLOCK_LENGTH
+	t.activePieces[piece] = &ActivePiece{
+		downloaderCount: make([]int, pieceCount),
+		pieceLength:     pieceLength,
+		contributors:    make(map[string]bool),
+	}
+}
+
+// ChoosePiece returns a piece to download from p, which none of lan has,
+// or -1.
+func (t *TorrentSession) ChoosePiece(p *peerState, lan []*peerState) (piece int) {
+	if piece = t.chooseSequential(p, lan); piece >= 0 {
+		return
+	}
+	// What the peer suggests is likely in its cache
+	if piece = t.chooseSuggested(p); piece >= 0 && !lanHas(lan, piece) {
+		return
+	}
 	n := t.totalPieces
 	start := rand.Intn(n)
-	piece = t.checkRange(p, start, n)
+	piece = t.checkRange(p, start, n, lan)
 	if piece == -1 {
-		piece = t.checkRange(p, 0, start)
+		piece = t.checkRange(p, 0, start, lan)
 	}
 	return
 }
 
-func (t *TorrentSession) checkRange(p *peerState, start, end int) (piece int) {
+func (t *TorrentSession) checkRange(p *peerState, start, end int, lan []*peerState) (piece int) {
 	for i := start; i < end; i++ {
-		if !t.pieceSet.IsSet(i) && p.have.IsSet(i) {
+		if !t.pieceSet.IsSet(i) && p.have.IsSet(i) && !lanHas(lan, i) {
 			if _, ok := t.activePieces[i]; !ok {
 				return i
 			}
@@ -541,32 +949,38 @@ func (t *TorrentSession) checkRange(p *peerState, start, end int) (piece int) {
 }
 
 func (t *TorrentSession) RequestBlock2(p *peerState, piece int, endGame bool) (err error) {
+	if endGame {
+		return t.requestEndgame(p, piece)
+	}
 	v := t.activePieces[piece]
-	for {
+	// Up to what the peer queues, the rest of the piece is requested as
+	// its blocks come in
+	for len(p.our_requests) < p.maxOurRequests() {
 		block := v.chooseBlockToDownload(endGame)
-		if block >= 0 {
-			t.requestBlockImp(p, piece, block, true)
-		} else {
+		if block < 0 {
 			break
 		}
+		blocks := 1
+		if !endGame {
+			blocks = v.extendRun(block, p.blocksPerRequest())
+		}
+		t.requestBlockImp(p, piece, block, blocks, true)
 	}
 	return
 }
 
-// Request or cancel a block
-func (t *TorrentSession) requestBlockImp(p *peerState, piece int, block int, request bool) {
+// Request or cancel a run of blocks
+func (t *TorrentSession) requestBlockImp(p *peerState, piece int, block int, blocks int, request bool) {
 	begin := block * STANDARD_BLOCK_LENGTH
 	req := make([]byte, 13)
 	opcode := byte(REQUEST)
 	if !request {
 		opcode = byte(CANCEL)
 	}
-	length := STANDARD_BLOCK_LENGTH
-	if piece == t.totalPieces-1 {
-		left := t.lastPieceLength - begin
-		if left < length {
-			length = left
-		}
+	length := blocks * STANDARD_BLOCK_LENGTH
+	left := int(pieceSize(t.totalSize, t.m.Info.PieceLength, piece)) - begin
+	if left < length {
+		length = left
 	}
 	// log.Println("Requesting block", piece, ".", block, length, request)
 	req[0] = opcode
@@ -577,72 +991,149 @@ func (t *TorrentSession) requestBlockImp(p *peerState, piece int, block int, req
 	if !request {
 		delete(p.our_requests, requestIndex)
 	} else {
-		p.our_requests[requestIndex] = time.Now()
+		p.our_requests[requestIndex] = ourRequest{at: time.Now(), blocks: blocks}
 	}
 	p.sendMessage(req)
 	return
 }
 
 func (t *TorrentSession) RecordBlock(p *peerState, piece, begin, length uint32) (err error) {
-	block := begin / STANDARD_BLOCK_LENGTH
-	// log.Println("Received block", piece, ".", block)
+	// log.Println("Received block", piece, ".", begin/STANDARD_BLOCK_LENGTH)
 	requestIndex := (uint64(piece) << 32) | uint64(begin)
+	if r, ok := p.our_requests[requestIndex]; ok {
+		p.recordRTT(time.Since(r.at))
+	}
 	delete(p.our_requests, requestIndex)
+	p.snubbed = false
 	v, ok := t.activePieces[int(piece)]
 	if ok {
-		requestCount := v.recordBlock(int(block))
-		if requestCount > 1 {
-			// Someone else has also requested this, so send cancel notices
-			for _, peer := range t.peers.All() {
-				if p != peer {
-					if _, ok := peer.our_requests[requestIndex]; ok {
-						t.requestBlockImp(peer, int(piece), int(block), false)
-						requestCount--
-					}
-				}
+		v.contributors[banKey(p.address, p.id)] = true
+		end := int(begin+length+STANDARD_BLOCK_LENGTH-1) / STANDARD_BLOCK_LENGTH
+		for block := int(begin / STANDARD_BLOCK_LENGTH); block < end && block < len(v.downloaderCount); block++ {
+			if v.recordBlock(block) > 1 {
+				t.cancelOthers(p, int(piece), block)
 			}
 		}
-		t.si.Downloaded += int64(length)
-		if v.isComplete() {
-			delete(t.activePieces, int(piece))
-			ok, err = checkPiece(t.fileStore, t.totalSize, t.m, int(piece))
-			if !ok || err != nil {
-				log.Println("Closing peer that sent a bad piece", piece, p.id, err)
-				p.Close()
-				return
+		atomic.AddInt64(&t.si.Downloaded, int64(length))
+		t.transfers.add(t.m.InfoHash, 0, int64(length))
+		p.downloaded += int64(length)
+		if v.isComplete() && !v.verifying {
+			// The piece stays active until checked, so that it isn't
+			// requested again meanwhile
+			v.verifying = true
+			store, totalSize, m := t.fileStore, t.totalSize, t.m
+			t.writer.verify(int(piece), func() (bool, error) {
+				return checkPiece(store, totalSize, m, int(piece))
+			})
+		}
+	} else {
+		log.Println("Received a block we already have.", piece, begin/STANDARD_BLOCK_LENGTH, p.address)
+	}
+	return
+}
+
+// pieceVerified handles the check of a downloaded piece.
+func (t *TorrentSession) pieceVerified(v pieceVerification) {
+	a, ok := t.activePieces[v.piece]
+	if !ok || t.pieceSet.IsSet(v.piece) {
+		// A mirror sent it meanwhile
+		return
+	}
+	delete(t.activePieces, v.piece)
+	if !v.ok || v.err != nil {
+		if v.err != nil {
+			log.Println("Piece", v.piece, "failed verification:", v.err)
+		} else {
+			log.Println("Piece", v.piece, "failed verification")
+		}
+		badPieces.Add(1)
+		t.events.notify(eventVerifyFailed, t.m.InfoHash, "", "Piece %d from peers failed verification", v.piece)
+		t.blameBadPiece(a)
+		return
+	}
+	t.pieceCompleted(v.piece, a.pieceLength)
+}
+
+// pieceCompleted records that we have piece, checked, and tells peers.
+func (t *TorrentSession) pieceCompleted(piece int, length int) {
+	t.si.Left -= int64(length)
+	t.pieceSet.Set(piece)
+	t.syncCompleted(piece)
+	t.goodPieces++
+	log.Println("Have", t.goodPieces, "of", t.totalPieces, "pieces.")
+	if t.goodPieces == t.totalPieces {
+		log.Println("We're complete!")
+		t.completedAt = t.synced.completedAt(t.m.InfoHash, time.Now())
+		t.events.notify(eventSynced, t.m.InfoHash, "", "Revision %x is fully downloaded", t.m.InfoHash)
+		t.waitSyncs()
+		err := t.fileStore.Cleanup()
+		if err != nil {
+			log.Println("Couldn't cleanup correctly: ", err)
+		}
+		applyTombstones(t.target, t.m.Info, newVersionKeeper(t.target, t.store.versions))
+		applySymlinks(t.target, t.m.Info)
+		t.synced.record(t.target, t.m.Info)
+		if *verifyChecksums {
+			go t.verifyFiles()
+		}
+
+		// TODO: Drop connections to all seeders.
+	}
+	for _, p := range t.peers.All() {
+		if p.have != nil {
+			if p.have.IsSet(piece) {
+				// We don't do anything special. We rely on the caller
+				// to decide if this peer is still interesting.
+			} else {
+				// log.Println("...telling ", p)
+				haveMsg := make([]byte, 5)
+				haveMsg[0] = HAVE
+				binary.BigEndian.PutUint32(haveMsg[1:5], uint32(piece))
+				p.sendMessage(haveMsg)
 			}
-			t.si.Left -= int64(v.pieceLength)
-			t.pieceSet.Set(int(piece))
-			t.goodPieces++
-			log.Println("Have", t.goodPieces, "of", t.totalPieces, "pieces.")
-			if t.goodPieces == t.totalPieces {
-				log.Println("We're complete!")
-				err := t.fileStore.Cleanup()
-				if err != nil {
-					log.Println("Couldn't cleanup correctly: ", err)
-				}
+		}
+	}
+}
 
-				// TODO: Drop connections to all seeders.
+// verifyFiles checks the downloaded files against the checksums of the
+// revision, which catches damage pieces can't see, such as data written
+// to the wrong file.
+func (t *TorrentSession) verifyFiles() {
+	bad, err := verifyFiles(t.m.Info, t.target)
+	if err != nil {
+		log.Println("Couldn't verify files: ", err)
+		return
+	}
+	for _, path := range bad {
+		raiseAlert("bad-checksum", "%s doesn't match the checksum of revision %x", path, t.m.InfoHash)
+		t.events.notify(eventVerifyFailed, t.m.InfoHash, "", "%s doesn't match its checksum", path)
+	}
+	if len(bad) == 0 {
+		log.Println("All files match their checksums")
+	}
+}
+
+// blameBadPiece counts a failure against every peer that contributed to a
+// corrupt piece, and drops those that get banned.
+func (t *TorrentSession) blameBadPiece(v *ActivePiece) {
+	now := time.Now()
+	for key := range v.contributors {
+		banned := bannedPeers.badPiece(key, now)
+		if banned {
+			raiseAlert("ban", "Banning %s for %s: it sent too many corrupt pieces", key, *banDuration)
+			t.events.notify(eventPeerBanned, t.m.InfoHash, key, "Banned for %s: it sent too many corrupt pieces", *banDuration)
+		}
+		for _, p := range t.peers.All() {
+			if banKey(p.address, p.id) != key {
+				continue
 			}
-			for _, p := range t.peers.All() {
-				if p.have != nil {
-					if p.have.IsSet(int(piece)) {
-						// We don't do anything special. We rely on the caller
-						// to decide if this peer is still interesting.
-					} else {
-						// log.Println("...telling ", p)
-						haveMsg := make([]byte, 5)
-						haveMsg[0] = HAVE
-						binary.BigEndian.PutUint32(haveMsg[1:5], uint32(piece))
-						p.sendMessage(haveMsg)
-					}
-				}
+			if banned {
+				t.ClosePeer(p)
+			} else {
+				p.setError(errCorruptPiece)
 			}
 		}
-	} else {
-		log.Println("Received a block we already have.", piece, block, p.address)
 	}
-	return
 }
 
 func (t *TorrentSession) doChoke(p *peerState) (err error) {
@@ -651,34 +1142,55 @@ func (t *TorrentSession) doChoke(p *peerState) (err error) {
 	return
 }
 
+// cancelOthers cancels the requests of other peers than p for block,
+// which p just sent us. Requests of several blocks are only cancelled
+// once all their blocks arrived.
+func (t *TorrentSession) cancelOthers(p *peerState, piece, block int) {
+	v := t.activePieces[piece]
+	for _, peer := range t.peers.All() {
+		if p == peer {
+			continue
+		}
+		for k, r := range peer.our_requests {
+			first := int(k&0xffffffff) / STANDARD_BLOCK_LENGTH
+			if int(k>>32) != piece || block < first || block >= first+r.blocks || !v.received(first, r.blocks) {
+				continue
+			}
+			t.requestBlockImp(peer, piece, first, r.blocks, false)
+			t.removeRequest(piece, first, r.blocks)
+		}
+	}
+}
+
 func (t *TorrentSession) removeRequests(p *peerState) (err error) {
-	for k, _ := range p.our_requests {
+	for k, r := range p.our_requests {
 		piece := int(k >> 32)
 		begin := int(k & 0xffffffff)
 		block := begin / STANDARD_BLOCK_LENGTH
 		// log.Println("Forgetting we requested block ", piece, ".", block)
-		t.removeRequest(piece, block)
+		t.removeRequest(piece, block, r.blocks)
 	}
-	p.our_requests = make(map[uint64]time.Time, MAX_OUR_REQUESTS)
+	p.our_requests = make(map[uint64]ourRequest, MAX_OUR_REQUESTS)
 	return
 }
 
-func (t *TorrentSession) removeRequest(piece, block int) {
+// removeRequest forgets that a run of blocks was requested. Blocks
+// already downloaded are left alone.
+func (t *TorrentSession) removeRequest(piece, block, blocks int) {
 	v, ok := t.activePieces[piece]
-	if ok && v.downloaderCount[block] > 0 {
-		v.downloaderCount[block]--
+	if !ok {
+		return
+	}
+	for i := block; i < block+blocks && i < len(v.downloaderCount); i++ {
+		if v.downloaderCount[i] > 0 {
+			v.downloaderCount[i]--
+		}
 	}
 }
 
 func (t *TorrentSession) doCheckRequests(p *peerState) (err error) {
-	now := time.Now()
-	for k, v := range p.our_requests {
-		if now.Sub(v).Seconds() > 30 {
-			piece := int(k >> 32)
-			block := int(k&0xffffffff) / STANDARD_BLOCK_LENGTH
-			// log.Println("timing out request of", piece, ".", block)
-			t.removeRequest(piece, block)
-		}
+	if t.expireRequests(p, time.Now()) {
+		t.snub(p)
 	}
 	return
 }
@@ -711,7 +1223,19 @@ func (t *TorrentSession) extensionMessage(message []byte, p *peerState) (err err
 		p.temporaryBitfield = make([]byte, len(message[1:]))
 		copy(p.temporaryBitfield, message[1:])
 		p.can_receive_bitfield = false
+	case HAVE_ALL:
+		if p.fast && p.can_receive_bitfield {
+			p.temporaryHaveAll = true
+			p.can_receive_bitfield = false
+		}
+	case HAVE_NONE:
+		if p.fast {
+			p.can_receive_bitfield = false
+		}
 	case EXTENSION:
+		if err = t.checkExtension(message[1:]); err != nil {
+			return
+		}
 		err := t.DoExtension(message[1:], p)
 		if err != nil {
 			log.Printf("Failed extensions for %s: %s\n", p.address, err)
@@ -736,7 +1260,7 @@ func (t *TorrentSession) generalMessage(message []byte, p *peerState) (err error
 			return errors.New("Unexpected length")
 		}
 		p.peer_choking = false
-		for i := 0; i < MAX_OUR_REQUESTS; i++ {
+		for i := 0; i < p.maxOurRequests(); i++ {
 			err = t.RequestBlock(p)
 			if err != nil {
 				return
@@ -749,10 +1273,8 @@ func (t *TorrentSession) generalMessage(message []byte, p *peerState) (err error
 		}
 		p.peer_interested = true
 
-		// TODO: Consider better unchoking policy (this is needed for
-		// clients like Transmission who don't send a BITFIELD so we have to
-		// unchoke them at this moment)
-		p.SetChoke(false)
+		// Don't make them wait for the next rechoke if we have room
+		t.unchokeIfFreeSlot(p)
 	case NOT_INTERESTED:
 		// log.Println("not interested", p)
 		if len(message) != 1 {
@@ -766,18 +1288,19 @@ func (t *TorrentSession) generalMessage(message []byte, p *peerState) (err error
 		piece := binary.BigEndian.Uint32(message[1:])
 		if p.have.IsWithinLimits(int(piece)) {
 			log.Printf("[TORRENT] Set have at %d for %s\n", piece, p.address)
+			hadPiece := p.have.IsSet(int(piece))
 			p.have.Set(int(piece))
+			if !hadPiece && p.have.FindNextClear(0) == -1 {
+				t.peerCompleted(p)
+			}
+			if t.superSeed != nil {
+				t.superSeedHave(p, int(piece))
+			}
 			if !p.am_interested && !t.pieceSet.IsSet(int(piece)) {
 				p.SetInterested(true)
 
 				log.Printf("[TORRENT] %s has %d, asking for it", p.address, piece)
-				// TODO DRY up, this is a copy paste from RequestBlock
-				pieceLength := int(t.m.Info.PieceLength)
-				if int(piece) == t.totalPieces-1 {
-					pieceLength = t.lastPieceLength
-				}
-				pieceCount := (pieceLength + STANDARD_BLOCK_LENGTH - 1) / STANDARD_BLOCK_LENGTH
-				t.activePieces[int(piece)] = &ActivePiece{make([]int, pieceCount), pieceLength}
+				t.activatePiece(int(piece))
 				t.RequestBlock2(p, int(piece), false)
 			}
 		} else {
@@ -785,21 +1308,34 @@ func (t *TorrentSession) generalMessage(message []byte, p *peerState) (err error
 		}
 	case BITFIELD:
 		// log.Println("bitfield", p.address)
+		have := bitset.NewFromBytes(t.totalPieces, message[1:])
+		if have == nil {
+			return errors.New("Invalid bitfield data.")
+		}
 		if !p.can_receive_bitfield {
-			return errors.New("Late bitfield operation")
+			// A super-seed done hiding its pieces tells them all at once;
+			// it can only add to what we knew
+			if p.have == nil {
+				return errors.New("Late bitfield operation")
+			}
+			for i := have.FindNextSet(0); i != -1; i = have.FindNextSet(i + 1) {
+				p.have.Set(i)
+			}
+			have = p.have
 		}
-		p.SetChoke(false) // TODO: better choke policy
-
-		p.have = bitset.NewFromBytes(t.totalPieces, message[1:])
-		if p.have == nil {
-			return errors.New("Invalid bitfield data.")
+		p.have = have
+		for i := p.have.FindNextSet(0); i != -1 && t.superSeed != nil; i = p.have.FindNextSet(i + 1) {
+			t.superSeedHave(p, i)
+		}
+		if p.have.FindNextClear(0) == -1 {
+			t.peerCompleted(p)
 		}
 
 		t.checkInteresting(p)
 		p.can_receive_bitfield = false
 
 		if p.peer_choking == false {
-			for i := 0; i < MAX_OUR_REQUESTS; i++ {
+			for i := 0; i < p.maxOurRequests(); i++ {
 				err = t.RequestBlock(p)
 				if err != nil {
 					return
@@ -817,13 +1353,21 @@ func (t *TorrentSession) generalMessage(message []byte, p *peerState) (err error
 			return errors.New("piece out of range.")
 		}
 		if !t.pieceSet.IsSet(int(index)) {
+			if p.fast {
+				t.rejectRequest(p, index, begin, length)
+				return
+			}
 			return errors.New("we don't have that piece.")
 		}
-		if int64(begin) >= t.m.Info.PieceLength {
-			return errors.New("begin out of range.")
+		if err = t.checkBlock(index, begin, length); err != nil {
+			return
 		}
-		if int64(begin)+int64(length) > t.m.Info.PieceLength {
-			return errors.New("begin + length out of range.")
+		if length > maxBlockLength {
+			return errors.New("Block length too large.")
+		}
+		if (p.am_choking && !p.ourAllowedFast[index]) || t.doneSeeding {
+			t.rejectRequest(p, index, begin, length)
+			return
 		}
 		// TODO: Asynchronous
 		// p.AddRequest(index, begin, length)
@@ -843,21 +1387,23 @@ func (t *TorrentSession) generalMessage(message []byte, p *peerState) (err error
 			// We already have that piece, keep going
 			break
 		}
-		if int64(begin) >= t.m.Info.PieceLength {
-			return errors.New("begin out of range.")
-		}
-		if int64(begin)+int64(length) > t.m.Info.PieceLength {
-			return errors.New("begin + length out of range.")
+		if err = t.checkBlock(index, begin, uint32(length)); err != nil {
+			return
 		}
-		if length > 128*1024 {
+		if length > maxBlockLength {
 			return errors.New("Block length too large.")
 		}
-		globalOffset := int64(index)*t.m.Info.PieceLength + int64(begin)
-		_, err = t.fileStore.WriteAt(message[9:], globalOffset)
-		if err != nil {
-			return err
+		if p.sealed {
+			t.sealBlock(index, begin, message[9:])
 		}
+		globalOffset := int64(index)*t.m.Info.PieceLength + int64(begin)
+		t.writer.write(int(index), globalOffset, message[9:])
 		t.RecordBlock(p, index, begin, uint32(length))
+		if p.peer_choking {
+			// We can only be getting an allowed fast piece
+			t.requestAllowedFast(p)
+			break
+		}
 		err = t.RequestBlock(p)
 	case CANCEL:
 		// log.Println("cancel")
@@ -879,7 +1425,7 @@ func (t *TorrentSession) generalMessage(message []byte, p *peerState) (err error
 		if int64(begin)+int64(length) > t.m.Info.PieceLength {
 			return errors.New("begin + length out of range.")
 		}
-		if length != STANDARD_BLOCK_LENGTH {
+		if length > maxBlockLength {
 			return errors.New("Unexpected block length.")
 		}
 		p.CancelRequest(index, begin, length)
@@ -891,11 +1437,17 @@ func (t *TorrentSession) generalMessage(message []byte, p *peerState) (err error
 			return fmt.Errorf("Unexpected length for port message: %d", len(message))
 		}
 	case EXTENSION:
+		if err = t.checkExtension(message[1:]); err != nil {
+			return
+		}
 		err := t.DoExtension(message[1:], p)
 		if err != nil {
 			log.Printf("Failed extensions for %s: %s\n", p.address, err)
 		}
-
+	case SUGGEST, HAVE_ALL, HAVE_NONE, REJECT_REQUEST, ALLOWED_FAST:
+		return t.fastMessage(message, p)
+	case HASH_REQUEST, HASHES, HASH_REJECT:
+		return t.hashMessage(message, p)
 	default:
 		return errors.New(fmt.Sprintf("Uknown message id: %d\n", messageId))
 	}
@@ -912,6 +1464,16 @@ type ExtensionHandshake struct {
 	Ipv4         string         `bencode:"ipv4,omitempty"`
 	Reqq         uint16         `bencode:"reqq,omitempty"`
 	MetadataSize int64          `bencode:"metadata_size,omitempty"`
+	Conns        uint16         `bencode:"bs_conns,omitempty"`
+	MaxBlock     uint32         `bencode:"bs_max_block,omitempty"`
+	Onion        string         `bencode:"bs_onion,omitempty"`
+}
+
+// checkExtension makes sure an extension message respects our limits.
+// Holepunch messages aren't bencoded.
+func (t *TorrentSession) checkExtension(msg []byte) error {
+	bencoded := len(msg) < 1 || msg[0] == EXTENSION_HANDSHAKE || t.si.OurExtensions[int(msg[0])] != "ut_holepunch"
+	return checkExtensionMessage(msg, bencoded)
 }
 
 func (t *TorrentSession) DoExtension(msg []byte, p *peerState) (err error) {
@@ -924,10 +1486,8 @@ func (t *TorrentSession) DoExtension(msg []byte, p *peerState) (err error) {
 			return err
 		}
 
-		p.theirExtensions = make(map[string]int)
-		for name, code := range h.M {
-			p.theirExtensions[name] = code
-		}
+		p.readExtensionHandshake(h)
+		go t.openStripes(p)
 
 		if t.si.HaveTorrent || t.si.ME != nil && t.si.ME.Transferring {
 			return
@@ -938,6 +1498,9 @@ func (t *TorrentSession) DoExtension(msg []byte, p *peerState) (err error) {
 			log.Printf("Missing metadata_size argument, this is invalid.")
 			return
 		}
+		if h.MetadataSize < 0 || h.MetadataSize > maxMetadataSize {
+			return fmt.Errorf("Invalid metadata_size: %d", h.MetadataSize)
+		}
 
 		nPieces := h.MetadataSize/METADATA_PIECE_SIZE + 1
 		t.si.ME.Pieces = make([][]byte, nPieces)
@@ -953,6 +1516,8 @@ func (t *TorrentSession) DoExtension(msg []byte, p *peerState) (err error) {
 			t.DoMetadata(msg[1:], p)
 		case "ut_pex":
 			t.DoPex(msg[1:], p)
+		case "ut_holepunch":
+			t.DoHolepunch(msg[1:], p)
 		default:
 			log.Println("Unknown extension: ", ext)
 		}
@@ -963,24 +1528,74 @@ func (t *TorrentSession) DoExtension(msg []byte, p *peerState) (err error) {
 	return nil
 }
 
+// checkBlock makes sure a block is within its piece, the last piece being
+// shorter than the others.
+func (t *TorrentSession) checkBlock(index, begin, length uint32) error {
+	size := pieceSize(t.totalSize, t.m.Info.PieceLength, int(index))
+	if int64(begin) >= size {
+		return errors.New("begin out of range.")
+	}
+	if int64(begin)+int64(length) > size {
+		return errors.New("begin + length out of range.")
+	}
+	return nil
+}
+
 func (t *TorrentSession) sendRequest(peer *peerState, index, begin, length uint32) (err error) {
-	if !peer.am_choking {
+	if !peer.am_choking || peer.ourAllowedFast[index] {
 		// log.Println("Sending block", index, begin, length)
 		buf := make([]byte, length+9)
 		buf[0] = PIECE
 		binary.BigEndian.PutUint32(buf[1:5], index)
 		binary.BigEndian.PutUint32(buf[5:9], begin)
-		_, err = t.fileStore.ReadAt(buf[9:],
-			int64(index)*t.m.Info.PieceLength+int64(begin))
+		err = t.readBlock(buf[9:], index, begin)
 		if err != nil {
 			return
 		}
+		if peer.sealed {
+			t.sealBlock(index, begin, buf[9:])
+		}
 		peer.sendMessage(buf)
-		t.si.Uploaded += int64(length)
+		atomic.AddInt64(&t.si.Uploaded, int64(length))
+		t.transfers.add(t.m.InfoHash, int64(length), 0)
+		peer.uploaded += int64(length)
 	}
 	return
 }
 
+// peerCompleted reports that p now has the whole torrent. Devices are
+// told apart by their peer id, as many may share an address behind a
+// NAT. The main loop may be busy, in which case the report is dropped
+// rather than stalling transfers.
+func (t *TorrentSession) peerCompleted(p *peerState) {
+	device := hex.EncodeToString([]byte(p.id))
+	if p.id == "" {
+		device = p.address
+	}
+	select {
+	case t.completions <- device:
+	default:
+		log.Println("[TORRENT] Dropping completion of", device)
+	}
+}
+
+// unchokeIfFreeSlot unchokes p if fewer than uploadSlots peers are
+// unchoked, p didn't snub us and we didn't stop seeding.
+func (t *TorrentSession) unchokeIfFreeSlot(p *peerState) {
+	if p.snubbed || t.doneSeeding {
+		return
+	}
+	unchoked := 0
+	for _, peer := range t.peers.All() {
+		if !peer.am_choking {
+			unchoked++
+		}
+	}
+	if unchoked < *uploadSlots {
+		p.SetChoke(false)
+	}
+}
+
 func (t *TorrentSession) checkInteresting(p *peerState) {
 	p.SetInterested(t.isInteresting(p))
 }
@@ -995,5 +1610,11 @@ func (t *TorrentSession) isInteresting(p *peerState) bool {
 }
 
 func (t *TorrentSession) Matches(ih string) bool {
-	return t.m.InfoHash == ih
+	return t.m.InfoHash == ih || ih == t.sealedInfoHash()
+}
+
+// isSealedPeer tells whether btconn comes from a replica that can't read
+// the share. Replicas don't seal what they exchange between themselves.
+func (t *TorrentSession) isSealedPeer(btconn *btConn) bool {
+	return btconn.channel == channelSealed && !t.sealedOnly
 }
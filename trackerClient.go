@@ -7,9 +7,11 @@ import (
 	"log"
 	"math/rand"
 	"net"
+	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/nictuku/nettools"
@@ -27,12 +29,23 @@ type ClientStatusReport struct {
 	Uploaded   int64
 	Downloaded int64
 	Left       int64
+
+	// Our global IPv6 address, if we have one. Our listener accepts
+	// connections on all addresses, so trackers are told about it.
+	IPv6 string
 }
 
 type trackerClient struct {
 	trackerInfoChan chan *TrackerResponse
 	announceList    [][]string
 	failedTrackers  map[string]struct{}
+
+	// Guards failedTrackers and the order of announceList, as
+	// AnnounceSync may run along with a periodic announce
+	lock *sync.Mutex
+
+	// Closed when nobody receives responses anymore
+	quit chan struct{}
 }
 
 func NewTrackerClient(announce string, announceList [][]string) trackerClient {
@@ -49,18 +62,56 @@ func NewTrackerClient(announce string, announceList [][]string) trackerClient {
 		trackerInfoChan: tic,
 		announceList:    announceList,
 		failedTrackers:  make(map[string]struct{}),
+		lock:            new(sync.Mutex),
+		quit:            make(chan struct{}),
 	}
 }
 
+// Announce queries the trackers in the background. The response is sent
+// on trackerInfoChan; it is nil if no tracker could be contacted. It is
+// dropped once the client is closed.
 func (tc trackerClient) Announce(report ClientStatusReport) {
 	go func() {
 		tr := tc.queryTrackers(report)
-		if tr != nil {
-			tc.trackerInfoChan <- tr
+		select {
+		case tc.trackerInfoChan <- tr:
+		case <-tc.quit:
 		}
 	}()
 }
 
+// Close tells the announces still running that their responses won't be
+// received. AnnounceSync can still be used.
+func (tc trackerClient) Close() {
+	close(tc.quit)
+}
+
+func (tc trackerClient) HasTrackers() bool {
+	for _, level := range tc.announceList {
+		if len(level) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// AnnounceSync announces the report and waits at most timeout for a
+// tracker to answer. It is used when the answer can't be received
+// asynchronously, such as when exiting.
+func (tc trackerClient) AnnounceSync(report ClientStatusReport, timeout time.Duration) (tr *TrackerResponse) {
+	done := make(chan *TrackerResponse, 1)
+	go func() {
+		done <- tc.queryTrackers(report)
+	}()
+
+	select {
+	case tr = <-done:
+	case <-time.After(timeout):
+		log.Printf("Timed out announcing %q to trackers\n", report.Event)
+	}
+	return
+}
+
 // Deep copy announcelist and shuffle each level.
 func shuffleAnnounceList(announceList [][]string) (result [][]string) {
 	result = make([][]string, len(announceList))
@@ -82,17 +133,26 @@ func shuffleAnnounceListLevel(level []string) (shuffled []string) {
 
 func (tc trackerClient) queryTrackers(report ClientStatusReport) (tr *TrackerResponse) {
 	for _, level := range tc.announceList {
-		for i, tracker := range level {
-			if _, ok := tc.failedTrackers[tracker]; ok {
+		tc.lock.Lock()
+		trackers := append([]string{}, level...)
+		tc.lock.Unlock()
+		for _, tracker := range trackers {
+			tc.lock.Lock()
+			_, failed := tc.failedTrackers[tracker]
+			tc.lock.Unlock()
+			if failed {
 				continue
 			}
+			start := time.Now()
 			var err error
 			tr, err = queryTracker(report, tracker)
+			announceStats.observe(tracker, time.Since(start), err)
+			tc.lock.Lock()
 			if err == nil {
 				// Move successful tracker to front of slice for next announcement
 				// cycle.
-				copy(level[1:i+1], level[0:i])
-				level[0] = tracker
+				moveToFront(level, tracker)
+				tc.lock.Unlock()
 				return
 			} else {
 				log.Println("Couldn't contact", tracker, ": ", err)
@@ -101,14 +161,35 @@ func (tc trackerClient) queryTrackers(report ClientStatusReport) (tr *TrackerRes
 				}
 				tc.failedTrackers[tracker] = struct{}{}
 			}
+			tc.lock.Unlock()
 		}
 	}
+	tc.lock.Lock()
 	if len(tc.announceList) > 0 && len(tc.announceList[0]) > 0 {
 		log.Println("Error: Did not successfully contact a tracker:", tc.announceList)
 	}
+
+	// Every tracker failed. Forget about it so that the next announce,
+	// which the caller is expected to delay, tries all of them again.
+	for tracker := range tc.failedTrackers {
+		delete(tc.failedTrackers, tracker)
+	}
+	tc.lock.Unlock()
 	return
 }
 
+// moveToFront moves tracker to the front of level, keeping the order of
+// the others.
+func moveToFront(level []string, tracker string) {
+	for i, t := range level {
+		if t == tracker {
+			copy(level[1:i+1], level[0:i])
+			level[0] = tracker
+			return
+		}
+	}
+}
+
 func queryTracker(report ClientStatusReport, trackerUrl string) (tr *TrackerResponse, err error) {
 	// We sometimes indicate www.domain.com:port/path, it should be
 	// automatically detected
@@ -131,14 +212,9 @@ func queryTracker(report ClientStatusReport, trackerUrl string) (tr *TrackerResp
 	uq.Add("left", strconv.FormatInt(report.Left, 10))
 	uq.Add("compact", "1")
 
-	// Don't report IPv6 address, the user might prefer to keep
-	// that information private when communicating with IPv4 hosts.
-	if false {
-		ipv6Address, err := findLocalIPV6AddressFor(u.Host)
-		if err == nil {
-			log.Println("our ipv6", ipv6Address)
-			uq.Add("ipv6", ipv6Address)
-		}
+	// BEP 7
+	if report.IPv6 != "" {
+		uq.Add("ipv6", report.IPv6)
 	}
 
 	if report.Event != "" {
@@ -150,7 +226,29 @@ func queryTracker(report ClientStatusReport, trackerUrl string) (tr *TrackerResp
 
 	u.RawQuery = uq.Encode()
 
-	tr, err = getTrackerInfo(u.String())
+	// Trackers only see the address we connect from. Unless a proxy
+	// hides it anyway, announce over both IPv4 and IPv6 so that peers
+	// of both families can find us.
+	if report.IPv6 == "" || useProxy() {
+		return announceOver(proxyHttpClient(), u.String())
+	}
+
+	tr, err = announceOver(trackerClient4, u.String())
+	tr6, err6 := announceOver(trackerClient6, u.String())
+	if err6 != nil {
+		log.Println("Couldn't announce to", trackerUrl, "over IPv6:", err6)
+		return
+	}
+	if err != nil {
+		return tr6, nil
+	}
+	tr.Peers = append(tr.Peers, tr6.Peers...)
+	tr.Peers6 = append(tr.Peers6, tr6.Peers6...)
+	return
+}
+
+func announceOver(client *http.Client, url string) (tr *TrackerResponse, err error) {
+	tr, err = getTrackerInfo(client, url)
 	if tr == nil || err != nil {
 		log.Println("Error: Could not fetch tracker info:", err)
 	} else if tr.FailureReason != "" {
@@ -160,27 +258,42 @@ func queryTracker(report ClientStatusReport, trackerUrl string) (tr *TrackerResp
 	return
 }
 
-func findLocalIPV6AddressFor(hostAddr string) (local string, err error) {
-	// Figure out our IPv6 address to talk to a given host.
-	host, hostPort, err := net.SplitHostPort(hostAddr)
-	if err != nil {
-		host = hostAddr
-		hostPort = "1234"
+// Clients announcing over a single family. They are shared by all
+// announces, so that connections to trackers are reused rather than
+// left open by a new transport each time.
+var (
+	trackerClient4 = httpClientOver("tcp4")
+	trackerClient6 = httpClientOver("tcp6")
+)
+
+// httpClientOver returns a client that only connects over the given
+// network, "tcp4" or "tcp6".
+func httpClientOver(network string) *http.Client {
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	return &http.Client{
+		Transport: &http.Transport{
+			Dial: func(_, addr string) (net.Conn, error) {
+				return dialer.Dial(network, addr)
+			},
+		},
 	}
-	dummyAddr := net.JoinHostPort(host, hostPort)
-	log.Println("Looking for host ", dummyAddr)
-	conn, err := net.Dial("udp6", dummyAddr)
+}
+
+// localIPv6Address returns the global IPv6 address we use to reach the
+// internet, or "" if we don't have one.
+func localIPv6Address() string {
+	// No packet is sent: this only asks the system for a route
+	conn, err := net.Dial("udp6", "[2001:4860:4860::8888]:53")
 	if err != nil {
-		log.Println("No IPV6 for host ", host, err)
-		return "", err
+		return ""
 	}
 	defer conn.Close()
-	localAddr := conn.LocalAddr()
-	local, _, err = net.SplitHostPort(localAddr.String())
-	if err != nil {
-		local = localAddr.String()
+
+	addr, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok || addr.IP.To4() != nil || !addr.IP.IsGlobalUnicast() {
+		return ""
 	}
-	return
+	return addr.IP.String()
 }
 
 type TrackerResponse struct {
@@ -197,8 +310,8 @@ type TrackerResponse struct {
 	Peers6         []string
 }
 
-func getTrackerInfo(url string) (tr *TrackerResponse, err error) {
-	r, err := proxyHttpGet(url)
+func getTrackerInfo(client *http.Client, url string) (tr *TrackerResponse, err error) {
+	r, err := client.Get(url)
 	if err != nil {
 		return
 	}
@@ -218,34 +331,27 @@ func getTrackerInfo(url string) (tr *TrackerResponse, err error) {
 		return
 	}
 
-	// Decode peers
-	if len(tr2.PeersRaw) > 0 {
-		const peerLen = 6
-		nPeers := len(tr2.PeersRaw) / peerLen
-		// log.Println("Tracker gave us", nPeers, "peers")
-		tr2.Peers = make([]string, nPeers)
-		for i := 0; i < nPeers; i++ {
-			peer := nettools.BinaryToDottedPort(tr2.PeersRaw[i*peerLen : (i+1)*peerLen])
-			tr2.Peers[i/peerLen] = peer
-		}
-	}
+	tr2.Peers = decodeCompactPeers(tr2.PeersRaw)
+	tr2.Peers6 = decodeCompactPeers6(tr2.Peers6Raw)
 
-	// Decode peers6
+	tr = &tr2
+	return
+}
 
-	if len(tr2.Peers6Raw) > 0 {
-		const peerLen = 18
-		nPeers := len(tr2.Peers6Raw) / peerLen
-		// log.Println("Tracker gave us", nPeers, "IPv6 peers")
-		tr2.Peers6 = make([]string, nPeers)
-		for i := 0; i < nPeers; i++ {
-			peerEntry := tr2.Peers6Raw[i*peerLen : (i+1)*peerLen]
-			host := net.IP(peerEntry[0:16])
-			port := int((uint(peerEntry[16]) << 8) | uint(peerEntry[17]))
-			peer := net.JoinHostPort(host.String(), strconv.Itoa(port))
-			tr2.Peers6[i] = peer
-		}
+func decodeCompactPeers(raw string) (peers []string) {
+	const peerLen = 6
+	for i := 0; i+peerLen <= len(raw); i += peerLen {
+		peers = append(peers, nettools.BinaryToDottedPort(raw[i:i+peerLen]))
 	}
+	return
+}
 
-	tr = &tr2
+func decodeCompactPeers6(raw string) (peers []string) {
+	const peerLen = 18
+	for i := 0; i+peerLen <= len(raw); i += peerLen {
+		host := net.IP(raw[i : i+16])
+		port := int(raw[i+16])<<8 | int(raw[i+17])
+		peers = append(peers, net.JoinHostPort(host.String(), strconv.Itoa(port)))
+	}
 	return
 }
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestDecodeCompactPeers(t *testing.T) {
+	raw := "\x0a\x00\x00\x01\x1e\x61" + "\x0a\x00\x00\x02\x1e\x62" + "\x0a"
+	expected := []string{"10.0.0.1:7777", "10.0.0.2:7778"}
+	if got := decodeCompactPeers(raw); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected %v, got %v", expected, got)
+	}
+}
+
+func TestDecodeCompactPeers6(t *testing.T) {
+	raw := "\x20\x01\x0d\xb8" + "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01" + "\x1e\x61"
+	expected := []string{"[2001:db8::1]:7777"}
+	if got := decodeCompactPeers6(raw); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected %v, got %v", expected, got)
+	}
+}
+
+func TestConcurrentAnnounces(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/bad" {
+			http.Error(w, "no", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte("d8:intervali60e5:peers0:e"))
+	}))
+	defer server.Close()
+
+	tc := NewTrackerClient("", [][]string{{server.URL + "/bad", server.URL + "/good"}})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if tr := tc.queryTrackers(ClientStatusReport{}); tr == nil {
+				t.Error("Expected the good tracker to answer")
+			}
+		}()
+	}
+	wg.Wait()
+	if tc.announceList[0][0] != server.URL+"/good" {
+		t.Errorf("Expected the good tracker first, got %v", tc.announceList[0])
+	}
+}
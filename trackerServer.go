@@ -0,0 +1,433 @@
+package main
+
+// A minimal BitTorrent tracker, so that a small team can bootstrap a
+// private swarm without public infrastructure. It speaks HTTP (BEP 3,
+// with the compact peer lists of BEP 23 and BEP 7) and UDP (BEP 15) on
+// the same port number.
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/zeebo/bencode"
+)
+
+const (
+	trackerInterval = 5 * time.Minute
+	trackerNumWant  = 50
+
+	// BEP 15 constants
+	udpTrackerProtocolID = 0x41727101980
+	udpActionConnect     = 0
+	udpActionAnnounce    = 1
+	udpActionScrape      = 2
+	udpActionError       = 3
+	udpConnectionTTL     = 2 * time.Minute
+
+	// How many UDP connection ids are valid at once at most. Beyond that,
+	// connecting drops a random one.
+	udpMaxConnections = 4096
+)
+
+var (
+	errInvalidAnnounce = errors.New("Invalid announce")
+	errUnknownTorrent  = errors.New("Unknown torrent")
+)
+
+type trackerPeer struct {
+	peerID   string
+	ip       net.IP
+	port     int
+	seed     bool
+	lastSeen time.Time
+}
+
+type trackerAnswer struct {
+	Interval   int64  `bencode:"interval"`
+	Complete   int    `bencode:"complete"`
+	Incomplete int    `bencode:"incomplete"`
+	Peers      string `bencode:"peers"`
+	Peers6     string `bencode:"peers6,omitempty"`
+}
+
+type trackerFailure struct {
+	FailureReason string `bencode:"failure reason"`
+}
+
+type TrackerServer struct {
+	sync.Mutex
+
+	// infohash -> peer id -> peer
+	swarms map[string]map[string]*trackerPeer
+
+	// Infohashes we share ourselves, with the port we listen on. They are
+	// the only ones the tracker answers for: it is no public tracker.
+	self map[string]int
+
+	// UDP connection ids handed out, and when
+	connections map[uint64]time.Time
+}
+
+// NewTrackerServer starts a tracker on the given port, for both HTTP and
+// UDP.
+func NewTrackerServer(port int) (ts *TrackerServer, err error) {
+	ts = newTrackerServer()
+
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{Port: port})
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/announce", ts)
+	go func() {
+		err := http.Serve(listener, mux)
+		log.Println("[TRACKER] HTTP tracker stopped:", err)
+	}()
+	go ts.serveUDP(conn)
+	go ts.expireLoop()
+
+	return ts, nil
+}
+
+func newTrackerServer() *TrackerServer {
+	return &TrackerServer{
+		swarms:      make(map[string]map[string]*trackerPeer),
+		self:        make(map[string]int),
+		connections: make(map[uint64]time.Time),
+	}
+}
+
+// expireLoop forgets the peers that stopped announcing and the UDP
+// connection ids that expired, even of swarms nobody announces to
+// anymore.
+func (ts *TrackerServer) expireLoop() {
+	for now := range time.Tick(udpConnectionTTL) {
+		ts.expire(now)
+	}
+}
+
+func (ts *TrackerServer) expire(now time.Time) {
+	ts.Lock()
+	defer ts.Unlock()
+	for ih, swarm := range ts.swarms {
+		for key, p := range swarm {
+			if now.Sub(p.lastSeen) > 2*trackerInterval {
+				delete(swarm, key)
+			}
+		}
+		if len(swarm) == 0 {
+			delete(ts.swarms, ih)
+		}
+	}
+	for id, given := range ts.connections {
+		if now.Sub(given) > udpConnectionTTL {
+			delete(ts.connections, id)
+		}
+	}
+}
+
+// AddSelf makes the tracker hand out our own address for the given
+// infohash, without us having to announce to ourselves.
+func (ts *TrackerServer) AddSelf(ih string, listenPort int) {
+	ts.Lock()
+	defer ts.Unlock()
+	ts.self[ih] = listenPort
+}
+
+// announce records the peer in the swarm and returns the other peers of
+// the swarm. A peer reachable over both IPv4 and IPv6 has one entry per
+// address, but is only counted once. Only the torrents we share have a
+// swarm.
+func (ts *TrackerServer) announce(ih, peerID string, ip net.IP, port int, seed bool, event string) (peers []*trackerPeer, complete, incomplete int, err error) {
+	ts.Lock()
+	defer ts.Unlock()
+
+	if _, ok := ts.self[ih]; !ok {
+		return nil, 0, 0, errUnknownTorrent
+	}
+	swarm, ok := ts.swarms[ih]
+	if !ok {
+		swarm = make(map[string]*trackerPeer)
+		ts.swarms[ih] = swarm
+	}
+
+	now := time.Now()
+	if event == "stopped" {
+		delete(swarm, peerID+"/4")
+		delete(swarm, peerID+"/6")
+	} else {
+		swarm[swarmKey(peerID, ip)] = &trackerPeer{peerID: peerID, ip: ip, port: port, seed: seed, lastSeen: now}
+	}
+
+	counted := make(map[string]struct{})
+	for key, p := range swarm {
+		if now.Sub(p.lastSeen) > 2*trackerInterval {
+			delete(swarm, key)
+			continue
+		}
+		if _, ok := counted[p.peerID]; !ok {
+			counted[p.peerID] = struct{}{}
+			if p.seed {
+				complete++
+			} else {
+				incomplete++
+			}
+		}
+		// Map iteration order is random, so is the subset of peers we give
+		if p.peerID != peerID && len(peers) < trackerNumWant {
+			peers = append(peers, p)
+		}
+	}
+	if len(swarm) == 0 {
+		delete(ts.swarms, ih)
+	}
+	return
+}
+
+func swarmKey(peerID string, ip net.IP) string {
+	if ip.To4() != nil {
+		return peerID + "/4"
+	}
+	return peerID + "/6"
+}
+
+func (ts *TrackerServer) selfPeer(ih string, ip net.IP) *trackerPeer {
+	ts.Lock()
+	defer ts.Unlock()
+
+	port, ok := ts.self[ih]
+	if !ok || ip == nil {
+		return nil
+	}
+	return &trackerPeer{ip: ip, port: port, lastSeen: time.Now()}
+}
+
+func (ts *TrackerServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	ih := q.Get("info_hash")
+	peerID := q.Get("peer_id")
+	port, err := strconv.Atoi(q.Get("port"))
+	if len(ih) != 20 || len(peerID) != 20 || err != nil || port <= 0 || port > 65535 {
+		bencode.NewEncoder(w).Encode(trackerFailure{errInvalidAnnounce.Error()})
+		return
+	}
+	left, _ := strconv.ParseInt(q.Get("left"), 10, 64)
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		bencode.NewEncoder(w).Encode(trackerFailure{"Unknown address"})
+		return
+	}
+
+	peers, complete, incomplete, err := ts.announce(ih, peerID, ip, port, left == 0, q.Get("event"))
+	if err != nil {
+		bencode.NewEncoder(w).Encode(trackerFailure{err.Error()})
+		return
+	}
+
+	// BEP 7: a peer announcing over IPv4 can tell its IPv6 address
+	if ip6 := net.ParseIP(q.Get("ipv6")); ip6 != nil && ip6.To4() == nil && !ip6.Equal(ip) {
+		ts.announce(ih, peerID, ip6, port, left == 0, q.Get("event"))
+	}
+
+	// The address the peer used to reach us is also where we share from
+	localHost, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		localHost = r.Host
+	}
+	if self := ts.selfPeer(ih, net.ParseIP(localHost)); self != nil {
+		peers = append(peers, self)
+	}
+
+	answer := trackerAnswer{
+		Interval:   int64(trackerInterval / time.Second),
+		Complete:   complete,
+		Incomplete: incomplete,
+	}
+	var peers4, peers6 bytes.Buffer
+	for _, p := range peers {
+		if ip4 := p.ip.To4(); ip4 != nil {
+			writeCompactPeer(&peers4, ip4, p.port)
+		} else {
+			writeCompactPeer(&peers6, p.ip.To16(), p.port)
+		}
+	}
+	answer.Peers = peers4.String()
+	answer.Peers6 = peers6.String()
+
+	err = bencode.NewEncoder(w).Encode(answer)
+	if err != nil {
+		log.Println("[TRACKER] Couldn't encode answer:", err)
+	}
+}
+
+func writeCompactPeer(buf *bytes.Buffer, ip net.IP, port int) {
+	buf.Write(ip)
+	buf.WriteByte(byte(port >> 8))
+	buf.WriteByte(byte(port))
+}
+
+func (ts *TrackerServer) serveUDP(conn *net.UDPConn) {
+	packet := make([]byte, 2048)
+	for {
+		n, from, err := conn.ReadFromUDP(packet)
+		if err != nil {
+			log.Println("[TRACKER] Error reading from UDP:", err)
+			continue
+		}
+		if n < 16 {
+			continue
+		}
+
+		response := ts.handleUDP(packet[:n], from)
+		if response != nil {
+			conn.WriteToUDP(response, from)
+		}
+	}
+}
+
+func (ts *TrackerServer) handleUDP(packet []byte, from *net.UDPAddr) []byte {
+	connectionID := binary.BigEndian.Uint64(packet[0:8])
+	action := binary.BigEndian.Uint32(packet[8:12])
+	transactionID := packet[12:16]
+
+	if action == udpActionConnect {
+		if connectionID != udpTrackerProtocolID {
+			return nil
+		}
+		resp := make([]byte, 16)
+		binary.BigEndian.PutUint32(resp[0:4], udpActionConnect)
+		copy(resp[4:8], transactionID)
+		binary.BigEndian.PutUint64(resp[8:16], ts.newConnectionID())
+		return resp
+	}
+
+	if !ts.validConnectionID(connectionID) {
+		return udpError(transactionID, "Invalid connection id")
+	}
+
+	switch action {
+	case udpActionAnnounce:
+		if len(packet) < 98 {
+			return udpError(transactionID, errInvalidAnnounce.Error())
+		}
+		ih := string(packet[16:36])
+		peerID := string(packet[36:56])
+		left := binary.BigEndian.Uint64(packet[64:72])
+		event := ""
+		switch binary.BigEndian.Uint32(packet[80:84]) {
+		case 1:
+			event = "completed"
+		case 2:
+			event = "started"
+		case 3:
+			event = "stopped"
+		}
+		port := int(binary.BigEndian.Uint16(packet[96:98]))
+
+		peers, complete, incomplete, err := ts.announce(ih, peerID, from.IP, port, left == 0, event)
+		if err != nil {
+			return udpError(transactionID, err.Error())
+		}
+
+		// Peers are given in the address family of the request
+		isV4 := from.IP.To4() != nil
+		var buf bytes.Buffer
+		header := make([]byte, 20)
+		binary.BigEndian.PutUint32(header[0:4], udpActionAnnounce)
+		copy(header[4:8], transactionID)
+		binary.BigEndian.PutUint32(header[8:12], uint32(trackerInterval/time.Second))
+		binary.BigEndian.PutUint32(header[12:16], uint32(incomplete))
+		binary.BigEndian.PutUint32(header[16:20], uint32(complete))
+		buf.Write(header)
+		for _, p := range peers {
+			if ip4 := p.ip.To4(); ip4 != nil && isV4 {
+				writeCompactPeer(&buf, ip4, p.port)
+			} else if ip4 == nil && !isV4 {
+				writeCompactPeer(&buf, p.ip.To16(), p.port)
+			}
+		}
+		return buf.Bytes()
+
+	case udpActionScrape:
+		var buf bytes.Buffer
+		header := make([]byte, 8)
+		binary.BigEndian.PutUint32(header[0:4], udpActionScrape)
+		copy(header[4:8], transactionID)
+		buf.Write(header)
+		for i := 16; i+20 <= len(packet) && i < 16+74*20; i += 20 {
+			complete, incomplete := ts.scrape(string(packet[i : i+20]))
+			stats := make([]byte, 12)
+			binary.BigEndian.PutUint32(stats[0:4], uint32(complete))
+			binary.BigEndian.PutUint32(stats[8:12], uint32(incomplete))
+			buf.Write(stats)
+		}
+		return buf.Bytes()
+	}
+
+	return udpError(transactionID, "Unknown action")
+}
+
+func (ts *TrackerServer) scrape(ih string) (complete, incomplete int) {
+	ts.Lock()
+	defer ts.Unlock()
+	for _, p := range ts.swarms[ih] {
+		if p.seed {
+			complete++
+		} else {
+			incomplete++
+		}
+	}
+	return
+}
+
+func (ts *TrackerServer) newConnectionID() uint64 {
+	var b [8]byte
+	rand.Read(b[:])
+	id := binary.BigEndian.Uint64(b[:])
+
+	ts.Lock()
+	defer ts.Unlock()
+	if len(ts.connections) >= udpMaxConnections {
+		// Map iteration order is random
+		for old := range ts.connections {
+			delete(ts.connections, old)
+			break
+		}
+	}
+	ts.connections[id] = time.Now()
+	return id
+}
+
+func (ts *TrackerServer) validConnectionID(id uint64) bool {
+	ts.Lock()
+	defer ts.Unlock()
+	given, ok := ts.connections[id]
+	return ok && time.Now().Sub(given) <= udpConnectionTTL
+}
+
+func udpError(transactionID []byte, message string) []byte {
+	resp := make([]byte, 8+len(message))
+	binary.BigEndian.PutUint32(resp[0:4], udpActionError)
+	copy(resp[4:8], transactionID)
+	copy(resp[8:], message)
+	return resp
+}
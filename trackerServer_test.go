@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zeebo/bencode"
+)
+
+var (
+	testTrackerIH    = strings.Repeat("i", 20)
+	testTrackerPeerA = strings.Repeat("a", 20)
+	testTrackerPeerB = strings.Repeat("b", 20)
+)
+
+func TestTrackerAnnounce(t *testing.T) {
+	ts := newTrackerServer()
+	ts.AddSelf(testTrackerIH, 7777)
+
+	vectors := []struct {
+		ih, peerID string
+		ip         string
+		seed       bool
+		event      string
+
+		peers, complete, incomplete int
+		err                         error
+	}{
+		// Other torrents are none of our business
+		{strings.Repeat("x", 20), testTrackerPeerA, "192.0.2.1", false, "started", 0, 0, 0, errUnknownTorrent},
+		{testTrackerIH, testTrackerPeerA, "192.0.2.1", false, "started", 0, 0, 1, nil},
+		{testTrackerIH, testTrackerPeerB, "192.0.2.2", true, "started", 1, 1, 1, nil},
+		// A peer over IPv6 too is counted once
+		{testTrackerIH, testTrackerPeerA, "2001:db8::1", false, "", 1, 1, 1, nil},
+		{testTrackerIH, testTrackerPeerB, "192.0.2.2", true, "", 2, 1, 1, nil},
+		{testTrackerIH, testTrackerPeerA, "192.0.2.1", false, "stopped", 1, 1, 0, nil},
+	}
+	for i, vec := range vectors {
+		peers, complete, incomplete, err := ts.announce(vec.ih, vec.peerID, net.ParseIP(vec.ip), 6881, vec.seed, vec.event)
+		if err != vec.err || len(peers) != vec.peers || complete != vec.complete || incomplete != vec.incomplete {
+			t.Errorf("%d: expected %d peers, %d complete, %d incomplete, %v, got %d, %d, %d, %v",
+				i, vec.peers, vec.complete, vec.incomplete, vec.err, len(peers), complete, incomplete, err)
+		}
+	}
+	if _, ok := ts.swarms[strings.Repeat("x", 20)]; ok {
+		t.Error("Expected no swarm for unknown torrents")
+	}
+
+	ts.expire(time.Now().Add(3 * trackerInterval))
+	if len(ts.swarms) != 0 {
+		t.Errorf("Expected silent swarms to expire, got %d", len(ts.swarms))
+	}
+}
+
+func TestTrackerConnectionsCap(t *testing.T) {
+	ts := newTrackerServer()
+	for i := 0; i < udpMaxConnections+10; i++ {
+		ts.newConnectionID()
+	}
+	if n := len(ts.connections); n > udpMaxConnections {
+		t.Errorf("Expected at most %d connections, got %d", udpMaxConnections, n)
+	}
+	ts.expire(time.Now().Add(2 * udpConnectionTTL))
+	if n := len(ts.connections); n != 0 {
+		t.Errorf("Expected connections to expire, got %d", n)
+	}
+}
+
+func udpTrackerPacket(connectionID uint64, action uint32, payload []byte) []byte {
+	packet := make([]byte, 16, 16+len(payload))
+	binary.BigEndian.PutUint64(packet[0:8], connectionID)
+	binary.BigEndian.PutUint32(packet[8:12], action)
+	copy(packet[12:16], "txid")
+	return append(packet, payload...)
+}
+
+func udpAnnouncePayload(ih, peerID string, left uint64, port uint16) []byte {
+	payload := make([]byte, 82)
+	copy(payload[0:20], ih)
+	copy(payload[20:40], peerID)
+	binary.BigEndian.PutUint64(payload[48:56], left)
+	binary.BigEndian.PutUint16(payload[80:82], port)
+	return payload
+}
+
+func TestTrackerUDP(t *testing.T) {
+	ts := newTrackerServer()
+	ts.AddSelf(testTrackerIH, 7777)
+	from := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 6881}
+
+	if resp := ts.handleUDP(udpTrackerPacket(1234, udpActionConnect, nil), from); resp != nil {
+		t.Errorf("Expected no answer without the protocol id, got %v", resp)
+	}
+	resp := ts.handleUDP(udpTrackerPacket(udpTrackerProtocolID, udpActionConnect, nil), from)
+	if len(resp) != 16 || binary.BigEndian.Uint32(resp[0:4]) != udpActionConnect || string(resp[4:8]) != "txid" {
+		t.Fatalf("Unexpected connect answer %v", resp)
+	}
+	connectionID := binary.BigEndian.Uint64(resp[8:16])
+
+	ts.announce(testTrackerIH, testTrackerPeerB, net.ParseIP("192.0.2.2"), 6882, true, "")
+	ts.announce(testTrackerIH, strings.Repeat("c", 20), net.ParseIP("2001:db8::2"), 6883, false, "")
+
+	vectors := []struct {
+		packet []byte
+		action uint32
+		length int
+	}{
+		{udpTrackerPacket(connectionID+1, udpActionAnnounce, udpAnnouncePayload(testTrackerIH, testTrackerPeerA, 1, 6881)), udpActionError, 0},
+		{udpTrackerPacket(connectionID, udpActionAnnounce, udpAnnouncePayload(strings.Repeat("x", 20), testTrackerPeerA, 1, 6881)), udpActionError, 0},
+		{udpTrackerPacket(connectionID, udpActionAnnounce, []byte("short")), udpActionError, 0},
+		// Only the IPv4 peer is given to an IPv4 peer
+		{udpTrackerPacket(connectionID, udpActionAnnounce, udpAnnouncePayload(testTrackerIH, testTrackerPeerA, 1, 6881)), udpActionAnnounce, 20 + 6},
+		{udpTrackerPacket(connectionID, udpActionScrape, []byte(testTrackerIH+strings.Repeat("x", 20))), udpActionScrape, 8 + 2*12},
+		{udpTrackerPacket(connectionID, 42, nil), udpActionError, 0},
+	}
+	for i, vec := range vectors {
+		resp := ts.handleUDP(vec.packet, from)
+		if len(resp) < 8 || binary.BigEndian.Uint32(resp[0:4]) != vec.action || string(resp[4:8]) != "txid" {
+			t.Errorf("%d: expected action %d, got %v", i, vec.action, resp)
+			continue
+		}
+		if vec.length > 0 && len(resp) != vec.length {
+			t.Errorf("%d: expected %d bytes, got %d", i, vec.length, len(resp))
+		}
+	}
+
+	resp = ts.handleUDP(udpTrackerPacket(connectionID, udpActionAnnounce, udpAnnouncePayload(testTrackerIH, testTrackerPeerA, 1, 6881)), from)
+	if leechers, seeders := binary.BigEndian.Uint32(resp[12:16]), binary.BigEndian.Uint32(resp[16:20]); leechers != 2 || seeders != 1 {
+		t.Errorf("Expected 2 leechers and 1 seeder, got %d and %d", leechers, seeders)
+	}
+	if ip, port := net.IP(resp[20:24]), binary.BigEndian.Uint16(resp[24:26]); !ip.Equal(net.ParseIP("192.0.2.2")) || port != 6882 {
+		t.Errorf("Expected 192.0.2.2:6882, got %s:%d", ip, port)
+	}
+}
+
+func TestTrackerHTTP(t *testing.T) {
+	ts := newTrackerServer()
+	ts.AddSelf(testTrackerIH, 7777)
+	ts.announce(testTrackerIH, testTrackerPeerB, net.ParseIP("192.0.2.2"), 6882, true, "")
+	ts.announce(testTrackerIH, strings.Repeat("c", 20), net.ParseIP("2001:db8::2"), 6883, false, "")
+
+	get := func(ih string) (answer trackerAnswer, failure trackerFailure) {
+		q := url.Values{
+			"info_hash": {ih},
+			"peer_id":   {testTrackerPeerA},
+			"port":      {"6881"},
+			"left":      {"10"},
+		}
+		r, err := http.NewRequest("GET", "http://192.0.2.100:8080/announce?"+q.Encode(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.RemoteAddr = "192.0.2.1:50000"
+		w := httptest.NewRecorder()
+		ts.ServeHTTP(w, r)
+
+		body := w.Body.Bytes()
+		if err := bencode.NewDecoder(bytes.NewReader(body)).Decode(&answer); err != nil {
+			t.Fatal(err)
+		}
+		if err := bencode.NewDecoder(bytes.NewReader(body)).Decode(&failure); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	answer, failure := get(testTrackerIH)
+	if failure.FailureReason != "" {
+		t.Fatal(failure.FailureReason)
+	}
+	// The other IPv4 peer and ourselves, and the IPv6 peer
+	if len(answer.Peers) != 2*6 || len(answer.Peers6) != 18 || answer.Complete != 1 || answer.Incomplete != 2 {
+		t.Fatalf("Unexpected answer %+v", answer)
+	}
+	if ip := net.IP(answer.Peers6[:16]); !ip.Equal(net.ParseIP("2001:db8::2")) || binary.BigEndian.Uint16([]byte(answer.Peers6[16:18])) != 6883 {
+		t.Errorf("Expected [2001:db8::2]:6883, got %x", answer.Peers6)
+	}
+	if !strings.Contains(answer.Peers, string(net.ParseIP("192.0.2.100").To4())+"\x1e\x61") {
+		t.Errorf("Expected our own address in %x", answer.Peers)
+	}
+
+	if _, failure := get(strings.Repeat("x", 20)); failure.FailureReason != errUnknownTorrent.Error() {
+		t.Errorf("Expected unknown torrents to fail, got %+v", failure)
+	}
+}
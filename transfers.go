@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rakoo/rakoshare/pkg/sharesession"
+	"github.com/zeebo/bencode"
+)
+
+// The setting where the bytes transferred over the life of the share are
+// kept, so that they survive restarts
+const settingTransfers = "transfers"
+
+// How many of the last revisions keep their own transfer statistics
+const transferRevisions = 20
+
+// How often the transfer statistics are saved while the share runs
+const transfersSaveInterval = time.Minute
+
+// TransferStats counts the bytes exchanged with peers.
+type TransferStats struct {
+	Uploaded   int64 `bencode:"uploaded" json:"uploaded"`
+	Downloaded int64 `bencode:"downloaded" json:"downloaded"`
+}
+
+// RevisionTransfers counts the bytes exchanged for the data torrent of a
+// revision.
+type RevisionTransfers struct {
+	InfoHash   string `bencode:"infohash" json:"infohash"`
+	Uploaded   int64  `bencode:"uploaded" json:"uploaded"`
+	Downloaded int64  `bencode:"downloaded" json:"downloaded"`
+}
+
+// transferRecord is what is kept of the transfers of a share.
+type transferRecord struct {
+	Lifetime TransferStats `bencode:"lifetime"`
+
+	// Oldest first
+	Revisions []RevisionTransfers `bencode:"revisions"`
+}
+
+// transferTotals counts the bytes transferred by the data torrents of a
+// share since it was created, in total and for each of its last
+// revisions. It is safe for concurrent use.
+type transferTotals struct {
+	sync.Mutex
+	record transferRecord
+}
+
+func loadTransferTotals(session *sharesession.Session) *transferTotals {
+	t := new(transferTotals)
+	if raw := session.GetSetting(settingTransfers); raw != "" {
+		bencode.NewDecoder(strings.NewReader(raw)).Decode(&t.record)
+	}
+	return t
+}
+
+// add counts bytes transferred for the torrent with infohash ih. Nothing
+// is counted without totals.
+func (t *transferTotals) add(ih string, uploaded, downloaded int64) {
+	if t == nil {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	t.record.Lifetime.Uploaded += uploaded
+	t.record.Lifetime.Downloaded += downloaded
+
+	// The revision becomes the last one, even if it was transferred before
+	revs := t.record.Revisions
+	r := RevisionTransfers{InfoHash: ih}
+	for i := range revs {
+		if revs[i].InfoHash == ih {
+			r = revs[i]
+			revs = append(revs[:i], revs[i+1:]...)
+			break
+		}
+	}
+	r.Uploaded += uploaded
+	r.Downloaded += downloaded
+	revs = append(revs, r)
+	if len(revs) > transferRevisions {
+		revs = revs[len(revs)-transferRevisions:]
+	}
+	t.record.Revisions = revs
+}
+
+// stats returns the lifetime totals, and those of the last revisions
+// with hex infohashes, newest first.
+func (t *transferTotals) stats() (lifetime TransferStats, revisions []RevisionTransfers) {
+	t.Lock()
+	defer t.Unlock()
+	for i := len(t.record.Revisions) - 1; i >= 0; i-- {
+		r := t.record.Revisions[i]
+		r.InfoHash = fmt.Sprintf("%x", r.InfoHash)
+		revisions = append(revisions, r)
+	}
+	return t.record.Lifetime, revisions
+}
+
+func (t *transferTotals) save(session *sharesession.Session) error {
+	t.Lock()
+	var buf bytes.Buffer
+	err := bencode.NewEncoder(&buf).Encode(t.record)
+	t.Unlock()
+	if err != nil {
+		return err
+	}
+	return session.SetSetting(settingTransfers, buf.String())
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestTransferTotals(t *testing.T) {
+	var none *transferTotals
+	none.add("a", 1, 1)
+
+	totals := new(transferTotals)
+	totals.add("a", 10, 0)
+	totals.add("b", 0, 5)
+	totals.add("a", 1, 2)
+
+	lifetime, revisions := totals.stats()
+	if lifetime != (TransferStats{Uploaded: 11, Downloaded: 7}) {
+		t.Errorf("Unexpected lifetime totals %+v", lifetime)
+	}
+	want := []RevisionTransfers{
+		{InfoHash: fmt.Sprintf("%x", "a"), Uploaded: 11, Downloaded: 2},
+		{InfoHash: fmt.Sprintf("%x", "b"), Downloaded: 5},
+	}
+	if fmt.Sprint(revisions) != fmt.Sprint(want) {
+		t.Errorf("Expected %v, got %v", want, revisions)
+	}
+
+	for i := 0; i < transferRevisions; i++ {
+		totals.add(fmt.Sprint(i), 1, 0)
+	}
+	lifetime, revisions = totals.stats()
+	if len(revisions) != transferRevisions || lifetime.Uploaded != 11+transferRevisions {
+		t.Errorf("Expected the last %d revisions only, got %d", transferRevisions, len(revisions))
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net"
+)
+
+// trustedPeers are the peers a share is configured to always connect to.
+// They are dialed at startup and don't count against MaxPeers; in
+// trusted-only mode, they are the only peers accepted. A nil
+// *trustedPeers trusts nobody and accepts everybody.
+type trustedPeers struct {
+	// The hosts of all entries: peers connect to us from any port, even
+	// those we know the listening port of
+	hosts map[string]bool
+
+	// The entries with a port, which we dial
+	addrs map[string]bool
+	only  bool
+}
+
+func newTrustedPeers(cfg ShareConfig) *trustedPeers {
+	tp := &trustedPeers{
+		hosts: make(map[string]bool),
+		addrs: make(map[string]bool),
+		only:  cfg.TrustedOnly,
+	}
+	for _, entry := range cfg.Trusted {
+		if host, port, err := net.SplitHostPort(entry); err == nil {
+			tp.addrs[net.JoinHostPort(normalizeHost(host), port)] = true
+			tp.hosts[normalizeHost(host)] = true
+		} else {
+			tp.hosts[normalizeHost(entry)] = true
+		}
+	}
+	return tp
+}
+
+// normalizeHost writes IP addresses the way net does, so that entries
+// match the addresses of connections.
+func normalizeHost(host string) string {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+	return host
+}
+
+// isTrusted tells whether the peer at addr is one of the trusted ones.
+func (tp *trustedPeers) isTrusted(addr string) bool {
+	if tp == nil {
+		return false
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return tp.hosts[normalizeHost(host)]
+}
+
+// allows tells whether we may connect with the peer at addr.
+func (tp *trustedPeers) allows(addr string) bool {
+	return tp == nil || !tp.only || tp.isTrusted(addr)
+}
+
+// dialable returns the trusted peers we know the port of.
+func (tp *trustedPeers) dialable() (peers []string) {
+	if tp == nil {
+		return nil
+	}
+	for addr := range tp.addrs {
+		peers = append(peers, addr)
+	}
+	return
+}
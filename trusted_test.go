@@ -0,0 +1,49 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTrustedPeers(t *testing.T) {
+	tp := newTrustedPeers(ShareConfig{Trusted: []string{"10.0.0.1:6881", "nas.local", "::1"}})
+	for addr, expected := range map[string]bool{
+		"10.0.0.1:6881":  true,
+		"10.0.0.1:7000":  true, // connecting from another port
+		"nas.local:1234": true,
+		"[::1]:6881":     true,
+		"10.0.0.2:6881":  false,
+	} {
+		if tp.isTrusted(addr) != expected {
+			t.Errorf("%s: expected trusted to be %v", addr, expected)
+		}
+		if !tp.allows(addr) {
+			t.Errorf("%s: expected all peers to be allowed", addr)
+		}
+	}
+	if d := tp.dialable(); !reflect.DeepEqual(d, []string{"10.0.0.1:6881"}) {
+		t.Errorf("Expected only peers with a port to be dialed, got %v", d)
+	}
+
+	tp.only = true
+	if tp.allows("10.0.0.2:6881") {
+		t.Error("Expected untrusted peers to be refused in trusted-only mode")
+	}
+	if !tp.allows("10.0.0.1:6881") {
+		t.Error("Expected trusted peers to be allowed in trusted-only mode")
+	}
+
+	var none *trustedPeers
+	if none.isTrusted("10.0.0.1:6881") || !none.allows("10.0.0.1:6881") {
+		t.Error("Expected no list to trust nobody and allow everybody")
+	}
+}
+
+func TestShareConfigMergeTrusted(t *testing.T) {
+	profile := ShareConfig{Trusted: []string{"10.0.0.1:6881"}}
+	share := ShareConfig{Trusted: []string{"10.0.0.2:6881"}, TrustedOnly: true}
+	merged := profile.merge(share)
+	if !reflect.DeepEqual(merged.Trusted, []string{"10.0.0.1:6881", "10.0.0.2:6881"}) || !merged.TrustedOnly {
+		t.Errorf("Unexpected merged trusted peers: %+v", merged)
+	}
+}
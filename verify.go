@@ -0,0 +1,109 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var verifyWorkers = flag.Int("verifyWorkers", runtime.NumCPU(), "Number of goroutines checking the pieces of a share on disk when it starts")
+
+// How many pieces are read ahead of the workers checking them
+const verifyReadAhead = 4
+
+// VerifyProgress tells how far the check of the pieces on disk went.
+type VerifyProgress struct {
+	Checked int64 `json:"checked"`
+	Total   int64 `json:"total"`
+}
+
+// get returns the progress of the running check, if any. Fields are
+// updated atomically while the check runs.
+func (v *VerifyProgress) get() (p VerifyProgress, ok bool) {
+	if v == nil {
+		return p, false
+	}
+	p.Total = atomic.LoadInt64(&v.Total)
+	p.Checked = atomic.LoadInt64(&v.Checked)
+	return p, p.Total > 0
+}
+
+func (v *VerifyProgress) start(total int) {
+	if v != nil {
+		atomic.StoreInt64(&v.Checked, 0)
+		atomic.StoreInt64(&v.Total, int64(total))
+	}
+}
+
+func (v *VerifyProgress) checked() {
+	if v != nil {
+		atomic.AddInt64(&v.Checked, 1)
+	}
+}
+
+func (v *VerifyProgress) done() {
+	if v != nil {
+		atomic.StoreInt64(&v.Total, 0)
+	}
+}
+
+// hashPieces reads the pieces of fs one after the other and hands them to
+// verifyWorkers goroutines calling fn, so that disks are read sequentially
+// while all cores hash. fn is called concurrently, and data is only valid
+// until it returns. Read errors are ignored: the piece just won't match.
+// The progress of the check is reported to progress, if not nil.
+func hashPieces(fs FileStore, totalLength, pieceLength int64, progress *VerifyProgress, fn func(piece int, data []byte)) {
+	numPieces := int((totalLength + pieceLength - 1) / pieceLength)
+	progress.start(numPieces)
+	defer progress.done()
+	var checked int64
+
+	workers := *verifyWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	jobs := make(chan chunk, verifyReadAhead)
+	free := make(chan []byte, workers+verifyReadAhead)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range jobs {
+				fn(int(c.i), c.data)
+				atomic.AddInt64(&checked, 1)
+				progress.checked()
+				free <- c.data
+			}
+		}()
+	}
+
+	buffers := 0
+	reported := time.Now()
+	for i := 0; i < numPieces; i++ {
+		var buf []byte
+		select {
+		case buf = <-free:
+		default:
+			if buffers < cap(free) {
+				buffers++
+				buf = make([]byte, pieceLength)
+			} else {
+				buf = <-free
+			}
+		}
+		data := buf[:pieceSize(totalLength, pieceLength, i)]
+		fs.ReadAt(data, int64(i)*pieceLength)
+		jobs <- chunk{i: int64(i), data: data}
+
+		if time.Since(reported) >= hashProgressInterval {
+			reported = time.Now()
+			log.Printf("[VERIFY] %d of %d pieces checked\n", atomic.LoadInt64(&checked), numPieces)
+		}
+	}
+	close(jobs)
+	wg.Wait()
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestHashPieces(t *testing.T) {
+	defer func(ram bool, n int) { *ramMode, *verifyWorkers = ram, n }(*ramMode, *verifyWorkers)
+	*ramMode = true
+	*verifyWorkers = 3
+	info := &InfoDict{PieceLength: 4, Length: 42}
+	store, size, err := openStore(info, "/nonexistent", storeOptions{storage: storageFiles})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOP")
+	store.WriteAt(data, 0)
+
+	var mu sync.Mutex
+	seen := make(map[int]string)
+	var progress VerifyProgress
+	hashPieces(store, size, info.PieceLength, &progress, func(piece int, data []byte) {
+		if _, ok := progress.get(); !ok {
+			t.Error("Expected the check to be reported while it runs")
+		}
+		mu.Lock()
+		seen[piece] = string(data)
+		mu.Unlock()
+	})
+	if len(seen) != 11 {
+		t.Fatalf("Expected 11 pieces, got %d", len(seen))
+	}
+	for i, piece := range seen {
+		end := (i + 1) * 4
+		if end > len(data) {
+			end = len(data)
+		}
+		if piece != string(data[i*4:end]) {
+			t.Errorf("Piece %d: expected %q, got %q", i, data[i*4:end], piece)
+		}
+	}
+	if p, ok := progress.get(); ok {
+		t.Errorf("Expected no check to be reported once done, got %+v", p)
+	}
+}
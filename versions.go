@@ -0,0 +1,82 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var keepVersions = flag.Duration("keepVersions", 30*24*time.Hour, "How long copies of the files that syncs overwrite or delete are kept, in .rakoshare/versions in the share. 0 not to keep them")
+
+// The directory of a share where rakoshare keeps its own files. It is
+// never shared.
+const rakoshareDir = ".rakoshare"
+
+// versionStamp names the directories of versions, by when they were made.
+const versionStamp = "20060102-150405"
+
+// versionKeeper moves the files of a share that syncs would overwrite or
+// delete to .rakoshare/versions/<timestamp>/ in the share, where they
+// stay for the retention period. A nil versionKeeper keeps nothing.
+type versionKeeper struct {
+	root      string
+	retention time.Duration
+}
+
+func newVersionKeeper(root string, retention time.Duration) *versionKeeper {
+	if retention <= 0 {
+		return nil
+	}
+	return &versionKeeper{root: root, retention: retention}
+}
+
+func (v *versionKeeper) dir() string {
+	return filepath.Join(v.root, rakoshareDir, "versions")
+}
+
+// keep moves full, a file of the share, to the versions of now. It
+// returns false if there was nothing to keep.
+func (v *versionKeeper) keep(full string, now time.Time) (kept bool, err error) {
+	if v == nil {
+		return false, nil
+	}
+	if _, err := os.Stat(full); os.IsNotExist(err) {
+		return false, nil
+	}
+	rel, err := filepath.Rel(v.root, full)
+	if err != nil {
+		return false, err
+	}
+	dest := filepath.Join(v.dir(), now.UTC().Format(versionStamp), rel)
+	if err = ensureDirectory(dest); err != nil {
+		return false, err
+	}
+	openFiles.invalidate(full)
+	if err = os.Rename(full, dest); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// prune removes the versions older than the retention period.
+func (v *versionKeeper) prune(now time.Time) {
+	if v == nil {
+		return
+	}
+	dirs, err := ioutil.ReadDir(v.dir())
+	if err != nil {
+		return
+	}
+	for _, d := range dirs {
+		made, err := time.ParseInLocation(versionStamp, d.Name(), time.UTC)
+		if err != nil || now.Sub(made) < v.retention {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(v.dir(), d.Name())); err != nil {
+			log.Printf("Couldn't remove old versions %s: %s", d.Name(), err)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestVersionKeeper(t *testing.T) {
+	dir, err := ioutil.TempDir("", "versions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	name := filepath.Join(dir, "sub", "a")
+	ioutil.WriteFile(name, []byte("old"), 0600)
+
+	v := newVersionKeeper(dir, time.Hour)
+	now := time.Date(2015, 3, 14, 15, 9, 26, 0, time.UTC)
+	if kept, err := v.keep(name, now); !kept || err != nil {
+		t.Fatalf("Expected the file to be kept, got %v, %v", kept, err)
+	}
+	kept := filepath.Join(dir, rakoshareDir, "versions", "20150314-150926", "sub", "a")
+	if data, err := ioutil.ReadFile(kept); err != nil || string(data) != "old" {
+		t.Errorf("Expected the old version in %s, got %q, %v", kept, data, err)
+	}
+	if kept, err := v.keep(name, now); kept || err != nil {
+		t.Errorf("Expected nothing to keep for a missing file, got %v, %v", kept, err)
+	}
+
+	// Kept files aren't shared
+	torrentWalk(dir, nil, func(path string, info os.FileInfo, perr error) error {
+		t.Errorf("Expected no file to share, got %s", path)
+		return nil
+	})
+
+	v.prune(now.Add(30 * time.Minute))
+	if _, err := os.Stat(kept); err != nil {
+		t.Error("Expected recent versions to stay")
+	}
+	v.prune(now.Add(2 * time.Hour))
+	if _, err := os.Stat(kept); !os.IsNotExist(err) {
+		t.Error("Expected old versions to be removed")
+	}
+}
+
+func TestFileStoreCleanupKeepsVersions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "versions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "a")
+	ioutil.WriteFile(name, []byte("old"), 0600)
+	ioutil.WriteFile(name+".part", []byte("new"), 0600)
+
+	fs := &fileStore{[]int64{0}, []fileEntry{{3, name + ".part", false, nil}}, 3, newVersionKeeper(dir, time.Hour)}
+	if err := fs.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(name); string(data) != "new" {
+		t.Errorf("Expected the new version in place, got %q", data)
+	}
+	kept, _ := filepath.Glob(filepath.Join(dir, rakoshareDir, "versions", "*", "a"))
+	if len(kept) != 1 {
+		t.Fatalf("Expected the old version to be kept, got %v", kept)
+	}
+	if data, _ := ioutil.ReadFile(kept[0]); string(data) != "old" {
+		t.Errorf("Expected the old version, got %q", data)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strings"
+	"syscall"
+)
+
+// readXattrs returns the user extended attributes of the file at path.
+func readXattrs(path string) map[string]string {
+	size, err := syscall.Listxattr(path, nil)
+	if err != nil || size == 0 {
+		return nil
+	}
+	list := make([]byte, size)
+	if size, err = syscall.Listxattr(path, list); err != nil {
+		return nil
+	}
+
+	var xattrs map[string]string
+	for _, name := range strings.Split(string(list[:size]), "\x00") {
+		if !strings.HasPrefix(name, "user.") {
+			continue
+		}
+		n, err := syscall.Getxattr(path, name, nil)
+		if err != nil {
+			continue
+		}
+		value := make([]byte, n)
+		if n, err = syscall.Getxattr(path, name, value); err != nil {
+			continue
+		}
+		if xattrs == nil {
+			xattrs = make(map[string]string)
+		}
+		xattrs[name] = string(value[:n])
+	}
+	return xattrs
+}
+
+func writeXattr(path, name, value string) error {
+	return syscall.Setxattr(path, name, []byte(value), 0)
+}
@@ -0,0 +1,12 @@
+// +build !linux
+
+package main
+
+// Extended attributes are only carried on Linux.
+func readXattrs(path string) map[string]string {
+	return nil
+}
+
+func writeXattr(path, name, value string) error {
+	return nil
+}